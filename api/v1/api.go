@@ -13,9 +13,14 @@
 package v1
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -57,6 +62,22 @@ func (e *apiError) Error() string {
 	return fmt.Sprintf("%s: %s", e.typ, e.err)
 }
 
+// ageSegment and statsSegment are the last path components of the URLs to
+// query the age and the statistics of a group, respectively, e.g.
+// /api/v1/groups/job/foo/instance/bar/age.
+const (
+	ageSegment   = "age"
+	statsSegment = "stats"
+)
+
+// defaultGroupsLimit is the maximum number of groups returned by the groups
+// endpoint if no limit is requested.
+const defaultGroupsLimit = 1000
+
+// retryAfter is the value of the Retry-After header (in seconds) sent if a
+// request could not be processed because the write queue is full.
+const retryAfter = "5"
+
 var corsHeaders = map[string]string{
 	"Access-Control-Allow-Headers":  "Accept, Authorization, Content-Type, Origin",
 	"Access-Control-Allow-Methods":  "GET, POST, DELETE, OPTIONS",
@@ -79,6 +100,20 @@ type API struct {
 	Flags       map[string]string
 	StartTime   time.Time
 	BuildInfo   map[string]string
+	// StatusReporter provides the state of the metric store reported by
+	// the status endpoint. If nil, the state is not reported.
+	StatusReporter storage.StatusReporter
+	// ParsePush decodes and checks a push with the provided grouping
+	// labels and replace semantics like the push handlers do, see
+	// handler.ParsePush. It is used by the validate endpoint, which
+	// responds with an error if ParsePush is nil.
+	ParsePush func(r *http.Request, labels map[string]string, replace bool) (storage.WriteRequest, error)
+	// Validator checks pushes validated by the validate endpoint against
+	// the stored metrics. If nil, that check is skipped.
+	Validator storage.ValidatingMetricStore
+	// Quarantine holds the rejected pushes listed by the rejected
+	// endpoint, which responds with an error if Quarantine is nil.
+	Quarantine *handler.Quarantine
 }
 
 // New returns a new API. The log.Logger can be nil, in which case no logging is performed.
@@ -118,22 +153,188 @@ func (api *API) Register(r *route.Router) {
 
 	r.Get("/status", wrap("api/v1/status", api.status))
 	r.Get("/metrics", wrap("api/v1/metrics", api.metrics))
+	r.Post("/flush", wrap("api/v1/flush", api.flush))
+	r.Post("/validate", wrap("api/v1/validate", api.validate))
+	r.Post("/validate/*grouping", wrap("api/v1/validate", api.validate))
+	r.Get("/healthy", wrap("api/v1/healthy", api.healthy))
+	r.Get("/ready", wrap("api/v1/ready", api.ready))
+	r.Get("/groups", wrap("api/v1/groups", api.groups))
+	groupAge := wrap("api/v1/groups/age", api.groupAge)
+	groupStats := wrap("api/v1/groups/stats", api.groupStats)
+	r.Get("/groups/*grouping", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(route.Param(r.Context(), "grouping"), "/"+statsSegment) {
+			groupStats(w, r)
+			return
+		}
+		groupAge(w, r)
+	})
+	r.Get("/rejected", wrap("api/v1/rejected", api.rejected))
+}
+
+// rejected lists the rejected pushes kept in the Quarantine, the most recent
+// first.
+func (api *API) rejected(w http.ResponseWriter, r *http.Request) {
+	if api.Quarantine == nil {
+		api.respondError(w, apiError{
+			typ: errorUnavailable,
+			err: errors.New("the quarantine for rejected pushes is disabled"),
+		}, nil)
+		return
+	}
+	api.respond(w, api.Quarantine.Pushes())
+}
+
+// group is the JSON representation of a metric group returned by the groups
+// endpoint. Times that have not occurred yet are null, and so is the remaining
+// TTL of a group that does not expire, the expected push interval of a group
+// without one, and the push format and the error of the last failed push if
+// unknown.
+type group struct {
+	Labels              map[string]string `json:"labels"`
+	MetricNames         []string          `json:"metric_names"`
+	LastPushSuccessful  bool              `json:"last_push_successful"`
+	LastPushTime        *time.Time        `json:"last_push_time"`
+	LastPushFailureTime *time.Time        `json:"last_push_failure_time"`
+	LastPushError       *string           `json:"last_push_error"`
+	TTLRemaining        *float64          `json:"ttl_remaining_seconds"`
+	ExpectedInterval    *float64          `json:"expected_push_interval_seconds"`
+	Overdue             bool              `json:"push_overdue"`
+	PushFormat          *pushFormat       `json:"push_format"`
+	Locked              bool              `json:"locked"`
+}
+
+// pushFormat is the JSON representation of a storage.PushFormat.
+type pushFormat struct {
+	ContentType     string `json:"content_type"`
+	ContentEncoding string `json:"content_encoding"`
+	Format          string `json:"format"`
+}
+
+// newPushFormat returns the JSON representation of pf, or nil if pf is zero.
+func newPushFormat(pf storage.PushFormat) *pushFormat {
+	if pf == (storage.PushFormat{}) {
+		return nil
+	}
+	return &pushFormat{
+		ContentType:     pf.ContentType,
+		ContentEncoding: pf.ContentEncoding,
+		Format:          string(pf.Format),
+	}
+}
+
+// groupsPage is a page of groups returned by the groups endpoint. Continue is
+// the token to request the next page with, empty on the last page.
+type groupsPage struct {
+	Groups   []group `json:"groups"`
+	Continue string  `json:"continue,omitempty"`
+}
+
+// groups lists the metric groups ordered by their grouping key, at most as many
+// as the "limit" query parameter (or defaultGroupsLimit) allows. The following
+// page is requested with the token from the response in the "continue" query
+// parameter. As the token identifies the last group of the page, paginating is
+// stable while groups are added or removed: No group is listed twice, and
+// every group that exists during the whole pagination is listed exactly once.
+func (api *API) groups(w http.ResponseWriter, r *http.Request) {
+	limit := defaultGroupsLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l <= 0 {
+			api.respondError(w, apiError{
+				typ: errorBadData,
+				err: fmt.Errorf("invalid limit %q, must be a positive integer", s),
+			}, nil)
+			return
+		}
+		limit = l
+	}
+	after, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("continue"))
+	if err != nil {
+		api.respondError(w, apiError{
+			typ: errorBadData,
+			err: fmt.Errorf("invalid continue token: %v", err),
+		}, nil)
+		return
+	}
+
+	groups := api.MetricStore.GetMetricFamiliesMap()
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		if k > string(after) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	page := groupsPage{Groups: []group{}}
+	if len(keys) > limit {
+		keys = keys[:limit]
+		page.Continue = base64.RawURLEncoding.EncodeToString([]byte(keys[limit-1]))
+	}
+	now := time.Now()
+	for _, k := range keys {
+		mg := groups[k]
+		g := group{
+			Labels:             mg.Labels,
+			MetricNames:        mg.MetricNames(),
+			LastPushSuccessful: mg.LastPushSuccess(),
+			Overdue:            mg.Overdue(now),
+			PushFormat:         newPushFormat(mg.PushFormat),
+			Locked:             mg.Locked,
+		}
+		if mg.ExpectedInterval > 0 {
+			interval := mg.ExpectedInterval.Seconds()
+			g.ExpectedInterval = &interval
+		}
+		if t := mg.LastPushTime(); !t.IsZero() {
+			g.LastPushTime = &t
+		}
+		if t := mg.LastPushFailureTime(); !t.IsZero() {
+			g.LastPushFailureTime = &t
+		}
+		if mg.LastPushError != "" {
+			g.LastPushError = &mg.LastPushError
+		}
+		if exp := mg.Expiration(); !exp.IsZero() {
+			remaining := exp.Sub(now).Seconds()
+			if remaining < 0 {
+				remaining = 0
+			}
+			g.TTLRemaining = &remaining
+		}
+		page.Groups = append(page.Groups, g)
+	}
+	api.respond(w, page)
 }
 
 type metrics struct {
-	Timestamp time.Time         `json:"time_stamp"`
-	Type      string            `json:"type"`
-	Help      string            `json:"help,omitempty"`
-	Metrics   []encodableMetric `json:"metrics"`
+	Timestamp    time.Time         `json:"time_stamp"`
+	Type         string            `json:"type"`
+	Help         string            `json:"help,omitempty"`
+	TTLRemaining *float64          `json:"ttl_remaining_seconds,omitempty"`
+	Metrics      []encodableMetric `json:"metrics"`
 }
 
 func (api *API) metrics(w http.ResponseWriter, r *http.Request) {
 	familyMaps := api.MetricStore.GetMetricFamiliesMap()
+	now := time.Now()
 	res := []interface{}{}
 	for _, v := range familyMaps {
 		metricResponse := map[string]interface{}{}
 		metricResponse["labels"] = v.Labels
 		metricResponse["last_push_successful"] = v.LastPushSuccess()
+		metricResponse["locked"] = v.Locked
+		if len(v.Annotations) > 0 {
+			metricResponse["annotations"] = v.Annotations
+		}
+		if v.PayloadHash != "" {
+			metricResponse["payload_hash"] = v.PayloadHash
+		}
+		if v.LastPushError != "" {
+			metricResponse["last_push_error"] = v.LastPushError
+		}
+		if pf := newPushFormat(v.PushFormat); pf != nil {
+			metricResponse["push_format"] = pf
+		}
 		for name, metricValues := range v.Metrics {
 			metricFamily := metricValues.GetMetricFamily()
 			uniqueMetrics := metrics{
@@ -142,6 +343,13 @@ func (api *API) metrics(w http.ResponseWriter, r *http.Request) {
 				Timestamp: metricValues.Timestamp,
 				Metrics:   makeEncodableMetrics(metricFamily.GetMetric(), metricFamily.GetType()),
 			}
+			if exp := metricValues.Expiration(); !exp.IsZero() {
+				remaining := exp.Sub(now).Seconds()
+				if remaining < 0 {
+					remaining = 0
+				}
+				uniqueMetrics.TTLRemaining = &remaining
+			}
 			metricResponse[name] = uniqueMetrics
 		}
 		res = append(res, metricResponse)
@@ -150,15 +358,277 @@ func (api *API) metrics(w http.ResponseWriter, r *http.Request) {
 	api.respond(w, res)
 }
 
+// flush persists the metric store and responds once that is done, i.e. after
+// all write requests submitted before have been processed, too.
+func (api *API) flush(w http.ResponseWriter, r *http.Request) {
+	errCh := make(chan error, 1)
+	if err := api.MetricStore.SubmitWriteRequest(storage.WriteRequest{
+		Timestamp: time.Now(),
+		Flush:     true,
+		Done:      errCh,
+	}); err != nil {
+		w.Header().Set("Retry-After", retryAfter)
+		api.respondError(w, apiError{
+			typ: errorUnavailable,
+			err: err,
+		}, nil)
+		return
+	}
+	for err := range errCh {
+		api.respondError(w, apiError{
+			typ: errorInternal,
+			err: err,
+		}, nil)
+		return
+	}
+	api.respond(w, nil)
+}
+
+// validate decodes and checks the pushed metrics in the request body as a push
+// to the group identified by the optional "grouping" route parameter would,
+// including the checks against the stored metrics if a job is given, but
+// without storing anything. The "method" query parameter selects PUT or POST
+// (the default) semantics.
+func (api *API) validate(w http.ResponseWriter, r *http.Request) {
+	if api.ParsePush == nil {
+		api.respondError(w, apiError{
+			typ: errorUnavailable,
+			err: errors.New("validation is not available"),
+		}, nil)
+		return
+	}
+	var replace bool
+	switch method := strings.ToUpper(r.URL.Query().Get("method")); method {
+	case "", http.MethodPost:
+	case http.MethodPut:
+		replace = true
+	default:
+		api.respondError(w, apiError{
+			typ: errorBadData,
+			err: fmt.Errorf("unsupported method %q, must be PUT or POST", method),
+		}, nil)
+		return
+	}
+	labels, err := handler.ParseGroupingPath(route.Param(r.Context(), "grouping"))
+	if err != nil {
+		api.respondError(w, apiError{
+			typ: errorBadData,
+			err: err,
+		}, nil)
+		return
+	}
+
+	res := map[string]interface{}{
+		"labels":              labels,
+		"consistency_checked": false,
+	}
+	wr, err := api.ParsePush(r, labels, replace)
+	if err != nil {
+		api.respondError(w, apiError{
+			typ: errorBadData,
+			err: err,
+		}, res)
+		return
+	}
+	families := make([]map[string]interface{}, 0, len(wr.MetricFamilies))
+	for name, mf := range wr.MetricFamilies {
+		families = append(families, map[string]interface{}{
+			"name":    name,
+			"type":    mf.GetType().String(),
+			"samples": storage.NumSamples(mf),
+		})
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i]["name"].(string) < families[j]["name"].(string)
+	})
+	res["metric_families"] = families
+	res["payload_hash"] = wr.PayloadHash
+	if api.Validator != nil && labels["job"] != "" {
+		res["consistency_checked"] = true
+		if err := api.Validator.ValidateWriteRequest(wr); err != nil {
+			api.respondError(w, apiError{
+				typ: errorBadData,
+				err: err,
+			}, res)
+			return
+		}
+	}
+	api.respond(w, res)
+}
+
+// healthy reports whether the metric store is healthy, see
+// storage.MetricStore.Healthy.
+func (api *API) healthy(w http.ResponseWriter, r *http.Request) {
+	if err := api.MetricStore.Healthy(); err != nil {
+		api.respondError(w, apiError{
+			typ: errorUnavailable,
+			err: err,
+		}, nil)
+		return
+	}
+	api.respond(w, nil)
+}
+
+// ready reports whether the metric store is ready, see
+// storage.MetricStore.Ready.
+func (api *API) ready(w http.ResponseWriter, r *http.Request) {
+	if err := api.MetricStore.Ready(); err != nil {
+		api.respondError(w, apiError{
+			typ: errorUnavailable,
+			err: err,
+		}, nil)
+		return
+	}
+	api.respond(w, nil)
+}
+
+// groupAge reports the time since the last successful push to the group
+// identified by the "grouping" route parameter, which contains the grouping
+// labels in the same form as the push URL followed by ageSegment.
+func (api *API) groupAge(w http.ResponseWriter, r *http.Request) {
+	group, ok := api.findGroup(w, r, ageSegment)
+	if !ok {
+		return
+	}
+	res := map[string]interface{}{
+		"labels":               group.Labels,
+		"last_push_successful": group.LastPushSuccess(),
+		"last_push_time":       nil,
+		"age_seconds":          nil,
+	}
+	if t := group.LastPushTime(); !t.IsZero() {
+		res["last_push_time"] = t
+		res["age_seconds"] = time.Since(t).Seconds()
+	}
+	api.respond(w, res)
+}
+
+// groupStats reports the statistics of the group identified by the "grouping"
+// route parameter, which contains the grouping labels in the same form as the
+// push URL followed by statsSegment. Pushes are only counted since the start-up,
+// see storage.MetricGroup.
+func (api *API) groupStats(w http.ResponseWriter, r *http.Request) {
+	group, ok := api.findGroup(w, r, statsSegment)
+	if !ok {
+		return
+	}
+	res := map[string]interface{}{
+		"labels":                     group.Labels,
+		"metric_families":            group.NumMetricFamilies(),
+		"samples":                    group.NumSamples(),
+		"size_bytes":                 group.SizeBytes(),
+		"last_push_size_bytes":       group.LastPushSize,
+		"last_push_duration_seconds": nil,
+		"pushes_total":               group.Pushes,
+		"pushes_today":               group.PushesToday(time.Now()),
+		"failed_pushes_total":        group.FailedPushes,
+		"last_push_error":            nil,
+	}
+	if group.LastPushError != "" {
+		res["last_push_error"] = group.LastPushError
+	}
+	if group.LastPushDuration > 0 {
+		res["last_push_duration_seconds"] = group.LastPushDuration.Seconds()
+	}
+	api.respond(w, res)
+}
+
+// findGroup returns the group identified by the "grouping" route parameter,
+// which contains the grouping labels in the same form as the push URL followed
+// by the provided segment. If there is no such group, or if the route parameter
+// is invalid, an error is responded and false is returned.
+func (api *API) findGroup(w http.ResponseWriter, r *http.Request, segment string) (storage.MetricGroup, bool) {
+	grouping := route.Param(r.Context(), "grouping")
+	labelsString := strings.TrimSuffix(grouping, "/"+segment)
+	if labelsString == grouping {
+		http.NotFound(w, r)
+		return storage.MetricGroup{}, false
+	}
+	labels, err := handler.ParseGroupingPath(labelsString)
+	if err == nil && labels["job"] == "" {
+		err = errors.New("job name is required")
+	}
+	if err != nil {
+		api.respondError(w, apiError{
+			typ: errorBadData,
+			err: err,
+		}, nil)
+		return storage.MetricGroup{}, false
+	}
+	for _, group := range api.MetricStore.GetMetricFamiliesMap() {
+		if equalLabels(group.Labels, labels) {
+			return group, true
+		}
+	}
+	api.respondError(w, apiError{
+		typ: errorNotFound,
+		err: storage.ErrGroupNotFound,
+	}, nil)
+	return storage.MetricGroup{}, false
+}
+
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ln, lv := range a {
+		if v, ok := b[ln]; !ok || v != lv {
+			return false
+		}
+	}
+	return true
+}
+
 func (api *API) status(w http.ResponseWriter, r *http.Request) {
 	res := map[string]interface{}{}
 	res["flags"] = api.Flags
 	res["start_time"] = api.StartTime
 	res["build_information"] = api.BuildInfo
+	if api.StatusReporter != nil {
+		res["store"] = storeStatus(api.StatusReporter.Status())
+	}
 
 	api.respond(w, res)
 }
 
+// storeStatus returns the JSON representation of the provided StoreStatus.
+// Times that have not occurred yet are null.
+func storeStatus(s storage.StoreStatus) map[string]interface{} {
+	res := map[string]interface{}{
+		"write_queue_length":   s.WriteQueueLength,
+		"write_queue_capacity": s.WriteQueueCapacity,
+		"metric_groups":        s.Groups,
+		"metric_families":      s.MetricFamilies,
+		"samples":              s.Samples,
+		"memory_only":          !s.Persisting,
+		"persistence":          nil,
+	}
+	if !s.Persisting {
+		return res
+	}
+	persistence := map[string]interface{}{
+		"last_time":             nil,
+		"last_duration_seconds": s.LastPersistDuration.Seconds(),
+		"last_error":            nil,
+		"last_success_time":     nil,
+		"file_size_bytes":       nil,
+	}
+	if !s.LastPersistTime.IsZero() {
+		persistence["last_time"] = s.LastPersistTime
+	}
+	if s.LastPersistError != nil {
+		persistence["last_error"] = s.LastPersistError.Error()
+	}
+	if !s.LastPersistSuccessTime.IsZero() {
+		persistence["last_success_time"] = s.LastPersistSuccessTime
+	}
+	if s.PersistenceSize >= 0 {
+		persistence["file_size_bytes"] = s.PersistenceSize
+	}
+	res["persistence"] = persistence
+	return res
+}
+
 type response struct {
 	Status    status      `json:"status"`
 	Data      interface{} `json:"data,omitempty"`
@@ -195,6 +665,10 @@ func (api *API) respondError(w http.ResponseWriter, apiErr apiError, data interf
 		w.WriteHeader(http.StatusBadRequest)
 	case errorInternal:
 		w.WriteHeader(http.StatusInternalServerError)
+	case errorUnavailable:
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case errorNotFound:
+		w.WriteHeader(http.StatusNotFound)
 	default:
 		panic(fmt.Sprintf("unknown error type %q", apiErr.Error()))
 	}
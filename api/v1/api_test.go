@@ -15,8 +15,11 @@ package v1
 import (
 	"bytes"
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"reflect"
 	"testing"
 	"time"
@@ -24,9 +27,11 @@ import (
 	"github.com/go-kit/kit/log"
 	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/route"
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/handler"
 	"github.com/prometheus/pushgateway/storage"
 	"github.com/prometheus/pushgateway/testutil"
 )
@@ -112,6 +117,65 @@ func TestStatusAPI(t *testing.T) {
 	}
 }
 
+func TestStatusAPIStore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "api.TestStatusAPIStore.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dms := storage.NewDiskMetricStore(path.Join(tempDir, "persistence"), time.Hour, nil, logger)
+	defer dms.Shutdown()
+	testAPI := New(logger, dms, testFlags, testBuildInfo)
+	testAPI.StatusReporter = dms
+
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf1),
+	})
+	dms.SubmitWriteRequest(storage.WriteRequest{
+		Timestamp: time.Now(),
+		Flush:     true,
+		Done:      errCh,
+	})
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "http://example.org/", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	testAPI.status(w, req)
+	testResponse := response{}
+	if err := json.Unmarshal(w.Body.Bytes(), &testResponse); err != nil {
+		t.Fatal(err)
+	}
+	store := testResponse.Data.(map[string]interface{})["store"].(map[string]interface{})
+	for key, value := range map[string]float64{
+		"write_queue_length": 0,
+		"metric_groups":      1,
+		"metric_families":    1,
+		"samples":            2, // Sum and count of the summary.
+	} {
+		if expected, got := value, store[key]; expected != got {
+			t.Errorf("Wanted %s %v, got %v.", key, expected, got)
+		}
+	}
+	if store["memory_only"] != false {
+		t.Errorf("Wanted memory_only false, got %v.", store["memory_only"])
+	}
+	persistence := store["persistence"].(map[string]interface{})
+	if persistence["last_error"] != nil || persistence["last_success_time"] == nil {
+		t.Errorf("Wanted successful persisting, got %v.", persistence)
+	}
+	if size, ok := persistence["file_size_bytes"].(float64); !ok || size <= 0 {
+		t.Errorf("Wanted positive file size, got %v.", persistence["file_size_bytes"])
+	}
+}
+
 func TestMetricsAPI(t *testing.T) {
 	dms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
 	testAPI := New(logger, dms, testFlags, testBuildInfo)
@@ -166,6 +230,7 @@ func TestMetricsAPI(t *testing.T) {
 				"job": "Björn"
 			},
 			"last_push_successful": true,
+			"locked": false,
 			"mf1": {
 				"time_stamp": "2020-03-10T00:54:08.025744841+05:30",
 				"type": "SUMMARY",
@@ -221,3 +286,454 @@ func TestMetricsAPI(t *testing.T) {
 		t.Errorf("Wanted response %q, got %q.", expected, got)
 	}
 }
+
+func TestFlushAPI(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "api.TestFlushAPI.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := storage.NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	testAPI := New(logger, dms, testFlags, testBuildInfo)
+
+	// Not waiting for the push as the flush has to wait for it anyway.
+	dms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf1),
+	})
+
+	req, err := http.NewRequest("POST", "http://example.org/", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	testAPI.flush(w, req)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := `{"status":"success"}`, w.Body.String(); expected != got {
+		t.Errorf("Wanted response %q, got %q.", expected, got)
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		t.Error("Persistence file not written:", err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make persisting fail by removing the directory of the persistence
+	// file.
+	dir := path.Join(tempDir, "vanishing")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	dms = storage.NewDiskMetricStore(path.Join(dir, "persistence"), time.Hour, nil, logger)
+	testAPI = New(logger, dms, testFlags, testBuildInfo)
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	testAPI.flush(w, req)
+	if expected, got := http.StatusInternalServerError, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if err := dms.Shutdown(); err == nil {
+		t.Error("Expected error on shutdown.")
+	}
+}
+
+func TestHealthyReadyAPI(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "api.TestHealthyReadyAPI.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dir := path.Join(tempDir, "vanishing")
+	if err := os.Mkdir(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	dms := storage.NewDiskMetricStore(path.Join(dir, "persistence"), time.Hour, nil, logger)
+	testAPI := New(logger, dms, testFlags, testBuildInfo)
+
+	req, err := http.NewRequest("GET", "http://example.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(h http.HandlerFunc, expectedCode int) {
+		w := httptest.NewRecorder()
+		h(w, req)
+		if expected, got := expectedCode, w.Code; expected != got {
+			t.Errorf("Wanted status code %v, got %v (%s).", expected, got, w.Body.String())
+		}
+	}
+	check(testAPI.healthy, http.StatusOK)
+	check(testAPI.ready, http.StatusOK)
+
+	// A failed persist makes the store unready but not unhealthy.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	testAPI.flush(httptest.NewRecorder(), req)
+	check(testAPI.healthy, http.StatusOK)
+	check(testAPI.ready, http.StatusServiceUnavailable)
+
+	dms.Shutdown()
+}
+
+func TestGroupAgeAPI(t *testing.T) {
+	dms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	testAPI := New(logger, dms, testFlags, testBuildInfo)
+
+	pushTime := time.Now().Add(-time.Minute)
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      pushTime,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1),
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	for grouping, expectedCode := range map[string]int{
+		"/job/Björn/instance@base64/aW5zdCdhIm5cY2Ux/age": http.StatusOK,
+		"/job/Björn/age": http.StatusNotFound,
+		"/job/Björn/instance@base64/aW5zdCdhIm5cY2Ux": http.StatusNotFound,
+		"/instance/foo/age":                           http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest("GET", "http://example.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(route.WithParam(req.Context(), "grouping", grouping))
+		w := httptest.NewRecorder()
+		testAPI.groupAge(w, req)
+		if expected, got := expectedCode, w.Code; expected != got {
+			t.Errorf("%s: Wanted status code %v, got %v.", grouping, expected, got)
+		}
+		if expectedCode != http.StatusOK {
+			continue
+		}
+		testResponse := response{}
+		if err := json.Unmarshal(w.Body.Bytes(), &testResponse); err != nil {
+			t.Fatal(err)
+		}
+		data := testResponse.Data.(map[string]interface{})
+		if age := data["age_seconds"].(float64); age < 60 || age > 120 {
+			t.Errorf("%s: Wanted age of about 60s, got %v.", grouping, age)
+		}
+		if !reflect.DeepEqual(data["labels"], convertMap(grouping1)) {
+			t.Errorf("%s: Wanted labels %v, got %v.", grouping, grouping1, data["labels"])
+		}
+	}
+}
+
+func TestGroupStatsAPI(t *testing.T) {
+	dms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer dms.Shutdown()
+	testAPI := New(logger, dms, testFlags, testBuildInfo)
+
+	// Timestamps are rejected.
+	invalid := &dto.MetricFamily{
+		Name:   proto.String("mf2"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}, TimestampMs: proto.Int64(1)}},
+	}
+	var pushErr error
+	for i, mf := range []*dto.MetricFamily{mf1, mf1, invalid} {
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:         grouping1,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(mf),
+			PayloadSize:    100 + i,
+			Done:           errCh,
+		})
+		for err := range errCh {
+			if mf != invalid {
+				t.Fatal(err)
+			}
+			pushErr = err
+		}
+	}
+	if pushErr == nil {
+		t.Fatal("Expected push with timestamps to fail.")
+	}
+
+	for grouping, expectedCode := range map[string]int{
+		"/job/Björn/instance@base64/aW5zdCdhIm5cY2Ux/stats": http.StatusOK,
+		"/job/Björn/stats":    http.StatusNotFound,
+		"/instance/foo/stats": http.StatusBadRequest,
+	} {
+		req, err := http.NewRequest("GET", "http://example.org/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(route.WithParam(req.Context(), "grouping", grouping))
+		w := httptest.NewRecorder()
+		testAPI.groupStats(w, req)
+		if expected, got := expectedCode, w.Code; expected != got {
+			t.Errorf("%s: Wanted status code %v, got %v.", grouping, expected, got)
+		}
+		if expectedCode != http.StatusOK {
+			continue
+		}
+		testResponse := response{}
+		if err := json.Unmarshal(w.Body.Bytes(), &testResponse); err != nil {
+			t.Fatal(err)
+		}
+		data := testResponse.Data.(map[string]interface{})
+		for name, expected := range map[string]float64{
+			"metric_families":      1,
+			"samples":              float64(storage.NumSamples(mf1)),
+			"size_bytes":           float64(proto.Size(mf1)),
+			"last_push_size_bytes": 101,
+			"pushes_total":         3,
+			"pushes_today":         3,
+			"failed_pushes_total":  1,
+		} {
+			if got, ok := data[name].(float64); !ok || expected != got {
+				t.Errorf("%s: Wanted %s to be %v, got %v.", grouping, name, expected, data[name])
+			}
+		}
+		if d, ok := data["last_push_duration_seconds"].(float64); !ok || d <= 0 || d > 10 {
+			t.Errorf("%s: Wanted a last push duration, got %v.", grouping, data["last_push_duration_seconds"])
+		}
+		if expected, got := pushErr.Error(), data["last_push_error"]; expected != got {
+			t.Errorf("%s: Wanted last push error %q, got %v.", grouping, expected, got)
+		}
+	}
+}
+
+func TestGroupsAPI(t *testing.T) {
+	dms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer dms.Shutdown()
+	testAPI := New(logger, dms, testFlags, testBuildInfo)
+
+	pushTime := time.Now().Add(-time.Minute)
+	for i, job := range []string{"c", "a", "b"} {
+		var ttl, expect time.Duration
+		switch job {
+		case "a":
+			ttl = time.Hour
+		case "b":
+			expect = 30 * time.Second
+		}
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:           map[string]string{"job": job},
+			Timestamp:        pushTime.Add(time.Duration(i) * time.Second),
+			MetricFamilies:   testutil.MetricFamiliesMap(mf1),
+			TTL:              ttl,
+			ExpectedInterval: expect,
+			Done:             errCh,
+		})
+		for err := range errCh {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(query string) (int, groupsPage) {
+		req, err := http.NewRequest("GET", "http://example.org/groups"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		testAPI.groups(w, req)
+		var page groupsPage
+		if w.Code == http.StatusOK {
+			testResponse := struct {
+				Data *groupsPage `json:"data"`
+			}{Data: &page}
+			if err := json.Unmarshal(w.Body.Bytes(), &testResponse); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, page
+	}
+
+	code, page := get("?limit=2")
+	if expected, got := http.StatusOK, code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := 2, len(page.Groups); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+	if page.Continue == "" {
+		t.Error("Wanted continue token.")
+	}
+	a := page.Groups[0]
+	if expected, got := "a", a.Labels["job"]; expected != got {
+		t.Errorf("Wanted job %q first, got %q.", expected, got)
+	}
+	if expected, got := []string{"mf1"}, a.MetricNames; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted metric names %v, got %v.", expected, got)
+	}
+	if a.LastPushTime == nil || a.LastPushTime.Sub(pushTime.Add(time.Second)) > time.Millisecond || !a.LastPushSuccessful {
+		t.Errorf("Unexpected last push time %v.", a.LastPushTime)
+	}
+	if a.LastPushFailureTime != nil {
+		t.Errorf("Wanted no last push failure time, got %v.", a.LastPushFailureTime)
+	}
+	if a.TTLRemaining == nil || *a.TTLRemaining < 3500 || *a.TTLRemaining > 3600 {
+		t.Errorf("Wanted remaining TTL of about 59m, got %v.", a.TTLRemaining)
+	}
+	if a.ExpectedInterval != nil || a.Overdue {
+		t.Errorf("Wanted no expected push interval, got %v (overdue: %v).", a.ExpectedInterval, a.Overdue)
+	}
+	if b := page.Groups[1]; b.Labels["job"] != "b" || b.TTLRemaining != nil {
+		t.Errorf("Unexpected second group %+v.", b)
+	} else if b.ExpectedInterval == nil || *b.ExpectedInterval != 30 || !b.Overdue {
+		t.Errorf("Wanted overdue group with expected push interval of 30s, got %v (overdue: %v).", b.ExpectedInterval, b.Overdue)
+	}
+
+	// Groups added in the meantime before the continue token are skipped.
+	submitErrCh := make(chan error, 1)
+	dms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:         map[string]string{"job": "0"},
+		Timestamp:      pushTime,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1),
+		Done:           submitErrCh,
+	})
+	for err := range submitErrCh {
+		t.Fatal(err)
+	}
+	code, page = get("?limit=2&continue=" + page.Continue)
+	if expected, got := http.StatusOK, code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	if len(page.Groups) != 1 || page.Groups[0].Labels["job"] != "c" || page.Continue != "" {
+		t.Errorf("Unexpected last page %+v.", page)
+	}
+
+	if _, page := get(""); len(page.Groups) != 4 || page.Continue != "" {
+		t.Errorf("Wanted all 4 groups without limit, got %+v.", page)
+	}
+	for _, query := range []string{"?limit=0", "?limit=x", "?continue=%25"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: Wanted status code %v, got %v.", query, http.StatusBadRequest, code)
+		}
+	}
+}
+
+func TestRejectedAPI(t *testing.T) {
+	testAPI := New(logger, nil, testFlags, testBuildInfo)
+	get := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://example.org/rejected", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		testAPI.rejected(w, req)
+		return w
+	}
+
+	if expected, got := http.StatusServiceUnavailable, get().Code; expected != got {
+		t.Errorf("Wanted status code %d, got %d.", expected, got)
+	}
+
+	testAPI.Quarantine = handler.NewQuarantine(10, 100)
+	testAPI.Quarantine.Add(handler.RejectedPush{Path: "/metrics/job/a", Status: http.StatusBadRequest, Body: "bad"})
+	w := get()
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("Wanted status code %d, got %d.", expected, got)
+	}
+	var pushes []handler.RejectedPush
+	if err := json.Unmarshal(w.Body.Bytes(), &struct {
+		Data *[]handler.RejectedPush `json:"data"`
+	}{Data: &pushes}); err != nil {
+		t.Fatal(err)
+	}
+	if len(pushes) != 1 || pushes[0].Path != "/metrics/job/a" || pushes[0].Body != "bad" {
+		t.Errorf("Unexpected rejected pushes %+v.", pushes)
+	}
+}
+
+func TestValidateAPI(t *testing.T) {
+	dms := storage.NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer dms.Shutdown()
+	testAPI := New(logger, dms, testFlags, testBuildInfo)
+
+	validate := func(grouping, query, body string) (int, map[string]interface{}) {
+		req, err := http.NewRequest("POST", "http://example.org/validate"+query, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req = req.WithContext(route.WithParam(req.Context(), "grouping", grouping))
+		w := httptest.NewRecorder()
+		testAPI.validate(w, req)
+		testResponse := response{}
+		if err := json.Unmarshal(w.Body.Bytes(), &testResponse); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := testResponse.Data.(map[string]interface{})
+		return w.Code, data
+	}
+
+	if code, _ := validate("/job/foo", "", "some_metric 1\n"); code != http.StatusServiceUnavailable {
+		t.Errorf("Wanted status code %v without ParsePush, got %v.", http.StatusServiceUnavailable, code)
+	}
+	testAPI.ParsePush = func(r *http.Request, labels map[string]string, replace bool) (storage.WriteRequest, error) {
+		return handler.ParsePush(r, labels, replace, handler.TimestampReject, handler.LabelConflictOverride, handler.ValidationStrict, nil)
+	}
+	testAPI.Validator = dms
+
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:         map[string]string{"job": "foo"},
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf1),
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	code, data := validate("/job/foo", "?method=put", "# TYPE other_metric counter\nother_metric 1\nother_metric{a=\"b\"} 2\n")
+	if expected, got := http.StatusOK, code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if data["consistency_checked"] != true {
+		t.Error("Consistency not checked.")
+	}
+	families := data["metric_families"].([]interface{})
+	if len(families) != 1 || families[0].(map[string]interface{})["samples"] != 2.0 {
+		t.Errorf("Unexpected metric families %v.", families)
+	}
+	for _, group := range dms.GetMetricFamiliesMap() {
+		if _, ok := group.Metrics["other_metric"]; ok {
+			t.Error("Validated metrics have been stored.")
+		}
+	}
+
+	for _, s := range []struct {
+		grouping, query, body string
+		checked               bool
+	}{
+		{"/job/bar", "", "# TYPE mf1 counter\nmf1 1\n", true}, // Type conflict.
+		{"/job/bar", "", "mf1_sum 1\n", true},                 // Name collision.
+		{"/job/bar", "", "some_metric 1 1234\n", false},
+		{"", "", "invalid metric\n", false},
+		{"/job/bar", "?method=get", "some_metric 1\n", false},
+	} {
+		code, data := validate(s.grouping, s.query, s.body)
+		if expected, got := http.StatusBadRequest, code; expected != got {
+			t.Errorf("%+v: Wanted status code %v, got %v.", s, expected, got)
+		}
+		if checked, _ := data["consistency_checked"].(bool); checked != s.checked {
+			t.Errorf("%+v: Wanted consistency checked %v, got %v.", s, s.checked, checked)
+		}
+	}
+
+	// Without a job, only the push itself is checked.
+	code, data = validate("", "", "some_metric 1\n")
+	if expected, got := http.StatusOK, code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if data["consistency_checked"] != false {
+		t.Error("Consistency checked without a job.")
+	}
+}
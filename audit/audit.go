@@ -0,0 +1,215 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit writes an append-only log of the changes made to the metric
+// store.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stdout is the file name to write the audit log to standard output instead
+// of a file.
+const Stdout = "-"
+
+var errorsDesc = prometheus.NewDesc(
+	"pushgateway_audit_log_errors_total",
+	"Total number of audit log entries that could not be written.",
+	nil, nil,
+)
+
+var errClosed = errors.New("audit log is closed")
+
+// Entry is a single record of the audit log, written as one line of JSON.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"` // "push" or "delete".
+	Method string    `json:"method"`
+	// Tenant is the ID of the tenant whose store was addressed, or empty
+	// for the default namespace.
+	Tenant string `json:"tenant,omitempty"`
+	// Group holds the grouping labels, or nil if the URL could not be
+	// parsed.
+	Group map[string]string `json:"group"`
+	// MetricNames are the names of the metric families deleted from the
+	// group. It is empty if the whole group was deleted.
+	MetricNames []string `json:"metric_names,omitempty"`
+
+	// The identities the client presented, not necessarily verified (see
+	// Status). Bearer tokens are only logged as the first 12 hex digits of
+	// their SHA-256 hash.
+	User          string `json:"user,omitempty"`
+	ClientCertCN  string `json:"client_cert_cn,omitempty"`
+	BearerTokenID string `json:"bearer_token_sha256,omitempty"`
+	RemoteAddr    string `json:"remote_addr"`
+
+	// MetricFamilies and Samples count the pushed metrics after
+	// relabeling. Both are zero for deletions and for pushes rejected
+	// before their body was parsed.
+	MetricFamilies int `json:"metric_families,omitempty"`
+	Samples        int `json:"samples,omitempty"`
+
+	Status   int     `json:"status"` // The HTTP status code of the response.
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// Log writes Entries to a file, rotating it once it exceeds a maximum size, or
+// to standard output. It is safe for concurrent use.
+//
+// A Log implements prometheus.Collector to expose the number of Entries that
+// could not be written. It is up to the caller to register it.
+type Log struct {
+	file       string
+	maxSize    int64
+	maxBackups int
+
+	mtx    sync.Mutex
+	w      io.Writer
+	f      *os.File // nil if writing to standard output.
+	size   int64
+	errors int
+	closed bool
+}
+
+// New returns a Log appending to the provided file, or writing to standard
+// output if file is Stdout. If maxSize is positive, the file is rotated before
+// it would grow beyond maxSize bytes: It is renamed to <file>.1, an existing
+// <file>.1 to <file>.2, and so on, keeping at most maxBackups rotated files.
+func New(file string, maxSize int64, maxBackups int) (*Log, error) {
+	l := &Log{file: file, maxSize: maxSize, maxBackups: maxBackups}
+	if file == Stdout {
+		l.w = os.Stdout
+		return l, nil
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not open audit log: %v", err)
+	}
+	l.f, l.w, l.size = f, f, fi.Size()
+	return nil
+}
+
+// Record writes the provided Entry. A failure is counted and returned.
+func (l *Log) Record(e Entry) error {
+	// Marshaling an Entry cannot fail.
+	line, _ := json.Marshal(e)
+	line = append(line, '\n')
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.closed {
+		return errClosed
+	}
+	if l.f != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return l.failed(err)
+		}
+	}
+	if l.w == nil {
+		// A previous rotation could not reopen the file.
+		if err := l.open(); err != nil {
+			return l.failed(err)
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return l.failed(err)
+	}
+	return nil
+}
+
+// rotate closes the current file, shifts the rotated files, and opens a new
+// file. The caller has to hold mtx.
+func (l *Log) rotate() error {
+	err := l.f.Close()
+	l.f, l.w = nil, nil
+	if err != nil {
+		return fmt.Errorf("could not close audit log for rotation: %v", err)
+	}
+	if l.maxBackups < 1 {
+		if err := os.Remove(l.file); err != nil {
+			return fmt.Errorf("could not rotate audit log: %v", err)
+		}
+		return l.open()
+	}
+	os.Remove(l.backup(l.maxBackups))
+	for i := l.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(l.backup(i), l.backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not rotate audit log: %v", err)
+		}
+	}
+	if err := os.Rename(l.file, l.backup(1)); err != nil {
+		return fmt.Errorf("could not rotate audit log: %v", err)
+	}
+	return l.open()
+}
+
+func (l *Log) backup(i int) string {
+	return fmt.Sprintf("%s.%d", l.file, i)
+}
+
+// failed counts a failure. The caller has to hold mtx.
+func (l *Log) failed(err error) error {
+	l.errors++
+	return err
+}
+
+// Close closes the file of the Log, if any. Entries recorded afterwards are
+// discarded.
+func (l *Log) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f, l.w = nil, nil
+	return err
+}
+
+// Describe implements prometheus.Collector.
+func (l *Log) Describe(ch chan<- *prometheus.Desc) {
+	ch <- errorsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (l *Log) Collect(ch chan<- prometheus.Metric) {
+	l.mtx.Lock()
+	n := l.errors
+	l.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(errorsDesc, prometheus.CounterValue, float64(n))
+}
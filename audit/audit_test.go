@@ -0,0 +1,89 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestRotation(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestRotation.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := path.Join(tempDir, "audit.log")
+
+	e := Entry{Time: time.Unix(1000, 0).UTC(), Action: "push", Method: "PUT", Group: map[string]string{"job": "foo"}}
+	l, err := New(file, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		e.Status = 200 + i
+		if err := l.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(e); err == nil {
+		t.Error("Expected error recording to a closed log.")
+	}
+
+	// Every entry exceeds the maximum size, so each ends up in a file of
+	// its own, and the oldest one is gone.
+	for name, status := range map[string]string{
+		file:        "203",
+		file + ".1": "202",
+		file + ".2": "201",
+	} {
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := 1, bytes.Count(content, []byte("\n")); expected != got {
+			t.Errorf("%s: Wanted %d line, got %d.", name, expected, got)
+		}
+		if !bytes.Contains(content, []byte(`"status":`+status)) {
+			t.Errorf("%s: Wanted status %s, got %s.", name, status, content)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected rotated file %s.3.", file)
+	}
+
+	// Without rotation, entries are appended to the existing file.
+	l, err = New(file, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Record(e); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, bytes.Count(content, []byte("\n")); expected != got {
+		t.Errorf("Wanted %d lines, got %d.", expected, got)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Admin calls the admin API of the Pushgateway, which has to be enabled with
+// the --web.enable-admin-api flag. It is safe for concurrent use.
+type Admin struct {
+	url string // Of the admin API.
+	options
+}
+
+// NewAdmin returns an Admin for the Pushgateway with the provided URL, see
+// NewPusher.
+func NewAdmin(url string, opts ...Option) *Admin {
+	return &Admin{
+		url:     strings.TrimRight(url, "/") + "/api/v1/admin",
+		options: newOptions(opts),
+	}
+}
+
+// APIKey is an API key of the Pushgateway.
+type APIKey struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	// Jobs are anchored regular expressions for the job names the key may
+	// be used for.
+	Jobs []string `json:"jobs"`
+	// Verbs are the operations the key may be used for, i.e. "push",
+	// "delete", and "read".
+	Verbs   []string   `json:"verbs"`
+	Created time.Time  `json:"created"`
+	Rotated *time.Time `json:"rotated,omitempty"`
+	// PreviousExpires is when the key before the last rotation stops being
+	// accepted.
+	PreviousExpires *time.Time `json:"previous_expires,omitempty"`
+	// Key is the key itself, only returned upon creation and rotation.
+	Key string `json:"key,omitempty"`
+}
+
+// Wipe deletes all metrics in the Pushgateway.
+func (a *Admin) Wipe(ctx context.Context) error {
+	return a.do(ctx, http.MethodPut, a.url+"/wipe", "", nil, nil, http.StatusAccepted)
+}
+
+// ReadOnly returns whether the Pushgateway is in read-only mode.
+func (a *Admin) ReadOnly(ctx context.Context) (bool, error) {
+	var result struct {
+		ReadOnly bool `json:"read_only"`
+	}
+	err := a.do(ctx, http.MethodGet, a.url+"/read-only", "", nil, decodeJSON(&result), http.StatusOK)
+	return result.ReadOnly, err
+}
+
+// SetReadOnly switches the read-only mode of the Pushgateway on or off.
+func (a *Admin) SetReadOnly(ctx context.Context, enabled bool) error {
+	method := http.MethodDelete
+	if enabled {
+		method = http.MethodPut
+	}
+	return a.do(ctx, method, a.url+"/read-only", "", nil, nil, http.StatusNoContent)
+}
+
+// CreateAPIKey creates an API key for the provided jobs and verbs. The
+// returned APIKey contains the key itself, which cannot be retrieved later.
+func (a *Admin) CreateAPIKey(ctx context.Context, description string, jobs, verbs []string) (APIKey, error) {
+	body, err := json.Marshal(struct {
+		Description string   `json:"description,omitempty"`
+		Jobs        []string `json:"jobs"`
+		Verbs       []string `json:"verbs"`
+	}{description, jobs, verbs})
+	if err != nil {
+		return APIKey{}, err
+	}
+	var k APIKey
+	err = a.do(ctx, http.MethodPost, a.url+"/api-keys", "application/json", bytes.NewReader(body), decodeJSON(&k), http.StatusCreated)
+	return k, err
+}
+
+// APIKeys returns all API keys, without the keys themselves.
+func (a *Admin) APIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	err := a.do(ctx, http.MethodGet, a.url+"/api-keys", "", nil, decodeJSON(&keys), http.StatusOK)
+	return keys, err
+}
+
+// RevokeAPIKey removes the API key with the provided ID.
+func (a *Admin) RevokeAPIKey(ctx context.Context, id string) error {
+	return a.do(ctx, http.MethodDelete, a.url+"/api-keys/"+url.PathEscape(id), "", nil, nil, http.StatusNoContent)
+}
+
+// RotateAPIKey replaces the key of the API key with the provided ID. The
+// previous key stays valid for the provided grace period. The returned APIKey
+// contains the new key.
+func (a *Admin) RotateAPIKey(ctx context.Context, id string, gracePeriod time.Duration) (APIKey, error) {
+	u := a.url + "/api-keys/" + url.PathEscape(id) + "/rotate"
+	if gracePeriod > 0 {
+		u += "?grace_period=" + url.QueryEscape(gracePeriod.String())
+	}
+	var k APIKey
+	err := a.do(ctx, http.MethodPost, u, "", nil, decodeJSON(&k), http.StatusOK)
+	return k, err
+}
+
+func decodeJSON(v interface{}) func(io.Reader) error {
+	return func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(v)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// Package client pushes metrics to the Pushgateway and controls it via its
+// admin API, so that Go programs (typically batch jobs) neither have to
+// assemble request URLs nor escape grouping labels themselves.
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Option configures a Pusher or an Admin.
+type Option func(*options)
+
+type options struct {
+	grouping           map[string]string
+	username, password string
+	apiKey             string
+	timeout            time.Duration
+	client             *http.Client
+}
+
+// WithGroupingLabels adds the provided labels to the grouping key of the
+// Pusher, in addition to the job label. It is ignored by an Admin.
+func WithGroupingLabels(labels map[string]string) Option {
+	return func(o *options) {
+		for name, value := range labels {
+			o.grouping[name] = value
+		}
+	}
+}
+
+// WithBasicAuth sets the username and password for HTTP basic authentication.
+func WithBasicAuth(username, password string) Option {
+	return func(o *options) {
+		o.username, o.password = username, password
+	}
+}
+
+// WithAPIKey sets an API key (as created with Admin.CreateAPIKey) to send as a
+// bearer token. It takes precedence over WithBasicAuth.
+func WithAPIKey(key string) Option {
+	return func(o *options) {
+		o.apiKey = key
+	}
+}
+
+// WithTimeout limits the time each request may take, including reading the
+// response. Zero (the default) means no limit other than the one of the
+// context of the request.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithHTTPClient sets the http.Client to send the requests with, e.g. for TLS
+// configuration. The default is http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{grouping: map[string]string{}, client: http.DefaultClient}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// StatusError is returned for requests the Pushgateway responds to with an
+// unexpected status code.
+type StatusError struct {
+	Method, URL string
+	StatusCode  int
+	// Message is the body of the response, which the Pushgateway uses to
+	// explain the error.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d for %s %s: %s", e.StatusCode, e.Method, e.URL, e.Message)
+}
+
+// do sends a request with the provided method and body (if not nil) to the
+// provided URL and checks that the response has one of the expected status
+// codes. If into is not nil, the body of the response is passed to it.
+func (o *options) do(ctx context.Context, method, url, contentType string, body io.Reader, into func(io.Reader) error, expected ...int) error {
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	switch {
+	case o.apiKey != "":
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	case o.username != "":
+		req.SetBasicAuth(o.username, o.password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	for _, code := range expected {
+		if resp.StatusCode != code {
+			continue
+		}
+		if into != nil {
+			return into(resp.Body)
+		}
+		io.Copy(ioutil.Discard, resp.Body) // Allow the connection to be reused.
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &StatusError{Method: method, URL: url, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
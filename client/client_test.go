@@ -0,0 +1,145 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/route"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+var logger = log.NewNopLogger()
+
+func TestPusher(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	defer ms.Shutdown()
+	r := route.New()
+	for _, p := range []string{"/metrics/job@base64/:job", "/metrics/job@base64/:job/*labels"} {
+		r.Put(p, handler.Push(ms, true, true, true, handler.TimestampReject, handler.LabelConflictOverride, handler.ValidationStrict, nil, logger))
+		r.Post(p, handler.Push(ms, false, true, true, handler.TimestampReject, handler.LabelConflictOverride, handler.ValidationStrict, nil, logger))
+		r.Del(p, handler.Delete(ms, true, logger))
+	}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{Name: "last_success", Help: "Last success."})
+	g.Set(42)
+	reg.MustRegister(g)
+	grouping := map[string]string{"job": "batch/nightly", "instance": "", "path": "/var/tmp"}
+	p := NewPusher(srv.URL+"/", "batch/nightly", WithGroupingLabels(map[string]string{"instance": "", "path": "/var/tmp"}), WithTimeout(time.Minute))
+
+	ctx := context.Background()
+	if err := p.Push(ctx, reg); err != nil {
+		t.Fatal(err)
+	}
+	group, ok := storage.GetMetricGroup(ms, grouping)
+	if !ok {
+		t.Fatal("Group not found.")
+	}
+	if expected, got := 42., group.Metrics["last_success"].GetMetricFamily().GetMetric()[0].GetGauge().GetValue(); expected != got {
+		t.Errorf("Wanted value %v, got %v.", expected, got)
+	}
+	if err := p.Add(ctx, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return nil, nil })); err != nil {
+		t.Error(err)
+	}
+	if err := p.Delete(ctx); err != nil {
+		t.Error(err)
+	}
+	if _, ok := storage.GetMetricGroup(ms, grouping); ok {
+		t.Error("Group not deleted.")
+	}
+
+	if err := NewPusher(srv.URL, "").Push(ctx, reg); err == nil {
+		t.Error("Expected error for empty job name.")
+	}
+	err := NewPusher(srv.URL+"/other", "batch").Push(ctx, reg)
+	if se, ok := err.(*StatusError); !ok || se.StatusCode != http.StatusNotFound {
+		t.Errorf("Wanted StatusError with status code %d, got %v.", http.StatusNotFound, err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client.TestAdmin.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keys, err := handler.NewAPIKeyStore(path.Join(dir, "api-keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly := &handler.ReadOnlyMode{}
+	r := route.New()
+	r.Get("/api/v1/admin/read-only", handler.GetReadOnly(readOnly, logger).ServeHTTP)
+	r.Put("/api/v1/admin/read-only", handler.SetReadOnly(readOnly, true, logger).ServeHTTP)
+	r.Del("/api/v1/admin/read-only", handler.SetReadOnly(readOnly, false, logger).ServeHTTP)
+	r.Post("/api/v1/admin/api-keys", handler.CreateAPIKey(keys, logger).ServeHTTP)
+	r.Get("/api/v1/admin/api-keys", handler.ListAPIKeys(keys, logger).ServeHTTP)
+	r.Del("/api/v1/admin/api-keys/:id", handler.RevokeAPIKey(keys, logger).ServeHTTP)
+	r.Post("/api/v1/admin/api-keys/:id/rotate", handler.RotateAPIKey(keys, logger).ServeHTTP)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	a := NewAdmin(srv.URL)
+	ctx := context.Background()
+
+	if err := a.SetReadOnly(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := a.ReadOnly(ctx); err != nil || !enabled {
+		t.Errorf("Wanted read-only mode, got %v, error: %v", enabled, err)
+	}
+
+	k, err := a.CreateAPIKey(ctx, "nightly", []string{"batch.*"}, []string{"push"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Key == "" || k.ID == "" {
+		t.Errorf("Wanted key and ID, got %+v.", k)
+	}
+	rotated, err := a.RotateAPIKey(ctx, k.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Key == k.Key || rotated.PreviousExpires == nil {
+		t.Errorf("Wanted new key with previous key expiring, got %+v.", rotated)
+	}
+	list, err := a.APIKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, len(list); expected != got || list[0].Key != "" {
+		t.Fatalf("Wanted %d API key without key, got %+v.", expected, list)
+	}
+	if err := a.RevokeAPIKey(ctx, k.ID); err != nil {
+		t.Error(err)
+	}
+	if err := a.RevokeAPIKey(ctx, k.ID); err == nil {
+		t.Error("Expected error for revoking unknown API key.")
+	}
+}
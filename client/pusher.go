@@ -0,0 +1,117 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Pusher pushes metrics to a group of the Pushgateway and deletes it. It is
+// safe for concurrent use.
+type Pusher struct {
+	url string // Of the group.
+	options
+	err error // Of the configuration, returned by every call.
+}
+
+// NewPusher returns a Pusher for the group with the provided job name and the
+// grouping labels set by WithGroupingLabels (if any) on the Pushgateway with
+// the provided URL, e.g. "http://pushgateway.example.org:9091". If the
+// Pushgateway is running with a route prefix, it has to be part of the URL.
+func NewPusher(url, job string, opts ...Option) *Pusher {
+	p := &Pusher{options: newOptions(opts)}
+	if job == "" {
+		p.err = errors.New("job name must not be empty")
+		return p
+	}
+	if _, ok := p.grouping["job"]; ok {
+		p.err = errors.New("job must not be set as a grouping label, it is set by the job name")
+		return p
+	}
+	grouping := map[string]string{"job": job}
+	for name, value := range p.grouping {
+		grouping[name] = value
+	}
+	p.url = strings.TrimRight(url, "/") + "/metrics" + groupingPath(grouping)
+	return p
+}
+
+// Push gathers the metrics from g and pushes them, replacing all metrics in
+// the group (PUT method).
+func (p *Pusher) Push(ctx context.Context, g prometheus.Gatherer) error {
+	return p.push(ctx, http.MethodPut, g)
+}
+
+// Add gathers the metrics from g and pushes them, replacing only the metrics
+// with the same name in the group (POST method).
+func (p *Pusher) Add(ctx context.Context, g prometheus.Gatherer) error {
+	return p.push(ctx, http.MethodPost, g)
+}
+
+// Delete deletes all metrics in the group.
+func (p *Pusher) Delete(ctx context.Context) error {
+	if p.err != nil {
+		return p.err
+	}
+	return p.do(ctx, http.MethodDelete, p.url, "", nil, nil, http.StatusAccepted)
+}
+
+func (p *Pusher) push(ctx context.Context, method string, g prometheus.Gatherer) error {
+	if p.err != nil {
+		return p.err
+	}
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	enc := expfmt.NewEncoder(buf, expfmt.FmtProtoDelim)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+	return p.do(ctx, method, p.url, string(expfmt.FmtProtoDelim), buf, nil, http.StatusOK, http.StatusAccepted)
+}
+
+// groupingPath returns the URL path of the group with the provided labels below
+// the metrics path, with the job label first and all values base64-encoded, so
+// that they may contain any character.
+func groupingPath(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != "job" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range append([]string{"job"}, names...) {
+		value := base64.RawURLEncoding.EncodeToString([]byte(labels[name]))
+		if value == "" {
+			// An empty path component would be dropped.
+			value = "="
+		}
+		b.WriteString("/" + name + "@base64/" + value)
+	}
+	return b.String()
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	minReconnectInterval = 100 * time.Millisecond
+	maxReconnectInterval = 10 * time.Second
+)
+
+var (
+	followerConnectedDesc = prometheus.NewDesc(
+		"pushgateway_follower_connected",
+		"Whether the stream of changes from the followed Pushgateway is currently received (1) or not (0).",
+		nil, nil,
+	)
+	followerAppliedDesc = prometheus.NewDesc(
+		"pushgateway_follower_applied_changes_total",
+		"Total number of changes received from the followed Pushgateway and applied, including the initial restores.",
+		nil, nil,
+	)
+	followerFailedDesc = prometheus.NewDesc(
+		"pushgateway_follower_failed_changes_total",
+		"Total number of changes received from the followed Pushgateway that could not be applied.",
+		nil, nil,
+	)
+)
+
+// Follower mirrors the MetricStore of another Pushgateway, the primary, by
+// applying the changes it streams (see Replicator.ServeChanges) to a local
+// MetricStore. Every time the Follower (re)connects, the primary first sends
+// all its groups, replacing the content of the local MetricStore.
+//
+// A Follower implements prometheus.Collector to expose metrics about the
+// stream. It is up to the caller to register it.
+type Follower struct {
+	ms        storage.MetricStore
+	url       string
+	client    *http.Client
+	following func() bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	logger    log.Logger
+
+	mtx             sync.Mutex
+	connected       bool
+	applied, failed int
+}
+
+// NewFollower returns a Follower applying the changes of the Pushgateway with
+// the provided base URL (e.g. "http://pushgateway-1:9091") to ms. Credentials
+// for basic auth may be included in the URL. The Follower only follows as long
+// as following returns true. Once it returns false, e.g. because the local
+// Pushgateway has been promoted to accept changes itself, the Follower stops
+// for good.
+func NewFollower(ms storage.MetricStore, rawURL string, following func() bool, logger log.Logger) (*Follower, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %q to follow: %v", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("URL %q to follow has to start with http:// or https://", rawURL)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + ChangesPath
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Follower{
+		ms:        ms,
+		url:       u.String(),
+		client:    &http.Client{},
+		following: following,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		logger:    log.With(logger, "primary", u.Host),
+	}, nil
+}
+
+// Run follows the primary until Stop is called or following returns false,
+// reconnecting with a backoff whenever the stream ends.
+func (f *Follower) Run() {
+	defer close(f.done)
+	backoff := minReconnectInterval
+	for f.ctx.Err() == nil && f.following() {
+		start := time.Now()
+		err := f.follow()
+		f.setConnected(false)
+		if f.ctx.Err() != nil || !f.following() {
+			break
+		}
+		if time.Since(start) > maxReconnectInterval {
+			backoff = minReconnectInterval
+		}
+		level.Warn(f.logger).Log("msg", "stream of changes from primary ended, reconnecting", "err", err, "backoff", backoff)
+		select {
+		case <-f.ctx.Done():
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxReconnectInterval {
+			backoff = maxReconnectInterval
+		}
+	}
+	level.Info(f.logger).Log("msg", "stopped following primary")
+}
+
+// Stop makes Run return, aborting the current stream, and waits for it to
+// return. Run must have been called.
+func (f *Follower) Stop() {
+	f.cancel()
+	<-f.done
+}
+
+// Describe implements prometheus.Collector.
+func (f *Follower) Describe(ch chan<- *prometheus.Desc) {
+	ch <- followerConnectedDesc
+	ch <- followerAppliedDesc
+	ch <- followerFailedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (f *Follower) Collect(ch chan<- prometheus.Metric) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	connected := 0.
+	if f.connected {
+		connected = 1
+	}
+	ch <- prometheus.MustNewConstMetric(followerConnectedDesc, prometheus.GaugeValue, connected)
+	ch <- prometheus.MustNewConstMetric(followerAppliedDesc, prometheus.CounterValue, float64(f.applied))
+	ch <- prometheus.MustNewConstMetric(followerFailedDesc, prometheus.CounterValue, float64(f.failed))
+}
+
+func (f *Follower) setConnected(connected bool) {
+	f.mtx.Lock()
+	f.connected = connected
+	f.mtx.Unlock()
+}
+
+// follow receives and applies the stream of changes until it ends. Unless the
+// Follower has stopped following, an error is returned then.
+func (f *Follower) follow() error {
+	ctx, cancel := context.WithCancel(f.ctx)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	// The primary sends heartbeats, so a stream without any records for a
+	// while is considered dead.
+	idle := time.AfterFunc(3*heartbeatInterval, cancel)
+	defer idle.Stop()
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %q: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	br := bufio.NewReader(resp.Body)
+	for first := true; ; first = false {
+		record, err := readRecord(br)
+		if err != nil {
+			if ctx.Err() != nil && f.ctx.Err() == nil {
+				return fmt.Errorf("no heartbeat received: %v", err)
+			}
+			return err
+		}
+		idle.Reset(3 * heartbeatInterval)
+		if len(record) == 0 {
+			continue // Heartbeat.
+		}
+		if !f.following() {
+			return nil
+		}
+		wr, err := storage.UnmarshalWriteRequest(record)
+		if err != nil {
+			return fmt.Errorf("invalid change received: %v", err)
+		}
+		if first {
+			if wr.Groups == nil {
+				return fmt.Errorf("stream does not start with a restore")
+			}
+			f.setConnected(true)
+			level.Info(f.logger).Log("msg", "following primary", "groups", len(wr.Groups))
+		}
+		wr.AllowTimestamps = true
+		f.apply(wr)
+	}
+}
+
+// apply submits the provided change to the local MetricStore and waits for it
+// to be processed, so that the changes are applied in order and a follower
+// that cannot keep up is noticed by the primary.
+func (f *Follower) apply(wr storage.WriteRequest) {
+	done := make(chan error, 1)
+	wr.Done = done
+	var failed bool
+	if err := f.ms.SubmitWriteRequest(wr); err != nil {
+		level.Error(f.logger).Log("msg", "could not apply change from primary", "err", err)
+		failed = true
+	} else {
+		for err := range done {
+			level.Warn(f.logger).Log("msg", "change from primary rejected", "err", err)
+			failed = true
+		}
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if failed {
+		f.failed++
+		return
+	}
+	f.applied++
+}
@@ -0,0 +1,323 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cluster replicates changes between Pushgateway instances.
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// ReplicatePath is the path, relative to the base URL of a peer, to which
+// changes are sent.
+const ReplicatePath = "/api/v1/replicate"
+
+const (
+	queueCapacity   = 1000
+	sendAttempts    = 3
+	retryInterval   = time.Second
+	requestTimeout  = 10 * time.Second
+	shutdownTimeout = 5 * time.Second
+)
+
+var (
+	replicatedDesc = prometheus.NewDesc(
+		"pushgateway_replication_sent_total",
+		"Total number of changes successfully sent to a peer.",
+		[]string{"peer"}, nil,
+	)
+	droppedDesc = prometheus.NewDesc(
+		"pushgateway_replication_dropped_total",
+		"Total number of changes that could not be sent to a peer.",
+		[]string{"peer"}, nil,
+	)
+	subscribersDesc = prometheus.NewDesc(
+		"pushgateway_change_stream_subscribers",
+		"Number of followers currently receiving the stream of changes.",
+		nil, nil,
+	)
+)
+
+// Replicator is a storage.MetricStore that forwards every successfully applied
+// WriteRequest to a number of peers, i.e. other Pushgateways. The WriteRequests
+// are applied to the wrapped MetricStore first. Peers receive them in the same
+// order, but asynchronously and on a best-effort basis: A change that cannot be
+// sent to a peer after a few attempts is dropped for that peer.
+//
+// A Replicator also streams the applied WriteRequests to followers, see
+// ServeChanges.
+//
+// A Replicator implements prometheus.Collector to expose metrics about the
+// replication. It is up to the caller to register it.
+type Replicator struct {
+	storage.MetricStore
+	// submitMtx makes sure changes are queued for the peers in the same
+	// order as they are submitted to the wrapped MetricStore.
+	submitMtx sync.Mutex
+	peers     []*peer
+	queue     chan pendingChange
+	done      chan struct{}
+	logger    log.Logger
+
+	subMtx      sync.Mutex
+	subscribers map[*subscriber]struct{}
+	subsClosed  bool // No more subscribers are accepted.
+}
+
+// pendingChange is a change waiting for the wrapped MetricStore to process it.
+type pendingChange struct {
+	record []byte
+	// local is the Done channel of the WriteRequest submitted to the
+	// wrapped MetricStore, orig the Done channel provided by the caller,
+	// nil if the caller has not provided one.
+	local <-chan error
+	orig  chan error
+	// synced is closed by the loop once all changes queued before have
+	// been handed on. Nothing else is set then.
+	synced chan struct{}
+}
+
+// NewReplicator returns a Replicator wrapping the provided MetricStore and
+// replicating to the Pushgateways with the provided base URLs (e.g.
+// "http://pushgateway-2:9091"). The changes are sent with the provided secret
+// shared by all peers, see handler.Replicate. Credentials for basic auth may be
+// included in the URLs.
+func NewReplicator(ms storage.MetricStore, peerURLs []string, secret string, logger log.Logger) (*Replicator, error) {
+	r := &Replicator{
+		MetricStore: ms,
+		queue:       make(chan pendingChange, queueCapacity),
+		done:        make(chan struct{}),
+		logger:      logger,
+		subscribers: map[*subscriber]struct{}{},
+	}
+	client := &http.Client{Timeout: requestTimeout}
+	for _, rawURL := range peerURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer URL %q: %v", rawURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("peer URL %q has to start with http:// or https://", rawURL)
+		}
+		u.Path = strings.TrimRight(u.Path, "/") + ReplicatePath
+		name := u.Host
+		r.peers = append(r.peers, &peer{
+			name:    name,
+			url:     u.String(),
+			secret:  secret,
+			client:  client,
+			changes: make(chan []byte, queueCapacity),
+			done:    make(chan struct{}),
+			logger:  log.With(logger, "peer", name),
+		})
+	}
+	for _, p := range r.peers {
+		go p.loop()
+	}
+	go r.loop()
+	return r, nil
+}
+
+// SubmitWriteRequest implements storage.MetricStore. The WriteRequest is
+// encoded right away, before the wrapped MetricStore gets a chance to modify
+// it. Changes the wrapped MetricStore does not accept are not replicated.
+func (r *Replicator) SubmitWriteRequest(wr storage.WriteRequest) error {
+	if wr.Flush {
+		// Flushing is local only.
+		return r.MetricStore.SubmitWriteRequest(wr)
+	}
+	record, err := storage.MarshalWriteRequest(wr)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "could not encode write request for replication", "err", err)
+		return r.MetricStore.SubmitWriteRequest(wr)
+	}
+	// Always wait for the wrapped MetricStore, so that only successfully
+	// applied changes are handed on.
+	local := make(chan error, 1)
+	pc := pendingChange{record: record, local: local, orig: wr.Done}
+	wr.Done = local
+	r.submitMtx.Lock()
+	defer r.submitMtx.Unlock()
+	if err := r.MetricStore.SubmitWriteRequest(wr); err != nil {
+		return err
+	}
+	r.queue <- pc
+	return nil
+}
+
+// Shutdown implements storage.MetricStore. It ends all streams of changes and
+// waits a bit for pending changes to be sent to the peers before shutting down
+// the wrapped MetricStore.
+func (r *Replicator) Shutdown() error {
+	r.submitMtx.Lock()
+	r.CloseChangeStreams()
+	close(r.queue)
+	r.submitMtx.Unlock()
+	<-r.done
+	timeout := time.After(shutdownTimeout)
+	for _, p := range r.peers {
+		select {
+		case <-p.done:
+		case <-timeout:
+			level.Warn(p.logger).Log("msg", "not all changes sent to peer before shutdown")
+		}
+	}
+	return r.MetricStore.Shutdown()
+}
+
+// Describe implements prometheus.Collector.
+func (r *Replicator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- replicatedDesc
+	ch <- droppedDesc
+	ch <- subscribersDesc
+}
+
+// Collect implements prometheus.Collector.
+func (r *Replicator) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range r.peers {
+		p.mtx.Lock()
+		sent, dropped := p.sent, p.dropped
+		p.mtx.Unlock()
+		ch <- prometheus.MustNewConstMetric(replicatedDesc, prometheus.CounterValue, float64(sent), p.name)
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(dropped), p.name)
+	}
+	r.subMtx.Lock()
+	subscribers := len(r.subscribers)
+	r.subMtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(subscribers))
+}
+
+// loop hands changes to the peers once the wrapped MetricStore has applied them
+// successfully.
+func (r *Replicator) loop() {
+	defer close(r.done)
+	for pc := range r.queue {
+		if pc.synced != nil {
+			close(pc.synced)
+			continue
+		}
+		failed := false
+		for err := range pc.local {
+			failed = true
+			if pc.orig != nil {
+				pc.orig <- err
+			}
+		}
+		if pc.orig != nil {
+			close(pc.orig)
+		}
+		if failed {
+			continue
+		}
+		for _, p := range r.peers {
+			p.enqueue(pc.record)
+		}
+		r.publish(pc.record)
+	}
+	for _, p := range r.peers {
+		close(p.changes)
+	}
+}
+
+// peer sends changes to one other Pushgateway.
+type peer struct {
+	name    string
+	url     string
+	secret  string
+	client  *http.Client
+	changes chan []byte
+	done    chan struct{}
+	logger  log.Logger
+
+	mtx           sync.Mutex
+	sent, dropped int
+}
+
+func (p *peer) enqueue(record []byte) {
+	select {
+	case p.changes <- record:
+	default:
+		p.drop(fmt.Errorf("queue full"))
+	}
+}
+
+func (p *peer) drop(err error) {
+	p.mtx.Lock()
+	p.dropped++
+	p.mtx.Unlock()
+	level.Warn(p.logger).Log("msg", "dropping change for peer", "err", err)
+}
+
+func (p *peer) loop() {
+	defer close(p.done)
+	for record := range p.changes {
+		var (
+			err       error
+			retryable bool
+		)
+		for attempt := 0; attempt < sendAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(retryInterval)
+			}
+			if retryable, err = p.send(record); err == nil || !retryable {
+				break
+			}
+		}
+		if err != nil {
+			p.drop(err)
+			continue
+		}
+		p.mtx.Lock()
+		p.sent++
+		p.mtx.Unlock()
+	}
+}
+
+// send sends the provided record to the peer. If it fails, it returns whether
+// it makes sense to try again, which is not the case if the peer has rejected
+// the change.
+func (p *peer) send(record []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(record))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(handler.PeerSecretHeader, p.secret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(body))
+	return resp.StatusCode >= 500, err
+}
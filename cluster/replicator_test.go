@@ -0,0 +1,148 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+var logger = log.NewNopLogger()
+
+func gauge(name string, v float64) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String("A gauge."),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(v)}},
+		},
+	}
+}
+
+func submit(ms storage.MetricStore, wr storage.WriteRequest) error {
+	errCh := make(chan error, 1)
+	wr.Done = errCh
+	ms.SubmitWriteRequest(wr)
+	var err error
+	for e := range errCh {
+		err = e
+	}
+	return err
+}
+
+// waitFor polls the provided condition until it is true or a second has
+// passed.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestReplicator(t *testing.T) {
+	peerMS := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	mux := http.NewServeMux()
+	mux.Handle(ReplicatePath, handler.Replicate(peerMS, "s3cret", false, logger))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	if _, err := NewReplicator(peerMS, []string{"ftp://example.org"}, "s3cret", logger); err == nil {
+		t.Error("Expected error for invalid peer URL.")
+	}
+
+	localMS := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	r, err := NewReplicator(localMS, []string{server.URL + "/"}, "s3cret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := map[string]string{"job": "job1", "instance": "instance1"}
+	var key string
+	ts := time.Now()
+	if err := submit(r, storage.WriteRequest{
+		Labels:         labels,
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": gauge("mf1", 1), "mf2": gauge("mf2", 2)},
+		TTL:            time.Hour,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var group storage.MetricGroup
+	for k, g := range localMS.GetMetricFamiliesMap() {
+		key, group = k, g
+	}
+	// Two pushed metric families plus the two push timestamps.
+	if expected, got := 4, len(group.Metrics); expected != got {
+		t.Fatalf("Wanted %d metric families locally, got %d.", expected, got)
+	}
+	if !waitFor(func() bool { return len(peerMS.GetMetricFamiliesMap()[key].Metrics) == 4 }) {
+		t.Fatalf("Change not replicated, peer has %v.", peerMS.GetMetricFamiliesMap())
+	}
+	peerGroup := peerMS.GetMetricFamiliesMap()[key]
+	if expected, got := group.LastPushTime(), peerGroup.LastPushTime(); !expected.Equal(got) {
+		t.Errorf("Wanted last push time %v on peer, got %v.", expected, got)
+	}
+	if expected, got := ts.Add(time.Hour), peerGroup.Metrics["mf1"].Expiration(); !expected.Equal(got) {
+		t.Errorf("Wanted expiration %v on peer, got %v.", expected, got)
+	}
+
+	// A rejected change is not replicated.
+	bad := gauge("mf1", 3)
+	bad.Type = dto.MetricType_COUNTER.Enum()
+	bad.Metric[0].Gauge = nil
+	bad.Metric[0].Counter = &dto.Counter{Value: proto.Float64(3)}
+	if err := submit(r, storage.WriteRequest{
+		Labels:         map[string]string{"job": "job2"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": bad},
+	}); err == nil {
+		t.Error("Expected error for inconsistent push.")
+	}
+
+	// Deleting a metric family is replicated.
+	if err := submit(r, storage.WriteRequest{
+		Labels:      labels,
+		Timestamp:   ts,
+		MetricNames: []string{"mf2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { return len(peerMS.GetMetricFamiliesMap()[key].Metrics) == 3 }) {
+		t.Errorf("Deletion not replicated, peer has %v.", peerMS.GetMetricFamiliesMap()[key].Metrics)
+	}
+	if expected, got := 1, len(peerMS.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d groups on peer, got %d.", expected, got)
+	}
+
+	if err := r.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := peerMS.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
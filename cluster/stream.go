@@ -0,0 +1,208 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// ChangesPath is the path, relative to the base URL of a Pushgateway, from
+// which its changes are streamed, see ServeChanges.
+const ChangesPath = "/api/v1/changes"
+
+// maxRecordSize is the maximum size of a record in the stream of changes
+// accepted by a Follower. The first record holds all groups, so it is large.
+const maxRecordSize = 1 << 30
+
+// heartbeatInterval is the interval at which an empty record is sent to
+// followers while there are no changes. It is a variable for testing.
+var heartbeatInterval = 10 * time.Second
+
+// errStreamsClosed is returned by subscribe once CloseChangeStreams has been
+// called.
+var errStreamsClosed = errors.New("change streams closed")
+
+// subscriber is a follower receiving the stream of changes.
+type subscriber struct {
+	// changes is closed by the Replicator if the follower cannot keep up
+	// or the change streams are closed.
+	changes chan []byte
+}
+
+// subscribe registers a new subscriber and returns it together with the
+// current content of the wrapped MetricStore, to which exactly the changes
+// sent to the subscriber have to be applied to stay in sync with it.
+func (r *Replicator) subscribe() (*subscriber, storage.GroupingKeyToMetricGroup, error) {
+	// Holding submitMtx, no changes are submitted in the meantime. Once
+	// synced, all changes submitted before have been applied and handed
+	// on.
+	r.submitMtx.Lock()
+	defer r.submitMtx.Unlock()
+	r.subMtx.Lock()
+	closed := r.subsClosed
+	r.subMtx.Unlock()
+	if closed {
+		return nil, nil, errStreamsClosed
+	}
+	synced := make(chan struct{})
+	r.queue <- pendingChange{synced: synced}
+	<-synced
+
+	s := &subscriber{changes: make(chan []byte, queueCapacity)}
+	groups := r.MetricStore.GetMetricFamiliesMap()
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	if r.subsClosed {
+		return nil, nil, errStreamsClosed
+	}
+	r.subscribers[s] = struct{}{}
+	return s, groups, nil
+}
+
+// unsubscribe removes the provided subscriber, if it has not been removed yet,
+// and closes its channel.
+func (r *Replicator) unsubscribe(s *subscriber) {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	if _, ok := r.subscribers[s]; ok {
+		delete(r.subscribers, s)
+		close(s.changes)
+	}
+}
+
+// publish sends the provided record to all subscribers. A subscriber that
+// cannot keep up is removed, so that it has to subscribe anew, starting over
+// with the current content of the MetricStore.
+func (r *Replicator) publish(record []byte) {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	for s := range r.subscribers {
+		select {
+		case s.changes <- record:
+		default:
+			level.Warn(r.logger).Log("msg", "follower cannot keep up with the changes, closing its stream")
+			delete(r.subscribers, s)
+			close(s.changes)
+		}
+	}
+}
+
+// CloseChangeStreams ends all streams of changes and rejects new ones. It is
+// meant to be called upon shutdown, before the Replicator is shut down, so that
+// the streams do not keep the HTTP server from shutting down.
+func (r *Replicator) CloseChangeStreams() {
+	r.subMtx.Lock()
+	defer r.subMtx.Unlock()
+	r.subsClosed = true
+	for s := range r.subscribers {
+		delete(r.subscribers, s)
+		close(s.changes)
+	}
+}
+
+// ServeChanges streams the changes applied by the Replicator to a follower, see
+// Follower. The stream is a sequence of records, each of them a uvarint length
+// followed by a WriteRequest encoded with storage.MarshalWriteRequest. The first
+// record restores the current content of the wrapped MetricStore, the following
+// ones are the changes applied afterwards. While there are no changes, empty
+// records are sent as heartbeats. The stream ends if the follower cannot keep
+// up, so that it has to start over.
+func (r *Replicator) ServeChanges(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	s, groups, err := r.subscribe()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer r.unsubscribe(s)
+	snapshot, err := storage.MarshalWriteRequest(storage.WriteRequest{
+		Timestamp: time.Now(),
+		Groups:    groups,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	level.Info(r.logger).Log("msg", "follower subscribed to changes", "source", req.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	bw := bufio.NewWriter(w)
+	send := func(record []byte) error {
+		var l [binary.MaxVarintLen64]byte
+		if _, err := bw.Write(l[:binary.PutUvarint(l[:], uint64(len(record)))]); err != nil {
+			return err
+		}
+		if _, err := bw.Write(record); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := send(snapshot); err != nil {
+		return
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		var record []byte
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+		case change, ok := <-s.changes:
+			if !ok {
+				level.Info(r.logger).Log("msg", "stream of changes closed", "source", req.RemoteAddr)
+				return
+			}
+			record = change
+		}
+		if err := send(record); err != nil {
+			level.Debug(r.logger).Log("msg", "could not send change to follower", "source", req.RemoteAddr, "err", err)
+			return
+		}
+	}
+}
+
+// readRecord reads a record as written by ServeChanges.
+func readRecord(br *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes too large", l)
+	}
+	record := make([]byte, l)
+	if _, err := io.ReadFull(br, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
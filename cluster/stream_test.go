@@ -0,0 +1,148 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestFollower(t *testing.T) {
+	primaryMS := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	r, err := NewReplicator(primaryMS, nil, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(ChangesPath, r.ServeChanges)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// Pushed before the follower connects, so it is part of the restore.
+	ts := time.Now()
+	if err := submit(r, storage.WriteRequest{
+		Labels:         map[string]string{"job": "job1"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": gauge("mf1", 1)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFollower(primaryMS, "ftp://example.org", func() bool { return true }, logger); err == nil {
+		t.Error("Expected error for invalid URL.")
+	}
+	followerMS := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	// Stale content is replaced by the restore.
+	if err := submit(followerMS, storage.WriteRequest{
+		Labels:         map[string]string{"job": "stale"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf1": gauge("mf1", 0)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var following int32 = 1
+	f, err := NewFollower(followerMS, server.URL+"/", func() bool { return atomic.LoadInt32(&following) == 1 }, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Run()
+	defer f.Stop()
+
+	groups := func() map[string]int {
+		result := map[string]int{}
+		for _, g := range followerMS.GetMetricFamiliesMap() {
+			result[g.Labels["job"]] = len(g.Metrics)
+		}
+		return result
+	}
+	// One pushed metric family plus the two push timestamps.
+	if !waitFor(func() bool { m := groups(); return len(m) == 1 && m["job1"] == 3 }) {
+		t.Fatalf("Not synced, follower has %v.", groups())
+	}
+
+	// Changes applied afterwards are streamed, rejected ones are not.
+	if err := submit(r, storage.WriteRequest{
+		Labels:         map[string]string{"job": "job2"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": gauge("mf2", 2)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	bad := gauge("mf2", 3)
+	bad.Type = dto.MetricType_COUNTER.Enum()
+	bad.Metric[0].Gauge = nil
+	bad.Metric[0].Counter = &dto.Counter{Value: proto.Float64(3)}
+	if err := submit(r, storage.WriteRequest{
+		Labels:         map[string]string{"job": "job3"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": bad},
+	}); err == nil {
+		t.Error("Expected error for inconsistent push.")
+	}
+	if err := submit(r, storage.WriteRequest{
+		Labels:    map[string]string{"job": "job1"},
+		Timestamp: ts,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool { m := groups(); return len(m) == 1 && m["job2"] == 3 }) {
+		t.Fatalf("Changes not streamed, follower has %v.", groups())
+	}
+	f.mtx.Lock()
+	applied, failed, connected := f.applied, f.failed, f.connected
+	f.mtx.Unlock()
+	if expected, got := 3, applied; expected != got || failed != 0 || !connected {
+		t.Errorf("Wanted %d applied changes, got %d (failed: %d, connected: %v).", expected, got, failed, connected)
+	}
+
+	// Once promoted, the follower ignores the primary.
+	atomic.StoreInt32(&following, 0)
+	if err := submit(r, storage.WriteRequest{
+		Labels:         map[string]string{"job": "job4"},
+		Timestamp:      ts,
+		MetricFamilies: map[string]*dto.MetricFamily{"mf2": gauge("mf2", 4)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool {
+		r.subMtx.Lock()
+		defer r.subMtx.Unlock()
+		return len(r.subscribers) == 0
+	}) {
+		t.Error("Follower still subscribed after promotion.")
+	}
+	if expected, got := 1, len(groups()); expected != got {
+		t.Errorf("Wanted %d groups on promoted follower, got %d.", expected, got)
+	}
+
+	if err := r.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.subscribe(); err != errStreamsClosed {
+		t.Errorf("Wanted %v after shutdown, got %v.", errStreamsClosed, err)
+	}
+	if err := followerMS.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,420 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package graphite accepts metrics in the Graphite plaintext protocol and
+// stores them in the Pushgateway, to help migrating off Graphite.
+package graphite
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/ingest"
+	"github.com/prometheus/pushgateway/internal/lineserver"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// ActionDrop is the Action of a Mapping dropping the matching lines.
+const ActionDrop = "drop"
+
+var (
+	linesDesc = prometheus.NewDesc(
+		"pushgateway_graphite_lines_total",
+		"Total number of Graphite lines received.",
+		nil, nil,
+	)
+	invalidLinesDesc = prometheus.NewDesc(
+		"pushgateway_graphite_invalid_lines_total",
+		"Total number of Graphite lines that could not be parsed or mapped.",
+		nil, nil,
+	)
+)
+
+// Mapping maps Graphite metric paths matching a template to a metric name,
+// labels, and grouping labels. In Match, a component of the dotted path
+// consisting of "*" matches any single component of the metric path. The
+// matched components can be referenced as $1, $2, ... (or ${1}, ...) in Name
+// and in the values of Labels and Grouping.
+type Mapping struct {
+	Match    string            `yaml:"match"`
+	Name     string            `yaml:"name"`
+	Labels   map[string]string `yaml:"labels"`
+	Grouping map[string]string `yaml:"grouping"`
+	// Action is empty or ActionDrop.
+	Action string `yaml:"action"`
+
+	components []string
+}
+
+// MappingConfig is the content of the file provided with
+// --graphite.mapping-file.
+type MappingConfig struct {
+	Mappings []*Mapping `yaml:"mappings"`
+}
+
+// LoadMappingFile reads and validates a MappingConfig from the provided YAML
+// file.
+func LoadMappingFile(file string) (*MappingConfig, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &MappingConfig{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse Graphite mapping file %q: %v", file, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%v in Graphite mapping file %q", err, file)
+	}
+	return cfg, nil
+}
+
+// validate returns an error if a Mapping has no template, an invalid action,
+// neither a name nor the drop action, or invalid label names. Labels must not
+// be named like a grouping label (including job and instance, which every
+// group has).
+func (cfg *MappingConfig) validate() error {
+	for _, m := range cfg.Mappings {
+		if m == nil || m.Match == "" {
+			return errors.New("mapping without match")
+		}
+		switch {
+		case m.Action != "" && m.Action != ActionDrop:
+			return fmt.Errorf("invalid action %q for mapping %q", m.Action, m.Match)
+		case m.Action == "" && m.Name == "":
+			return fmt.Errorf("no name for mapping %q", m.Match)
+		}
+		for name := range m.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				return fmt.Errorf("invalid label name %q for mapping %q", name, m.Match)
+			}
+			if _, ok := m.Grouping[name]; ok || name == "job" || name == "instance" {
+				return fmt.Errorf("label %q would be overwritten by the grouping labels for mapping %q", name, m.Match)
+			}
+		}
+		for name := range m.Grouping {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				return fmt.Errorf("invalid grouping label name %q for mapping %q", name, m.Match)
+			}
+		}
+		m.components = strings.Split(m.Match, ".")
+	}
+	return nil
+}
+
+// match returns the components of path matched by the "*" components of the
+// Mapping, or false if path does not match.
+func (m *Mapping) match(path []string) ([]string, bool) {
+	if len(path) != len(m.components) {
+		return nil, false
+	}
+	var captures []string
+	for i, c := range m.components {
+		switch c {
+		case "*":
+			captures = append(captures, path[i])
+		case path[i]:
+		default:
+			return nil, false
+		}
+	}
+	return captures, true
+}
+
+// Options configure a Listener.
+type Options struct {
+	// Job is the job label of the groups the metrics are stored in unless
+	// the Mapping sets a job grouping label.
+	Job string
+	// Mappings are tried in order. The first matching one is applied.
+	// Metric paths without a matching Mapping are stored under their path
+	// with the dots (and any other characters invalid in metric names)
+	// replaced by '_', without labels, in the group of Job alone.
+	Mappings []*Mapping
+	// TTL is how long a series is kept after its last line. Its group is
+	// submitted with the same TTL, so that the group is removed once no
+	// lines have been received for any of its series for that long. Zero
+	// means forever.
+	TTL time.Duration
+	// FlushInterval is the interval at which the received lines are
+	// submitted to the MetricStore.
+	FlushInterval time.Duration
+}
+
+// series is the last value received for one series.
+type series struct {
+	labels []*dto.LabelPair
+	value  float64
+	seen   time.Time
+}
+
+// group holds the series of one metric group by metric name and label
+// signature.
+type group struct {
+	labels  map[string]string
+	series  map[string]map[uint64]*series
+	changed bool
+}
+
+// Listener receives lines in the Graphite plaintext protocol (i.e. "path value
+// timestamp") via TCP and UDP, maps them according to its Options, and
+// submits the groups that have changed to a MetricStore at the configured
+// flush interval. As Graphite has no metric types, all metrics are stored as
+// gauges. The timestamps of the lines are ignored. Each submission replaces
+// the whole group with the last value received for each of its series.
+//
+// A Listener implements prometheus.Collector to expose metrics about the
+// received lines. It is up to the caller to register it.
+type Listener struct {
+	ms     storage.MetricStore
+	o      Options
+	server *lineserver.Server
+	stop   chan struct{}
+	done   chan struct{}
+	logger log.Logger
+
+	mtx     sync.Mutex // Protects the fields below.
+	groups  map[uint64]*group
+	lines   int
+	invalid int
+}
+
+// NewListener returns a Listener listening on the provided address (e.g.
+// ":2003") for both TCP and UDP, which starts receiving and flushing in the
+// background until Close is called. The Mappings in the Options must be
+// validated already, see LoadMappingFile.
+func NewListener(ms storage.MetricStore, address string, o Options, logger log.Logger) (*Listener, error) {
+	l := &Listener{
+		ms:     ms,
+		o:      o,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: logger,
+		groups: map[uint64]*group{},
+	}
+	var err error
+	if l.server, err = lineserver.Listen(address, l.handleLine, logger); err != nil {
+		return nil, err
+	}
+	go l.loop()
+	return l, nil
+}
+
+// Close stops listening and flushes the lines received so far one last time,
+// so that the MetricStore can be shut down afterwards.
+func (l *Listener) Close() {
+	l.server.Close()
+	close(l.stop)
+	<-l.done
+	l.flush(time.Now())
+}
+
+// Describe implements prometheus.Collector.
+func (l *Listener) Describe(ch chan<- *prometheus.Desc) {
+	ch <- linesDesc
+	ch <- invalidLinesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (l *Listener) Collect(ch chan<- prometheus.Metric) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(linesDesc, prometheus.CounterValue, float64(l.lines))
+	ch <- prometheus.MustNewConstMetric(invalidLinesDesc, prometheus.CounterValue, float64(l.invalid))
+}
+
+func (l *Listener) loop() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.o.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			l.flush(now)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// handleLine parses and maps the provided line and records its value.
+func (l *Listener) handleLine(line string) {
+	name, labels, grouping, value, err := l.parseLine(line)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.lines++
+	if err != nil {
+		l.invalid++
+		level.Debug(l.logger).Log("msg", "invalid Graphite line", "line", line, "err", err)
+		return
+	}
+	if grouping == nil {
+		return // Dropped.
+	}
+	key := model.LabelsToSignature(grouping)
+	g, ok := l.groups[key]
+	if !ok {
+		g = &group{labels: grouping, series: map[string]map[uint64]*series{}}
+		l.groups[key] = g
+	}
+	byLabels, ok := g.series[name]
+	if !ok {
+		byLabels = map[uint64]*series{}
+		g.series[name] = byLabels
+	}
+	sig := model.LabelsToSignature(labels)
+	s, ok := byLabels[sig]
+	if !ok {
+		s = &series{labels: ingest.LabelPairs(labels)}
+		byLabels[sig] = s
+	}
+	s.value = value
+	s.seen = time.Now()
+	g.changed = true
+}
+
+// parseLine returns the metric name, labels, grouping labels, and value of the
+// provided line. The grouping labels are nil if the line is to be dropped.
+func (l *Listener) parseLine(line string) (string, map[string]string, map[string]string, float64, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return "", nil, nil, 0, errors.New("expected a metric path, a value, and optionally a timestamp")
+	}
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", nil, nil, 0, fmt.Errorf("invalid value %q", fields[1])
+	}
+	path := strings.Split(fields[0], ".")
+	for _, m := range l.o.Mappings {
+		captures, ok := m.match(path)
+		if !ok {
+			continue
+		}
+		if m.Action == ActionDrop {
+			return "", nil, nil, 0, nil
+		}
+		expand := func(s string) string {
+			return os.Expand(s, func(ref string) string {
+				i, err := strconv.Atoi(ref)
+				if err != nil || i < 1 || i > len(captures) {
+					return ""
+				}
+				return captures[i-1]
+			})
+		}
+		name := expand(m.Name)
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return "", nil, nil, 0, fmt.Errorf("invalid metric name %q from mapping %q", name, m.Match)
+		}
+		labels := make(map[string]string, len(m.Labels))
+		for n, v := range m.Labels {
+			labels[n] = expand(v)
+		}
+		grouping := map[string]string{"job": l.o.Job}
+		for n, v := range m.Grouping {
+			grouping[n] = expand(v)
+		}
+		if grouping["job"] == "" {
+			return "", nil, nil, 0, fmt.Errorf("empty job label from mapping %q", m.Match)
+		}
+		return name, labels, grouping, value, nil
+	}
+	return ingest.MetricName(fields[0]), map[string]string{}, map[string]string{"job": l.o.Job}, value, nil
+}
+
+// flush drops the series not received within the TTL before the provided time
+// and submits the groups that have changed to the MetricStore, waiting for it
+// to process them. Groups left without series are deleted.
+func (l *Listener) flush(now time.Time) {
+	var wrs []storage.WriteRequest
+	l.mtx.Lock()
+	for key, g := range l.groups {
+		if l.o.TTL > 0 {
+			for name, byLabels := range g.series {
+				for sig, s := range byLabels {
+					if now.Sub(s.seen) > l.o.TTL {
+						delete(byLabels, sig)
+						g.changed = true
+					}
+				}
+				if len(byLabels) == 0 {
+					delete(g.series, name)
+				}
+			}
+		}
+		if !g.changed {
+			continue
+		}
+		g.changed = false
+		wr := storage.WriteRequest{
+			Labels:    ingest.CopyLabels(g.labels),
+			Timestamp: now,
+		}
+		if len(g.series) == 0 {
+			delete(l.groups, key)
+		} else {
+			wr.MetricFamilies = metricFamilies(g.series)
+			wr.Replace = true
+			wr.TTL = l.o.TTL
+		}
+		wrs = append(wrs, wr)
+	}
+	l.mtx.Unlock()
+
+	for _, wr := range wrs {
+		errCh := make(chan error, 1)
+		wr.Done = errCh
+		if err := l.ms.SubmitWriteRequest(wr); err != nil {
+			level.Warn(l.logger).Log("msg", "could not submit Graphite metrics", "group", fmt.Sprint(wr.Labels), "err", err)
+			continue
+		}
+		for err := range errCh {
+			level.Warn(l.logger).Log("msg", "Graphite metrics rejected", "group", fmt.Sprint(wr.Labels), "err", err)
+		}
+	}
+}
+
+// metricFamilies converts the provided series into gauge MetricFamilies.
+func metricFamilies(byName map[string]map[uint64]*series) map[string]*dto.MetricFamily {
+	mfs := make(map[string]*dto.MetricFamily, len(byName))
+	for name, byLabels := range byName {
+		mf := &dto.MetricFamily{
+			Name: proto.String(name),
+			Help: proto.String("Received via Graphite."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		for _, s := range byLabels {
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: s.labels,
+				Gauge: &dto.Gauge{Value: proto.Float64(s.value)},
+			})
+		}
+		mfs[name] = mf
+	}
+	return mfs
+}
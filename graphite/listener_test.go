@@ -0,0 +1,177 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestMappingValidation(t *testing.T) {
+	for name, s := range map[string]struct {
+		m       Mapping
+		wantErr string
+	}{
+		"valid":          {m: Mapping{Match: "a.*", Name: "a", Labels: map[string]string{"x": "$1"}, Grouping: map[string]string{"instance": "$1"}}},
+		"drop":           {m: Mapping{Match: "a.*", Action: ActionDrop}},
+		"no match":       {m: Mapping{Name: "a"}, wantErr: "without match"},
+		"no name":        {m: Mapping{Match: "a.*"}, wantErr: "no name"},
+		"bad action":     {m: Mapping{Match: "a.*", Action: "keep"}, wantErr: "invalid action"},
+		"bad label":      {m: Mapping{Match: "a.*", Name: "a", Labels: map[string]string{"__x": "y"}}, wantErr: "invalid label name"},
+		"grouping label": {m: Mapping{Match: "a.*", Name: "a", Labels: map[string]string{"instance": "y"}}, wantErr: "overwritten"},
+	} {
+		m := s.m
+		err := (&MappingConfig{Mappings: []*Mapping{&m}}).validate()
+		if s.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: Unexpected error: %v", name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), s.wantErr) {
+			t.Errorf("%s: Wanted error containing %q, got %v.", name, s.wantErr, err)
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	cfg := &MappingConfig{Mappings: []*Mapping{
+		{Match: "servers.*.debug.*", Action: ActionDrop},
+		{
+			Match:    "servers.*.cpu.*",
+			Name:     "cpu_${2}_percent",
+			Labels:   map[string]string{"core": "$2"},
+			Grouping: map[string]string{"job": "servers", "instance": "$1"},
+		},
+	}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	l := &Listener{o: Options{Job: "graphite", Mappings: cfg.Mappings}}
+
+	for line, s := range map[string]struct {
+		name     string
+		labels   map[string]string
+		grouping map[string]string
+		value    float64
+		wantErr  bool
+	}{
+		"servers.web1.cpu.user 12.5 1600000000": {
+			name:     "cpu_user_percent",
+			labels:   map[string]string{"core": "user"},
+			grouping: map[string]string{"job": "servers", "instance": "web1"},
+			value:    12.5,
+		},
+		"servers.web1.debug.x 1": {},
+		"app.req-count 3": {
+			name:     "app_req_count",
+			labels:   map[string]string{},
+			grouping: map[string]string{"job": "graphite"},
+			value:    3,
+		},
+		"app.requests":     {wantErr: true},
+		"app.requests x 1": {wantErr: true},
+	} {
+		name, labels, grouping, value, err := l.parseLine(line)
+		if s.wantErr {
+			if err == nil {
+				t.Errorf("%q: Expected error.", line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %v", line, err)
+			continue
+		}
+		if name != s.name || value != s.value || !reflect.DeepEqual(labels, s.labels) || !reflect.DeepEqual(grouping, s.grouping) {
+			t.Errorf("%q: Wanted %s%v in %v = %v, got %s%v in %v = %v.", line, s.name, s.labels, s.grouping, s.value, name, labels, grouping, value)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, log.NewNopLogger())
+	defer ms.Shutdown()
+	l, err := NewListener(ms, "127.0.0.1:0", Options{
+		Job:           "graphite",
+		TTL:           time.Minute,
+		FlushInterval: time.Hour,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", l.server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("app.a 1\napp.b 2 1600000000\napp.a 3\n")); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		l.mtx.Lock()
+		lines := l.lines
+		l.mtx.Unlock()
+		if lines == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d of 3 lines handled.", lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.Close()
+
+	labels := map[string]string{"job": "graphite"}
+	group, ok := storage.GetMetricGroup(ms, labels)
+	if !ok {
+		t.Fatal("Group not found.")
+	}
+	if expected, got := 3.0, group.Metrics["app_a"].GetMetricFamily().GetMetric()[0].GetGauge().GetValue(); expected != got {
+		t.Errorf("Wanted app_a %v, got %v.", expected, got)
+	}
+	if expected, got := time.Minute, group.Metrics["app_b"].TTL; expected != got {
+		t.Errorf("Wanted TTL %v, got %v.", expected, got)
+	}
+
+	// Series not received within the TTL are dropped, and the group is
+	// deleted once it has none left.
+	l.handleLine("app.a 4")
+	l.mtx.Lock()
+	for _, g := range l.groups {
+		for _, s := range g.series["app_b"] {
+			s.seen = s.seen.Add(-2 * time.Minute)
+		}
+	}
+	l.mtx.Unlock()
+	l.flush(time.Now())
+	group, _ = storage.GetMetricGroup(ms, labels)
+	if _, ok := group.Metrics["app_b"]; ok {
+		t.Error("Expired series app_b still stored.")
+	}
+	if expected, got := 4.0, group.Metrics["app_a"].GetMetricFamily().GetMetric()[0].GetGauge().GetValue(); expected != got {
+		t.Errorf("Wanted app_a %v, got %v.", expected, got)
+	}
+	l.flush(time.Now().Add(2 * time.Minute))
+	if _, ok := storage.GetMetricGroup(ms, labels); ok {
+		t.Error("Group without series still stored.")
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package grpcapi serves the PushService defined in push.proto, which accepts
+// pushes via gRPC. The messages and the service are generated from push.proto.
+package grpcapi
+
+// CLIENT_MODEL_PROTO has to name a directory containing
+// io/prometheus/client/metrics.proto from github.com/prometheus/client_model.
+//go:generate protoc -I .. -I $CLIENT_MODEL_PROTO --go_out=paths=source_relative:.. --go-grpc_out=paths=source_relative:.. grpcapi/push.proto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/internal/codec"
+)
+
+// ServiceName is the fully qualified name of the PushService.
+const ServiceName = "pushgateway.PushService"
+
+// server implements the PushService by translating every call into a request
+// to the HTTP handler of the Pushgateway. Thereby, gRPC calls are subject to the
+// same authentication, ACLs, rate limits, relabeling, and consistency checks as
+// the corresponding HTTP requests.
+type server struct {
+	UnimplementedPushServiceServer
+
+	handler  http.Handler
+	pushPath string
+	logger   log.Logger
+}
+
+// NewServer returns a gRPC server with the PushService registered. The calls
+// are passed on as requests below pushPath to h, e.g. a Push call for the group
+// {job="foo"} as a POST request to <pushPath>/job@base64/Zm9v. The credentials
+// from the "authorization" metadata, the address of the peer, and its TLS
+// state (if any) are passed on, too.
+func NewServer(h http.Handler, pushPath string, logger log.Logger, opts ...grpc.ServerOption) *grpc.Server {
+	srv := grpc.NewServer(opts...)
+	RegisterPushServiceServer(srv, &server{handler: h, pushPath: pushPath, logger: logger})
+	return srv
+}
+
+// Handler returns a handler passing gRPC requests (HTTP/2 requests with a
+// content type of application/grpc) on to srv and all other requests on to
+// next, so that gRPC can be served on the same port as HTTP. For plaintext
+// HTTP/2, the returned handler has to be wrapped with h2c.NewHandler.
+func Handler(srv *grpc.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			srv.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) Push(ctx context.Context, req *PushRequest) (*PushResponse, error) {
+	path, err := s.groupPath(req.GetGrouping())
+	if err != nil {
+		return nil, err
+	}
+	var body bytes.Buffer
+	enc := codec.NewEncoder(&body, codec.ProtoDelim)
+	for _, mf := range req.GetMetricFamily() {
+		if err := enc.Encode(mf); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	method := http.MethodPost
+	if req.GetReplace() {
+		method = http.MethodPut
+	}
+	r := s.newRequest(ctx, method, path, &body)
+	r.Header.Set("Content-Type", string(codec.ProtoDelim))
+	if _, err := s.serve(r); err != nil {
+		return nil, err
+	}
+	return &PushResponse{}, nil
+}
+
+func (s *server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	path, err := s.groupPath(req.GetGrouping())
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range req.GetMetricName() {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid metric name %q", name)
+		}
+		path += "/" + handler.MetricNameSegment + "/" + name
+	}
+	if _, err := s.serve(s.newRequest(ctx, http.MethodDelete, path, nil)); err != nil {
+		return nil, err
+	}
+	return &DeleteResponse{}, nil
+}
+
+func (s *server) GetGroup(ctx context.Context, req *GetGroupRequest) (*Group, error) {
+	path, err := s.groupPath(req.GetGrouping())
+	if err != nil {
+		return nil, err
+	}
+	r := s.newRequest(ctx, http.MethodGet, path, nil)
+	r.Header.Set("Accept", string(codec.ProtoDelim))
+	body, err := s.serve(r)
+	if err != nil {
+		return nil, err
+	}
+	group := &Group{Grouping: req.GetGrouping()}
+	dec := codec.NewDecoder(body, codec.ProtoDelim)
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				return group, nil
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		group.MetricFamily = append(group.MetricFamily, mf)
+	}
+}
+
+// groupPath returns the path of the group with the provided grouping labels
+// below the push path. All label values are base64-encoded so that they may
+// contain any character. If a label name is repeated, the last value wins.
+func (s *server) groupPath(labels []*dto.LabelPair) (string, error) {
+	grouping := make(map[string]string, len(labels))
+	for _, lp := range labels {
+		grouping[lp.GetName()] = lp.GetValue()
+	}
+	if grouping["job"] == "" {
+		return "", status.Error(codes.InvalidArgument, "job name is required")
+	}
+	path := s.pushPath + "/job" + handler.Base64Suffix + "/" + encodeBase64(grouping["job"])
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		if name != "job" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path += "/" + name + handler.Base64Suffix + "/" + encodeBase64(grouping[name])
+	}
+	return path, nil
+}
+
+// encodeBase64 encodes the provided label value for the URL path. The empty
+// value is encoded as "=" as an empty path component is not allowed.
+func encodeBase64(s string) string {
+	if s == "" {
+		return "="
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// newRequest returns the HTTP request for a call, carrying the credentials and
+// the peer information of the call.
+func (s *server) newRequest(ctx context.Context, method, path string, body io.Reader) *http.Request {
+	// The method is valid and the path has been assembled from a valid
+	// prefix and escaped components, so there cannot be an error.
+	r, _ := http.NewRequest(method, path, body)
+	r = r.WithContext(ctx)
+	if r.Body == nil {
+		// Like for server requests, the body is always non-nil.
+		r.Body = http.NoBody
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, auth := range md.Get("authorization") {
+			r.Header.Add("Authorization", auth)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := info.State
+			r.TLS = &state
+		}
+	}
+	return r
+}
+
+// serve passes the provided request on to the HTTP handler and returns the
+// response body. Error responses are turned into a gRPC status error.
+func (s *server) serve(r *http.Request) (*bytes.Buffer, error) {
+	rw := &responseWriter{header: http.Header{}, code: http.StatusOK}
+	s.handler.ServeHTTP(rw, r)
+	if rw.code < 300 {
+		return &rw.body, nil
+	}
+	msg := strings.TrimSpace(rw.body.String())
+	level.Debug(s.logger).Log("msg", "gRPC call failed", "method", r.Method, "path", r.URL.Path, "status", rw.code, "err", msg)
+	return nil, status.Error(codeFor(rw.code), msg)
+}
+
+// codeFor returns the gRPC status code corresponding to the provided HTTP
+// status code of an error response.
+func codeFor(httpCode int) codes.Code {
+	switch httpCode {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusRequestTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
+
+// responseWriter records the response of the HTTP handler.
+type responseWriter struct {
+	header      http.Header
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *responseWriter) Header() http.Header { return rw.header }
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.code = code
+	rw.wroteHeader = true
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	return rw.body.Write(b)
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var mf = &dto.MetricFamily{
+	Name: proto.String("some_metric"),
+	Type: dto.MetricType_GAUGE.Enum(),
+	Metric: []*dto.Metric{
+		{Gauge: &dto.Gauge{Value: proto.Float64(3.14)}},
+	},
+}
+
+// grouping returns the provided grouping labels as LabelPairs.
+func grouping(labels ...string) []*dto.LabelPair {
+	var lps []*dto.LabelPair
+	for i := 0; i < len(labels); i += 2 {
+		lps = append(lps, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return lps
+}
+
+// recordedRequest is what the fake HTTP handler saw of a request.
+type recordedRequest struct {
+	method, path, auth string
+	body               []byte
+}
+
+func TestServer(t *testing.T) {
+	var (
+		last       recordedRequest
+		statusCode = http.StatusOK
+	)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		last = recordedRequest{r.Method, r.URL.Path, r.Header.Get("Authorization"), body}
+		if statusCode != http.StatusOK {
+			http.Error(w, "nope", statusCode)
+			return
+		}
+		if r.Method == http.MethodGet {
+			pbutil.WriteDelimited(w, mf)
+		}
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(h, "/metrics", log.NewNopLogger())
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, l.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+	client := NewPushServiceClient(conn)
+
+	if _, err := client.Push(ctx, &PushRequest{
+		Grouping:     grouping("job", "foo", "instance", "a/b", "empty", ""),
+		MetricFamily: []*dto.MetricFamily{mf},
+		Replace:      true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := http.MethodPut, last.method; expected != got {
+		t.Errorf("Wanted method %q, got %q.", expected, got)
+	}
+	if expected, got := "/metrics/job@base64/Zm9v/empty@base64/=/instance@base64/YS9i", last.path; expected != got {
+		t.Errorf("Wanted path %q, got %q.", expected, got)
+	}
+	if expected, got := "Bearer secret", last.auth; expected != got {
+		t.Errorf("Wanted authorization %q, got %q.", expected, got)
+	}
+	pushed := &dto.MetricFamily{}
+	if _, err := pbutil.ReadDelimited(bytes.NewReader(last.body), pushed); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(mf, pushed) {
+		t.Errorf("Wanted pushed metric family %v, got %v.", mf, pushed)
+	}
+
+	if _, err := client.Delete(ctx, &DeleteRequest{Grouping: grouping("job", "foo"), MetricName: []string{"some_metric"}}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := http.MethodDelete, last.method; expected != got {
+		t.Errorf("Wanted method %q, got %q.", expected, got)
+	}
+	if expected, got := "/metrics/job@base64/Zm9v/@metric/some_metric", last.path; expected != got {
+		t.Errorf("Wanted path %q, got %q.", expected, got)
+	}
+
+	group, err := client.GetGroup(ctx, &GetGroupRequest{Grouping: grouping("job", "foo")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group.GetGrouping()) != 1 || group.GetGrouping()[0].GetValue() != "foo" {
+		t.Errorf("Wanted grouping job=foo, got %v.", group.GetGrouping())
+	}
+	if len(group.GetMetricFamily()) != 1 || !proto.Equal(mf, group.GetMetricFamily()[0]) {
+		t.Errorf("Wanted metric family %v, got %v.", mf, group.GetMetricFamily())
+	}
+
+	// Invalid calls are rejected without reaching the handler.
+	last = recordedRequest{}
+	_, pushErr := client.Push(ctx, &PushRequest{Grouping: grouping("instance", "a")})
+	_, deleteErr := client.Delete(ctx, &DeleteRequest{Grouping: grouping("job", "foo"), MetricName: []string{"not a name"}})
+	for _, err := range []error{pushErr, deleteErr} {
+		if expected, got := codes.InvalidArgument, status.Code(err); expected != got {
+			t.Errorf("Wanted code %s, got %s.", expected, got)
+		}
+	}
+	if last.method != "" {
+		t.Errorf("Unexpected request %v.", last)
+	}
+
+	// Error responses are translated into status codes.
+	for httpCode, code := range map[int]codes.Code{
+		http.StatusForbidden:          codes.PermissionDenied,
+		http.StatusConflict:           codes.Aborted,
+		http.StatusTooManyRequests:    codes.ResourceExhausted,
+		http.StatusServiceUnavailable: codes.Unavailable,
+	} {
+		statusCode = httpCode
+		_, err := client.Push(ctx, &PushRequest{Grouping: grouping("job", "foo")})
+		if expected, got := code, status.Code(err); expected != got {
+			t.Errorf("Wanted code %s for status %d, got %s.", expected, httpCode, got)
+		}
+		if expected, got := "nope", status.Convert(err).Message(); expected != got {
+			t.Errorf("Wanted message %q, got %q.", expected, got)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gopkg.in/yaml.v2"
+)
+
+// JobACL permits the listed identities to push to, delete, and lock the groups
+// of all jobs whose name matches one of the Jobs patterns.
+type JobACL struct {
+	// Users are basic auth users as configured in the auth file.
+	Users []string `yaml:"users"`
+	// ClientCertCNs are common names of verified client certificates.
+	ClientCertCNs []string `yaml:"client_cert_cns"`
+	// BearerTokens are tokens as configured in the auth file.
+	BearerTokens []string `yaml:"bearer_tokens"`
+	// Jobs are anchored regular expressions for job names.
+	Jobs []string `yaml:"jobs"`
+
+	jobs []*regexp.Regexp
+}
+
+// ACLConfig is the content of the file provided with --web.acl-file.
+type ACLConfig struct {
+	ACLs []*JobACL `yaml:"acls"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. It validates the JobACL and
+// compiles its job patterns.
+func (acl *JobACL) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain JobACL
+	if err := unmarshal((*plain)(acl)); err != nil {
+		return err
+	}
+	if len(acl.Users)+len(acl.ClientCertCNs)+len(acl.BearerTokens) == 0 {
+		return fmt.Errorf("ACL for jobs %q lists no identities", acl.Jobs)
+	}
+	if len(acl.Jobs) == 0 {
+		return errors.New("ACL lists no jobs")
+	}
+	for _, identities := range [][]string{acl.Users, acl.ClientCertCNs, acl.BearerTokens} {
+		for _, identity := range identities {
+			if identity == "" {
+				return fmt.Errorf("empty identity in ACL for jobs %q", acl.Jobs)
+			}
+		}
+	}
+	for _, job := range acl.Jobs {
+		re, err := regexp.Compile("^(?:" + job + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid job pattern %q: %v", job, err)
+		}
+		acl.jobs = append(acl.jobs, re)
+	}
+	return nil
+}
+
+// LoadACLFile reads and validates an ACLConfig from the provided YAML file.
+func LoadACLFile(file string) (*ACLConfig, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ACLConfig{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse ACL file %q: %v", file, err)
+	}
+	if len(cfg.ACLs) == 0 {
+		return nil, fmt.Errorf("ACL file %q configures no ACLs", file)
+	}
+	return cfg, nil
+}
+
+// UsesCredentials returns true if any of the ACLs identifies requests by basic
+// auth users or bearer tokens, which requires the Authenticate handler to
+// verify them first.
+func (cfg *ACLConfig) UsesCredentials() bool {
+	for _, acl := range cfg.ACLs {
+		if len(acl.Users) > 0 || len(acl.BearerTokens) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesClientCerts returns true if any of the ACLs identifies requests by client
+// certificates, which requires mutual TLS.
+func (cfg *ACLConfig) UsesClientCerts() bool {
+	for _, acl := range cfg.ACLs {
+		if len(acl.ClientCertCNs) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizeJobs returns a handler that rejects PUT, POST, and DELETE requests
+// below pushPath, and PUT and DELETE requests below groupsPath (locking and
+// unlocking), with http.StatusForbidden unless one of the ACLs in cfg permits
+// an identity of the request to modify the job of the addressed group. Like
+// with RateLimit, the job is taken from the URL no matter if base64-encoded or
+// not. POST requests to rename a group (see Rename) need permission for both
+// the old and the new job. Requests whose groups cannot be determined (see
+// modifiedGroups) are rejected with http.StatusBadRequest. All other requests
+// are passed on to next unchecked.
+//
+// The receivers of other formats (see InfluxDB, RemoteWrite, and OTLP) derive
+// the groups to modify from the request body. AuthorizeJobs therefore passes cfg
+// on to them with the request context, and they reject the request with
+// http.StatusForbidden before modifying any group unless the ACLs permit all of
+// the jobs, see authorizeConverted.
+//
+// AuthorizeJobs does not verify credentials. Basic auth users and bearer
+// tokens have to be verified by an Authenticate handler in front of it, and
+// client certificates by the TLS configuration.
+func AuthorizeJobs(
+	cfg *ACLConfig,
+	pushPath, groupsPath string,
+	next http.Handler,
+	logger log.Logger,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, groups, ok, err := modifiedGroups(r, pushPath, groupsPath)
+		if !ok {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), aclKey{}, cfg)))
+			return
+		}
+		if err != nil {
+			level.Debug(logger).Log("msg", "cannot check ACLs for malformed request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !permitsGroups(w, r, cfg, groups, logger) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// aclKey is the context key for the ACLConfig passed on by AuthorizeJobs.
+type aclKey struct{}
+
+// authorizeConverted checks the grouping labels of the groups a receiver has
+// converted the request into against the ACLs passed on by AuthorizeJobs, if
+// any. Like AuthorizeJobs, it responds with http.StatusForbidden and returns
+// false if an ACL does not permit the job of one of the groups.
+func authorizeConverted(w http.ResponseWriter, r *http.Request, groups []map[string]string, logger log.Logger) bool {
+	cfg, ok := r.Context().Value(aclKey{}).(*ACLConfig)
+	if !ok {
+		return true
+	}
+	return permitsGroups(w, r, cfg, groups, logger)
+}
+
+// permitsGroups returns true if cfg permits the request to modify the jobs of
+// all provided groups. Otherwise, it responds with http.StatusForbidden.
+func permitsGroups(w http.ResponseWriter, r *http.Request, cfg *ACLConfig, groups []map[string]string, logger log.Logger) bool {
+	for _, labels := range groups {
+		if job := labels["job"]; !cfg.permits(r, job) {
+			level.Debug(logger).Log("msg", "job not permitted by ACLs", "job", job, "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			http.Error(w, fmt.Sprintf("not permitted to modify groups of job %q", job), http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// modifiedGroups returns what the provided request does (one of "push",
+// "delete", "lock", "unlock", and "rename") and the grouping labels of the
+// groups it modifies, i.e. the old and the new ones of a rename, for the
+// requests checked by AuthorizeJobs. The grouping labels of pushes and
+// deletions are parsed like the Push and Delete handlers do, see
+// parsePushPath. For all other requests, it returns false. For malformed ones,
+// it returns true and an error, so that they are rejected rather than passed on
+// unchecked.
+func modifiedGroups(r *http.Request, pushPath, groupsPath string) (string, []map[string]string, bool, error) {
+	switch {
+	case r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodDelete:
+		return "", nil, false, nil
+	case strings.HasPrefix(r.URL.Path, pushPath+"/"):
+		action := "push"
+		if r.Method == http.MethodDelete {
+			action = "delete"
+		}
+		labels, _, err := parsePushPath(strings.TrimPrefix(r.URL.Path, pushPath), r.Method == http.MethodDelete)
+		if err != nil {
+			return action, nil, true, err
+		}
+		return action, []map[string]string{labels}, true, nil
+	case r.Method == http.MethodPost && r.URL.Path == groupsPath+"/"+RenameSegment:
+		req, err := readRenameRequest(r)
+		if err != nil {
+			return "rename", nil, true, err
+		}
+		return "rename", []map[string]string{req.From, req.To}, true, nil
+	case r.Method != http.MethodPost && strings.HasPrefix(r.URL.Path, groupsPath+"/"):
+		action := "lock"
+		if r.Method == http.MethodDelete {
+			action = "unlock"
+		}
+		// The same as in the Lock handler.
+		labels, err := splitLabels(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, groupsPath), "/"+LockSegment))
+		if err == nil && labels["job"] == "" {
+			err = errors.New("job name is required")
+		}
+		if err != nil {
+			return action, nil, true, err
+		}
+		return action, []map[string]string{labels}, true, nil
+	}
+	return "", nil, false, nil
+}
+
+// permits returns true if an ACL that matches an identity of the request also
+// matches the provided job name.
+func (cfg *ACLConfig) permits(r *http.Request, job string) bool {
+	for _, acl := range cfg.ACLs {
+		if !acl.identifies(r) {
+			continue
+		}
+		for _, re := range acl.jobs {
+			if re.MatchString(job) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identifies returns true if the request carries one of the identities listed
+// in the ACL.
+func (acl *JobACL) identifies(r *http.Request) bool {
+	if user, _, ok := r.BasicAuth(); ok {
+		for _, u := range acl.Users {
+			if u == user {
+				return true
+			}
+		}
+	}
+	if cn, ok := clientCertCN(r); ok {
+		for _, c := range acl.ClientCertCNs {
+			if c == cn {
+				return true
+			}
+		}
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, bearerPrefix) {
+		token := []byte(strings.TrimPrefix(auth, bearerPrefix))
+		valid := false
+		for _, t := range acl.BearerTokens {
+			if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+				valid = true
+			}
+		}
+		return valid
+	}
+	return false
+}
+
+// clientCertCN returns the common name of the verified client certificate of
+// the request and true, or false if there is none.
+func clientCertCN(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+}
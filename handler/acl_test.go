@@ -0,0 +1,199 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestLoadACLFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestLoadACLFile.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	scenarios := map[string]struct {
+		content string
+		valid   bool
+	}{
+		"valid": {
+			content: "acls:\n- users: [alice]\n  client_cert_cns: [team-a]\n  jobs: ['team_a_.*']\n",
+			valid:   true,
+		},
+		"no ACLs": {
+			content: "acls: []\n",
+		},
+		"no identities": {
+			content: "acls:\n- jobs: [foo]\n",
+		},
+		"no jobs": {
+			content: "acls:\n- users: [alice]\n",
+		},
+		"empty identity": {
+			content: "acls:\n- bearer_tokens: ['']\n  jobs: [foo]\n",
+		},
+		"invalid pattern": {
+			content: "acls:\n- users: [alice]\n  jobs: ['(']\n",
+		},
+		"unknown field": {
+			content: "acls:\n- user: alice\n  jobs: [foo]\n",
+		},
+	}
+	for name, s := range scenarios {
+		file := path.Join(tempDir, "acl.yml")
+		if err := ioutil.WriteFile(file, []byte(s.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadACLFile(file)
+		if expected, got := s.valid, err == nil; expected != got {
+			t.Errorf("%s: Wanted valid=%v, got error %v.", name, expected, err)
+		}
+		if err != nil {
+			continue
+		}
+		if !cfg.UsesCredentials() || !cfg.UsesClientCerts() {
+			t.Errorf("%s: Wanted ACLs using credentials and client certificates.", name)
+		}
+	}
+}
+
+func TestAuthorizeJobs(t *testing.T) {
+	cfg := &ACLConfig{}
+	if err := yaml.UnmarshalStrict([]byte(`
+acls:
+- users: [alice]
+  jobs: ['team_a_.*']
+- client_cert_cns: [team-b]
+  jobs: [team_b]
+- bearer_tokens: [token-c]
+  jobs: [team_c, shared]
+`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	h := AuthorizeJobs(cfg, "/metrics", "/api/v1/groups", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}), logger)
+
+	for i, s := range []struct {
+		method, path    string
+		user, cn, token string
+		body            string
+		code            int
+	}{
+		{method: "PUT", path: "/metrics/job/team_a_x", user: "alice", code: http.StatusAccepted},
+		{method: "POST", path: "/metrics/job/team_b", user: "alice", code: http.StatusForbidden},
+		// Anchored patterns.
+		{method: "PUT", path: "/metrics/job/x_team_a_x", user: "alice", code: http.StatusForbidden},
+		// Base64-encoded job name "team_b".
+		{method: "PUT", path: "/metrics/job@base64/dGVhbV9i/instance/i", cn: "team-b", code: http.StatusAccepted},
+		{method: "DELETE", path: "/metrics/job/team_b/@metric/foo", cn: "team-b", code: http.StatusAccepted},
+		{method: "DELETE", path: "/metrics/job/team_a_x", cn: "team-b", code: http.StatusForbidden},
+		{method: "DELETE", path: "/metrics/job/shared", token: "token-c", code: http.StatusAccepted},
+		{method: "DELETE", path: "/metrics/job/shared", token: "token-x", code: http.StatusForbidden},
+		{method: "PUT", path: "/metrics/job/shared", code: http.StatusForbidden},
+		// Locking.
+		{method: "PUT", path: "/api/v1/groups/instance/i/job/team_c/lock", token: "token-c", code: http.StatusAccepted},
+		{method: "DELETE", path: "/api/v1/groups/job/team_c/lock", user: "alice", code: http.StatusForbidden},
+		// Renaming needs permission for both jobs.
+		{method: "POST", path: "/api/v1/groups/rename", token: "token-c", body: `{"from": {"job": "team_c"}, "to": {"job": "shared"}}`, code: http.StatusAccepted},
+		{method: "POST", path: "/api/v1/groups/rename", token: "token-c", body: `{"from": {"job": "team_c"}, "to": {"job": "team_b"}}`, code: http.StatusForbidden},
+		{method: "POST", path: "/api/v1/groups/rename", user: "alice", body: `{"from": {"job": "team_c"}, "to": {"job": "team_a_x"}}`, code: http.StatusForbidden},
+		// A trailing slash addresses the same group as the handlers see it.
+		{method: "PUT", path: "/metrics/job/team_b/", user: "alice", code: http.StatusForbidden},
+		{method: "POST", path: "/metrics/job/team_b/", user: "alice", code: http.StatusForbidden},
+		{method: "DELETE", path: "/metrics/job/team_b/", user: "alice", code: http.StatusForbidden},
+		{method: "PUT", path: "/metrics/job/team_a_x/", user: "alice", code: http.StatusAccepted},
+		{method: "DELETE", path: "/metrics/job@base64/dGVhbV9i/@metric/foo", user: "alice", code: http.StatusForbidden},
+		// Malformed requests are rejected rather than passed on unchecked.
+		{method: "POST", path: "/api/v1/groups/rename", body: `{"from": `, code: http.StatusBadRequest},
+		{method: "PUT", path: "/metrics/job/team_b/instance", code: http.StatusBadRequest},
+		{method: "PUT", path: "/metrics/job", code: http.StatusBadRequest},
+		{method: "PUT", path: "/metrics/job@base64/!!!", code: http.StatusBadRequest},
+		{method: "DELETE", path: "/api/v1/groups/instance/i/lock", code: http.StatusBadRequest},
+		// Reads are passed on.
+		{method: "GET", path: "/metrics/job/team_b", code: http.StatusAccepted},
+		{method: "GET", path: "/api/v1/groups/job/team_b/age", code: http.StatusAccepted},
+		{method: "PUT", path: "/api/v1/admin/wipe", code: http.StatusAccepted},
+	} {
+		req, err := http.NewRequest(s.method, "http://example.org"+s.path, strings.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.user != "" {
+			req.SetBasicAuth(s.user, "secret")
+		}
+		if s.cn != "" {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{
+				{{Subject: pkix.Name{CommonName: s.cn}}},
+			}}
+		}
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("%d. %s %s: Wanted status code %d, got %d.", i, s.method, s.path, expected, got)
+		}
+	}
+}
+
+func TestAuthorizeConverted(t *testing.T) {
+	cfg := &ACLConfig{}
+	if err := yaml.UnmarshalStrict([]byte(`
+acls:
+- users: [alice]
+  jobs: ['team_a_.*']
+`), cfg); err != nil {
+		t.Fatal(err)
+	}
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	defer ms.Shutdown()
+	h := AuthorizeJobs(cfg, "/metrics", "/api/v1/groups", InfluxDB(ms, true, "team_a_influxdb", []string{"host"}, ValidationStrict, nil, logger), logger)
+	write := func(url, body string) int {
+		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("alice", "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if expected, got := http.StatusNoContent, write("http://example.org/write", "cpu,host=a usage=0.5\n"); expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := http.StatusForbidden, write("http://example.org/write?db=team_b", "cpu,host=a usage=0.5\n"); expected != got {
+		t.Errorf("Wanted status code %v for other job, got %v.", expected, got)
+	}
+	if _, ok := storage.GetMetricGroup(ms, map[string]string{"job": "team_b", "host": "a"}); ok {
+		t.Error("Unexpected group of forbidden job.")
+	}
+}
@@ -0,0 +1,540 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/route"
+)
+
+// apiKeyPrefix starts every API key, so that API keys can be told apart from
+// the bearer tokens of the auth file. It is followed by the ID of the key, an
+// underscore, and the secret. The ID is hex-encoded and thus never contains an
+// underscore itself.
+const apiKeyPrefix = "pgk_"
+
+// The verbs an API key can be scoped to.
+const (
+	// VerbPush permits pushing to groups and locking and unlocking them.
+	VerbPush = "push"
+	// VerbDelete permits deleting groups (or metric families in them).
+	VerbDelete = "delete"
+	// VerbRead permits reading back the metrics of groups.
+	VerbRead = "read"
+)
+
+// Verbs are all valid verbs of an API key.
+var Verbs = []string{VerbPush, VerbDelete, VerbRead}
+
+// APIKey is an API key as stored in the APIKeyStore, i.e. without its secret.
+type APIKey struct {
+	ID          string `json:"id"`
+	Description string `json:"description,omitempty"`
+	// Jobs are anchored regular expressions for the job names the key may
+	// be used for, like in a JobACL.
+	Jobs []string `json:"jobs"`
+	// Verbs are the operations the key may be used for, see Verbs.
+	Verbs   []string  `json:"verbs"`
+	Created time.Time `json:"created"`
+	// Rotated is the time the secret of the key has been replaced last,
+	// if ever.
+	Rotated *time.Time `json:"rotated,omitempty"`
+
+	// Hash is the hex-encoded SHA-256 hash of the secret. API keys are
+	// random with as much entropy as the hash, so a slow password hash
+	// is not needed.
+	Hash string `json:"hash"`
+	// PreviousHash is the hash of the secret before the last rotation,
+	// accepted until PreviousExpires.
+	PreviousHash    string     `json:"previous_hash,omitempty"`
+	PreviousExpires *time.Time `json:"previous_expires,omitempty"`
+
+	jobs []*regexp.Regexp
+}
+
+// compile validates the APIKey and compiles its job patterns.
+func (k *APIKey) compile() error {
+	if len(k.Jobs) == 0 {
+		return errors.New("API key lists no jobs")
+	}
+	if len(k.Verbs) == 0 {
+		return errors.New("API key lists no verbs")
+	}
+	for _, verb := range k.Verbs {
+		if verb != VerbPush && verb != VerbDelete && verb != VerbRead {
+			return fmt.Errorf("invalid verb %q, must be one of %s", verb, strings.Join(Verbs, ", "))
+		}
+	}
+	k.jobs = nil
+	for _, job := range k.Jobs {
+		re, err := regexp.Compile("^(?:" + job + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid job pattern %q: %v", job, err)
+		}
+		k.jobs = append(k.jobs, re)
+	}
+	return nil
+}
+
+// permits returns true if the APIKey may be used for the provided verb and job.
+func (k *APIKey) permits(verb, job string) bool {
+	found := false
+	for _, v := range k.Verbs {
+		if v == verb {
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+	for _, re := range k.jobs {
+		if re.MatchString(job) {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyStore keeps API keys in a JSON file, with only the hashes of their
+// secrets. Every change is written to the file right away. All methods are safe
+// for concurrent use.
+type APIKeyStore struct {
+	mtx  sync.RWMutex
+	file string
+	keys map[string]*APIKey
+	now  func() time.Time // For testing.
+}
+
+// NewAPIKeyStore returns an APIKeyStore for the provided file, reading the keys
+// stored in it. A missing file is not an error, it is created with the first
+// key.
+func NewAPIKeyStore(file string) (*APIKeyStore, error) {
+	s := &APIKeyStore{file: file, keys: map[string]*APIKey{}, now: time.Now}
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []*APIKey
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, fmt.Errorf("could not parse API key file %q: %v", file, err)
+	}
+	for _, k := range keys {
+		if err := k.compile(); err != nil {
+			return nil, fmt.Errorf("invalid API key %q in %q: %v", k.ID, file, err)
+		}
+		s.keys[k.ID] = k
+	}
+	return s, nil
+}
+
+// Create creates a new API key with the provided scope and returns it together
+// with the key to hand out, which is not stored anywhere.
+func (s *APIKeyStore) Create(description string, jobs, verbs []string) (APIKey, string, error) {
+	k := &APIKey{
+		Description: description,
+		Jobs:        jobs,
+		Verbs:       verbs,
+		Created:     s.now().UTC(),
+	}
+	if err := k.compile(); err != nil {
+		return APIKey{}, "", err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for k.ID == "" || s.keys[k.ID] != nil {
+		b := make([]byte, 6)
+		if _, err := rand.Read(b); err != nil {
+			return APIKey{}, "", err
+		}
+		k.ID = hex.EncodeToString(b)
+	}
+	secret, hash, err := newSecret()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	k.Hash = hash
+	s.keys[k.ID] = k
+	if err := s.writeLocked(); err != nil {
+		delete(s.keys, k.ID)
+		return APIKey{}, "", err
+	}
+	return *k, apiKeyPrefix + k.ID + "_" + secret, nil
+}
+
+// List returns all API keys, sorted by ID.
+func (s *APIKeyStore) List() []APIKey {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, *k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// Revoke removes the API key with the provided ID. It returns false if there is
+// no such key.
+func (s *APIKeyStore) Revoke(id string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	k, ok := s.keys[id]
+	if !ok {
+		return false, nil
+	}
+	delete(s.keys, id)
+	if err := s.writeLocked(); err != nil {
+		s.keys[id] = k
+		return true, err
+	}
+	return true, nil
+}
+
+// Rotate replaces the secret of the API key with the provided ID, keeping its
+// scope, and returns the new key to hand out. The previous secret stays valid
+// for the provided grace period so that clients can be switched over without
+// failing requests. The returned bool is false if there is no such key.
+func (s *APIKeyStore) Rotate(id string, grace time.Duration) (APIKey, string, bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	old, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, "", false, nil
+	}
+	secret, hash, err := newSecret()
+	if err != nil {
+		return APIKey{}, "", true, err
+	}
+	k := *old
+	now := s.now().UTC()
+	k.Rotated = &now
+	k.PreviousHash, k.PreviousExpires = "", nil
+	if grace > 0 {
+		expires := now.Add(grace)
+		k.PreviousHash, k.PreviousExpires = old.Hash, &expires
+	}
+	k.Hash = hash
+	s.keys[id] = &k
+	if err := s.writeLocked(); err != nil {
+		s.keys[id] = old
+		return APIKey{}, "", true, err
+	}
+	return k, apiKeyPrefix + id + "_" + secret, true, nil
+}
+
+// lookup returns the API key matching the provided token, or nil if there is
+// none.
+func (s *APIKeyStore) lookup(token string) *APIKey {
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	s.mtx.RLock()
+	k, ok := s.keys[parts[0]]
+	s.mtx.RUnlock()
+	if !ok {
+		return nil
+	}
+	hash := hashSecret(parts[1])
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) == 1 {
+		return k
+	}
+	if k.PreviousExpires != nil && s.now().Before(*k.PreviousExpires) &&
+		subtle.ConstantTimeCompare([]byte(hash), []byte(k.PreviousHash)) == 1 {
+		return k
+	}
+	return nil
+}
+
+// writeLocked replaces the file with the current keys. The caller must hold mtx.
+func (s *APIKeyStore) writeLocked() error {
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	content, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.file), filepath.Base(s.file)+".in_progress.")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.file)
+}
+
+// newSecret returns a random secret, base64-encoded without padding, and its
+// hash.
+func newSecret() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(b)
+	return secret, hashSecret(secret), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAPIKey returns true if the request carries an API key in an
+// "Authorization: Bearer" header.
+func IsAPIKey(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), bearerPrefix+apiKeyPrefix)
+}
+
+// AuthenticateAPIKeys returns a handler that passes requests carrying an API
+// key (see IsAPIKey) on to next if the key is valid and its scope permits the
+// request, while all other requests are passed on to fallback. An invalid key
+// is rejected with http.StatusUnauthorized, a request not permitted by the key
+// with http.StatusForbidden.
+//
+// Only requests addressing a group are permitted: PUT and POST below pushPath
+// as well as PUT and DELETE below groupsPath (locking and unlocking) require
+// the push verb, DELETE below pushPath the delete verb, and GET below pushPath
+// the read verb. The job is taken from the URL like with AuthorizeJobs. In
+// particular, API keys cannot be used for scraping, the query API, or the admin
+// API.
+func AuthenticateAPIKeys(
+	s *APIKeyStore,
+	pushPath, groupsPath string,
+	next, fallback http.Handler,
+	logger log.Logger,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsAPIKey(r) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		k := s.lookup(strings.TrimPrefix(r.Header.Get("Authorization"), bearerPrefix))
+		if k == nil {
+			level.Debug(logger).Log("msg", "invalid API key", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Pushgateway"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var verb, labelsString string
+		switch {
+		case strings.HasPrefix(r.URL.Path, pushPath+"/"):
+			labelsString = strings.TrimPrefix(r.URL.Path, pushPath)
+			switch r.Method {
+			case http.MethodPut, http.MethodPost:
+				verb = VerbPush
+			case http.MethodDelete:
+				verb = VerbDelete
+				labelsString, _, _ = splitMetricNames(labelsString)
+			case http.MethodGet, http.MethodHead:
+				verb = VerbRead
+			}
+		case strings.HasPrefix(r.URL.Path, groupsPath+"/") && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+			verb = VerbPush
+			labelsString = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, groupsPath), "/"+LockSegment)
+		}
+		labels, err := splitLabels(labelsString)
+		if verb == "" || err != nil || labels["job"] == "" {
+			level.Debug(logger).Log("msg", "request not permitted for API keys", "key", k.ID, "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+			http.Error(w, "API keys can only be used to push to, delete, lock, or read groups", http.StatusForbidden)
+			return
+		}
+		if !k.permits(verb, labels["job"]) {
+			level.Debug(logger).Log("msg", "job not permitted by API key", "key", k.ID, "verb", verb, "job", labels["job"], "remote_addr", r.RemoteAddr)
+			http.Error(w, fmt.Sprintf("API key not permitted to %s groups of job %q", verb, labels["job"]), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyRequest is the body of a request to create an API key.
+type apiKeyRequest struct {
+	Description string   `json:"description"`
+	Jobs        []string `json:"jobs"`
+	Verbs       []string `json:"verbs"`
+}
+
+// publicAPIKey is an API key as listed, without any hashes.
+type publicAPIKey struct {
+	ID              string     `json:"id"`
+	Description     string     `json:"description,omitempty"`
+	Jobs            []string   `json:"jobs"`
+	Verbs           []string   `json:"verbs"`
+	Created         time.Time  `json:"created"`
+	Rotated         *time.Time `json:"rotated,omitempty"`
+	PreviousExpires *time.Time `json:"previous_expires,omitempty"`
+}
+
+func toPublicAPIKey(k APIKey) publicAPIKey {
+	return publicAPIKey{
+		ID:              k.ID,
+		Description:     k.Description,
+		Jobs:            k.Jobs,
+		Verbs:           k.Verbs,
+		Created:         k.Created,
+		Rotated:         k.Rotated,
+		PreviousExpires: k.PreviousExpires,
+	}
+}
+
+// CreateAPIKey returns an http.Handler that creates an API key with the scope
+// in the JSON request body and responds with it, including the key itself,
+// with http.StatusCreated.
+//
+// The returned handler is already instrumented for Prometheus.
+func CreateAPIKey(s *APIKeyStore, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"api_keys",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req apiKeyRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+				return
+			}
+			k, key, err := s.Create(req.Description, req.Jobs, req.Verbs)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			level.Info(logger).Log("msg", "API key created", "key", k.ID, "jobs", strings.Join(k.Jobs, ","), "verbs", strings.Join(k.Verbs, ","))
+			writeAPIKey(w, http.StatusCreated, k, key, logger)
+		}))
+}
+
+// ListAPIKeys returns an http.Handler that responds with all API keys, without
+// the keys themselves or their hashes.
+//
+// The returned handler is already instrumented for Prometheus.
+func ListAPIKeys(s *APIKeyStore, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"api_keys",
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			keys := []publicAPIKey{}
+			for _, k := range s.List() {
+				keys = append(keys, toPublicAPIKey(k))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(keys); err != nil {
+				level.Error(logger).Log("msg", "failed to write API keys", "err", err.Error())
+			}
+		}))
+}
+
+// RevokeAPIKey returns an http.Handler that removes the API key with the ID in
+// the "id" route parameter. It responds with http.StatusNotFound if there is no
+// such key.
+//
+// The returned handler is already instrumented for Prometheus.
+func RevokeAPIKey(s *APIKeyStore, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"api_keys",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := route.Param(r.Context(), "id")
+			found, err := s.Revoke(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				level.Error(logger).Log("msg", "failed to revoke API key", "key", id, "err", err.Error())
+				return
+			}
+			if !found {
+				http.Error(w, "API key not found", http.StatusNotFound)
+				return
+			}
+			level.Info(logger).Log("msg", "API key revoked", "key", id)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+}
+
+// RotateAPIKey returns an http.Handler that replaces the secret of the API key
+// with the ID in the "id" route parameter and responds with the new key. The
+// previous key stays valid for the duration in the "grace_period" query
+// parameter (e.g. "1h"), if any.
+//
+// The returned handler is already instrumented for Prometheus.
+func RotateAPIKey(s *APIKeyStore, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"api_keys",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := route.Param(r.Context(), "id")
+			var grace time.Duration
+			if v := r.URL.Query().Get("grace_period"); v != "" {
+				var err error
+				if grace, err = time.ParseDuration(v); err != nil || grace < 0 {
+					http.Error(w, fmt.Sprintf("invalid grace period %q", v), http.StatusBadRequest)
+					return
+				}
+			}
+			k, key, found, err := s.Rotate(id, grace)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				level.Error(logger).Log("msg", "failed to rotate API key", "key", id, "err", err.Error())
+				return
+			}
+			if !found {
+				http.Error(w, "API key not found", http.StatusNotFound)
+				return
+			}
+			level.Info(logger).Log("msg", "API key rotated", "key", id, "grace_period", grace)
+			writeAPIKey(w, http.StatusOK, k, key, logger)
+		}))
+}
+
+// writeAPIKey responds with the provided API key including the key itself,
+// which is the only time the key is shown.
+func writeAPIKey(w http.ResponseWriter, status int, k APIKey, key string, logger log.Logger) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(struct {
+		publicAPIKey
+		Key string `json:"key"`
+	}{toPublicAPIKey(k), key}); err != nil {
+		level.Error(logger).Log("msg", "failed to write API key", "err", err.Error())
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestAPIKeyStore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestAPIKeyStore.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := path.Join(tempDir, "api-keys")
+
+	s, err := NewAPIKeyStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Create("", []string{"foo"}, []string{"scrape"}); err == nil {
+		t.Error("Wanted error for invalid verb.")
+	}
+	if _, _, err := s.Create("", []string{"("}, []string{VerbPush}); err == nil {
+		t.Error("Wanted error for invalid job pattern.")
+	}
+	k, key, err := s.Create("ci", []string{"team_a_.*"}, []string{VerbPush})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.lookup(key) != s.keys[k.ID] {
+		t.Errorf("Key %q not found.", key)
+	}
+	if s.lookup(key+"x") != nil || s.lookup(apiKeyPrefix+k.ID) != nil {
+		t.Error("Invalid key found.")
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), strings.TrimPrefix(key, apiKeyPrefix+k.ID+"_")) {
+		t.Error("Secret stored in plain text.")
+	}
+
+	// Rotating keeps the previous key valid during the grace period.
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	_, rotated, found, err := s.Rotate(k.ID, time.Minute)
+	if err != nil || !found {
+		t.Fatalf("Rotating failed, found=%v, error %v.", found, err)
+	}
+	if s.lookup(rotated) == nil || s.lookup(key) == nil {
+		t.Error("Wanted both keys to be valid during the grace period.")
+	}
+	s.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if s.lookup(rotated) == nil || s.lookup(key) != nil {
+		t.Error("Wanted only the rotated key to be valid after the grace period.")
+	}
+
+	// Keys survive reloading.
+	s, err = NewAPIKeyStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks := s.List(); len(ks) != 1 || ks[0].ID != k.ID || !ks[0].permits(VerbPush, "team_a_x") {
+		t.Errorf("Unexpected keys %v.", ks)
+	}
+	if s.lookup(rotated) == nil {
+		t.Error("Rotated key not found after reloading.")
+	}
+	if found, err := s.Revoke(k.ID); err != nil || !found {
+		t.Fatalf("Revoking failed, found=%v, error %v.", found, err)
+	}
+	if s.lookup(rotated) != nil {
+		t.Error("Revoked key found.")
+	}
+	if found, _ := s.Revoke(k.ID); found {
+		t.Error("Revoked key revoked again.")
+	}
+}
+
+func TestAuthenticateAPIKeys(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestAuthenticateAPIKeys.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	s, err := NewAPIKeyStore(path.Join(tempDir, "api-keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pushKey, err := s.Create("", []string{"team_a_.*"}, []string{VerbPush, VerbRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, deleteKey, err := s.Create("", []string{"shared"}, []string{VerbDelete})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reached string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = "next" })
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = "fallback" })
+	h := AuthenticateAPIKeys(s, "/metrics", "/api/v1/groups", next, fallback, log.NewNopLogger())
+
+	scenarios := []struct {
+		method, path, key string
+		status            int
+		reached           string
+	}{
+		{http.MethodPut, "/metrics/job/team_a_1", "", http.StatusOK, "fallback"},
+		{http.MethodPut, "/metrics/job/team_a_1", "other-token", http.StatusOK, "fallback"},
+		{http.MethodPut, "/metrics/job/team_a_1", pushKey, http.StatusOK, "next"},
+		{http.MethodPost, "/metrics/job@base64/dGVhbV9hXzE/instance/a", pushKey, http.StatusOK, "next"},
+		{http.MethodGet, "/metrics/job/team_a_1", pushKey, http.StatusOK, "next"},
+		{http.MethodPut, "/api/v1/groups/job/team_a_1/lock", pushKey, http.StatusOK, "next"},
+		{http.MethodPut, "/metrics/job/team_b", pushKey, http.StatusForbidden, ""},
+		{http.MethodDelete, "/metrics/job/team_a_1", pushKey, http.StatusForbidden, ""},
+		{http.MethodDelete, "/metrics/job/shared/metrics/foo", deleteKey, http.StatusOK, "next"},
+		{http.MethodPut, "/metrics/job/shared", deleteKey, http.StatusForbidden, ""},
+		{http.MethodGet, "/metrics", pushKey, http.StatusForbidden, ""},
+		{http.MethodPut, "/api/v1/admin/wipe", pushKey, http.StatusForbidden, ""},
+		{http.MethodPut, "/metrics/job/team_a_1", pushKey + "x", http.StatusUnauthorized, ""},
+	}
+	for _, sc := range scenarios {
+		reached = ""
+		req := httptest.NewRequest(sc.method, sc.path, nil)
+		if sc.key != "" {
+			req.Header.Set("Authorization", bearerPrefix+sc.key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if expected, got := sc.status, w.Code; expected != got {
+			t.Errorf("%s %s: Wanted status code %v, got %v.", sc.method, sc.path, expected, got)
+		}
+		if expected, got := sc.reached, reached; expected != got {
+			t.Errorf("%s %s: Wanted %q to be reached, got %q.", sc.method, sc.path, expected, got)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/audit"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// maxAuditErrorSize is the maximum number of bytes of an error response
+// recorded in the audit log.
+const maxAuditErrorSize = 1024
+
+// pushStatsKey is the context key for the pushStats of an audited request.
+type pushStatsKey struct{}
+
+// pushStats are filled in by the Push handler for the Audit handler.
+type pushStats struct {
+	families, samples int
+}
+
+// recordPushStats counts the provided metric families in the pushStats of the
+// request, if it is audited.
+func recordPushStats(r *http.Request, metricFamilies map[string]*dto.MetricFamily) {
+	ps, ok := r.Context().Value(pushStatsKey{}).(*pushStats)
+	if !ok {
+		return
+	}
+	ps.families = len(metricFamilies)
+	for _, mf := range metricFamilies {
+		ps.samples += storage.NumSamples(mf)
+	}
+}
+
+// Audit returns a handler that passes all requests on to next and records every
+// PUT, POST, and DELETE request below pushPath in al, including rejected ones.
+// The tenant is recorded with each entry, it is empty for the default
+// namespace. To record requests rejected by authentication, ACLs, or rate
+// limits, the Audit handler has to be in front of those handlers. Failures to
+// write the audit log are logged, but do not affect the request.
+func Audit(
+	al *audit.Log,
+	tenant, pushPath string,
+	next http.Handler,
+	logger log.Logger,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodDelete,
+			!strings.HasPrefix(r.URL.Path, pushPath+"/"):
+			next.ServeHTTP(w, r)
+			return
+		}
+		e := audit.Entry{
+			Time:       time.Now(),
+			Action:     "push",
+			Method:     r.Method,
+			Tenant:     tenant,
+			RemoteAddr: r.RemoteAddr,
+		}
+		labelsString := strings.TrimPrefix(r.URL.Path, pushPath)
+		var err error
+		if r.Method == http.MethodDelete {
+			e.Action = "delete"
+			labelsString, e.MetricNames, err = splitMetricNames(labelsString)
+		}
+		if err == nil {
+			// Malformed URLs are recorded without a group.
+			if labels, err := splitLabels(labelsString); err == nil {
+				e.Group = labels
+			}
+		}
+		if user, _, ok := r.BasicAuth(); ok {
+			e.User = user
+		}
+		if cn, ok := clientCertCN(r); ok {
+			e.ClientCertCN = cn
+		}
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, bearerPrefix) {
+			sum := sha256.Sum256([]byte(strings.TrimPrefix(auth, bearerPrefix)))
+			e.BearerTokenID = hex.EncodeToString(sum[:6])
+		}
+
+		ps := &pushStats{}
+		aw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), pushStatsKey{}, ps)))
+
+		e.Duration = time.Since(e.Time).Seconds()
+		e.Status = aw.status
+		e.Error = strings.TrimSpace(aw.errBody.String())
+		e.MetricFamilies, e.Samples = ps.families, ps.samples
+		if err := al.Record(e); err != nil {
+			level.Error(logger).Log("msg", "could not write audit log", "err", err)
+		}
+	})
+}
+
+// auditResponseWriter records the status code and the beginning of the body
+// of an error response.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	errBody     bytes.Buffer
+}
+
+func (aw *auditResponseWriter) WriteHeader(code int) {
+	if !aw.wroteHeader {
+		aw.status = code
+		aw.wroteHeader = true
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *auditResponseWriter) Write(b []byte) (int, error) {
+	if !aw.wroteHeader {
+		aw.WriteHeader(http.StatusOK)
+	}
+	if aw.status >= 400 && aw.errBody.Len() < maxAuditErrorSize {
+		rest := b
+		if n := maxAuditErrorSize - aw.errBody.Len(); len(rest) > n {
+			rest = rest[:n]
+		}
+		aw.errBody.Write(rest)
+	}
+	return aw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/common/route"
+
+	"github.com/prometheus/pushgateway/audit"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestAudit(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestAudit.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := path.Join(tempDir, "audit.log")
+	al, err := audit.New(file, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mms := MockMetricStore{}
+	r := route.New()
+	r.Post("/metrics/job/:job/*labels", Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger))
+	r.Del("/metrics/job/:job/*labels", Delete(&mms, false, logger))
+	h := Audit(al, "", "/metrics", r, logger)
+
+	request := func(method, path, body string, prepare func(*http.Request)) {
+		req, err := http.NewRequest(method, "http://example.org"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "10.0.0.1:1234"
+		if prepare != nil {
+			prepare(req)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	request("POST", "/metrics/job/foo/instance/bar", "a 1\nb{x=\"1\"} 2\nb{x=\"2\"} 3\n", func(r *http.Request) {
+		r.SetBasicAuth("alice", "secret")
+	})
+	mms.err = storage.ErrGroupLocked
+	request("POST", "/metrics/job/foo/instance/bar", "a 1\n", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer secret")
+	})
+	mms.err = nil
+	request("DELETE", "/metrics/job/foo/instance/bar/@metric/a", "", nil)
+	request("POST", "/metrics/job/foo/odd", "", nil)
+	// Not audited.
+	request("GET", "/metrics/job/foo/instance/bar", "", nil)
+	request("POST", "/api/v1/replicate", "", nil)
+	al.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []audit.Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e audit.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if expected, got := 4, len(entries); expected != got {
+		t.Fatalf("Wanted %d entries, got %d.", expected, got)
+	}
+
+	e := entries[0]
+	if expected, got := "push", e.Action; expected != got {
+		t.Errorf("Wanted action %q, got %q.", expected, got)
+	}
+	if expected, got := "bar", e.Group["instance"]; expected != got {
+		t.Errorf("Wanted instance %q, got %q.", expected, got)
+	}
+	if expected, got := "alice", e.User; expected != got {
+		t.Errorf("Wanted user %q, got %q.", expected, got)
+	}
+	if expected, got := "10.0.0.1:1234", e.RemoteAddr; expected != got {
+		t.Errorf("Wanted remote address %q, got %q.", expected, got)
+	}
+	if e.MetricFamilies != 2 || e.Samples != 3 {
+		t.Errorf("Wanted 2 metric families and 3 samples, got %d and %d.", e.MetricFamilies, e.Samples)
+	}
+	if expected, got := http.StatusOK, e.Status; expected != got {
+		t.Errorf("Wanted status %d, got %d.", expected, got)
+	}
+
+	e = entries[1]
+	if expected, got := http.StatusForbidden, e.Status; expected != got {
+		t.Errorf("Wanted status %d, got %d.", expected, got)
+	}
+	if expected, got := storage.ErrGroupLocked.Error(), e.Error; expected != got {
+		t.Errorf("Wanted error %q, got %q.", expected, got)
+	}
+	// The first 6 bytes of the SHA-256 hash of "secret".
+	if expected, got := "2bb80d537b1d", e.BearerTokenID; expected != got {
+		t.Errorf("Wanted bearer token ID %q, got %q.", expected, got)
+	}
+
+	e = entries[2]
+	if expected, got := "delete", e.Action; expected != got {
+		t.Errorf("Wanted action %q, got %q.", expected, got)
+	}
+	if len(e.MetricNames) != 1 || e.MetricNames[0] != "a" || e.Group["job"] != "foo" {
+		t.Errorf("Wanted deletion of a from job foo, got %+v.", e)
+	}
+
+	e = entries[3]
+	if e.Group != nil || e.Status != http.StatusBadRequest {
+		t.Errorf("Wanted rejected push without group, got %+v.", e)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+const bearerPrefix = "Bearer "
+
+// AuthConfig is the content of the file provided with --web.auth.file.
+type AuthConfig struct {
+	// BasicAuthUsers maps user names to bcrypt-hashed passwords.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	// BearerTokens are accepted verbatim in an "Authorization: Bearer"
+	// header.
+	BearerTokens []string `yaml:"bearer_tokens"`
+	// ProtectMetrics requires authentication for all reads, too (i.e.
+	// scrapes, reading back groups, the web UI, the API, and the debug
+	// endpoints), except for health and readiness checks and static
+	// assets.
+	ProtectMetrics bool `yaml:"protect_metrics"`
+}
+
+// LoadAuthFile reads and validates an AuthConfig from the provided YAML file.
+func LoadAuthFile(file string) (*AuthConfig, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &AuthConfig{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse auth file %q: %v", file, err)
+	}
+	if err := cfg.validate(fmt.Sprintf("auth file %q", file)); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate returns an error if the AuthConfig configures no credentials or
+// invalid ones. The source (e.g. `auth file "auth.yml"`) is only used for error
+// messages.
+func (cfg *AuthConfig) validate(source string) error {
+	if err := cfg.checkCredentials(source); err != nil {
+		return err
+	}
+	if !cfg.hasCredentials() {
+		return fmt.Errorf("%s configures neither users nor bearer tokens", source)
+	}
+	return nil
+}
+
+// checkCredentials returns an error if any of the configured users or tokens
+// is invalid. The source is only used for error messages.
+func (cfg *AuthConfig) checkCredentials(source string) error {
+	for user, hash := range cfg.BasicAuthUsers {
+		if user == "" {
+			return fmt.Errorf("empty user name in %s", source)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash for user %q in %s: %v", user, source, err)
+		}
+	}
+	for _, token := range cfg.BearerTokens {
+		if token == "" {
+			return fmt.Errorf("empty bearer token in %s", source)
+		}
+	}
+	return nil
+}
+
+func (cfg *AuthConfig) hasCredentials() bool {
+	return len(cfg.BasicAuthUsers) > 0 || len(cfg.BearerTokens) > 0
+}
+
+// Authenticate returns a handler that requires authentication as configured
+// in cfg for all PUT, POST, and DELETE requests before passing them on to next.
+// If cfg.ProtectMetrics is true, this includes all other requests but those for
+// the health and readiness endpoints and the static assets below routePrefix,
+// as about every other endpoint exposes pushed metrics or the metric store in
+// some way. Otherwise, all other requests are passed on unchecked.
+func Authenticate(
+	cfg *AuthConfig,
+	routePrefix string,
+	next http.Handler,
+	logger log.Logger,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.protects(r, routePrefix) || cfg.authenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg.reject(w, r, logger)
+	})
+}
+
+// protects returns true if the request requires authentication, see
+// Authenticate.
+func (cfg *AuthConfig) protects(r *http.Request, routePrefix string) bool {
+	switch {
+	case r.Method == http.MethodPut, r.Method == http.MethodPost, r.Method == http.MethodDelete:
+		return true
+	case cfg.ProtectMetrics:
+		return !publicPath(r.URL.Path, routePrefix)
+	}
+	return false
+}
+
+// publicPath returns true if the provided path below routePrefix is readable
+// without authentication even if the metrics are protected, see Authenticate.
+func publicPath(p, routePrefix string) bool {
+	switch p {
+	case path.Join(routePrefix, "/-/healthy"), path.Join(routePrefix, "/-/ready"):
+		return true
+	}
+	return strings.HasPrefix(p, path.Join(routePrefix, "/static")+"/")
+}
+
+// reject responds to an unauthenticated request with http.StatusUnauthorized.
+func (cfg *AuthConfig) reject(w http.ResponseWriter, r *http.Request, logger log.Logger) {
+	level.Debug(logger).Log("msg", "unauthenticated request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+	if len(cfg.BasicAuthUsers) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Pushgateway"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="Pushgateway"`)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// authenticated returns true if the request carries valid credentials.
+func (cfg *AuthConfig) authenticated(r *http.Request) bool {
+	if user, pass, ok := r.BasicAuth(); ok {
+		hash, ok := cfg.BasicAuthUsers[user]
+		return ok && bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearerPrefix) {
+		return false
+	}
+	token := []byte(strings.TrimPrefix(auth, bearerPrefix))
+	valid := false
+	for _, t := range cfg.BearerTokens {
+		// Check all tokens to not leak which one matched via timing.
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
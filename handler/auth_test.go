@@ -0,0 +1,148 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadAuthFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestLoadAuthFile.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scenarios := map[string]struct {
+		content string
+		valid   bool
+	}{
+		"valid": {
+			content: fmt.Sprintf("basic_auth_users:\n  alice: %s\nbearer_tokens: [token]\nprotect_metrics: true\n", hash),
+			valid:   true,
+		},
+		"tokens only": {
+			content: "bearer_tokens: [token]\n",
+			valid:   true,
+		},
+		"empty": {
+			content: "",
+		},
+		"unknown field": {
+			content: "bearer_tokens: [token]\nusers: {}\n",
+		},
+		"plain-text password": {
+			content: "basic_auth_users:\n  alice: secret\n",
+		},
+		"empty token": {
+			content: "bearer_tokens: ['']\n",
+		},
+	}
+	for name, s := range scenarios {
+		file := path.Join(tempDir, "auth.yml")
+		if err := ioutil.WriteFile(file, []byte(s.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadAuthFile(file)
+		if expected, got := s.valid, err == nil; expected != got {
+			t.Errorf("%s: Wanted valid=%v, got error %v.", name, expected, err)
+		}
+	}
+	if _, err := LoadAuthFile(path.Join(tempDir, "nonexistent")); err == nil {
+		t.Error("Expected error for nonexistent auth file.")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &AuthConfig{
+		BasicAuthUsers: map[string]string{"alice": string(hash)},
+		BearerTokens:   []string{"token1", "token2"},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	handler := Authenticate(cfg, "/", next, logger)
+
+	scenarios := []struct {
+		method, path string
+		user, pass   string
+		token        string
+		protect      bool
+		code         int
+	}{
+		{method: "GET", path: "/", code: http.StatusAccepted},
+		{method: "GET", path: "/metrics", code: http.StatusAccepted},
+		{method: "GET", path: "/metrics", protect: true, code: http.StatusUnauthorized},
+		{method: "GET", path: "/metrics", protect: true, token: "token1", code: http.StatusAccepted},
+		{method: "GET", path: "/metrics/job/foo", code: http.StatusAccepted},
+		{method: "GET", path: "/metrics/job/foo", protect: true, code: http.StatusUnauthorized},
+		// Protecting the metrics protects all other reads exposing them.
+		{method: "GET", path: "/", protect: true, code: http.StatusUnauthorized},
+		{method: "GET", path: "/api/v1/metrics", protect: true, code: http.StatusUnauthorized},
+		{method: "GET", path: "/api/v1/rejected", protect: true, code: http.StatusUnauthorized},
+		{method: "GET", path: "/api/v1/admin/backup", protect: true, code: http.StatusUnauthorized},
+		{method: "GET", path: "/debug/pprof/heap", protect: true, code: http.StatusUnauthorized},
+		{method: "GET", path: "/api/v1/metrics", protect: true, token: "token2", code: http.StatusAccepted},
+		{method: "GET", path: "/-/healthy", protect: true, code: http.StatusAccepted},
+		{method: "GET", path: "/-/ready", protect: true, code: http.StatusAccepted},
+		{method: "GET", path: "/static/functions.js", protect: true, code: http.StatusAccepted},
+		{method: "PUT", path: "/metrics/job/foo", code: http.StatusUnauthorized},
+		{method: "POST", path: "/metrics/job/foo", code: http.StatusUnauthorized},
+		{method: "DELETE", path: "/metrics/job/foo", code: http.StatusUnauthorized},
+		{method: "PUT", path: "/metrics/job/foo", user: "alice", pass: "secret", code: http.StatusAccepted},
+		{method: "PUT", path: "/metrics/job/foo", user: "alice", pass: "wrong", code: http.StatusUnauthorized},
+		{method: "PUT", path: "/metrics/job/foo", user: "bob", pass: "secret", code: http.StatusUnauthorized},
+		{method: "POST", path: "/metrics/job/foo", token: "token2", code: http.StatusAccepted},
+		{method: "DELETE", path: "/metrics/job/foo", token: "token3", code: http.StatusUnauthorized},
+	}
+	for i, s := range scenarios {
+		cfg.ProtectMetrics = s.protect
+		req, err := http.NewRequest(s.method, "http://example.org"+s.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.user != "" {
+			req.SetBasicAuth(s.user, s.pass)
+		}
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("%d. %s %s: Wanted status code %d, got %d.", i, s.method, s.path, expected, got)
+		}
+		if w.Code == http.StatusUnauthorized {
+			if expected, got := `Basic realm="Pushgateway"`, w.Header().Get("WWW-Authenticate"); expected != got {
+				t.Errorf("%d. Wanted WWW-Authenticate header %q, got %q.", i, expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxAuthzCacheSize is the number of cached decisions of an AuthzWebhook
+// beyond which expired decisions are dropped from the cache (and all of them
+// if none has expired).
+const maxAuthzCacheSize = 10000
+
+var authzDecisionsDesc = prometheus.NewDesc(
+	"pushgateway_authz_webhook_decisions_total",
+	"Total number of authorization decisions, by result (allowed, denied, or error) and whether they were taken from the cache.",
+	[]string{"result", "cached"}, nil,
+)
+
+// AuthzRequest is the JSON body POSTed to the authorization webhook for every
+// group a request modifies.
+type AuthzRequest struct {
+	Action       string            `json:"action"` // push, delete, lock, unlock, or rename.
+	Method       string            `json:"method"`
+	Path         string            `json:"path"`
+	Group        map[string]string `json:"group"`
+	User         string            `json:"user,omitempty"`
+	BearerToken  string            `json:"bearer_token,omitempty"`
+	ClientCertCN string            `json:"client_cert_cn,omitempty"`
+	RemoteAddr   string            `json:"remote_addr"`
+}
+
+// AuthzResponse is the JSON body expected from the authorization webhook.
+type AuthzResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// AuthzWebhook asks an external authorization service whether a request may
+// modify a group, see AuthorizeWebhook. Decisions are cached per identity,
+// action, and group. It is safe for concurrent use.
+//
+// An AuthzWebhook implements prometheus.Collector to expose metrics about its
+// decisions. It is up to the caller to register it.
+type AuthzWebhook struct {
+	url      string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mtx       sync.Mutex
+	cache     map[string]authzDecision
+	decisions map[[2]string]float64 // By result and cached.
+}
+
+type authzDecision struct {
+	AuthzResponse
+	expires time.Time
+}
+
+// NewAuthzWebhook returns an AuthzWebhook POSTing to the provided URL, waiting
+// at most timeout for a response, and caching decisions for cacheTTL (not at
+// all if zero). Credentials for basic auth may be included in the URL.
+func NewAuthzWebhook(rawURL string, timeout, cacheTTL time.Duration) (*AuthzWebhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization webhook URL %q: %v", rawURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("authorization webhook URL %q has to start with http:// or https://", rawURL)
+	}
+	return &AuthzWebhook{
+		url:       u.String(),
+		client:    &http.Client{Timeout: timeout},
+		cacheTTL:  cacheTTL,
+		cache:     map[string]authzDecision{},
+		decisions: map[[2]string]float64{},
+	}, nil
+}
+
+// Describe implements prometheus.Collector.
+func (wh *AuthzWebhook) Describe(ch chan<- *prometheus.Desc) {
+	ch <- authzDecisionsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (wh *AuthzWebhook) Collect(ch chan<- prometheus.Metric) {
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+	for _, result := range []string{"allowed", "denied", "error"} {
+		for _, cached := range []string{"false", "true"} {
+			if result == "error" && cached == "true" {
+				continue // Errors are never cached.
+			}
+			ch <- prometheus.MustNewConstMetric(
+				authzDecisionsDesc, prometheus.CounterValue,
+				wh.decisions[[2]string{result, cached}], result, cached,
+			)
+		}
+	}
+}
+
+// authorize returns the decision of the webhook for the provided request. An
+// error is returned if the webhook could not be asked or did not respond with
+// a valid AuthzResponse. Errors are not cached.
+func (wh *AuthzWebhook) authorize(req AuthzRequest) (AuthzResponse, error) {
+	key := authzCacheKey(req)
+	now := time.Now()
+	wh.mtx.Lock()
+	if d, ok := wh.cache[key]; ok && now.Before(d.expires) {
+		wh.count(d.AuthzResponse, nil, true)
+		wh.mtx.Unlock()
+		return d.AuthzResponse, nil
+	}
+	wh.mtx.Unlock()
+
+	resp, err := wh.ask(req)
+
+	wh.mtx.Lock()
+	defer wh.mtx.Unlock()
+	wh.count(resp, err, false)
+	if err != nil || wh.cacheTTL <= 0 {
+		return resp, err
+	}
+	if len(wh.cache) >= maxAuthzCacheSize {
+		for k, d := range wh.cache {
+			if !now.Before(d.expires) {
+				delete(wh.cache, k)
+			}
+		}
+		if len(wh.cache) >= maxAuthzCacheSize {
+			wh.cache = map[string]authzDecision{}
+		}
+	}
+	wh.cache[key] = authzDecision{AuthzResponse: resp, expires: now.Add(wh.cacheTTL)}
+	return resp, nil
+}
+
+// count counts a decision. The caller must hold wh.mtx.
+func (wh *AuthzWebhook) count(resp AuthzResponse, err error, cached bool) {
+	result := "denied"
+	switch {
+	case err != nil:
+		result = "error"
+	case resp.Allowed:
+		result = "allowed"
+	}
+	wh.decisions[[2]string{result, fmt.Sprint(cached)}]++
+}
+
+// ask POSTs the provided request to the webhook and decodes its response.
+func (wh *AuthzWebhook) ask(req AuthzRequest) (AuthzResponse, error) {
+	var resp AuthzResponse
+	body, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	httpResp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, httpResp.Body)
+		httpResp.Body.Close()
+	}()
+	if httpResp.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("unexpected status code %d", httpResp.StatusCode)
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("invalid response: %v", err)
+	}
+	return resp, nil
+}
+
+// authzCacheKey returns the key under which the decision for the provided
+// request is cached. The method and path are not part of it, as the decision
+// must only depend on the identity, the action, and the group.
+func authzCacheKey(req AuthzRequest) string {
+	names := make([]string, 0, len(req.Group))
+	for name := range req.Group {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{req.Action, req.User, req.BearerToken, req.ClientCertCN}
+	for _, name := range names {
+		parts = append(parts, name, req.Group[name])
+	}
+	// JSON encoding keeps the parts apart no matter what they contain.
+	b, _ := json.Marshal(parts)
+	return string(b)
+}
+
+// AuthorizeWebhook returns a handler that asks wh whether the request may
+// modify the addressed groups for the same requests AuthorizeJobs checks, i.e.
+// pushes and deletions below pushPath and locking, unlocking, and renaming
+// below groupsPath. A rename needs permission for both the old and the new
+// group. Denied requests are rejected with http.StatusForbidden, and requests
+// for which the webhook could not decide with http.StatusServiceUnavailable.
+// Requests whose groups cannot be determined are rejected with
+// http.StatusBadRequest without asking the webhook. All other requests are
+// passed on to next unchecked.
+//
+// The identities sent to the webhook are the basic auth user (but not its
+// password), the bearer token, and the common name of the verified client
+// certificate. Like AuthorizeJobs, AuthorizeWebhook does not verify basic auth
+// credentials.
+func AuthorizeWebhook(
+	wh *AuthzWebhook,
+	pushPath, groupsPath string,
+	next http.Handler,
+	logger log.Logger,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action, groups, ok, err := modifiedGroups(r, pushPath, groupsPath)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			level.Debug(logger).Log("msg", "cannot authorize malformed request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := AuthzRequest{
+			Action:     action,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			RemoteAddr: r.RemoteAddr,
+		}
+		if user, _, ok := r.BasicAuth(); ok {
+			req.User = user
+		}
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, bearerPrefix) {
+			req.BearerToken = strings.TrimPrefix(auth, bearerPrefix)
+		}
+		if cn, ok := clientCertCN(r); ok {
+			req.ClientCertCN = cn
+		}
+		for _, labels := range groups {
+			req.Group = labels
+			resp, err := wh.authorize(req)
+			if err != nil {
+				level.Error(logger).Log("msg", "authorization webhook failed", "method", r.Method, "path", r.URL.Path, "err", err)
+				http.Error(w, "authorization not possible, try again later", http.StatusServiceUnavailable)
+				return
+			}
+			if !resp.Allowed {
+				level.Debug(logger).Log("msg", "request denied by authorization webhook", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr, "reason", resp.Reason)
+				msg := fmt.Sprintf("not permitted to %s group %v", action, labels)
+				if resp.Reason != "" {
+					msg += ": " + resp.Reason
+				}
+				http.Error(w, msg, http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
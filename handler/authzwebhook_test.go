@@ -0,0 +1,131 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeWebhook(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests []AuthzRequest
+		failing  bool
+	)
+	// Allows alice to modify the job "team_a" only.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var req AuthzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, req)
+		resp := AuthzResponse{Allowed: req.User == "alice" && req.Group["job"] == "team_a"}
+		if !resp.Allowed {
+			resp.Reason = "ask team A"
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	wh, err := NewAuthzWebhook(server.URL, time.Second, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := AuthorizeWebhook(wh, "/metrics", "/api/v1/groups", next, logger)
+	serve := func(method, path, body, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	numRequests := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(requests)
+	}
+
+	scenarios := []struct {
+		method, path, body, user string
+		expectedCode             int
+		expectedRequests         int
+	}{
+		{http.MethodPut, "/metrics/job/team_a/instance/x", "", "alice", http.StatusAccepted, 1},
+		// Cached.
+		{http.MethodPost, "/metrics/job/team_a/instance/x", "", "alice", http.StatusAccepted, 1},
+		{http.MethodDelete, "/metrics/job/team_a/instance/x/@metric/foo", "", "alice", http.StatusAccepted, 2},
+		{http.MethodPut, "/metrics/job/team_b", "", "alice", http.StatusForbidden, 3},
+		{http.MethodPut, "/metrics/job/team_a", "", "bob", http.StatusForbidden, 4},
+		{http.MethodPut, "/api/v1/groups/job/team_a/lock", "", "alice", http.StatusAccepted, 5},
+		// Both groups of a rename are checked.
+		{http.MethodPost, "/api/v1/groups/rename", `{"from": {"job": "team_a"}, "to": {"job": "team_b"}}`, "alice", http.StatusForbidden, 7},
+		// A trailing slash addresses the group without further labels.
+		{http.MethodPut, "/metrics/job/team_a/", "", "alice", http.StatusAccepted, 8},
+		{http.MethodDelete, "/metrics/job/team_b/", "", "alice", http.StatusForbidden, 9},
+		// Malformed, rejected without asking.
+		{http.MethodPut, "/metrics/job/team_b/instance", "", "bob", http.StatusBadRequest, 9},
+		{http.MethodPut, "/metrics/job/", "", "bob", http.StatusBadRequest, 9},
+		{http.MethodPost, "/api/v1/groups/rename", `{"from": `, "bob", http.StatusBadRequest, 9},
+		// Not checked.
+		{http.MethodGet, "/metrics/job/team_b", "", "bob", http.StatusAccepted, 9},
+	}
+	for _, s := range scenarios {
+		w := serve(s.method, s.path, s.body, s.user)
+		if expected, got := s.expectedCode, w.Code; expected != got {
+			t.Errorf("%s %s as %q: Wanted status code %d, got %d.", s.method, s.path, s.user, expected, got)
+		}
+		if expected, got := s.expectedRequests, numRequests(); expected != got {
+			t.Errorf("%s %s as %q: Wanted %d webhook requests, got %d.", s.method, s.path, s.user, expected, got)
+		}
+	}
+	if body := serve(http.MethodPut, "/metrics/job/team_b", "", "alice").Body.String(); !strings.Contains(body, "ask team A") {
+		t.Errorf("Wanted reason in response, got %q.", body)
+	}
+	mtx.Lock()
+	req := requests[0]
+	mtx.Unlock()
+	if req.Action != "push" || req.User != "alice" || req.Group["instance"] != "x" || req.Path != "/metrics/job/team_a/instance/x" {
+		t.Errorf("Unexpected webhook request %+v.", req)
+	}
+
+	// Errors are not cached, and the request is rejected as unavailable.
+	mtx.Lock()
+	failing = true
+	mtx.Unlock()
+	for i := 0; i < 2; i++ {
+		if expected, got := http.StatusServiceUnavailable, serve(http.MethodPut, "/metrics/job/team_c", "", "alice").Code; expected != got {
+			t.Errorf("Wanted status code %d, got %d.", expected, got)
+		}
+	}
+	if expected, got := float64(2), wh.decisions[[2]string{"error", "false"}]; expected != got {
+		t.Errorf("Wanted %v errors, got %v.", expected, got)
+	}
+}
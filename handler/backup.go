@@ -0,0 +1,260 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// backupRetention is how long the snapshot of the last backup is kept to
+// resume its download.
+const backupRetention = time.Hour
+
+var (
+	errInvalidRange       = errors.New("not a single byte range")
+	errUnsatisfiableRange = errors.New("byte range not satisfiable")
+	// errRangeWritten stops writing a snapshot once the requested range
+	// has been written.
+	errRangeWritten = errors.New("range written")
+)
+
+// Backup returns an http.Handler that writes a snapshot of the MetricStore to
+// the response like the handler returned by Snapshot does. The snapshot is a
+// copy-on-write view of the metric groups (see GetMetricFamiliesMap), so no
+// lock is held while it is written, and pushes are processed meanwhile.
+//
+// The snapshot of the last backup is kept for backupRetention, identified by
+// the ETag of the response, so that an interrupted download can be resumed with
+// a request for a single byte range. A range request continues the last backup
+// unless its If-Range header names another ETag, in which case (as well as
+// after the retention, or for any other request) a new backup is taken and
+// written as a whole.
+//
+// The returned handler is already instrumented for Prometheus.
+func Backup(ms storage.MetricStore, logger log.Logger) http.Handler {
+	return InstrumentWithCounter("backup", &backup{ms: ms, logger: logger})
+}
+
+type backup struct {
+	ms     storage.MetricStore
+	logger log.Logger
+
+	mtx  sync.Mutex
+	last *backupSnapshot
+}
+
+// backupSnapshot is the snapshot of a backup, kept to resume its download.
+type backupSnapshot struct {
+	etag    string
+	created time.Time
+	groups  storage.GroupingKeyToMetricGroup
+
+	sizeOnce sync.Once
+	size     int64
+	sizeErr  error
+}
+
+func (b *backup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var snap *backupSnapshot
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" {
+		snap = b.resumable(r.Header.Get("If-Range"))
+	}
+	resumed := snap != nil
+	if !resumed {
+		snap = b.take()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="pushgateway.snapshot"`)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", snap.etag)
+	w.Header().Set("Last-Modified", snap.created.UTC().Format(http.TimeFormat))
+
+	if resumed {
+		size, err := snap.getSize()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			level.Error(b.logger).Log("msg", "failed to write backup", "err", err.Error())
+			return
+		}
+		start, length, err := parseByteRange(rangeHeader, size)
+		switch err {
+		case nil:
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+			w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+			w.WriteHeader(http.StatusPartialContent)
+			err := storage.WriteSnapshot(&rangeWriter{w: w, skip: start, remaining: length}, snap.groups)
+			if err != nil && err != errRangeWritten {
+				// Too late to change the status code.
+				level.Error(b.logger).Log("msg", "failed to write backup", "err", err.Error())
+			}
+			return
+		case errUnsatisfiableRange:
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		// Any other range is ignored, and the whole backup is written.
+	}
+	if err := storage.WriteSnapshot(w, snap.groups); err != nil {
+		// Too late to change the status code.
+		level.Error(b.logger).Log("msg", "failed to write backup", "err", err.Error())
+	}
+}
+
+// resumable returns the snapshot of the last backup if it is still kept and
+// matches the provided If-Range header (if not empty), or nil otherwise.
+func (b *backup) resumable(ifRange string) *backupSnapshot {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.last == nil || time.Since(b.last.created) > backupRetention {
+		return nil
+	}
+	if ifRange != "" && ifRange != b.last.etag {
+		return nil
+	}
+	return b.last
+}
+
+// take takes a new snapshot and keeps it as the last backup.
+func (b *backup) take() *backupSnapshot {
+	now := time.Now()
+	snap := &backupSnapshot{
+		etag:    fmt.Sprintf(`"%x"`, now.UnixNano()),
+		created: now,
+		groups:  b.ms.GetMetricFamiliesMap(),
+	}
+	b.mtx.Lock()
+	b.last = snap
+	b.mtx.Unlock()
+	// Release the snapshot after the retention so that it does not keep
+	// replaced metric groups from being garbage collected.
+	time.AfterFunc(backupRetention, func() {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		if b.last == snap {
+			b.last = nil
+		}
+	})
+	return snap
+}
+
+// getSize returns the size of the written snapshot, which is determined by
+// writing it once without keeping the output.
+func (s *backupSnapshot) getSize() (int64, error) {
+	s.sizeOnce.Do(func() {
+		cw := &countingWriter{}
+		s.sizeErr = storage.WriteSnapshot(cw, s.groups)
+		s.size = cw.n
+	})
+	return s.size, s.sizeErr
+}
+
+// parseByteRange parses a Range header with a single byte range for a body of
+// the provided size and returns the position of its first byte and its length.
+// For anything but a single byte range, errInvalidRange is returned. For a
+// range outside of the body, errUnsatisfiableRange is returned.
+func parseByteRange(s string, size int64) (int64, int64, error) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, errInvalidRange
+	}
+	parts := strings.SplitN(strings.TrimSpace(s[len("bytes="):]), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errInvalidRange
+	}
+	first, last := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if first == "" {
+		// A suffix range, i.e. the last bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errInvalidRange
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidRange
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, errInvalidRange
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+	return start, end - start + 1, nil
+}
+
+// rangeWriter writes only the byte range of what is written to it that starts
+// after skip bytes and is remaining bytes long. Once the range has been
+// written, errRangeWritten is returned.
+type rangeWriter struct {
+	w               io.Writer
+	skip, remaining int64
+}
+
+func (rw *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if rw.skip >= int64(n) {
+		rw.skip -= int64(n)
+		return n, nil
+	}
+	p = p[rw.skip:]
+	rw.skip = 0
+	if int64(len(p)) > rw.remaining {
+		p = p[:rw.remaining]
+	}
+	if _, err := rw.w.Write(p); err != nil {
+		return 0, err
+	}
+	rw.remaining -= int64(len(p))
+	if rw.remaining == 0 {
+		return n, errRangeWritten
+	}
+	return n, nil
+}
+
+// countingWriter discards what is written to it, counting the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
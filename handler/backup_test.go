@@ -0,0 +1,124 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestBackup(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	defer ms.Shutdown()
+	push := func(job string) {
+		errCh := make(chan error, 1)
+		ms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:    map[string]string{"job": job},
+			Timestamp: time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{"some_metric": {
+				Name:   proto.String("some_metric"),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+			}},
+			Done: errCh,
+		})
+		for err := range errCh {
+			t.Fatal(err)
+		}
+	}
+	push("a")
+	handler := Backup(ms, logger)
+	get := func(header ...string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://example.org/api/v1/admin/backup", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get()
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	full, etag := w.Body.Bytes(), w.Header().Get("ETag")
+	groups, err := storage.ReadSnapshot(bytes.NewReader(full))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, len(groups); expected != got {
+		t.Fatalf("Wanted %d groups in backup, got %d.", expected, got)
+	}
+
+	// Resuming returns the rest of the same backup, even after a push.
+	push("b")
+	for _, s := range []struct {
+		header   []string
+		expected []byte
+	}{
+		{[]string{"Range", "bytes=10-"}, full[10:]},
+		{[]string{"Range", "bytes=10-19", "If-Range", etag}, full[10:20]},
+		{[]string{"Range", "bytes=-5"}, full[len(full)-5:]},
+		{[]string{"Range", "bytes=5-100000"}, full[5:]},
+	} {
+		w := get(s.header...)
+		if expected, got := http.StatusPartialContent, w.Code; expected != got {
+			t.Errorf("%v: Wanted status code %v, got %v.", s.header, expected, got)
+			continue
+		}
+		if !bytes.Equal(s.expected, w.Body.Bytes()) {
+			t.Errorf("%v: Wanted %x, got %x.", s.header, s.expected, w.Body.Bytes())
+		}
+		if expected, got := etag, w.Header().Get("ETag"); expected != got {
+			t.Errorf("%v: Wanted ETag %s, got %s.", s.header, expected, got)
+		}
+	}
+	if expected, got := http.StatusRequestedRangeNotSatisfiable, get("Range", "bytes=100000-").Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	// A multi-range request gets the whole last backup.
+	if got := get("Range", "bytes=0-1,5-6").Body.Bytes(); !bytes.Equal(full, got) {
+		t.Errorf("Wanted whole backup for multiple ranges, got %x.", got)
+	}
+
+	// With another ETag, a new backup is taken.
+	w = get("Range", "bytes=10-", "If-Range", `"other"`)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Errorf("Wanted new ETag, got %s again.", etag)
+	}
+	if groups, err = storage.ReadSnapshot(w.Body); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(groups); expected != got {
+		t.Errorf("Wanted %d groups in new backup, got %d.", expected, got)
+	}
+}
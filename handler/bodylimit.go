@@ -0,0 +1,114 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errBodyTooLarge = errors.New("request body too large")
+	errPushTimeout  = errors.New("timeout while reading request body")
+)
+
+// LimitPushes returns a handler that limits the body of all PUT and POST
+// requests below pushPath to maxBodySize bytes and the time to read it to
+// timeout before passing them on to next. A zero value means no limit. The push
+// handlers reject requests exceeding the size with
+// http.StatusRequestEntityTooLarge and requests exceeding the time with
+// http.StatusRequestTimeout. Requests with a Content-Length exceeding the size
+// are rejected right away. All other requests are passed on unchanged.
+func LimitPushes(maxBodySize int64, timeout time.Duration, pushPath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodPut && r.Method != http.MethodPost,
+			!strings.HasPrefix(r.URL.Path, pushPath+"/"):
+			next.ServeHTTP(w, r)
+			return
+		}
+		if maxBodySize > 0 {
+			if r.ContentLength > maxBodySize {
+				w.Header().Set("Connection", "close")
+				http.Error(w, fmt.Sprintf("%v, limit is %d bytes", errBodyTooLarge, maxBodySize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = &limitedBody{
+				ReadCloser: http.MaxBytesReader(w, r.Body, maxBodySize),
+				remaining:  maxBodySize,
+			}
+		}
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+			r.Body = newDeadlineBody(ctx, r.Body)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitedBody turns the error returned by an http.MaxBytesReader upon exceeding
+// the limit into errBodyTooLarge.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if err != nil && err != io.EOF && b.remaining <= 0 {
+		err = errBodyTooLarge
+	}
+	return n, err
+}
+
+// newDeadlineBody returns a reader for body that reads from it in a separate
+// goroutine so that a stalled upload does not block the reader beyond the
+// deadline of ctx. After the deadline, reading returns errPushTimeout. Closing
+// the returned reader does not close body, as that would block while the
+// goroutine is stuck reading from it. The server closes body anyway.
+func newDeadlineBody(ctx context.Context, body io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(pw, body)
+		pw.CloseWithError(err)
+	}()
+	go func() {
+		<-ctx.Done()
+		// This is a no-op if the copying above has completed.
+		// Otherwise, it also makes the copying goroutine return once
+		// its current read from body returns.
+		pw.CloseWithError(errPushTimeout)
+	}()
+	return pr
+}
+
+// readErrorStatus returns the HTTP status code for an error that occurred while
+// reading the body of a push.
+func readErrorStatus(err error) int {
+	switch err {
+	case errBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errPushTimeout:
+		return http.StatusRequestTimeout
+	}
+	return http.StatusBadRequest
+}
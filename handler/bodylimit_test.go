@@ -0,0 +1,86 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLimitPushes(t *testing.T) {
+	mms := MockMetricStore{}
+	push := http.HandlerFunc(Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger))
+	h := LimitPushes(100, 50*time.Millisecond, "/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		push.ServeHTTP(w, r.WithContext(ctxWithParams(map[string]string{"job": "foo"}, r)))
+	}))
+	small := "some_metric 1\n"
+	large := strings.Repeat("# Padding to exceed the limit.\n", 10) + small
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte(large))
+	gz.Close()
+	stalled, _ := io.Pipe()
+
+	for name, s := range map[string]struct {
+		method, path  string
+		body          io.Reader
+		contentLength int64
+		encoding      string
+		code          int
+	}{
+		"small":                     {method: "POST", path: "/metrics/job/foo", body: strings.NewReader(small), contentLength: -1, code: http.StatusOK},
+		"large with content length": {method: "POST", path: "/metrics/job/foo", body: strings.NewReader(large), contentLength: int64(len(large)), code: http.StatusRequestEntityTooLarge},
+		"large chunked":             {method: "PUT", path: "/metrics/job/foo", body: strings.NewReader(large), contentLength: -1, code: http.StatusRequestEntityTooLarge},
+		// The limit applies to the compressed body.
+		"gzipped": {method: "POST", path: "/metrics/job/foo", body: &gzipped, contentLength: -1, encoding: "gzip", code: http.StatusOK},
+		"stalled": {method: "POST", path: "/metrics/job/foo", body: stalled, contentLength: -1, code: http.StatusRequestTimeout},
+	} {
+		mms.writeRequests = nil
+		req, err := http.NewRequest(s.method, "http://example.org"+s.path, s.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = s.contentLength
+		if s.encoding != "" {
+			req.Header.Set("Content-Encoding", s.encoding)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("%s: Wanted status code %v, got %v (%s).", name, expected, got, w.Body.String())
+		}
+		if expected, got := s.code == http.StatusOK, len(mms.writeRequests) == 1; expected != got {
+			t.Errorf("%s: Wanted write request %v, got %v.", name, expected, got)
+		}
+	}
+
+	// Other requests are passed on unchanged.
+	req, err := http.NewRequest("POST", "http://example.org/other", stalled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body io.Reader
+	LimitPushes(100, 50*time.Millisecond, "/metrics", http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		body = r.Body
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if body != req.Body {
+		t.Error("Body of other request was modified.")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the content of the file provided with --config.file. All sections
+// are optional. A present section replaces the corresponding flag, i.e. limits
+// replaces the --storage.max-* and --storage.limit-action flags, auth replaces --web.auth.file, acls
+// replaces --web.acl-file, metric_relabel_configs replaces
+// --push.relabel-config-file, and tenants replaces --tenancy.file. The sections
+// have the same format as the content of the respective files.
+type Config struct {
+	Limits               *TenantLimits            `yaml:"limits"`
+	Auth                 *AuthConfig              `yaml:"auth"`
+	ACLs                 []*JobACL                `yaml:"acls"`
+	MetricRelabelConfigs []*RelabelConfig         `yaml:"metric_relabel_configs"`
+	Tenants              map[string]*TenantConfig `yaml:"tenants"`
+}
+
+// LoadConfigFile reads and validates a Config from the provided YAML file,
+// applying the same checks as the loaders of the files it replaces.
+func LoadConfigFile(file string) (*Config, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse config file %q: %v", file, err)
+	}
+	if cfg.Limits != nil {
+		if err := cfg.Limits.validate(); err != nil {
+			return nil, fmt.Errorf("%v in config file %q", err, file)
+		}
+	}
+	if cfg.Auth != nil {
+		if err := cfg.Auth.validate(fmt.Sprintf("the auth section of config file %q", file)); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ACLs != nil && len(cfg.ACLs) == 0 {
+		return nil, fmt.Errorf("the acls section of config file %q configures no ACLs", file)
+	}
+	if cfg.Tenants != nil {
+		tc := &TenantsConfig{Tenants: cfg.Tenants}
+		if err := tc.validate(fmt.Sprintf("the tenants section of config file %q", file)); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// ACLConfig returns the acls section as an ACLConfig, or nil if the section is
+// absent.
+func (cfg *Config) ACLConfig() *ACLConfig {
+	if cfg.ACLs == nil {
+		return nil
+	}
+	return &ACLConfig{ACLs: cfg.ACLs}
+}
+
+// TenantsConfig returns the tenants section as a TenantsConfig, or nil if the
+// section is absent.
+func (cfg *Config) TenantsConfig() *TenantsConfig {
+	if cfg.Tenants == nil {
+		return nil
+	}
+	return &TenantsConfig{Tenants: cfg.Tenants}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestLoadConfigFile.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	scenarios := map[string]struct {
+		content string
+		valid   bool
+	}{
+		"empty": {
+			content: "",
+			valid:   true,
+		},
+		"all sections": {
+			content: `
+limits:
+  max_groups: 10
+auth:
+  bearer_tokens: [secret]
+acls:
+- bearer_tokens: [secret]
+  jobs: ['.*']
+metric_relabel_configs:
+- action: labeldrop
+  regex: debug
+tenants:
+  team-a:
+`,
+			valid: true,
+		},
+		"negative limit": {
+			content: "limits:\n  max_samples: -1\n",
+		},
+		"negative label value length": {
+			content: "limits:\n  max_label_value_length: -1\n  truncate: true\n",
+		},
+		"auth without credentials": {
+			content: "auth:\n  protect_metrics: true\n",
+		},
+		"empty ACLs": {
+			content: "acls: []\n",
+		},
+		"invalid relabel config": {
+			content: "metric_relabel_configs:\n- action: keep\n",
+		},
+		"invalid tenant ID": {
+			content: "tenants:\n  team/a:\n",
+		},
+		"unknown section": {
+			content: "max_groups: 10\n",
+		},
+	}
+	for name, s := range scenarios {
+		file := path.Join(tempDir, "config.yml")
+		if err := ioutil.WriteFile(file, []byte(s.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfigFile(file)
+		if expected, got := s.valid, err == nil; expected != got {
+			t.Errorf("%s: Wanted valid=%v, got error %v.", name, expected, err)
+		}
+		if err != nil || name != "all sections" {
+			continue
+		}
+		if expected, got := 10, cfg.Limits.MaxGroups; expected != got {
+			t.Errorf("%s: Wanted max_groups %d, got %d.", name, expected, got)
+		}
+		if cfg.ACLConfig() == nil || !cfg.ACLConfig().UsesCredentials() {
+			t.Errorf("%s: Wanted ACLs using credentials.", name)
+		}
+		if tc := cfg.TenantsConfig(); tc == nil || tc.Tenants["team-a"] == nil {
+			t.Errorf("%s: Wanted empty config for tenant without settings.", name)
+		}
+	}
+}
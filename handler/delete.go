@@ -16,18 +16,33 @@ package handler
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
 
 	"github.com/prometheus/pushgateway/storage"
 )
 
+// MetricNameSegment marks a pair of path components at the end of a delete URL
+// that names a single metric family to delete instead of the whole group,
+// e.g. /metrics/job/foo/instance/bar/@metric/my_counter. As '@' is not allowed
+// in label names, it cannot be confused with a grouping label.
+const MetricNameSegment = "@metric"
+
 // Delete returns a handler that accepts delete requests.
 //
+// If the URL ends with one or more MetricNameSegment components, each followed
+// by a metric name, only the named metric families are deleted from the group.
+// Metric families can also be named with (possibly repeated) "metric" query
+// parameters. With (possibly repeated) "label" query parameters in the form
+// name:value, only the metrics with all of those labels are deleted from the
+// (named or otherwise all) metric families, see storage.WriteRequest.
+//
 // The returned handler is already instrumented for Prometheus.
 func Delete(ms storage.MetricStore, jobBase64Encoded bool, logger log.Logger) func(http.ResponseWriter, *http.Request) {
 	var mtx sync.Mutex // Protects ps.
@@ -36,33 +51,35 @@ func Delete(ms storage.MetricStore, jobBase64Encoded bool, logger log.Logger) fu
 		"delete",
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			job := route.Param(r.Context(), "job")
-			if jobBase64Encoded {
-				var err error
-				if job, err = decodeBase64(job); err != nil {
-					http.Error(w, fmt.Sprintf("invalid base64 encoding in job name %q: %v", job, err), http.StatusBadRequest)
-					level.Debug(logger).Log("msg", "invalid base64 encoding in job name", "job", job, "err", err.Error())
-					return
-				}
-			}
 			labelsString := route.Param(r.Context(), "labels")
 			mtx.Unlock()
 
-			labels, err := splitLabels(labelsString)
+			labelsString, metricNames, err := splitMetricNames(labelsString)
+			var labels map[string]string
+			if err == nil {
+				labels, err = groupingLabels(job, labelsString, jobBase64Encoded)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to parse URL", "url", r.URL.Path, "err", err.Error())
+				return
+			}
+			metricNames, metricLabels, err := parseDeleteFilters(r, metricNames)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
-				level.Debug(logger).Log("msg", "failed to parse URL", "url", labelsString, "err", err.Error())
+				level.Debug(logger).Log("msg", "failed to parse query", "query", r.URL.RawQuery, "err", err.Error())
 				return
 			}
-			if job == "" {
-				http.Error(w, "job name is required", http.StatusBadRequest)
-				level.Debug(logger).Log("msg", "job name is required")
+			traceGroup(r, labels, nil)
+			if err := ms.SubmitWriteRequest(storage.WriteRequest{
+				Labels:       labels,
+				Timestamp:    time.Now(),
+				MetricNames:  metricNames,
+				MetricLabels: metricLabels,
+			}); err != nil {
+				submitFailed(w, err, logger)
 				return
 			}
-			labels["job"] = job
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:    labels,
-				Timestamp: time.Now(),
-			})
 			w.WriteHeader(http.StatusAccepted)
 		}),
 	)
@@ -72,3 +89,56 @@ func Delete(ms storage.MetricStore, jobBase64Encoded bool, logger log.Logger) fu
 		instrumentedHandler.ServeHTTP(w, r)
 	}
 }
+
+// parseDeleteFilters appends the metric names from the "metric" query
+// parameters of the provided delete request to names and returns them together
+// with the label pairs from the "label" query parameters, nil if there are none.
+func parseDeleteFilters(r *http.Request, names []string) ([]string, map[string]string, error) {
+	query := r.URL.Query()
+	for _, name := range query["metric"] {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return nil, nil, fmt.Errorf("invalid metric name %q", name)
+		}
+		names = append(names, name)
+	}
+	var labels map[string]string
+	for _, v := range query["label"] {
+		i := strings.Index(v, ":")
+		if i <= 0 {
+			return nil, nil, fmt.Errorf("invalid label %q, must be name:value", v)
+		}
+		name, value := v[:i], v[i+1:]
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		if _, ok := labels[name]; ok {
+			return nil, nil, fmt.Errorf("duplicate label %q", name)
+		}
+		labels[name] = value
+	}
+	return names, labels, nil
+}
+
+// splitMetricNames removes trailing MetricNameSegment components and the metric
+// names following them from the provided label string. It returns the remaining
+// label string and the removed metric names.
+func splitMetricNames(labels string) (string, []string, error) {
+	var names []string
+	marker := "/" + MetricNameSegment + "/"
+	for {
+		i := strings.LastIndex(labels, marker)
+		if i < 0 {
+			break
+		}
+		name := labels[i+len(marker):]
+		if strings.Contains(name, "/") {
+			break
+		}
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return "", nil, fmt.Errorf("invalid metric name %q", name)
+		}
+		names = append([]string{name}, names...)
+		labels = labels[:i]
+	}
+	return labels, names, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/route"
+
+	"github.com/prometheus/pushgateway/internal/codec"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// GroupMetrics returns a handler that exposes the metric families of the group
+// identified by the request URL (using the same format as a push URL) in the
+// exposition format negotiated with the client, i.e. text or protobuf. This
+// allows pushers to read back what the Pushgateway currently holds for them,
+// including the automatically added push timestamp metrics. If the group does
+// not exist, http.StatusNotFound is returned.
+//
+// With the "format" query parameter set to "push", the exposition format of the
+// last push to the group (see storage.PushFormat) is used instead of the
+// negotiated one, falling back to the negotiated one if it is unknown.
+//
+// The returned handler is already instrumented for Prometheus.
+func GroupMetrics(ms storage.MetricStore, jobBase64Encoded bool, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"group_metrics",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			job := route.Param(r.Context(), "job")
+			if jobBase64Encoded {
+				var err error
+				if job, err = decodeBase64(job); err != nil {
+					http.Error(w, fmt.Sprintf("invalid base64 encoding in job name %q: %v", job, err), http.StatusBadRequest)
+					level.Debug(logger).Log("msg", "invalid base64 encoding in job name", "job", job, "err", err.Error())
+					return
+				}
+			}
+			labelsString := route.Param(r.Context(), "labels")
+			labels, err := splitLabels(labelsString)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to parse URL", "url", labelsString, "err", err.Error())
+				return
+			}
+			if job == "" {
+				http.Error(w, "job name is required", http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "job name is required")
+				return
+			}
+			labels["job"] = job
+
+			group, ok := findGroup(ms.GetMetricFamiliesMap(), labels)
+			if !ok {
+				http.Error(w, "metric group not found", http.StatusNotFound)
+				return
+			}
+			names := make([]string, 0, len(group.Metrics))
+			for name := range group.Metrics {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			format := codec.Negotiate(r.Header, false)
+			switch f := r.URL.Query().Get("format"); f {
+			case "":
+			case "push":
+				if group.PushFormat.Format != "" {
+					format = group.PushFormat.Format
+				}
+			default:
+				http.Error(w, fmt.Sprintf("unknown format %q, must be \"push\"", f), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", string(format))
+			enc := codec.NewEncoder(w, format)
+			for _, name := range names {
+				mf := group.Metrics[name].GetMetricFamily()
+				if mf == nil {
+					continue
+				}
+				if err := enc.Encode(mf); err != nil {
+					level.Error(logger).Log("msg", "error encoding metric family", "metric_family", name, "err", err.Error())
+					return
+				}
+			}
+			enc.Close()
+		}),
+	)
+}
+
+// findGroup returns the group with exactly the provided grouping labels.
+func findGroup(groups storage.GroupingKeyToMetricGroup, labels map[string]string) (storage.MetricGroup, bool) {
+	for _, group := range groups {
+		if sameGroupingLabels(group.Labels, labels) {
+			return group, true
+		}
+	}
+	return storage.MetricGroup{}, false
+}
+
+func sameGroupingLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for ln, lv := range a {
+		if other, ok := b[ln]; !ok || other != lv {
+			return false
+		}
+	}
+	return true
+}
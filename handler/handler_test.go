@@ -15,11 +15,15 @@ package handler
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,10 +31,13 @@ import (
 	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
 	"github.com/golang/protobuf/proto"
 	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/route"
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/internal/codec"
 	"github.com/prometheus/pushgateway/storage"
 )
 
@@ -45,9 +52,13 @@ type MockMetricStore struct {
 	metricGroups     storage.GroupingKeyToMetricGroup
 	writeRequests    []storage.WriteRequest
 	err              error // If non-nil, will be sent to Done channel in request.
+	submitErr        error // If non-nil, returned by SubmitWriteRequest instead of submitting.
 }
 
-func (m *MockMetricStore) SubmitWriteRequest(req storage.WriteRequest) {
+func (m *MockMetricStore) SubmitWriteRequest(req storage.WriteRequest) error {
+	if m.submitErr != nil {
+		return m.submitErr
+	}
 	m.writeRequests = append(m.writeRequests, req)
 	m.lastWriteRequest = req
 	if req.Done != nil {
@@ -56,6 +67,7 @@ func (m *MockMetricStore) SubmitWriteRequest(req storage.WriteRequest) {
 		}
 		close(req.Done)
 	}
+	return nil
 }
 
 func (m *MockMetricStore) GetMetricFamilies() []*dto.MetricFamily {
@@ -114,9 +126,11 @@ func TestPush(t *testing.T) {
 	mms := MockMetricStore{}
 	mmsWithErr := MockMetricStore{err: errors.New("testerror")}
 	// false, true, false → no replace, check consistency, no base64 encoding.
-	handler := Push(&mms, false, true, false, logger)
-	handlerWithErr := Push(&mmsWithErr, false, true, false, logger)
-	handlerBase64 := Push(&mms, false, true, true, logger)
+	handler := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	handlerWithErr := Push(&mmsWithErr, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	handlerBase64 := Push(&mms, false, true, true, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	handlerAllowTimestamps := Push(&mms, false, true, false, TimestampAllow, LabelConflictOverride, ValidationStrict, nil, logger)
+	handlerStripTimestamps := Push(&mms, false, true, false, TimestampStrip, LabelConflictOverride, ValidationStrict, nil, logger)
 	req, err := http.NewRequest("POST", "http://example.org/", &bytes.Buffer{})
 	if err != nil {
 		t.Fatal(err)
@@ -247,6 +261,55 @@ func TestPush(t *testing.T) {
 		t.Errorf("Wanted metric family %v, got %v.", expected, got)
 	}
 
+	// Same, but storage returns a limit error.
+	mmsWithErr.err = storage.LimitError{What: "metric groups", Value: 2, Max: 1}
+	req, err = http.NewRequest(
+		"POST", "http://example.org/",
+		bytes.NewBufferString("some_metric 3.14\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handlerWithErr(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusRequestEntityTooLarge, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	// Same, but the write queue is full.
+	mmsWithErr.submitErr = storage.ErrWriteQueueFull
+	req, err = http.NewRequest(
+		"POST", "http://example.org/",
+		bytes.NewBufferString("some_metric 3.14\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handlerWithErr(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusServiceUnavailable, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "5", w.Header().Get("Retry-After"); expected != got {
+		t.Errorf("Wanted Retry-After header %q, got %q.", expected, got)
+	}
+	mmsWithErr.submitErr = nil
+
+	// Same, but the group is locked.
+	mmsWithErr.err = storage.ErrGroupLocked
+	req, err = http.NewRequest(
+		"POST", "http://example.org/",
+		bytes.NewBufferString("some_metric 3.14\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handlerWithErr(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusForbidden, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	mmsWithErr.err = errors.New("testerror")
+
 	// With base64-encoded job name and instance name and text content.
 	mms.lastWriteRequest = storage.WriteRequest{}
 	req, err = http.NewRequest(
@@ -333,9 +396,23 @@ func TestPush(t *testing.T) {
 	}
 
 	handler(w, req.WithContext(ctxWithParams(params, req)))
-	// Note that a real storage shourd reject pushes with timestamps. Here
-	// we only make sure it gets through. Rejection is tested in the storage
-	// package.
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request should not have been sent, got %#v.", mms.lastWriteRequest)
+	}
+
+	// Same with timestamps allowed.
+	req, err = http.NewRequest(
+		"POST", "http://example.org/",
+		bytes.NewBufferString("a 1\nb 1 1000\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handlerAllowTimestamps(w, req.WithContext(ctxWithParams(params, req)))
 	if expected, got := http.StatusOK, w.Code; expected != got {
 		t.Errorf("Wanted status code %v, got %v.", expected, got)
 	}
@@ -346,6 +423,30 @@ func TestPush(t *testing.T) {
 	if expected, got := int64(1000), mms.lastWriteRequest.MetricFamilies["b"].GetMetric()[0].GetTimestampMs(); expected != got {
 		t.Errorf("Wanted protobuf timestamp %v, got %v.", expected, got)
 	}
+	if !mms.lastWriteRequest.AllowTimestamps {
+		t.Error("Write request should allow timestamps.")
+	}
+
+	// Same with timestamps stripped.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	req, err = http.NewRequest(
+		"POST", "http://example.org/",
+		bytes.NewBufferString("a 1\nb 1 1000\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handlerStripTimestamps(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if got := mms.lastWriteRequest.MetricFamilies["b"].GetMetric()[0].TimestampMs; got != nil {
+		t.Errorf("Wanted no protobuf timestamp, got %v.", *got)
+	}
+	if mms.lastWriteRequest.AllowTimestamps {
+		t.Error("Write request should not allow timestamps.")
+	}
 
 	// With job name and instance name and protobuf content.
 	mms.lastWriteRequest = storage.WriteRequest{}
@@ -415,11 +516,480 @@ func TestPush(t *testing.T) {
 	}
 }
 
+func TestPushTTL(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	params := map[string]string{
+		"job": "testjob",
+	}
+
+	for _, s := range []struct {
+		url        string
+		header     string
+		wantStatus int
+		wantTTL    time.Duration
+	}{
+		{url: "http://example.org/", wantStatus: http.StatusOK, wantTTL: 0},
+		{url: "http://example.org/?ttl=5m", wantStatus: http.StatusOK, wantTTL: 5 * time.Minute},
+		{url: "http://example.org/", header: "1h", wantStatus: http.StatusOK, wantTTL: time.Hour},
+		{url: "http://example.org/?ttl=30s", header: "1h", wantStatus: http.StatusOK, wantTTL: 30 * time.Second},
+		{url: "http://example.org/?ttl=blub", wantStatus: http.StatusBadRequest},
+		{url: "http://example.org/", header: "-5m", wantStatus: http.StatusBadRequest},
+	} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", s.url, bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.header != "" {
+			req.Header.Set(TTLHeader, s.header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.wantStatus, w.Code; expected != got {
+			t.Errorf("%s, header %q: Wanted status code %v, got %v.", s.url, s.header, expected, got)
+		}
+		if s.wantStatus != http.StatusOK {
+			if !mms.lastWriteRequest.Timestamp.IsZero() {
+				t.Errorf("%s, header %q: Write request unexpectedly submitted: %#v", s.url, s.header, mms.lastWriteRequest)
+			}
+			continue
+		}
+		if expected, got := s.wantTTL, mms.lastWriteRequest.TTL; expected != got {
+			t.Errorf("%s, header %q: Wanted TTL %v, got %v.", s.url, s.header, expected, got)
+		}
+	}
+}
+
+func TestPushExpectedInterval(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	params := map[string]string{
+		"job": "testjob",
+	}
+
+	for _, s := range []struct {
+		url          string
+		wantStatus   int
+		wantInterval time.Duration
+	}{
+		{url: "http://example.org/", wantStatus: http.StatusOK, wantInterval: 0},
+		{url: "http://example.org/?expect=1h", wantStatus: http.StatusOK, wantInterval: time.Hour},
+		{url: "http://example.org/?expect=0s", wantStatus: http.StatusBadRequest},
+		{url: "http://example.org/?expect=blub", wantStatus: http.StatusBadRequest},
+	} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", s.url, bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.wantStatus, w.Code; expected != got {
+			t.Errorf("%s: Wanted status code %v, got %v.", s.url, expected, got)
+		}
+		if expected, got := s.wantInterval, mms.lastWriteRequest.ExpectedInterval; expected != got {
+			t.Errorf("%s: Wanted expected interval %v, got %v.", s.url, expected, got)
+		}
+	}
+}
+
+func TestPushSequence(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	params := map[string]string{
+		"job": "testjob",
+	}
+	push := func(seq string) int {
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != "" {
+			req.Header.Set(SequenceHeader, seq)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		return w.Code
+	}
+
+	for _, s := range []struct {
+		seq          string
+		wantStatus   int
+		wantSequence uint64
+	}{
+		{seq: "", wantStatus: http.StatusOK, wantSequence: 0},
+		{seq: "17", wantStatus: http.StatusOK, wantSequence: 17},
+		{seq: "0", wantStatus: http.StatusBadRequest},
+		{seq: "-1", wantStatus: http.StatusBadRequest},
+		{seq: "blub", wantStatus: http.StatusBadRequest},
+	} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		if expected, got := s.wantStatus, push(s.seq); expected != got {
+			t.Errorf("%q: Wanted status code %v, got %v.", s.seq, expected, got)
+		}
+		if expected, got := s.wantSequence, mms.lastWriteRequest.Sequence; expected != got {
+			t.Errorf("%q: Wanted sequence %d, got %d.", s.seq, expected, got)
+		}
+	}
+
+	mms.err = storage.SequenceError{Sequence: 3, Stored: 17}
+	if expected, got := http.StatusConflict, push("3"); expected != got {
+		t.Errorf("Wanted status code %v for out-of-order push, got %v.", expected, got)
+	}
+}
+
+func TestPushAggregation(t *testing.T) {
+	mms := MockMetricStore{}
+	params := map[string]string{
+		"job": "testjob",
+	}
+
+	for _, s := range []struct {
+		url             string
+		replace         bool
+		wantStatus      int
+		wantAggregation storage.Aggregation
+	}{
+		{url: "http://example.org/", wantStatus: http.StatusOK, wantAggregation: storage.AggregateNone},
+		{url: "http://example.org/?aggregate=sum", wantStatus: http.StatusOK, wantAggregation: storage.AggregateSum},
+		{url: "http://example.org/?aggregate=max", wantStatus: http.StatusOK, wantAggregation: storage.AggregateMax},
+		{url: "http://example.org/?aggregate=avg", wantStatus: http.StatusBadRequest},
+		{url: "http://example.org/?aggregate=sum", replace: true, wantStatus: http.StatusBadRequest},
+	} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		handler := Push(&mms, s.replace, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+		req, err := http.NewRequest("POST", s.url, bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.wantStatus, w.Code; expected != got {
+			t.Errorf("%s, replace %v: Wanted status code %v, got %v.", s.url, s.replace, expected, got)
+		}
+		if s.wantStatus != http.StatusOK {
+			if !mms.lastWriteRequest.Timestamp.IsZero() {
+				t.Errorf("%s, replace %v: Write request unexpectedly submitted: %#v", s.url, s.replace, mms.lastWriteRequest)
+			}
+			continue
+		}
+		if expected, got := s.wantAggregation, mms.lastWriteRequest.Aggregation; expected != got {
+			t.Errorf("%s: Wanted aggregation %q, got %q.", s.url, expected, got)
+		}
+	}
+}
+
+func TestPushAnnotations(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	params := map[string]string{
+		"job": "testjob",
+	}
+
+	for _, s := range []struct {
+		headers         []string
+		wantStatus      int
+		wantAnnotations map[string]string
+	}{
+		{wantStatus: http.StatusOK},
+		{
+			headers:         []string{"build=1234", "pipeline = https://ci.example.org/run?id=5"},
+			wantStatus:      http.StatusOK,
+			wantAnnotations: map[string]string{"build": "1234", "pipeline": "https://ci.example.org/run?id=5"},
+		},
+		{headers: []string{"build"}, wantStatus: http.StatusBadRequest},
+		{headers: []string{"build-id=1234"}, wantStatus: http.StatusBadRequest},
+	} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString("some_metric 3.14\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range s.headers {
+			req.Header.Add(AnnotationHeader, h)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.wantStatus, w.Code; expected != got {
+			t.Errorf("%v: Wanted status code %v, got %v.", s.headers, expected, got)
+		}
+		if s.wantStatus != http.StatusOK {
+			continue
+		}
+		if expected, got := s.wantAnnotations, mms.lastWriteRequest.Annotations; !reflect.DeepEqual(expected, got) {
+			t.Errorf("%v: Wanted annotations %v, got %v.", s.headers, expected, got)
+		}
+	}
+}
+
+func TestPushLabelConflicts(t *testing.T) {
+	mms := MockMetricStore{}
+	override := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	reject := Push(&mms, false, true, false, TimestampReject, LabelConflictReject, ValidationStrict, nil, logger)
+
+	for _, s := range []struct {
+		labels, body string
+		wantStatus   int
+	}{
+		{labels: "", body: "some_metric 1\n", wantStatus: http.StatusOK},
+		{labels: "", body: "some_metric{job=\"testjob\",instance=\"\"} 1\n", wantStatus: http.StatusOK},
+		{labels: "", body: "some_metric{job=\"other\"} 1\n", wantStatus: http.StatusBadRequest},
+		{labels: "", body: "some_metric{instance=\"a\"} 1\n", wantStatus: http.StatusBadRequest},
+		{labels: "/instance/a", body: "some_metric{instance=\"a\"} 1\n", wantStatus: http.StatusOK},
+		{labels: "/instance/a/zone/x", body: "some_metric{zone=\"y\"} 1\n", wantStatus: http.StatusBadRequest},
+		{labels: "/instance/a", body: "some_metric{zone=\"y\"} 1\n", wantStatus: http.StatusOK},
+	} {
+		params := map[string]string{"job": "testjob", "labels": s.labels}
+		for policy, handler := range map[LabelConflictPolicy]func(http.ResponseWriter, *http.Request){
+			LabelConflictOverride: override,
+			LabelConflictReject:   reject,
+		} {
+			req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(s.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req.WithContext(ctxWithParams(params, req)))
+			wantStatus := s.wantStatus
+			if policy == LabelConflictOverride {
+				wantStatus = http.StatusOK
+			}
+			if expected, got := wantStatus, w.Code; expected != got {
+				t.Errorf("%s, %q, %q: Wanted status code %v, got %v.", policy, s.labels, s.body, expected, got)
+			}
+		}
+	}
+}
+
+func TestPushValidation(t *testing.T) {
+	mms := MockMetricStore{}
+	handlers := map[ValidationPolicy]func(http.ResponseWriter, *http.Request){}
+	for _, policy := range ValidationPolicies {
+		handlers[ValidationPolicy(policy)] = Push(&mms, false, false, false, TimestampReject, LabelConflictOverride, ValidationPolicy(policy), nil, logger)
+	}
+
+	for _, s := range []struct {
+		labels             string
+		name, label, value string
+		wantStrict         int
+		wantUTF8           int
+	}{
+		{"", "some_metric", "label", "välue", http.StatusAccepted, http.StatusAccepted},
+		{"", "some.metric", "label", "value", http.StatusBadRequest, http.StatusAccepted},
+		{"", "some_metric", "läbel", "value", http.StatusBadRequest, http.StatusAccepted},
+		{"", "", "label", "value", http.StatusBadRequest, http.StatusBadRequest},
+		{"", "some_metric", "__label", "value", http.StatusBadRequest, http.StatusBadRequest},
+		{"", "some_metric\xff", "label", "value", http.StatusBadRequest, http.StatusBadRequest},
+		{"", "some_metric", "label", "\xff", http.StatusBadRequest, http.StatusBadRequest},
+		// "_w==" is the base64 encoding of "\xff".
+		{"/zone@base64/_w==", "some_metric", "label", "value", http.StatusBadRequest, http.StatusBadRequest},
+	} {
+		buf := &bytes.Buffer{}
+		if _, err := pbutil.WriteDelimited(buf, &dto.MetricFamily{
+			Name: proto.String(s.name),
+			Type: dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{{
+				Label:   []*dto.LabelPair{{Name: proto.String(s.label), Value: proto.String(s.value)}},
+				Untyped: &dto.Untyped{Value: proto.Float64(1)},
+			}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		params := map[string]string{"job": "testjob", "labels": s.labels}
+		for policy, wantStatus := range map[ValidationPolicy]int{
+			ValidationStrict: s.wantStrict,
+			ValidationUTF8:   s.wantUTF8,
+			ValidationNone:   http.StatusAccepted,
+		} {
+			req, err := http.NewRequest("POST", "http://example.org/", bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/vnd.google.protobuf; encoding=delimited; proto=io.prometheus.client.MetricFamily")
+			w := httptest.NewRecorder()
+			handlers[policy](w, req.WithContext(ctxWithParams(params, req)))
+			if expected, got := wantStatus, w.Code; expected != got {
+				t.Errorf("%s, %q, %q, %q, %q: Wanted status code %v, got %v.", policy, s.labels, s.name, s.label, s.value, expected, got)
+			}
+		}
+	}
+}
+
+func TestPushConditional(t *testing.T) {
+	dms := storage.NewDiskMetricStore("", time.Minute, nil, logger)
+	defer dms.Shutdown()
+	handler := Push(dms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	params := map[string]string{"job": "testjob"}
+
+	push := func(body, ifNoneMatch, annotation string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		if annotation != "" {
+			req.Header.Set(AnnotationHeader, annotation)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := http.StatusOK, w.Code; expected != got {
+			t.Errorf("Wanted status code %v, got %v.", expected, got)
+		}
+		return w
+	}
+	lastPushTime := func() time.Time {
+		group, _ := dms.GetMetricGroup(map[string]string{"job": "testjob"})
+		return group.LastPushTime()
+	}
+
+	// SHA-256 of "some_metric 1\n".
+	etag := `"2ab429572972ce6016773eeaab8bb758cf998113e5b04909d28971d24bb954bd"`
+	w := push("some_metric 1\n", etag, "")
+	if expected, got := etag, w.Header().Get("ETag"); expected != got {
+		t.Errorf("Wanted ETag %s, got %s.", expected, got)
+	}
+	if got := w.Header().Get(SkippedHeader); got != "" {
+		t.Errorf("Push to a new group skipped.")
+	}
+	pushTime := lastPushTime()
+
+	for _, ifNoneMatch := range []string{etag, "*", `"other", W/` + etag} {
+		w = push("some_metric 1\n", ifNoneMatch, "")
+		if expected, got := "true", w.Header().Get(SkippedHeader); expected != got {
+			t.Errorf("%s: Unchanged push not skipped.", ifNoneMatch)
+		}
+		if expected, got := etag, w.Header().Get("ETag"); expected != got {
+			t.Errorf("%s: Wanted ETag %s, got %s.", ifNoneMatch, expected, got)
+		}
+	}
+	if expected, got := pushTime, lastPushTime(); !expected.Equal(got) {
+		t.Errorf("Wanted push time %v after skipped pushes, got %v.", expected, got)
+	}
+
+	// Not skipped without If-None-Match, for a new annotation, or for a
+	// changed payload.
+	for _, s := range []struct{ body, ifNoneMatch, annotation string }{
+		{"some_metric 1\n", "", ""},
+		{"some_metric 1\n", `"other"`, ""},
+		{"some_metric 1\n", "*", "build=1"},
+		{"some_metric 2\n", "*", ""},
+	} {
+		if w := push(s.body, s.ifNoneMatch, s.annotation); w.Header().Get(SkippedHeader) != "" {
+			t.Errorf("%+v: Push skipped.", s)
+		}
+	}
+	if group, _ := dms.GetMetricGroup(map[string]string{"job": "testjob"}); group.PayloadHash == "" || `"`+group.PayloadHash+`"` == etag {
+		t.Errorf("Wanted payload hash of the last push, got %q.", group.PayloadHash)
+	}
+	if group, _ := dms.GetMetricGroup(map[string]string{"job": "testjob"}); group.LastPushSize != len("some_metric 2\n") {
+		t.Errorf("Wanted last push size %d, got %d.", len("some_metric 2\n"), group.LastPushSize)
+	}
+}
+
+func TestPushOpenMetrics(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	params := map[string]string{"job": "testjob"}
+	for _, s := range []struct {
+		body       string
+		wantStatus int
+	}{
+		{"# TYPE some_counter counter\nsome_counter_total 3\nsome_counter_created 1000\n# EOF\n", http.StatusOK},
+		{"# TYPE some_counter counter\nsome_counter_total 3\n", http.StatusBadRequest},
+	} {
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/openmetrics-text; version=0.0.1; charset=utf-8")
+		w := httptest.NewRecorder()
+		mms.lastWriteRequest = storage.WriteRequest{}
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.wantStatus, w.Code; expected != got {
+			t.Errorf("%q: Wanted status code %v, got %v.", s.body, expected, got)
+		}
+		if s.wantStatus != http.StatusOK {
+			continue
+		}
+		mf, ok := mms.lastWriteRequest.MetricFamilies["some_counter_total"]
+		if !ok || len(mms.lastWriteRequest.MetricFamilies) != 1 {
+			t.Fatalf("Wanted only metric family some_counter_total, got %v.", mms.lastWriteRequest.MetricFamilies)
+		}
+		if expected, got := 3., mf.GetMetric()[0].GetCounter().GetValue(); expected != got {
+			t.Errorf("Wanted value %v, got %v.", expected, got)
+		}
+	}
+}
+
+func TestPushCompressed(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, nil, logger)
+	params := map[string]string{
+		"job": "testjob",
+	}
+	text := "some_metric 3.14\nanother_metric 42\n"
+
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	gw.Write([]byte(text))
+	gw.Close()
+	deflated := &bytes.Buffer{}
+	zw := zlib.NewWriter(deflated)
+	zw.Write([]byte(text))
+	zw.Close()
+
+	for _, s := range []struct {
+		encoding   string
+		body       []byte
+		wantStatus int
+	}{
+		{encoding: "", body: []byte(text), wantStatus: http.StatusOK},
+		{encoding: "identity", body: []byte(text), wantStatus: http.StatusOK},
+		{encoding: "gzip", body: gzipped.Bytes(), wantStatus: http.StatusOK},
+		{encoding: "deflate", body: deflated.Bytes(), wantStatus: http.StatusOK},
+		{encoding: "gzip", body: []byte(text), wantStatus: http.StatusBadRequest},
+		{encoding: "gzip", body: gzipped.Bytes()[:gzipped.Len()/2], wantStatus: http.StatusBadRequest},
+		{encoding: "br", body: []byte(text), wantStatus: http.StatusUnsupportedMediaType},
+	} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewReader(s.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.encoding != "" {
+			req.Header.Set("Content-Encoding", s.encoding)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		if expected, got := s.wantStatus, w.Code; expected != got {
+			t.Errorf("Encoding %q: Wanted status code %v, got %v.", s.encoding, expected, got)
+		}
+		if s.wantStatus != http.StatusOK {
+			if !mms.lastWriteRequest.Timestamp.IsZero() {
+				t.Errorf("Encoding %q: Write request unexpectedly submitted: %#v", s.encoding, mms.lastWriteRequest)
+			}
+			continue
+		}
+		if expected, got := 2, len(mms.lastWriteRequest.MetricFamilies); expected != got {
+			t.Errorf("Encoding %q: Wanted %d metric families, got %d.", s.encoding, expected, got)
+		}
+		if expected, got := (storage.PushFormat{ContentEncoding: s.encoding, Format: codec.Text}), mms.lastWriteRequest.PushFormat; expected != got {
+			t.Errorf("Encoding %q: Wanted push format %v, got %v.", s.encoding, expected, got)
+		}
+	}
+}
+
 func TestDelete(t *testing.T) {
 	mms := MockMetricStore{}
 	handler := Delete(&mms, false, logger)
 	handlerBase64 := Delete(&mms, true, logger)
-	req := &http.Request{}
+	req, err := http.NewRequest("DELETE", "http://example.org/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 	var params map[string]string
 
 	// No job name.
@@ -502,6 +1072,82 @@ func TestDelete(t *testing.T) {
 		t.Errorf("Wanted instance %v, got %v.", expected, got)
 	}
 
+	// With job name, instance name, and metric names.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+
+	params = map[string]string{
+		"job":    "testjob",
+		"labels": "/instance/testinstance/@metric/some_metric/@metric/other_metric",
+	}
+
+	handler(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "testinstance", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	}
+	if expected, got := 2, len(mms.lastWriteRequest.Labels); expected != got {
+		t.Errorf("Wanted %d labels, got %d.", expected, got)
+	}
+	if expected, got := "[some_metric other_metric]", fmt.Sprint(mms.lastWriteRequest.MetricNames); expected != got {
+		t.Errorf("Wanted metric names %s, got %s.", expected, got)
+	}
+
+	// With metric names and labels in the query.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+	queryReq, err := http.NewRequest("DELETE", "http://example.org/?metric=third_metric&label=code:500&label=path:/a:b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler(w, queryReq.WithContext(ctxWithParams(params, queryReq)))
+	if expected, got := http.StatusAccepted, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "[some_metric other_metric third_metric]", fmt.Sprint(mms.lastWriteRequest.MetricNames); expected != got {
+		t.Errorf("Wanted metric names %s, got %s.", expected, got)
+	}
+	if expected, got := "map[code:500 path:/a:b]", fmt.Sprint(mms.lastWriteRequest.MetricLabels); expected != got {
+		t.Errorf("Wanted metric labels %s, got %s.", expected, got)
+	}
+
+	// With invalid labels in the query.
+	for _, query := range []string{"label=code", "label=:500", "label=code:500&label=code:200", "metric=some-metric"} {
+		mms.lastWriteRequest = storage.WriteRequest{}
+		w = httptest.NewRecorder()
+		queryReq, err := http.NewRequest("DELETE", "http://example.org/?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler(w, queryReq.WithContext(ctxWithParams(params, queryReq)))
+		if expected, got := http.StatusBadRequest, w.Code; expected != got {
+			t.Errorf("%s: Wanted status code %v, got %v.", query, expected, got)
+		}
+		if !mms.lastWriteRequest.Timestamp.IsZero() {
+			t.Errorf("%s: Write request timestamp unexpectedly set: %#v", query, mms.lastWriteRequest)
+		}
+	}
+
+	// With invalid metric name.
+	mms.lastWriteRequest = storage.WriteRequest{}
+	w = httptest.NewRecorder()
+
+	params = map[string]string{
+		"job":    "testjob",
+		"labels": "/instance/testinstance/@metric/some-metric",
+	}
+
+	handler(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Timestamp.IsZero() {
+		t.Errorf("Write request timestamp unexpectedly set: %#v", mms.lastWriteRequest)
+	}
 }
 
 func TestSplitLabels(t *testing.T) {
@@ -584,8 +1230,7 @@ func TestSplitLabels(t *testing.T) {
 
 func TestWipeMetricStore(t *testing.T) {
 	// Create MockMetricStore with a few GroupingKeyToMetricGroup metrics
-	// so they can be returned by GetMetricFamiliesMap() to later send write
-	// requests for each of them.
+	// to make sure the wipe doesn't result in one write request per group.
 	metricCount := 5
 	mgs := storage.GroupingKeyToMetricGroup{}
 	for i := 0; i < metricCount; i++ {
@@ -608,14 +1253,436 @@ func TestWipeMetricStore(t *testing.T) {
 		t.Errorf("status code should be %d", http.StatusAccepted)
 	}
 
-	if len(mms.writeRequests) != metricCount {
-		t.Errorf("there should be %d write requests, got %d instead", metricCount, len(mms.writeRequests))
+	if len(mms.writeRequests) != 1 {
+		t.Fatalf("there should be exactly one write request, got %d instead", len(mms.writeRequests))
+	}
+	if wr := mms.writeRequests[0]; !wr.Wipe || wr.MetricFamilies != nil {
+		t.Errorf("write request is not a wipe request: %#v", wr)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	mgs := storage.GroupingKeyToMetricGroup{}
+	for _, job := range []string{"foo", "bar"} {
+		labels := map[string]string{"job": job}
+		mgs[job] = storage.MetricGroup{
+			Labels: labels,
+			Metrics: storage.NameToTimestampedMetricFamilyMap{
+				"some_metric": storage.TimestampedMetricFamily{
+					Timestamp: time.Now(),
+					GobbableMetricFamily: (*storage.GobbableMetricFamily)(&dto.MetricFamily{
+						Name: proto.String("some_metric"),
+						Type: dto.MetricType_UNTYPED.Enum(),
+						Metric: []*dto.Metric{{
+							Label:   []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(job)}},
+							Untyped: &dto.Untyped{Value: proto.Float64(1)},
+						}},
+					}),
+				},
+			},
+		}
+	}
+	mms := MockMetricStore{metricGroups: mgs}
+
+	req, err := http.NewRequest("GET", "http://example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	Snapshot(&mms, logger).ServeHTTP(w, req)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	snapshot := w.Body.Bytes()
+
+	restoreHandler := Restore(&mms, logger)
+	req, err = http.NewRequest("POST", "http://example.org", bytes.NewReader(snapshot))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	restoreHandler.ServeHTTP(w, req)
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := 1, len(mms.writeRequests); expected != got {
+		t.Fatalf("Wanted %d write requests, got %d.", expected, got)
+	}
+	groups := mms.lastWriteRequest.Groups
+	if expected, got := 2, len(groups); expected != got {
+		t.Errorf("Wanted %d restored groups, got %d.", expected, got)
+	}
+	for _, g := range groups {
+		if _, ok := g.Metrics["some_metric"]; !ok {
+			t.Errorf("Restored group %v lacks some_metric.", g.Labels)
+		}
+	}
+
+	// Garbage is rejected without a write request.
+	mms.writeRequests = nil
+	req, err = http.NewRequest("POST", "http://example.org", bytes.NewBufferString("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	restoreHandler.ServeHTTP(w, req)
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if len(mms.writeRequests) != 0 {
+		t.Errorf("Unexpected write requests: %v", mms.writeRequests)
+	}
+}
+
+func TestLock(t *testing.T) {
+	mms := MockMetricStore{}
+	lockHandler := Lock(&mms, true, logger)
+	unlockHandler := Lock(&mms, false, logger)
+
+	for grouping, expectedCode := range map[string]int{
+		"/job/foo/instance/bar":       http.StatusNotFound,
+		"/job/foo/instance/lock/lock": http.StatusOK,
+		"/instance/bar/lock":          http.StatusBadRequest,
+		"/job/foo/instance/lock":      http.StatusBadRequest,
+	} {
+		mms.writeRequests = nil
+		req, err := http.NewRequest("PUT", "http://example.org", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		lockHandler.ServeHTTP(w, req.WithContext(ctxWithParams(map[string]string{"grouping": grouping}, req)))
+		if expected, got := expectedCode, w.Code; expected != got {
+			t.Errorf("Wanted status code %v for %q, got %v.", expected, grouping, got)
+		}
+		if expectedCode != http.StatusOK && len(mms.writeRequests) != 0 {
+			t.Errorf("Unexpected write requests for %q: %v", grouping, mms.writeRequests)
+		}
+	}
+
+	req, err := http.NewRequest("DELETE", "http://example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	params := map[string]string{"grouping": "/job@base64/Zm9vL2Jhcg/lock"}
+	unlockHandler.ServeHTTP(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Unlock || mms.lastWriteRequest.Lock {
+		t.Errorf("Write request is not an unlock request: %#v", mms.lastWriteRequest)
+	}
+	if expected, got := "foo/bar", mms.lastWriteRequest.Labels["job"]; expected != got {
+		t.Errorf("Wanted job %v, got %v.", expected, got)
+	}
+
+	// The group does not exist.
+	mms.err = storage.ErrGroupNotFound
+	w = httptest.NewRecorder()
+	lockHandler.ServeHTTP(w, req.WithContext(ctxWithParams(params, req)))
+	if expected, got := http.StatusNotFound, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
+
+func TestRename(t *testing.T) {
+	mms := MockMetricStore{}
+	handler := Rename(&mms, logger)
+
+	for body, expectedCode := range map[string]int{
+		`{"from": {"job": "foo", "instance": "bar"}, "to": {"job": "baz"}}`: http.StatusOK,
+		`{"from": {"job": "foo"}, "to": {"instance": "bar"}}`:               http.StatusBadRequest,
+		`{"from": {"job": "foo"}, "to": {"job": "baz", "__name__": "x"}}`:   http.StatusBadRequest,
+		`{"from": {"job": "foo"}}`:                                          http.StatusBadRequest,
+		`{"from": `:                                                         http.StatusBadRequest,
+	} {
+		mms.writeRequests = nil
+		req, err := http.NewRequest("POST", "http://example.org/api/v1/groups/rename", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if expected, got := expectedCode, w.Code; expected != got {
+			t.Errorf("Wanted status code %v for %s, got %v.", expected, body, got)
+		}
+		if expectedCode != http.StatusOK && len(mms.writeRequests) != 0 {
+			t.Errorf("Unexpected write requests for %s: %v", body, mms.writeRequests)
+		}
+	}
+	if expected, got := "baz", mms.lastWriteRequest.RenameTo["job"]; expected != got {
+		t.Errorf("Wanted new job %v, got %v.", expected, got)
+	}
+	if expected, got := "bar", mms.lastWriteRequest.Labels["instance"]; expected != got {
+		t.Errorf("Wanted instance %v, got %v.", expected, got)
+	}
+
+	for err, expectedCode := range map[error]int{
+		storage.ErrGroupNotFound: http.StatusNotFound,
+		storage.ErrGroupLocked:   http.StatusForbidden,
+		storage.ErrGroupExists:   http.StatusConflict,
+	} {
+		mms.err = err
+		req, _ := http.NewRequest("POST", "http://example.org/api/v1/groups/rename", strings.NewReader(`{"from": {"job": "foo"}, "to": {"job": "baz"}}`))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if expected, got := expectedCode, w.Code; expected != got {
+			t.Errorf("Wanted status code %v for error %v, got %v.", expected, err, got)
+		}
+	}
+}
+
+func TestGroupMetrics(t *testing.T) {
+	gauge := func(name string, v float64) storage.TimestampedMetricFamily {
+		return storage.TimestampedMetricFamily{
+			GobbableMetricFamily: &storage.GobbableMetricFamily{
+				Name:   proto.String(name),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(v)}}},
+			},
+		}
+	}
+	mms := MockMetricStore{metricGroups: storage.GroupingKeyToMetricGroup{
+		"a": storage.MetricGroup{
+			Labels:     map[string]string{"job": "foo/bar", "instance": "baz"},
+			Metrics:    storage.NameToTimestampedMetricFamilyMap{"b_metric": gauge("b_metric", 2), "a_metric": gauge("a_metric", 1)},
+			PushFormat: storage.PushFormat{ContentType: "application/openmetrics-text; version=1.0.0", Format: codec.OpenMetrics},
+		},
+		"b": storage.MetricGroup{
+			Labels:  map[string]string{"job": "foo/bar"},
+			Metrics: storage.NameToTimestampedMetricFamilyMap{"c_metric": gauge("c_metric", 3)},
+		},
+	}}
+	handler := GroupMetrics(&mms, false, logger)
+	handlerBase64 := GroupMetrics(&mms, true, logger)
+
+	getURL := func(h http.Handler, url string, params map[string]string, accept string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req.WithContext(ctxWithParams(params, req)))
+		return w
+	}
+	get := func(h http.Handler, params map[string]string, accept string) *httptest.ResponseRecorder {
+		return getURL(h, "http://example.org/", params, accept)
+	}
+
+	w := get(handlerBase64, map[string]string{"job": "Zm9vL2Jhcg", "labels": "/instance/baz"}, "")
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "# TYPE a_metric gauge\na_metric 1\n# TYPE b_metric gauge\nb_metric 2\n", w.Body.String(); expected != got {
+		t.Errorf("Wanted body %q, got %q.", expected, got)
+	}
+
+	w = get(handler, map[string]string{"job": "foo/bar"}, "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited")
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	mf := &dto.MetricFamily{}
+	if _, err := pbutil.ReadDelimited(w.Body, mf); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "c_metric", mf.GetName(); expected != got {
+		t.Errorf("Wanted metric family %v, got %v.", expected, got)
+	}
+
+	// The format of the last push is used on request, if known.
+	for _, s := range []struct {
+		params      map[string]string
+		query       string
+		status      int
+		contentType string
+	}{
+		{map[string]string{"job": "foo/bar", "labels": "/instance/baz"}, "?format=push", http.StatusOK, string(codec.OpenMetrics)},
+		{map[string]string{"job": "foo/bar"}, "?format=push", http.StatusOK, string(codec.Text)},
+		{map[string]string{"job": "foo/bar"}, "?format=json", http.StatusBadRequest, ""},
+	} {
+		w = getURL(handler, "http://example.org/"+s.query, s.params, "")
+		if expected, got := s.status, w.Code; expected != got {
+			t.Errorf("%v%s: Wanted status code %v, got %v.", s.params, s.query, expected, got)
+		}
+		if got := w.Header().Get("Content-Type"); s.contentType != "" && s.contentType != got {
+			t.Errorf("%v%s: Wanted Content-Type %q, got %q.", s.params, s.query, s.contentType, got)
+		}
+	}
+
+	w = get(handler, map[string]string{"job": "foo/bar", "labels": "/instance/other"}, "")
+	if expected, got := http.StatusNotFound, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	w = get(handler, map[string]string{"job": "", "labels": "/instance/baz"}, "")
+	if expected, got := http.StatusBadRequest, w.Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
+
+func TestOpenMetrics(t *testing.T) {
+	counter := &dto.MetricFamily{
+		Name: proto.String("requests_total"),
+		Help: proto.String("Total requests."),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("instance"), Value: proto.String("")},
+					{Name: proto.String("job"), Value: proto.String("a}b")},
+				},
+				Counter: &dto.Counter{
+					Value: proto.Float64(3),
+					Exemplar: &dto.Exemplar{
+						Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+						Value: proto.Float64(1),
+					},
+				},
+			},
+			{
+				// Not pushed, so no _created sample.
+				Label: []*dto.LabelPair{
+					{Name: proto.String("instance"), Value: proto.String("")},
+					{Name: proto.String("job"), Value: proto.String("other")},
+				},
+				Counter: &dto.Counter{Value: proto.Float64(5)},
+			},
+		},
+	}
+	gauge := &dto.MetricFamily{
+		Name: proto.String("temperature"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(21.5)}},
+		},
+	}
+	pushed := &dto.MetricFamily{
+		Name:   counter.Name,
+		Help:   counter.Help,
+		Type:   counter.Type,
+		Metric: counter.Metric[:1],
+	}
+	mms := MockMetricStore{
+		metricGroups: storage.GroupingKeyToMetricGroup{
+			"group": storage.MetricGroup{
+				Labels: map[string]string{"job": "a}b"},
+				Metrics: storage.NameToTimestampedMetricFamilyMap{
+					"requests_total": storage.TimestampedMetricFamily{
+						Timestamp:            time.Unix(1600000000, 500000000),
+						GobbableMetricFamily: (*storage.GobbableMetricFamily)(pushed),
+					},
+				},
+			},
+		},
+	}
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{counter, gauge}, nil
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("next"))
+	})
+	handler := OpenMetrics(g, &mms, next, logger)
+
+	req, err := http.NewRequest("GET", "http://example.org/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if expected, got := "next", w.Body.String(); expected != got {
+		t.Errorf("Wanted body %q without OpenMetrics negotiated, got %q.", expected, got)
 	}
 
-	// Were all the writeRequest deletes?.
-	for i, wr := range mms.writeRequests {
-		if wr.MetricFamilies != nil {
-			t.Errorf("writeRequest at index %d was not a delete request", i)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if expected, got := string(expfmt.FmtOpenMetrics), w.Header().Get("Content-Type"); expected != got {
+		t.Errorf("Wanted content type %q, got %q.", expected, got)
+	}
+	expected := `# HELP requests Total requests.
+# TYPE requests counter
+requests_total{instance="",job="a}b"} 3.0 # {trace_id="abc"} 1.0
+requests_created{instance="",job="a}b"} 1600000000.5
+requests_total{instance="",job="other"} 5.0
+# TYPE temperature gauge
+temperature 21.5
+# EOF
+`
+	if got := w.Body.String(); expected != got {
+		t.Errorf("Wanted body\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestAttachPushTimestamps(t *testing.T) {
+	pushTime := time.Unix(1600000000, 500000000)
+	gauge := func(name string, v float64, job string, ts *int64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String(name),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label:       []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(job)}},
+				Gauge:       &dto.Gauge{Value: proto.Float64(v)},
+				TimestampMs: ts,
+			}},
 		}
 	}
+	pushed := gauge("pushed", 1, "a", nil)
+	withTimestamp := gauge("with_timestamp", 2, "a", proto.Int64(1000))
+	pushTimeSeconds := gauge("push_time_seconds", float64(pushTime.UnixNano())/1e9, "a", nil)
+	neverPushed := gauge("pushed", 3, "b", nil)
+	process := gauge("process_metric", 4, "", nil)
+	mms := MockMetricStore{
+		metricGroups: storage.GroupingKeyToMetricGroup{
+			"a": storage.MetricGroup{
+				Labels: map[string]string{"job": "a"},
+				Metrics: storage.NameToTimestampedMetricFamilyMap{
+					"pushed":            {GobbableMetricFamily: (*storage.GobbableMetricFamily)(pushed)},
+					"with_timestamp":    {GobbableMetricFamily: (*storage.GobbableMetricFamily)(withTimestamp)},
+					"push_time_seconds": {GobbableMetricFamily: (*storage.GobbableMetricFamily)(pushTimeSeconds)},
+				},
+			},
+			// No successful push yet.
+			"b": storage.MetricGroup{
+				Labels: map[string]string{"job": "b"},
+				Metrics: storage.NameToTimestampedMetricFamilyMap{
+					"pushed": {GobbableMetricFamily: (*storage.GobbableMetricFamily)(neverPushed)},
+				},
+			},
+		},
+	}
+	merged := &dto.MetricFamily{
+		Name:   pushed.Name,
+		Type:   pushed.Type,
+		Metric: []*dto.Metric{pushed.Metric[0], neverPushed.Metric[0]},
+	}
+	g := AttachPushTimestamps(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{merged, withTimestamp, process}, nil
+	}), &mms)
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 3, len(mfs); expected != got {
+		t.Fatalf("Wanted %d metric families, got %d.", expected, got)
+	}
+	if expected, got := int64(1600000000500), mfs[0].Metric[0].GetTimestampMs(); expected != got {
+		t.Errorf("Wanted timestamp %d, got %d.", expected, got)
+	}
+	if ts := mfs[0].Metric[1].TimestampMs; ts != nil {
+		t.Errorf("Unexpected timestamp %d for group without successful push.", *ts)
+	}
+	if expected, got := int64(1000), mfs[1].Metric[0].GetTimestampMs(); expected != got {
+		t.Errorf("Wanted explicit timestamp %d to be kept, got %d.", expected, got)
+	}
+	if ts := mfs[2].Metric[0].TimestampMs; ts != nil {
+		t.Errorf("Unexpected timestamp %d for metric not in the store.", *ts)
+	}
+	// The metrics in the store are not modified.
+	if pushed.Metric[0].TimestampMs != nil {
+		t.Error("Metric in the store was modified.")
+	}
 }
@@ -0,0 +1,110 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/pushgateway/influxdb"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// InfluxDBPath is the path of the InfluxDB write endpoint below the route
+// prefix, as used by InfluxDB 1.x clients.
+const InfluxDBPath = "/write"
+
+// InfluxDB returns an http.Handler which accepts points in the InfluxDB line
+// protocol, optionally gzip-compressed, and stores them in the MetricStore. The
+// points are converted and grouped as described for influxdb.Convert, with the
+// job label set to the "db" query parameter or, if there is none, to the
+// provided job, and with the tags named in groupingTags added to the grouping
+// labels.
+//
+// Each group is pushed like with a POST request, i.e. replacing stored metric
+// families of the same name. The RelabelConfigs currently held by relabelRules
+// (if any) and validationPolicy apply as for Push, and check does, too. The
+// groups are pushed one after the other, and the first rejected push determines
+// the response, with the same status codes as for Push. The groups pushed
+// before remain stored. Like InfluxDB, the handler responds with
+// http.StatusNoContent on success.
+//
+// The returned handler is already instrumented for Prometheus.
+func InfluxDB(
+	ms storage.MetricStore,
+	check bool,
+	job string,
+	groupingTags []string,
+	validationPolicy ValidationPolicy,
+	relabelRules *RelabelRules,
+	logger log.Logger,
+) http.Handler {
+	return InstrumentWithCounter(
+		"influxdb",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := decodeBody(r)
+			if err != nil {
+				status := readErrorStatus(err)
+				if _, ok := err.(unsupportedEncodingError); ok {
+					status = http.StatusUnsupportedMediaType
+				}
+				http.Error(w, err.Error(), status)
+				level.Debug(logger).Log("msg", "failed to decode request body", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+			defer body.Close()
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				http.Error(w, err.Error(), readErrorStatus(err))
+				level.Debug(logger).Log("msg", "failed to read request body", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+			groupJob := job
+			if db := r.URL.Query().Get("db"); db != "" {
+				groupJob = db
+			}
+			groups, err := influxdb.Convert(b, groupJob, groupingTags)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to parse line protocol", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+
+			pushFormat := storage.PushFormat{
+				ContentType:     r.Header.Get("Content-Type"),
+				ContentEncoding: strings.TrimSpace(r.Header.Get("Content-Encoding")),
+			}
+			labels := make([]map[string]string, len(groups))
+			for i, g := range groups {
+				labels[i] = g.Labels
+			}
+			if !authorizeConverted(w, r, labels, logger) {
+				return
+			}
+			for _, g := range groups {
+				if len(g.MetricFamilies) == 0 {
+					continue // Only string fields.
+				}
+				if !pushConverted(w, r, ms, check, g.Labels, g.MetricFamilies, storage.AggregateNone, pushFormat, validationPolicy, relabelRules, logger) {
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestInfluxDB(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	defer ms.Shutdown()
+	handler := InfluxDB(ms, true, "influxdb", []string{"host"}, ValidationStrict, nil, logger)
+	write := func(url, body string) int {
+		req, err := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if expected, got := http.StatusNoContent, write("http://example.org/write", "cpu,host=a usage=0.5\n"); expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := http.StatusNoContent, write("http://example.org/write?db=sensors", "temp,host=b value=21.5 1600000000000000000\n"); expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	group, ok := storage.GetMetricGroup(ms, map[string]string{"job": "influxdb", "host": "a"})
+	if !ok {
+		t.Fatal("Group not found.")
+	}
+	if expected, got := 0.5, group.Metrics["cpu_usage"].GetMetricFamily().GetMetric()[0].GetGauge().GetValue(); expected != got {
+		t.Errorf("Wanted gauge %v, got %v.", expected, got)
+	}
+	group, ok = storage.GetMetricGroup(ms, map[string]string{"job": "sensors", "host": "b"})
+	if !ok {
+		t.Fatal("Group of the db not found.")
+	}
+	if expected, got := 21.5, group.Metrics["temp"].GetMetricFamily().GetMetric()[0].GetGauge().GetValue(); expected != got {
+		t.Errorf("Wanted gauge %v, got %v.", expected, got)
+	}
+
+	if expected, got := http.StatusBadRequest, write("http://example.org/write", "cpu usage=0.5\ncpu\n"); expected != got {
+		t.Errorf("Wanted status code %v for invalid line, got %v.", expected, got)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// InstanceSource determines where DefaultInstance takes the instance label
+// from.
+type InstanceSource string
+
+// Valid InstanceSource values.
+const (
+	// InstanceFromRemoteAddr uses the IP address the request came from.
+	InstanceFromRemoteAddr InstanceSource = "remote-addr"
+	// InstanceFromForwardedFor uses the first IP address in the
+	// X-Forwarded-For header, falling back to the IP address the request
+	// came from if there is no valid one. Only use it behind a proxy
+	// setting the header, as clients can set it to anything.
+	InstanceFromForwardedFor InstanceSource = "x-forwarded-for"
+)
+
+// InstanceSources are all valid InstanceSource values as strings.
+var InstanceSources = []string{
+	string(InstanceFromRemoteAddr), string(InstanceFromForwardedFor),
+}
+
+// DefaultInstance returns a handler that adds an instance label with the IP
+// address of the client, as determined by source, to the URL path of PUT, POST,
+// and DELETE requests below pushPath without an instance label before passing
+// them on to next. Thus, a client pushing to and deleting e.g.
+// /metrics/job/foo addresses the group {job="foo",instance="<its IP>"}. Deleting
+// single metric families works the same way. All other requests, and requests
+// with a malformed URL (which are left to the handlers to reject), are passed
+// on unchanged.
+//
+// To have authentication, ACLs, and rate limits apply to the resulting group,
+// the DefaultInstance handler has to be in front of those handlers.
+func DefaultInstance(source InstanceSource, pushPath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodDelete,
+			!strings.HasPrefix(r.URL.Path, pushPath+"/"):
+			next.ServeHTTP(w, r)
+			return
+		}
+		labelsString := strings.TrimPrefix(r.URL.Path, pushPath)
+		var metricNames []string
+		if r.Method == http.MethodDelete {
+			var err error
+			if labelsString, metricNames, err = splitMetricNames(labelsString); err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		labels, err := splitLabels(labelsString)
+		if _, ok := labels[string(model.InstanceLabel)]; err != nil || ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r, source)
+		if ip == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		path := pushPath + labelsString + "/" + string(model.InstanceLabel) + "/" + ip
+		for _, name := range metricNames {
+			path += "/" + MetricNameSegment + "/" + name
+		}
+		u := *r.URL
+		u.Path, u.RawPath = path, ""
+		r = r.WithContext(r.Context())
+		r.URL = &u
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address of the client as determined by source, or an
+// empty string if it cannot be determined.
+func clientIP(r *http.Request, source InstanceSource) string {
+	if source == InstanceFromForwardedFor {
+		first := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0])
+		if ip := net.ParseIP(first); ip != nil {
+			return ip.String()
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
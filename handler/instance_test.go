@@ -0,0 +1,62 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDefaultInstance(t *testing.T) {
+	var gotPath string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	})
+	remoteAddr := DefaultInstance(InstanceFromRemoteAddr, "/metrics", next)
+	forwardedFor := DefaultInstance(InstanceFromForwardedFor, "/metrics", next)
+
+	for i, s := range []struct {
+		h                                   http.Handler
+		method, path, remoteAddr, forwarded string
+		wantPath                            string
+	}{
+		{remoteAddr, "PUT", "/metrics/job/foo", "10.0.0.1:1234", "", "/metrics/job/foo/instance/10.0.0.1"},
+		{remoteAddr, "POST", "/metrics/job@base64/Zm9v/zone/a", "[2001:db8::1]:1234", "", "/metrics/job@base64/Zm9v/zone/a/instance/2001:db8::1"},
+		{remoteAddr, "DELETE", "/metrics/job/foo/@metric/a/@metric/b", "10.0.0.1:1234", "", "/metrics/job/foo/instance/10.0.0.1/@metric/a/@metric/b"},
+		// The header is ignored unless configured.
+		{remoteAddr, "PUT", "/metrics/job/foo", "10.0.0.1:1234", "192.168.0.1", "/metrics/job/foo/instance/10.0.0.1"},
+		{forwardedFor, "PUT", "/metrics/job/foo", "10.0.0.1:1234", "192.168.0.1, 10.0.0.2", "/metrics/job/foo/instance/192.168.0.1"},
+		{forwardedFor, "PUT", "/metrics/job/foo", "10.0.0.1:1234", "unknown", "/metrics/job/foo/instance/10.0.0.1"},
+		// Left unchanged.
+		{remoteAddr, "PUT", "/metrics/job/foo/instance/bar", "10.0.0.1:1234", "", "/metrics/job/foo/instance/bar"},
+		{remoteAddr, "PUT", "/metrics/job/foo/instance@base64/=", "10.0.0.1:1234", "", "/metrics/job/foo/instance@base64/="},
+		{remoteAddr, "PUT", "/metrics/job/foo/odd", "10.0.0.1:1234", "", "/metrics/job/foo/odd"},
+		{remoteAddr, "GET", "/metrics/job/foo", "10.0.0.1:1234", "", "/metrics/job/foo"},
+		{remoteAddr, "PUT", "/api/v1/groups/job/foo", "10.0.0.1:1234", "", "/api/v1/groups/job/foo"},
+	} {
+		req, err := http.NewRequest(s.method, "http://example.org"+s.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = s.remoteAddr
+		if s.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", s.forwarded)
+		}
+		s.h.ServeHTTP(httptest.NewRecorder(), req)
+		if expected, got := s.wantPath, gotPath; expected != got {
+			t.Errorf("%d: Wanted path %q, got %q.", i, expected, got)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/route"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// LockSegment is the last path component of the URL to lock or unlock a group,
+// e.g. /api/v1/groups/job/foo/instance/bar/lock.
+const LockSegment = "lock"
+
+// Lock returns an http.Handler that locks (if lock is true) or unlocks the group
+// identified by the "grouping" route parameter, which contains the grouping
+// labels in the same form as the push URL (including the base64 variant for
+// label values) followed by LockSegment. Pushes to a locked group are rejected
+// with http.StatusForbidden. If the group does not exist, http.StatusNotFound
+// is returned.
+//
+// The returned handler is already instrumented for Prometheus.
+func Lock(ms storage.MetricStore, lock bool, logger log.Logger) http.Handler {
+	handlerName := "unlock"
+	if lock {
+		handlerName = "lock"
+	}
+	return InstrumentWithCounter(
+		handlerName,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			grouping := route.Param(r.Context(), "grouping")
+			labelsString := strings.TrimSuffix(grouping, "/"+LockSegment)
+			if labelsString == grouping {
+				http.NotFound(w, r)
+				return
+			}
+			labels, err := splitLabels(labelsString)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to parse URL", "url", labelsString, "err", err.Error())
+				return
+			}
+			if labels["job"] == "" {
+				http.Error(w, "job name is required", http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "job name is required")
+				return
+			}
+			errCh := make(chan error, 1)
+			if err := ms.SubmitWriteRequest(storage.WriteRequest{
+				Labels:    labels,
+				Timestamp: time.Now(),
+				Lock:      lock,
+				Unlock:    !lock,
+				Done:      errCh,
+			}); err != nil {
+				submitFailed(w, err, logger)
+				return
+			}
+			errReceived := false
+			for err := range errCh {
+				if !errReceived {
+					status := http.StatusInternalServerError
+					if err == storage.ErrGroupNotFound {
+						status = http.StatusNotFound
+					}
+					http.Error(w, err.Error(), status)
+				}
+				errReceived = true
+			}
+			if !errReceived {
+				level.Info(logger).Log("msg", "metric group lock changed", "group", labelsString, "locked", lock)
+			}
+		}))
+}
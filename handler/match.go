@@ -0,0 +1,64 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// MatchParam is the query parameter of a scrape to select the exposed metrics by
+// a series selector. It can be repeated.
+const MatchParam = "match[]"
+
+// ShardParam is the query parameter of a scrape to select the exposed metrics by
+// the shard their group belongs to, e.g. "2of5", see storage.Shard.
+const ShardParam = "shard"
+
+// Match returns an http.Handler for scrape endpoints. Requests with "match[]"
+// query parameters or a "shard" query parameter are served by the handler that
+// selected returns for the parsed selectors and shard (the zero storage.Shard
+// if there is none), which is expected to expose only the metrics matched by
+// any of the selectors in groups of the shard. All other requests are passed on
+// to next. An invalid selector or shard is rejected with
+// http.StatusBadRequest.
+func Match(next http.Handler, selected func([]storage.Selector, storage.Shard) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		params := query[MatchParam]
+		if len(params) == 0 && query.Get(ShardParam) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var shard storage.Shard
+		if param := query.Get(ShardParam); param != "" {
+			var err error
+			if shard, err = storage.ParseShard(param); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		selectors := make([]storage.Selector, 0, len(params))
+		for _, param := range params {
+			sel, err := storage.ParseSelector(param)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			selectors = append(selectors, sel)
+		}
+		selected(selectors, shard).ServeHTTP(w, r)
+	})
+}
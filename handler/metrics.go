@@ -45,6 +45,13 @@ var (
 		},
 		[]string{"method"},
 	)
+	httpRateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pushgateway_http_rate_limited_requests_total",
+			Help: "Total HTTP requests rejected by the Pushgateway because of a rate limit, by the scope (ip or group) of the exceeded limit.",
+		},
+		[]string{"scope"},
+	)
 )
 
 func InstrumentWithCounter(handlerName string, handler http.Handler) http.HandlerFunc {
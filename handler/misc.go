@@ -17,11 +17,31 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/common/server"
 
 	"github.com/prometheus/pushgateway/storage"
 )
 
+// retryAfter is the value of the Retry-After header (in seconds) sent if a
+// WriteRequest could not be submitted because the write queue is full.
+const retryAfter = "5"
+
+// submitFailed responds to a request whose WriteRequest could not be submitted
+// to the MetricStore. A full write queue results in
+// http.StatusServiceUnavailable with a Retry-After header so that well-behaved
+// clients back off.
+func submitFailed(w http.ResponseWriter, err error, logger log.Logger) {
+	status := http.StatusInternalServerError
+	if err == storage.ErrWriteQueueFull {
+		w.Header().Set("Retry-After", retryAfter)
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+	level.Warn(logger).Log("msg", "could not submit write request", "err", err.Error())
+}
+
 // Healthy is used to report the health of the Pushgateway. It currently only
 // uses the Healthy method of the MetricScore to detect healthy state.
 //
@@ -15,7 +15,6 @@ package handler
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -31,8 +30,6 @@ type fakeFileSystem struct {
 // If a file is present, no error will be returned.
 // This implementation always returns a nil File.
 func (f *fakeFileSystem) Open(name string) (http.File, error) {
-	log.Println("requesting" + name)
-
 	if _, ok := f.files[name]; !ok {
 		return nil, os.ErrNotExist
 	}
@@ -0,0 +1,205 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/codec"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// OpenMetrics returns an http.Handler that exposes the metrics gathered from g
+// in the OpenMetrics text format if the client negotiates it. All other
+// requests are passed on to next, typically created with promhttp.HandlerFor
+// for the same Gatherer.
+//
+// Exemplars are exposed as pushed. Pushed counters (with the usual _total
+// suffix) additionally get a _created sample, set to the time they were last
+// pushed, as each push (re-)creates them. The push times are looked up in ms,
+// whose metrics are expected to be included in g.
+func OpenMetrics(g prometheus.Gatherer, ms storage.MetricStore, next http.Handler, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if codec.Negotiate(r.Header, true) != codec.OpenMetrics {
+			next.ServeHTTP(w, r)
+			return
+		}
+		created := pushTimes(ms.GetMetricFamiliesMap())
+		mfs, err := g.Gather()
+		if err != nil {
+			level.Error(logger).Log("msg", "error gathering metrics", "err", err)
+			if len(mfs) == 0 {
+				http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", string(codec.OpenMetrics))
+		out := bufio.NewWriter(w)
+		if gzipAccepted(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out.Reset(gz)
+		}
+		defer out.Flush()
+		for _, mf := range mfs {
+			if err := writeOpenMetricsFamily(out, mf, created[mf.GetName()]); err != nil {
+				level.Error(logger).Log("msg", "error encoding metric family", "metric_family", mf.GetName(), "err", err)
+				return
+			}
+		}
+		if err := codec.NewEncoder(out, codec.OpenMetrics).Close(); err != nil {
+			level.Error(logger).Log("msg", "error finalizing OpenMetrics exposition", "err", err)
+		}
+	})
+}
+
+// pushTimes returns the push times of all pushed counters, keyed by metric
+// family name and then by the signature of the labels of each metric.
+func pushTimes(groups storage.GroupingKeyToMetricGroup) map[string]map[uint64]time.Time {
+	result := map[string]map[uint64]time.Time{}
+	for _, group := range groups {
+		for name, tmf := range group.Metrics {
+			mf := tmf.GetMetricFamily()
+			if mf.GetType() != dto.MetricType_COUNTER || !strings.HasSuffix(name, "_total") {
+				continue
+			}
+			times, ok := result[name]
+			if !ok {
+				times = map[uint64]time.Time{}
+				result[name] = times
+			}
+			for _, m := range mf.GetMetric() {
+				times[labelsSignature(m)] = tmf.Timestamp
+			}
+		}
+	}
+	return result
+}
+
+// pushTimesOf returns what pushTimes would return for the metric family with the
+// provided name in the provided groups, or nil if there is none.
+func pushTimesOf(groups []storage.MetricGroup, name string) map[uint64]time.Time {
+	if !strings.HasSuffix(name, "_total") {
+		return nil
+	}
+	var result map[uint64]time.Time
+	for _, group := range groups {
+		tmf, ok := group.Metrics[name]
+		if !ok {
+			continue
+		}
+		mf := tmf.GetMetricFamily()
+		if mf.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		if result == nil {
+			result = map[uint64]time.Time{}
+		}
+		for _, m := range mf.GetMetric() {
+			result[labelsSignature(m)] = tmf.Timestamp
+		}
+	}
+	return result
+}
+
+func labelsSignature(m *dto.Metric) uint64 {
+	labels := make(map[string]string, len(m.GetLabel()))
+	for _, lp := range m.GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	return model.LabelsToSignature(labels)
+}
+
+// writeOpenMetricsFamily writes mf in the OpenMetrics text format, adding a
+// _created sample after each counter sample with a time in created.
+func writeOpenMetricsFamily(w *bufio.Writer, mf *dto.MetricFamily, created map[uint64]time.Time) error {
+	if len(created) == 0 {
+		return codec.NewEncoder(w, codec.OpenMetrics).Encode(mf)
+	}
+	// The encoder writes the comment lines followed by exactly one line
+	// per counter, in order. Insert the _created lines in between.
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, codec.OpenMetrics).Encode(mf); err != nil {
+		return err
+	}
+	name := mf.GetName()
+	shortName := strings.TrimSuffix(name, "_total")
+	i := 0
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if _, err := w.WriteString(line); err != nil {
+			return err
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := mf.GetMetric()[i]
+		i++
+		t, ok := created[labelsSignature(m)]
+		if !ok {
+			continue
+		}
+		if _, err := w.WriteString(
+			shortName + "_created" + labelsOf(line[len(name):]) + " " +
+				strconv.FormatFloat(float64(t.UnixNano())/1e9, 'f', -1, 64) + "\n",
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelsOf returns the label set (including the braces) at the start of the
+// provided remainder of a sample line, or an empty string if there is none.
+func labelsOf(s string) string {
+	if !strings.HasPrefix(s, "{") {
+		return ""
+	}
+	inQuotes := false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case inQuotes && s[i] == '\\':
+			i++ // Skip the escaped character.
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && s[i] == '}':
+			return s[:i+1]
+		}
+	}
+	return ""
+}
+
+// gzipAccepted returns whether the client accepts gzip-encoded content.
+func gzipAccepted(header http.Header) bool {
+	for _, part := range strings.Split(header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(part, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
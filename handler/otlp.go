@@ -0,0 +1,133 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/otlp"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// OTLPPath is the path of the OTLP/HTTP metrics endpoint below the route
+// prefix, as appended to the endpoint configured in OpenTelemetry SDKs.
+const OTLPPath = "/v1/metrics"
+
+// OTLP returns an http.Handler which accepts OTLP/HTTP metric export requests,
+// in the binary protobuf or the JSON encoding (according to the Content-Type)
+// and optionally gzip-compressed, and stores the contained metrics in the
+// MetricStore. The metrics are converted and grouped by resource as described
+// for otlp.Convert, with the resource attributes named in groupingAttributes
+// added to the grouping labels.
+//
+// Each group is pushed like with a POST request without the "aggregate" query
+// parameter, i.e. replacing stored metric families of the same name, except for
+// sums and histograms with delta temporality, which are pushed in a second
+// request with the "aggregate" query parameter set to "sum". The
+// RelabelConfigs currently held by relabelRules (if any) and validationPolicy
+// apply as for Push, and check does, too. The groups are pushed one after the
+// other, and the first rejected push determines the response, with the same
+// status codes as for Push. The groups pushed before remain stored. Data points
+// that cannot be converted are reported as rejected in a partial success.
+//
+// The returned handler is already instrumented for Prometheus.
+func OTLP(
+	ms storage.MetricStore,
+	check bool,
+	groupingAttributes []string,
+	validationPolicy ValidationPolicy,
+	relabelRules *RelabelRules,
+	logger log.Logger,
+) http.Handler {
+	return InstrumentWithCounter(
+		"otlp",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != otlp.ContentTypeProtobuf && mediaType != otlp.ContentTypeJSON {
+				http.Error(w, fmt.Sprintf("unsupported Content-Type %q, use %s or %s", mediaType, otlp.ContentTypeProtobuf, otlp.ContentTypeJSON), http.StatusUnsupportedMediaType)
+				level.Debug(logger).Log("msg", "unsupported Content-Type of OTLP request", "source", r.RemoteAddr, "content_type", mediaType)
+				return
+			}
+			jsonEncoded := mediaType == otlp.ContentTypeJSON
+
+			body, err := decodeBody(r)
+			if err != nil {
+				status := readErrorStatus(err)
+				if _, ok := err.(unsupportedEncodingError); ok {
+					status = http.StatusUnsupportedMediaType
+				}
+				http.Error(w, err.Error(), status)
+				level.Debug(logger).Log("msg", "failed to decode request body", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+			defer body.Close()
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				http.Error(w, err.Error(), readErrorStatus(err))
+				level.Debug(logger).Log("msg", "failed to read request body", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+			result, err := otlp.Convert(b, jsonEncoded, groupingAttributes)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to convert OTLP request", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+
+			pushFormat := storage.PushFormat{
+				ContentType:     r.Header.Get("Content-Type"),
+				ContentEncoding: strings.TrimSpace(r.Header.Get("Content-Encoding")),
+			}
+			labels := make([]map[string]string, len(result.Groups))
+			for i, g := range result.Groups {
+				labels[i] = g.Labels
+			}
+			if !authorizeConverted(w, r, labels, logger) {
+				return
+			}
+			for _, g := range result.Groups {
+				for _, push := range []struct {
+					mfs         map[string]*dto.MetricFamily
+					aggregation storage.Aggregation
+				}{
+					{g.MetricFamilies, storage.AggregateNone},
+					{g.DeltaFamilies, storage.AggregateSum},
+				} {
+					if len(push.mfs) == 0 {
+						continue
+					}
+					if !pushConverted(w, r, ms, check, g.Labels, push.mfs, push.aggregation, pushFormat, validationPolicy, relabelRules, logger) {
+						return
+					}
+				}
+			}
+			if jsonEncoded {
+				w.Header().Set("Content-Type", otlp.ContentTypeJSON)
+			} else {
+				w.Header().Set("Content-Type", otlp.ContentTypeProtobuf)
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write(otlp.MarshalResponse(jsonEncoded, result.Rejected))
+		}),
+	)
+}
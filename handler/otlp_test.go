@@ -0,0 +1,87 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const otlpRequest = `{"resourceMetrics": [{
+  "resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}]},
+  "scopeMetrics": [{"metrics": [
+    {"name": "requests", "sum": {"dataPoints": [{"asInt": "2"}], "aggregationTemporality": 1, "isMonotonic": true}},
+    {"name": "temperature", "gauge": {"dataPoints": [{"asDouble": 21.5}]}},
+    {"name": "sizes", "exponentialHistogram": {"dataPoints": [{}]}}
+  ]}]
+}]}`
+
+func TestOTLP(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	defer ms.Shutdown()
+	handler := OTLP(ms, true, nil, ValidationStrict, nil, logger)
+	export := func(contentType, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://example.org"+OTLPPath, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := export("application/json", otlpRequest)
+		if expected, got := http.StatusOK, w.Code; expected != got {
+			t.Fatalf("Wanted status code %v, got %v: %s", expected, got, w.Body)
+		}
+		if expected, got := `{"partialSuccess":{"errorMessage":"1 data points of exponential histograms, with unspecified temporality, or with inconsistent buckets rejected","rejectedDataPoints":"1"}}`, w.Body.String(); expected != got {
+			t.Errorf("Wanted response %s, got %s.", expected, got)
+		}
+	}
+	group, ok := storage.GetMetricGroup(ms, map[string]string{"job": "api"})
+	if !ok {
+		t.Fatal("Group not found.")
+	}
+	// The delta sum is aggregated, the gauge replaced.
+	if expected, got := 4.0, group.Metrics["requests_total"].GetMetricFamily().GetMetric()[0].GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted counter %v, got %v.", expected, got)
+	}
+	if expected, got := 21.5, group.Metrics["temperature"].GetMetricFamily().GetMetric()[0].GetGauge().GetValue(); expected != got {
+		t.Errorf("Wanted gauge %v, got %v.", expected, got)
+	}
+	if expected, got := "application/json", group.PushFormat.ContentType; expected != got {
+		t.Errorf("Wanted Content-Type %q recorded, got %q.", expected, got)
+	}
+
+	if expected, got := http.StatusUnsupportedMediaType, export("text/plain", otlpRequest).Code; expected != got {
+		t.Errorf("Wanted status code %v for unsupported Content-Type, got %v.", expected, got)
+	}
+	if expected, got := http.StatusBadRequest, export("application/x-protobuf", "garbage").Code; expected != got {
+		t.Errorf("Wanted status code %v for invalid request, got %v.", expected, got)
+	}
+	w := export("application/x-protobuf", "")
+	if expected, got := http.StatusOK, w.Code; expected != got {
+		t.Errorf("Wanted status code %v for empty request, got %v.", expected, got)
+	}
+	if expected, got := "application/x-protobuf", w.Header().Get("Content-Type"); expected != got {
+		t.Errorf("Wanted Content-Type %q, got %q.", expected, got)
+	}
+}
@@ -14,143 +14,264 @@
 package handler
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/matttproud/golang_protobuf_extensions/pbutil"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/expfmt"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/route"
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/internal/codec"
 	"github.com/prometheus/pushgateway/storage"
+	"github.com/prometheus/pushgateway/tracing"
 )
 
 const (
 	// Base64Suffix is appended to a label name in the request URL path to
 	// mark the following label value as base64 encoded.
 	Base64Suffix = "@base64"
+	// TTLHeader is the HTTP header that can be used instead of the "ttl"
+	// query parameter to set the time to live of pushed metrics.
+	TTLHeader = "X-Pushgateway-TTL"
+	// AnnotationHeader is the HTTP header to attach an annotation (in the
+	// form name=value) to the pushed group. It can be repeated.
+	AnnotationHeader = "X-Pushgateway-Annotation"
+	// SkippedHeader is the HTTP header set to "true" in the response to a
+	// conditional push that has been skipped as the payload is unchanged.
+	SkippedHeader = "X-Pushgateway-Skipped"
+	// SequenceHeader is the HTTP header to set the sequence number of a
+	// push, see storage.WriteRequest.
+	SequenceHeader = "X-Pushgateway-Sequence"
 )
 
+// TimestampPolicy determines how Push handles pushed samples with a timestamp.
+type TimestampPolicy string
+
+// Valid TimestampPolicy values.
+const (
+	// TimestampReject rejects pushes containing any sample with a
+	// timestamp with http.StatusBadRequest.
+	TimestampReject TimestampPolicy = "reject"
+	// TimestampStrip removes the timestamps from pushed samples.
+	TimestampStrip TimestampPolicy = "strip"
+	// TimestampAllow stores pushed samples together with their timestamps.
+	TimestampAllow TimestampPolicy = "allow"
+)
+
+// TimestampPolicies are all valid TimestampPolicy values as strings.
+var TimestampPolicies = []string{
+	string(TimestampReject), string(TimestampStrip), string(TimestampAllow),
+}
+
+// LabelConflictPolicy determines how Push handles pushed samples with a label
+// conflicting with the grouping labels of the push.
+type LabelConflictPolicy string
+
+// Valid LabelConflictPolicy values.
+const (
+	// LabelConflictOverride replaces the values of pushed grouping labels
+	// by the values of the grouping labels. A pushed instance label is
+	// kept if the grouping labels contain none.
+	LabelConflictOverride LabelConflictPolicy = "override"
+	// LabelConflictReject rejects pushes containing any sample with a
+	// conflicting label with http.StatusBadRequest.
+	LabelConflictReject LabelConflictPolicy = "reject"
+)
+
+// LabelConflictPolicies are all valid LabelConflictPolicy values as strings.
+var LabelConflictPolicies = []string{
+	string(LabelConflictOverride), string(LabelConflictReject),
+}
+
+// ValidationPolicy determines which metric names, label names, and label values
+// Push accepts.
+type ValidationPolicy string
+
+// Valid ValidationPolicy values.
+const (
+	// ValidationStrict accepts metric names and label names following the
+	// classic Prometheus data model (label names starting with "__" are
+	// reserved) and label values that are valid UTF-8.
+	ValidationStrict ValidationPolicy = "strict"
+	// ValidationUTF8 accepts any non-empty metric name and label name that
+	// is valid UTF-8 (label names starting with "__" are still reserved)
+	// and label values that are valid UTF-8.
+	ValidationUTF8 ValidationPolicy = "utf8"
+	// ValidationNone accepts everything.
+	ValidationNone ValidationPolicy = "none"
+)
+
+// ValidationPolicies are all valid ValidationPolicy values as strings.
+var ValidationPolicies = []string{
+	string(ValidationStrict), string(ValidationUTF8), string(ValidationNone),
+}
+
 // Push returns an http.Handler which accepts samples over HTTP and stores them
 // in the MetricStore. If replace is true, all metrics for the job and instance
 // given by the request are deleted before new ones are stored. If check is
 // true, the pushed metrics are immediately checked for consistency (with
 // existing metrics and themselves), and an inconsistent push is rejected with
-// http.StatusBadRequest.
+// http.StatusBadRequest. A push exceeding the limits of the MetricStore is
+// rejected with http.StatusRequestEntityTooLarge, a push to a locked group with
+// http.StatusForbidden, and an out-of-order push with http.StatusConflict
+// (provided check is true). If the MetricStore cannot
+// accept the push because its write queue is full, http.StatusServiceUnavailable
+// is returned.
+//
+// The pushed metrics are decoded according to the Content-Type of the request,
+// see codec.FormatForContentType. The Content-Type and Content-Encoding are
+// recorded with the group, see storage.PushFormat.
+//
+// Pushed samples with a timestamp are handled according to timestampPolicy.
+// Pushed samples with a label conflicting with the grouping labels are handled
+// according to labelConflictPolicy. A label conflicts if it is a grouping label
+// with a different value, or if it is the instance label with a non-empty
+// value while the grouping labels contain no instance label (as the group has
+// an implicit empty instance label). Pushes with an invalid metric name, label
+// name, or label value (including the values of the grouping labels) according
+// to validationPolicy are rejected with http.StatusBadRequest.
+// The RelabelConfigs currently held by relabelRules (if any) are applied to the
+// pushed samples before anything else, see LoadRelabelFile.
+//
+// A time to live for the pushed metrics can be set via the "ttl" query
+// parameter or the X-Pushgateway-TTL header, using the usual Prometheus
+// duration format (e.g. "5m").
+//
+// The interval within which the next push to the group is expected can be
+// declared via the "expect" query parameter in the same format, see
+// storage.WriteRequest. Groups not pushed to successfully within the declared
+// interval are reported as overdue, see storage.PushOverdue.
+//
+// With the "aggregate" query parameter set to "sum" or "max", pushed counters,
+// gauges, and untyped metrics (and, with "sum", histograms and summaries) are
+// aggregated with the stored ones rather than replacing them, see
+// storage.WriteRequest. This is not possible if replace is true.
+//
+// Annotations for the group can be set via X-Pushgateway-Annotation headers in
+// the form name=value, see storage.WriteRequest for how they are merged.
+//
+// A positive sequence number, increasing with each push to the group, can be
+// set via the X-Pushgateway-Sequence header. A push with a sequence number not
+// greater than the one of the last push applied to the group is rejected, see
+// storage.WriteRequest. Thus, a conflict in response to a retried push means
+// that an earlier attempt has been applied after all.
+//
+// The hex-encoded SHA-256 of the (decoded) request body is stored with the group
+// as its payload hash and returned as the ETag of a successful push. A push
+// with an If-None-Match header listing that ETag (or "*") is acknowledged
+// without changing anything if the group is known to be unchanged by it (see
+// storage.MetricGroup.Unchanged), with the X-Pushgateway-Skipped header set in
+// the response. Note that a skipped push neither refreshes the push time nor
+// the time to live of the group.
 //
 // The returned handler is already instrumented for Prometheus.
 func Push(
 	ms storage.MetricStore,
 	replace, check, jobBase64Encoded bool,
+	timestampPolicy TimestampPolicy,
+	labelConflictPolicy LabelConflictPolicy,
+	validationPolicy ValidationPolicy,
+	relabelRules *RelabelRules,
 	logger log.Logger,
 ) func(http.ResponseWriter, *http.Request) {
 	var mtx sync.Mutex // Protects ps.
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		job := route.Param(r.Context(), "job")
-		if jobBase64Encoded {
-			var err error
-			if job, err = decodeBase64(job); err != nil {
-				http.Error(w, fmt.Sprintf("invalid base64 encoding in job name %q: %v", job, err), http.StatusBadRequest)
-				level.Debug(logger).Log("msg", "invalid base64 encoding in job name", "job", job, "err", err.Error())
-				return
-			}
-		}
 		labelsString := route.Param(r.Context(), "labels")
 		mtx.Unlock()
 
-		labels, err := splitLabels(labelsString)
+		labels, err := groupingLabels(job, labelsString, jobBase64Encoded)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
-			level.Debug(logger).Log("msg", "failed to parse URL", "url", labelsString, "err", err.Error())
+			level.Debug(logger).Log("msg", "failed to parse URL", "url", r.URL.Path, "err", err.Error())
 			return
 		}
-		if job == "" {
-			http.Error(w, "job name is required", http.StatusBadRequest)
-			level.Debug(logger).Log("msg", "job name is required")
+
+		wr, err := ParsePush(r, labels, replace, timestampPolicy, labelConflictPolicy, validationPolicy, relabelRules)
+		if err != nil {
+			pe := err.(PushError)
+			http.Error(w, pe.Error(), pe.Status)
+			level.Debug(logger).Log("msg", pe.Reason, "source", r.RemoteAddr, "err", pe.Error())
 			return
 		}
-		labels["job"] = job
-
-		var metricFamilies map[string]*dto.MetricFamily
-		ctMediatype, ctParams, ctErr := mime.ParseMediaType(r.Header.Get("Content-Type"))
-		if ctErr == nil && ctMediatype == "application/vnd.google.protobuf" &&
-			ctParams["encoding"] == "delimited" &&
-			ctParams["proto"] == "io.prometheus.client.MetricFamily" {
-			metricFamilies = map[string]*dto.MetricFamily{}
-			for {
-				mf := &dto.MetricFamily{}
-				if _, err = pbutil.ReadDelimited(r.Body, mf); err != nil {
-					if err == io.EOF {
-						err = nil
-					}
-					break
+		recordPushStats(r, wr.MetricFamilies)
+		traceGroup(r, labels, wr.MetricFamilies)
+		etag := `"` + wr.PayloadHash + `"`
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			if group, ok := storage.GetMetricGroup(ms, labels); ok && !group.Locked && group.Unchanged(wr) {
+				w.Header().Set("ETag", etag)
+				w.Header().Set(SkippedHeader, "true")
+				if check {
+					w.WriteHeader(http.StatusOK)
+				} else {
+					w.WriteHeader(http.StatusAccepted)
 				}
-				metricFamilies[mf.GetName()] = mf
+				level.Debug(logger).Log("msg", "unchanged push skipped", "source", r.RemoteAddr, "job", labels["job"], "instance", labels["instance"])
+				return
 			}
-		} else {
-			// We could do further content-type checks here, but the
-			// fallback for now will anyway be the text format
-			// version 0.0.4, so just go for it and see if it works.
-			var parser expfmt.TextParser
-			metricFamilies, err = parser.TextToMetricFamilies(r.Body)
-		}
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			level.Debug(logger).Log("msg", "failed to parse text", "source", r.RemoteAddr, "err", err.Error())
-			return
 		}
-		now := time.Now()
+		// The write span covers waiting for space in the write queue and,
+		// if checking, for the MetricStore to process the push.
+		_, span := tracing.Start(r.Context(), "write", tracing.SpanKindInternal)
+		defer span.End()
 		if !check {
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:         labels,
-				Timestamp:      now,
-				MetricFamilies: metricFamilies,
-				Replace:        replace,
-			})
+			if err := ms.SubmitWriteRequest(wr); err != nil {
+				span.SetError(err)
+				submitFailed(w, err, logger)
+				return
+			}
+			w.Header().Set("ETag", etag)
 			w.WriteHeader(http.StatusAccepted)
 			return
 		}
 		errCh := make(chan error, 1)
 		errReceived := false
-		ms.SubmitWriteRequest(storage.WriteRequest{
-			Labels:         labels,
-			Timestamp:      now,
-			MetricFamilies: metricFamilies,
-			Replace:        replace,
-			Done:           errCh,
-		})
+		wr.Done = errCh
+		if err := ms.SubmitWriteRequest(wr); err != nil {
+			span.SetError(err)
+			submitFailed(w, err, logger)
+			return
+		}
 		for err := range errCh {
+			span.SetError(err)
 			// Send only first error via HTTP, but log all of them.
 			// TODO(beorn): Consider sending all errors once we
 			// have a use case. (Currently, at most one error is
 			// produced.)
 			if !errReceived {
-				http.Error(
-					w,
-					fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics: %v", err),
-					http.StatusBadRequest,
-				)
+				writeRequestFailed(w, err)
 			}
 			level.Error(logger).Log(
 				"msg", "pushed metrics are invalid or inconsistent with existing metrics",
 				"method", r.Method,
 				"source", r.RemoteAddr,
+				"job", labels["job"],
+				"instance", labels["instance"],
 				"err", err.Error(),
 			)
 			errReceived = true
 		}
+		if !errReceived {
+			w.Header().Set("ETag", etag)
+		}
 	})
 
 	instrumentedHandler := promhttp.InstrumentHandlerRequestSize(
@@ -164,6 +285,318 @@ func Push(
 	}
 }
 
+// writeRequestFailed responds to a push rejected by the MetricStore with the
+// provided error, see Push for the status codes.
+func writeRequestFailed(w http.ResponseWriter, err error) {
+	if _, ok := err.(storage.LimitError); ok {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	} else if err == storage.ErrGroupLocked {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	} else if _, ok := err.(storage.SequenceError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else {
+		http.Error(
+			w,
+			fmt.Sprintf("pushed metrics are invalid or inconsistent with existing metrics: %v", err),
+			http.StatusBadRequest,
+		)
+	}
+}
+
+// pushConverted pushes the provided metric families, converted from a request
+// in another protocol (e.g. OTLP), to the group with the provided grouping
+// labels like Push does. If the push is rejected, it responds accordingly and
+// returns false.
+func pushConverted(
+	w http.ResponseWriter, r *http.Request,
+	ms storage.MetricStore,
+	check bool,
+	labels map[string]string,
+	mfs map[string]*dto.MetricFamily,
+	aggregation storage.Aggregation,
+	pushFormat storage.PushFormat,
+	validationPolicy ValidationPolicy,
+	relabelRules *RelabelRules,
+	logger log.Logger,
+) bool {
+	if relabelConfigs := relabelRules.Get(); len(relabelConfigs) > 0 {
+		var err error
+		if mfs, err = relabelMetricFamilies(mfs, labels, relabelConfigs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			level.Debug(logger).Log("msg", "failed to relabel pushed metrics", "source", r.RemoteAddr, "err", err.Error())
+			return false
+		}
+	}
+	if err := validate(mfs, labels, validationPolicy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		level.Debug(logger).Log("msg", "pushed metrics are invalid", "source", r.RemoteAddr, "err", err.Error())
+		return false
+	}
+	wr := storage.WriteRequest{
+		Labels:         labels,
+		Timestamp:      time.Now(),
+		MetricFamilies: mfs,
+		Aggregation:    aggregation,
+		PushFormat:     pushFormat,
+	}
+	if !check {
+		if err := ms.SubmitWriteRequest(wr); err != nil {
+			submitFailed(w, err, logger)
+			return false
+		}
+		return true
+	}
+	errCh := make(chan error, 1)
+	wr.Done = errCh
+	if err := ms.SubmitWriteRequest(wr); err != nil {
+		submitFailed(w, err, logger)
+		return false
+	}
+	ok := true
+	for err := range errCh {
+		if ok {
+			writeRequestFailed(w, err)
+		}
+		level.Error(logger).Log(
+			"msg", "pushed metrics are invalid or inconsistent with existing metrics",
+			"method", r.Method,
+			"source", r.RemoteAddr,
+			"job", labels["job"],
+			"instance", labels["instance"],
+			"err", err.Error(),
+		)
+		ok = false
+	}
+	return ok
+}
+
+// PushError is the error returned by ParsePush for a rejected push.
+type PushError struct {
+	Status int    // The HTTP status code to reject the push with.
+	Reason string // Short description for logging, e.g. "invalid annotation".
+	Err    error
+}
+
+func (e PushError) Error() string {
+	return e.Err.Error()
+}
+
+// ParsePush decodes and checks the body and the parameters of a push request
+// with the provided grouping labels as the handler returned by Push does (see
+// there for the meaning of the arguments), and it returns the resulting
+// WriteRequest, without a Done channel. A rejected push results in a PushError.
+// The checks against the stored metrics happen later, upon processing of the
+// WriteRequest by the MetricStore.
+func ParsePush(
+	r *http.Request,
+	labels map[string]string,
+	replace bool,
+	timestampPolicy TimestampPolicy,
+	labelConflictPolicy LabelConflictPolicy,
+	validationPolicy ValidationPolicy,
+	relabelRules *RelabelRules,
+) (storage.WriteRequest, error) {
+	reject := func(status int, reason string, err error) (storage.WriteRequest, error) {
+		return storage.WriteRequest{}, PushError{Status: status, Reason: reason, Err: err}
+	}
+
+	ttl, err := parseTTL(r)
+	if err != nil {
+		return reject(http.StatusBadRequest, "failed to parse TTL", err)
+	}
+	expectedInterval, err := parseExpectedInterval(r)
+	if err != nil {
+		return reject(http.StatusBadRequest, "failed to parse expected push interval", err)
+	}
+	aggregation, err := parseAggregation(r, replace)
+	if err != nil {
+		return reject(http.StatusBadRequest, "invalid aggregation", err)
+	}
+	annotations, err := parseAnnotations(r)
+	if err != nil {
+		return reject(http.StatusBadRequest, "invalid annotation", err)
+	}
+	sequence, err := parseSequence(r)
+	if err != nil {
+		return reject(http.StatusBadRequest, "invalid sequence number", err)
+	}
+
+	body, err := decodeBody(r)
+	if err != nil {
+		status := readErrorStatus(err)
+		if _, ok := err.(unsupportedEncodingError); ok {
+			status = http.StatusUnsupportedMediaType
+		}
+		return reject(status, "failed to decode request body", err)
+	}
+	defer body.Close()
+	// The text parser mistakes a read error at the start of a line for the
+	// end of the body, so record read errors separately.
+	hash := sha256.New()
+	rec := &errRecorder{r: io.TeeReader(body, hash)}
+
+	// We could do further content-type checks here, but the fallback for
+	// now will anyway be the text format version 0.0.4, so just go for it
+	// and see if it works.
+	pushFormat := storage.PushFormat{
+		ContentType:     r.Header.Get("Content-Type"),
+		ContentEncoding: strings.TrimSpace(r.Header.Get("Content-Encoding")),
+		Format:          codec.FormatForContentType(r.Header.Get("Content-Type")),
+	}
+	metricFamilies, err := codec.DecodeAll(rec, pushFormat.Format)
+	if rec.err != nil {
+		err = rec.err
+	}
+	if err != nil {
+		return reject(readErrorStatus(err), "failed to parse text", err)
+	}
+	if relabelConfigs := relabelRules.Get(); len(relabelConfigs) > 0 {
+		if metricFamilies, err = relabelMetricFamilies(metricFamilies, labels, relabelConfigs); err != nil {
+			return reject(http.StatusBadRequest, "failed to relabel pushed metrics", err)
+		}
+	}
+	switch timestampPolicy {
+	case TimestampReject:
+		if name, ok := findTimestamp(metricFamilies); ok {
+			return reject(
+				http.StatusBadRequest, "pushed metrics have timestamps",
+				fmt.Errorf("pushed metrics must not have timestamps, found one in metric family %q", name),
+			)
+		}
+	case TimestampStrip:
+		stripTimestamps(metricFamilies)
+	}
+	if err := validate(metricFamilies, labels, validationPolicy); err != nil {
+		return reject(http.StatusBadRequest, "pushed metrics are invalid", err)
+	}
+	if labelConflictPolicy == LabelConflictReject {
+		if name, lp, ok := findLabelConflict(metricFamilies, labels); ok {
+			return reject(
+				http.StatusBadRequest, "pushed metrics have labels conflicting with the grouping labels",
+				fmt.Errorf("label %s=%q in metric family %q conflicts with the grouping labels %v", lp.GetName(), lp.GetValue(), name, labels),
+			)
+		}
+	}
+	return storage.WriteRequest{
+		Labels:           labels,
+		Timestamp:        time.Now(),
+		MetricFamilies:   metricFamilies,
+		Replace:          replace,
+		TTL:              ttl,
+		AllowTimestamps:  timestampPolicy == TimestampAllow,
+		Aggregation:      aggregation,
+		Annotations:      annotations,
+		ExpectedInterval: expectedInterval,
+		Sequence:         sequence,
+		PayloadHash:      hex.EncodeToString(hash.Sum(nil)),
+		PayloadSize:      rec.n,
+		PushFormat:       pushFormat,
+	}, nil
+}
+
+// etagMatches returns whether the provided If-None-Match header value is "*" or
+// lists the provided ETag (ignoring a weakness indicator).
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// findTimestamp returns the name of a metric family containing a sample with a
+// timestamp and true. If there is none, it returns false.
+func findTimestamp(metricFamilies map[string]*dto.MetricFamily) (string, bool) {
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			if m.TimestampMs != nil {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// findLabelConflict returns the name of a metric family containing a sample
+// with a label conflicting with the provided grouping labels (see Push), that
+// label, and true. If there is none, it returns false.
+func findLabelConflict(metricFamilies map[string]*dto.MetricFamily, groupingLabels map[string]string) (string, *dto.LabelPair, bool) {
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				lv, ok := groupingLabels[lp.GetName()]
+				if !ok && lp.GetName() == string(model.InstanceLabel) {
+					// The group has an implicit empty instance label.
+					lv, ok = "", true
+				}
+				if ok && lp.GetValue() != lv {
+					return name, lp, true
+				}
+			}
+		}
+	}
+	return "", nil, false
+}
+
+// validate returns an error describing the first metric name, label name, or
+// label value in metricFamilies or groupingLabels that is invalid according to
+// policy, or nil if there is none.
+func validate(metricFamilies map[string]*dto.MetricFamily, groupingLabels map[string]string, policy ValidationPolicy) error {
+	if policy == ValidationNone {
+		return nil
+	}
+	validName := func(name string) bool {
+		return name != "" && utf8.ValidString(name)
+	}
+	if policy == ValidationStrict {
+		validName = func(name string) bool {
+			return model.IsValidMetricName(model.LabelValue(name))
+		}
+	}
+	validLabelName := func(name string) bool {
+		if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return false
+		}
+		if policy == ValidationStrict {
+			return model.LabelName(name).IsValid()
+		}
+		return name != "" && utf8.ValidString(name)
+	}
+
+	for name, value := range groupingLabels {
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("grouping label %s has a value that is not valid UTF-8: %q", name, value)
+		}
+	}
+	for name, mf := range metricFamilies {
+		if !validName(name) {
+			return fmt.Errorf("invalid metric name %q", name)
+		}
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if !validLabelName(lp.GetName()) {
+					return fmt.Errorf("invalid label name %q in metric family %q", lp.GetName(), name)
+				}
+				if !utf8.ValidString(lp.GetValue()) {
+					return fmt.Errorf("label %s in metric family %q has a value that is not valid UTF-8: %q", lp.GetName(), name, lp.GetValue())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// stripTimestamps removes the timestamps from all samples.
+func stripTimestamps(metricFamilies map[string]*dto.MetricFamily) {
+	for _, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			m.TimestampMs = nil
+		}
+	}
+}
+
 // decodeBase64 decodes the provided string using the “Base 64 Encoding with URL
 // and Filename Safe Alphabet” (RFC 4648). Padding characters (i.e. trailing
 // '=') are ignored.
@@ -172,6 +605,232 @@ func decodeBase64(s string) (string, error) {
 	return string(b), err
 }
 
+// parseTTL returns the TTL requested for a push. The "ttl" query parameter takes
+// precedence over the X-Pushgateway-TTL header. If neither is set, a zero TTL
+// is returned, i.e. the pushed metrics never expire.
+func parseTTL(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("ttl")
+	if s == "" {
+		s = r.Header.Get(TTLHeader)
+	}
+	if s == "" {
+		return 0, nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TTL %q: %v", s, err)
+	}
+	return time.Duration(d), nil
+}
+
+// parseExpectedInterval returns the interval within which the next push is
+// expected as requested by the "expect" query parameter of a push, or zero if
+// it is not set.
+func parseExpectedInterval(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("expect")
+	if s == "" {
+		return 0, nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil || d == 0 {
+		return 0, fmt.Errorf("invalid expected push interval %q, must be a positive duration", s)
+	}
+	return time.Duration(d), nil
+}
+
+// parseSequence returns the sequence number set by the X-Pushgateway-Sequence
+// header of a push, or zero if it is not set.
+func parseSequence(r *http.Request) (uint64, error) {
+	s := r.Header.Get(SequenceHeader)
+	if s == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || seq == 0 {
+		return 0, fmt.Errorf("invalid sequence number %q, must be a positive integer", s)
+	}
+	return seq, nil
+}
+
+// parseAggregation returns the storage.Aggregation requested by the "aggregate"
+// query parameter of a push. An error is returned for an unknown value or if
+// replace is true, as replacing a whole group leaves nothing to aggregate with.
+func parseAggregation(r *http.Request, replace bool) (storage.Aggregation, error) {
+	switch agg := storage.Aggregation(r.URL.Query().Get("aggregate")); agg {
+	case storage.AggregateNone:
+		return agg, nil
+	case storage.AggregateSum, storage.AggregateMax:
+		if replace {
+			return storage.AggregateNone, fmt.Errorf("aggregation %q is not possible with method %s", agg, r.Method)
+		}
+		return agg, nil
+	default:
+		return storage.AggregateNone, fmt.Errorf("unknown aggregation %q, must be %q or %q", agg, storage.AggregateSum, storage.AggregateMax)
+	}
+}
+
+// parseAnnotations returns the annotations set via X-Pushgateway-Annotation
+// headers, or nil if there are none. The value of an annotation is everything
+// after the first '=', so it may contain further '=' (or ',') characters.
+func parseAnnotations(r *http.Request) (map[string]string, error) {
+	values := r.Header[http.CanonicalHeaderKey(AnnotationHeader)]
+	if len(values) == 0 {
+		return nil, nil
+	}
+	annotations := make(map[string]string, len(values))
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !model.LabelName(name).IsValid() {
+			return nil, fmt.Errorf("invalid annotation %q, must be name=value with a valid label name", v)
+		}
+		annotations[name] = strings.TrimSpace(kv[1])
+	}
+	return annotations, nil
+}
+
+// decodeBody returns a reader for the decompressed request body according to
+// the Content-Encoding header. Supported encodings are gzip and deflate (i.e.
+// zlib as per RFC 7230). An unsupportedEncodingError is returned for any other
+// encoding.
+func decodeBody(r *http.Request) (io.ReadCloser, error) {
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		body, err := gzip.NewReader(r.Body)
+		if err == errBodyTooLarge || err == errPushTimeout {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip encoding: %v", err)
+		}
+		return body, nil
+	case "deflate":
+		body, err := zlib.NewReader(r.Body)
+		if err == errBodyTooLarge || err == errPushTimeout {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid deflate encoding: %v", err)
+		}
+		return body, nil
+	default:
+		return nil, unsupportedEncodingError(enc)
+	}
+}
+
+// errRecorder records the first error other than io.EOF returned by the
+// wrapped reader and counts the bytes read.
+type errRecorder struct {
+	r   io.Reader
+	err error
+	n   int
+}
+
+func (er *errRecorder) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	er.n += n
+	if err != nil && err != io.EOF && er.err == nil {
+		er.err = err
+	}
+	return n, err
+}
+
+type unsupportedEncodingError string
+
+func (e unsupportedEncodingError) Error() string {
+	return fmt.Sprintf("unsupported Content-Encoding %q", string(e))
+}
+
+// ParseGroupingPath parses grouping labels in the form of the push URL path
+// after the metrics path, e.g. "/job/foo/instance@base64/YmFy".
+func ParseGroupingPath(path string) (map[string]string, error) {
+	return splitLabels(path)
+}
+
+// GroupingPath returns the push URL path after the metrics path for the provided
+// grouping labels, i.e. the reverse of ParseGroupingPath. The job label comes
+// first, followed by the other labels in lexicographical order. All values are
+// base64-encoded so that they may contain any character.
+func GroupingPath(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != "job" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range append([]string{"job"}, names...) {
+		value := base64.RawURLEncoding.EncodeToString([]byte(labels[name]))
+		if value == "" {
+			// An empty path component would be dropped.
+			value = "="
+		}
+		b.WriteString("/" + name + Base64Suffix + "/" + value)
+	}
+	return b.String()
+}
+
+// groupingLabels returns the grouping labels of a push or delete request from
+// the job and the labels string taken from its URL. The labels string must not
+// contain metric names anymore, see splitMetricNames.
+func groupingLabels(job, labelsString string, jobBase64Encoded bool) (map[string]string, error) {
+	if jobBase64Encoded {
+		var err error
+		if job, err = decodeBase64(job); err != nil {
+			return nil, fmt.Errorf("invalid base64 encoding in job name %q: %v", job, err)
+		}
+	}
+	labels, err := splitLabels(labelsString)
+	if err != nil {
+		return nil, err
+	}
+	if job == "" {
+		return nil, errors.New("job name is required")
+	}
+	labels["job"] = job
+	return labels, nil
+}
+
+// parsePushPath returns the grouping labels of a push or (if deletion is true)
+// delete request, and the metric names of the latter, from the provided URL
+// path below the push path, e.g. "/job/foo/instance/bar". The path is split
+// like the router does for the routes of the Push and Delete handlers, and the
+// result is the same as the grouping labels used by those handlers, so that
+// handlers in front of them check the same group.
+func parsePushPath(path string, deletion bool) (map[string]string, []string, error) {
+	components := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(components) < 2 {
+		return nil, nil, errors.New("job name is required")
+	}
+	var jobBase64Encoded bool
+	switch components[0] {
+	case "job":
+	case "job" + Base64Suffix:
+		jobBase64Encoded = true
+	default:
+		return nil, nil, fmt.Errorf("invalid push path %q", path)
+	}
+	labelsString := ""
+	if len(components) == 3 {
+		labelsString = "/" + components[2]
+	}
+	var metricNames []string
+	if deletion {
+		var err error
+		if labelsString, metricNames, err = splitMetricNames(labelsString); err != nil {
+			return nil, nil, err
+		}
+	}
+	labels, err := groupingLabels(components[1], labelsString, jobBase64Encoded)
+	if err != nil {
+		return nil, nil, err
+	}
+	return labels, metricNames, nil
+}
+
 // splitLabels splits a labels string into a label map mapping names to values.
 func splitLabels(labels string) (map[string]string, error) {
 	result := map[string]string{}
@@ -0,0 +1,171 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// RejectedPush is a push rejected by the Pushgateway as kept in a Quarantine.
+// The body is the raw request body (i.e. still compressed if it was sent with
+// a Content-Encoding). If it is not valid UTF-8, it is base64-encoded, with
+// BodyEncoding set to "base64".
+type RejectedPush struct {
+	Time            time.Time `json:"time"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	RemoteAddr      string    `json:"remote_addr"`
+	ContentType     string    `json:"content_type,omitempty"`
+	ContentEncoding string    `json:"content_encoding,omitempty"`
+	Status          int       `json:"status"`
+	Error           string    `json:"error"`
+	Body            string    `json:"body"`
+	BodyEncoding    string    `json:"body_encoding,omitempty"`
+	BodyTruncated   bool      `json:"body_truncated"`
+}
+
+// Quarantine keeps the most recently rejected pushes for inspection, see
+// QuarantineRejected. It is safe for concurrent use.
+type Quarantine struct {
+	maxBodySize int
+
+	mtx    sync.Mutex
+	pushes []RejectedPush // Ring buffer, next is the oldest once full.
+	next   int
+	full   bool
+}
+
+// NewQuarantine returns a Quarantine keeping at most size rejected pushes, each
+// with at most maxBodySize bytes of its body.
+func NewQuarantine(size, maxBodySize int) *Quarantine {
+	return &Quarantine{
+		maxBodySize: maxBodySize,
+		pushes:      make([]RejectedPush, size),
+	}
+}
+
+// Add adds the provided rejected push, replacing the oldest one if the
+// Quarantine is full.
+func (q *Quarantine) Add(p RejectedPush) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.pushes) == 0 {
+		return
+	}
+	q.pushes[q.next] = p
+	q.next = (q.next + 1) % len(q.pushes)
+	if q.next == 0 {
+		q.full = true
+	}
+}
+
+// Pushes returns the rejected pushes in the Quarantine, the most recent first.
+func (q *Quarantine) Pushes() []RejectedPush {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	n := q.next
+	if q.full {
+		n = len(q.pushes)
+	}
+	result := make([]RejectedPush, 0, n)
+	for i := 1; i <= n; i++ {
+		result = append(result, q.pushes[(q.next-i+len(q.pushes))%len(q.pushes)])
+	}
+	return result
+}
+
+// QuarantineRejected returns a handler that passes all requests on to next and
+// adds every PUT and POST request below pushPath that is responded to with a
+// status code of 400 or above to q, together with the beginning of its body
+// and the error response. The body is read before passing the request on, so
+// that it is also kept if the push is rejected before its body is read. To
+// keep pushes rejected by authentication or rate limits (which is usually not
+// desired), the QuarantineRejected handler has to be in front of those
+// handlers.
+func QuarantineRejected(q *Quarantine, pushPath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodPut && r.Method != http.MethodPost,
+			!strings.HasPrefix(r.URL.Path, pushPath+"/"):
+			next.ServeHTTP(w, r)
+			return
+		}
+		p := RejectedPush{
+			Time:            time.Now(),
+			Method:          r.Method,
+			Path:            r.URL.Path,
+			RemoteAddr:      r.RemoteAddr,
+			ContentType:     r.Header.Get("Content-Type"),
+			ContentEncoding: r.Header.Get("Content-Encoding"),
+		}
+		// Read one byte more than kept to find out about truncation. A
+		// read error is returned to next after the bytes read so far.
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(q.maxBodySize)+1))
+		r.Body = &replayedBody{
+			r:    io.MultiReader(bytes.NewReader(body), &errReader{err: err, r: r.Body}),
+			body: r.Body,
+		}
+
+		aw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(aw, r)
+		if aw.status < 400 {
+			return
+		}
+
+		if len(body) > q.maxBodySize {
+			body = body[:q.maxBodySize]
+			p.BodyTruncated = true
+		}
+		if utf8.Valid(body) {
+			p.Body = string(body)
+		} else {
+			p.Body = base64.StdEncoding.EncodeToString(body)
+			p.BodyEncoding = "base64"
+		}
+		p.Status = aw.status
+		p.Error = strings.TrimSpace(aw.errBody.String())
+		q.Add(p)
+	})
+}
+
+// replayedBody is a request body whose beginning has been read already.
+type replayedBody struct {
+	r    io.Reader
+	body io.Closer
+}
+
+func (b *replayedBody) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+func (b *replayedBody) Close() error { return b.body.Close() }
+
+// errReader returns err if it is not nil, and otherwise reads from r.
+type errReader struct {
+	err error
+	r   io.Reader
+}
+
+func (er *errReader) Read(p []byte) (int, error) {
+	if er.err != nil {
+		return 0, er.err
+	}
+	return er.r.Read(p)
+}
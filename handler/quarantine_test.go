@@ -0,0 +1,99 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuarantineRejected(t *testing.T) {
+	q := NewQuarantine(2, 8)
+	// Rejects pushes with a body starting with "bad", before reading the
+	// rest of it if it is "bad early".
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/early") {
+			http.Error(w, "rejected early", http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.HasPrefix(body, []byte("bad")) {
+			http.Error(w, "rejected "+string(body), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := QuarantineRejected(q, "/metrics", next)
+	push := func(method, path, body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	if expected, got := http.StatusAccepted, push(http.MethodPut, "/metrics/job/a", "good"); expected != got {
+		t.Errorf("Wanted status code %d, got %d.", expected, got)
+	}
+	if expected, got := 0, len(q.Pushes()); expected != got {
+		t.Errorf("Wanted %d rejected pushes, got %d.", expected, got)
+	}
+
+	// The whole body reaches the wrapped handler, even if it is longer
+	// than kept in the quarantine.
+	if expected, got := http.StatusBadRequest, push(http.MethodPost, "/metrics/job/a", "bad metrics"); expected != got {
+		t.Errorf("Wanted status code %d, got %d.", expected, got)
+	}
+	pushes := q.Pushes()
+	if expected, got := 1, len(pushes); expected != got {
+		t.Fatalf("Wanted %d rejected pushes, got %d.", expected, got)
+	}
+	p := pushes[0]
+	if p.Method != http.MethodPost || p.Path != "/metrics/job/a" || p.Status != http.StatusBadRequest {
+		t.Errorf("Unexpected rejected push %+v.", p)
+	}
+	if expected, got := "rejected bad metrics", p.Error; expected != got {
+		t.Errorf("Wanted error %q, got %q.", expected, got)
+	}
+	if expected, got := "bad metr", p.Body; expected != got || !p.BodyTruncated {
+		t.Errorf("Wanted truncated body %q, got %q (truncated: %v).", expected, got, p.BodyTruncated)
+	}
+
+	push(http.MethodPut, "/metrics/job/early", "\xffbad")
+	p = q.Pushes()[0]
+	if p.Path != "/metrics/job/early" || p.BodyTruncated {
+		t.Errorf("Unexpected rejected push %+v.", p)
+	}
+	if expected, got := "/2JhZA==", p.Body; expected != got || p.BodyEncoding != "base64" {
+		t.Errorf("Wanted base64-encoded body %q, got %q (encoding %q).", expected, got, p.BodyEncoding)
+	}
+
+	// Deletions and requests outside of the push path are not kept, and
+	// the oldest rejected push is replaced once the quarantine is full.
+	push(http.MethodDelete, "/metrics/job/early", "")
+	push(http.MethodPut, "/api/v1/early", "bad")
+	push(http.MethodPut, "/metrics/job/b", "bad")
+	pushes = q.Pushes()
+	if expected, got := 2, len(pushes); expected != got {
+		t.Fatalf("Wanted %d rejected pushes, got %d.", expected, got)
+	}
+	if pushes[0].Path != "/metrics/job/b" || pushes[1].Path != "/metrics/job/early" {
+		t.Errorf("Unexpected rejected pushes %+v.", pushes)
+	}
+}
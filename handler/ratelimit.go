@@ -0,0 +1,204 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+// Rate is the rate of requests a RateLimiter permits.
+type Rate struct {
+	// Limit is the number of requests per second permitted on average.
+	Limit float64
+	// Burst is the number of requests permitted at once after a period
+	// without any requests.
+	Burst int
+}
+
+// ParseRate parses a rate in the form <number>/<unit>, e.g. "10/s", where the
+// unit is one of s, m, or h. The burst is the number of requests per unit,
+// rounded up.
+func ParseRate(s string) (Rate, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Rate{}, fmt.Errorf("invalid rate %q, must be <number>/<unit>, e.g. 10/s", s)
+	}
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return Rate{}, fmt.Errorf("invalid number of requests in rate %q", s)
+	}
+	var unit time.Duration
+	switch parts[1] {
+	case "s":
+		unit = time.Second
+	case "m":
+		unit = time.Minute
+	case "h":
+		unit = time.Hour
+	default:
+		return Rate{}, fmt.Errorf("invalid unit in rate %q, must be s, m, or h", s)
+	}
+	return Rate{
+		Limit: n / unit.Seconds(),
+		Burst: int(math.Ceil(n)),
+	}, nil
+}
+
+// RateLimiter is a token-bucket rate limiter with one bucket per key. All its
+// methods are safe for concurrent use.
+type RateLimiter struct {
+	rate Rate
+	now  func() time.Time // For testing.
+
+	mtx       sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter permitting the provided Rate per key.
+func NewRateLimiter(rate Rate) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// allow takes a token from the bucket for the provided key. If the bucket is
+// empty, it returns false and the time until a token is available again.
+func (l *RateLimiter) allow(key string) (bool, time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate.Limit * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *RateLimiter) refill(b *bucket, now time.Time) float64 {
+	return math.Min(float64(l.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rate.Limit)
+}
+
+// sweep removes full buckets, which are equivalent to missing ones, so that
+// the number of buckets does not grow without bounds. To keep the cost low, it
+// only does so once per time needed to fill an empty bucket. The caller must
+// hold the lock.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep).Seconds() < float64(l.rate.Burst)/l.rate.Limit {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.rate.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimit returns a handler that applies the provided RateLimiters to all
+// PUT, POST, and DELETE requests below pushPath before passing them on to
+// next, perIP keyed by the source IP of the request, perGroup keyed by the
+// grouping labels in the URL (no matter if base64-encoded or not), parsed the
+// same way as by the push and delete handlers. Malformed URLs are left to those
+// handlers to reject, but they still count against the job they name. Either of
+// the RateLimiters may be nil. Requests exceeding the rate are rejected with
+// http.StatusTooManyRequests and a Retry-After header. All other requests are
+// passed on unchecked.
+func RateLimit(
+	perIP, perGroup *RateLimiter,
+	pushPath string,
+	next http.Handler,
+	logger log.Logger,
+) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodDelete,
+			!strings.HasPrefix(r.URL.Path, pushPath+"/"):
+			next.ServeHTTP(w, r)
+			return
+		}
+		if perIP != nil {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			if ok, wait := perIP.allow(ip); !ok {
+				rateLimited(w, r, "ip", wait, logger)
+				return
+			}
+		}
+		if perGroup != nil {
+			if ok, wait := perGroup.allow(groupKey(strings.TrimPrefix(r.URL.Path, pushPath), r.Method == http.MethodDelete)); !ok {
+				rateLimited(w, r, "group", wait, logger)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// groupKey returns the key of the per-group RateLimiter for the provided push
+// path (with the pushPath prefix removed). If the path cannot be parsed, the
+// key is derived from its job component alone.
+func groupKey(path string, deletion bool) string {
+	labels, _, err := parsePushPath(path, deletion)
+	if err == nil {
+		return strconv.FormatUint(model.LabelsToSignature(labels), 16)
+	}
+	components := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	if len(components) < 2 {
+		return "job="
+	}
+	job := components[1]
+	if components[0] == "job"+Base64Suffix {
+		if decoded, err := decodeBase64(job); err == nil {
+			job = decoded
+		}
+	}
+	return "job=" + job
+}
+
+func rateLimited(w http.ResponseWriter, r *http.Request, scope string, wait time.Duration, logger log.Logger) {
+	httpRateLimited.WithLabelValues(scope).Inc()
+	level.Debug(logger).Log("msg", "rate limit exceeded", "scope", scope, "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+}
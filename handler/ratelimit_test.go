@@ -0,0 +1,115 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	scenarios := map[string]struct {
+		rate  Rate
+		valid bool
+	}{
+		"10/s":  {rate: Rate{Limit: 10, Burst: 10}, valid: true},
+		"120/m": {rate: Rate{Limit: 2, Burst: 120}, valid: true},
+		"0.5/s": {rate: Rate{Limit: 0.5, Burst: 1}, valid: true},
+		"36/h":  {rate: Rate{Limit: 0.01, Burst: 36}, valid: true},
+		"10":    {},
+		"10/d":  {},
+		"0/s":   {},
+		"-1/s":  {},
+		"x/s":   {},
+	}
+	for s, scenario := range scenarios {
+		rate, err := ParseRate(s)
+		if expected, got := scenario.valid, err == nil; expected != got {
+			t.Errorf("%s: Wanted valid=%v, got error %v.", s, expected, err)
+			continue
+		}
+		if expected, got := scenario.rate, rate; expected != got {
+			t.Errorf("%s: Wanted %+v, got %+v.", s, expected, got)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	perIP := NewRateLimiter(Rate{Limit: 1, Burst: 3})
+	perIP.now = clock
+	perGroup := NewRateLimiter(Rate{Limit: 0.5, Burst: 1})
+	perGroup.now = clock
+
+	h := RateLimit(perIP, perGroup, "/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}), logger)
+	request := func(method, path, remoteAddr string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://example.org"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, s := range []struct {
+		method, path, remoteAddr string
+		wantStatus               int
+		wantRetryAfter           string
+	}{
+		{"POST", "/metrics/job/a", "10.0.0.1:1234", http.StatusAccepted, ""},
+		// Same group, base64-encoded.
+		{"PUT", "/metrics/job@base64/YQ", "10.0.0.2:1234", http.StatusTooManyRequests, "2"},
+		{"DELETE", "/metrics/job/b/instance/x", "10.0.0.1:1234", http.StatusAccepted, ""},
+		{"POST", "/metrics/job/c", "10.0.0.1:1234", http.StatusAccepted, ""},
+		// Per-IP limit exhausted.
+		{"POST", "/metrics/job/d", "10.0.0.1:4321", http.StatusTooManyRequests, "1"},
+		// Trailing slashes and metric names do not make a new group.
+		{"POST", "/metrics/job/c/", "10.0.0.3:1234", http.StatusTooManyRequests, "2"},
+		{"DELETE", "/metrics/job/b/instance/x/@metric/m", "10.0.0.3:1234", http.StatusTooManyRequests, "2"},
+		// Malformed URLs are limited by job.
+		{"PUT", "/metrics/job/e/instance", "10.0.0.4:1234", http.StatusAccepted, ""},
+		{"PUT", "/metrics/job@base64/ZQ/instance/x/y", "10.0.0.4:1234", http.StatusTooManyRequests, "2"},
+		// Scrapes and other paths are not limited.
+		{"GET", "/metrics", "10.0.0.1:1234", http.StatusAccepted, ""},
+		{"PUT", "/api/v1/admin/wipe", "10.0.0.1:1234", http.StatusAccepted, ""},
+	} {
+		w := request(s.method, s.path, s.remoteAddr)
+		if expected, got := s.wantStatus, w.Code; expected != got {
+			t.Errorf("%d: Wanted status code %v, got %v.", i, expected, got)
+		}
+		if expected, got := s.wantRetryAfter, w.Header().Get("Retry-After"); expected != got {
+			t.Errorf("%d: Wanted Retry-After %q, got %q.", i, expected, got)
+		}
+	}
+
+	// The buckets refill over time.
+	now = now.Add(2 * time.Second)
+	if expected, got := http.StatusAccepted, request("POST", "/metrics/job/a", "10.0.0.1:1234").Code; expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+
+	// Full buckets are removed eventually.
+	now = now.Add(time.Hour)
+	request("POST", "/metrics/job/a", "10.0.0.3:1234")
+	if expected, got := 1, len(perIP.buckets); expected != got {
+		t.Errorf("Wanted %d per-IP buckets, got %d.", expected, got)
+	}
+}
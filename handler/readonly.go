@@ -0,0 +1,92 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// ReadOnlyMode is the switch for rejecting all changes of pushed metrics, see
+// RejectWrites. The zero value is switched off. It is safe for concurrent use.
+type ReadOnlyMode struct {
+	enabled int32
+}
+
+// Enabled returns true if the read-only mode is switched on.
+func (m *ReadOnlyMode) Enabled() bool {
+	return atomic.LoadInt32(&m.enabled) == 1
+}
+
+// Set switches the read-only mode on or off.
+func (m *ReadOnlyMode) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&m.enabled, v)
+}
+
+// RejectWrites returns a handler that rejects PUT, POST, and DELETE requests
+// for any of the provided paths or below them with http.StatusForbidden while
+// the read-only mode is switched on. All other requests are passed on to next.
+func RejectWrites(m *ReadOnlyMode, next http.Handler, paths ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.Enabled() && (r.Method == http.MethodPut || r.Method == http.MethodPost || r.Method == http.MethodDelete) {
+			for _, p := range paths {
+				if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+					http.Error(w, "the Pushgateway is in read-only mode", http.StatusForbidden)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetReadOnly returns an http.Handler that switches the provided read-only mode
+// on (if enable is true) or off.
+//
+// The returned handler is already instrumented for Prometheus.
+func SetReadOnly(m *ReadOnlyMode, enable bool, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"read_only",
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			if m.Enabled() != enable {
+				level.Info(logger).Log("msg", "read-only mode switched", "read_only", enable)
+			}
+			m.Set(enable)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+}
+
+// GetReadOnly returns an http.Handler that responds with a JSON object telling
+// if the provided read-only mode is switched on, e.g. {"read_only": true}.
+//
+// The returned handler is already instrumented for Prometheus.
+func GetReadOnly(m *ReadOnlyMode, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"read_only",
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(map[string]bool{"read_only": m.Enabled()}); err != nil {
+				level.Error(logger).Log("msg", "failed to write read-only mode", "err", err.Error())
+			}
+		}))
+}
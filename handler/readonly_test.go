@@ -0,0 +1,71 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRejectWrites(t *testing.T) {
+	m := &ReadOnlyMode{}
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := RejectWrites(m, next, "/metrics", "/api/v1/groups", "/api/v1/admin/wipe")
+	setOn, setOff, get := SetReadOnly(m, true, logger), SetReadOnly(m, false, logger), GetReadOnly(m, logger)
+
+	serve := func(h http.Handler, method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	scenarios := []struct {
+		method, path string
+		rejected     bool
+	}{
+		{http.MethodPut, "/metrics/job/foo", true},
+		{http.MethodPost, "/metrics/job/foo", true},
+		{http.MethodDelete, "/metrics/job/foo", true},
+		{http.MethodPut, "/api/v1/groups/job/foo/lock", true},
+		{http.MethodPost, "/api/v1/groups/rename", true},
+		{http.MethodPut, "/api/v1/admin/wipe", true},
+		{http.MethodGet, "/metrics", false},
+		{http.MethodGet, "/metrics/job/foo", false},
+		{http.MethodPost, "/api/v1/replicate", false},
+		{http.MethodPut, "/api/v1/admin/wiped", false},
+	}
+	for _, enabled := range []bool{false, true, false} {
+		if enabled {
+			serve(setOn, http.MethodPut, "/api/v1/admin/read-only")
+		} else {
+			serve(setOff, http.MethodDelete, "/api/v1/admin/read-only")
+		}
+		body := serve(get, http.MethodGet, "/api/v1/admin/read-only").Body.String()
+		if expected, got := enabled, strings.Contains(body, "true"); expected != got {
+			t.Errorf("Wanted read-only mode %v, got %s.", expected, body)
+		}
+		for _, s := range scenarios {
+			expectedCode := http.StatusAccepted
+			if enabled && s.rejected {
+				expectedCode = http.StatusForbidden
+			}
+			if got := serve(h, s.method, s.path).Code; expectedCode != got {
+				t.Errorf("read-only=%v, %s %s: Wanted status code %d, got %d.", enabled, s.method, s.path, expectedCode, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// RelabelAction is the action to be performed by a RelabelConfig.
+type RelabelAction string
+
+// The supported RelabelActions. They behave like their namesakes in the
+// relabel_config of Prometheus.
+const (
+	RelabelReplace   RelabelAction = "replace"
+	RelabelKeep      RelabelAction = "keep"
+	RelabelDrop      RelabelAction = "drop"
+	RelabelLabelMap  RelabelAction = "labelmap"
+	RelabelLabelDrop RelabelAction = "labeldrop"
+)
+
+// RelabelConfig is a relabeling rule applied to every pushed sample. Its fields
+// have the same meaning as in the relabel_config of Prometheus.
+type RelabelConfig struct {
+	SourceLabels []string      `yaml:"source_labels,flow,omitempty"`
+	Separator    string        `yaml:"separator,omitempty"`
+	Regex        string        `yaml:"regex,omitempty"`
+	TargetLabel  string        `yaml:"target_label,omitempty"`
+	Replacement  string        `yaml:"replacement,omitempty"`
+	Action       RelabelAction `yaml:"action,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// RelabelFile is the content of the file provided with
+// --push.relabel-config-file.
+type RelabelFile struct {
+	MetricRelabelConfigs []*RelabelConfig `yaml:"metric_relabel_configs"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. It sets the defaults and validates
+// the RelabelConfig.
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RelabelConfig
+	*c = RelabelConfig{
+		Separator:   ";",
+		Regex:       "(.*)",
+		Replacement: "$1",
+		Action:      RelabelReplace,
+	}
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %v", c.Regex, err)
+	}
+	c.regex = regex
+	switch c.Action {
+	case RelabelReplace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %q requires target_label", c.Action)
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(c.SourceLabels) == 0 {
+			return fmt.Errorf("relabel action %q requires source_labels", c.Action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop:
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+	return nil
+}
+
+// LoadRelabelFile reads and validates the RelabelConfigs from the provided YAML
+// file.
+func LoadRelabelFile(file string) ([]*RelabelConfig, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &RelabelFile{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse relabel config file %q: %v", file, err)
+	}
+	return cfg.MetricRelabelConfigs, nil
+}
+
+// RelabelRules holds the RelabelConfigs applied by the Push handlers. They can
+// be replaced at runtime, e.g. upon reloading the configuration. A nil
+// *RelabelRules applies no relabeling. RelabelRules is safe for concurrent use.
+type RelabelRules struct {
+	mtx  sync.RWMutex
+	cfgs []*RelabelConfig
+}
+
+// NewRelabelRules returns RelabelRules holding the provided RelabelConfigs.
+func NewRelabelRules(cfgs []*RelabelConfig) *RelabelRules {
+	return &RelabelRules{cfgs: cfgs}
+}
+
+// Set replaces the held RelabelConfigs. Pushes already being processed keep
+// using the previous ones.
+func (rr *RelabelRules) Set(cfgs []*RelabelConfig) {
+	rr.mtx.Lock()
+	defer rr.mtx.Unlock()
+	rr.cfgs = cfgs
+}
+
+// Get returns the held RelabelConfigs.
+func (rr *RelabelRules) Get() []*RelabelConfig {
+	if rr == nil {
+		return nil
+	}
+	rr.mtx.RLock()
+	defer rr.mtx.RUnlock()
+	return rr.cfgs
+}
+
+// relabel applies the provided RelabelConfigs, in order, to the provided label
+// set (which includes the metric name as model.MetricNameLabel). It returns nil
+// if the sample is to be dropped. The provided map may be modified.
+func relabel(labels map[string]string, cfgs []*RelabelConfig) map[string]string {
+	for _, cfg := range cfgs {
+		values := make([]string, 0, len(cfg.SourceLabels))
+		for _, ln := range cfg.SourceLabels {
+			values = append(values, labels[ln])
+		}
+		value := strings.Join(values, cfg.Separator)
+
+		switch cfg.Action {
+		case RelabelDrop:
+			if cfg.regex.MatchString(value) {
+				return nil
+			}
+		case RelabelKeep:
+			if !cfg.regex.MatchString(value) {
+				return nil
+			}
+		case RelabelReplace:
+			indexes := cfg.regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				break
+			}
+			target := string(cfg.regex.ExpandString(nil, cfg.TargetLabel, value, indexes))
+			if !model.LabelName(target).IsValid() {
+				break
+			}
+			if res := string(cfg.regex.ExpandString(nil, cfg.Replacement, value, indexes)); res != "" {
+				labels[target] = res
+			} else {
+				delete(labels, target)
+			}
+		case RelabelLabelMap:
+			for ln, lv := range labels {
+				if cfg.regex.MatchString(ln) {
+					labels[cfg.regex.ReplaceAllString(ln, cfg.Replacement)] = lv
+				}
+			}
+		case RelabelLabelDrop:
+			for ln := range labels {
+				if cfg.regex.MatchString(ln) {
+					delete(labels, ln)
+				}
+			}
+		}
+	}
+	return labels
+}
+
+// relabelMetricFamilies applies the provided RelabelConfigs to every sample in
+// the provided MetricFamilies and returns the result. The grouping labels are
+// visible to the rules, but changing them has no effect as the MetricStore sets
+// them anyway. A sample whose metric name is changed by the rules moves to the
+// MetricFamily of that name. Samples that are dropped or end up with an invalid
+// metric name are removed. The provided MetricFamilies may be modified.
+func relabelMetricFamilies(
+	metricFamilies map[string]*dto.MetricFamily,
+	groupingLabels map[string]string,
+	cfgs []*RelabelConfig,
+) (map[string]*dto.MetricFamily, error) {
+	// Process the MetricFamilies sorted by name so that samples moving to
+	// another MetricFamily always end up in the same order.
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := make(map[string]*dto.MetricFamily, len(metricFamilies))
+	for _, mfName := range names {
+		mf := metricFamilies[mfName]
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string, len(m.GetLabel())+len(groupingLabels)+1)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			for ln, lv := range groupingLabels {
+				labels[ln] = lv
+			}
+			labels[model.MetricNameLabel] = mf.GetName()
+
+			labels = relabel(labels, cfgs)
+			name := labels[model.MetricNameLabel]
+			if labels == nil || !model.IsValidMetricName(model.LabelValue(name)) {
+				continue
+			}
+			m.Label = m.Label[:0]
+			for ln, lv := range labels {
+				if _, ok := groupingLabels[ln]; ok || ln == model.MetricNameLabel {
+					continue
+				}
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  proto.String(ln),
+					Value: proto.String(lv),
+				})
+			}
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+
+			target, ok := result[name]
+			if !ok {
+				target = &dto.MetricFamily{
+					Name: proto.String(name),
+					Help: mf.Help,
+					Type: mf.Type,
+				}
+				result[name] = target
+			} else if target.GetType() != mf.GetType() {
+				return nil, fmt.Errorf(
+					"relabeling results in metric family %q with types %s and %s",
+					name, target.GetType(), mf.GetType(),
+				)
+			}
+			target.Metric = append(target.Metric, m)
+		}
+	}
+	return result, nil
+}
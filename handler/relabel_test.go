@@ -0,0 +1,169 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+)
+
+const relabelFileContent = `
+metric_relabel_configs:
+  # Enforce a naming convention.
+  - source_labels: [__name__]
+    regex: 'legacy_(.*)'
+    target_label: __name__
+    replacement: 'app_$1'
+  - source_labels: [__name__]
+    regex: 'debug_.*'
+    action: drop
+  - regex: 'meta_(.*)'
+    action: labelmap
+  - regex: 'meta_.*|secret'
+    action: labeldrop
+  - source_labels: [job, env]
+    regex: 'batch;prod'
+    target_label: tier
+    replacement: critical
+`
+
+func TestLoadRelabelFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestLoadRelabelFile.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	scenarios := map[string]struct {
+		content string
+		valid   bool
+	}{
+		"valid": {
+			content: relabelFileContent,
+			valid:   true,
+		},
+		"empty": {
+			content: "",
+			valid:   true,
+		},
+		"unknown field": {
+			content: "metric_relabel_configs:\n  - action: drop\n    source_labels: [a]\n    modulus: 2\n",
+		},
+		"unknown action": {
+			content: "metric_relabel_configs:\n  - action: hashmod\n    source_labels: [a]\n",
+		},
+		"invalid regex": {
+			content: "metric_relabel_configs:\n  - action: drop\n    source_labels: [a]\n    regex: '('\n",
+		},
+		"replace without target": {
+			content: "metric_relabel_configs:\n  - source_labels: [a]\n",
+		},
+		"drop without source": {
+			content: "metric_relabel_configs:\n  - action: drop\n",
+		},
+	}
+	for name, s := range scenarios {
+		file := path.Join(tempDir, "relabel.yml")
+		if err := ioutil.WriteFile(file, []byte(s.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadRelabelFile(file)
+		if expected, got := s.valid, err == nil; expected != got {
+			t.Errorf("%s: Wanted valid=%v, got error %v.", name, expected, err)
+		}
+	}
+	if _, err := LoadRelabelFile(path.Join(tempDir, "nonexistent")); err == nil {
+		t.Error("Expected error for nonexistent relabel config file.")
+	}
+}
+
+func TestPushRelabel(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestPushRelabel.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := path.Join(tempDir, "relabel.yml")
+	if err := ioutil.WriteFile(file, []byte(relabelFileContent), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cfgs, err := LoadRelabelFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mms := MockMetricStore{}
+	handler := Push(&mms, false, true, false, TimestampReject, LabelConflictOverride, ValidationStrict, NewRelabelRules(cfgs), logger)
+	params := map[string]string{
+		"job":    "batch",
+		"labels": "/env/prod",
+	}
+	push := func(body string) int {
+		req, err := http.NewRequest("POST", "http://example.org/", bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req.WithContext(ctxWithParams(params, req)))
+		return w.Code
+	}
+
+	if expected, got := http.StatusOK, push(`
+# TYPE legacy_requests counter
+legacy_requests{meta_team="a",secret="x"} 1
+# TYPE app_requests counter
+app_requests{meta_team="b"} 2
+debug_info 3
+other 4
+`); expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	var buf bytes.Buffer
+	for _, name := range []string{"app_requests", "debug_info", "legacy_requests", "other"} {
+		mf, ok := mms.lastWriteRequest.MetricFamilies[name]
+		if !ok {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := `# TYPE app_requests counter
+app_requests{team="b",tier="critical"} 2
+app_requests{team="a",tier="critical"} 1
+# TYPE other untyped
+other{tier="critical"} 4
+`
+	got := buf.String()
+	if expected != got {
+		t.Errorf("Wanted metric families\n%s\ngot\n%s", expected, got)
+	}
+
+	// Renaming to an existing metric family of a different type fails.
+	if expected, got := http.StatusBadRequest, push(`
+# TYPE legacy_requests counter
+legacy_requests 1
+# TYPE app_requests gauge
+app_requests 2
+`); expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/pushgateway/remotewrite"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// RemoteWritePath is the path of the remote-write endpoint below the API path
+// of version 1, i.e. /api/v1/write below the route prefix, as used by
+// Prometheus.
+const RemoteWritePath = "/write"
+
+// RemoteWrite returns an http.Handler which accepts Prometheus remote-write
+// requests (snappy-compressed protobuf) and stores the series in the
+// MetricStore. The series are converted and grouped as described for
+// remotewrite.Convert, with the provided job set for series without a job label,
+// and with the labels named in groupingLabels added to the grouping labels.
+//
+// Each group is pushed like with a POST request, i.e. replacing stored metric
+// families of the same name. The RelabelConfigs currently held by relabelRules
+// (if any) and validationPolicy apply as for Push, and check does, too. The
+// groups are pushed one after the other, and the first rejected push determines
+// the response, with the same status codes as for Push. The groups pushed
+// before remain stored. Like Prometheus, the handler responds with
+// http.StatusNoContent on success.
+//
+// The returned handler is already instrumented for Prometheus.
+func RemoteWrite(
+	ms storage.MetricStore,
+	check bool,
+	job string,
+	groupingLabels []string,
+	validationPolicy ValidationPolicy,
+	relabelRules *RelabelRules,
+	logger log.Logger,
+) http.Handler {
+	return InstrumentWithCounter(
+		"remote_write",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc != "snappy" {
+				err := unsupportedEncodingError(enc)
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+				level.Debug(logger).Log("msg", "failed to decode request body", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+			b, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), readErrorStatus(err))
+				level.Debug(logger).Log("msg", "failed to read request body", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+			groups, err := remotewrite.Convert(b, job, groupingLabels)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to convert remote-write request", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+
+			pushFormat := storage.PushFormat{
+				ContentType:     r.Header.Get("Content-Type"),
+				ContentEncoding: "snappy",
+			}
+			labels := make([]map[string]string, len(groups))
+			for i, g := range groups {
+				labels[i] = g.Labels
+			}
+			if !authorizeConverted(w, r, labels, logger) {
+				return
+			}
+			for _, g := range groups {
+				if !pushConverted(w, r, ms, check, g.Labels, g.MetricFamilies, storage.AggregateNone, pushFormat, validationPolicy, relabelRules, logger) {
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}),
+	)
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+
+	"github.com/prometheus/pushgateway/remotewrite/prompb"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	defer ms.Shutdown()
+	handler := RemoteWrite(ms, true, "remote_write", []string{"job", "instance"}, ValidationStrict, nil, logger)
+	// body returns a snappy-compressed WriteRequest with one series with
+	// the provided labels and value.
+	body := func(value float64, labels ...string) []byte {
+		ts := &prompb.TimeSeries{Samples: []*prompb.Sample{{Value: value}}}
+		for i := 0; i < len(labels); i += 2 {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: labels[i], Value: labels[i+1]})
+		}
+		b, err := proto.Marshal(&prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{ts}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snappy.Encode(nil, b)
+	}
+	write := func(encoding string, b []byte) int {
+		req, err := http.NewRequest("POST", "http://example.org/api/v1/write", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Encoding", encoding)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if expected, got := http.StatusNoContent, write("snappy", body(3, "__name__", "up", "job", "node", "instance", "a:9100")); expected != got {
+		t.Fatalf("Wanted status code %v, got %v.", expected, got)
+	}
+	group, ok := storage.GetMetricGroup(ms, map[string]string{"job": "node", "instance": "a:9100"})
+	if !ok {
+		t.Fatal("Group not found.")
+	}
+	if expected, got := 3., group.Metrics["up"].GetMetricFamily().GetMetric()[0].GetUntyped().GetValue(); expected != got {
+		t.Errorf("Wanted value %v, got %v.", expected, got)
+	}
+
+	if expected, got := http.StatusUnsupportedMediaType, write("gzip", body(1, "__name__", "up")); expected != got {
+		t.Errorf("Wanted status code %v for wrong encoding, got %v.", expected, got)
+	}
+	if expected, got := http.StatusBadRequest, write("snappy", body(1, "job", "node")); expected != got {
+		t.Errorf("Wanted status code %v for series without name, got %v.", expected, got)
+	}
+}
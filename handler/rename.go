@@ -0,0 +1,136 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// RenameSegment is the last path component of the URL to rename a group, i.e.
+// /api/v1/groups/rename.
+const RenameSegment = "rename"
+
+// maxRenameRequestSize is the maximum size of the body of a rename request.
+const maxRenameRequestSize = 64 << 10
+
+// renameRequest is the body of a request to rename a group.
+type renameRequest struct {
+	From map[string]string `json:"from"`
+	To   map[string]string `json:"to"`
+}
+
+// readRenameRequest parses the body of a rename request and validates the
+// grouping labels in it. The body of the request is replaced by a copy, so that
+// it can be read again.
+func readRenameRequest(r *http.Request) (renameRequest, error) {
+	var req renameRequest
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRenameRequestSize+1))
+	if err != nil {
+		return req, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) > maxRenameRequestSize {
+		return req, errors.New("request body too large")
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return req, fmt.Errorf("invalid request body: %v", err)
+	}
+	if err := checkGroupingLabels(req.From); err != nil {
+		return req, fmt.Errorf("invalid group to rename: %v", err)
+	}
+	if err := checkGroupingLabels(req.To); err != nil {
+		return req, fmt.Errorf("invalid new grouping labels: %v", err)
+	}
+	return req, nil
+}
+
+// checkGroupingLabels returns an error if the provided labels are not a valid
+// grouping key, following the same rules as the labels in a push URL.
+func checkGroupingLabels(labels map[string]string) error {
+	if labels["job"] == "" {
+		return errors.New("job name is required")
+	}
+	for name := range labels {
+		if !model.LabelNameRE.MatchString(name) || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("improper label name %q", name)
+		}
+	}
+	return nil
+}
+
+// Rename returns an http.Handler that moves a group to another grouping key,
+// keeping its metric families with their push timestamps and its annotations
+// (see storage.WriteRequest). The request body is a JSON object with the
+// grouping labels of the group as "from" and the new grouping labels as "to",
+// e.g. {"from": {"job": "old"}, "to": {"job": "new"}}. The response is
+// http.StatusNotFound if the group does not exist, http.StatusForbidden if it
+// is locked, and http.StatusConflict if there is a group with the new grouping
+// labels already.
+//
+// The returned handler is already instrumented for Prometheus.
+func Rename(ms storage.MetricStore, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"rename",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			req, err := readRenameRequest(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "invalid rename request", "err", err.Error())
+				return
+			}
+			errCh := make(chan error, 1)
+			if err := ms.SubmitWriteRequest(storage.WriteRequest{
+				Labels:    req.From,
+				Timestamp: time.Now(),
+				RenameTo:  req.To,
+				Done:      errCh,
+			}); err != nil {
+				submitFailed(w, err, logger)
+				return
+			}
+			errReceived := false
+			for err := range errCh {
+				if !errReceived {
+					status := http.StatusInternalServerError
+					switch err {
+					case storage.ErrGroupNotFound:
+						status = http.StatusNotFound
+					case storage.ErrGroupLocked:
+						status = http.StatusForbidden
+					case storage.ErrGroupExists:
+						status = http.StatusConflict
+					}
+					http.Error(w, err.Error(), status)
+				}
+				errReceived = true
+			}
+			if !errReceived {
+				level.Info(logger).Log("msg", "metric group renamed", "from", fmt.Sprint(req.From), "to", fmt.Sprint(req.To))
+			}
+		}))
+}
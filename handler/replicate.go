@@ -0,0 +1,84 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// PeerSecretHeader is the header in which a Pushgateway replicating its changes
+// sends the secret shared by all peers.
+const PeerSecretHeader = "X-Pushgateway-Peer-Secret"
+
+// Replicate returns an http.Handler which accepts a single WriteRequest encoded
+// with storage.MarshalWriteRequest, as sent by another Pushgateway replicating
+// its changes, and submits it to the MetricStore. Requests without the provided
+// secret in the PeerSecretHeader are rejected with http.StatusUnauthorized. The
+// request has already been validated by the sending Pushgateway, so samples
+// with timestamps are accepted. Wipes and restores (i.e. WriteRequests with
+// Wipe or Groups set) are rejected with http.StatusForbidden unless adminAPI is
+// true. If the MetricStore reports an error, http.StatusBadRequest is
+// returned. If its write queue is full, http.StatusServiceUnavailable is
+// returned so that the sender retries.
+//
+// The returned handler is already instrumented for Prometheus.
+func Replicate(ms storage.MetricStore, secret string, adminAPI bool, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"replicate",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(PeerSecretHeader)), []byte(secret)) != 1 {
+				http.Error(w, "missing or wrong peer secret", http.StatusUnauthorized)
+				level.Warn(logger).Log("msg", "replicated write request with missing or wrong peer secret", "source", r.RemoteAddr)
+				return
+			}
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			wr, err := storage.UnmarshalWriteRequest(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to decode replicated write request", "source", r.RemoteAddr, "err", err.Error())
+				return
+			}
+			if (wr.Wipe || wr.Groups != nil) && !adminAPI {
+				http.Error(w, "wipes and restores are only accepted with the admin API enabled", http.StatusForbidden)
+				level.Warn(logger).Log("msg", "replicated wipe or restore rejected as the admin API is disabled", "source", r.RemoteAddr)
+				return
+			}
+			wr.AllowTimestamps = true
+			errCh := make(chan error, 1)
+			wr.Done = errCh
+			if err := ms.SubmitWriteRequest(wr); err != nil {
+				submitFailed(w, err, logger)
+				return
+			}
+			errReceived := false
+			for err := range errCh {
+				if !errReceived {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				}
+				level.Warn(logger).Log("msg", "replicated write request rejected", "source", r.RemoteAddr, "err", err.Error())
+				errReceived = true
+			}
+		}))
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestReplicate(t *testing.T) {
+	replicate := func(h http.Handler, secret string, wr storage.WriteRequest) int {
+		b, err := storage.MarshalWriteRequest(wr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "http://example.org/api/v1/replicate", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "" {
+			req.Header.Set(PeerSecretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	push := storage.WriteRequest{
+		Labels:    map[string]string{"job": "job1"},
+		Timestamp: time.Now(),
+	}
+
+	mms := MockMetricStore{}
+	h := Replicate(&mms, "s3cret", false, logger)
+	if expected, got := http.StatusUnauthorized, replicate(h, "", push); expected != got {
+		t.Errorf("Wanted status code %v without secret, got %v.", expected, got)
+	}
+	if expected, got := http.StatusUnauthorized, replicate(h, "wrong", push); expected != got {
+		t.Errorf("Wanted status code %v with wrong secret, got %v.", expected, got)
+	}
+	if expected, got := 0, len(mms.writeRequests); expected != got {
+		t.Fatalf("Wanted %d write requests, got %d.", expected, got)
+	}
+	if expected, got := http.StatusOK, replicate(h, "s3cret", push); expected != got {
+		t.Errorf("Wanted status code %v, got %v.", expected, got)
+	}
+	if expected, got := "job1", mms.lastWriteRequest.Labels["job"]; expected != got {
+		t.Errorf("Wanted job %q, got %q.", expected, got)
+	}
+	if !mms.lastWriteRequest.AllowTimestamps {
+		t.Error("Expected replicated write request to allow timestamps.")
+	}
+
+	// Wipes and restores need the admin API.
+	mms = MockMetricStore{}
+	if expected, got := http.StatusForbidden, replicate(h, "s3cret", storage.WriteRequest{Wipe: true}); expected != got {
+		t.Errorf("Wanted status code %v for wipe, got %v.", expected, got)
+	}
+	restore := storage.WriteRequest{Groups: storage.GroupingKeyToMetricGroup{}}
+	if expected, got := http.StatusForbidden, replicate(h, "s3cret", restore); expected != got {
+		t.Errorf("Wanted status code %v for restore, got %v.", expected, got)
+	}
+	if expected, got := 0, len(mms.writeRequests); expected != got {
+		t.Errorf("Wanted %d write requests, got %d.", expected, got)
+	}
+	h = Replicate(&mms, "s3cret", true, logger)
+	if expected, got := http.StatusOK, replicate(h, "s3cret", storage.WriteRequest{Wipe: true}); expected != got {
+		t.Errorf("Wanted status code %v for wipe with admin API, got %v.", expected, got)
+	}
+	if !mms.lastWriteRequest.Wipe {
+		t.Error("Expected wipe to be submitted.")
+	}
+}
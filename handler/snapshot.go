@@ -0,0 +1,87 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Snapshot returns an http.Handler that writes the current content of the
+// MetricStore to the response in the format of the persistence file (see
+// storage.WriteSnapshot).
+//
+// The returned handler is already instrumented for Prometheus.
+func Snapshot(ms storage.MetricStore, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"snapshot",
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", `attachment; filename="pushgateway.snapshot"`)
+			if err := storage.WriteSnapshot(w, ms.GetMetricFamiliesMap()); err != nil {
+				// Too late to change the status code.
+				level.Error(logger).Log("msg", "failed to write snapshot", "err", err.Error())
+			}
+		}))
+}
+
+// Restore returns an http.Handler that replaces the whole content of the
+// MetricStore with the snapshot in the request body, as created by the handler
+// returned by Snapshot. This happens with a single WriteRequest so that the
+// restore is atomic with regard to other write requests. Invalid snapshots are
+// rejected with http.StatusBadRequest.
+//
+// The returned handler is already instrumented for Prometheus.
+func Restore(ms storage.MetricStore, logger log.Logger) http.Handler {
+	return InstrumentWithCounter(
+		"restore",
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := decodeBody(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to decode snapshot", "err", err.Error())
+				return
+			}
+			groups, err := storage.ReadSnapshot(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				level.Debug(logger).Log("msg", "failed to parse snapshot", "err", err.Error())
+				return
+			}
+			errCh := make(chan error, 1)
+			if err := ms.SubmitWriteRequest(storage.WriteRequest{
+				Timestamp: time.Now(),
+				Groups:    groups,
+				Done:      errCh,
+			}); err != nil {
+				submitFailed(w, err, logger)
+				return
+			}
+			errReceived := false
+			for err := range errCh {
+				if !errReceived {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				errReceived = true
+			}
+			if !errReceived {
+				level.Info(logger).Log("msg", "metric store restored", "groups", len(groups))
+			}
+		}))
+}
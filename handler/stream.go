@@ -0,0 +1,137 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net/http"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/codec"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Stream returns an http.Handler for scrape endpoints that exposes the metrics
+// gathered from g together with the metrics in the groups of ms in the provided
+// Shard matched by any of the provided selectors. Unlike a handler created with
+// promhttp.HandlerFor, it encodes the metric families of ms one by one as
+// storage.WalkMetricFamilies hands them out, so that the memory needed for a
+// scrape does not grow with the number of stored metrics. The metric families
+// gathered from g and those returned by groupFamilies (if not nil) for the
+// groups in the Shard (both of which are expected to be few) are merged in by
+// name.
+//
+// In exchange, the metric families are not checked for consistency, and an
+// error after the first metric family has been written can only be signaled by
+// cutting the response short. A pushed metric family whose type conflicts with
+// a gathered one of the same name is left out.
+//
+// The format is negotiated like by OpenMetrics, including the _created samples
+// of pushed counters. If attachPushTimes is true, the timestamps of pushed
+// samples are set as by AttachPushTimestamps.
+func Stream(g prometheus.Gatherer, groupFamilies func(storage.GroupingKeyToMetricGroup) []*dto.MetricFamily, ms storage.MetricStore, shard storage.Shard, selectors []storage.Selector, attachPushTimes bool, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gathered, err := g.Gather()
+		if err != nil {
+			level.Error(logger).Log("msg", "error gathering metrics", "err", err)
+			if len(gathered) == 0 {
+				http.Error(w, "An error has occurred while serving metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		format := codec.Negotiate(r.Header, true)
+
+		w.Header().Set("Content-Type", string(format))
+		out := bufio.NewWriter(w)
+		if gzipAccepted(r.Header) {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out.Reset(gz)
+		}
+		defer out.Flush()
+		enc := codec.NewEncoder(out, format)
+
+		// The groups are only needed for the push times, and only those
+		// the metric family has been merged from.
+		write := func(mf *dto.MetricFamily, groups []storage.MetricGroup) error {
+			name := mf.GetName()
+			if attachPushTimes {
+				if times := lastPushTimesOf(groups, name); len(times) > 0 {
+					mf = withTimestamps(mf, times)
+				}
+			}
+			if format == codec.OpenMetrics {
+				return writeOpenMetricsFamily(out, mf, pushTimesOf(groups, name))
+			}
+			return enc.Encode(mf)
+		}
+		addGroupFamilies := func(groups storage.GroupingKeyToMetricGroup) error {
+			if groupFamilies != nil {
+				gathered = append(gathered, groupFamilies(groups)...)
+			}
+			sort.Slice(gathered, func(i, j int) bool {
+				return gathered[i].GetName() < gathered[j].GetName()
+			})
+			return nil
+		}
+		if err := storage.WalkMetricFamilies(ms, shard, selectors, addGroupFamilies, func(mf *dto.MetricFamily, groups []storage.MetricGroup) error {
+			for len(gathered) > 0 && gathered[0].GetName() <= mf.GetName() {
+				next := gathered[0]
+				gathered = gathered[1:]
+				if next.GetName() == mf.GetName() {
+					mf = mergeGathered(next, mf, logger)
+					break
+				}
+				if err := write(next, nil); err != nil {
+					return err
+				}
+			}
+			return write(mf, groups)
+		}); err != nil {
+			level.Error(logger).Log("msg", "error encoding metric family", "err", err)
+			return
+		}
+		for _, mf := range gathered {
+			if err := write(mf, nil); err != nil {
+				level.Error(logger).Log("msg", "error encoding metric family", "metric_family", mf.GetName(), "err", err)
+				return
+			}
+		}
+		if err := enc.Close(); err != nil {
+			level.Error(logger).Log("msg", "error finalizing exposition", "err", err)
+		}
+	})
+}
+
+// mergeGathered returns a metric family with the metrics of both the provided
+// gathered and pushed metric family of the same name, or only the gathered one
+// if their types conflict. Neither is modified.
+func mergeGathered(gathered, pushed *dto.MetricFamily, logger log.Logger) *dto.MetricFamily {
+	if gathered.GetType() != pushed.GetType() {
+		level.Error(logger).Log("msg", "pushed metric family conflicts with metric family of the Pushgateway, leaving it out", "metric_family", pushed.GetName(), "type", pushed.GetType(), "expected_type", gathered.GetType())
+		return gathered
+	}
+	result := *gathered
+	result.Metric = make([]*dto.Metric, 0, len(gathered.Metric)+len(pushed.Metric))
+	result.Metric = append(append(result.Metric, gathered.Metric...), pushed.Metric...)
+	return &result
+}
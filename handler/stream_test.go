@@ -0,0 +1,125 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestStream(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	defer ms.Shutdown()
+	family := func(name string, typ dto.MetricType, v float64, job string) *dto.MetricFamily {
+		m := &dto.Metric{}
+		if job != "" {
+			m.Label = []*dto.LabelPair{
+				{Name: proto.String("instance"), Value: proto.String("")},
+				{Name: proto.String("job"), Value: proto.String(job)},
+			}
+		}
+		switch typ {
+		case dto.MetricType_COUNTER:
+			m.Counter = &dto.Counter{Value: proto.Float64(v)}
+		default:
+			m.Gauge = &dto.Gauge{Value: proto.Float64(v)}
+		}
+		return &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum(), Metric: []*dto.Metric{m}}
+	}
+	for _, job := range []string{"a", "b"} {
+		errCh := make(chan error, 1)
+		ms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:    map[string]string{"job": job},
+			Timestamp: time.Unix(1600000000, 0),
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"requests_total": family("requests_total", dto.MetricType_COUNTER, 3, job),
+				"shared_gauge":   family("shared_gauge", dto.MetricType_GAUGE, 2, job),
+				"conflict":       family("conflict", dto.MetricType_COUNTER, 4, job),
+			},
+			Done: errCh,
+		})
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return []*dto.MetricFamily{
+			family("temperature", dto.MetricType_GAUGE, 21.5, ""),
+			family("shared_gauge", dto.MetricType_GAUGE, 7, ""),
+			family("conflict", dto.MetricType_GAUGE, 1, ""),
+		}, nil
+	})
+	groupFamilies := func(groups storage.GroupingKeyToMetricGroup) []*dto.MetricFamily {
+		return []*dto.MetricFamily{family("groups", dto.MetricType_GAUGE, float64(len(groups)), "")}
+	}
+	selector, err := storage.ParseSelector(`{__name__=~"requests_total|shared_gauge|conflict"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrape := func(shard storage.Shard, accept string) string {
+		req, err := http.NewRequest("GET", "http://example.org/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		Stream(g, groupFamilies, ms, shard, []storage.Selector{selector}, false, logger).ServeHTTP(w, req)
+		if expected, got := http.StatusOK, w.Code; expected != got {
+			t.Fatalf("Wanted status code %v, got %v.", expected, got)
+		}
+		return w.Body.String()
+	}
+
+	// The conflicting pushed metric family is left out, the gathered ones
+	// and those for the groups are merged in by name.
+	if expected, got := `# TYPE conflict gauge
+conflict 1
+# TYPE groups gauge
+groups 2
+# TYPE requests_total counter
+requests_total{instance="",job="a"} 3
+requests_total{instance="",job="b"} 3
+# TYPE shared_gauge gauge
+shared_gauge 7
+shared_gauge{instance="",job="a"} 2
+shared_gauge{instance="",job="b"} 2
+# TYPE temperature gauge
+temperature 21.5
+`, scrape(storage.Shard{}, "text/plain"); expected != got {
+		t.Errorf("Wanted body\n%s\ngot\n%s", expected, got)
+	}
+
+	got := scrape(storage.Shard{}, "application/openmetrics-text; version=0.0.1")
+	if !strings.Contains(got, `requests_created{instance="",job="a"} 1600000000`+"\n") || !strings.HasSuffix(got, "# EOF\n") {
+		t.Errorf("Wanted OpenMetrics body with _created samples, got\n%s", got)
+	}
+
+	// Each pushed series is exposed in exactly one shard.
+	shard1 := scrape(storage.Shard{Index: 1, Count: 2}, "text/plain")
+	shard2 := scrape(storage.Shard{Index: 2, Count: 2}, "text/plain")
+	if expected, got := 2, strings.Count(shard1+shard2, "requests_total{"); expected != got {
+		t.Errorf("Wanted %d requests_total series in both shards, got %d.", expected, got)
+	}
+}
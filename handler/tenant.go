@@ -0,0 +1,150 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"gopkg.in/yaml.v2"
+)
+
+// TenantsSegment is the path component below the route prefix under which the
+// tenants live, e.g. /tenants/team-a/metrics/job/foo for a push to the tenant
+// team-a.
+const TenantsSegment = "tenants"
+
+var tenantIDRE = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// TenantConfig configures one tenant.
+type TenantConfig struct {
+	// The credentials for the tenant. If the tenant has neither users nor
+	// tokens, the global authentication (if any) applies to it.
+	AuthConfig `yaml:",inline"`
+	// Limits restrict the metric store of the tenant. A zero value means
+	// that the corresponding global limit applies.
+	Limits TenantLimits `yaml:"limits"`
+}
+
+// TenantLimits are the per-tenant equivalents of the storage limit flags. They
+// also make up the limits section of the config file.
+type TenantLimits struct {
+	MaxGroups           int  `yaml:"max_groups"`
+	MaxFamiliesPerGroup int  `yaml:"max_families_per_group"`
+	MaxSamples          int  `yaml:"max_samples"`
+	MaxSeriesPerGroup   int  `yaml:"max_series_per_group"`
+	MaxLabelsPerMetric  int  `yaml:"max_labels_per_metric"`
+	MaxLabelValueLength int  `yaml:"max_label_value_length"`
+	Truncate            bool `yaml:"truncate"`
+}
+
+// TenantsConfig is the content of the file provided with --tenancy.file.
+type TenantsConfig struct {
+	// Tenants maps tenant IDs to their configuration.
+	Tenants map[string]*TenantConfig `yaml:"tenants"`
+}
+
+// LoadTenantsFile reads and validates a TenantsConfig from the provided YAML
+// file. Tenant IDs may only contain letters, digits, '_', and '-'.
+func LoadTenantsFile(file string) (*TenantsConfig, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &TenantsConfig{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse tenants file %q: %v", file, err)
+	}
+	if err := cfg.validate(fmt.Sprintf("tenants file %q", file)); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate returns an error if the TenantsConfig configures no tenants or an
+// invalid one. Tenants without settings get an empty TenantConfig. The source
+// (e.g. `tenants file "tenants.yml"`) is only used for error messages.
+func (cfg *TenantsConfig) validate(source string) error {
+	if len(cfg.Tenants) == 0 {
+		return fmt.Errorf("%s configures no tenants", source)
+	}
+	for id, tc := range cfg.Tenants {
+		if !tenantIDRE.MatchString(id) {
+			return fmt.Errorf("invalid tenant ID %q in %s", id, source)
+		}
+		if tc == nil {
+			cfg.Tenants[id] = &TenantConfig{}
+			continue
+		}
+		if err := tc.checkCredentials(fmt.Sprintf("tenant %q in %s", id, source)); err != nil {
+			return err
+		}
+		if err := tc.Limits.validate(); err != nil {
+			return fmt.Errorf("%v for tenant %q in %s", err, id, source)
+		}
+	}
+	return nil
+}
+
+// validate returns an error if any of the limits is negative.
+func (l TenantLimits) validate() error {
+	if l.MaxGroups < 0 || l.MaxFamiliesPerGroup < 0 || l.MaxSamples < 0 ||
+		l.MaxSeriesPerGroup < 0 || l.MaxLabelsPerMetric < 0 || l.MaxLabelValueLength < 0 {
+		return errors.New("negative limit")
+	}
+	return nil
+}
+
+// TenantPath returns the path below which the tenant with the provided ID
+// lives.
+func TenantPath(routePrefix, id string) string {
+	return strings.TrimRight(routePrefix, "/") + "/" + TenantsSegment + "/" + id
+}
+
+// AuthenticateTenants returns a handler that requires authentication with the
+// credentials of a tenant for requests below the path of that tenant before
+// passing them on to next. Within the tenant path, the same rules as for
+// Authenticate apply. Requests for tenants without credentials and all other
+// requests are passed on to fallback instead, which typically applies the
+// global authentication.
+func AuthenticateTenants(
+	cfg *TenantsConfig,
+	routePrefix string,
+	next, fallback http.Handler,
+	logger log.Logger,
+) http.Handler {
+	tenantsPath := TenantPath(routePrefix, "")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, tenantsPath) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		id := strings.SplitN(strings.TrimPrefix(r.URL.Path, tenantsPath), "/", 2)[0]
+		tc, ok := cfg.Tenants[id]
+		if !ok || !tc.hasCredentials() {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		if !tc.protects(r, routePrefix) || tc.authenticated(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tc.reject(w, r, logger)
+	})
+}
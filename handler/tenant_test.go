@@ -0,0 +1,117 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadTenantsFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "handler.TestLoadTenantsFile.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	scenarios := map[string]struct {
+		content string
+		valid   bool
+	}{
+		"valid": {
+			content: "tenants:\n  team-a:\n    bearer_tokens: [a]\n    limits:\n      max_groups: 10\n  team_b:\n",
+			valid:   true,
+		},
+		"no tenants": {
+			content: "tenants: {}\n",
+		},
+		"invalid ID": {
+			content: "tenants:\n  team/a:\n",
+		},
+		"empty token": {
+			content: "tenants:\n  team-a:\n    bearer_tokens: ['']\n",
+		},
+		"negative limit": {
+			content: "tenants:\n  team-a:\n    limits:\n      max_samples: -1\n",
+		},
+		"unknown field": {
+			content: "tenants:\n  team-a:\n    max_groups: 10\n",
+		},
+	}
+	for name, s := range scenarios {
+		file := path.Join(tempDir, "tenants.yml")
+		if err := ioutil.WriteFile(file, []byte(s.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadTenantsFile(file)
+		if expected, got := s.valid, err == nil; expected != got {
+			t.Errorf("%s: Wanted valid=%v, got error %v.", name, expected, err)
+		}
+		if err != nil {
+			continue
+		}
+		if cfg.Tenants["team_b"] == nil {
+			t.Errorf("%s: Wanted empty config for tenant without settings.", name)
+		}
+		if expected, got := 10, cfg.Tenants["team-a"].Limits.MaxGroups; expected != got {
+			t.Errorf("%s: Wanted max_groups %d, got %d.", name, expected, got)
+		}
+	}
+}
+
+func TestAuthenticateTenants(t *testing.T) {
+	cfg := &TenantsConfig{Tenants: map[string]*TenantConfig{
+		"a": {AuthConfig: AuthConfig{BearerTokens: []string{"token-a"}, ProtectMetrics: true}},
+		"b": {},
+	}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	// The fallback stands in for the global authentication.
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := AuthenticateTenants(cfg, "/prefix", next, fallback, logger)
+
+	for i, s := range []struct {
+		method, path, token string
+		code                int
+	}{
+		{method: "PUT", path: "/prefix/metrics/job/foo", code: http.StatusTeapot},
+		{method: "PUT", path: "/prefix/tenants/a/metrics/job/foo", code: http.StatusUnauthorized},
+		{method: "PUT", path: "/prefix/tenants/a/metrics/job/foo", token: "token-a", code: http.StatusAccepted},
+		{method: "PUT", path: "/prefix/tenants/a/metrics/job/foo", token: "token-b", code: http.StatusUnauthorized},
+		{method: "GET", path: "/prefix/tenants/a/metrics", code: http.StatusUnauthorized},
+		{method: "GET", path: "/prefix/tenants/a/metrics", token: "token-a", code: http.StatusAccepted},
+		{method: "PUT", path: "/prefix/tenants/b/metrics/job/foo", code: http.StatusTeapot},
+		{method: "PUT", path: "/prefix/tenants/c/metrics/job/foo", code: http.StatusTeapot},
+	} {
+		req, err := http.NewRequest(s.method, "http://example.org"+s.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if expected, got := s.code, w.Code; expected != got {
+			t.Errorf("%d. %s %s: Wanted status code %d, got %d.", i, s.method, s.path, expected, got)
+		}
+	}
+}
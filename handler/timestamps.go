@@ -0,0 +1,109 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"time"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// AttachPushTimestamps returns a Gatherer that gathers from g and sets the
+// timestamp of each pushed sample to the time of the last successful push to
+// its group, so that Prometheus stops returning samples that have not been
+// refreshed for longer than its lookback delta. Samples pushed with an
+// explicit timestamp keep it. The groups and their push times are looked up in
+// ms, whose metrics are expected to be included in g. All other metrics are
+// passed through unchanged.
+func AttachPushTimestamps(g prometheus.Gatherer, ms storage.MetricStore) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		times := lastPushTimes(ms.GetMetricFamiliesMap())
+		mfs, err := g.Gather()
+		for i, mf := range mfs {
+			if ts, ok := times[mf.GetName()]; ok {
+				mfs[i] = withTimestamps(mf, ts)
+			}
+		}
+		return mfs, err
+	})
+}
+
+// lastPushTimes returns the time of the last successful push of the group of
+// each pushed metric, keyed by metric family name and then by the signature of
+// the labels of each metric. Groups without a successful push are left out.
+func lastPushTimes(groups storage.GroupingKeyToMetricGroup) map[string]map[uint64]time.Time {
+	result := map[string]map[uint64]time.Time{}
+	for _, group := range groups {
+		pushTime := group.LastPushTime()
+		if pushTime.IsZero() {
+			continue
+		}
+		for name, tmf := range group.Metrics {
+			times, ok := result[name]
+			if !ok {
+				times = map[uint64]time.Time{}
+				result[name] = times
+			}
+			for _, m := range tmf.GetMetricFamily().GetMetric() {
+				times[labelsSignature(m)] = pushTime
+			}
+		}
+	}
+	return result
+}
+
+// lastPushTimesOf returns what lastPushTimes would return for the metric family
+// with the provided name in the provided groups, or nil if there is none.
+func lastPushTimesOf(groups []storage.MetricGroup, name string) map[uint64]time.Time {
+	var result map[uint64]time.Time
+	for _, group := range groups {
+		tmf, ok := group.Metrics[name]
+		pushTime := group.LastPushTime()
+		if !ok || pushTime.IsZero() {
+			continue
+		}
+		if result == nil {
+			result = map[uint64]time.Time{}
+		}
+		for _, m := range tmf.GetMetricFamily().GetMetric() {
+			result[labelsSignature(m)] = pushTime
+		}
+	}
+	return result
+}
+
+// withTimestamps returns a copy of mf with the timestamps in times set on all
+// metrics that have none yet. The metrics in mf are owned by the MetricStore,
+// so mf is copied as far as needed.
+func withTimestamps(mf *dto.MetricFamily, times map[uint64]time.Time) *dto.MetricFamily {
+	result := *mf
+	result.Metric = make([]*dto.Metric, len(mf.Metric))
+	for i, m := range mf.Metric {
+		t, ok := times[labelsSignature(m)]
+		if !ok || m.TimestampMs != nil {
+			result.Metric[i] = m
+			continue
+		}
+		mc := *m
+		mc.TimestampMs = proto.Int64(t.UnixNano() / int64(time.Millisecond))
+		result.Metric[i] = &mc
+	}
+	return &result
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+	"github.com/prometheus/pushgateway/tracing"
+)
+
+// Trace returns a handler that records a server span (see package tracing) for
+// every push (PUT and POST below pushPath), deletion (DELETE below pushPath),
+// and scrape (GET of metricsPath) and passes all requests on to next. A valid
+// traceparent header of the request makes the span a child of the client's
+// span. The span covers everything next does, so to include the time spent in
+// authentication, rate limiting, etc., the Trace handler has to be in front of
+// those handlers.
+func Trace(pushPath, metricsPath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		switch {
+		case strings.HasPrefix(r.URL.Path, pushPath+"/") && (r.Method == http.MethodPut || r.Method == http.MethodPost):
+			name = "push"
+		case strings.HasPrefix(r.URL.Path, pushPath+"/") && r.Method == http.MethodDelete:
+			name = "delete"
+		case r.URL.Path == metricsPath && r.Method == http.MethodGet:
+			name = "scrape"
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if sc, err := tracing.ParseTraceparent(r.Header.Get(tracing.TraceparentHeader)); err == nil {
+			ctx = tracing.ContextWithRemoteSpanContext(ctx, sc)
+		}
+		ctx, span := tracing.Start(ctx, name, tracing.SpanKindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer span.End()
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("net.peer.addr", r.RemoteAddr)
+		if ua := r.UserAgent(); ua != "" {
+			span.SetAttribute("http.user_agent", ua)
+		}
+
+		tw := &traceResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(tw, r.WithContext(ctx))
+		span.SetAttribute("http.status_code", tw.status)
+		if tw.status >= 400 {
+			span.SetError(fmt.Errorf("%d %s", tw.status, http.StatusText(tw.status)))
+		}
+	})
+}
+
+// traceGroup adds the grouping labels and the pushed metric families (if any)
+// to the span of the request, if it is traced.
+func traceGroup(r *http.Request, labels map[string]string, metricFamilies map[string]*dto.MetricFamily) {
+	span := tracing.SpanFromContext(r.Context())
+	if span == nil {
+		return
+	}
+	for name, value := range labels {
+		span.SetAttribute("pushgateway.group."+name, value)
+	}
+	if metricFamilies == nil {
+		return
+	}
+	samples := 0
+	for _, mf := range metricFamilies {
+		samples += storage.NumSamples(mf)
+	}
+	span.SetAttribute("pushgateway.metric_families", len(metricFamilies))
+	span.SetAttribute("pushgateway.samples", samples)
+}
+
+// traceResponseWriter records the status code of the response.
+type traceResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (tw *traceResponseWriter) WriteHeader(code int) {
+	if !tw.wroteHeader {
+		tw.status = code
+		tw.wroteHeader = true
+	}
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *traceResponseWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
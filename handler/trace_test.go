@@ -0,0 +1,71 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/pushgateway/tracing"
+)
+
+func TestTrace(t *testing.T) {
+	e, err := tracing.NewExporter("http://127.0.0.1:1/v1/traces", "pushgateway", "test", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Shutdown()
+	tracing.SetTracer(tracing.NewTracer(e, 1))
+	defer tracing.SetTracer(nil)
+
+	var span *tracing.Span
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span = tracing.SpanFromContext(r.Context())
+		traceGroup(r, map[string]string{"job": "foo"}, nil)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	h := Trace("/metrics", "/metrics", next)
+
+	scenarios := []struct {
+		method, path string
+		traced       bool
+	}{
+		{http.MethodPut, "/metrics/job/foo", true},
+		{http.MethodPost, "/metrics/job/foo", true},
+		{http.MethodDelete, "/metrics/job/foo", true},
+		{http.MethodGet, "/metrics", true},
+		{http.MethodGet, "/metrics/job/foo", false},
+		{http.MethodPut, "/api/v1/admin/wipe", false},
+	}
+	for _, s := range scenarios {
+		span = nil
+		req := httptest.NewRequest(s.method, s.path, nil)
+		req.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if expected, got := s.traced, span != nil; expected != got {
+			t.Errorf("%s %s: Wanted traced=%v, got %v.", s.method, s.path, expected, got)
+		}
+		if span == nil {
+			continue
+		}
+		if expected, got := "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().Traceparent()[3:35]; expected != got {
+			t.Errorf("%s %s: Wanted trace ID %s, got %s.", s.method, s.path, expected, got)
+		}
+		if expected, got := http.StatusAccepted, w.Code; expected != got {
+			t.Errorf("%s %s: Wanted status code %v, got %v.", s.method, s.path, expected, got)
+		}
+	}
+}
@@ -23,7 +23,9 @@ import (
 	"github.com/prometheus/pushgateway/storage"
 )
 
-// WipeMetricStore deletes all the metrics in MetricStore.
+// WipeMetricStore deletes all the metrics in MetricStore. This happens with a
+// single WriteRequest so that the wipe is atomic with regard to other write
+// requests. The MetricStore removes its persistence file in the same step.
 //
 // The returned handler is already instrumented for Prometheus.
 func WipeMetricStore(
@@ -33,15 +35,14 @@ func WipeMetricStore(
 	return InstrumentWithCounter(
 		"wipe",
 		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-			w.WriteHeader(http.StatusAccepted)
 			level.Debug(logger).Log("msg", "start wiping metric store")
-			// Delete all metric groups by sending write requests with MetricFamilies equal to nil.
-			for _, group := range ms.GetMetricFamiliesMap() {
-				ms.SubmitWriteRequest(storage.WriteRequest{
-					Labels:    group.Labels,
-					Timestamp: time.Now(),
-				})
+			if err := ms.SubmitWriteRequest(storage.WriteRequest{
+				Timestamp: time.Now(),
+				Wipe:      true,
+			}); err != nil {
+				submitFailed(w, err, logger)
+				return
 			}
-
+			w.WriteHeader(http.StatusAccepted)
 		}))
 }
@@ -0,0 +1,275 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package influxdb converts points in the InfluxDB line protocol into metric
+// families.
+package influxdb
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/ingest"
+)
+
+// Group is the result of converting all points with the same grouping labels.
+type Group struct {
+	Labels         map[string]string
+	MetricFamilies map[string]*dto.MetricFamily
+}
+
+// point is a single line of the line protocol, without its timestamp.
+type point struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]float64 // String fields are left out.
+}
+
+// Convert parses the provided points in the line protocol and converts them
+// into metric families, grouped by the grouping labels made up of the provided
+// job label and the tags with the provided names (if present).
+//
+// Every numeric or boolean field becomes a gauge, named after the measurement
+// and the field joined by '_' (or only after the measurement if the field is
+// named "value"), with all characters invalid in Prometheus names replaced by
+// '_'. Booleans become 1 or 0. String fields are ignored. The remaining tags
+// become labels, with the names of grouping labels (including the instance
+// label) prefixed with "exported_". If a series occurs more than once, the last
+// value wins. Timestamps are discarded.
+//
+// Lines that are empty or start with '#' are skipped. Any other line that
+// cannot be parsed makes Convert fail.
+func Convert(b []byte, job string, groupingTags []string) ([]Group, error) {
+	isGroupingTag := make(map[string]bool, len(groupingTags))
+	for _, tag := range groupingTags {
+		isGroupingTag[tag] = true
+	}
+	groups := map[string]*Group{}
+	var order []string // Group signatures in order of appearance.
+	series := map[string]*dto.Metric{}
+
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+
+		grouping := map[string]string{string(model.JobLabel): job}
+		labels := map[string]string{}
+		for name, value := range p.tags {
+			if isGroupingTag[name] {
+				grouping[ingest.LabelName(name)] = value
+			}
+		}
+		for name, value := range p.tags {
+			if isGroupingTag[name] {
+				continue
+			}
+			name = ingest.LabelName(name)
+			if _, ok := grouping[name]; ok || name == string(model.InstanceLabel) {
+				name = "exported_" + name
+			} else if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				name = "tag" + name // Reserved otherwise.
+			}
+			labels[name] = value
+		}
+
+		key := ingest.Signature(grouping)
+		g, ok := groups[key]
+		if !ok {
+			g = &Group{Labels: grouping, MetricFamilies: map[string]*dto.MetricFamily{}}
+			groups[key] = g
+			order = append(order, key)
+		}
+		for field, value := range p.fields {
+			name := p.measurement
+			if field != "value" {
+				name += "_" + field
+			}
+			name = ingest.MetricName(name)
+			seriesKey := key + name + "{" + ingest.Signature(labels) + "}"
+			if m, ok := series[seriesKey]; ok {
+				m.Gauge.Value = proto.Float64(value)
+				continue
+			}
+			mf, ok := g.MetricFamilies[name]
+			if !ok {
+				mf = &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_GAUGE.Enum()}
+				g.MetricFamilies[name] = mf
+			}
+			m := &dto.Metric{Label: ingest.LabelPairs(labels), Gauge: &dto.Gauge{Value: proto.Float64(value)}}
+			mf.Metric = append(mf.Metric, m)
+			series[seriesKey] = m
+		}
+	}
+
+	result := make([]Group, 0, len(order))
+	for _, key := range order {
+		result = append(result, *groups[key])
+	}
+	return result, nil
+}
+
+// parseLine parses a line of the form
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+//
+// with commas, spaces, and (except in the measurement) equal signs escaped by a
+// backslash, and string field values in double quotes.
+func parseLine(line string) (point, error) {
+	i := index(line, ' ', false)
+	if i == len(line) {
+		return point{}, errors.New("missing fields")
+	}
+	seriesKey, rest := line[:i], strings.TrimLeft(line[i:], " ")
+	i = index(rest, ' ', true)
+	fields, timestamp := rest[:i], strings.TrimSpace(rest[i:])
+	if timestamp != "" {
+		if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+			return point{}, fmt.Errorf("invalid timestamp %q", timestamp)
+		}
+	}
+
+	parts := split(seriesKey, ',', false)
+	p := point{
+		measurement: unescape(parts[0]),
+		tags:        make(map[string]string, len(parts)-1),
+		fields:      map[string]float64{},
+	}
+	if p.measurement == "" {
+		return point{}, errors.New("missing measurement")
+	}
+	for _, tag := range parts[1:] {
+		name, value, err := splitPair(tag)
+		if err != nil {
+			return point{}, fmt.Errorf("invalid tag %q: %v", tag, err)
+		}
+		p.tags[name] = value
+	}
+	if fields == "" {
+		return point{}, errors.New("missing fields")
+	}
+	for _, field := range split(fields, ',', true) {
+		i := index(field, '=', false)
+		if i == 0 || i == len(field) {
+			return point{}, fmt.Errorf("invalid field %q", field)
+		}
+		name, raw := unescape(field[:i]), field[i+1:]
+		value, numeric, err := parseFieldValue(raw)
+		if err != nil {
+			return point{}, fmt.Errorf("invalid value of field %q: %v", name, err)
+		}
+		if numeric {
+			p.fields[name] = value
+		}
+	}
+	return p, nil
+}
+
+// parseFieldValue returns the provided field value as a float64 and true. For a
+// string value, it returns false.
+func parseFieldValue(s string) (float64, bool, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	switch {
+	case s == "":
+		return 0, false, errors.New("empty value")
+	case s[0] == '"':
+		if len(s) < 2 || s[len(s)-1] != '"' || index(s[1:len(s)-1], '"', false) < len(s)-2 {
+			return 0, false, fmt.Errorf("unterminated string %s", s)
+		}
+		return 0, false, nil
+	case s[len(s)-1] == 'i':
+		x, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(x), true, err
+	case s[len(s)-1] == 'u':
+		x, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(x), true, err
+	}
+	x, err := strconv.ParseFloat(s, 64)
+	return x, true, err
+}
+
+// splitPair splits the provided tag into its unescaped name and value.
+func splitPair(s string) (string, string, error) {
+	i := index(s, '=', false)
+	if i == len(s) {
+		return "", "", errors.New("missing '='")
+	}
+	name, value := unescape(s[:i]), unescape(s[i+1:])
+	if name == "" || value == "" {
+		return "", "", errors.New("empty name or value")
+	}
+	return name, value, nil
+}
+
+// index returns the index of the first occurrence of c in s that is not escaped
+// by a backslash and, if quoted is true, not within double quotes, or len(s) if
+// there is none.
+func index(s string, c byte, quoted bool) int {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == c && !inQuotes:
+			return i
+		}
+	}
+	return len(s)
+}
+
+// split splits s at every occurrence of sep found by index.
+func split(s string, sep byte, quoted bool) []string {
+	var parts []string
+	for {
+		i := index(s, sep, quoted)
+		parts = append(parts, s[:i])
+		if i == len(s) {
+			return parts
+		}
+		s = s[i+1:]
+	}
+}
+
+// unescape removes the backslashes escaping commas, spaces, and equal signs.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(", =", s[i+1]) >= 0 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package influxdb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseLine(t *testing.T) {
+	for line, s := range map[string]struct {
+		want    point
+		wantErr bool
+	}{
+		"cpu,host=a usage=0.5,count=3i 1600000000000000000": {want: point{
+			measurement: "cpu",
+			tags:        map[string]string{"host": "a"},
+			fields:      map[string]float64{"usage": 0.5, "count": 3},
+		}},
+		`disk\ io,path=C:\\,mount\ point=/x\,y up=t,bytes=7u,label="a, b=c \"d\""`: {want: point{
+			measurement: "disk io",
+			tags:        map[string]string{"path": `C:\\`, "mount point": "/x,y"},
+			fields:      map[string]float64{"up": 1, "bytes": 7},
+		}},
+		"temp value=-1e3":           {want: point{measurement: "temp", tags: map[string]string{}, fields: map[string]float64{"value": -1000}}},
+		"temp":                      {wantErr: true},
+		"temp,host value=1":         {wantErr: true},
+		"temp,host= value=1":        {wantErr: true},
+		"temp value=":               {wantErr: true},
+		"temp value=x":              {wantErr: true},
+		"temp value=1.5i":           {wantErr: true},
+		`temp value="unterminated`:  {wantErr: true},
+		"temp value=1 yesterday":    {wantErr: true},
+		",host=a value=1":           {wantErr: true},
+		"temp =1":                   {wantErr: true},
+		"temp value=1,other=2 3 4 ": {wantErr: true},
+	} {
+		got, err := parseLine(line)
+		if s.wantErr {
+			if err == nil {
+				t.Errorf("%q: Expected error, got %+v.", line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %v", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(s.want, got) {
+			t.Errorf("%q: Wanted %+v, got %+v.", line, s.want, got)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	groups, err := Convert([]byte(`
+# Comment.
+cpu,host=a,core=0,instance=x usage=0.5 1600000000000000000
+cpu,host=a,core=0,instance=x usage=0.7 1600000010000000000
+cpu,host=b,core=0 usage=0.1
+mem,host=a value=1024i,state="ok"
+`), "influxdb", []string{"host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(groups); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+	a := groups[0]
+	if expected, got := map[string]string{"job": "influxdb", "host": "a"}, a.Labels; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted grouping labels %v, got %v.", expected, got)
+	}
+	want := map[string]*dto.MetricFamily{
+		"cpu_usage": {
+			Name: proto.String("cpu_usage"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("core"), Value: proto.String("0")},
+					{Name: proto.String("exported_instance"), Value: proto.String("x")},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(0.7)},
+			}},
+		},
+		"mem": {
+			Name: proto.String("mem"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{},
+				Gauge: &dto.Gauge{Value: proto.Float64(1024)},
+			}},
+		},
+	}
+	if expected, got := len(want), len(a.MetricFamilies); expected != got {
+		t.Errorf("Wanted %d metric families, got %d.", expected, got)
+	}
+	for name, mf := range want {
+		if got := a.MetricFamilies[name]; !proto.Equal(mf, got) {
+			t.Errorf("Wanted %s, got %s.", mf, got)
+		}
+	}
+	if expected, got := map[string]string{"job": "influxdb", "host": "b"}, groups[1].Labels; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted grouping labels %v, got %v.", expected, got)
+	}
+
+	if _, err := Convert([]byte("cpu usage=1\ncpu\n"), "influxdb", nil); err == nil || err.Error() != "line 2: missing fields" {
+		t.Errorf("Wanted error for line 2, got %v.", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Formats a persistence file can be converted to with the inspect command.
+const (
+	formatCurrent = "current"
+	formatLegacy  = "legacy"
+)
+
+// inspectOptions configures runInspect.
+type inspectOptions struct {
+	// format is the format to rewrite the file in. If empty, the file is
+	// only rewritten if groups are deleted, keeping its format.
+	format string
+	// compression is the Compression to rewrite the file with. If empty,
+	// the file keeps its compression unless rewritten in the legacy
+	// format, which is never compressed.
+	compression string
+	// deleteGroups are the grouping labels of the groups to delete, in the
+	// form of the push URL path.
+	deleteGroups []string
+	// output is the file to write to. If empty, the inspected file is
+	// overwritten.
+	output        string
+	encryptionKey string
+}
+
+// runInspect lists the groups and metric families in the persistence file with
+// the provided name and modifies the file as configured by o. A corrupted file
+// is an error unless it is rewritten, which drops the corrupted records.
+func runInspect(out io.Writer, file string, o inspectOptions) error {
+	pf, err := storage.ReadPersistenceFile(file, o.encryptionKey)
+	if err != nil {
+		return fmt.Errorf("could not read persistence file %q: %v", file, err)
+	}
+	printPersistenceFile(out, pf)
+
+	for _, g := range o.deleteGroups {
+		if !strings.HasPrefix(g, "/") {
+			g = "/" + g
+		}
+		labels, err := handler.ParseGroupingPath(g)
+		if err != nil {
+			return fmt.Errorf("invalid group %q: %v", g, err)
+		}
+		if !pf.DeleteGroup(labels) {
+			return fmt.Errorf("group %s not found", groupString(labels))
+		}
+		fmt.Fprintf(out, "\ndeleted group %s\n", groupString(labels))
+	}
+
+	rewrite := o.format != "" || o.compression != "" || len(o.deleteGroups) > 0 || o.output != ""
+	if !rewrite {
+		if pf.Corruptions > 0 {
+			return fmt.Errorf("persistence file %q is corrupted, rewrite it with --format=%s to drop the corrupted records", file, formatCurrent)
+		}
+		return nil
+	}
+	switch o.format {
+	case formatCurrent:
+		pf.Legacy = false
+	case formatLegacy:
+		pf.Legacy = true
+		pf.Compression = storage.CompressionNone
+	}
+	if o.compression != "" {
+		pf.Compression = storage.Compression(o.compression)
+	}
+	if o.output == "" {
+		o.output = file
+	}
+	if err := storage.WritePersistenceFile(o.output, pf, o.encryptionKey); err != nil {
+		return fmt.Errorf("could not write persistence file %q: %v", o.output, err)
+	}
+	fmt.Fprintf(out, "\nwrote %d groups to %q\n", len(pf.Groups), o.output)
+	return nil
+}
+
+func printPersistenceFile(out io.Writer, pf *storage.PersistenceFile) {
+	format := formatCurrent
+	if pf.Legacy {
+		format = formatLegacy + " (gob)"
+	}
+	if pf.Compression != storage.CompressionNone {
+		format += " (" + string(pf.Compression) + ")"
+	}
+	if pf.Encrypted {
+		format += " (encrypted)"
+	}
+	fmt.Fprintf(out, "format:        %s\n", format)
+	if !pf.Legacy {
+		fmt.Fprintf(out, "last sequence: %d\n", pf.LastSequence)
+		fmt.Fprintf(out, "corruptions:   %d\n", pf.Corruptions)
+	}
+	if pf.Deltas > 0 {
+		fmt.Fprintf(out, "delta files:   %d\n", pf.Deltas)
+	}
+	fmt.Fprintf(out, "groups:        %d\n", len(pf.Groups))
+
+	groups := make([]storage.MetricGroup, 0, len(pf.Groups))
+	for _, g := range pf.Groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groupString(groups[i].Labels) < groupString(groups[j].Labels)
+	})
+	for _, g := range groups {
+		lastPush := "never"
+		if t := g.LastPushTime(); !t.IsZero() {
+			lastPush = t.UTC().Format(time.RFC3339)
+		}
+		locked := ""
+		if g.Locked {
+			locked = ", locked"
+		}
+		fmt.Fprintf(out, "\n%s last push %s%s\n", groupString(g.Labels), lastPush, locked)
+
+		names := make([]string, 0, len(g.Metrics))
+		for name := range g.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			mf := g.Metrics[name].GetMetricFamily()
+			fmt.Fprintf(
+				out, "  %s %s, %d metrics\n",
+				name, strings.ToLower(mf.GetType().String()), len(mf.GetMetric()),
+			)
+		}
+	}
+}
+
+func groupString(labels map[string]string) string {
+	ls := make(model.LabelSet, len(labels))
+	for ln, lv := range labels {
+		ls[model.LabelName(ln)] = model.LabelValue(lv)
+	}
+	return ls.String()
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestInspect(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestInspect.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := path.Join(tempDir, "persistence")
+
+	ms := storage.NewDiskMetricStore(file, time.Hour, nil, log.NewNopLogger())
+	pushTime := time.Unix(1600000000, 0)
+	for _, job := range []string{"a", "b"} {
+		errCh := make(chan error, 1)
+		ms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:    map[string]string{"job": job},
+			Timestamp: pushTime,
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"some_metric": {
+					Name: proto.String("some_metric"),
+					Type: dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{{
+						Label: []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(job)}},
+						Gauge: &dto.Gauge{Value: proto.Float64(1)},
+					}},
+				},
+			},
+			Done: errCh,
+		})
+		for err := range errCh {
+			t.Fatal(err)
+		}
+	}
+	if err := ms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runInspect(&out, file, inspectOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"format:        current\n",
+		"groups:        2\n",
+		`{job="a"} last push 2020-09-13T12:26:40Z` + "\n  push_failure_time_seconds gauge, 1 metrics\n  push_time_seconds gauge, 1 metrics\n  some_metric gauge, 1 metrics\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Wanted output to contain %q, got:\n%s", expected, out.String())
+		}
+	}
+
+	// Convert to the legacy format, deleting a group.
+	if err := runInspect(&out, file, inspectOptions{format: formatLegacy, deleteGroups: []string{"job/a"}}); err != nil {
+		t.Fatal(err)
+	}
+	pf, err := storage.ReadPersistenceFile(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pf.Legacy {
+		t.Error("Expected persistence file in the legacy format.")
+	}
+	if expected, got := 1, len(pf.Groups); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+	if err := runInspect(&out, file, inspectOptions{deleteGroups: []string{"job/a"}}); err == nil {
+		t.Error("Expected error deleting a missing group.")
+	}
+
+	// Convert back, encrypting into another file.
+	encrypted := file + ".encrypted"
+	if err := runInspect(&out, file, inspectOptions{format: formatCurrent, output: encrypted, encryptionKey: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.ReadPersistenceFile(encrypted, ""); err == nil {
+		t.Error("Expected error reading encrypted file without key.")
+	}
+	if pf, err = storage.ReadPersistenceFile(encrypted, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if pf.Legacy || !pf.Encrypted || len(pf.Groups) != 1 {
+		t.Errorf("Unexpected persistence file: %+v", pf)
+	}
+
+	// Compress into another file. The compression is kept when rewriting.
+	compressed := file + ".gz"
+	if err := runInspect(&out, encrypted, inspectOptions{compression: "gzip", output: compressed, encryptionKey: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runInspect(&out, compressed, inspectOptions{deleteGroups: []string{"job/b"}, encryptionKey: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "format:        current (gzip) (encrypted)\n"; !strings.Contains(out.String(), expected) {
+		t.Errorf("Wanted output to contain %q, got:\n%s", expected, out.String())
+	}
+	if pf, err = storage.ReadPersistenceFile(compressed, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if pf.Compression != storage.CompressionGzip || !pf.Encrypted || len(pf.Groups) != 0 {
+		t.Errorf("Unexpected persistence file: %+v", pf)
+	}
+
+	// Corrupted records are an error unless the file is rewritten.
+	if err := runInspect(&out, file, inspectOptions{format: formatCurrent}); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[len(content)-10] ^= 0xff
+	if err := ioutil.WriteFile(file, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := runInspect(&out, file, inspectOptions{}); err == nil {
+		t.Error("Expected error for corrupted persistence file.")
+	}
+	if err := runInspect(&out, file, inspectOptions{format: formatCurrent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runInspect(&out, file, inspectOptions{}); err != nil {
+		t.Error("Unexpected error after repair:", err)
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package codec encodes and decodes metric families in the exposition formats
+// understood by the Pushgateway (protobuf delimited, text, and OpenMetrics) and
+// in the plain protobuf encoding used for persistence and the gRPC API. All
+// formats use dto.MetricFamily as the common intermediate.
+package codec
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+	"github.com/prometheus/common/expfmt"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Format is an exposition format. Its value is the Content-Type to use for it.
+type Format string
+
+// The supported Formats.
+const (
+	ProtoDelim  = Format(expfmt.FmtProtoDelim)
+	Text        = Format(expfmt.FmtText)
+	OpenMetrics = Format(expfmt.FmtOpenMetrics)
+)
+
+// FormatForContentType returns the Format of a body with the provided
+// Content-Type header. Anything not recognized is taken to be in the text
+// format, as the text format has been the default for pushes since forever.
+func FormatForContentType(contentType string) Format {
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return Text
+	}
+	switch {
+	case mediatype == "application/vnd.google.protobuf" &&
+		params["encoding"] == "delimited" &&
+		params["proto"] == "io.prometheus.client.MetricFamily":
+		return ProtoDelim
+	case mediatype == "application/openmetrics-text":
+		return OpenMetrics
+	}
+	return Text
+}
+
+// Negotiate returns the Format to respond with according to the Accept header
+// in h. OpenMetrics is only considered if includeOpenMetrics is true.
+func Negotiate(h http.Header, includeOpenMetrics bool) Format {
+	if includeOpenMetrics {
+		return Format(expfmt.NegotiateIncludingOpenMetrics(h))
+	}
+	return Format(expfmt.Negotiate(h))
+}
+
+// Decoder decodes metric families.
+type Decoder interface {
+	// Decode decodes the next metric family into mf. It returns io.EOF
+	// once there are no metric families left.
+	Decode(mf *dto.MetricFamily) error
+}
+
+// NewDecoder returns a Decoder reading from r in the provided Format. Metric
+// families in the text and OpenMetrics format are only decoded once the input
+// has been read completely, upon the first call of Decode, and are then
+// returned sorted by name.
+func NewDecoder(r io.Reader, format Format) Decoder {
+	switch format {
+	case ProtoDelim:
+		return protoDecoder{r: r}
+	case OpenMetrics:
+		return &parsingDecoder{r: r, parse: parseOpenMetrics}
+	}
+	return &parsingDecoder{r: r, parse: parseText}
+}
+
+// DecodeAll decodes all metric families from r in the provided Format and
+// returns them keyed by name. If there are several metric families of the same
+// name in the protobuf delimited format, the last one wins.
+func DecodeAll(r io.Reader, format Format) (map[string]*dto.MetricFamily, error) {
+	if format == Text {
+		// Avoid the detour via a slice.
+		var parser expfmt.TextParser
+		return parser.TextToMetricFamilies(r)
+	}
+	dec := NewDecoder(r, format)
+	mfs := map[string]*dto.MetricFamily{}
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				return mfs, nil
+			}
+			return nil, err
+		}
+		mfs[mf.GetName()] = mf
+	}
+}
+
+type protoDecoder struct {
+	r io.Reader
+}
+
+func (d protoDecoder) Decode(mf *dto.MetricFamily) error {
+	_, err := pbutil.ReadDelimited(d.r, mf)
+	return err
+}
+
+// parsingDecoder parses the whole input upon the first call of Decode.
+type parsingDecoder struct {
+	r      io.Reader
+	parse  func(io.Reader) ([]*dto.MetricFamily, error)
+	parsed bool
+	mfs    []*dto.MetricFamily
+	err    error
+}
+
+func (d *parsingDecoder) Decode(mf *dto.MetricFamily) error {
+	if !d.parsed {
+		d.mfs, d.err = d.parse(d.r)
+		d.parsed = true
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.mfs) == 0 {
+		return io.EOF
+	}
+	*mf = *d.mfs[0]
+	d.mfs = d.mfs[1:]
+	return nil
+}
+
+func parseText(r io.Reader) ([]*dto.MetricFamily, error) {
+	var parser expfmt.TextParser
+	mfMap, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		return nil, err
+	}
+	mfs := make([]*dto.MetricFamily, 0, len(mfMap))
+	for _, mf := range mfMap {
+		mfs = append(mfs, mf)
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, nil
+}
+
+// Encoder encodes metric families.
+type Encoder interface {
+	// Encode encodes the provided metric family.
+	Encode(mf *dto.MetricFamily) error
+	// Close finishes the encoding, e.g. by writing the "# EOF" line of
+	// the OpenMetrics format. It does not close the underlying writer.
+	Close() error
+}
+
+// NewEncoder returns an Encoder writing to w in the provided Format.
+func NewEncoder(w io.Writer, format Format) Encoder {
+	if format == OpenMetrics {
+		return openMetricsEncoder{w: w}
+	}
+	return expfmtEncoder{enc: expfmt.NewEncoder(w, expfmt.Format(format))}
+}
+
+type expfmtEncoder struct {
+	enc expfmt.Encoder
+}
+
+func (e expfmtEncoder) Encode(mf *dto.MetricFamily) error {
+	return e.enc.Encode(mf)
+}
+
+func (e expfmtEncoder) Close() error {
+	if closer, ok := e.enc.(expfmt.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type openMetricsEncoder struct {
+	w io.Writer
+}
+
+func (e openMetricsEncoder) Encode(mf *dto.MetricFamily) error {
+	_, err := expfmt.MetricFamilyToOpenMetrics(e.w, mf)
+	return err
+}
+
+func (e openMetricsEncoder) Close() error {
+	_, err := expfmt.FinalizeOpenMetrics(e.w)
+	return err
+}
+
+// MarshalMetricFamily returns the protobuf encoding of mf.
+func MarshalMetricFamily(mf *dto.MetricFamily) ([]byte, error) {
+	return proto.Marshal(mf)
+}
+
+// UnmarshalMetricFamily decodes the protobuf encoding of a metric family into
+// mf.
+func UnmarshalMetricFamily(b []byte, mf *dto.MetricFamily) error {
+	return proto.Unmarshal(b, mf)
+}
+
+// MarshalLabelPair returns the protobuf encoding of the label pair with the
+// provided name and value.
+func MarshalLabelPair(name, value string) []byte {
+	// Marshaling a LabelPair cannot fail.
+	b, _ := proto.Marshal(&dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	return b
+}
+
+// UnmarshalLabelPair decodes the protobuf encoding of a label pair and returns
+// its name and value.
+func UnmarshalLabelPair(b []byte) (string, string, error) {
+	lp := &dto.LabelPair{}
+	if err := proto.Unmarshal(b, lp); err != nil {
+		return "", "", err
+	}
+	return lp.GetName(), lp.GetValue(), nil
+}
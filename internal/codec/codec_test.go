@@ -0,0 +1,256 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+var testFamilies = []*dto.MetricFamily{
+	{
+		Name: proto.String("some_counter_total"),
+		Help: proto.String(`A "counter" with\nfunny help.`),
+		Type: dto.MetricType_COUNTER.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("path"), Value: proto.String(`/a"b\c`)}},
+				Counter: &dto.Counter{
+					Value: proto.Float64(42),
+					Exemplar: &dto.Exemplar{
+						Label: []*dto.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+						Value: proto.Float64(1),
+					},
+				},
+			},
+		},
+	},
+	{
+		Name: proto.String("some_gauge"),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{Gauge: &dto.Gauge{Value: proto.Float64(-3.5)}, TimestampMs: proto.Int64(1234567)},
+		},
+	},
+	{
+		Name: proto.String("some_histogram"),
+		Help: proto.String("A histogram."),
+		Type: dto.MetricType_HISTOGRAM.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(5),
+					SampleSum:   proto.Float64(7.5),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(2)},
+						{UpperBound: proto.Float64(5), CumulativeCount: proto.Uint64(4)},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name: proto.String("some_summary"),
+		Type: dto.MetricType_SUMMARY.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{{Name: proto.String("a"), Value: proto.String("x")}},
+				Summary: &dto.Summary{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(1.5),
+					Quantile: []*dto.Quantile{
+						{Quantile: proto.Float64(0.5), Value: proto.Float64(0.25)},
+						{Quantile: proto.Float64(0.99), Value: proto.Float64(1)},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name: proto.String("some_untyped"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{Untyped: &dto.Untyped{Value: proto.Float64(1)}},
+		},
+	},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{ProtoDelim, Text, OpenMetrics} {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, format)
+		for _, mf := range testFamilies {
+			if err := enc.Encode(mf); err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		encoded := buf.String()
+
+		dec := NewDecoder(&buf, format)
+		for i := 0; ; i++ {
+			mf := &dto.MetricFamily{}
+			err := dec.Decode(mf)
+			if err == io.EOF {
+				if i != len(testFamilies) {
+					t.Errorf("%s: Wanted %d metric families, got %d.", format, len(testFamilies), i)
+				}
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v\n%s", format, err, encoded)
+			}
+			expected := testFamilies[i]
+			if format == Text {
+				// The text format knows no exemplars.
+				expected = proto.Clone(expected).(*dto.MetricFamily)
+				for _, m := range expected.Metric {
+					if m.Counter != nil {
+						m.Counter.Exemplar = nil
+					}
+				}
+			}
+			if format != ProtoDelim {
+				// The +Inf bucket is added by the encoder.
+				for _, m := range mf.Metric {
+					if h := m.Histogram; h != nil && len(h.Bucket) > 0 {
+						h.Bucket = h.Bucket[:len(h.Bucket)-1]
+					}
+				}
+			}
+			if !proto.Equal(expected, mf) {
+				t.Errorf("%s: Wanted %s, got %s.", format, expected, mf)
+			}
+		}
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	mfs, err := DecodeAll(strings.NewReader("# TYPE a counter\na_total 1\n# TYPE b info\nb_info{v=\"1\"} 1\n# EOF\n"), OpenMetrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := dto.MetricType_COUNTER, mfs["a_total"].GetType(); expected != got {
+		t.Errorf("Wanted type %s, got %s.", expected, got)
+	}
+	if expected, got := dto.MetricType_GAUGE, mfs["b_info"].GetType(); expected != got {
+		t.Errorf("Wanted type %s, got %s.", expected, got)
+	}
+
+	mfs, err = DecodeAll(strings.NewReader("x 1\ny 2\n"), Text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(mfs); expected != got {
+		t.Errorf("Wanted %d metric families, got %d.", expected, got)
+	}
+}
+
+func TestParseOpenMetrics(t *testing.T) {
+	mfs, err := parseOpenMetrics(strings.NewReader(`# HELP door State of the door.
+# TYPE door stateset
+door{door="open"} 1
+door{door="closed"} 0
+# TYPE requests counter
+# UNIT requests seconds
+requests_total{code="200"} 10 1.5 # {trace_id="a # b"} 0.5 1.25
+requests_created{code="200"} 1000
+requests_total{code="500"} 1
+# EOF
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(mfs); expected != got {
+		t.Fatalf("Wanted %d metric families, got %d.", expected, got)
+	}
+	door, requests := mfs[0], mfs[1]
+	if door.GetName() != "door" || door.GetType() != dto.MetricType_GAUGE || door.GetHelp() != "State of the door." || len(door.Metric) != 2 {
+		t.Errorf("Unexpected StateSet %s.", door)
+	}
+	if requests.GetName() != "requests_total" || len(requests.Metric) != 2 {
+		t.Fatalf("Unexpected counter %s.", requests)
+	}
+	m := requests.Metric[0]
+	if expected, got := int64(1500), m.GetTimestampMs(); expected != got {
+		t.Errorf("Wanted timestamp %d, got %d.", expected, got)
+	}
+	e := m.GetCounter().GetExemplar()
+	if e.GetValue() != 0.5 || e.GetLabel()[0].GetValue() != "a # b" || e.GetTimestamp().GetSeconds() != 1 || e.GetTimestamp().GetNanos() != 250000000 {
+		t.Errorf("Unexpected exemplar %s.", e)
+	}
+
+	for _, s := range []string{
+		"a 1\n",                                   // No # EOF.
+		"a 1\n# EOF\nb 1\n",                       // Content after # EOF.
+		"a 1\n# EOF",                              // No final newline.
+		"a 1\nb 1\na 2\n# EOF\n",                  // Not contiguous.
+		"a 1\na 2\n# EOF\n",                       // Duplicate sample.
+		"# TYPE a gaugehistogram\n# EOF\n",        // Unsupported type.
+		"# TYPE a foo\n# EOF\n",                   // Invalid type.
+		"# a comment\n# EOF\n",                    // Comments are not allowed.
+		"a{b=\"c} 1\n# EOF\n",                     // Unterminated label value.
+		"a{b=\"x\",b=\"y\"} 1\n# EOF\n",           // Duplicate label.
+		"a 1 # {x=\"y\"} 1\n# EOF\n",              // Exemplar on a gauge.
+		"a inf\n# EOF\n",                          // Invalid number.
+		"# TYPE a histogram\na_bucket 1\n# EOF\n", // Missing le label.
+		"# TYPE a counter\na 1\n# EOF\n",          // Counter sample without _total.
+	} {
+		if _, err := parseOpenMetrics(strings.NewReader(s)); err == nil {
+			t.Errorf("%q: Expected error.", s)
+		}
+	}
+}
+
+func TestFormatForContentType(t *testing.T) {
+	for contentType, expected := range map[string]Format{
+		"":           Text,
+		"text/plain": Text,
+		"application/vnd.google.protobuf; encoding=delimited; proto=io.prometheus.client.MetricFamily": ProtoDelim,
+		"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily":                     Text,
+		"application/openmetrics-text; version=0.0.1; charset=utf-8":                                   OpenMetrics,
+	} {
+		if got := FormatForContentType(contentType); expected != got {
+			t.Errorf("%q: Wanted format %s, got %s.", contentType, expected, got)
+		}
+	}
+
+	h := http.Header{"Accept": []string{"application/openmetrics-text; version=0.0.1"}}
+	if expected, got := OpenMetrics, Negotiate(h, true); expected != got {
+		t.Errorf("Wanted format %s, got %s.", expected, got)
+	}
+	if got := Negotiate(h, false); got == OpenMetrics {
+		t.Error("OpenMetrics negotiated although not included.")
+	}
+}
+
+func TestMarshalLabelPair(t *testing.T) {
+	name, value, err := UnmarshalLabelPair(MarshalLabelPair("job", "foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "job" || value != "foo" {
+		t.Errorf("Wanted job=foo, got %s=%s.", name, value)
+	}
+}
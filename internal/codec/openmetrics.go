@@ -0,0 +1,530 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// The metric types of the OpenMetrics format and the dto.MetricType they are
+// decoded into. The suffixes are those of the sample names for each type.
+var openMetricsTypes = map[string]struct {
+	typ      dto.MetricType
+	suffixes []string
+}{
+	"counter":   {dto.MetricType_COUNTER, []string{"_total", "_created"}},
+	"gauge":     {dto.MetricType_GAUGE, []string{""}},
+	"histogram": {dto.MetricType_HISTOGRAM, []string{"_bucket", "_count", "_sum", "_created"}},
+	"summary":   {dto.MetricType_SUMMARY, []string{"", "_count", "_sum", "_created"}},
+	"info":      {dto.MetricType_GAUGE, []string{"_info"}},
+	"stateset":  {dto.MetricType_GAUGE, []string{""}},
+	"unknown":   {dto.MetricType_UNTYPED, []string{""}},
+}
+
+// openMetricsFamily is a metric family in the OpenMetrics format while being
+// parsed.
+type openMetricsFamily struct {
+	name    string // Without any suffix.
+	typ     string // One of the keys of openMetricsTypes.
+	help    *string
+	mf      *dto.MetricFamily // Created with the first sample.
+	metrics map[uint64]*dto.Metric
+	samples map[string]bool // All names and label sets seen so far.
+}
+
+// parseOpenMetrics parses metric families in the OpenMetrics text format, as
+// exposed by Prometheus client libraries. Counters are decoded with the _total
+// suffix of their samples as the metric family name, as in the text format,
+// and info metrics with the _info suffix. Info and StateSet metrics are decoded
+// as gauges. _created samples are dropped, as are UNIT lines. Gauge histograms
+// are not supported.
+func parseOpenMetrics(r io.Reader) ([]*dto.MetricFamily, error) {
+	var (
+		br       = bufio.NewReader(r)
+		families []*openMetricsFamily
+		seen     = map[string]bool{}
+		cur      *openMetricsFamily
+		eof      bool
+	)
+	start := func(name string) (*openMetricsFamily, error) {
+		if seen[name] {
+			return nil, fmt.Errorf("metric family %q is not contiguous", name)
+		}
+		seen[name] = true
+		f := &openMetricsFamily{
+			name:    name,
+			typ:     "unknown",
+			metrics: map[uint64]*dto.Metric{},
+			samples: map[string]bool{},
+		}
+		families = append(families, f)
+		return f, nil
+	}
+
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				return nil, fmt.Errorf("line %d: line not terminated by a newline", lineNum)
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = line[:len(line)-1]
+		if eof {
+			return nil, fmt.Errorf("line %d: unexpected content after # EOF", lineNum)
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) == 3 {
+				fields = append(fields, "") // An empty help string.
+			}
+			if len(fields) < 4 || fields[0] != "#" {
+				return nil, fmt.Errorf("line %d: invalid comment line %q", lineNum, line)
+			}
+			keyword, name, rest := fields[1], fields[2], fields[3]
+			if keyword != "HELP" && keyword != "TYPE" && keyword != "UNIT" {
+				return nil, fmt.Errorf("line %d: unknown keyword %q", lineNum, keyword)
+			}
+			if !model.IsValidMetricName(model.LabelValue(name)) {
+				return nil, fmt.Errorf("line %d: invalid metric name %q", lineNum, name)
+			}
+			if cur == nil || cur.name != name {
+				if cur, err = start(name); err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNum, err)
+				}
+			}
+			switch keyword {
+			case "HELP":
+				help, err := unescapeOpenMetrics(rest)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNum, err)
+				}
+				cur.help = &help
+			case "TYPE":
+				if cur.mf != nil {
+					return nil, fmt.Errorf("line %d: TYPE line for metric family %q after its samples", lineNum, name)
+				}
+				if rest == "gaugehistogram" {
+					return nil, fmt.Errorf("line %d: metric type %q not supported", lineNum, rest)
+				}
+				if _, ok := openMetricsTypes[rest]; !ok {
+					return nil, fmt.Errorf("line %d: invalid metric type %q", lineNum, rest)
+				}
+				cur.typ = rest
+			}
+			continue
+		}
+
+		name := leadingOpenMetricsName(line, true)
+		if name == "" {
+			return nil, fmt.Errorf("line %d: invalid sample line %q", lineNum, line)
+		}
+		suffix, ok := "", false
+		if cur != nil {
+			suffix, ok = familySuffix(cur, name)
+		}
+		if !ok {
+			if cur, err = start(name); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+		}
+		if err := parseOpenMetricsSample(cur, suffix, line[len(name):]); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+	}
+	if !eof {
+		return nil, errors.New("missing # EOF at the end of the input")
+	}
+
+	var mfs []*dto.MetricFamily
+	for _, f := range families {
+		if f.mf == nil {
+			continue
+		}
+		for _, m := range f.mf.Metric {
+			if m.Histogram != nil {
+				sort.Slice(m.Histogram.Bucket, func(i, j int) bool {
+					return m.Histogram.Bucket[i].GetUpperBound() < m.Histogram.Bucket[j].GetUpperBound()
+				})
+			}
+		}
+		mfs = append(mfs, f.mf)
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, nil
+}
+
+// familySuffix returns the suffix of the provided sample name for the provided
+// family and true, or false if the sample does not belong to the family.
+func familySuffix(f *openMetricsFamily, sampleName string) (string, bool) {
+	for _, suffix := range openMetricsTypes[f.typ].suffixes {
+		if sampleName == f.name+suffix {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+// parseOpenMetricsSample parses the rest (after the sample name) of a sample
+// line of the provided family and adds the sample to it.
+func parseOpenMetricsSample(f *openMetricsFamily, suffix, rest string) error {
+	labels, rest, err := parseOpenMetricsLabels(rest)
+	if err != nil {
+		return err
+	}
+	sampleKey := suffix + strconv.FormatUint(model.LabelsToSignature(labels), 16)
+	if f.samples[sampleKey] {
+		return fmt.Errorf("duplicate sample for metric family %q", f.name)
+	}
+	f.samples[sampleKey] = true
+
+	if !strings.HasPrefix(rest, " ") {
+		return errors.New("expected space before sample value")
+	}
+	var valueStr, tsStr string
+	valueStr, rest = nextOpenMetricsToken(rest[1:])
+	value, err := parseOpenMetricsFloat(valueStr)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(rest, " ") && !strings.HasPrefix(rest, " #") {
+		tsStr, rest = nextOpenMetricsToken(rest[1:])
+	}
+	var exemplar *dto.Exemplar
+	if strings.HasPrefix(rest, " # ") {
+		if exemplar, err = parseOpenMetricsExemplar(rest[3:]); err != nil {
+			return err
+		}
+		rest = ""
+	}
+	if rest != "" {
+		return fmt.Errorf("unexpected %q at the end of the sample line", rest)
+	}
+	if exemplar != nil && suffix != "_total" && suffix != "_bucket" {
+		return fmt.Errorf("exemplar not allowed for sample of metric family %q", f.name)
+	}
+	if suffix == "_created" {
+		return nil
+	}
+
+	// Special labels that are not part of the label set of the metric.
+	var special string
+	switch {
+	case f.typ == "histogram" && suffix == "_bucket":
+		special = model.BucketLabel
+	case f.typ == "summary" && suffix == "":
+		special = model.QuantileLabel
+	}
+	var specialValue float64
+	if special != "" {
+		v, ok := labels[special]
+		if !ok {
+			return fmt.Errorf("missing label %q for metric family %q", special, f.name)
+		}
+		if specialValue, err = parseOpenMetricsFloat(v); err != nil {
+			return err
+		}
+		delete(labels, special)
+	}
+	if f.typ == "stateset" {
+		if _, ok := labels[f.name]; !ok {
+			return fmt.Errorf("missing label %q for StateSet %q", f.name, f.name)
+		}
+	}
+
+	if f.mf == nil {
+		name := f.name
+		if f.typ == "counter" || f.typ == "info" {
+			name += openMetricsTypes[f.typ].suffixes[0]
+		}
+		f.mf = &dto.MetricFamily{
+			Name: proto.String(name),
+			Help: f.help,
+			Type: openMetricsTypes[f.typ].typ.Enum(),
+		}
+	}
+	signature := model.LabelsToSignature(labels)
+	m, ok := f.metrics[signature]
+	if !ok {
+		m = &dto.Metric{}
+		names := make([]string, 0, len(labels))
+		for ln := range labels {
+			names = append(names, ln)
+		}
+		sort.Strings(names)
+		for _, ln := range names {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(ln), Value: proto.String(labels[ln])})
+		}
+		f.metrics[signature] = m
+		f.mf.Metric = append(f.mf.Metric, m)
+	}
+	if tsStr != "" {
+		ts, err := parseOpenMetricsFloat(tsStr)
+		if err != nil {
+			return err
+		}
+		m.TimestampMs = proto.Int64(int64(math.Round(ts * 1000)))
+	}
+
+	switch f.typ {
+	case "counter":
+		m.Counter = &dto.Counter{Value: proto.Float64(value), Exemplar: exemplar}
+	case "gauge", "info", "stateset":
+		m.Gauge = &dto.Gauge{Value: proto.Float64(value)}
+	case "unknown":
+		m.Untyped = &dto.Untyped{Value: proto.Float64(value)}
+	case "histogram":
+		if m.Histogram == nil {
+			m.Histogram = &dto.Histogram{}
+		}
+		switch suffix {
+		case "_bucket":
+			count, err := openMetricsCount(value)
+			if err != nil {
+				return err
+			}
+			m.Histogram.Bucket = append(m.Histogram.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(specialValue),
+				CumulativeCount: proto.Uint64(count),
+				Exemplar:        exemplar,
+			})
+		case "_count":
+			count, err := openMetricsCount(value)
+			if err != nil {
+				return err
+			}
+			m.Histogram.SampleCount = proto.Uint64(count)
+		case "_sum":
+			m.Histogram.SampleSum = proto.Float64(value)
+		}
+	case "summary":
+		if m.Summary == nil {
+			m.Summary = &dto.Summary{}
+		}
+		switch suffix {
+		case "":
+			m.Summary.Quantile = append(m.Summary.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(specialValue),
+				Value:    proto.Float64(value),
+			})
+		case "_count":
+			count, err := openMetricsCount(value)
+			if err != nil {
+				return err
+			}
+			m.Summary.SampleCount = proto.Uint64(count)
+		case "_sum":
+			m.Summary.SampleSum = proto.Float64(value)
+		}
+	}
+	return nil
+}
+
+// parseOpenMetricsExemplar parses an exemplar, i.e. a label set followed by a
+// value and an optional timestamp.
+func parseOpenMetricsExemplar(s string) (*dto.Exemplar, error) {
+	if !strings.HasPrefix(s, "{") {
+		return nil, errors.New("expected label set of exemplar")
+	}
+	labels, rest, err := parseOpenMetricsLabels(s)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return nil, errors.New("expected space before exemplar value")
+	}
+	var valueStr, tsStr string
+	valueStr, rest = nextOpenMetricsToken(rest[1:])
+	value, err := parseOpenMetricsFloat(valueStr)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(rest, " ") {
+		tsStr, rest = nextOpenMetricsToken(rest[1:])
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q at the end of the exemplar", rest)
+	}
+	e := &dto.Exemplar{Value: proto.Float64(value)}
+	names := make([]string, 0, len(labels))
+	for ln := range labels {
+		names = append(names, ln)
+	}
+	sort.Strings(names)
+	for _, ln := range names {
+		e.Label = append(e.Label, &dto.LabelPair{Name: proto.String(ln), Value: proto.String(labels[ln])})
+	}
+	if tsStr != "" {
+		ts, err := parseOpenMetricsFloat(tsStr)
+		if err != nil {
+			return nil, err
+		}
+		secs, frac := math.Modf(ts)
+		if e.Timestamp, err = ptypes.TimestampProto(time.Unix(int64(secs), int64(frac*1e9))); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// parseOpenMetricsLabels parses the optional label set at the start of s and
+// returns it together with the rest of s.
+func parseOpenMetricsLabels(s string) (map[string]string, string, error) {
+	labels := map[string]string{}
+	if !strings.HasPrefix(s, "{") {
+		return labels, s, nil
+	}
+	s = s[1:]
+	for {
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		name := leadingOpenMetricsName(s, false)
+		if name == "" {
+			return nil, "", fmt.Errorf("expected label name at %q", s)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, "", fmt.Errorf("duplicate label name %q", name)
+		}
+		s = s[len(name):]
+		if !strings.HasPrefix(s, `="`) {
+			return nil, "", fmt.Errorf("expected '=\"' after label name %q", name)
+		}
+		s = s[2:]
+		end := -1
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == '"' {
+				end = i
+				break
+			}
+		}
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated value of label %q", name)
+		}
+		value, err := unescapeOpenMetrics(s[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		labels[name] = value
+		s = s[end+1:]
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return nil, "", fmt.Errorf("expected ',' or '}' after value of label %q", name)
+		}
+	}
+}
+
+// leadingOpenMetricsName returns the longest prefix of s that is a valid label
+// name or, if metricName is true, a valid metric name.
+func leadingOpenMetricsName(s string, metricName bool) string {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c == ':' && metricName:
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// nextOpenMetricsToken returns the part of s up to the next space and the rest
+// (starting with the space, if any).
+func nextOpenMetricsToken(s string) (string, string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i:]
+	}
+	return s, ""
+}
+
+func parseOpenMetricsFloat(s string) (float64, error) {
+	// strconv.ParseFloat would also accept e.g. "inf" or hex floats.
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(+1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	if s == "" || strings.ContainsAny(s, "xXiInN_") {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// openMetricsCount converts the provided sample value into a count.
+func openMetricsCount(v float64) (uint64, error) {
+	if v < 0 || v != math.Trunc(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid count %v", v)
+	}
+	return uint64(v), nil
+}
+
+// unescapeOpenMetrics resolves the escape sequences in a label value or a help
+// string.
+func unescapeOpenMetrics(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		if i++; i == len(s) {
+			return "", fmt.Errorf("invalid escape sequence at the end of %q", s)
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case '"':
+			b.WriteByte('"')
+		default:
+			return "", fmt.Errorf(`invalid escape sequence \%c in %q`, s[i], s)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ingest contains the helpers shared by the receivers that convert
+// other formats (statsd, Graphite, the InfluxDB line protocol, remote-write,
+// and OTLP) into metric families.
+package ingest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricName replaces all characters invalid in a Prometheus metric name with
+// '_'. A leading digit is prefixed with '_'.
+func MetricName(s string) string {
+	return sanitize(s, true)
+}
+
+// LabelName replaces all characters invalid in a Prometheus label name with
+// '_'. A leading digit is prefixed with '_'. Unlike MetricName, it replaces ':'.
+func LabelName(s string) string {
+	return sanitize(s, false)
+}
+
+func sanitize(s string, colons bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9' || colons && c == ':') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// Signature returns a string identifying the provided labels.
+func Signature(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, labels[name])
+	}
+	return b.String()
+}
+
+// LabelPairs returns the provided labels as LabelPairs sorted by name.
+func LabelPairs(labels map[string]string) []*dto.LabelPair {
+	lps := make([]*dto.LabelPair, 0, len(labels))
+	for name, value := range labels {
+		lps = append(lps, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(lps, func(i, j int) bool { return lps[i].GetName() < lps[j].GetName() })
+	return lps
+}
+
+// CopyLabels returns a copy of the provided labels.
+func CopyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for name, value := range labels {
+		c[name] = value
+	}
+	return c
+}
@@ -0,0 +1,46 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ingest
+
+import "testing"
+
+func TestNames(t *testing.T) {
+	for _, s := range []struct {
+		in, metric, label string
+	}{
+		{in: "http_requests_total", metric: "http_requests_total", label: "http_requests_total"},
+		{in: "job:errors:rate5m", metric: "job:errors:rate5m", label: "job_errors_rate5m"},
+		{in: "disk.used-bytes", metric: "disk_used_bytes", label: "disk_used_bytes"},
+		{in: "5xx", metric: "_5xx", label: "_5xx"},
+		{in: "", metric: "", label: ""},
+	} {
+		if expected, got := s.metric, MetricName(s.in); expected != got {
+			t.Errorf("%q: Wanted metric name %q, got %q.", s.in, expected, got)
+		}
+		if expected, got := s.label, LabelName(s.in); expected != got {
+			t.Errorf("%q: Wanted label name %q, got %q.", s.in, expected, got)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	a := Signature(map[string]string{"job": "a", "instance": "b"})
+	if expected, got := `instance="b",job="a",`, a; expected != got {
+		t.Errorf("Wanted signature %q, got %q.", expected, got)
+	}
+	// Quoting keeps label values containing separators apart.
+	if Signature(map[string]string{"a": `x",b="y`}) == Signature(map[string]string{"a": "x", "b": "y"}) {
+		t.Error("Expected different signatures.")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lineserver receives newline-separated lines via both TCP and UDP, as
+// needed by line-based ingestion protocols like statsd and Graphite.
+package lineserver
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// maxPacketSize is the maximum size of a UDP datagram.
+const maxPacketSize = 65535
+
+// Server passes every non-empty line received via TCP or UDP, with surrounding
+// white space trimmed, to its handler. Each UDP datagram may contain several
+// lines, and each TCP connection any number of them. The handler is called
+// concurrently.
+type Server struct {
+	tcp    net.Listener
+	udp    net.PacketConn
+	handle func(line string)
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	logger log.Logger
+}
+
+// Listen returns a Server listening on the provided address (e.g. ":9125")
+// for both TCP and UDP, which starts serving in the background until Close is
+// called. If the address asks for any port, both use the port picked for TCP.
+func Listen(address string, handle func(line string), logger log.Logger) (*Server, error) {
+	tcp, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		return nil, err
+	}
+	s := &Server{
+		tcp:    tcp,
+		udp:    udp,
+		handle: handle,
+		stop:   make(chan struct{}),
+		logger: logger,
+	}
+	s.wg.Add(2)
+	go s.serveTCP()
+	go s.serveUDP()
+	return s, nil
+}
+
+// Addr returns the address the Server listens on, which is the same for TCP
+// and UDP.
+func (s *Server) Addr() string {
+	return s.tcp.Addr().String()
+}
+
+// Close stops listening, closes all TCP connections, and waits for the
+// handler calls in progress to return.
+func (s *Server) Close() {
+	close(s.stop)
+	s.tcp.Close()
+	s.udp.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	var conns sync.WaitGroup
+	defer conns.Wait()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			select {
+			case <-s.stop:
+			default:
+				level.Error(s.logger).Log("msg", "TCP listener stopped", "address", s.Addr(), "err", err)
+			}
+			return
+		}
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	// Unblock the scanner below once the Server is closed.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text())
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.stop:
+			default:
+				level.Error(s.logger).Log("msg", "UDP listener stopped", "address", s.Addr(), "err", err)
+			}
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			s.handleLine(line)
+		}
+	}
+}
+
+func (s *Server) handleLine(line string) {
+	if line = strings.TrimSpace(line); line != "" {
+		s.handle(line)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// unixPrefix marks a listen address as the path of a UNIX domain socket.
+const unixPrefix = "unix://"
+
+// socketOptions configure the socket files created by listen.
+type socketOptions struct {
+	mode  os.FileMode
+	group string // Name or numeric ID. Empty means the default group.
+}
+
+// listen returns a listener for the provided address, which is either a TCP
+// address (e.g. ":9091") or the path of a UNIX domain socket prefixed with
+// "unix://" (e.g. "unix:///run/pushgateway.sock"). A socket file left behind
+// by a previous run is removed first, but an existing file that is not a socket
+// or a socket still in use results in an error. The socket file is set up
+// according to the provided socketOptions and removed again once the listener
+// is closed.
+func listen(address string, opts socketOptions) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, unixPrefix)
+	if path == "" {
+		return nil, fmt.Errorf("no socket path in listen address %q", address)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setUpSocket(path, opts); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file at the provided path if nothing
+// is listening on it anymore. It does nothing if there is no file.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// setUpSocket applies the provided socketOptions to the socket file at the
+// provided path.
+func setUpSocket(path string, opts socketOptions) error {
+	if opts.group != "" {
+		gid, err := lookupGroup(opts.group)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, opts.mode)
+}
+
+// lookupGroup returns the ID of the group with the provided name or numeric ID.
+func lookupGroup(group string) (int, error) {
+	if g, err := user.LookupGroup(group); err == nil {
+		group = g.Gid
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q", group)
+	}
+	return gid, nil
+}
+
+// parseSocketMode parses the provided octal permission bits, e.g. "0660".
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("invalid socket mode %q, must be octal permission bits like 0660", s)
+	}
+	return os.FileMode(mode), nil
+}
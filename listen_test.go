@@ -0,0 +1,86 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestListenUnix.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	sock := path.Join(tempDir, "pushgateway.sock")
+	opts := socketOptions{mode: 0600}
+
+	// Leave a stale socket behind.
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen(unixPrefix+sock, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := os.FileMode(0600), fi.Mode().Perm(); expected != got {
+		t.Errorf("Wanted mode %v, got %v.", expected, got)
+	}
+	if _, err := listen(unixPrefix+sock, opts); err == nil {
+		t.Error("Expected error listening on a socket in use.")
+	}
+	l.Close()
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("Expected socket to be removed, got %v.", err)
+	}
+
+	if err := ioutil.WriteFile(sock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(unixPrefix+sock, opts); err == nil {
+		t.Error("Expected error listening on a regular file.")
+	}
+	if _, err := os.Stat(sock); err != nil {
+		t.Errorf("Expected regular file to be kept, got %v.", err)
+	}
+}
+
+func TestParseSocketMode(t *testing.T) {
+	for s, expected := range map[string]os.FileMode{"0660": 0660, "600": 0600, "0777": 0777} {
+		got, err := parseSocketMode(s)
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %v", s, err)
+		}
+		if expected != got {
+			t.Errorf("%q: Wanted mode %v, got %v.", s, expected, got)
+		}
+	}
+	for _, s := range []string{"", "rw", "0990", "01777"} {
+		if _, err := parseSocketMode(s); err == nil {
+			t.Errorf("%q: Expected error.", s)
+		}
+	}
+}
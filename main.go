@@ -14,7 +14,11 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -23,6 +27,7 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -34,6 +39,8 @@ import (
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/route"
 	"github.com/prometheus/common/version"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	dto "github.com/prometheus/client_model/go"
@@ -41,10 +48,24 @@ import (
 
 	api_v1 "github.com/prometheus/pushgateway/api/v1"
 	"github.com/prometheus/pushgateway/asset"
+	"github.com/prometheus/pushgateway/audit"
+	"github.com/prometheus/pushgateway/cluster"
+	"github.com/prometheus/pushgateway/graphite"
+	"github.com/prometheus/pushgateway/grpcapi"
 	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/remotewrite"
+	"github.com/prometheus/pushgateway/scrape"
+	"github.com/prometheus/pushgateway/sd"
+	"github.com/prometheus/pushgateway/statsd"
 	"github.com/prometheus/pushgateway/storage"
+	"github.com/prometheus/pushgateway/tracing"
+	"github.com/prometheus/pushgateway/webhook"
 )
 
+// encryptionKeyEnv is the environment variable to provide the secret for
+// encrypting persisted metrics if --persistence.encryption-key-file is not set.
+const encryptionKeyEnv = "PUSHGATEWAY_PERSISTENCE_ENCRYPTION_KEY"
+
 func init() {
 	prometheus.MustRegister(version.NewCollector("pushgateway"))
 }
@@ -60,22 +81,138 @@ func main() {
 	var (
 		app = kingpin.New(filepath.Base(os.Args[0]), "The Pushgateway")
 
-		listenAddress       = app.Flag("web.listen-address", "Address to listen on for the web interface, API, and telemetry.").Default(":9091").String()
-		metricsPath         = app.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-		externalURL         = app.Flag("web.external-url", "The URL under which the Pushgateway is externally reachable.").Default("").URL()
-		routePrefix         = app.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints. Defaults to the path of --web.external-url.").Default("").String()
-		enableLifeCycle     = app.Flag("web.enable-lifecycle", "Enable shutdown via HTTP request.").Default("false").Bool()
-		enableAdminAPI      = app.Flag("web.enable-admin-api", "Enable API endpoints for admin control actions.").Default("false").Bool()
-		persistenceFile     = app.Flag("persistence.file", "File to persist metrics. If empty, metrics are only kept in memory.").Default("").String()
-		persistenceInterval = app.Flag("persistence.interval", "The minimum interval at which to write out the persistence file.").Default("5m").Duration()
-		pushUnchecked       = app.Flag("push.disable-consistency-check", "Do not check consistency of pushed metrics. DANGEROUS.").Default("false").Bool()
-		promlogConfig       = promlog.Config{}
+		listenAddress        = app.Flag("web.listen-address", "Address to listen on for the web interface, API, and telemetry. Use unix:///path/to/socket to listen on a UNIX domain socket.").Default(":9091").String()
+		socketMode           = app.Flag("web.socket-mode", "Permission bits (in octal) of UNIX domain sockets to listen on.").Default("0660").String()
+		socketGroup          = app.Flag("web.socket-group", "Group (name or numeric ID) to own UNIX domain sockets to listen on. If empty, the default group of the process is used.").Default("").String()
+		grpcListenAddress    = app.Flag("grpc.listen-address", "Address to serve the gRPC PushService on. If equal to --web.listen-address, gRPC is served on the same port as HTTP. A UNIX domain socket can be used as for --web.listen-address. If empty, gRPC is disabled.").Default("").String()
+		metricsPath          = app.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+		externalURL          = app.Flag("web.external-url", "The URL under which the Pushgateway is externally reachable.").Default("").URL()
+		routePrefix          = app.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints. Defaults to the path of --web.external-url.").Default("").String()
+		configFile           = app.Flag("config.file", "Path to a YAML file with limits, auth, acls, metric_relabel_configs, and tenants sections, each replacing the corresponding flags. Reloaded (together with the files provided by those flags) upon SIGHUP and, if the lifecycle API is enabled, POST /-/reload.").Default("").String()
+		enableLifeCycle      = app.Flag("web.enable-lifecycle", "Enable shutdown and reloading of the configuration via HTTP request.").Default("false").Bool()
+		shutdownTimeout      = app.Flag("web.shutdown-timeout", "Maximum time to wait for in-flight requests to complete upon shutdown.").Default("30s").Duration()
+		readTimeout          = app.Flag("web.read-timeout", "Maximum duration for reading an entire request, including the body. 0 means no timeout.").Default("0s").Duration()
+		writeTimeout         = app.Flag("web.write-timeout", "Maximum duration from the end of reading the request headers until the end of writing the response. 0 means no timeout. Note that a timeout also ends the streams of changes served to standby Pushgateways.").Default("0s").Duration()
+		idleTimeout          = app.Flag("web.idle-timeout", "Maximum duration to keep an idle keep-alive connection open. 0 means --web.read-timeout is used, and no timeout if that is 0, too.").Default("0s").Duration()
+		maxConcurrentStreams = app.Flag("web.http2-max-concurrent-streams", "Maximum number of concurrent streams (i.e. requests) per HTTP/2 connection.").Default("250").Uint32()
+		enableH2C            = app.Flag("web.enable-h2c", "Serve HTTP/2 without TLS (h2c) to clients using it with prior knowledge or upgrading to it. With TLS, HTTP/2 is always negotiated.").Default("false").Bool()
+		enableAdminAPI       = app.Flag("web.enable-admin-api", "Enable API endpoints for admin control actions.").Default("false").Bool()
+		enableInfluxDB       = app.Flag("web.enable-influxdb-write", "Accept points in the InfluxDB line protocol (e.g. from IoT agents) at /write, storing them as gauges. The requests are subject to authentication and ACLs, but API keys are not accepted for them.").Default("false").Bool()
+		enableRemoteWrite    = app.Flag("web.enable-remote-write-receiver", "Accept Prometheus remote-write requests at /api/v1/write, storing the latest sample of each series. The requests are subject to authentication and ACLs, but API keys are not accepted for them.").Default("false").Bool()
+		enableOTLP           = app.Flag("web.enable-otlp-receiver", "Accept OTLP/HTTP metric export requests (e.g. from OpenTelemetry SDKs) at /v1/metrics, storing the metrics grouped by resource. The requests are subject to authentication and ACLs, but API keys are not accepted for them.").Default("false").Bool()
+		readOnly             = app.Flag("web.read-only", "Start in read-only mode, rejecting all pushes, deletions, locks, renames, wipes, and restores with status code 403 while still serving the stored metrics. Changes replicated from other Pushgateways are rejected, too, but changes from a followed primary are still applied. If the admin API is enabled, the mode can be switched at runtime.").Default("false").Bool()
+		tlsCertFile          = app.Flag("web.tls-cert-file", "Path to the TLS certificate file. If set together with --web.tls-key-file, HTTPS is served instead of HTTP. The certificate is reloaded upon SIGHUP and when the files change.").Default("").String()
+		tlsKeyFile           = app.Flag("web.tls-key-file", "Path to the TLS key file.").Default("").String()
+		tlsClientCAFile      = app.Flag("web.tls-client-ca-file", "Path to a file with CA certificates. If set, clients have to present a certificate signed by one of them (mutual TLS).").Default("").String()
+		tenantsFile          = app.Flag("tenancy.file", "Path to a YAML file configuring tenants, each with its own isolated metric store below /tenants/<id>/metrics. If empty, multi-tenancy is disabled.").Default("").String()
+		authFile             = app.Flag("web.auth.file", "Path to a YAML file configuring basic auth users and bearer tokens required for PUT, POST, and DELETE requests. If empty, no authentication is required.").Default("").String()
+		aclFile              = app.Flag("web.acl-file", "Path to a YAML file mapping basic auth users, client certificate common names, and bearer tokens to the job names they may push to, delete, and lock. If empty, every authenticated client may modify every job.").Default("").String()
+		authzWebhookURL      = app.Flag("web.authz-webhook.url", "URL of an external authorization service to POST the identity and the target group of every push, deletion, lock, and rename to, answering whether it is allowed. If empty, no such service is asked.").Default("").String()
+		authzWebhookTimeout  = app.Flag("web.authz-webhook.timeout", "Maximum time to wait for the authorization service. Requests it does not decide on in time are rejected with status code 503.").Default("5s").Duration()
+		authzWebhookTTL      = app.Flag("web.authz-webhook.cache-ttl", "How long to cache the decisions of the authorization service. 0 disables caching.").Default("1m").Duration()
+		apiKeysFile          = app.Flag("web.api-keys-file", "File to store the API keys created via the admin API in, with only the hashes of their secrets. Defaults to the persistence file with the suffix .api-keys. If neither is set, API keys are disabled.").Default("").String()
+		persistenceBackend   = app.Flag("persistence.backend", "Storage backend to keep pushed metrics in. One of: "+strings.Join(storage.Backends(), ", ")+".").Default("disk").Enum(storage.Backends()...)
+		persistenceFile      = app.Flag("persistence.file", "File to persist metrics. If empty, metrics are only kept in memory.").Default("").String()
+		persistenceURL       = app.Flag("persistence.url", "URL of the object storage location to persist metrics to, e.g. s3://bucket/prefix or gs://bucket/prefix. Requires --persistence.backend=object.").Default("").String()
+		persistenceInterval  = app.Flag("persistence.interval", "The minimum interval at which to write out the persistence file.").Default("5m").Duration()
+		persistLagWarning    = app.Flag("persistence.lag-warning-threshold", "Log a warning whenever persisting completes with changes older than this, e.g. because persisting takes too long or keeps failing. The age of the oldest change not persisted yet is also exposed as the pushgateway_persistence_lag_seconds metric. 0 means three times --persistence.interval.").Default("0").Duration()
+		compactionInterval   = app.Flag("persistence.compaction-interval", "If set, only the groups changed since the previous persisting are written to a delta file next to the persistence file, and the delta files are merged into the persistence file at this interval. 0 means the whole persistence file is written every time.").Default("0").Duration()
+		persistenceSync      = app.Flag("persistence.sync", "When to sync persisted files to disk. One of: always (the write-ahead log after every change, and the persistence file and delta files before renaming them into place, followed by their directory), interval (the persistence file and delta files like always, and the write-ahead log whenever one of them is written), never (leave it to the operating system, fewest IOPS).").Default(string(storage.SyncInterval)).Enum(storage.SyncPolicies...)
+		compression          = app.Flag("persistence.compression", "Codec to compress the persistence file and delta files with. One of: none, gzip. Files are read regardless of their compression, so that it can be changed at any time.").Default(string(storage.CompressionNone)).Enum(storage.Compressions...)
+		persistenceIndex     = app.Flag("persistence.index", "Write an index file next to the persistence file, so that metric families are only read from the persistence file when first needed after a restart. Speeds up the start with large persistence files. Has no effect if the persistence file is compressed or encrypted.").Default("false").Bool()
+		encryptionKeyFile    = app.Flag("persistence.encryption-key-file", "Path to a file with a secret to encrypt the persisted metrics with (AES-256-GCM). Alternatively, the secret can be provided via the "+encryptionKeyEnv+" environment variable. If neither is set, persisted metrics are not encrypted.").Default("").String()
+		timestampPolicy      = app.Flag("push.timestamp-policy", "How to handle pushed samples with a timestamp. One of: reject (reject the whole push), strip (drop the timestamps), allow (store the timestamps, DANGEROUS).").Default(string(handler.TimestampReject)).Enum(handler.TimestampPolicies...)
+		labelConflictPolicy  = app.Flag("push.label-conflict-policy", "How to handle pushed samples with a label conflicting with the grouping labels of the push (including a non-empty instance label if there is no instance grouping label). One of: override (replace the label values by those of the grouping labels, keep the instance label), reject (reject the whole push).").Default(string(handler.LabelConflictOverride)).Enum(handler.LabelConflictPolicies...)
+		validationPolicy     = app.Flag("push.validation", "Which pushed metric names, label names, and label values to accept. One of: strict (names following the classic Prometheus data model), utf8 (any names that are valid UTF-8, which scrapers not supporting UTF-8 names may fail to parse), none (accept everything, DANGEROUS). Label values always have to be valid UTF-8 unless set to none.").Default(string(handler.ValidationStrict)).Enum(handler.ValidationPolicies...)
+		instanceFromClient   = app.Flag("push.instance-from-client", "If set, pushes and deletions without an instance label in the URL path address the group with an instance label set to the IP address of the client. One of: remote-addr (the address the request came from), x-forwarded-for (the first address in the X-Forwarded-For header, DANGEROUS unless behind a proxy setting it). If empty, such groups get an empty instance label.").Default("").Enum(append([]string{""}, handler.InstanceSources...)...)
+		pushUnchecked        = app.Flag("push.disable-consistency-check", "Do not check consistency of pushed metrics. DANGEROUS.").Default("false").Bool()
+		pushMaxBodySize      = app.Flag("push.max-body-size", "Maximum size of the (possibly compressed) body of a push, e.g. 10MB. Larger pushes are rejected with status code 413. 0 means no limit.").Default("0").Bytes()
+		pushTimeout          = app.Flag("push.timeout", "Maximum time to receive the body of a push. Slower pushes are rejected with status code 408. 0 means no limit.").Default("0").Duration()
+		quarantineSize       = app.Flag("push.quarantine-size", "Number of most recently rejected pushes to keep with their body and error for inspection at /api/v1/rejected. 0 disables the quarantine.").Default("0").Int()
+		quarantineBodySize   = app.Flag("push.quarantine-max-body-size", "Maximum number of bytes of the body of a rejected push to keep in the quarantine.").Default("64KB").Bytes()
+		pushRateLimit        = app.Flag("push.rate-limit", "Maximum rate of pushes and deletions per group, e.g. 10/s (units s, m, h). Exceeding requests are rejected with status code 429. If empty, there is no limit.").Default("").String()
+		pushIPRateLimit      = app.Flag("push.ip-rate-limit", "Maximum rate of pushes and deletions per source IP, e.g. 100/m (units s, m, h). Exceeding requests are rejected with status code 429. If empty, there is no limit.").Default("").String()
+		attachPushTimes      = app.Flag("scrape.attach-push-timestamps", "Expose pushed samples with the time of the last successful push to their group as timestamp (unless pushed with an explicit timestamp), so that Prometheus stops returning samples that have not been refreshed recently.").Default("false").Bool()
+		streamScrapes        = app.Flag("scrape.stream", "Encode the pushed metric families one by one while serving a scrape instead of gathering all of them first, to bound the memory needed for scrapes of large metric stores. Pushed metrics are not checked for consistency during scrapes then.").Default("false").Bool()
+		annotationsInfo      = app.Flag("push.annotations-info-metric", "Expose the annotations of all groups as labels of a push_annotations_info metric.").Default("false").Bool()
+		relabelFile          = app.Flag("push.relabel-config-file", "Path to a YAML file with metric_relabel_configs applied to all pushed samples. If empty, no relabeling is performed.").Default("").String()
+		maxGroups            = app.Flag("storage.max-groups", "Maximum number of metric groups to store. Pushes creating more groups are rejected. 0 means no limit.").Default("0").Int()
+		maxFamiliesPerGroup  = app.Flag("storage.max-families-per-group", "Maximum number of metric families to store per group. Pushes creating more metric families are rejected. 0 means no limit.").Default("0").Int()
+		maxSamplesTotal      = app.Flag("storage.max-samples-total", "Maximum number of samples to store in all groups combined. Pushes creating more samples are rejected. 0 means no limit.").Default("0").Int()
+		maxSeriesPerGroup    = app.Flag("storage.max-series-per-group", "Maximum number of samples to store per group. Pushes creating more samples are rejected or, with --storage.limit-action=truncate, stripped of the excess metrics. 0 means no limit.").Default("0").Int()
+		maxLabelsPerMetric   = app.Flag("storage.max-labels-per-metric", "Maximum number of labels of a pushed metric, including the grouping labels. Pushes with more labels are rejected or, with --storage.limit-action=truncate, stripped of the excess labels. 0 means no limit.").Default("0").Int()
+		maxLabelValueLength  = app.Flag("storage.max-label-value-length", "Maximum length of a label value of a pushed metric in bytes. Pushes with longer label values are rejected or, with --storage.limit-action=truncate, get them truncated (but never the values of grouping labels). 0 means no limit.").Default("0").Int()
+		limitAction          = app.Flag("storage.limit-action", "What to do with pushes exceeding --storage.max-series-per-group, --storage.max-labels-per-metric, or --storage.max-label-value-length. One of: reject, truncate.").Default("reject").Enum("reject", "truncate")
+		maxGroupsPerJob      = app.Flag("storage.retention.max-groups-per-job", "Maximum number of metric groups to keep per job. The groups pushed to least recently are removed first. Locked groups are neither removed nor counted. 0 means no limit.").Default("0").Int()
+		maxGroupAge          = app.Flag("storage.retention.max-age", "Remove metric groups whose last successful push is longer ago than this, regardless of any TTL. Locked groups are not removed. 0 means no limit.").Default("0").Duration()
+		emptyGroups          = app.Flag("storage.empty-groups", "What to do with a metric group left without pushed metrics after deleting some of them or after their TTL has elapsed. One of: remove (remove the whole group), keep (keep the group with only its push_time_seconds and push_failure_time_seconds metrics, e.g. for alerting on the time of its last push).").Default(string(storage.EmptyGroupRemove)).Enum(storage.EmptyGroupPolicies...)
+		groupMetrics         = app.Flag("storage.group-metrics", "Expose metrics about every metric group (number of metric families and samples, size of the last push, and number of pushes), labeled by the grouping labels. This adds four series per group to the metrics of the Pushgateway.").Default("false").Bool()
+		internInterval       = app.Flag("storage.intern-interval", "Interval at which identical label pairs and help strings of the stored metric families are deduplicated in memory, which saves memory if many groups share the same metric families. 0 disables the deduplication.").Default("0").Duration()
+		queueCapacity        = app.Flag("storage.write-queue-capacity", "Number of write requests that can be queued for processing.").Default(strconv.Itoa(storage.DefaultWriteQueueCapacity)).Int()
+		queueTimeout         = app.Flag("storage.write-queue-timeout", "How long to wait for space in a full write queue before rejecting a request with status code 503. 0 means waiting indefinitely.").Default("5s").Duration()
+		queueSpillDir        = app.Flag("storage.write-queue-spill-dir", "Directory of a file to which write requests are spilled while the write queue is full, rather than waiting for space in the queue. Spilled requests survive a restart. The file is not encrypted. If empty, requests are not spilled.").Default("").String()
+		queueSpillMaxSize    = app.Flag("storage.write-queue-spill-max-size", "Maximum size of the spill file, e.g. 1GB. Once reached, requests are rejected with status code 503. 0 means no limit.").Default("0").Bytes()
+		queueBatchSize       = app.Flag("storage.write-batch-size", "Maximum number of queued write requests applied at once, taking the write lock only once for all of them. 1 disables batching.").Default("1").Int()
+		clusterPeers         = app.Flag("cluster.peer", "Base URL of another Pushgateway (e.g. http://pushgateway-2:9091) to replicate all changes to. Can be repeated. Requires --cluster.secret-file.").Strings()
+		clusterSecretFile    = app.Flag("cluster.secret-file", "Path to a file with a secret shared by all replicating Pushgateways. If set, changes replicated from peers sending the same secret are accepted at /api/v1/replicate, and changes replicated to peers are sent with it.").Default("").String()
+		clusterServe         = app.Flag("cluster.serve-changes", "Stream all applied changes to Pushgateways following this one via --cluster.follow.").Default("false").Bool()
+		clusterFollow        = app.Flag("cluster.follow", "Base URL of a Pushgateway (e.g. http://pushgateway-1:9091) started with --cluster.serve-changes to mirror as a standby. Implies --web.read-only. Once read-only mode is switched off via the admin API, the Pushgateway stops following for good and accepts changes itself.").Default("").String()
+		remoteWriteURLs      = app.Flag("push.remote-write-url", "URL of a Prometheus remote-write endpoint (e.g. http://prometheus:9090/api/v1/write) to forward all accepted pushes to. Can be repeated.").Strings()
+		webhookURLs          = app.Flag("webhook.url", "URL to POST a JSON notification to whenever a metric group is removed because of its TTL, the retention settings, or a deletion. Can be repeated.").Strings()
+		sdFile               = app.Flag("sd.file", "File to write a document for the file-based service discovery of Prometheus to, listing one target per job with pushed metrics. If empty, no such file is written.").Default("").String()
+		sdTarget             = app.Flag("sd.target", "Address of the Pushgateway to list as the target in the service discovery file. Defaults to --web.listen-address, with the host name of the machine if the host is empty.").Default("").String()
+		sdPerGroup           = app.Flag("sd.per-group", "List one target per metric group in the service discovery file, with the metrics path set to read back the metrics of that group only.").Default("false").Bool()
+		sdInterval           = app.Flag("sd.refresh-interval", "Interval at which the service discovery file is regenerated. It is only written if it has changed.").Default("10s").Duration()
+		scrapeConfigFile     = app.Flag("scrape.config-file", "YAML file listing targets (e.g. short-lived ones that cannot push) to scrape at intervals, storing their metrics as if they had been pushed. If empty, nothing is scraped.").Default("").String()
+		statsdAddress        = app.Flag("statsd.listen-address", "Address to accept statsd metrics on, via both UDP and TCP (e.g. :9125). If empty, no statsd metrics are accepted.").Default("").String()
+		statsdJob            = app.Flag("statsd.job", "Job label of the metric groups statsd metrics are stored in.").Default("statsd").String()
+		statsdGroupingTags   = app.Flag("statsd.grouping-tag", "Name of a DogStatsD tag to use as a grouping label of the statsd metrics rather than as a label of the metric. Can be repeated.").Strings()
+		statsdFlushInterval  = app.Flag("statsd.flush-interval", "Interval at which received statsd metrics are stored.").Default("10s").Duration()
+		graphiteAddress      = app.Flag("graphite.listen-address", "Address to accept metrics in the Graphite plaintext protocol on, via both TCP and UDP (e.g. :2003). If empty, no Graphite metrics are accepted.").Default("").String()
+		graphiteMappingFile  = app.Flag("graphite.mapping-file", "YAML file with mappings of Graphite metric paths to metric names, labels, and grouping labels. If empty, the paths are only turned into metric names.").Default("").String()
+		graphiteJob          = app.Flag("graphite.job", "Job label of the metric groups Graphite metrics are stored in, unless a mapping sets it.").Default("graphite").String()
+		graphiteTTL          = app.Flag("graphite.ttl", "How long to keep a Graphite series after its last value has been received. 0 means forever.").Default("5m").Duration()
+		graphiteFlushPeriod  = app.Flag("graphite.flush-interval", "Interval at which received Graphite metrics are stored.").Default("10s").Duration()
+		influxDBJob          = app.Flag("influxdb.job", "Job label of the metric groups points received via the InfluxDB line protocol are stored in, unless set by the db query parameter of the request.").Default("influxdb").String()
+		influxDBGroupingTags = app.Flag("influxdb.grouping-tag", "Name of an InfluxDB tag to use as a grouping label of the points received via the InfluxDB line protocol rather than as a label of the metrics. Can be repeated.").Strings()
+		remoteWriteJob       = app.Flag("remote-write.job", "Job label of the metric groups series received via remote write are stored in if they have no job label.").Default("remote_write").String()
+		remoteWriteGrouping  = app.Flag("remote-write.grouping-label", "Name of a label of the series received via remote write to group them by. The job label is always a grouping label. Can be repeated.").Default("job", "instance").Strings()
+		otlpGroupingAttrs    = app.Flag("otlp.grouping-attribute", "Name of an OTLP resource attribute to use as a grouping label (with its name sanitized) in addition to the job and instance labels derived from service.name, service.namespace, and service.instance.id. Can be repeated.").Strings()
+		tracingEndpoint      = app.Flag("tracing.otlp-endpoint", "URL of an OTLP/HTTP traces endpoint (e.g. http://otel-collector:4318/v1/traces) to export spans of pushes, deletions, scrapes, and persistence operations to. Requests with a traceparent header are traced as part of the client's trace. If empty, tracing is disabled.").Default("").String()
+		tracingRatio         = app.Flag("tracing.sampling-ratio", "Fraction of traces started by the Pushgateway to sample. Requests with a traceparent header are sampled if the client's span is sampled.").Default("1").Float64()
+		auditFile            = app.Flag("audit.file", "File to append an audit log of all pushes and deletions to, one JSON object per line. \""+audit.Stdout+"\" writes to standard output. If empty, no audit log is written.").Default("").String()
+		auditMaxSize         = app.Flag("audit.max-size", "Size at which the audit log file is rotated, e.g. 100MB. 0 means no rotation.").Default("100MB").Bytes()
+		auditMaxBackups      = app.Flag("audit.max-backups", "Number of rotated audit log files to keep.").Default("5").Int()
+		promlogConfig        = promlog.Config{}
+
+		inspectCmd         = app.Command("inspect", "Inspect a persistence file offline and optionally convert it or delete groups from it. Stop any Pushgateway using the file first. An encrypted file is read with the secret configured by --persistence.encryption-key-file.")
+		inspectFile        = inspectCmd.Arg("file", "The persistence file to inspect.").Required().String()
+		inspectFormat      = inspectCmd.Flag("format", "Rewrite the file in this format: "+formatCurrent+" or "+formatLegacy+" (gob, as written by older versions). Rewriting drops corrupted records.").Enum(formatCurrent, formatLegacy)
+		inspectCompression = inspectCmd.Flag("compression", "Rewrite the file compressed with this codec: none or gzip. By default, the compression of the file is kept.").Enum(storage.Compressions...)
+		inspectDelete      = inspectCmd.Flag("delete-group", "Delete the group with these grouping labels, given like in the push URL path, e.g. job/foo/instance/bar. Can be repeated.").Strings()
+		inspectOutput      = inspectCmd.Flag("output", "Write the result to this file instead of overwriting the inspected one.").Default("").String()
 	)
+	app.Command("serve", "Run the Pushgateway. This is the default command.").Default()
 	promlogflag.AddFlags(app, &promlogConfig)
 	app.Version(version.Print("pushgateway"))
 	app.HelpFlag.Short('h')
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	if cmd == inspectCmd.FullCommand() {
+		encryptionKey, err := readEncryptionKey(*encryptionKeyFile)
+		app.FatalIfError(err, "could not read encryption key")
+		app.FatalIfError(runInspect(os.Stdout, *inspectFile, inspectOptions{
+			format:        *inspectFormat,
+			compression:   *inspectCompression,
+			deleteGroups:  *inspectDelete,
+			output:        *inspectOutput,
+			encryptionKey: encryptionKey,
+		}), "inspect")
+		return
+	}
+
 	logger := promlog.New(&promlogConfig)
+	serviceStopCh, serviceStopped := runService(logger)
 
 	*routePrefix = computeRoutePrefix(*routePrefix, *externalURL)
 	externalPathPrefix := computeRoutePrefix("", *externalURL)
@@ -96,34 +233,270 @@ func main() {
 		}
 	}
 
-	ms := storage.NewDiskMetricStore(*persistenceFile, *persistenceInterval, prometheus.DefaultGatherer, logger)
+	sources := settingsSources{
+		configFile:  *configFile,
+		authFile:    *authFile,
+		aclFile:     *aclFile,
+		relabelFile: *relabelFile,
+		tenantsFile: *tenantsFile,
+		limits: storage.Limits{
+			MaxGroups:           *maxGroups,
+			MaxFamiliesPerGroup: *maxFamiliesPerGroup,
+			MaxSamples:          *maxSamplesTotal,
+			MaxSeriesPerGroup:   *maxSeriesPerGroup,
+			MaxLabelsPerMetric:  *maxLabelsPerMetric,
+			MaxLabelValueLength: *maxLabelValueLength,
+			Truncate:            *limitAction == "truncate",
+		},
+		clientCerts: *tlsClientCAFile != "",
+	}
+	initialSettings, err := sources.load()
+	if err != nil {
+		level.Error(logger).Log("msg", "could not load configuration", "err", err)
+		os.Exit(1)
+	}
+
+	// Set up before the metric store, so that restoring it is traced.
+	var spanExporter *tracing.Exporter
+	if *tracingEndpoint != "" {
+		if spanExporter, err = tracing.NewExporter(*tracingEndpoint, "pushgateway", version.Version, logger); err != nil {
+			level.Error(logger).Log("msg", "could not set up tracing", "err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(spanExporter)
+		tracing.SetTracer(tracing.NewTracer(spanExporter, *tracingRatio))
+	}
+
+	encryptionKey, err := readEncryptionKey(*encryptionKeyFile)
+	if err != nil {
+		level.Error(logger).Log("msg", "could not read encryption key", "file", *encryptionKeyFile, "err", err)
+		os.Exit(1)
+	}
+	storeOpts := storage.BackendOptions{
+		PersistenceFile:          *persistenceFile,
+		PersistenceInterval:      *persistenceInterval,
+		CompactionInterval:       *compactionInterval,
+		PersistLagWarning:        *persistLagWarning,
+		Sync:                     storage.SyncPolicy(*persistenceSync),
+		Compression:              storage.Compression(*compression),
+		PersistenceIndex:         *persistenceIndex,
+		PersistenceURL:           *persistenceURL,
+		EncryptionKey:            encryptionKey,
+		GatherPredefinedHelpFrom: prometheus.DefaultGatherer,
+		Logger:                   logger,
+		Limits:                   initialSettings.limits,
+		Retention: storage.Retention{
+			MaxGroupsPerJob: *maxGroupsPerJob,
+			MaxAge:          *maxGroupAge,
+		},
+		EmptyGroups:    storage.EmptyGroupPolicy(*emptyGroups),
+		GroupMetrics:   *groupMetrics,
+		InternInterval: *internInterval,
+		WriteQueue: storage.WriteQueueOptions{
+			Capacity:     *queueCapacity,
+			Timeout:      *queueTimeout,
+			SpillDir:     *queueSpillDir,
+			SpillMaxSize: int64(*queueSpillMaxSize),
+			BatchSize:    *queueBatchSize,
+		},
+	}
+	ms, err := storage.NewMetricStore(*persistenceBackend, storeOpts)
+	if err != nil {
+		level.Error(logger).Log("msg", "could not create metric store", "backend", *persistenceBackend, "err", err)
+		os.Exit(1)
+	}
+	if c, ok := ms.(prometheus.Collector); ok {
+		prometheus.MustRegister(c)
+	}
+	if sr, ok := ms.(storage.StatusReporter); ok && !sr.Status().Persisting {
+		level.Warn(logger).Log("msg", "metrics are only kept in memory and lost upon restart, set --persistence.file to persist them")
+	}
+	// localMS receives changes replicated from peers, which must not be
+	// replicated again.
+	localMS := ms
+	var peerSecret string
+	if *clusterSecretFile != "" {
+		peerSecret, err = readSecretFile(*clusterSecretFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not read peer secret", "file", *clusterSecretFile, "err", err)
+			os.Exit(1)
+		}
+	}
+	if len(*clusterPeers) > 0 && peerSecret == "" {
+		level.Error(logger).Log("msg", "replicating to peers requires --cluster.secret-file")
+		os.Exit(1)
+	}
+	var replicator *cluster.Replicator
+	if len(*clusterPeers) > 0 || *clusterServe {
+		replicator, err = cluster.NewReplicator(ms, *clusterPeers, peerSecret, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not set up replication", "err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(replicator)
+		ms = replicator
+		if len(*clusterPeers) > 0 {
+			level.Info(logger).Log("msg", "replicating changes", "peers", strings.Join(*clusterPeers, ","))
+		}
+	}
+	if len(*remoteWriteURLs) > 0 {
+		f, err := remotewrite.NewForwarder(ms, *remoteWriteURLs, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not set up remote-write forwarding", "err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(f)
+		ms = f
+		level.Info(logger).Log("msg", "forwarding pushes via remote write", "endpoints", strings.Join(*remoteWriteURLs, ","))
+	}
+
+	// Each tenant has its own metric store, which is neither replicated nor
+	// forwarded.
+	tenantStores := map[string]storage.MetricStore{}
+	if initialSettings.tenants != nil {
+		for id, tc := range initialSettings.tenants.Tenants {
+			tms, err := storage.NewMetricStore(*persistenceBackend, tenantStoreOptions(storeOpts, id, tc.Limits))
+			if err != nil {
+				level.Error(logger).Log("msg", "could not create metric store for tenant", "tenant", id, "err", err)
+				os.Exit(1)
+			}
+			tenantStores[id] = tms
+		}
+		level.Info(logger).Log("msg", "multi-tenancy is enabled", "tenants", len(tenantStores))
+	}
+
+	var notifier *webhook.Notifier
+	if len(*webhookURLs) > 0 {
+		notifier, err = webhook.NewNotifier(*webhookURLs, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not set up webhooks", "err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(notifier)
+		// Removals are detected by the stores themselves, so replicated
+		// deletions are notified by every peer.
+		if rhs, ok := localMS.(removalHookSetter); ok {
+			rhs.SetRemovalHook(notifier.Hook(""))
+		}
+		for id, tms := range tenantStores {
+			if rhs, ok := tms.(removalHookSetter); ok {
+				rhs.SetRemovalHook(notifier.Hook(id))
+			}
+		}
+		level.Info(logger).Log("msg", "notifying webhooks about removed groups", "webhooks", strings.Join(*webhookURLs, ","))
+	}
+
+	var sdWriter *sd.Writer
+	if *sdFile != "" {
+		target := *sdTarget
+		if target == "" {
+			if target, err = defaultSDTarget(*listenAddress); err != nil {
+				level.Error(logger).Log("msg", "could not determine service discovery target, set --sd.target", "err", err)
+				os.Exit(1)
+			}
+		}
+		sdWriter = sd.NewWriter(ms, sd.Options{
+			File:     *sdFile,
+			Target:   target,
+			PushPath: *routePrefix + "/metrics",
+			PerGroup: *sdPerGroup,
+			Interval: *sdInterval,
+		}, logger)
+		level.Info(logger).Log("msg", "writing service discovery file", "file", *sdFile, "target", target)
+	}
+
+	var scraper *scrape.Scraper
+	if *scrapeConfigFile != "" {
+		scrapeCfg, err := scrape.LoadConfigFile(*scrapeConfigFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not load scrape config", "err", err)
+			os.Exit(1)
+		}
+		scraper = scrape.NewScraper(ms, scrapeCfg, logger)
+		prometheus.MustRegister(scraper)
+		level.Info(logger).Log("msg", "scraping targets", "file", *scrapeConfigFile, "targets", len(scrapeCfg.Targets))
+	}
+
+	var statsdListener *statsd.Listener
+	if *statsdAddress != "" {
+		statsdListener, err = statsd.NewListener(ms, *statsdAddress, statsd.Options{
+			Job:           *statsdJob,
+			GroupingTags:  *statsdGroupingTags,
+			FlushInterval: *statsdFlushInterval,
+		}, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not listen for statsd metrics", "err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(statsdListener)
+		level.Info(logger).Log("msg", "accepting statsd metrics", "address", *statsdAddress)
+	}
 
-	// Create a Gatherer combining the DefaultGatherer and the metrics from the metric store.
-	g := prometheus.Gatherers{
-		prometheus.DefaultGatherer,
-		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return ms.GetMetricFamilies(), nil }),
+	var graphiteListener *graphite.Listener
+	if *graphiteAddress != "" {
+		var mappings []*graphite.Mapping
+		if *graphiteMappingFile != "" {
+			mappingCfg, err := graphite.LoadMappingFile(*graphiteMappingFile)
+			if err != nil {
+				level.Error(logger).Log("msg", "could not load Graphite mappings", "err", err)
+				os.Exit(1)
+			}
+			mappings = mappingCfg.Mappings
+		}
+		graphiteListener, err = graphite.NewListener(ms, *graphiteAddress, graphite.Options{
+			Job:           *graphiteJob,
+			Mappings:      mappings,
+			TTL:           *graphiteTTL,
+			FlushInterval: *graphiteFlushPeriod,
+		}, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not listen for Graphite metrics", "err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(graphiteListener)
+		level.Info(logger).Log("msg", "accepting Graphite metrics", "address", *graphiteAddress, "mappings", len(mappings))
 	}
 
 	r := route.New()
 	r.Get(*routePrefix+"/-/healthy", handler.Healthy(ms).ServeHTTP)
 	r.Get(*routePrefix+"/-/ready", handler.Ready(ms).ServeHTTP)
+	// The scrape endpoint combines the DefaultGatherer and the metrics from
+	// the metric store, read from localMS to select them efficiently.
 	r.Get(
 		path.Join(*routePrefix, *metricsPath),
-		promhttp.HandlerFor(g, promhttp.HandlerOpts{
-			ErrorLog: logFunc(level.Error(logger).Log),
-		}).ServeHTTP,
+		scrapeHandler(prometheus.DefaultGatherer, localMS, *annotationsInfo, *attachPushTimes, *streamScrapes, logger).ServeHTTP,
 	)
 
-	// Handlers for pushing and deleting metrics.
+	relabelRules := handler.NewRelabelRules(initialSettings.relabelConfigs)
+	if len(initialSettings.relabelConfigs) > 0 {
+		level.Info(logger).Log("msg", "relabeling pushed metrics", "rules", len(initialSettings.relabelConfigs))
+	}
+
+	// Handlers for pushing, deleting, and reading back metrics.
 	pushAPIPath := *routePrefix + "/metrics"
-	for _, suffix := range []string{"", handler.Base64Suffix} {
-		jobBase64Encoded := suffix == handler.Base64Suffix
-		r.Put(pushAPIPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, true, !*pushUnchecked, jobBase64Encoded, logger))
-		r.Post(pushAPIPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, false, !*pushUnchecked, jobBase64Encoded, logger))
-		r.Del(pushAPIPath+"/job"+suffix+"/:job/*labels", handler.Delete(ms, jobBase64Encoded, logger))
-		r.Put(pushAPIPath+"/job"+suffix+"/:job", handler.Push(ms, true, !*pushUnchecked, jobBase64Encoded, logger))
-		r.Post(pushAPIPath+"/job"+suffix+"/:job", handler.Push(ms, false, !*pushUnchecked, jobBase64Encoded, logger))
-		r.Del(pushAPIPath+"/job"+suffix+"/:job", handler.Delete(ms, jobBase64Encoded, logger))
+	registerPushRoutes(r, pushAPIPath, ms, !*pushUnchecked, handler.TimestampPolicy(*timestampPolicy), handler.LabelConflictPolicy(*labelConflictPolicy), handler.ValidationPolicy(*validationPolicy), relabelRules, logger)
+	// The endpoints for other protocols are limited like pushes here, as
+	// they are not below pushAPIPath.
+	limitPushes := func(h http.Handler) http.Handler {
+		if *pushMaxBodySize > 0 || *pushTimeout > 0 {
+			return handler.LimitPushes(int64(*pushMaxBodySize), *pushTimeout, "", h)
+		}
+		return h
+	}
+	otlpPath := *routePrefix + handler.OTLPPath
+	if *enableOTLP {
+		r.Post(otlpPath, limitPushes(handler.OTLP(ms, !*pushUnchecked, *otlpGroupingAttrs, handler.ValidationPolicy(*validationPolicy), relabelRules, logger)).ServeHTTP)
+	}
+	influxDBPath := *routePrefix + handler.InfluxDBPath
+	if *enableInfluxDB {
+		r.Post(influxDBPath, limitPushes(handler.InfluxDB(ms, !*pushUnchecked, *influxDBJob, *influxDBGroupingTags, handler.ValidationPolicy(*validationPolicy), relabelRules, logger)).ServeHTTP)
+	}
+	// Tenants get the same handlers below their own path, plus a scrape
+	// endpoint exposing only their metrics.
+	for id, tms := range tenantStores {
+		tenantPushPath := handler.TenantPath(*routePrefix, id) + "/metrics"
+		registerPushRoutes(r, tenantPushPath, tms, !*pushUnchecked, handler.TimestampPolicy(*timestampPolicy), handler.LabelConflictPolicy(*labelConflictPolicy), handler.ValidationPolicy(*validationPolicy), relabelRules, log.With(logger, "tenant", id))
+		r.Get(tenantPushPath, scrapeHandler(tenantRegistry(tms), tms, *annotationsInfo, *attachPushTimes, *streamScrapes, logger).ServeHTTP)
 	}
 	r.Get(*routePrefix+"/static/*filepath", handler.Static(asset.Assets, *routePrefix).ServeHTTP)
 
@@ -134,13 +507,46 @@ func main() {
 	// Re-enable pprof.
 	r.Get(*routePrefix+"/debug/pprof/*pprof", handlePprof)
 
+	mode, err := parseSocketMode(*socketMode)
+	if err != nil {
+		level.Error(logger).Log("err", err)
+		os.Exit(1)
+	}
+	sockOpts := socketOptions{mode: mode, group: *socketGroup}
 	level.Info(logger).Log("listen_address", *listenAddress)
-	l, err := net.Listen("tcp", *listenAddress)
+	l, err := listen(*listenAddress, sockOpts)
 	if err != nil {
 		level.Error(logger).Log("err", err)
 		os.Exit(1)
 	}
 
+	if (*tlsCertFile == "") != (*tlsKeyFile == "") {
+		level.Error(logger).Log("msg", "--web.tls-cert-file and --web.tls-key-file have to be set together")
+		os.Exit(1)
+	}
+	if *tlsClientCAFile != "" && *tlsCertFile == "" {
+		level.Error(logger).Log("msg", "--web.tls-client-ca-file requires --web.tls-cert-file and --web.tls-key-file")
+		os.Exit(1)
+	}
+	var tlsConfig *tls.Config // nil if TLS is disabled.
+	if *tlsCertFile != "" {
+		cr, err := newCertReloader(*tlsCertFile, *tlsKeyFile, logger)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		tlsConfig, err = newTLSConfig(cr, *tlsClientCAFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not create TLS config", "err", err)
+			os.Exit(1)
+		}
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go cr.watch(certCheckInterval, hupCh)
+		l = tls.NewListener(l, tlsConfig)
+		level.Info(logger).Log("msg", "TLS is enabled", "client_auth", *tlsClientCAFile != "")
+	}
+
 	quitCh := make(chan struct{})
 	quitHandler := func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Requesting termination... Goodbye!")
@@ -152,12 +558,21 @@ func main() {
 		w.Write([]byte("Lifecycle API is not enabled."))
 	}
 
+	// The reloader is only created further down, once the handlers it
+	// swaps are known.
+	var rl *reloader
+	reloadHandler := func(w http.ResponseWriter, r *http.Request) {
+		rl.ServeHTTP(w, r)
+	}
+
 	if *enableLifeCycle {
 		r.Put(*routePrefix+"/-/quit", quitHandler)
 		r.Post(*routePrefix+"/-/quit", quitHandler)
+		r.Post(*routePrefix+"/-/reload", reloadHandler)
 	} else {
 		r.Put(*routePrefix+"/-/quit", forbiddenAPINotEnabled)
 		r.Post(*routePrefix+"/-/quit", forbiddenAPINotEnabled)
+		r.Post(*routePrefix+"/-/reload", forbiddenAPINotEnabled)
 	}
 
 	r.Get("/-/quit", func(w http.ResponseWriter, _ *http.Request) {
@@ -178,30 +593,439 @@ func main() {
 	}
 
 	apiv1 := api_v1.New(logger, ms, flags, buildInfo)
+	// The store is reported as is, without replication or forwarding.
+	if sr, ok := localMS.(storage.StatusReporter); ok {
+		apiv1.StatusReporter = sr
+	}
+	apiv1.ParsePush = func(r *http.Request, labels map[string]string, replace bool) (storage.WriteRequest, error) {
+		return handler.ParsePush(r, labels, replace, handler.TimestampPolicy(*timestampPolicy), handler.LabelConflictPolicy(*labelConflictPolicy), handler.ValidationPolicy(*validationPolicy), relabelRules)
+	}
+	if v, ok := localMS.(storage.ValidatingMetricStore); ok {
+		apiv1.Validator = v
+	}
+	if *quarantineSize > 0 {
+		apiv1.Quarantine = handler.NewQuarantine(*quarantineSize, int(*quarantineBodySize))
+	}
 
 	apiPath := "/api"
 	if *routePrefix != "/" {
 		apiPath = *routePrefix + apiPath
 	}
 
+	var apiKeys *handler.APIKeyStore
+	if *apiKeysFile == "" && *persistenceFile != "" {
+		*apiKeysFile = *persistenceFile + ".api-keys"
+	}
+	if *apiKeysFile != "" {
+		if apiKeys, err = handler.NewAPIKeyStore(*apiKeysFile); err != nil {
+			level.Error(logger).Log("msg", "could not load API keys", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	readOnlyMode := &handler.ReadOnlyMode{}
+	readOnlyMode.Set(*readOnly || *clusterFollow != "")
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "pushgateway_read_only",
+			Help: "Whether the Pushgateway is in read-only mode (1) or not (0).",
+		},
+		func() float64 {
+			if readOnlyMode.Enabled() {
+				return 1
+			}
+			return 0
+		},
+	))
+
 	av1 := route.New()
 	apiv1.Register(av1)
+	if peerSecret != "" {
+		av1.Post("/replicate", limitPushes(handler.Replicate(localMS, peerSecret, *enableAdminAPI, logger)).ServeHTTP)
+	}
+	if *enableRemoteWrite {
+		av1.Post(handler.RemoteWritePath, limitPushes(handler.RemoteWrite(ms, !*pushUnchecked, *remoteWriteJob, *remoteWriteGrouping, handler.ValidationPolicy(*validationPolicy), relabelRules, logger)).ServeHTTP)
+	}
+	if *clusterServe {
+		av1.Get("/changes", handler.InstrumentWithCounter("changes", http.HandlerFunc(replicator.ServeChanges)).ServeHTTP)
+	}
+	var follower *cluster.Follower
+	if *clusterFollow != "" {
+		// Changes from the primary are applied like replicated ones,
+		// i.e. neither replicated again nor forwarded.
+		follower, err = cluster.NewFollower(localMS, *clusterFollow, readOnlyMode.Enabled, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "could not set up following", "err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(follower)
+		go follower.Run()
+		level.Info(logger).Log("msg", "following primary in read-only mode", "primary", *clusterFollow)
+	}
+	av1.Put("/groups/*grouping", handler.Lock(ms, true, logger).ServeHTTP)
+	av1.Del("/groups/*grouping", handler.Lock(ms, false, logger).ServeHTTP)
+	av1.Post("/groups/"+handler.RenameSegment, handler.Rename(ms, logger).ServeHTTP)
 	if *enableAdminAPI {
 		av1.Put("/admin/wipe", handler.WipeMetricStore(ms, logger).ServeHTTP)
+		av1.Get("/admin/snapshot", handler.Snapshot(ms, logger).ServeHTTP)
+		av1.Get("/admin/backup", handler.Backup(ms, logger).ServeHTTP)
+		av1.Post("/admin/restore", handler.Restore(ms, logger).ServeHTTP)
+		av1.Get("/admin/read-only", handler.GetReadOnly(readOnlyMode, logger).ServeHTTP)
+		av1.Put("/admin/read-only", handler.SetReadOnly(readOnlyMode, true, logger).ServeHTTP)
+		av1.Del("/admin/read-only", handler.SetReadOnly(readOnlyMode, false, logger).ServeHTTP)
+		if apiKeys != nil {
+			av1.Post("/admin/api-keys", handler.CreateAPIKey(apiKeys, logger).ServeHTTP)
+			av1.Get("/admin/api-keys", handler.ListAPIKeys(apiKeys, logger).ServeHTTP)
+			av1.Del("/admin/api-keys/:id", handler.RevokeAPIKey(apiKeys, logger).ServeHTTP)
+			av1.Post("/admin/api-keys/:id/rotate", handler.RotateAPIKey(apiKeys, logger).ServeHTTP)
+		}
 	}
 
 	mux.Handle(apiPath+"/v1/", http.StripPrefix(apiPath+"/v1", av1))
 
-	go closeListenerOnQuit(l, quitCh, logger)
-	err = (&http.Server{Addr: *listenAddress, Handler: mux}).Serve(l)
-	level.Error(logger).Log("msg", "HTTP server stopped", "err", err)
-	// To give running connections a chance to submit their payload, we wait
-	// for 1sec, but we don't want to wait long (e.g. until all connections
-	// are done) to not delay the shutdown.
-	time.Sleep(time.Second)
+	var h http.Handler = mux
+	readOnlyPaths := []string{
+		pushAPIPath,
+		otlpPath,
+		influxDBPath,
+		apiPath + "/v1" + handler.RemoteWritePath,
+		apiPath + "/v1/replicate",
+		apiPath + "/v1/groups",
+		apiPath + "/v1/admin/wipe",
+		apiPath + "/v1/admin/restore",
+	}
+	for id := range tenantStores {
+		readOnlyPaths = append(readOnlyPaths, handler.TenantPath(*routePrefix, id)+"/metrics")
+	}
+	h = handler.RejectWrites(readOnlyMode, h, readOnlyPaths...)
+	// Inside the body size limit, so that reading the body for the
+	// quarantine is limited, too.
+	if apiv1.Quarantine != nil {
+		h = handler.QuarantineRejected(apiv1.Quarantine, pushAPIPath, h)
+		for id := range tenantStores {
+			h = handler.QuarantineRejected(apiv1.Quarantine, handler.TenantPath(*routePrefix, id)+"/metrics", h)
+		}
+	}
+	if *pushMaxBodySize > 0 || *pushTimeout > 0 {
+		h = handler.LimitPushes(int64(*pushMaxBodySize), *pushTimeout, pushAPIPath, h)
+		for id := range tenantStores {
+			h = handler.LimitPushes(int64(*pushMaxBodySize), *pushTimeout, handler.TenantPath(*routePrefix, id)+"/metrics", h)
+		}
+	}
+	if *authzWebhookURL != "" {
+		wh, err := handler.NewAuthzWebhook(*authzWebhookURL, *authzWebhookTimeout, *authzWebhookTTL)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		prometheus.MustRegister(wh)
+		h = handler.AuthorizeWebhook(wh, pushAPIPath, apiPath+"/v1/groups", h, logger)
+	}
+	if *pushRateLimit != "" || *pushIPRateLimit != "" {
+		perGroup, err := newRateLimiter(*pushRateLimit)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid per-group rate limit", "err", err)
+			os.Exit(1)
+		}
+		perIP, err := newRateLimiter(*pushIPRateLimit)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid per-IP rate limit", "err", err)
+			os.Exit(1)
+		}
+		h = handler.RateLimit(perIP, perGroup, pushAPIPath, h, logger)
+	}
+	// Authentication and ACLs are rebuilt upon every reload.
+	authorized := h
+	rl = newReloader(sources, localMS, tenantStores, relabelRules, func(s *settings) http.Handler {
+		h := authorized
+		if s.acl != nil {
+			h = handler.AuthorizeJobs(s.acl, pushAPIPath, apiPath+"/v1/groups", h, logger)
+		}
+		// Tenants with their own credentials bypass the global
+		// authentication.
+		unauthenticated := h
+		if s.auth != nil {
+			h = handler.Authenticate(s.auth, *routePrefix, h, logger)
+		}
+		// API keys carry their own scope and thus bypass the ACLs, too.
+		if apiKeys != nil {
+			h = handler.AuthenticateAPIKeys(apiKeys, pushAPIPath, apiPath+"/v1/groups", authorized, h, logger)
+		}
+		if s.tenants != nil {
+			h = handler.AuthenticateTenants(s.tenants, *routePrefix, unauthenticated, h, logger)
+		}
+		return h
+	}, logger)
+	rl.apply(initialSettings)
+	prometheus.MustRegister(rl)
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go rl.reloadOnSignal(reloadCh)
+	h = rl.handler
+	if *auditFile != "" {
+		al, err := audit.New(*auditFile, int64(*auditMaxSize), *auditMaxBackups)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		defer al.Close()
+		prometheus.MustRegister(al)
+		h = handler.Audit(al, "", pushAPIPath, h, logger)
+		for id := range tenantStores {
+			h = handler.Audit(al, id, handler.TenantPath(*routePrefix, id)+"/metrics", h, logger)
+		}
+	}
+	// Outermost, so that all of the above see the resulting group.
+	if *instanceFromClient != "" {
+		source := handler.InstanceSource(*instanceFromClient)
+		h = handler.DefaultInstance(source, pushAPIPath, h)
+		for id := range tenantStores {
+			h = handler.DefaultInstance(source, handler.TenantPath(*routePrefix, id)+"/metrics", h)
+		}
+	}
+	// Tracing wraps all of the above, so that the spans include the time
+	// spent in authentication, rate limiting, etc.
+	if spanExporter != nil {
+		h = handler.Trace(pushAPIPath, path.Join(*routePrefix, *metricsPath), h)
+		for id := range tenantStores {
+			tenantPushPath := handler.TenantPath(*routePrefix, id) + "/metrics"
+			h = handler.Trace(tenantPushPath, tenantPushPath, h)
+		}
+	}
+
+	serverOpts := serverOptions{
+		readTimeout:          *readTimeout,
+		writeTimeout:         *writeTimeout,
+		idleTimeout:          *idleTimeout,
+		maxConcurrentStreams: *maxConcurrentStreams,
+		h2c:                  *enableH2C,
+	}
+	var grpcSrv *grpc.Server
+	if *grpcListenAddress != "" {
+		sharedPort := *grpcListenAddress == *listenAddress
+		var opts []grpc.ServerOption
+		if tlsConfig != nil && !sharedPort {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		grpcSrv = grpcapi.NewServer(h, pushAPIPath, logger, opts...)
+		if sharedPort {
+			h = grpcapi.Handler(grpcSrv, h)
+			// gRPC requires HTTP/2.
+			serverOpts.h2c = true
+		} else {
+			level.Info(logger).Log("msg", "serving gRPC", "grpc_listen_address", *grpcListenAddress)
+			gl, err := listen(*grpcListenAddress, sockOpts)
+			if err != nil {
+				level.Error(logger).Log("err", err)
+				os.Exit(1)
+			}
+			go func() {
+				if err := grpcSrv.Serve(gl); err != nil {
+					level.Error(logger).Log("msg", "gRPC server stopped", "err", err)
+				}
+			}()
+		}
+	}
+
+	srv, err := newServer(*listenAddress, h, tlsConfig, serverOpts)
+	if err != nil {
+		level.Error(logger).Log("msg", "could not configure HTTP server", "err", err)
+		os.Exit(1)
+	}
+	if replicator != nil {
+		// Streams of changes never end on their own.
+		srv.RegisterOnShutdown(replicator.CloseChangeStreams)
+	}
+	shutdownDone := make(chan struct{})
+	go shutdownServerOnQuit(srv, quitCh, serviceStopCh, *shutdownTimeout, shutdownDone, logger)
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		level.Error(logger).Log("msg", "HTTP server stopped", "err", err)
+	} else {
+		// Wait for in-flight requests, so that pushes already received
+		// make it into the metric store before it is shut down.
+		<-shutdownDone
+	}
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
+	if follower != nil {
+		follower.Stop()
+	}
+	if scraper != nil {
+		scraper.Stop()
+	}
+	if statsdListener != nil {
+		statsdListener.Close()
+	}
+	if graphiteListener != nil {
+		graphiteListener.Close()
+	}
+	// Shutting down the metric store processes all queued write requests
+	// and persists the result.
 	if err := ms.Shutdown(); err != nil {
 		level.Error(logger).Log("msg", "problem shutting down metric storage", "err", err)
 	}
+	for id, tms := range tenantStores {
+		if err := tms.Shutdown(); err != nil {
+			level.Error(logger).Log("msg", "problem shutting down metric storage", "tenant", id, "err", err)
+		}
+	}
+	// Only now, as shutting down the metric stores may still remove groups.
+	if notifier != nil {
+		notifier.Close()
+	}
+	if sdWriter != nil {
+		sdWriter.Stop()
+	}
+	if spanExporter != nil {
+		tracing.SetTracer(nil)
+		spanExporter.Shutdown()
+	}
+	serviceStopped()
+}
+
+// defaultSDTarget returns the target to list in the service discovery file if
+// none is configured, i.e. the provided listen address, using the host name of
+// the machine if the address has no host.
+func defaultSDTarget(listenAddress string) (string, error) {
+	if strings.HasPrefix(listenAddress, unixPrefix) {
+		return "", errors.New("cannot derive a target from a UNIX domain socket")
+	}
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		if host, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// removalHookSetter is implemented by metric stores that can report removed
+// groups, like storage.DiskMetricStore.
+type removalHookSetter interface {
+	SetRemovalHook(func(storage.GroupRemoval))
+}
+
+// registerPushRoutes registers the handlers for pushing, deleting, and reading
+// back the metrics in ms below pushPath.
+func registerPushRoutes(
+	r *route.Router,
+	pushPath string,
+	ms storage.MetricStore,
+	check bool,
+	timestampPolicy handler.TimestampPolicy,
+	labelConflictPolicy handler.LabelConflictPolicy,
+	validationPolicy handler.ValidationPolicy,
+	relabelRules *handler.RelabelRules,
+	logger log.Logger,
+) {
+	for _, suffix := range []string{"", handler.Base64Suffix} {
+		jobBase64Encoded := suffix == handler.Base64Suffix
+		r.Put(pushPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, true, check, jobBase64Encoded, timestampPolicy, labelConflictPolicy, validationPolicy, relabelRules, logger))
+		r.Post(pushPath+"/job"+suffix+"/:job/*labels", handler.Push(ms, false, check, jobBase64Encoded, timestampPolicy, labelConflictPolicy, validationPolicy, relabelRules, logger))
+		r.Del(pushPath+"/job"+suffix+"/:job/*labels", handler.Delete(ms, jobBase64Encoded, logger))
+		r.Put(pushPath+"/job"+suffix+"/:job", handler.Push(ms, true, check, jobBase64Encoded, timestampPolicy, labelConflictPolicy, validationPolicy, relabelRules, logger))
+		r.Post(pushPath+"/job"+suffix+"/:job", handler.Push(ms, false, check, jobBase64Encoded, timestampPolicy, labelConflictPolicy, validationPolicy, relabelRules, logger))
+		r.Del(pushPath+"/job"+suffix+"/:job", handler.Delete(ms, jobBase64Encoded, logger))
+		r.Get(pushPath+"/job"+suffix+"/:job/*labels", handler.GroupMetrics(ms, jobBase64Encoded, logger).ServeHTTP)
+		r.Get(pushPath+"/job"+suffix+"/:job", handler.GroupMetrics(ms, jobBase64Encoded, logger).ServeHTTP)
+	}
+}
+
+// tenantStoreOptions derives the BackendOptions for the metric store of the
+// tenant with the provided ID from the global ones. The tenant persists to its
+// own file or below its own object storage prefix, and its limits override the
+// global ones.
+func tenantStoreOptions(o storage.BackendOptions, id string, limits handler.TenantLimits) storage.BackendOptions {
+	if o.PersistenceFile != "" {
+		o.PersistenceFile += ".tenant-" + id
+	}
+	if o.PersistenceURL != "" {
+		if u, err := url.Parse(o.PersistenceURL); err == nil {
+			u.Path = path.Join("/", u.Path, handler.TenantsSegment, id)
+			o.PersistenceURL = u.String()
+		}
+	}
+	o.Limits = tenantLimits(o.Limits, limits)
+	o.Logger = log.With(o.Logger, "tenant", id)
+	return o
+}
+
+// scrapeHandler returns the handler for a scrape endpoint, which exposes the
+// metrics gathered from others and the metrics in ms (see storeGatherer). Both
+// can be selected via the "match[]" query parameter, see handler.Match. If
+// stream is true, the metrics in ms are streamed, see handler.Stream.
+func scrapeHandler(others prometheus.Gatherer, ms storage.MetricStore, annotationsInfo, attachPushTimes, stream bool, logger log.Logger) http.Handler {
+	build := func(selectors []storage.Selector, shard storage.Shard) http.Handler {
+		othersGatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			// The other metrics do not belong to any group,
+			// so only the first shard exposes them.
+			if shard.Index > 1 {
+				return nil, nil
+			}
+			mfs, err := others.Gather()
+			return storage.SelectMetricFamilies(mfs, selectors), err
+		})
+		if stream {
+			return handler.Stream(othersGatherer, func(groups storage.GroupingKeyToMetricGroup) []*dto.MetricFamily {
+				return groupInfoFamilies(groups, annotationsInfo, selectors)
+			}, ms, shard, selectors, attachPushTimes, logger)
+		}
+		var g prometheus.Gatherer = prometheus.Gatherers{
+			othersGatherer,
+			storeGatherer(ms, annotationsInfo, selectors, shard),
+		}
+		if attachPushTimes {
+			g = handler.AttachPushTimestamps(g, ms)
+		}
+		return handler.OpenMetrics(g, ms, promhttp.HandlerFor(g, promhttp.HandlerOpts{
+			ErrorLog: logFunc(level.Error(logger).Log),
+		}), logger)
+	}
+	return handler.Match(build(nil, storage.Shard{}), build)
+}
+
+// tenantRegistry returns a Gatherer for the metrics about the metric store of a
+// tenant, to be exposed on the tenant's scrape endpoint instead of the metrics
+// of the Pushgateway process.
+func tenantRegistry(ms storage.MetricStore) prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	if c, ok := ms.(prometheus.Collector); ok {
+		reg.MustRegister(c)
+	}
+	return reg
+}
+
+// storeGatherer returns a Gatherer for the metrics in ms matched by any of the
+// provided selectors (or all of them if there are none) in groups of the
+// provided shard, including the push overdue metric for groups with an
+// expected push interval, and the annotations info metric if annotationsInfo is
+// true.
+func storeGatherer(ms storage.MetricStore, annotationsInfo bool, selectors []storage.Selector, shard storage.Shard) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs := storage.ShardMetricFamilies(ms, shard, selectors)
+		groups := shard.Groups(ms.GetMetricFamiliesMap())
+		return append(mfs, groupInfoFamilies(groups, annotationsInfo, selectors)...), nil
+	})
+}
+
+// groupInfoFamilies returns the push overdue metric for the provided groups with
+// an expected push interval, and the annotations info metric if annotationsInfo
+// is true, restricted to the metrics matched by any of the provided selectors.
+func groupInfoFamilies(groups storage.GroupingKeyToMetricGroup, annotationsInfo bool, selectors []storage.Selector) []*dto.MetricFamily {
+	var mfs []*dto.MetricFamily
+	if mf := storage.PushOverdue(groups, time.Now()); mf != nil {
+		mfs = append(mfs, storage.SelectMetricFamilies([]*dto.MetricFamily{mf}, selectors)...)
+	}
+	if annotationsInfo {
+		if mf := storage.AnnotationsInfo(groups); mf != nil {
+			mfs = append(mfs, storage.SelectMetricFamilies([]*dto.MetricFamily{mf}, selectors)...)
+		}
+	}
+	return mfs
 }
 
 func handlePprof(w http.ResponseWriter, r *http.Request) {
@@ -217,6 +1041,44 @@ func handlePprof(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// newRateLimiter returns a RateLimiter for the provided rate (see
+// handler.ParseRate), or nil if the rate is empty.
+func newRateLimiter(rate string) (*handler.RateLimiter, error) {
+	if rate == "" {
+		return nil, nil
+	}
+	r, err := handler.ParseRate(rate)
+	if err != nil {
+		return nil, err
+	}
+	return handler.NewRateLimiter(r), nil
+}
+
+// readEncryptionKey returns the secret for encrypting persisted metrics, read
+// from the provided file or, if file is empty, from the environment variable
+// named by encryptionKeyEnv. Surrounding whitespace is removed. An empty string
+// means no encryption.
+func readEncryptionKey(file string) (string, error) {
+	if file == "" {
+		return strings.TrimSpace(os.Getenv(encryptionKeyEnv)), nil
+	}
+	return readSecretFile(file)
+}
+
+// readSecretFile returns the content of the provided file with surrounding
+// whitespace removed. An empty content is an error.
+func readSecretFile(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %q is empty", file)
+	}
+	return secret, nil
+}
+
 // computeRoutePrefix returns the effective route prefix based on the
 // provided flag values for --web.route-prefix and
 // --web.external-url. With prefix empty, the path of externalURL is
@@ -238,9 +1100,19 @@ func computeRoutePrefix(prefix string, externalURL *url.URL) string {
 	return prefix
 }
 
-// closeListenerOnQuite closes the provided listener upon closing the provided
-// quitCh or upon receiving a SIGINT or SIGTERM.
-func closeListenerOnQuit(l net.Listener, quitCh <-chan struct{}, logger log.Logger) {
+// shutdownServerOnQuit gracefully shuts down the provided server upon closing
+// the provided quitCh or serviceStopCh (see runService) or upon receiving a
+// SIGINT or SIGTERM. The server stops accepting new connections right away,
+// while in-flight requests are given timeout to complete. Afterwards, the remaining connections are closed
+// forcefully, and done is closed.
+func shutdownServerOnQuit(
+	srv *http.Server,
+	quitCh <-chan struct{},
+	serviceStopCh <-chan struct{},
+	timeout time.Duration,
+	done chan<- struct{},
+	logger log.Logger,
+) {
 	notifier := make(chan os.Signal, 1)
 	signal.Notify(notifier, os.Interrupt, syscall.SIGTERM)
 
@@ -251,6 +1123,15 @@ func closeListenerOnQuit(l net.Listener, quitCh <-chan struct{}, logger log.Logg
 	case <-quitCh:
 		level.Warn(logger).Log("msg", "received termination request via web service, exiting gracefully...")
 		break
+	case <-serviceStopCh:
+		level.Info(logger).Log("msg", "received stop request from Windows service control manager, exiting gracefully...")
+		break
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		level.Warn(logger).Log("msg", "in-flight requests did not complete in time", "timeout", timeout, "err", err)
+		srv.Close()
 	}
-	l.Close()
+	close(done)
 }
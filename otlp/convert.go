@@ -0,0 +1,389 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otlp converts the metrics in OTLP/HTTP export requests, as sent by
+// OpenTelemetry SDKs and collectors, into metric families grouped by the
+// resource they belong to.
+package otlp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/model"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/ingest"
+)
+
+// The Content-Types of the two encodings of OTLP/HTTP.
+const (
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeJSON     = "application/json"
+)
+
+// The resource attributes the job and instance labels are derived from, as
+// specified for Prometheus by OpenTelemetry.
+const (
+	serviceNameAttribute       = "service.name"
+	serviceNamespaceAttribute  = "service.namespace"
+	serviceInstanceIDAttribute = "service.instance.id"
+)
+
+// targetInfoName is the name of the metric carrying the resource attributes not
+// used as grouping labels.
+const targetInfoName = "target_info"
+
+// Group is the result of converting the metrics of all resources with the same
+// grouping labels.
+type Group struct {
+	Labels map[string]string
+	// MetricFamilies stem from gauges, summaries, and sums and histograms
+	// with cumulative temporality. They replace stored metric families of
+	// the same name.
+	MetricFamilies map[string]*dto.MetricFamily
+	// DeltaFamilies stem from sums and histograms with delta temporality.
+	// They are to be added to the stored metric families of the same name,
+	// see storage.AggregateSum.
+	DeltaFamilies map[string]*dto.MetricFamily
+}
+
+// Result is the result of converting an export request.
+type Result struct {
+	Groups []Group
+	// Rejected is the number of data points that could not be converted,
+	// i.e. those of exponential histograms, those with an unspecified
+	// temporality, and histogram data points with inconsistent buckets.
+	Rejected int
+}
+
+// Convert decodes the provided export request, in the binary protobuf encoding
+// or, if jsonEncoded is true, in the JSON encoding of OTLP, and converts the
+// contained metrics.
+//
+// The job label of a group is the service.name resource attribute, prefixed
+// with the service.namespace attribute and a '/' if present, and the instance
+// label is the service.instance.id attribute (if present). The resource
+// attributes named in groupingAttributes are added to the grouping labels, with
+// their names sanitized like all other names (e.g. "host.name" becomes
+// "host_name"). All other resource attributes become the labels of a
+// target_info gauge with value 1.
+//
+// Metric names and data point attributes become metric names and labels as
+// described above, with monotonic sums getting the suffix "_total". Attributes
+// named like a grouping label are prefixed with "exported_". Data points marked
+// as having no recorded value are skipped, and timestamps are discarded.
+func Convert(b []byte, jsonEncoded bool, groupingAttributes []string) (Result, error) {
+	req, err := unmarshalRequest(b, jsonEncoded)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to decode export request: %v", err)
+	}
+
+	c := converter{groups: map[string]*Group{}, infos: map[string]bool{}}
+	for _, rm := range req.GetResourceMetrics() {
+		g, info := c.group(rm.GetResource().GetAttributes(), groupingAttributes)
+		if info != nil {
+			if err := c.add(g.MetricFamilies, targetInfoName, "Target metadata", dto.MetricType_GAUGE, info); err != nil {
+				return Result{}, err
+			}
+		}
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				if err := c.convert(g, m); err != nil {
+					return Result{}, err
+				}
+			}
+		}
+	}
+	result := Result{Rejected: c.rejected}
+	for _, key := range c.order {
+		result.Groups = append(result.Groups, *c.groups[key])
+	}
+	return result, nil
+}
+
+// MarshalResponse returns the response to an export request, in the binary
+// protobuf encoding or, if jsonEncoded is true, in the JSON encoding of OTLP.
+// If rejected is positive, it reports a partial success.
+func MarshalResponse(jsonEncoded bool, rejected int) []byte {
+	message := fmt.Sprintf("%d data points of exponential histograms, with unspecified temporality, or with inconsistent buckets rejected", rejected)
+	if jsonEncoded {
+		return marshalResponseJSON(rejected, message)
+	}
+	return marshalResponse(rejected, message)
+}
+
+type converter struct {
+	groups   map[string]*Group // By signature of the grouping labels.
+	order    []string          // Signatures in order of appearance.
+	infos    map[string]bool   // Signatures of the target_info metrics added so far.
+	rejected int
+}
+
+// group returns the Group for the resource with the provided attributes,
+// creating it if needed, and the metric for its target_info, or nil if the
+// attributes are all used as grouping labels or the target_info has been added
+// to the Group already.
+func (c *converter) group(attrs []*commonpb.KeyValue, groupingAttributes []string) (*Group, *dto.Metric) {
+	values := map[string]string{}
+	for _, kv := range attrs {
+		values[kv.GetKey()] = attributeString(kv.GetValue())
+	}
+	job := values[serviceNameAttribute]
+	if job == "" {
+		job = "unknown_service" // The default of the SDKs.
+	}
+	if ns := values[serviceNamespaceAttribute]; ns != "" {
+		job = ns + "/" + job
+	}
+	labels := map[string]string{string(model.JobLabel): job}
+	if instance := values[serviceInstanceIDAttribute]; instance != "" {
+		labels[string(model.InstanceLabel)] = instance
+	}
+	delete(values, serviceNameAttribute)
+	delete(values, serviceNamespaceAttribute)
+	delete(values, serviceInstanceIDAttribute)
+	for _, name := range groupingAttributes {
+		if value, ok := values[name]; ok {
+			labels[ingest.LabelName(name)] = value
+			delete(values, name)
+		}
+	}
+
+	key := ingest.Signature(labels)
+	g, ok := c.groups[key]
+	if !ok {
+		g = &Group{
+			Labels:         labels,
+			MetricFamilies: map[string]*dto.MetricFamily{},
+			DeltaFamilies:  map[string]*dto.MetricFamily{},
+		}
+		c.groups[key] = g
+		c.order = append(c.order, key)
+	}
+	if len(values) == 0 {
+		return g, nil
+	}
+	infoLabels := sanitizeLabels(values, labels)
+	infoKey := key + ingest.Signature(infoLabels)
+	if c.infos[infoKey] {
+		return g, nil
+	}
+	c.infos[infoKey] = true
+	return g, &dto.Metric{Label: ingest.LabelPairs(infoLabels), Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+}
+
+// convert adds the data points of the provided metric to the provided Group.
+func (c *converter) convert(g *Group, m *metricspb.Metric) error {
+	name := ingest.MetricName(m.GetName())
+	switch data := m.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		for _, dp := range data.Gauge.GetDataPoints() {
+			if noRecordedValue(dp.GetFlags()) {
+				continue
+			}
+			metric := &dto.Metric{
+				Label: c.labels(dp.GetAttributes(), g.Labels),
+				Gauge: &dto.Gauge{Value: proto.Float64(numberValue(dp))},
+			}
+			if err := c.add(g.MetricFamilies, name, m.GetDescription(), dto.MetricType_GAUGE, metric); err != nil {
+				return err
+			}
+		}
+	case *metricspb.Metric_Sum:
+		mfs, ok := c.families(g, data.Sum.GetAggregationTemporality(), len(data.Sum.GetDataPoints()))
+		if !ok {
+			return nil
+		}
+		typ := dto.MetricType_GAUGE
+		if data.Sum.GetIsMonotonic() {
+			typ = dto.MetricType_COUNTER
+			if !strings.HasSuffix(name, "_total") {
+				name += "_total"
+			}
+		}
+		for _, dp := range data.Sum.GetDataPoints() {
+			if noRecordedValue(dp.GetFlags()) {
+				continue
+			}
+			metric := &dto.Metric{Label: c.labels(dp.GetAttributes(), g.Labels)}
+			if typ == dto.MetricType_COUNTER {
+				metric.Counter = &dto.Counter{Value: proto.Float64(numberValue(dp))}
+			} else {
+				metric.Gauge = &dto.Gauge{Value: proto.Float64(numberValue(dp))}
+			}
+			if err := c.add(mfs, name, m.GetDescription(), typ, metric); err != nil {
+				return err
+			}
+		}
+	case *metricspb.Metric_Histogram:
+		mfs, ok := c.families(g, data.Histogram.GetAggregationTemporality(), len(data.Histogram.GetDataPoints()))
+		if !ok {
+			return nil
+		}
+		for _, dp := range data.Histogram.GetDataPoints() {
+			if noRecordedValue(dp.GetFlags()) {
+				continue
+			}
+			h, ok := histogram(dp)
+			if !ok {
+				c.rejected++
+				continue
+			}
+			metric := &dto.Metric{Label: c.labels(dp.GetAttributes(), g.Labels), Histogram: h}
+			if err := c.add(mfs, name, m.GetDescription(), dto.MetricType_HISTOGRAM, metric); err != nil {
+				return err
+			}
+		}
+	case *metricspb.Metric_Summary:
+		for _, dp := range data.Summary.GetDataPoints() {
+			if noRecordedValue(dp.GetFlags()) {
+				continue
+			}
+			s := &dto.Summary{
+				SampleCount: proto.Uint64(dp.GetCount()),
+				SampleSum:   proto.Float64(dp.GetSum()),
+			}
+			for _, q := range dp.GetQuantileValues() {
+				s.Quantile = append(s.Quantile, &dto.Quantile{
+					Quantile: proto.Float64(q.GetQuantile()),
+					Value:    proto.Float64(q.GetValue()),
+				})
+			}
+			metric := &dto.Metric{Label: c.labels(dp.GetAttributes(), g.Labels), Summary: s}
+			if err := c.add(g.MetricFamilies, name, m.GetDescription(), dto.MetricType_SUMMARY, metric); err != nil {
+				return err
+			}
+		}
+	case *metricspb.Metric_ExponentialHistogram:
+		c.rejected += len(data.ExponentialHistogram.GetDataPoints())
+	}
+	return nil
+}
+
+// noRecordedValue returns whether the provided data point flags mark a data
+// point without a value, e.g. a staleness marker.
+func noRecordedValue(flags uint32) bool {
+	return flags&uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE) != 0
+}
+
+// families returns the metric families of the provided Group to add data points
+// with the provided temporality to. If the temporality is unspecified, it
+// counts the provided number of data points as rejected and returns false.
+func (c *converter) families(g *Group, t metricspb.AggregationTemporality, dataPoints int) (map[string]*dto.MetricFamily, bool) {
+	switch t {
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+		return g.MetricFamilies, true
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+		return g.DeltaFamilies, true
+	}
+	c.rejected += dataPoints
+	return nil, false
+}
+
+// add adds the provided metric to the metric family of the provided name and
+// type in mfs, creating it if needed. It is an error if a metric family of that
+// name but another type exists in the Group already.
+func (c *converter) add(mfs map[string]*dto.MetricFamily, name, help string, typ dto.MetricType, m *dto.Metric) error {
+	mf, ok := mfs[name]
+	if !ok {
+		mf = &dto.MetricFamily{Name: proto.String(name), Type: typ.Enum()}
+		if help != "" {
+			mf.Help = proto.String(help)
+		}
+		mfs[name] = mf
+	}
+	if mf.GetType() != typ {
+		return fmt.Errorf("metric %q received as both %s and %s", name, mf.GetType(), typ)
+	}
+	mf.Metric = append(mf.Metric, m)
+	return nil
+}
+
+// labels returns the provided data point attributes as sorted label pairs.
+func (c *converter) labels(attrs []*commonpb.KeyValue, groupingLabels map[string]string) []*dto.LabelPair {
+	values := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		values[kv.GetKey()] = attributeString(kv.GetValue())
+	}
+	return ingest.LabelPairs(sanitizeLabels(values, groupingLabels))
+}
+
+// numberValue returns the value of the provided data point as a float.
+func numberValue(dp *metricspb.NumberDataPoint) float64 {
+	if v, ok := dp.GetValue().(*metricspb.NumberDataPoint_AsInt); ok {
+		return float64(v.AsInt)
+	}
+	return dp.GetAsDouble()
+}
+
+// histogram returns the provided data point as a Prometheus histogram, with
+// cumulative bucket counts and the +Inf bucket implied by the sample count. It
+// returns false if the bucket counts do not match the bounds.
+func histogram(dp *metricspb.HistogramDataPoint) (*dto.Histogram, bool) {
+	h := &dto.Histogram{SampleCount: proto.Uint64(dp.GetCount())}
+	if dp.Sum != nil {
+		h.SampleSum = proto.Float64(dp.GetSum())
+	}
+	counts, bounds := dp.GetBucketCounts(), dp.GetExplicitBounds()
+	if len(counts) == 0 {
+		return h, true
+	}
+	if len(counts) != len(bounds)+1 {
+		return nil, false
+	}
+	var cumulative uint64
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		h.Bucket = append(h.Bucket, &dto.Bucket{
+			UpperBound:      proto.Float64(bound),
+			CumulativeCount: proto.Uint64(cumulative),
+		})
+	}
+	if cumulative+counts[len(bounds)] != dp.GetCount() {
+		return nil, false
+	}
+	return h, true
+}
+
+// sanitizeLabels returns the provided attributes with sanitized names. Names
+// that end up the same have their values joined by ';' (in order of the
+// original names), names of grouping labels (including the instance label) are
+// prefixed with "exported_", and names starting with "__" with "key".
+func sanitizeLabels(attrs map[string]string, groupingLabels map[string]string) map[string]string {
+	keys := make([]string, 0, len(attrs))
+	for key := range attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := make(map[string]string, len(attrs))
+	for _, key := range keys {
+		name := ingest.LabelName(key)
+		if _, ok := groupingLabels[name]; ok || name == string(model.InstanceLabel) {
+			name = "exported_" + name
+		} else if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			name = "key" + name // Reserved otherwise.
+		}
+		if value, ok := labels[name]; ok {
+			labels[name] = value + ";" + attrs[key]
+			continue
+		}
+		labels[name] = attrs[key]
+	}
+	return labels
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+	protov2 "google.golang.org/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/ingest"
+)
+
+func attribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// protobufRequest returns the binary protobuf encoding of jsonRequest.
+func protobufRequest(t *testing.T) []byte {
+	sum := 0.7
+	req := &metricspb.MetricsData{ResourceMetrics: []*metricspb.ResourceMetrics{{
+		Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+			attribute("service.name", "api"),
+			attribute("service.namespace", "shop"),
+			attribute("service.instance.id", "pod-1"),
+			attribute("host.name", "node-1"),
+			attribute("cloud.region", "eu"),
+		}},
+		ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{
+			{
+				Name:        "http.server.requests",
+				Description: "Number of requests.",
+				Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+					DataPoints: []*metricspb.NumberDataPoint{
+						{
+							Attributes: []*commonpb.KeyValue{attribute("http.method", "GET"), attribute("instance", "x")},
+							Value:      &metricspb.NumberDataPoint_AsInt{AsInt: 7},
+						},
+						{
+							Attributes: []*commonpb.KeyValue{attribute("http.method", "POST")},
+							Value:      &metricspb.NumberDataPoint_AsInt{AsInt: 1},
+							Flags:      uint32(metricspb.DataPointFlags_FLAG_NO_RECORDED_VALUE),
+						},
+					},
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					IsMonotonic:            true,
+				}},
+			},
+			{
+				Name: "queue.length",
+				Data: &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: []*metricspb.NumberDataPoint{
+					{Value: &metricspb.NumberDataPoint_AsDouble{AsDouble: 2.5}},
+				}}},
+			},
+			{
+				Name: "http.server.duration",
+				Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+					DataPoints: []*metricspb.HistogramDataPoint{
+						{Count: 3, Sum: &sum, BucketCounts: []uint64{1, 2, 0}, ExplicitBounds: []float64{0.1, 1}},
+					},
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+				}},
+			},
+			{
+				Name: "unsupported",
+				Data: &metricspb.Metric_ExponentialHistogram{ExponentialHistogram: &metricspb.ExponentialHistogram{
+					DataPoints: []*metricspb.ExponentialHistogramDataPoint{{}, {}},
+				}},
+			},
+		}}},
+	}}}
+	b, err := protov2.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+const jsonRequest = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [
+      {"key": "service.name", "value": {"stringValue": "api"}},
+      {"key": "service.namespace", "value": {"stringValue": "shop"}},
+      {"key": "service.instance.id", "value": {"stringValue": "pod-1"}},
+      {"key": "host.name", "value": {"stringValue": "node-1"}},
+      {"key": "cloud.region", "value": {"stringValue": "eu"}}
+    ]},
+    "scopeMetrics": [{"metrics": [
+      {
+        "name": "http.server.requests",
+        "description": "Number of requests.",
+        "sum": {
+          "dataPoints": [
+            {"attributes": [
+              {"key": "http.method", "value": {"stringValue": "GET"}},
+              {"key": "instance", "value": {"stringValue": "x"}}
+            ], "asInt": "7"},
+            {"attributes": [{"key": "http.method", "value": {"stringValue": "POST"}}], "asInt": 1, "flags": 1}
+          ],
+          "aggregationTemporality": 2,
+          "isMonotonic": true
+        }
+      },
+      {"name": "queue.length", "gauge": {"dataPoints": [{"asDouble": 2.5}]}},
+      {
+        "name": "http.server.duration",
+        "histogram": {
+          "dataPoints": [{"count": "3", "sum": 0.7, "bucketCounts": ["1", "2", "0"], "explicitBounds": [0.1, 1]}],
+          "aggregationTemporality": 1
+        }
+      },
+      {"name": "unsupported", "exponentialHistogram": {"dataPoints": [{}, {}]}}
+    ]}]
+  }]
+}`
+
+func TestConvert(t *testing.T) {
+	for name, s := range map[string]struct {
+		b           []byte
+		jsonEncoded bool
+	}{
+		"protobuf": {b: protobufRequest(t)},
+		"json":     {b: []byte(jsonRequest), jsonEncoded: true},
+	} {
+		result, err := Convert(s.b, s.jsonEncoded, []string{"host.name"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if expected, got := 2, result.Rejected; expected != got {
+			t.Errorf("%s: Wanted %d rejected data points, got %d.", name, expected, got)
+		}
+		if expected, got := 1, len(result.Groups); expected != got {
+			t.Fatalf("%s: Wanted %d groups, got %d.", name, expected, got)
+		}
+		g := result.Groups[0]
+		if expected, got := `host_name="node-1",instance="pod-1",job="shop/api",`, ingest.Signature(g.Labels); expected != got {
+			t.Errorf("%s: Wanted grouping labels %s, got %s.", name, expected, got)
+		}
+
+		for mfName, want := range map[string]*dto.MetricFamily{
+			"target_info": {
+				Name: proto.String("target_info"),
+				Help: proto.String("Target metadata"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{
+					Label: []*dto.LabelPair{{Name: proto.String("cloud_region"), Value: proto.String("eu")}},
+					Gauge: &dto.Gauge{Value: proto.Float64(1)},
+				}},
+			},
+			"http_server_requests_total": {
+				Name: proto.String("http_server_requests_total"),
+				Help: proto.String("Number of requests."),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{{
+					Label: []*dto.LabelPair{
+						{Name: proto.String("exported_instance"), Value: proto.String("x")},
+						{Name: proto.String("http_method"), Value: proto.String("GET")},
+					},
+					Counter: &dto.Counter{Value: proto.Float64(7)},
+				}},
+			},
+			"queue_length": {
+				Name: proto.String("queue_length"),
+				Type: dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{
+					Label: []*dto.LabelPair{},
+					Gauge: &dto.Gauge{Value: proto.Float64(2.5)},
+				}},
+			},
+		} {
+			if got := g.MetricFamilies[mfName]; !proto.Equal(want, got) {
+				t.Errorf("%s: Wanted %s, got %s.", name, want, got)
+			}
+		}
+		if expected, got := 3, len(g.MetricFamilies); expected != got {
+			t.Errorf("%s: Wanted %d metric families, got %d.", name, expected, got)
+		}
+
+		want := &dto.MetricFamily{
+			Name: proto.String("http_server_duration"),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{},
+				Histogram: &dto.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(0.7),
+					Bucket: []*dto.Bucket{
+						{UpperBound: proto.Float64(0.1), CumulativeCount: proto.Uint64(1)},
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(3)},
+					},
+				},
+			}},
+		}
+		if got := g.DeltaFamilies["http_server_duration"]; !proto.Equal(want, got) {
+			t.Errorf("%s: Wanted delta %s, got %s.", name, want, got)
+		}
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	truncated := protobufRequest(t)
+	for name, s := range map[string]struct {
+		b           []byte
+		jsonEncoded bool
+	}{
+		"truncated protobuf": {b: truncated[:len(truncated)-3]},
+		"invalid JSON":       {b: []byte(`{"resourceMetrics": [`), jsonEncoded: true},
+		"type conflict": {b: []byte(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [
+			{"name": "x", "gauge": {"dataPoints": [{"asDouble": 1}]}},
+			{"name": "x", "summary": {"dataPoints": [{"count": 1, "sum": 1}]}}
+		]}]}]}`), jsonEncoded: true},
+	} {
+		if _, err := Convert(s.b, s.jsonEncoded, nil); err == nil {
+			t.Errorf("%s: Expected error.", name)
+		}
+	}
+}
+
+func TestMarshalResponse(t *testing.T) {
+	if got := MarshalResponse(false, 0); len(got) != 0 {
+		t.Errorf("Wanted empty response, got %x.", got)
+	}
+	if expected, got := "{}", string(MarshalResponse(true, 0)); expected != got {
+		t.Errorf("Wanted %s, got %s.", expected, got)
+	}
+	// The number of rejected data points is field 1 of the partial success,
+	// which is field 1 of the response.
+	b := MarshalResponse(false, 2)
+	num, typ, n := protowire.ConsumeTag(b)
+	if num != 1 || typ != protowire.BytesType {
+		t.Fatalf("Wanted partial success, got %x.", b)
+	}
+	partial, _ := protowire.ConsumeBytes(b[n:])
+	num, typ, n = protowire.ConsumeTag(partial)
+	if num != 1 || typ != protowire.VarintType {
+		t.Fatalf("Wanted rejected data points, got %x.", partial)
+	}
+	rejected, _ := protowire.ConsumeVarint(partial[n:])
+	if expected, got := uint64(2), rejected; expected != got {
+		t.Errorf("Wanted %d rejected data points, got %d.", expected, got)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// unmarshalRequest decodes an ExportMetricsServiceRequest as defined in
+// opentelemetry/proto/collector/metrics/v1/metrics_service.proto, in the binary
+// protobuf encoding or, if jsonEncoded is true, in the JSON encoding of OTLP.
+// The request has the same single field as the MetricsData message, so it is
+// decoded as one, which spares the dependencies of the generated gRPC service.
+// Unknown fields are skipped, as required by OTLP.
+func unmarshalRequest(b []byte, jsonEncoded bool) (*metricspb.MetricsData, error) {
+	req := &metricspb.MetricsData{}
+	if jsonEncoded {
+		return req, protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(b, req)
+	}
+	return req, proto.Unmarshal(b, req)
+}
+
+// attributeString returns the provided AnyValue as a label value. Arrays and
+// key-value lists are JSON-encoded, like the OpenTelemetry specification
+// requires for Prometheus.
+func attributeString(v *commonpb.AnyValue) string {
+	switch x := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return x.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(x.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(x.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(x.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(x.BytesValue)
+	case *commonpb.AnyValue_ArrayValue, *commonpb.AnyValue_KvlistValue:
+		b, _ := json.Marshal(plainValue(v)) // Cannot fail for these types.
+		return string(b)
+	}
+	return ""
+}
+
+// plainValue returns the provided AnyValue as a value for JSON encoding.
+func plainValue(v *commonpb.AnyValue) interface{} {
+	switch x := v.GetValue().(type) {
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]interface{}, len(x.ArrayValue.GetValues()))
+		for i, y := range x.ArrayValue.GetValues() {
+			values[i] = plainValue(y)
+		}
+		return values
+	case *commonpb.AnyValue_KvlistValue:
+		values := make(map[string]interface{}, len(x.KvlistValue.GetValues()))
+		for _, kv := range x.KvlistValue.GetValues() {
+			values[kv.GetKey()] = plainValue(kv.GetValue())
+		}
+		return values
+	case *commonpb.AnyValue_BoolValue:
+		return x.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return x.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		if !math.IsNaN(x.DoubleValue) && !math.IsInf(x.DoubleValue, 0) {
+			return x.DoubleValue
+		}
+	}
+	return attributeString(v)
+}
+
+// marshalResponse returns an ExportMetricsServiceResponse in the binary
+// protobuf encoding, with a partial success reporting the provided number of
+// rejected data points if it is positive. The two fields are encoded by hand
+// for the same reason the request is decoded as MetricsData.
+func marshalResponse(rejected int, message string) []byte {
+	if rejected <= 0 {
+		return nil
+	}
+	var partial []byte
+	partial = protowire.AppendTag(partial, 1, protowire.VarintType)
+	partial = protowire.AppendVarint(partial, uint64(rejected))
+	partial = protowire.AppendTag(partial, 2, protowire.BytesType)
+	partial = protowire.AppendString(partial, message)
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, partial)
+}
+
+// marshalResponseJSON is the JSON encoding of marshalResponse.
+func marshalResponseJSON(rejected int, message string) []byte {
+	if rejected <= 0 {
+		return []byte("{}")
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"partialSuccess": map[string]interface{}{
+			"rejectedDataPoints": strconv.Itoa(rejected),
+			"errorMessage":       message,
+		},
+	})
+	return b
+}
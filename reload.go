@@ -0,0 +1,303 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// settings are the parts of the configuration that can be changed at runtime
+// by reloading it.
+type settings struct {
+	limits         storage.Limits
+	auth           *handler.AuthConfig // nil if no authentication is required.
+	acl            *handler.ACLConfig  // nil if all jobs may be modified.
+	relabelConfigs []*handler.RelabelConfig
+	tenants        *handler.TenantsConfig // nil if multi-tenancy is disabled.
+}
+
+// settingsSources are the config file and the flags the settings are loaded
+// from.
+type settingsSources struct {
+	configFile  string
+	authFile    string
+	aclFile     string
+	relabelFile string
+	tenantsFile string
+	limits      storage.Limits // From the --storage.max-* flags.
+	clientCerts bool           // Whether --web.tls-client-ca-file is set.
+}
+
+// load reads the config file and the files provided by flags and returns the
+// resulting settings. A section of the config file replaces the corresponding
+// flag, setting both is an error.
+func (src settingsSources) load() (*settings, error) {
+	cfg := &handler.Config{}
+	if src.configFile != "" {
+		var err error
+		if cfg, err = handler.LoadConfigFile(src.configFile); err != nil {
+			return nil, err
+		}
+	}
+	s := &settings{
+		limits:         src.limits,
+		auth:           cfg.Auth,
+		acl:            cfg.ACLConfig(),
+		relabelConfigs: cfg.MetricRelabelConfigs,
+		tenants:        cfg.TenantsConfig(),
+	}
+	if cfg.Limits != nil {
+		s.limits = storage.Limits{
+			MaxGroups:           cfg.Limits.MaxGroups,
+			MaxFamiliesPerGroup: cfg.Limits.MaxFamiliesPerGroup,
+			MaxSamples:          cfg.Limits.MaxSamples,
+			MaxSeriesPerGroup:   cfg.Limits.MaxSeriesPerGroup,
+			MaxLabelsPerMetric:  cfg.Limits.MaxLabelsPerMetric,
+			MaxLabelValueLength: cfg.Limits.MaxLabelValueLength,
+			Truncate:            cfg.Limits.Truncate,
+		}
+	}
+	for _, f := range []struct {
+		flag, file, section string
+		inConfig            bool
+		load                func(string) error
+	}{
+		{"web.auth.file", src.authFile, "auth", cfg.Auth != nil, func(file string) (err error) {
+			s.auth, err = handler.LoadAuthFile(file)
+			return err
+		}},
+		{"web.acl-file", src.aclFile, "acls", cfg.ACLs != nil, func(file string) (err error) {
+			s.acl, err = handler.LoadACLFile(file)
+			return err
+		}},
+		{"push.relabel-config-file", src.relabelFile, "metric_relabel_configs", cfg.MetricRelabelConfigs != nil, func(file string) (err error) {
+			s.relabelConfigs, err = handler.LoadRelabelFile(file)
+			return err
+		}},
+		{"tenancy.file", src.tenantsFile, "tenants", cfg.Tenants != nil, func(file string) (err error) {
+			s.tenants, err = handler.LoadTenantsFile(file)
+			return err
+		}},
+	} {
+		if f.file == "" {
+			continue
+		}
+		if f.inConfig {
+			return nil, fmt.Errorf("--%s cannot be combined with the %s section of the config file", f.flag, f.section)
+		}
+		if err := f.load(f.file); err != nil {
+			return nil, err
+		}
+	}
+	if s.acl != nil && s.acl.UsesCredentials() && s.auth == nil {
+		return nil, errors.New("ACLs with users or bearer tokens require authentication to be configured")
+	}
+	if s.acl != nil && s.acl.UsesClientCerts() && !src.clientCerts {
+		return nil, errors.New("ACLs with client certificate common names require --web.tls-client-ca-file")
+	}
+	return s, nil
+}
+
+// tenantIDs returns the sorted IDs of the configured tenants.
+func (s *settings) tenantIDs() []string {
+	if s.tenants == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(s.tenants.Tenants))
+	for id := range s.tenants.Tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// tenantLimits returns the limits for the store of a tenant, i.e. the global
+// limits overridden by the non-zero limits of the tenant. Truncation can only
+// be switched on per tenant.
+func tenantLimits(global storage.Limits, limits handler.TenantLimits) storage.Limits {
+	if limits.MaxGroups > 0 {
+		global.MaxGroups = limits.MaxGroups
+	}
+	if limits.MaxFamiliesPerGroup > 0 {
+		global.MaxFamiliesPerGroup = limits.MaxFamiliesPerGroup
+	}
+	if limits.MaxSamples > 0 {
+		global.MaxSamples = limits.MaxSamples
+	}
+	if limits.MaxSeriesPerGroup > 0 {
+		global.MaxSeriesPerGroup = limits.MaxSeriesPerGroup
+	}
+	if limits.MaxLabelsPerMetric > 0 {
+		global.MaxLabelsPerMetric = limits.MaxLabelsPerMetric
+	}
+	if limits.MaxLabelValueLength > 0 {
+		global.MaxLabelValueLength = limits.MaxLabelValueLength
+	}
+	if limits.Truncate {
+		global.Truncate = true
+	}
+	return global
+}
+
+// limitSetter is implemented by metric stores whose limits can be changed at
+// runtime, like storage.DiskMetricStore.
+type limitSetter interface {
+	SetLimits(storage.Limits)
+}
+
+// swappableHandler is an http.Handler passing requests on to the handler most
+// recently set.
+type swappableHandler struct {
+	mtx sync.RWMutex
+	h   http.Handler
+}
+
+func (sh *swappableHandler) set(h http.Handler) {
+	sh.mtx.Lock()
+	defer sh.mtx.Unlock()
+	sh.h = h
+}
+
+func (sh *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sh.mtx.RLock()
+	h := sh.h
+	sh.mtx.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+// reloader applies the settings to the running Pushgateway, initially and
+// whenever the configuration is reloaded.
+type reloader struct {
+	sources      settingsSources
+	ms           storage.MetricStore            // The store before any replication or forwarding.
+	tenantStores map[string]storage.MetricStore // Cannot change at runtime.
+	relabelRules *handler.RelabelRules
+	handler      *swappableHandler
+	// newHandler returns the handler for all requests, built from the
+	// provided settings.
+	newHandler func(*settings) http.Handler
+	logger     log.Logger
+
+	mtx     sync.Mutex // Serializes reloads.
+	current *settings
+
+	lastSuccess          prometheus.Gauge
+	lastSuccessTimestamp prometheus.Gauge
+}
+
+func newReloader(
+	sources settingsSources,
+	ms storage.MetricStore,
+	tenantStores map[string]storage.MetricStore,
+	relabelRules *handler.RelabelRules,
+	newHandler func(*settings) http.Handler,
+	logger log.Logger,
+) *reloader {
+	return &reloader{
+		sources:      sources,
+		ms:           ms,
+		tenantStores: tenantStores,
+		relabelRules: relabelRules,
+		handler:      &swappableHandler{},
+		newHandler:   newHandler,
+		logger:       logger,
+		lastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pushgateway_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		}),
+		lastSuccessTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pushgateway_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (rl *reloader) Describe(ch chan<- *prometheus.Desc) {
+	rl.lastSuccess.Describe(ch)
+	rl.lastSuccessTimestamp.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (rl *reloader) Collect(ch chan<- prometheus.Metric) {
+	rl.lastSuccess.Collect(ch)
+	rl.lastSuccessTimestamp.Collect(ch)
+}
+
+// apply applies the provided settings, which have to be valid.
+func (rl *reloader) apply(s *settings) {
+	if ls, ok := rl.ms.(limitSetter); ok {
+		ls.SetLimits(s.limits)
+	}
+	for id, tms := range rl.tenantStores {
+		if ls, ok := tms.(limitSetter); ok {
+			ls.SetLimits(tenantLimits(s.limits, s.tenants.Tenants[id].Limits))
+		}
+	}
+	rl.relabelRules.Set(s.relabelConfigs)
+	rl.handler.set(rl.newHandler(s))
+	rl.current = s
+	rl.lastSuccess.Set(1)
+	rl.lastSuccessTimestamp.Set(float64(time.Now().Unix()))
+}
+
+// reload loads the settings anew and applies them. If they are invalid, the
+// current settings stay in place and the error is returned.
+func (rl *reloader) reload() error {
+	rl.mtx.Lock()
+	defer rl.mtx.Unlock()
+
+	s, err := rl.sources.load()
+	if err == nil && strings.Join(s.tenantIDs(), ",") != strings.Join(rl.current.tenantIDs(), ",") {
+		err = errors.New("adding or removing tenants requires a restart")
+	}
+	if err != nil {
+		rl.lastSuccess.Set(0)
+		level.Error(rl.logger).Log("msg", "could not reload configuration, keeping the current one", "err", err)
+		return err
+	}
+	rl.apply(s)
+	level.Info(rl.logger).Log("msg", "configuration reloaded")
+	return nil
+}
+
+// reloadOnSignal reloads the configuration whenever a signal is received on
+// the provided channel.
+func (rl *reloader) reloadOnSignal(ch <-chan os.Signal) {
+	for range ch {
+		rl.reload()
+	}
+}
+
+// ServeHTTP implements http.Handler for the reload endpoint. It responds with
+// http.StatusInternalServerError and the error if the reload failed.
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if err := rl.reload(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload config: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestLoadSettings(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestLoadSettings.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	configFile := path.Join(tempDir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte("limits:\n  max_groups: 10\nauth:\n  bearer_tokens: [secret]\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	aclFile := path.Join(tempDir, "acl.yml")
+	if err := ioutil.WriteFile(aclFile, []byte("acls:\n- bearer_tokens: [secret]\n  jobs: [foo]\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := settingsSources{
+		configFile: configFile,
+		aclFile:    aclFile,
+		limits:     storage.Limits{MaxGroups: 1, MaxSamples: 100},
+	}.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The limits section replaces all limit flags.
+	if expected, got := (storage.Limits{MaxGroups: 10}), s.limits; expected != got {
+		t.Errorf("Wanted limits %+v, got %+v.", expected, got)
+	}
+	if s.auth == nil || s.acl == nil {
+		t.Error("Wanted auth and ACLs to be configured.")
+	}
+
+	if _, err := (settingsSources{configFile: configFile, authFile: aclFile}).load(); err == nil {
+		t.Error("Expected error for auth section combined with --web.auth.file.")
+	}
+	if _, err := (settingsSources{aclFile: aclFile}).load(); err == nil {
+		t.Error("Expected error for ACLs with bearer tokens but no authentication.")
+	}
+}
+
+func TestReload(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestReload.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	configFile := path.Join(tempDir, "config.yml")
+	writeConfig := func(content string) {
+		if err := ioutil.WriteFile(configFile, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("tenants:\n  a:\n")
+
+	ms := storage.NewPersistentMetricStore(nil, time.Hour, storage.Limits{}, storage.WriteQueueOptions{}, nil, log.NewNopLogger())
+	defer ms.Shutdown()
+	tms := storage.NewPersistentMetricStore(nil, time.Hour, storage.Limits{}, storage.WriteQueueOptions{}, nil, log.NewNopLogger())
+	defer tms.Shutdown()
+	relabelRules := handler.NewRelabelRules(nil)
+	sources := settingsSources{configFile: configFile}
+	rl := newReloader(sources, ms, map[string]storage.MetricStore{"a": tms}, relabelRules, func(s *settings) http.Handler {
+		next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		})
+		if s.auth == nil {
+			return next
+		}
+		return handler.Authenticate(s.auth, "/", next, log.NewNopLogger())
+	}, log.NewNopLogger())
+	s, err := sources.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.apply(s)
+
+	push := func() int {
+		req, err := http.NewRequest("PUT", "http://example.org/metrics/job/foo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		rl.handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	reload := func() int {
+		req, err := http.NewRequest("POST", "http://example.org/-/reload", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		rl.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if expected, got := http.StatusAccepted, push(); expected != got {
+		t.Errorf("Wanted status code %d, got %d.", expected, got)
+	}
+
+	writeConfig("auth:\n  bearer_tokens: [secret]\nmetric_relabel_configs:\n- action: labeldrop\n  regex: debug\ntenants:\n  a:\n    limits:\n      max_groups: 3\n")
+	if expected, got := http.StatusOK, reload(); expected != got {
+		t.Errorf("Wanted status code %d, got %d.", expected, got)
+	}
+	if expected, got := http.StatusUnauthorized, push(); expected != got {
+		t.Errorf("Wanted status code %d, got %d.", expected, got)
+	}
+	if expected, got := 1, len(relabelRules.Get()); expected != got {
+		t.Errorf("Wanted %d relabel configs, got %d.", expected, got)
+	}
+
+	// Invalid configurations are rejected, keeping the current one.
+	for _, content := range []string{
+		"auth:\n  bearer_tokens: ['']\ntenants:\n  a:\n",
+		"tenants:\n  b:\n",
+	} {
+		writeConfig(content)
+		if expected, got := http.StatusInternalServerError, reload(); expected != got {
+			t.Errorf("Wanted status code %d, got %d.", expected, got)
+		}
+		if expected, got := http.StatusUnauthorized, push(); expected != got {
+			t.Errorf("Wanted status code %d, got %d.", expected, got)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/remotewrite/prompb"
+)
+
+// toSeries converts the metric families pushed for the group with the provided
+// grouping labels into series. The grouping labels are added to all series,
+// like the MetricStore does on storage. Metrics without a timestamp get the
+// provided push time. Summaries and histograms are split up into their
+// components as Prometheus does when scraping them.
+func toSeries(mfs map[string]*dto.MetricFamily, groupingLabels map[string]string, pushTime time.Time) []*prompb.TimeSeries {
+	names := make([]string, 0, len(mfs))
+	for name := range mfs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []*prompb.TimeSeries
+	for _, name := range names {
+		mf := mfs[name]
+		for _, m := range mf.GetMetric() {
+			ts := pushTime.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(suffix string, v float64, extra ...*prompb.Label) {
+				result = append(result, &prompb.TimeSeries{
+					Labels:  seriesLabels(name+suffix, m.GetLabel(), groupingLabels, extra),
+					Samples: []*prompb.Sample{{Value: v, Timestamp: ts}},
+				})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add("", q.GetValue(), &prompb.Label{Name: model.QuantileLabel, Value: formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				infSeen := false
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), +1) {
+						infSeen = true
+					}
+					add("_bucket", float64(b.GetCumulativeCount()), &prompb.Label{Name: model.BucketLabel, Value: formatFloat(b.GetUpperBound())})
+				}
+				if !infSeen {
+					add("_bucket", float64(h.GetSampleCount()), &prompb.Label{Name: model.BucketLabel, Value: "+Inf"})
+				}
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			default:
+				add("", m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return result
+}
+
+// seriesLabels returns the sorted labels of a series. Grouping labels take
+// precedence over the labels of the metric. Labels with an empty value are
+// left out as they are equivalent to a missing label in Prometheus.
+func seriesLabels(name string, lps []*dto.LabelPair, groupingLabels map[string]string, extra []*prompb.Label) []*prompb.Label {
+	labels := map[string]string{}
+	for _, lp := range lps {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	for ln, lv := range groupingLabels {
+		labels[ln] = lv
+	}
+	for _, l := range extra {
+		labels[l.Name] = l.Value
+	}
+	labels[model.MetricNameLabel] = name
+
+	result := make([]*prompb.Label, 0, len(labels))
+	for ln, lv := range labels {
+		if lv != "" {
+			result = append(result, &prompb.Label{Name: ln, Value: lv})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest returns the provided time series as a snappy-compressed
+// remote-write WriteRequest.
+func encodeWriteRequest(ts []*prompb.TimeSeries) ([]byte, error) {
+	b, err := proto.Marshal(&prompb.WriteRequest{Timeseries: ts})
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, b), nil
+}
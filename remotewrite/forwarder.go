@@ -0,0 +1,306 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package remotewrite forwards pushed metrics to Prometheus remote-write
+// endpoints and converts received remote-write requests into metric families.
+package remotewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	queueCapacity   = 1000
+	sendAttempts    = 5
+	maxBackoff      = 30 * time.Second
+	requestTimeout  = 30 * time.Second
+	shutdownTimeout = 5 * time.Second
+)
+
+// minBackoff is the time to wait before the first retry. It is doubled for
+// each further retry, up to maxBackoff. It is a variable for testing.
+var minBackoff = time.Second
+
+var (
+	sentDesc = prometheus.NewDesc(
+		"pushgateway_remote_write_sent_total",
+		"Total number of pushes successfully forwarded to a remote-write endpoint.",
+		[]string{"endpoint"}, nil,
+	)
+	droppedDesc = prometheus.NewDesc(
+		"pushgateway_remote_write_dropped_total",
+		"Total number of pushes that could not be forwarded to a remote-write endpoint.",
+		[]string{"endpoint"}, nil,
+	)
+)
+
+// Forwarder is a storage.MetricStore that forwards the metrics of every push
+// accepted by the wrapped MetricStore to a number of Prometheus remote-write
+// endpoints. Each push results in one remote-write request per endpoint,
+// containing one sample per series, timestamped with the pushed timestamp or,
+// if there is none, the time of the push. Like the MetricStore, the Forwarder
+// adds the grouping labels to all series.
+//
+// Requests are sent asynchronously and on a best-effort basis: A request that
+// cannot be sent to an endpoint after a few attempts (with exponential backoff)
+// or that is rejected by the endpoint is dropped for that endpoint. Deletions
+// are not forwarded as remote write has no way to express them. Neither are
+// aggregating pushes (see storage.Aggregation) as the pushed values are not
+// the ones stored.
+//
+// A Forwarder implements prometheus.Collector to expose metrics about the
+// forwarding. It is up to the caller to register it.
+type Forwarder struct {
+	storage.MetricStore
+	// submitMtx makes sure requests are queued for the endpoints in the
+	// same order as the pushes are submitted to the wrapped MetricStore.
+	submitMtx sync.Mutex
+	endpoints []*endpoint
+	queue     chan pendingPush
+	done      chan struct{}
+	logger    log.Logger
+}
+
+// pendingPush is a push waiting for the wrapped MetricStore to process it.
+type pendingPush struct {
+	body []byte
+	// local is the Done channel of the WriteRequest submitted to the
+	// wrapped MetricStore, orig the Done channel provided by the caller.
+	// Both are nil if the caller has not provided a Done channel.
+	local <-chan error
+	orig  chan error
+}
+
+// NewForwarder returns a Forwarder wrapping the provided MetricStore and
+// forwarding to the remote-write endpoints with the provided URLs (e.g.
+// "http://prometheus:9090/api/v1/write"). Credentials for basic auth may be
+// included in the URLs.
+func NewForwarder(ms storage.MetricStore, endpointURLs []string, logger log.Logger) (*Forwarder, error) {
+	f := &Forwarder{
+		MetricStore: ms,
+		queue:       make(chan pendingPush, queueCapacity),
+		done:        make(chan struct{}),
+		logger:      logger,
+	}
+	client := &http.Client{Timeout: requestTimeout}
+	for _, rawURL := range endpointURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote-write URL %q: %v", rawURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("remote-write URL %q has to start with http:// or https://", rawURL)
+		}
+		name := u.Host + u.Path
+		f.endpoints = append(f.endpoints, &endpoint{
+			name:     name,
+			url:      u.String(),
+			client:   client,
+			requests: make(chan []byte, queueCapacity),
+			done:     make(chan struct{}),
+			logger:   log.With(logger, "endpoint", name),
+		})
+	}
+	for _, e := range f.endpoints {
+		go e.loop()
+	}
+	go f.loop()
+	return f, nil
+}
+
+// SubmitWriteRequest implements storage.MetricStore. The pushed metrics are
+// converted right away, before the wrapped MetricStore gets a chance to modify
+// them. Pushes the wrapped MetricStore does not accept are not forwarded.
+func (f *Forwarder) SubmitWriteRequest(wr storage.WriteRequest) error {
+	if wr.MetricFamilies == nil || wr.Aggregation != storage.AggregateNone {
+		return f.MetricStore.SubmitWriteRequest(wr)
+	}
+	ss := toSeries(wr.MetricFamilies, wr.Labels, wr.Timestamp)
+	if len(ss) == 0 {
+		return f.MetricStore.SubmitWriteRequest(wr)
+	}
+	body, err := encodeWriteRequest(ss)
+	if err != nil {
+		// Only possible with names or label values that are not
+		// valid UTF-8, which the push handlers reject anyway.
+		level.Warn(f.logger).Log("msg", "push cannot be forwarded via remote write", "err", err)
+		return f.MetricStore.SubmitWriteRequest(wr)
+	}
+	pp := pendingPush{body: body}
+	if wr.Done != nil {
+		local := make(chan error, 1)
+		pp.local, pp.orig = local, wr.Done
+		wr.Done = local
+	}
+	f.submitMtx.Lock()
+	defer f.submitMtx.Unlock()
+	if err := f.MetricStore.SubmitWriteRequest(wr); err != nil {
+		return err
+	}
+	f.queue <- pp
+	return nil
+}
+
+// Shutdown implements storage.MetricStore. It waits a bit for pending requests
+// to be sent to the endpoints before shutting down the wrapped MetricStore.
+func (f *Forwarder) Shutdown() error {
+	close(f.queue)
+	<-f.done
+	timeout := time.After(shutdownTimeout)
+	for _, e := range f.endpoints {
+		select {
+		case <-e.done:
+		case <-timeout:
+			level.Warn(e.logger).Log("msg", "not all pushes forwarded to remote-write endpoint before shutdown")
+		}
+	}
+	return f.MetricStore.Shutdown()
+}
+
+// Describe implements prometheus.Collector.
+func (f *Forwarder) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sentDesc
+	ch <- droppedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (f *Forwarder) Collect(ch chan<- prometheus.Metric) {
+	for _, e := range f.endpoints {
+		e.mtx.Lock()
+		sent, dropped := e.sent, e.dropped
+		e.mtx.Unlock()
+		ch <- prometheus.MustNewConstMetric(sentDesc, prometheus.CounterValue, float64(sent), e.name)
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(dropped), e.name)
+	}
+}
+
+// loop hands requests to the endpoints once the wrapped MetricStore has
+// accepted the push.
+func (f *Forwarder) loop() {
+	defer close(f.done)
+	for pp := range f.queue {
+		failed := false
+		if pp.local != nil {
+			for err := range pp.local {
+				failed = true
+				pp.orig <- err
+			}
+			close(pp.orig)
+		}
+		if failed {
+			continue
+		}
+		for _, e := range f.endpoints {
+			e.enqueue(pp.body)
+		}
+	}
+	for _, e := range f.endpoints {
+		close(e.requests)
+	}
+}
+
+// endpoint sends remote-write requests to one remote-write endpoint.
+type endpoint struct {
+	name     string
+	url      string
+	client   *http.Client
+	requests chan []byte
+	done     chan struct{}
+	logger   log.Logger
+
+	mtx           sync.Mutex
+	sent, dropped int
+}
+
+func (e *endpoint) enqueue(body []byte) {
+	select {
+	case e.requests <- body:
+	default:
+		e.drop(fmt.Errorf("queue full"))
+	}
+}
+
+func (e *endpoint) drop(err error) {
+	e.mtx.Lock()
+	e.dropped++
+	e.mtx.Unlock()
+	level.Warn(e.logger).Log("msg", "dropping push for remote-write endpoint", "err", err)
+}
+
+func (e *endpoint) loop() {
+	defer close(e.done)
+	for body := range e.requests {
+		var (
+			err       error
+			retryable bool
+			backoff   = minBackoff
+		)
+		for attempt := 0; attempt < sendAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+			}
+			if retryable, err = e.send(body); err == nil || !retryable {
+				break
+			}
+		}
+		if err != nil {
+			e.drop(err)
+			continue
+		}
+		e.mtx.Lock()
+		e.sent++
+		e.mtx.Unlock()
+	}
+}
+
+// send sends the provided request body to the endpoint. If it fails, it
+// returns whether it makes sense to try again, which is the case for server
+// errors and throttling, but not if the endpoint has rejected the request.
+func (e *endpoint) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", "Pushgateway")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(respBody))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
@@ -0,0 +1,296 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remotewrite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/remotewrite/prompb"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+var logger = log.NewNopLogger()
+
+// decodeWriteRequest returns the series in the provided remote-write
+// WriteRequest in the form `name{label="value",...} value timestamp`.
+func decodeWriteRequest(b []byte) ([]string, error) {
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, ts := range req.GetTimeseries() {
+		var (
+			name   string
+			labels []string
+		)
+		for _, l := range ts.GetLabels() {
+			if l.GetName() == "__name__" {
+				name = l.GetValue()
+			} else {
+				labels = append(labels, fmt.Sprintf("%s=%q", l.GetName(), l.GetValue()))
+			}
+		}
+		if len(ts.GetSamples()) != 1 {
+			return nil, fmt.Errorf("wanted 1 sample for %s, got %d", name, len(ts.GetSamples()))
+		}
+		s := ts.GetSamples()[0]
+		result = append(result, fmt.Sprintf("%s{%s} %g %d", name, strings.Join(labels, ","), s.GetValue(), s.GetTimestamp()))
+	}
+	return result, nil
+}
+
+// receiver is a remote-write endpoint recording the received series. It
+// responds with the provided status codes first, and with 204 afterwards.
+type receiver struct {
+	mtx      sync.Mutex
+	statuses []int
+	requests int
+	series   []string
+	err      error
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	rcv.requests++
+	if len(rcv.statuses) > 0 {
+		status := rcv.statuses[0]
+		rcv.statuses = rcv.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		rcv.err = fmt.Errorf("unexpected headers %v", r.Header)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	b, err := snappy.Decode(nil, body)
+	if err == nil {
+		var ss []string
+		ss, err = decodeWriteRequest(b)
+		rcv.series = append(rcv.series, ss...)
+	}
+	if err != nil {
+		rcv.err = err
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rcv *receiver) state() (int, []string, error) {
+	rcv.mtx.Lock()
+	defer rcv.mtx.Unlock()
+	return rcv.requests, append([]string(nil), rcv.series...), rcv.err
+}
+
+func submit(ms storage.MetricStore, wr storage.WriteRequest) error {
+	errCh := make(chan error, 1)
+	wr.Done = errCh
+	ms.SubmitWriteRequest(wr)
+	var err error
+	for e := range errCh {
+		err = e
+	}
+	return err
+}
+
+// waitFor polls the provided condition until it is true or a second has
+// passed.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	var ts []*prompb.TimeSeries
+	for i := 0; i < 100; i++ {
+		ts = append(ts, &prompb.TimeSeries{
+			Labels:  []*prompb.Label{{Name: "__name__", Value: "requests_total"}, {Name: "job", Value: "api"}},
+			Samples: []*prompb.Sample{{Value: float64(i), Timestamp: 1000}},
+		})
+	}
+	body, err := encodeWriteRequest(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(body) >= len(b)/2 {
+		t.Errorf("Wanted repetitive request of %d bytes to be compressed, got %d bytes.", len(b), len(body))
+	}
+	ss, err := decodeWriteRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := `requests_total{job="api"} 99 1000`, ss[99]; expected != got {
+		t.Errorf("Wanted %s, got %s.", expected, got)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	defer func(d time.Duration) { minBackoff = d }(minBackoff)
+	minBackoff = 10 * time.Millisecond
+
+	rcv := &receiver{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	if _, err := NewForwarder(nil, []string{"ftp://example.org"}, logger); err == nil {
+		t.Error("Expected error for invalid remote-write URL.")
+	}
+
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, logger)
+	f, err := NewForwarder(ms, []string{server.URL + "/api/v1/write"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTime := time.Unix(1000, 0)
+
+	// A push rejected by the MetricStore (inconsistent types) is not
+	// forwarded.
+	if err := submit(f, storage.WriteRequest{
+		Labels:    map[string]string{"job": "a"},
+		Timestamp: pushTime,
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"x": {
+				Name:   proto.String("x"),
+				Type:   dto.MetricType_SUMMARY.Enum(),
+				Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(1)}}},
+			},
+		},
+	}); err == nil {
+		t.Fatal("Expected error for inconsistent push.")
+	}
+
+	if err := submit(f, storage.WriteRequest{
+		Labels:    map[string]string{"job": "a", "instance": "i"},
+		Timestamp: pushTime,
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"requests_total": {
+				Name: proto.String("requests_total"),
+				Help: proto.String("Requests."),
+				Type: dto.MetricType_COUNTER.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Label:   []*dto.LabelPair{{Name: proto.String("method"), Value: proto.String("get")}},
+						Counter: &dto.Counter{Value: proto.Float64(3)},
+					},
+				},
+			},
+			"duration_seconds": {
+				Name: proto.String("duration_seconds"),
+				Help: proto.String("Duration."),
+				Type: dto.MetricType_HISTOGRAM.Enum(),
+				Metric: []*dto.Metric{
+					{
+						Histogram: &dto.Histogram{
+							SampleCount: proto.Uint64(2),
+							SampleSum:   proto.Float64(1.5),
+							Bucket: []*dto.Bucket{
+								{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+							},
+						},
+						TimestampMs: proto.Int64(500),
+					},
+				},
+			},
+		},
+		AllowTimestamps: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Deletions are not forwarded.
+	if err := submit(f, storage.WriteRequest{
+		Labels:    map[string]string{"job": "a", "instance": "i"},
+		Timestamp: pushTime,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitFor(func() bool { _, ss, _ := rcv.state(); return len(ss) > 0 }) {
+		t.Fatal("Push not forwarded.")
+	}
+	requests, ss, err := rcv.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, requests; expected != got {
+		t.Errorf("Wanted %d requests (including a retry), got %d.", expected, got)
+	}
+	expected := []string{
+		`duration_seconds_bucket{instance="i",job="a",le="1"} 1 500`,
+		`duration_seconds_bucket{instance="i",job="a",le="+Inf"} 2 500`,
+		`duration_seconds_sum{instance="i",job="a"} 1.5 500`,
+		`duration_seconds_count{instance="i",job="a"} 2 500`,
+		`requests_total{instance="i",job="a",method="get"} 3 1000000`,
+	}
+	if strings.Join(expected, "\n") != strings.Join(ss, "\n") {
+		t.Errorf("Wanted series\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(ss, "\n"))
+	}
+
+	// A rejected request is not retried.
+	rcv.mtx.Lock()
+	rcv.statuses = []int{http.StatusBadRequest}
+	rcv.mtx.Unlock()
+	if err := submit(f, storage.WriteRequest{
+		Labels:    map[string]string{"job": "b"},
+		Timestamp: pushTime,
+		MetricFamilies: map[string]*dto.MetricFamily{
+			"g": {
+				Name:   proto.String("g"),
+				Type:   dto.MetricType_GAUGE.Enum(),
+				Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(1)}}},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(func() bool {
+		f.endpoints[0].mtx.Lock()
+		defer f.endpoints[0].mtx.Unlock()
+		return f.endpoints[0].dropped == 1
+	}) {
+		t.Error("Rejected request not dropped.")
+	}
+
+	if err := f.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	requests, _, _ = rcv.state()
+	if expected, got := 3, requests; expected != got {
+		t.Errorf("Wanted %d requests, got %d.", expected, got)
+	}
+	if expected, got := 1, f.endpoints[0].sent; expected != got {
+		t.Errorf("Wanted %d sent pushes, got %d.", expected, got)
+	}
+}
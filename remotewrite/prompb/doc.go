@@ -0,0 +1,18 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prompb contains the protobuf messages of the Prometheus remote-write
+// protocol, generated from the proto files in this directory.
+package prompb
+
+//go:generate protoc -I ../.. --go_out=paths=source_relative:../.. remotewrite/prompb/types.proto remotewrite/prompb/remote.proto
@@ -0,0 +1,185 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package remotewrite
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/ingest"
+	"github.com/prometheus/pushgateway/remotewrite/prompb"
+)
+
+// staleNaN is the bit pattern of the NaN value Prometheus marks stale series
+// with.
+const staleNaN = 0x7ff0000000000002
+
+// Group is the result of converting all series with the same grouping labels.
+type Group struct {
+	Labels         map[string]string
+	MetricFamilies map[string]*dto.MetricFamily
+}
+
+// Convert decodes the provided snappy-compressed remote-write WriteRequest and
+// converts its series into metric families, grouped by the grouping labels
+// made up of the job label (set to the provided job for series without one)
+// and the labels with the provided names (if present).
+//
+// Every series becomes a metric of the metric family named after its __name__
+// label. The metric family is a counter or a gauge (with the help taken over)
+// if the metadata in the request declares it as such, and untyped otherwise.
+// Only the latest sample of each series is kept, and its timestamp is
+// discarded. Stale markers, native histograms, exemplars, and labels starting
+// with "__" (other than __name__) are ignored. A series without a name makes
+// Convert fail.
+func Convert(b []byte, job string, groupingLabels []string) ([]Group, error) {
+	b, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snappy encoding: %v", err)
+	}
+	var req prompb.WriteRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return nil, fmt.Errorf("invalid write request: %v", err)
+	}
+	isGroupingLabel := map[string]bool{string(model.JobLabel): true}
+	for _, ln := range groupingLabels {
+		isGroupingLabel[ln] = true
+	}
+	type sample struct {
+		m         *dto.Metric
+		timestamp int64
+	}
+	groups := map[string]*Group{}
+	var order []string // Group signatures in order of appearance.
+	samples := map[string]*sample{}
+	metadata := map[string]*dto.MetricFamily{}
+	for _, md := range req.GetMetadata() {
+		addMetadata(md, metadata)
+	}
+
+	for i, ts := range req.GetTimeseries() {
+		value, timestamp, ok := latestSample(ts)
+		if !ok {
+			continue // No sample, or only stale markers.
+		}
+		labels := make(map[string]string, len(ts.GetLabels()))
+		for _, l := range ts.GetLabels() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		name := labels[model.MetricNameLabel]
+		if name == "" {
+			return nil, fmt.Errorf("time series %d: missing metric name", i+1)
+		}
+		grouping := map[string]string{string(model.JobLabel): job}
+		metricLabels := map[string]string{}
+		for ln, lv := range labels {
+			switch {
+			case lv == "", strings.HasPrefix(ln, model.ReservedLabelPrefix):
+			case isGroupingLabel[ln]:
+				grouping[ln] = lv
+			default:
+				metricLabels[ln] = lv
+			}
+		}
+
+		key := ingest.Signature(grouping)
+		g, ok := groups[key]
+		if !ok {
+			g = &Group{Labels: grouping, MetricFamilies: map[string]*dto.MetricFamily{}}
+			groups[key] = g
+			order = append(order, key)
+		}
+		seriesKey := key + name + "{" + ingest.Signature(metricLabels) + "}"
+		if s, ok := samples[seriesKey]; ok {
+			if timestamp >= s.timestamp {
+				s.m.Untyped.Value = proto.Float64(value)
+				s.timestamp = timestamp
+			}
+			continue
+		}
+		mf, ok := g.MetricFamilies[name]
+		if !ok {
+			mf = &dto.MetricFamily{Name: proto.String(name), Type: dto.MetricType_UNTYPED.Enum()}
+			g.MetricFamilies[name] = mf
+		}
+		m := &dto.Metric{Label: ingest.LabelPairs(metricLabels), Untyped: &dto.Untyped{Value: proto.Float64(value)}}
+		mf.Metric = append(mf.Metric, m)
+		samples[seriesKey] = &sample{m: m, timestamp: timestamp}
+	}
+
+	result := make([]Group, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		for name, mf := range g.MetricFamilies {
+			if md, ok := metadata[name]; ok {
+				setType(mf, md)
+			}
+		}
+		result = append(result, *g)
+	}
+	return result, nil
+}
+
+// latestSample returns the latest sample of the provided time series that is
+// not a stale marker. If there is no such sample, ok is false.
+func latestSample(ts *prompb.TimeSeries) (value float64, timestamp int64, ok bool) {
+	for _, s := range ts.GetSamples() {
+		if math.Float64bits(s.GetValue()) == staleNaN {
+			continue
+		}
+		if !ok || s.GetTimestamp() >= timestamp {
+			value, timestamp, ok = s.GetValue(), s.GetTimestamp(), true
+		}
+	}
+	return value, timestamp, ok
+}
+
+// addMetadata adds the metric family described by the provided metadata to
+// metadata, if it is a counter or a gauge.
+func addMetadata(md *prompb.MetricMetadata, metadata map[string]*dto.MetricFamily) {
+	mf := &dto.MetricFamily{}
+	switch md.GetType() {
+	case prompb.MetricMetadata_COUNTER:
+		mf.Type = dto.MetricType_COUNTER.Enum()
+	case prompb.MetricMetadata_GAUGE:
+		mf.Type = dto.MetricType_GAUGE.Enum()
+	default:
+		return
+	}
+	if help := md.GetHelp(); help != "" {
+		mf.Help = proto.String(help)
+	}
+	metadata[md.GetMetricFamilyName()] = mf
+}
+
+// setType sets the type and help of mf to those of md, moving the values of its
+// untyped metrics to the corresponding type.
+func setType(mf, md *dto.MetricFamily) {
+	mf.Type, mf.Help = md.Type, md.Help
+	for _, m := range mf.Metric {
+		v := m.Untyped.Value
+		m.Untyped = nil
+		if md.GetType() == dto.MetricType_COUNTER {
+			m.Counter = &dto.Counter{Value: v}
+		} else {
+			m.Gauge = &dto.Gauge{Value: v}
+		}
+	}
+}
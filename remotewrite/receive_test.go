@@ -0,0 +1,110 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package remotewrite
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/remotewrite/prompb"
+)
+
+func TestConvert(t *testing.T) {
+	series := func(value float64, timestamp int64, pairs ...string) *prompb.TimeSeries {
+		ts := &prompb.TimeSeries{Samples: []*prompb.Sample{{Value: value, Timestamp: timestamp}}}
+		for i := 0; i < len(pairs); i += 2 {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: pairs[i], Value: pairs[i+1]})
+		}
+		return ts
+	}
+	encode := func(req *prompb.WriteRequest) []byte {
+		b, err := proto.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snappy.Encode(nil, b)
+	}
+	b := encode(&prompb.WriteRequest{
+		Timeseries: []*prompb.TimeSeries{
+			series(7, 2000, "__name__", "requests_total", "job", "api", "instance", "a:80", "code", "200"),
+			series(5, 1000, "__name__", "requests_total", "job", "api", "instance", "a:80", "code", "200"),
+			series(21.5, 1000, "__name__", "temperature", "instance", "b:80", "__meta_x", "y"),
+			series(math.Float64frombits(staleNaN), 1000, "__name__", "temperature", "instance", "c:80"),
+			series(1, 1000, "__name__", "up", "job", "api", "instance", "a:80"),
+		},
+		Metadata: []*prompb.MetricMetadata{{
+			Type:             prompb.MetricMetadata_COUNTER,
+			MetricFamilyName: "requests_total",
+			Help:             "Requests served.",
+		}},
+	})
+
+	groups, err := Convert(b, "remote_write", []string{"instance"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(groups); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+	if expected, got := map[string]string{"job": "api", "instance": "a:80"}, groups[0].Labels; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted grouping labels %v, got %v.", expected, got)
+	}
+	want := map[string]*dto.MetricFamily{
+		"requests_total": {
+			Name: proto.String("requests_total"),
+			Help: proto.String("Requests served."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:   []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}},
+				Counter: &dto.Counter{Value: proto.Float64(7)},
+			}},
+		},
+		"up": {
+			Name: proto.String("up"),
+			Type: dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{{
+				Label:   []*dto.LabelPair{},
+				Untyped: &dto.Untyped{Value: proto.Float64(1)},
+			}},
+		},
+	}
+	if expected, got := len(want), len(groups[0].MetricFamilies); expected != got {
+		t.Errorf("Wanted %d metric families, got %d.", expected, got)
+	}
+	for name, mf := range want {
+		if got := groups[0].MetricFamilies[name]; !proto.Equal(mf, got) {
+			t.Errorf("Wanted %s, got %s.", mf, got)
+		}
+	}
+	// The stale series is left out, and so is its group.
+	if expected, got := map[string]string{"job": "remote_write", "instance": "b:80"}, groups[1].Labels; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted grouping labels %v, got %v.", expected, got)
+	}
+	if expected, got := 0, len(groups[1].MetricFamilies["temperature"].GetMetric()[0].GetLabel()); expected != got {
+		t.Errorf("Wanted %d labels, got %d.", expected, got)
+	}
+
+	unnamed := encode(&prompb.WriteRequest{Timeseries: []*prompb.TimeSeries{series(1, 0, "job", "api")}})
+	if _, err := Convert(unnamed, "remote_write", nil); err == nil || err.Error() != "time series 1: missing metric name" {
+		t.Errorf("Wanted error for time series 1, got %v.", err)
+	}
+	if _, err := Convert([]byte("\x0a\x02\x0a\x00"), "remote_write", nil); err == nil {
+		t.Error("Expected error for request without snappy encoding.")
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package scrape pulls metrics from targets that expose them but cannot push
+// them, and stores them in the Pushgateway as if the targets had pushed them.
+package scrape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/prometheus/pushgateway/internal/codec"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	defaultInterval = time.Minute
+	defaultTimeout  = 10 * time.Second
+)
+
+// acceptHeader prefers the protobuf format, which needs no parsing, over the
+// text format.
+var acceptHeader = string(codec.ProtoDelim) + ";q=0.7," + string(codec.Text) + ";q=0.3"
+
+var (
+	scrapesDesc = prometheus.NewDesc(
+		"pushgateway_scrape_target_scrapes_total",
+		"Total number of scrapes of a scrape target.",
+		[]string{"target"}, nil,
+	)
+	scrapeFailuresDesc = prometheus.NewDesc(
+		"pushgateway_scrape_target_failures_total",
+		"Total number of scrapes of a scrape target that failed or whose metrics have been rejected by the metric store.",
+		[]string{"target"}, nil,
+	)
+)
+
+// TargetConfig configures one scrape target.
+type TargetConfig struct {
+	// URL is the URL to scrape, e.g. "http://batch-host:8080/metrics".
+	// Credentials for basic auth may be included.
+	URL string `yaml:"url"`
+	// Labels are the grouping labels the scraped metrics are stored
+	// under. The job label is required. If there is no instance label,
+	// the host and port of URL are used, like Prometheus does.
+	Labels map[string]string `yaml:"labels"`
+	// Interval is the interval at which the target is scraped. Zero
+	// means one minute.
+	Interval model.Duration `yaml:"interval"`
+	// Timeout is how long to wait for the target to respond. Zero means
+	// 10s or Interval, whichever is shorter.
+	Timeout model.Duration `yaml:"timeout"`
+	// TTL is the time to live of the scraped metrics, see
+	// storage.WriteRequest. If a target goes away, its last scraped
+	// metrics are removed once the TTL has passed. Zero means the metrics
+	// never expire.
+	TTL model.Duration `yaml:"ttl"`
+}
+
+// Config is the content of the file provided with --scrape.config-file.
+type Config struct {
+	Targets []*TargetConfig `yaml:"targets"`
+}
+
+// LoadConfigFile reads and validates a Config from the provided YAML file and
+// fills in the defaults.
+func LoadConfigFile(file string) (*Config, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("could not parse scrape config file %q: %v", file, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%v in scrape config file %q", err, file)
+	}
+	return cfg, nil
+}
+
+// validate returns an error if the Config has no targets or an invalid one,
+// or if two targets have the same grouping labels. It fills in the defaults.
+func (cfg *Config) validate() error {
+	if len(cfg.Targets) == 0 {
+		return errors.New("no targets")
+	}
+	keys := map[string]string{}
+	for _, tc := range cfg.Targets {
+		if tc == nil {
+			return errors.New("empty target")
+		}
+		u, err := url.Parse(tc.URL)
+		if err != nil {
+			return fmt.Errorf("invalid target URL %q: %v", tc.URL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("target URL %q has to start with http:// or https://", tc.URL)
+		}
+		if tc.Labels["job"] == "" {
+			return fmt.Errorf("no job label for target %q", tc.URL)
+		}
+		labels := make(map[string]string, len(tc.Labels)+1)
+		for name, value := range tc.Labels {
+			if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+				return fmt.Errorf("invalid label name %q for target %q", name, tc.URL)
+			}
+			labels[name] = value
+		}
+		if _, ok := labels["instance"]; !ok {
+			labels["instance"] = u.Host
+		}
+		tc.Labels = labels
+		key := fmt.Sprint(labels)
+		if other, ok := keys[key]; ok {
+			return fmt.Errorf("targets %q and %q have the same grouping labels %s", other, tc.URL, key)
+		}
+		keys[key] = tc.URL
+		if tc.Interval < 0 || tc.Timeout < 0 || tc.TTL < 0 {
+			return fmt.Errorf("negative duration for target %q", tc.URL)
+		}
+		if tc.Interval == 0 {
+			tc.Interval = model.Duration(defaultInterval)
+		}
+		if tc.Timeout == 0 {
+			tc.Timeout = model.Duration(defaultTimeout)
+		}
+		if tc.Timeout > tc.Interval {
+			tc.Timeout = tc.Interval
+		}
+	}
+	return nil
+}
+
+// Scraper scrapes the targets of a Config at their intervals and submits the
+// scraped metrics to a MetricStore, replacing the group of the target each
+// time, just like a PUT of the metrics would. The targets are scraped for the
+// first time right away. Timestamps in the scraped metrics are dropped.
+//
+// A failed scrape leaves the group of the target alone. It is only logged (at
+// debug level, as short-lived targets are expected to go away) and counted.
+// Like a rejected push, metrics rejected by the MetricStore (e.g. because they
+// are inconsistent or exceed a limit) mark the push of the group as failed.
+//
+// A Scraper implements prometheus.Collector to expose metrics about the
+// scrapes. It is up to the caller to register it.
+type Scraper struct {
+	ms      storage.MetricStore
+	targets []*target
+	client  *http.Client
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	logger  log.Logger
+}
+
+type target struct {
+	cfg    *TargetConfig
+	name   string // The URL without credentials, for metrics and logging.
+	logger log.Logger
+
+	mtx               sync.Mutex
+	scrapes, failures int
+}
+
+// NewScraper returns a Scraper for the targets of the provided (validated)
+// Config, submitting to the provided MetricStore. It starts scraping in the
+// background until Stop is called.
+func NewScraper(ms storage.MetricStore, cfg *Config, logger log.Logger) *Scraper {
+	s := &Scraper{
+		ms:     ms,
+		client: &http.Client{},
+		stop:   make(chan struct{}),
+		logger: logger,
+	}
+	for _, tc := range cfg.Targets {
+		u, _ := url.Parse(tc.URL) // Validated already.
+		name := u.Host + u.Path
+		s.targets = append(s.targets, &target{
+			cfg:    tc,
+			name:   name,
+			logger: log.With(logger, "target", name),
+		})
+	}
+	for _, t := range s.targets {
+		s.wg.Add(1)
+		go s.loop(t)
+	}
+	return s
+}
+
+// Stop stops scraping and waits for scrapes in progress to complete, so that
+// the MetricStore can be shut down afterwards.
+func (s *Scraper) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Describe implements prometheus.Collector.
+func (s *Scraper) Describe(ch chan<- *prometheus.Desc) {
+	ch <- scrapesDesc
+	ch <- scrapeFailuresDesc
+}
+
+// Collect implements prometheus.Collector.
+func (s *Scraper) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range s.targets {
+		t.mtx.Lock()
+		scrapes, failures := t.scrapes, t.failures
+		t.mtx.Unlock()
+		ch <- prometheus.MustNewConstMetric(scrapesDesc, prometheus.CounterValue, float64(scrapes), t.name)
+		ch <- prometheus.MustNewConstMetric(scrapeFailuresDesc, prometheus.CounterValue, float64(failures), t.name)
+	}
+}
+
+func (s *Scraper) loop(t *target) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(time.Duration(t.cfg.Interval))
+	defer ticker.Stop()
+	for {
+		err := s.scrape(t)
+		t.mtx.Lock()
+		t.scrapes++
+		if err != nil {
+			t.failures++
+		}
+		t.mtx.Unlock()
+		if err != nil {
+			level.Debug(t.logger).Log("msg", "scrape failed", "err", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// scrape scrapes the provided target once and submits the result, waiting for
+// the MetricStore to process it.
+func (s *Scraper) scrape(t *target) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(t.cfg.Timeout))
+	defer cancel()
+	req, err := http.NewRequest("GET", t.cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	pushFormat := storage.PushFormat{
+		ContentType: resp.Header.Get("Content-Type"),
+		Format:      codec.FormatForContentType(resp.Header.Get("Content-Type")),
+	}
+	metricFamilies, err := codec.DecodeAll(resp.Body, pushFormat.Format)
+	if err != nil {
+		return fmt.Errorf("could not decode scraped metrics: %v", err)
+	}
+	for _, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			m.TimestampMs = nil
+		}
+	}
+
+	labels := make(map[string]string, len(t.cfg.Labels))
+	for name, value := range t.cfg.Labels {
+		labels[name] = value
+	}
+	errCh := make(chan error, 1)
+	if err := s.ms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:         labels,
+		Timestamp:      time.Now(),
+		MetricFamilies: metricFamilies,
+		Replace:        true,
+		TTL:            time.Duration(t.cfg.TTL),
+		PushFormat:     pushFormat,
+		Done:           errCh,
+	}); err != nil {
+		return err
+	}
+	var rejected error
+	for err := range errCh {
+		if rejected == nil {
+			rejected = fmt.Errorf("scraped metrics rejected: %v", err)
+		}
+	}
+	return rejected
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scrape
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "scrape.TestLoadConfigFile.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := path.Join(tempDir, "scrape.yml")
+
+	for name, s := range map[string]struct {
+		content string
+		wantErr string
+	}{
+		"valid": {content: `
+targets:
+  - url: http://a:8080/metrics
+    labels: {job: a}
+  - url: http://b:8080/metrics
+    labels: {job: b, instance: ""}
+    interval: 10s
+    timeout: 30s
+    ttl: 5m
+`},
+		"no targets":       {content: "targets: []\n", wantErr: "no targets"},
+		"unknown field":    {content: "targets:\n  - url: http://a/\n    lables: {job: a}\n", wantErr: "could not parse"},
+		"bad scheme":       {content: "targets:\n  - url: ftp://a/\n    labels: {job: a}\n", wantErr: "has to start with"},
+		"no job":           {content: "targets:\n  - url: http://a/\n", wantErr: "no job label"},
+		"bad label name":   {content: "targets:\n  - url: http://a/\n    labels: {job: a, __x: y}\n", wantErr: "invalid label name"},
+		"negative":         {content: "targets:\n  - url: http://a/\n    labels: {job: a}\n    ttl: -1m\n", wantErr: "could not parse"},
+		"duplicate labels": {content: "targets:\n  - url: http://a/x\n    labels: {job: a}\n  - url: http://a/y\n    labels: {job: a}\n", wantErr: "same grouping labels"},
+	} {
+		if err := ioutil.WriteFile(file, []byte(s.content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfigFile(file)
+		if s.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), s.wantErr) {
+				t.Errorf("%s: Wanted error containing %q, got %v.", name, s.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %v", name, err)
+		}
+		a, b := cfg.Targets[0], cfg.Targets[1]
+		if expected, got := "a:8080", a.Labels["instance"]; expected != got {
+			t.Errorf("%s: Wanted default instance %q, got %q.", name, expected, got)
+		}
+		if expected, got := model.Duration(time.Minute), a.Interval; expected != got {
+			t.Errorf("%s: Wanted default interval %v, got %v.", name, expected, got)
+		}
+		if expected, got := model.Duration(10*time.Second), a.Timeout; expected != got {
+			t.Errorf("%s: Wanted default timeout %v, got %v.", name, expected, got)
+		}
+		if expected, got := "", b.Labels["instance"]; expected != got {
+			t.Errorf("%s: Wanted explicit instance %q, got %q.", name, expected, got)
+		}
+		// The timeout is capped at the interval.
+		if expected, got := model.Duration(10*time.Second), b.Timeout; expected != got {
+			t.Errorf("%s: Wanted capped timeout %v, got %v.", name, expected, got)
+		}
+	}
+}
+
+func TestScraper(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "application/vnd.google.protobuf") {
+			t.Errorf("Unexpected Accept header %q.", r.Header.Get("Accept"))
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("# TYPE some_metric counter\nsome_metric{foo=\"bar\"} 3 1234567890\n"))
+	}))
+	defer ts.Close()
+
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, log.NewNopLogger())
+	defer ms.Shutdown()
+	cfg := &Config{Targets: []*TargetConfig{{
+		URL:      ts.URL + "/metrics",
+		Labels:   map[string]string{"job": "short-lived"},
+		Interval: model.Duration(time.Hour),
+		TTL:      model.Duration(time.Hour),
+	}}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	labels := cfg.Targets[0].Labels
+
+	// The first scrape happens right away and is complete once Stop
+	// returns.
+	s := NewScraper(ms, cfg, log.NewNopLogger())
+	s.Stop()
+	group, ok := storage.GetMetricGroup(ms, labels)
+	if !ok {
+		t.Fatalf("Group %v not found.", labels)
+	}
+	tmf, ok := group.Metrics["some_metric"]
+	if !ok {
+		t.Fatal("Scraped metric not found.")
+	}
+	if expected, got := time.Hour, tmf.TTL; expected != got {
+		t.Errorf("Wanted TTL %v, got %v.", expected, got)
+	}
+	m := tmf.GetMetricFamily().GetMetric()[0]
+	if m.TimestampMs != nil {
+		t.Errorf("Unexpected timestamp %d.", m.GetTimestampMs())
+	}
+	if expected, got := 3, len(m.GetLabel()); expected != got {
+		t.Errorf("Wanted %d labels, got %v.", expected, m.GetLabel())
+	}
+
+	// A failed scrape leaves the group alone.
+	status = http.StatusInternalServerError
+	if err := s.scrape(s.targets[0]); err == nil {
+		t.Error("Expected error for failed scrape.")
+	}
+	if _, ok := storage.GetMetricGroup(ms, labels); !ok {
+		t.Error("Group removed by failed scrape.")
+	}
+
+	tgt := s.targets[0]
+	if expected, got := strings.TrimPrefix(ts.URL, "http://")+"/metrics", tgt.name; expected != got {
+		t.Errorf("Wanted target name %q, got %q.", expected, got)
+	}
+	if expected, got := 1, tgt.scrapes; expected != got {
+		t.Errorf("Wanted %d scrapes, got %d.", expected, got)
+	}
+	if expected, got := 0, tgt.failures; expected != got {
+		t.Errorf("Wanted %d failures, got %d.", expected, got)
+	}
+}
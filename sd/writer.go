@@ -0,0 +1,218 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sd writes documents for the file-based service discovery of
+// Prometheus, listing the jobs (or metric groups) the Pushgateway currently has
+// pushed metrics for.
+package sd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+// Labels of the TargetGroups.
+const (
+	// JobLabel is the job of the target.
+	JobLabel = model.MetaLabelPrefix + "pushgateway_job"
+	// GroupLabelPrefix is prepended to the grouping label names of the
+	// target, if there is one target per group.
+	GroupLabelPrefix = model.MetaLabelPrefix + "pushgateway_group_"
+	// GroupsLabel is the number of groups of the job of the target, if
+	// there is one target per job.
+	GroupsLabel = model.MetaLabelPrefix + "pushgateway_groups"
+)
+
+// TargetGroup is an element of a file_sd document, which has the same format as
+// the response of an HTTP SD endpoint.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// Options configure a Writer.
+type Options struct {
+	// File is the file to write the document to. It is replaced
+	// atomically.
+	File string
+	// Target is the address Prometheus scrapes the Pushgateway at, i.e.
+	// the only target of every TargetGroup.
+	Target string
+	// PushPath is the path below which groups are pushed and read back,
+	// usually "/metrics".
+	PushPath string
+	// PerGroup makes the document list one TargetGroup per metric group
+	// rather than per job.
+	PerGroup bool
+	// Interval is the interval at which the document is regenerated. The
+	// file is only written if the document has changed.
+	Interval time.Duration
+}
+
+// TargetGroups returns one TargetGroup per job in groups, or, if perGroup is
+// true, per group, sorted by job (and grouping labels). All TargetGroups have
+// the provided target as their only target, so it is up to the relabeling in
+// Prometheus to tell them apart, using the labels prefixed with
+// model.MetaLabelPrefix. With perGroup, the TargetGroups set the metrics path
+// to the path reading back the metrics of the group (see handler.GroupMetrics)
+// below pushPath, so that each target scrapes exactly its group.
+func TargetGroups(groups storage.GroupingKeyToMetricGroup, target, pushPath string, perGroup bool) []TargetGroup {
+	tgs := []TargetGroup{}
+	if perGroup {
+		for _, group := range groups {
+			labels := map[string]string{
+				JobLabel:               group.Labels["job"],
+				model.MetricsPathLabel: pushPath + handler.GroupingPath(group.Labels),
+			}
+			for name, value := range group.Labels {
+				labels[GroupLabelPrefix+name] = value
+			}
+			tgs = append(tgs, TargetGroup{Targets: []string{target}, Labels: labels})
+		}
+		sort.Slice(tgs, func(i, j int) bool {
+			a, b := tgs[i].Labels, tgs[j].Labels
+			if a[JobLabel] != b[JobLabel] {
+				return a[JobLabel] < b[JobLabel]
+			}
+			return a[model.MetricsPathLabel] < b[model.MetricsPathLabel]
+		})
+		return tgs
+	}
+	jobs := map[string]int{}
+	for _, group := range groups {
+		jobs[group.Labels["job"]]++
+	}
+	names := make([]string, 0, len(jobs))
+	for job := range jobs {
+		names = append(names, job)
+	}
+	sort.Strings(names)
+	for _, job := range names {
+		tgs = append(tgs, TargetGroup{
+			Targets: []string{target},
+			Labels: map[string]string{
+				JobLabel:    job,
+				GroupsLabel: strconv.Itoa(jobs[job]),
+			},
+		})
+	}
+	return tgs
+}
+
+// Writer regenerates a file_sd document from the content of a MetricStore at a
+// fixed interval and writes it to a file whenever it has changed.
+type Writer struct {
+	ms     storage.MetricStore
+	o      Options
+	last   []byte
+	stop   chan struct{}
+	done   chan struct{}
+	logger log.Logger
+}
+
+// NewWriter returns a Writer for the provided MetricStore. It writes the
+// document right away and then starts regenerating it in the background until
+// Stop is called.
+func NewWriter(ms storage.MetricStore, o Options, logger log.Logger) *Writer {
+	w := &Writer{
+		ms:     ms,
+		o:      o,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	w.update()
+	go w.loop()
+	return w
+}
+
+// Stop stops regenerating the document and writes it a last time. The file is
+// not removed so that Prometheus keeps scraping the jobs that are still
+// persisted.
+func (w *Writer) Stop() {
+	close(w.stop)
+	<-w.done
+	w.update()
+}
+
+func (w *Writer) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.o.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.update()
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// update writes the document if it has changed since it was last written.
+// Failing to write it is only logged, it is tried again upon the next update.
+func (w *Writer) update() {
+	b, err := json.MarshalIndent(TargetGroups(w.ms.GetMetricFamiliesMap(), w.o.Target, w.o.PushPath, w.o.PerGroup), "", "  ")
+	if err != nil {
+		level.Error(w.logger).Log("msg", "could not encode service discovery document", "err", err)
+		return
+	}
+	b = append(b, '\n')
+	if bytes.Equal(b, w.last) {
+		return
+	}
+	if err := writeFile(w.o.File, b); err != nil {
+		level.Error(w.logger).Log("msg", "could not write service discovery file", "file", w.o.File, "err", err)
+		return
+	}
+	w.last = b
+	level.Debug(w.logger).Log("msg", "wrote service discovery file", "file", w.o.File)
+}
+
+// writeFile replaces the file with the provided name by one with the provided
+// content, so that Prometheus never reads a partially written file.
+func writeFile(name string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".in_progress.")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// TempFile creates files only readable by the owner, while Prometheus
+	// might run as another user.
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
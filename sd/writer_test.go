@@ -0,0 +1,129 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/handler"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func push(t *testing.T, ms storage.MetricStore, labels map[string]string) {
+	t.Helper()
+	errCh := make(chan error, 1)
+	if err := ms.SubmitWriteRequest(storage.WriteRequest{
+		Labels:    labels,
+		Timestamp: time.Now(),
+		// Push timestamps are added even without pushed metrics.
+		MetricFamilies: map[string]*dto.MetricFamily{},
+		Done:           errCh,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for err := range errCh {
+		t.Fatal(err)
+	}
+}
+
+func TestTargetGroups(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, log.NewNopLogger())
+	defer ms.Shutdown()
+	push(t, ms, map[string]string{"job": "b"})
+	push(t, ms, map[string]string{"job": "a", "instance": "x/y"})
+	push(t, ms, map[string]string{"job": "a", "instance": ""})
+
+	tgs := TargetGroups(ms.GetMetricFamiliesMap(), "pushgateway:9091", "/metrics", false)
+	if expected, got := 2, len(tgs); expected != got {
+		t.Fatalf("Wanted %d target groups, got %d.", expected, got)
+	}
+	if tgs[0].Labels[JobLabel] != "a" || tgs[0].Labels[GroupsLabel] != "2" || tgs[1].Labels[JobLabel] != "b" {
+		t.Errorf("Unexpected target groups %v.", tgs)
+	}
+
+	tgs = TargetGroups(ms.GetMetricFamiliesMap(), "pushgateway:9091", "/metrics", true)
+	if expected, got := 3, len(tgs); expected != got {
+		t.Fatalf("Wanted %d target groups, got %d.", expected, got)
+	}
+	for _, tg := range tgs {
+		if len(tg.Targets) != 1 || tg.Targets[0] != "pushgateway:9091" {
+			t.Errorf("Unexpected targets %v.", tg.Targets)
+		}
+		metricsPath := tg.Labels[model.MetricsPathLabel]
+		if !strings.HasPrefix(metricsPath, "/metrics/job@base64/") {
+			t.Fatalf("Unexpected metrics path %q.", metricsPath)
+		}
+		// The path addresses exactly the group of the target.
+		labels, err := handler.ParseGroupingPath(strings.Replace(metricsPath, "/metrics/job@base64/", "/job@base64/", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range labels {
+			if expected, got := value, tg.Labels[GroupLabelPrefix+name]; expected != got {
+				t.Errorf("Wanted label %s=%q, got %q.", name, expected, got)
+			}
+		}
+	}
+	if tgs[2].Labels[JobLabel] != "b" {
+		t.Errorf("Target groups not sorted by job: %v", tgs)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "sd.TestWriter.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	file := path.Join(tempDir, "pushgateway.json")
+	read := func() []TargetGroup {
+		t.Helper()
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tgs []TargetGroup
+		if err := json.Unmarshal(content, &tgs); err != nil {
+			t.Fatal(err)
+		}
+		return tgs
+	}
+
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, log.NewNopLogger())
+	defer ms.Shutdown()
+	push(t, ms, map[string]string{"job": "a"})
+	w := NewWriter(ms, Options{File: file, Target: "localhost:9091", PushPath: "/metrics", Interval: time.Hour}, log.NewNopLogger())
+	if tgs := read(); len(tgs) != 1 || tgs[0].Labels[JobLabel] != "a" {
+		t.Errorf("Unexpected target groups %v.", tgs)
+	}
+	push(t, ms, map[string]string{"job": "b"})
+	w.Stop()
+	if expected, got := 2, len(read()); expected != got {
+		t.Errorf("Wanted %d target groups, got %d.", expected, got)
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("Unexpected file info %v, error %v.", fi, err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// serverOptions configure the HTTP server created by newServer. Zero timeouts
+// mean no timeout, except for idleTimeout, which falls back to readTimeout like
+// in http.Server.
+type serverOptions struct {
+	readTimeout          time.Duration
+	writeTimeout         time.Duration
+	idleTimeout          time.Duration
+	maxConcurrentStreams uint32 // Per HTTP/2 connection. Zero means the default of 250.
+	h2c                  bool   // Serve HTTP/2 without TLS, too.
+}
+
+// newServer returns an http.Server serving h on the provided address according
+// to the provided serverOptions. If tlsConfig is not nil, it must be the
+// configuration of the TLS listener the server will serve, and HTTP/2 is
+// negotiated via ALPN, for which the NextProtos of tlsConfig are set.
+// Otherwise, HTTP/2 is only served if opts.h2c is true, i.e. to clients using
+// HTTP/2 with prior knowledge or upgrading a connection from HTTP/1.1.
+func newServer(address string, h http.Handler, tlsConfig *tls.Config, opts serverOptions) (*http.Server, error) {
+	h2s := &http2.Server{
+		MaxConcurrentStreams: opts.maxConcurrentStreams,
+		IdleTimeout:          opts.idleTimeout,
+	}
+	if tlsConfig == nil && opts.h2c {
+		h = h2c.NewHandler(h, h2s)
+	}
+	srv := &http.Server{
+		Addr:         address,
+		Handler:      h,
+		ReadTimeout:  opts.readTimeout,
+		WriteTimeout: opts.writeTimeout,
+		IdleTimeout:  opts.idleTimeout,
+	}
+	if tlsConfig == nil {
+		return srv, nil
+	}
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
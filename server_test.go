@@ -0,0 +1,109 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"golang.org/x/net/http2"
+)
+
+func TestNewServer(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestNewServer.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	certFile := path.Join(tempDir, "cert.pem")
+	keyFile := path.Join(tempDir, "key.pem")
+	writeCert(t, certFile, keyFile, "server", time.Now())
+	cr, err := newCertReloader(certFile, keyFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protocol := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	// The clients only speak HTTP/2, the plain one with prior knowledge.
+	plainClient := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	tlsClient := &http.Client{Transport: &http2.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	for name, s := range map[string]struct {
+		tls     bool
+		h2c     bool
+		wantErr bool
+	}{
+		"plain HTTP/1.1": {wantErr: true},
+		"h2c":            {h2c: true},
+		"TLS":            {tls: true},
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, url := plainClient, "http://"+l.Addr().String()
+		var tlsConfig *tls.Config
+		if s.tls {
+			if tlsConfig, err = newTLSConfig(cr, ""); err != nil {
+				t.Fatal(err)
+			}
+			l = tls.NewListener(l, tlsConfig)
+			client, url = tlsClient, "https://"+l.Addr().String()
+		}
+		srv, err := newServer(l.Addr().String(), protocol, tlsConfig, serverOptions{
+			idleTimeout: time.Minute,
+			h2c:         s.h2c,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := time.Minute, srv.IdleTimeout; expected != got {
+			t.Errorf("%s: Wanted idle timeout %v, got %v.", name, expected, got)
+		}
+		go srv.Serve(l)
+
+		resp, err := client.Get(url)
+		if s.wantErr {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: Expected error for HTTP/2 request.", name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: Unexpected error: %v", name, err)
+		} else {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if expected, got := "HTTP/2.0", string(body); expected != got {
+				t.Errorf("%s: Wanted protocol %s, got %s.", name, expected, got)
+			}
+		}
+		srv.Close()
+	}
+}
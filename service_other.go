@@ -0,0 +1,24 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/go-kit/kit/log"
+
+// runService is a no-op outside of Windows. It returns a nil channel, which
+// never receives a stop request, and a function doing nothing.
+func runService(logger log.Logger) (<-chan struct{}, func()) {
+	return nil, func() {}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceName is the name the Pushgateway runs under as a Windows service. As
+// it runs in its own process, the service control manager does not require the
+// name to match the one the service has been installed with.
+const serviceName = "pushgateway"
+
+// runService connects to the Windows service control manager if the
+// Pushgateway has been started as a Windows service, and reports it running.
+// It returns a channel closed once the service control manager requests the
+// service to stop (or the system shuts down), and a function to call once the
+// Pushgateway has shut down, which reports the service stopped. If the
+// Pushgateway has been started interactively, the returned channel is nil, and
+// the returned function does nothing.
+func runService(logger log.Logger) (<-chan struct{}, func()) {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		level.Warn(logger).Log("msg", "could not determine whether running as a Windows service, assuming not", "err", err)
+		return nil, func() {}
+	}
+	if interactive {
+		return nil, func() {}
+	}
+	s := &windowsService{
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		if err := svc.Run(serviceName, s); err != nil {
+			level.Error(logger).Log("msg", "could not run as Windows service", "err", err)
+		}
+	}()
+	level.Info(logger).Log("msg", "running as Windows service", "service", serviceName)
+	return s.stopCh, func() {
+		close(s.doneCh)
+		<-exited
+	}
+}
+
+// windowsService implements svc.Handler.
+type windowsService struct {
+	stopCh chan struct{} // Closed upon a stop request.
+	doneCh chan struct{} // Closed once the Pushgateway has shut down.
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				close(s.stopCh)
+				<-s.doneCh
+				return false, 0
+			}
+		case <-s.doneCh:
+			// Shut down for another reason, e.g. via the lifecycle
+			// API.
+			return false, 0
+		}
+	}
+}
@@ -0,0 +1,428 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package statsd accepts metrics in the statsd protocol and stores them in the
+// Pushgateway, so that legacy statsd emitters can feed a Prometheus
+// environment.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/ingest"
+	"github.com/prometheus/pushgateway/internal/lineserver"
+	"github.com/prometheus/pushgateway/storage"
+)
+
+var (
+	eventsDesc = prometheus.NewDesc(
+		"pushgateway_statsd_events_total",
+		"Total number of statsd events received, by metric type.",
+		[]string{"type"}, nil,
+	)
+	invalidLinesDesc = prometheus.NewDesc(
+		"pushgateway_statsd_invalid_lines_total",
+		"Total number of statsd lines that could not be parsed, had an unsupported metric type, or conflicted with the type of an earlier event of the same name.",
+		nil, nil,
+	)
+)
+
+// Options configure a Listener.
+type Options struct {
+	// Job is the job label of the groups the metrics are stored in.
+	Job string
+	// GroupingTags are the names of the tags (in the DogStatsD format,
+	// e.g. "|#instance:host1") that are turned into grouping labels
+	// rather than labels of the metrics. A tag "job" overrides Job.
+	GroupingTags []string
+	// FlushInterval is the interval at which the received events are
+	// submitted to the MetricStore.
+	FlushInterval time.Duration
+}
+
+// event is a parsed statsd line.
+type event struct {
+	name  string
+	typ   dto.MetricType
+	value float64
+	delta bool    // Only for gauges: value is added to the current value.
+	rate  float64 // The sample rate, in (0, 1].
+	tags  map[string]string
+}
+
+// sample is the aggregated state of one series.
+type sample struct {
+	labels []*dto.LabelPair
+	value  float64 // Counter or gauge value, or sum of a timer in seconds.
+	count  float64 // Sample count of a timer, scaled by the sample rates.
+}
+
+// family holds the samples of one metric name in a group, keyed by their label
+// signature.
+type family struct {
+	typ     dto.MetricType
+	samples map[string]*sample
+}
+
+// group holds the state of one metric group. Counters and timers only hold
+// what has been received since the last flush, as they are aggregated with
+// the stored ones by the MetricStore. Gauges hold their current values and are
+// submitted as a whole if any of them has changed.
+type group struct {
+	labels        map[string]string
+	deltas        map[string]*family // Counters and timers.
+	gauges        map[string]*family
+	gaugesChanged bool
+}
+
+// Listener receives statsd lines via UDP and TCP and submits the resulting
+// metrics to a MetricStore at the configured flush interval, one metric group
+// per distinct set of grouping labels (see Options).
+//
+// Metric names and tag names have all characters that are invalid in
+// Prometheus names replaced by '_' (so that "api.requests" becomes
+// "api_requests"). Counters ("c") become counters and gauges ("g") gauges. A
+// gauge value starting with '+' or '-' is added to the current value. Timers
+// ("ms" and "h") become summaries without quantiles, with the observations
+// converted to seconds. Sample rates ("|@0.1") are taken into account for
+// counters and timers. Sets and other metric types are not supported.
+//
+// Counters and timers are submitted with storage.AggregateSum, so that they
+// keep counting across flushes (and restarts of the Pushgateway, if the
+// metrics are persisted). Gauges are only known to the Listener, so their
+// values start at zero again after a restart.
+//
+// A Listener implements prometheus.Collector to expose metrics about the
+// received lines. It is up to the caller to register it.
+type Listener struct {
+	ms     storage.MetricStore
+	o      Options
+	server *lineserver.Server
+	stop   chan struct{}
+	done   chan struct{}
+	logger log.Logger
+
+	mtx     sync.Mutex // Protects the fields below.
+	groups  map[string]*group
+	types   map[string]dto.MetricType // Per metric name, across groups.
+	events  map[dto.MetricType]int
+	invalid int
+}
+
+// NewListener returns a Listener listening on the provided address (e.g.
+// ":9125") for both UDP and TCP, which starts receiving and flushing in the
+// background until Close is called.
+func NewListener(ms storage.MetricStore, address string, o Options, logger log.Logger) (*Listener, error) {
+	l := &Listener{
+		ms:     ms,
+		o:      o,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: logger,
+		groups: map[string]*group{},
+		types:  map[string]dto.MetricType{},
+		events: map[dto.MetricType]int{},
+	}
+	var err error
+	if l.server, err = lineserver.Listen(address, l.handleLine, logger); err != nil {
+		return nil, err
+	}
+	go l.loop()
+	return l, nil
+}
+
+// Close stops listening and flushes the events received so far one last time,
+// so that the MetricStore can be shut down afterwards.
+func (l *Listener) Close() {
+	l.server.Close()
+	close(l.stop)
+	<-l.done
+	l.flush()
+}
+
+// Describe implements prometheus.Collector.
+func (l *Listener) Describe(ch chan<- *prometheus.Desc) {
+	ch <- eventsDesc
+	ch <- invalidLinesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (l *Listener) Collect(ch chan<- prometheus.Metric) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, typ := range []dto.MetricType{dto.MetricType_COUNTER, dto.MetricType_GAUGE, dto.MetricType_SUMMARY} {
+		ch <- prometheus.MustNewConstMetric(eventsDesc, prometheus.CounterValue, float64(l.events[typ]), typeNames[typ])
+	}
+	ch <- prometheus.MustNewConstMetric(invalidLinesDesc, prometheus.CounterValue, float64(l.invalid))
+}
+
+// typeNames are the values of the type label of eventsDesc.
+var typeNames = map[dto.MetricType]string{
+	dto.MetricType_COUNTER: "counter",
+	dto.MetricType_GAUGE:   "gauge",
+	dto.MetricType_SUMMARY: "timer",
+}
+
+func (l *Listener) loop() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.o.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// handleLine parses the provided line and adds the event to its group.
+func (l *Listener) handleLine(line string) {
+	e, err := parseLine(line)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if err == nil {
+		if typ, ok := l.types[e.name]; ok && typ != e.typ {
+			err = fmt.Errorf("metric %q has been received as %s before", e.name, typeNames[typ])
+		}
+	}
+	if err != nil {
+		l.invalid++
+		level.Debug(l.logger).Log("msg", "invalid statsd line", "line", line, "err", err)
+		return
+	}
+	l.types[e.name] = e.typ
+	l.events[e.typ]++
+
+	groupingLabels := map[string]string{"job": l.o.Job}
+	for _, name := range l.o.GroupingTags {
+		if value, ok := e.tags[name]; ok {
+			groupingLabels[name] = value
+			delete(e.tags, name)
+		}
+	}
+	// Remaining tags named like a grouping label would be overwritten by
+	// it, so rename them like Prometheus does for conflicting labels.
+	for name, value := range e.tags {
+		if _, ok := groupingLabels[name]; ok || name == "instance" {
+			delete(e.tags, name)
+			e.tags["exported_"+name] = value
+		}
+	}
+	key := ingest.Signature(groupingLabels)
+	g, ok := l.groups[key]
+	if !ok {
+		g = &group{
+			labels: groupingLabels,
+			deltas: map[string]*family{},
+			gauges: map[string]*family{},
+		}
+		l.groups[key] = g
+	}
+	families := g.deltas
+	if e.typ == dto.MetricType_GAUGE {
+		families = g.gauges
+		g.gaugesChanged = true
+	}
+	f, ok := families[e.name]
+	if !ok {
+		f = &family{typ: e.typ, samples: map[string]*sample{}}
+		families[e.name] = f
+	}
+	sig := ingest.Signature(e.tags)
+	s, ok := f.samples[sig]
+	if !ok {
+		s = &sample{labels: ingest.LabelPairs(e.tags)}
+		f.samples[sig] = s
+	}
+	switch e.typ {
+	case dto.MetricType_COUNTER:
+		s.value += e.value / e.rate
+	case dto.MetricType_GAUGE:
+		if e.delta {
+			s.value += e.value
+		} else {
+			s.value = e.value
+		}
+	case dto.MetricType_SUMMARY:
+		s.value += e.value / 1000 / e.rate
+		s.count += 1 / e.rate
+	}
+}
+
+// flush submits the changes of all groups to the MetricStore and waits for it
+// to process them. Rejected submissions are logged, and their events are lost.
+func (l *Listener) flush() {
+	type submission struct {
+		labels map[string]string
+		deltas map[string]*dto.MetricFamily
+		gauges map[string]*dto.MetricFamily
+	}
+	var submissions []submission
+	l.mtx.Lock()
+	for _, g := range l.groups {
+		s := submission{labels: g.labels}
+		if len(g.deltas) > 0 {
+			s.deltas = metricFamilies(g.deltas)
+			g.deltas = map[string]*family{}
+		}
+		if g.gaugesChanged {
+			s.gauges = metricFamilies(g.gauges)
+			g.gaugesChanged = false
+		}
+		if s.deltas != nil || s.gauges != nil {
+			submissions = append(submissions, s)
+		}
+	}
+	l.mtx.Unlock()
+
+	for _, s := range submissions {
+		if s.deltas != nil {
+			l.submit(storage.WriteRequest{
+				Labels:         ingest.CopyLabels(s.labels),
+				Timestamp:      time.Now(),
+				MetricFamilies: s.deltas,
+				Aggregation:    storage.AggregateSum,
+			})
+		}
+		if s.gauges != nil {
+			l.submit(storage.WriteRequest{
+				Labels:         ingest.CopyLabels(s.labels),
+				Timestamp:      time.Now(),
+				MetricFamilies: s.gauges,
+			})
+		}
+	}
+}
+
+func (l *Listener) submit(wr storage.WriteRequest) {
+	errCh := make(chan error, 1)
+	wr.Done = errCh
+	if err := l.ms.SubmitWriteRequest(wr); err != nil {
+		level.Warn(l.logger).Log("msg", "could not submit statsd metrics", "group", fmt.Sprint(wr.Labels), "err", err)
+		return
+	}
+	for err := range errCh {
+		level.Warn(l.logger).Log("msg", "statsd metrics rejected", "group", fmt.Sprint(wr.Labels), "err", err)
+	}
+}
+
+// parseLine parses a line of the form name:value|type[|@rate][|#tag:value,...].
+func parseLine(line string) (event, error) {
+	e := event{rate: 1}
+	colon := strings.LastIndex(line[:indexOrLen(line, '|')], ":")
+	if colon <= 0 {
+		return e, errors.New("missing name or value")
+	}
+	e.name = ingest.MetricName(line[:colon])
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return e, errors.New("missing metric type")
+	}
+	switch parts[1] {
+	case "c":
+		e.typ = dto.MetricType_COUNTER
+	case "g":
+		e.typ = dto.MetricType_GAUGE
+		e.delta = strings.HasPrefix(parts[0], "+") || strings.HasPrefix(parts[0], "-")
+	case "ms", "h":
+		e.typ = dto.MetricType_SUMMARY
+	default:
+		return e, fmt.Errorf("unsupported metric type %q", parts[1])
+	}
+	var err error
+	if e.value, err = strconv.ParseFloat(parts[0], 64); err != nil || math.IsNaN(e.value) || math.IsInf(e.value, 0) {
+		return e, fmt.Errorf("invalid value %q", parts[0])
+	}
+	if e.typ == dto.MetricType_COUNTER && e.value < 0 {
+		return e, fmt.Errorf("negative counter value %q", parts[0])
+	}
+	for _, part := range parts[2:] {
+		switch {
+		case strings.HasPrefix(part, "@"):
+			if e.rate, err = strconv.ParseFloat(part[1:], 64); err != nil || e.rate <= 0 || e.rate > 1 {
+				return e, fmt.Errorf("invalid sample rate %q", part)
+			}
+		case strings.HasPrefix(part, "#"):
+			e.tags = map[string]string{}
+			for _, tag := range strings.Split(part[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if kv[0] == "" {
+					continue
+				}
+				name := ingest.LabelName(kv[0])
+				if strings.HasPrefix(name, "__") {
+					name = "tag" + name // Reserved otherwise.
+				}
+				if len(kv) == 2 {
+					e.tags[name] = kv[1]
+				} else {
+					e.tags[name] = ""
+				}
+			}
+		default:
+			return e, fmt.Errorf("invalid line section %q", part)
+		}
+	}
+	return e, nil
+}
+
+func indexOrLen(s string, c byte) int {
+	if i := strings.IndexByte(s, c); i >= 0 {
+		return i
+	}
+	return len(s)
+}
+
+// metricFamilies converts the provided families into MetricFamilies.
+func metricFamilies(families map[string]*family) map[string]*dto.MetricFamily {
+	mfs := make(map[string]*dto.MetricFamily, len(families))
+	for name, f := range families {
+		mf := &dto.MetricFamily{
+			Name: proto.String(name),
+			Help: proto.String("Received via statsd."),
+			Type: f.typ.Enum(),
+		}
+		for _, s := range f.samples {
+			m := &dto.Metric{Label: s.labels}
+			switch f.typ {
+			case dto.MetricType_COUNTER:
+				m.Counter = &dto.Counter{Value: proto.Float64(s.value)}
+			case dto.MetricType_GAUGE:
+				m.Gauge = &dto.Gauge{Value: proto.Float64(s.value)}
+			case dto.MetricType_SUMMARY:
+				m.Summary = &dto.Summary{
+					SampleCount: proto.Uint64(uint64(math.Round(s.count))),
+					SampleSum:   proto.Float64(s.value),
+				}
+			}
+			mf.Metric = append(mf.Metric, m)
+		}
+		mfs[name] = mf
+	}
+	return mfs
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package statsd
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestParseLine(t *testing.T) {
+	for line, s := range map[string]struct {
+		want    event
+		wantErr bool
+	}{
+		"api.requests:1|c": {want: event{name: "api_requests", typ: dto.MetricType_COUNTER, value: 1, rate: 1}},
+		"api.requests:2|c|@0.5|#code:200,region:eu": {want: event{
+			name: "api_requests", typ: dto.MetricType_COUNTER, value: 2, rate: 0.5,
+			tags: map[string]string{"code": "200", "region": "eu"},
+		}},
+		"temp:-3|g":           {want: event{name: "temp", typ: dto.MetricType_GAUGE, value: -3, delta: true, rate: 1}},
+		"temp:21.5|g":         {want: event{name: "temp", typ: dto.MetricType_GAUGE, value: 21.5, rate: 1}},
+		"1st-query:320|ms":    {want: event{name: "_1st_query", typ: dto.MetricType_SUMMARY, value: 320, rate: 1}},
+		"q:1|h|#__x:y":        {want: event{name: "q", typ: dto.MetricType_SUMMARY, value: 1, rate: 1, tags: map[string]string{"tag__x": "y"}}},
+		"users:alice|s":       {wantErr: true},
+		"api.requests:-1|c":   {wantErr: true},
+		"api.requests:1|c|@2": {wantErr: true},
+		"api.requests:x|c":    {wantErr: true},
+		"api.requests:1":      {wantErr: true},
+		":1|c":                {wantErr: true},
+		"api.requests:1|c|x":  {wantErr: true},
+	} {
+		got, err := parseLine(line)
+		if s.wantErr {
+			if err == nil {
+				t.Errorf("%q: Expected error, got %+v.", line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %v", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(s.want, got) {
+			t.Errorf("%q: Wanted %+v, got %+v.", line, s.want, got)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	ms := storage.NewDiskMetricStore("", time.Hour, nil, log.NewNopLogger())
+	defer ms.Shutdown()
+	l, err := NewListener(ms, "127.0.0.1:0", Options{
+		Job:           "statsd",
+		GroupingTags:  []string{"instance"},
+		FlushInterval: time.Hour,
+	}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the provided number of lines to be handled, so that the
+	// order of UDP and TCP lines is known.
+	waitHandled := func(n int) {
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			l.mtx.Lock()
+			handled := l.events[dto.MetricType_COUNTER] + l.events[dto.MetricType_GAUGE] + l.events[dto.MetricType_SUMMARY] + l.invalid
+			l.mtx.Unlock()
+			if handled == n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Only %d of %d lines handled.", handled, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	udp, err := net.Dial("udp", l.server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	if _, err := udp.Write([]byte("requests:1|c|#instance:a\nrequests:1|c|@0.5|#instance:a\nlatency:250|ms|#instance:a\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitHandled(3)
+	tcp, err := net.Dial("tcp", l.server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tcp.Write([]byte("temp:20|g\ntemp:+2|g\nrequests:1|g\nbogus\n")); err != nil {
+		t.Fatal(err)
+	}
+	tcp.Close()
+
+	waitHandled(7)
+	if expected, got := 2, l.invalid; expected != got {
+		t.Errorf("Wanted %d invalid lines, got %d.", expected, got)
+	}
+	l.Close()
+
+	value := func(labels map[string]string, name string) *dto.Metric {
+		group, ok := storage.GetMetricGroup(ms, labels)
+		if !ok {
+			t.Fatalf("Group %v not found.", labels)
+		}
+		ms := group.Metrics[name].GetMetricFamily().GetMetric()
+		if len(ms) != 1 {
+			t.Fatalf("Wanted one %s sample, got %v.", name, ms)
+		}
+		return ms[0]
+	}
+	a := map[string]string{"job": "statsd", "instance": "a"}
+	if expected, got := 3.0, value(a, "requests").GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted counter %v, got %v.", expected, got)
+	}
+	if expected, got := uint64(1), value(a, "latency").GetSummary().GetSampleCount(); expected != got {
+		t.Errorf("Wanted timer count %v, got %v.", expected, got)
+	}
+	if expected, got := 0.25, value(a, "latency").GetSummary().GetSampleSum(); expected != got {
+		t.Errorf("Wanted timer sum %v, got %v.", expected, got)
+	}
+	if expected, got := 22.0, value(map[string]string{"job": "statsd"}, "temp").GetGauge().GetValue(); expected != got {
+		t.Errorf("Wanted gauge %v, got %v.", expected, got)
+	}
+
+	// Counters keep counting across flushes.
+	l.handleLine("requests:2|c|#instance:a")
+	l.flush()
+	if expected, got := 5.0, value(a, "requests").GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted counter %v after second flush, got %v.", expected, got)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// BackendOptions are passed to a Backend to create a MetricStore.
+type BackendOptions struct {
+	// PersistenceFile and PersistenceInterval are meaningful for backends
+	// persisting to a local file. Other backends may interpret them
+	// differently or reject them.
+	PersistenceFile     string
+	PersistenceInterval time.Duration
+	// CompactionInterval, if positive, makes backends persisting to a
+	// local file persist incrementally, see NewIncrementalFilePersister.
+	CompactionInterval time.Duration
+	// PersistLagWarning, if positive, overrides the persistence lag
+	// beyond which a warning is logged, see
+	// DiskMetricStore.SetPersistLagWarning.
+	PersistLagWarning time.Duration
+	// Sync determines when backends persisting to a local file sync the
+	// written files to disk, see SyncPolicy. Empty means SyncInterval.
+	Sync SyncPolicy
+	// Compression is the Compression backends persisting to a local file
+	// compress the persisted state with. Empty means CompressionNone.
+	Compression Compression
+	// PersistenceIndex makes backends persisting to a local file write an
+	// index file next to it, so that the metric families in it are only
+	// loaded on first access after a restart, see index.go.
+	PersistenceIndex bool
+	// PersistenceURL locates the persisted state for backends persisting
+	// to a remote location, see NewObjectPersister.
+	PersistenceURL string
+	// EncryptionKey, if not empty, is the secret to encrypt the persisted
+	// state with, see NewFilePersister.
+	EncryptionKey string
+	// Limits restrict the content of the MetricStore, see Limits.
+	Limits Limits
+	// Retention configures the periodic removal of metric groups from the
+	// MetricStore, see Retention.
+	Retention Retention
+	// WriteQueue configures the write queue of the MetricStore, see
+	// WriteQueueOptions.
+	WriteQueue WriteQueueOptions
+	// EmptyGroups determines what happens to metric groups left without
+	// pushed metric families, see EmptyGroupPolicy. Empty means
+	// EmptyGroupRemove.
+	EmptyGroups EmptyGroupPolicy
+	// GroupMetrics enables metrics about every metric group, see
+	// DiskMetricStore.SetGroupMetrics.
+	GroupMetrics bool
+	// InternInterval, if positive, is the interval at which identical
+	// label pairs and help strings in the MetricStore are deduplicated,
+	// see DiskMetricStore.SetInternInterval.
+	InternInterval time.Duration
+	// GatherPredefinedHelpFrom provides the help strings to enforce for
+	// pushed metrics, see NewDiskMetricStore. It may be nil.
+	GatherPredefinedHelpFrom prometheus.Gatherer
+	Logger                   log.Logger
+}
+
+// Backend creates a MetricStore from the provided options.
+type Backend func(BackendOptions) (MetricStore, error)
+
+var (
+	backendsMtx sync.Mutex
+	backends    = map[string]Backend{}
+)
+
+func init() {
+	RegisterBackend("disk", func(o BackendOptions) (MetricStore, error) {
+		if o.PersistenceURL != "" {
+			return nil, errors.New("the disk backend does not support a persistence URL, use the object backend")
+		}
+		var p Persister
+		if o.PersistenceFile != "" {
+			syncPolicy := o.Sync
+			if syncPolicy == "" {
+				syncPolicy = SyncInterval
+			}
+			fp := newFilePersister(o.PersistenceFile, o.EncryptionKey, o.CompactionInterval, syncPolicy, o.Compression, o.Logger)
+			fp.index = o.PersistenceIndex
+			p = fp
+		} else if o.EncryptionKey != "" {
+			return nil, errors.New("an encryption key requires a persistence file")
+		}
+		return newBackendStore(p, o), nil
+	})
+	RegisterBackend("memory", func(o BackendOptions) (MetricStore, error) {
+		if o.PersistenceFile != "" || o.PersistenceURL != "" || o.EncryptionKey != "" {
+			return nil, errors.New("the memory backend does not support persistence")
+		}
+		return newBackendStore(nil, o), nil
+	})
+	RegisterBackend("object", func(o BackendOptions) (MetricStore, error) {
+		if o.PersistenceFile != "" {
+			return nil, errors.New("the object backend does not support a persistence file, use a persistence URL")
+		}
+		if o.PersistenceURL == "" {
+			return nil, errors.New("the object backend requires a persistence URL")
+		}
+		p, err := NewObjectPersister(o.PersistenceURL, o.EncryptionKey, o.Logger)
+		if err != nil {
+			return nil, err
+		}
+		return newBackendStore(p, o), nil
+	})
+}
+
+// newBackendStore returns a DiskMetricStore using the provided Persister (which
+// may be nil), configured according to the provided BackendOptions.
+func newBackendStore(p Persister, o BackendOptions) *DiskMetricStore {
+	dms := NewPersistentMetricStore(p, o.PersistenceInterval, o.Limits, o.WriteQueue, o.GatherPredefinedHelpFrom, o.Logger)
+	dms.SetRetention(o.Retention)
+	dms.SetGroupMetrics(o.GroupMetrics)
+	dms.SetEmptyGroupPolicy(o.EmptyGroups)
+	dms.SetInternInterval(o.InternInterval)
+	if o.PersistLagWarning > 0 {
+		dms.SetPersistLagWarning(o.PersistLagWarning)
+	}
+	return dms
+}
+
+// RegisterBackend makes a Backend available under the provided name. It is
+// meant to be called from init functions and panics if a Backend is registered
+// twice under the same name.
+func RegisterBackend(name string, b Backend) {
+	backendsMtx.Lock()
+	defer backendsMtx.Unlock()
+
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("storage backend %q registered twice", name))
+	}
+	backends[name] = b
+}
+
+// Backends returns the sorted names of all registered backends.
+func Backends() []string {
+	backendsMtx.Lock()
+	defer backendsMtx.Unlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewMetricStore creates a MetricStore with the Backend registered under the
+// provided name.
+func NewMetricStore(name string, o BackendOptions) (MetricStore, error) {
+	backendsMtx.Lock()
+	b, ok := backends[name]
+	backendsMtx.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q, available backends: %v", name, Backends())
+	}
+	return b(o)
+}
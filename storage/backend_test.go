@@ -0,0 +1,63 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackends(t *testing.T) {
+	if expected, got := "[disk memory object]", fmt.Sprint(Backends()); expected != got {
+		t.Errorf("Wanted backends %s, got %s.", expected, got)
+	}
+
+	if _, err := NewMetricStore("nonexistent", BackendOptions{Logger: logger}); err == nil {
+		t.Error("Expected error for unknown backend.")
+	}
+	if _, err := NewMetricStore("memory", BackendOptions{
+		PersistenceFile: "some/file",
+		Logger:          logger,
+	}); err == nil {
+		t.Error("Expected error for memory backend with persistence file.")
+	}
+	if _, err := NewMetricStore("disk", BackendOptions{
+		PersistenceURL: "s3://bucket",
+		Logger:         logger,
+	}); err == nil {
+		t.Error("Expected error for disk backend with persistence URL.")
+	}
+	if _, err := NewMetricStore("object", BackendOptions{Logger: logger}); err == nil {
+		t.Error("Expected error for object backend without persistence URL.")
+	}
+
+	ms, err := NewMetricStore("memory", BackendOptions{
+		PersistenceInterval: time.Minute,
+		Logger:              logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic when registering a backend twice.")
+		}
+	}()
+	RegisterBackend("memory", nil)
+}
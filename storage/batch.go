@@ -0,0 +1,166 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+// batchable returns true if the provided WriteRequest can be applied as part of
+// a batch. Flushes, wipes, and restores are applied on their own.
+func batchable(wr WriteRequest) bool {
+	return !wr.Flush && !wr.Wipe && wr.Groups == nil
+}
+
+// processQueued applies the provided WriteRequest taken from the write queue,
+// which must not be a flush. With batching enabled, further WriteRequests
+// waiting in the queue are applied together with it, see nextBatch and
+// applyBatch.
+func (dms *DiskMetricStore) processQueued(wr WriteRequest) {
+	if dms.batchSize <= 1 {
+		dms.applyWriteRequest(wr)
+		return
+	}
+	batch, next := dms.nextBatch(wr)
+	dms.applyBatch(batch)
+	switch {
+	case next == nil:
+	case next.Flush:
+		dms.flush(*next)
+	default:
+		dms.applyWriteRequest(*next)
+	}
+}
+
+// nextBatch returns the provided WriteRequest taken from the write queue
+// together with further WriteRequests waiting in the queue, up to the batch
+// size. All of them are batchable and change distinct groups, so that none of
+// them has to be checked against the changes of the others. The first
+// WriteRequest taken from the queue that does not fit into the batch is
+// returned separately (nil if there is none). nextBatch does not wait for more
+// WriteRequests to arrive.
+func (dms *DiskMetricStore) nextBatch(wr WriteRequest) ([]WriteRequest, *WriteRequest) {
+	batch := []WriteRequest{wr}
+	if !batchable(wr) {
+		return batch, nil
+	}
+	changed := map[string]struct{}{}
+	fits := func(wr WriteRequest) bool {
+		keys := []string{groupingKeyFor(wr.Labels)}
+		if wr.RenameTo != nil {
+			keys = append(keys, groupingKeyFor(wr.RenameTo))
+		}
+		for _, key := range keys {
+			if _, ok := changed[key]; ok {
+				return false
+			}
+		}
+		for _, key := range keys {
+			changed[key] = struct{}{}
+		}
+		return true
+	}
+	fits(wr)
+	for len(batch) < dms.batchSize {
+		select {
+		case next := <-dms.writeQueue:
+			if !batchable(next) || !fits(next) {
+				return batch, &next
+			}
+			batch = append(batch, next)
+		default:
+			return batch, nil
+		}
+	}
+	return batch, nil
+}
+
+// applyBatch applies the provided WriteRequests (see nextBatch) like
+// applyWriteRequest, but it takes the write lock only once for all of them, so
+// that scrapes never see a partially applied batch. As the WriteRequests change
+// distinct groups, each of them is checked against the metric groups as they
+// were before the batch. Whatever depends on all the groups, i.e. the
+// consistency check and the limits on the number of groups and samples, is
+// only checked once for the result of the whole batch, using a test store. If
+// that fails, or if any WriteRequest is rejected while such limits are set (an
+// earlier one might have made room for it), the WriteRequests are applied one
+// by one after all.
+func (dms *DiskMetricStore) applyBatch(batch []WriteRequest) {
+	if len(batch) == 1 {
+		dms.applyWriteRequest(batch[0])
+		return
+	}
+
+	errs := make([]error, len(batch))
+	rejected, checkConsistency := false, false
+	for i, wr := range batch {
+		if errs[i] = dms.validateWriteRequest(wr); errs[i] != nil {
+			rejected = true
+			continue
+		}
+		// Without Done channel, don't do the expensive consistency check.
+		if wr.Done != nil && pushesMetrics(wr) {
+			checkConsistency = true
+		}
+	}
+	dms.lock.RLock()
+	globalLimits := dms.limits.MaxGroups > 0 || dms.limits.MaxSamples > 0
+	dms.lock.RUnlock()
+	oneByOne := rejected && globalLimits
+	if !oneByOne && (checkConsistency || globalLimits) {
+		oneByOne = !dms.batchAcceptable(batch, errs, checkConsistency)
+	}
+	if oneByOne {
+		for _, wr := range batch {
+			dms.applyWriteRequest(wr)
+		}
+		return
+	}
+
+	for i, wr := range batch {
+		dms.reportRejection(wr, errs[i])
+	}
+	dms.lock.Lock()
+	for i, wr := range batch {
+		if errs[i] == nil {
+			dms.processWriteRequestLocked(wr)
+		} else {
+			dms.setPushFailedTimestampLocked(wr, errs[i])
+		}
+	}
+	dms.lock.Unlock()
+	for _, wr := range batch {
+		if wr.Done != nil {
+			close(wr.Done)
+		}
+	}
+}
+
+// batchAcceptable applies the provided batch to a test store, taking into
+// account the errors of the individual WriteRequests, and returns true if the
+// result stays within the limits on the number of groups and samples and, if
+// checkConsistency is true, can be gathered consistently.
+func (dms *DiskMetricStore) batchAcceptable(batch []WriteRequest, errs []error, checkConsistency bool) bool {
+	tdms := dms.testStore()
+	for i, wr := range batch {
+		if errs[i] == nil {
+			tdms.processWriteRequest(wr)
+		} else {
+			tdms.setPushFailedTimestamp(wr, errs[i])
+		}
+	}
+	if max := tdms.limits.MaxGroups; max > 0 && len(tdms.metricGroups) > max {
+		return false
+	}
+	if max := tdms.limits.MaxSamples; max > 0 && tdms.storedSamples() > max {
+		return false
+	}
+	return !checkConsistency || tdms.checkConsistency() == nil
+}
@@ -0,0 +1,357 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+// submitBatch submits the provided WriteRequests while the store loop is
+// blocked, so that they are queued together, and returns the last error
+// written to the Done channel of each of them.
+func submitBatch(t *testing.T, dms *DiskMetricStore, batch []WriteRequest) []error {
+	dms.lock.Lock()
+	blocked := make(chan error, 1)
+	if err := dms.SubmitWriteRequest(WriteRequest{
+		Labels: map[string]string{"job": "blocked"},
+		Done:   blocked,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for len(dms.writeQueue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	errChs := make([]chan error, len(batch))
+	for i, wr := range batch {
+		errChs[i] = make(chan error, 1)
+		wr.Done = errChs[i]
+		if err := dms.SubmitWriteRequest(wr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dms.lock.Unlock()
+	for range blocked {
+	}
+
+	errs := make([]error, len(batch))
+	for i, errCh := range errChs {
+		for err := range errCh {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+func newBatchMF(typ dto.MetricType) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name:   proto.String("batched"),
+		Type:   typ.Enum(),
+		Metric: []*dto.Metric{{}},
+	}
+	if typ == dto.MetricType_COUNTER {
+		mf.Metric[0].Counter = &dto.Counter{Value: proto.Float64(1)}
+	} else {
+		mf.Metric[0].Gauge = &dto.Gauge{Value: proto.Float64(1)}
+	}
+	return mf
+}
+
+func TestNextBatch(t *testing.T) {
+	// No loop is running, so the queue is only read by nextBatch.
+	dms := &DiskMetricStore{
+		writeQueue: make(chan WriteRequest, 10),
+		batchSize:  3,
+		logger:     logger,
+	}
+	a := map[string]string{"job": "a"}
+	b := map[string]string{"job": "b"}
+	c := map[string]string{"job": "c"}
+
+	for i, s := range []struct {
+		queued   []WriteRequest
+		want     int  // Length of the batch.
+		wantNext bool // Is a WriteRequest returned separately?
+	}{
+		{[]WriteRequest{{Labels: a}}, 1, false},
+		{[]WriteRequest{{Labels: a}, {Labels: b}, {Labels: c, Lock: true}}, 3, false},
+		// Batch size reached, the rest stays queued.
+		{[]WriteRequest{{Labels: a}, {Labels: b}, {Labels: c}, {Labels: a}}, 3, false},
+		// Same group.
+		{[]WriteRequest{{Labels: a}, {Labels: b}, {Labels: a}}, 2, true},
+		// Renaming to a group already changed.
+		{[]WriteRequest{{Labels: a}, {Labels: b, RenameTo: a}}, 1, true},
+		{[]WriteRequest{{Labels: a, RenameTo: c}, {Labels: c}}, 1, true},
+		// Not batchable.
+		{[]WriteRequest{{Labels: a}, {Flush: true}}, 1, true},
+		{[]WriteRequest{{Labels: a}, {Wipe: true}}, 1, true},
+		{[]WriteRequest{{Labels: a}, {Groups: GroupingKeyToMetricGroup{}}}, 1, true},
+		{[]WriteRequest{{Wipe: true}, {Labels: a}}, 1, false},
+	} {
+		for _, wr := range s.queued[1:] {
+			dms.writeQueue <- wr
+		}
+		batch, next := dms.nextBatch(s.queued[0])
+		if expected, got := s.want, len(batch); expected != got {
+			t.Errorf("%d: Wanted batch of %d, got %d.", i, expected, got)
+		}
+		if expected, got := s.wantNext, next != nil; expected != got {
+			t.Errorf("%d: Wanted separate write request %t, got %t.", i, expected, got)
+		}
+		for len(dms.writeQueue) > 0 {
+			<-dms.writeQueue
+		}
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestWriteBatch.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewPersistentMetricStore(
+		NewFilePersister(fileName, "", logger), time.Hour, Limits{},
+		WriteQueueOptions{BatchSize: 64}, nil, logger,
+	)
+
+	var (
+		mtx      sync.Mutex
+		removals []GroupRemoval
+	)
+	dms.SetRemovalHook(func(gr GroupRemoval) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		removals = append(removals, gr)
+	})
+
+	ts := time.Now()
+	a := map[string]string{"job": "a"}
+	b := map[string]string{"job": "b"}
+	c := map[string]string{"job": "c"}
+	for _, grouping := range []map[string]string{c, {"job": "deleted"}} {
+		submit(t, dms, WriteRequest{
+			Labels:         grouping,
+			Timestamp:      ts,
+			MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER)),
+		})
+	}
+
+	errs := submitBatch(t, dms, []WriteRequest{
+		{Labels: a, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER))},
+		{Labels: b, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER))},
+		{Labels: c, Timestamp: ts, Lock: true},
+		{Labels: map[string]string{"job": "deleted"}, Timestamp: ts},
+		// Rejected as the group is new.
+		{Labels: map[string]string{"job": "unknown"}, Timestamp: ts, Lock: true},
+		// Ends the batch, rejected as the group has been locked by the
+		// batch.
+		{Labels: c, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER))},
+	})
+	for i, want := range []error{nil, nil, nil, nil, ErrGroupNotFound, ErrGroupLocked} {
+		if expected, got := want, errs[i]; expected != got {
+			t.Errorf("Write request %d: Wanted error %v, got %v.", i, expected, got)
+		}
+	}
+
+	check := func(dms *DiskMetricStore) {
+		groups := dms.GetMetricFamiliesMap()
+		if expected, got := 3, len(groups); expected != got {
+			t.Errorf("Wanted %d groups, got %d.", expected, got)
+		}
+		for _, grouping := range []map[string]string{a, b} {
+			if group, ok := groups[groupingKeyFor(grouping)]; !ok || !group.LastPushSuccess() || group.NumMetricFamilies() != 1 {
+				t.Errorf("Wanted group %v with one metric family, got %+v.", grouping, group)
+			}
+		}
+		// The rejected push does not change the locked group at all.
+		if group, ok := groups[groupingKeyFor(c)]; !ok || !group.Locked || !group.LastPushSuccess() {
+			t.Errorf("Wanted locked group c, got %+v.", group)
+		}
+	}
+	check(dms)
+	mtx.Lock()
+	if len(removals) != 1 || removals[0].Labels["job"] != "deleted" || removals[0].Event != RemovalDeleted {
+		t.Errorf("Unexpected removals %+v.", removals)
+	}
+	mtx.Unlock()
+
+	// The batch has been logged in order.
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	check(dms2)
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch that cannot be gathered consistently is applied one by one,
+	// so that only the culprit is rejected.
+	d := map[string]string{"job": "d"}
+	e := map[string]string{"job": "e"}
+	errs = submitBatch(t, dms, []WriteRequest{
+		{Labels: d, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER))},
+		{Labels: e, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_GAUGE))},
+	})
+	if errs[0] != nil {
+		t.Errorf("Unexpected error for consistent push: %v", errs[0])
+	}
+	if errs[1] == nil {
+		t.Error("Wanted error for inconsistent push.")
+	}
+	groups := dms.GetMetricFamiliesMap()
+	if group := groups[groupingKeyFor(d)]; !group.LastPushSuccess() {
+		t.Errorf("Wanted successful push to group d, got %+v.", group)
+	}
+	if group := groups[groupingKeyFor(e)]; group.LastPushSuccess() || group.NumMetricFamilies() != 0 {
+		t.Errorf("Wanted group e with only a failed push, got %+v.", group)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteBatchLimits(t *testing.T) {
+	dms := NewPersistentMetricStore(
+		nil, time.Hour, Limits{MaxGroups: 2},
+		WriteQueueOptions{BatchSize: 64}, nil, logger,
+	)
+	defer dms.Shutdown()
+
+	ts := time.Now()
+	for _, job := range []string{"a", "b"} {
+		submit(t, dms, WriteRequest{
+			Labels:         map[string]string{"job": job},
+			Timestamp:      ts,
+			MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER)),
+		})
+	}
+
+	// Checked against the groups before the batch, the push to c would
+	// exceed the limit, but the deletion of a makes room for it.
+	errs := submitBatch(t, dms, []WriteRequest{
+		{Labels: map[string]string{"job": "a"}, Timestamp: ts},
+		{Labels: map[string]string{"job": "c"}, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER))},
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Write request %d: Unexpected error %v.", i, err)
+		}
+	}
+
+	// Checked against the groups before the batch, both pushes are within
+	// the limit, but not together.
+	errs = submitBatch(t, dms, []WriteRequest{
+		{Labels: map[string]string{"job": "b"}, Timestamp: ts},
+		{Labels: map[string]string{"job": "d"}, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER))},
+		{Labels: map[string]string{"job": "e"}, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(newBatchMF(dto.MetricType_COUNTER))},
+	})
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("Unexpected errors %v.", errs[:2])
+	}
+	if _, ok := errs[2].(LimitError); !ok {
+		t.Errorf("Wanted LimitError, got %v.", errs[2])
+	}
+	if expected, got := 2, len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+}
+
+// BenchmarkWriteBatch measures the throughput of the store loop during a storm
+// of small pushes to the 1000 groups of newBenchmarkStore while the store is
+// scraped concurrently, with and without batching. For "checked" pushes, a Done
+// channel is set, so that the consistency check is done, too.
+func BenchmarkWriteBatch(b *testing.B) {
+	for _, checked := range []bool{false, true} {
+		for _, batchSize := range []int{1, 64} {
+			b.Run(fmt.Sprintf("checked=%t/batch=%d", checked, batchSize), func(b *testing.B) {
+				benchmarkWriteBatch(b, checked, batchSize)
+			})
+		}
+	}
+}
+
+func benchmarkWriteBatch(b *testing.B, checked bool, batchSize int) {
+	dms, _ := newBenchmarkStore(1000, WriteQueueOptions{BatchSize: batchSize})
+	defer dms.Shutdown()
+	wrs := make([]WriteRequest, b.N)
+	for i := range wrs {
+		job := fmt.Sprint("job", i%1000)
+		wrs[i] = WriteRequest{
+			Labels:    map[string]string{"job": job},
+			Timestamp: time.Now(),
+			MetricFamilies: map[string]*dto.MetricFamily{
+				"benchmark_metric_0": {
+					Name: proto.String("benchmark_metric_0"),
+					Help: proto.String("A metric for benchmarking."),
+					Type: dto.MetricType_GAUGE.Enum(),
+					Metric: []*dto.Metric{{
+						Label: []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(job)}},
+						Gauge: &dto.Gauge{Value: proto.Float64(float64(i))},
+					}},
+				},
+			},
+		}
+		if checked {
+			wrs[i].Done = make(chan error, 1)
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				dms.GetMetricFamilies()
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for _, wr := range wrs {
+		if err := dms.SubmitWriteRequest(wr); err != nil {
+			b.Fatal(err)
+		}
+	}
+	flushed := make(chan error, 1)
+	if err := dms.SubmitWriteRequest(WriteRequest{Flush: true, Done: flushed}); err != nil {
+		b.Fatal(err)
+	}
+	for range flushed {
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+	for _, wr := range wrs {
+		if wr.Done == nil {
+			continue
+		}
+		for err := range wr.Done {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Compression is the codec a snapshot (i.e. a persistence file or a delta file)
+// is compressed with. The compression is applied before encryption, as
+// encrypted data does not compress. Upon reading, compressed snapshots are
+// detected by the magic bytes of the codec, so that the Compression can be
+// changed for an existing persistence file.
+type Compression string
+
+// Valid Compression values.
+const (
+	// CompressionNone writes snapshots uncompressed.
+	CompressionNone Compression = "none"
+	// CompressionGzip compresses snapshots with gzip.
+	CompressionGzip Compression = "gzip"
+)
+
+// Compressions are all valid Compression values as strings.
+var Compressions = []string{
+	string(CompressionNone), string(CompressionGzip),
+}
+
+// gzipMagic starts every gzip stream: The two ID bytes followed by the
+// compression method "deflate". It cannot be confused with persistenceMagic,
+// and a gob stream never starts with it either, as the type ID of the first
+// message would have to be positive.
+const gzipMagic = "\x1f\x8b\x08"
+
+// compressingWriter returns a WriteCloser compressing to w with the provided
+// Compression. Closing it does not close w. An empty Compression means
+// CompressionNone.
+func compressingWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case "", CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+// compressSnapshot works like writeSnapshot but compresses the snapshot with the
+// provided Compression.
+func compressSnapshot(w io.Writer, groups GroupingKeyToMetricGroup, lastSequence uint64, c Compression) error {
+	cw, err := compressingWriter(w, c)
+	if err != nil {
+		return err
+	}
+	if err := writeSnapshot(cw, groups, lastSequence); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// decompressingReader returns a reader for the uncompressed content of r and the
+// Compression detected.
+func decompressingReader(r io.Reader) (io.Reader, Compression, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if (err != nil && err != io.EOF) || string(magic) != gzipMagic {
+		// Let readSnapshot deal with errors and uncompressed snapshots.
+		return br, CompressionNone, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, CompressionGzip, err
+	}
+	return zr, CompressionGzip, nil
+}
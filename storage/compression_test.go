@@ -0,0 +1,94 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+func TestCompressedFilePersister(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestCompressedFilePersister.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	newDMS := func(file, key string, c Compression) *DiskMetricStore {
+		return NewPersistentMetricStore(
+			NewIncrementalFilePersister(file, key, time.Hour, SyncNever, c, logger),
+			time.Hour, Limits{}, WriteQueueOptions{}, nil, logger,
+		)
+	}
+	grouping1 := map[string]string{"job": "job1"}
+	grouping2 := map[string]string{"job": "job2"}
+
+	for _, key := range []string{"", "secret"} {
+		fileName := path.Join(tempDir, "persistence"+key)
+		dms := newDMS(fileName, key, CompressionGzip)
+		submit(t, dms, WriteRequest{
+			Labels:         grouping1,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+		})
+		if err := dms.persist(); err != nil {
+			t.Fatal(err)
+		}
+		// The second group ends up in a delta file.
+		submit(t, dms, WriteRequest{
+			Labels:         grouping2,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		})
+		if err := dms.persist(); err != nil {
+			t.Fatal(err)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := key == "", bytes.HasPrefix(content, []byte(gzipMagic)); expected != got {
+			t.Errorf("key %q: Wanted gzip magic %v, got %v.", key, expected, got)
+		}
+		pf, err := ReadPersistenceFile(fileName, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pf.Compression != CompressionGzip || pf.Deltas != 1 || len(pf.Groups) != 2 || pf.Corruptions != 0 {
+			t.Errorf("key %q: Unexpected persistence file %+v.", key, pf)
+		}
+
+		// Compressed files are read without compression configured,
+		// and rewritten uncompressed.
+		dms = newDMS(fileName, key, CompressionNone)
+		if expected, got := 2, len(dms.GetMetricFamiliesMap()); expected != got {
+			t.Errorf("key %q: Wanted %d groups, got %d.", key, expected, got)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		if pf, err := ReadPersistenceFile(fileName, key); err != nil || pf.Compression != CompressionNone {
+			t.Errorf("key %q: Wanted uncompressed persistence file, got %+v, error %v.", key, pf, err)
+		}
+	}
+}
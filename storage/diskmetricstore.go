@@ -14,16 +14,15 @@
 package storage
 
 import (
-	"encoding/gob"
+	"context"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"os"
-	"path"
+	"math"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -32,34 +31,273 @@ import (
 	"github.com/prometheus/common/model"
 
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/tracing"
 )
 
 const (
-	pushMetricName       = "push_time_seconds"
-	pushMetricHelp       = "Last Unix time when changing this group in the Pushgateway succeeded."
-	pushFailedMetricName = "push_failure_time_seconds"
-	pushFailedMetricHelp = "Last Unix time when changing this group in the Pushgateway failed."
-	writeQueueCapacity   = 1000
+	pushMetricName        = "push_time_seconds"
+	pushMetricHelp        = "Last Unix time when changing this group in the Pushgateway succeeded."
+	pushFailedMetricName  = "push_failure_time_seconds"
+	pushFailedMetricHelp  = "Last Unix time when changing this group in the Pushgateway failed."
+	annotationsMetricName = "push_annotations_info"
+	annotationsMetricHelp = "Annotations pushed for this group, as labels. The value is always 1."
+	overdueMetricName     = "push_overdue"
+	overdueMetricHelp     = "Whether no successful push to this group arrived within the interval declared as expected by the pushes (1) or not (0)."
+	// DefaultWriteQueueCapacity is the capacity of the write queue if none
+	// is configured in the WriteQueueOptions.
+	DefaultWriteQueueCapacity = 1000
+	// expirationInterval is the interval at which the store loop checks for
+	// metric families with an elapsed TTL.
+	expirationInterval = time.Second
+	// stuckQueueTimeout is how long the store loop may take no request
+	// from a non-empty write queue before the store is considered
+	// unhealthy.
+	stuckQueueTimeout = time.Minute
 )
 
 var errTimestamp = errors.New("pushed metrics must not have timestamps")
 
+var (
+	// ErrWriteQueueFull is returned by SubmitWriteRequest if the write
+	// queue is still full after the configured timeout.
+	ErrWriteQueueFull = errors.New("write queue is full")
+	// ErrGroupLocked is sent to the Done channel of a WriteRequest that has
+	// been rejected because its group is locked.
+	ErrGroupLocked = errors.New("metric group is locked")
+	// ErrGroupNotFound is sent to the Done channel of a WriteRequest to lock,
+	// unlock, or rename a group that does not exist.
+	ErrGroupNotFound = errors.New("metric group not found")
+	// ErrGroupExists is sent to the Done channel of a WriteRequest to
+	// rename a group to the grouping key of an existing group.
+	ErrGroupExists = errors.New("metric group exists already")
+)
+
+var (
+	writeQueueLengthDesc = prometheus.NewDesc(
+		"pushgateway_write_queue_length",
+		"Number of write requests currently waiting in the write queue.",
+		nil, nil,
+	)
+	writeQueueCapacityDesc = prometheus.NewDesc(
+		"pushgateway_write_queue_capacity",
+		"Capacity of the write queue.",
+		nil, nil,
+	)
+	spillLengthDesc = prometheus.NewDesc(
+		"pushgateway_write_queue_spill_length",
+		"Number of write requests currently waiting in the spill file of the write queue.",
+		nil, nil,
+	)
+	spillBytesDesc = prometheus.NewDesc(
+		"pushgateway_write_queue_spill_bytes",
+		"Size of the write requests currently waiting in the spill file of the write queue.",
+		nil, nil,
+	)
+	spilledDesc = prometheus.NewDesc(
+		"pushgateway_write_queue_spilled_total",
+		"Total number of write requests spilled to disk because the write queue was full.",
+		nil, nil,
+	)
+	metricGroupsDesc = prometheus.NewDesc(
+		"pushgateway_metric_groups",
+		"Number of metric groups currently stored.",
+		nil, nil,
+	)
+	metricFamiliesDesc = prometheus.NewDesc(
+		"pushgateway_metric_families",
+		"Number of metric families currently stored, summed up over all metric groups.",
+		nil, nil,
+	)
+	persistenceEnabledDesc = prometheus.NewDesc(
+		"pushgateway_persistence_enabled",
+		"Whether the metric store is persisted (1) or only kept in memory (0).",
+		nil, nil,
+	)
+)
+
 // DiskMetricStore is an implementation of MetricStore that persists metrics to
 // disk.
+//
+// The stored MetricGroups are copy-on-write: A change of a group stores a
+// modified copy (including a copy of its Metrics map) rather than modifying the
+// stored one. Readers thus only need the lock to take a snapshot of the groups,
+// see groupsSnapshot, and scrapes do not block pushes while assembling the
+// metric families.
 type DiskMetricStore struct {
-	lock            sync.RWMutex // Protects metricFamilies.
-	writeQueue      chan WriteRequest
-	drain           chan struct{}
-	done            chan error
-	metricGroups    GroupingKeyToMetricGroup
-	persistenceFile string
-	predefinedHelp  map[string]string
-	logger          log.Logger
+	lock           sync.RWMutex // Protects metricGroups.
+	persistLock    sync.Mutex   // Serializes writing and removing the persistence file.
+	writeQueue     chan WriteRequest
+	drain          chan struct{}
+	done           chan error
+	metricGroups   GroupingKeyToMetricGroup // Copy-on-write, see above.
+	families       int                      // Protected by lock, see countGroup.
+	samples        int                      // Protected by lock, see countGroup.
+	persister      Persister                // nil if not persisting.
+	predefinedHelp map[string]string
+	limits         Limits             // Protected by lock.
+	retention      Retention          // Protected by lock.
+	groupMetrics   bool               // Protected by lock.
+	emptyGroups    EmptyGroupPolicy   // Protected by lock.
+	internInterval time.Duration      // Protected by lock, see SetInternInterval.
+	lastIntern     time.Time          // Only accessed by the loop.
+	persistOnStart bool               // Set by restore before the loop starts.
+	replaying      bool               // Set by restore while replaying logged changes.
+	removalHook    func(GroupRemoval) // Protected by lock, nil if not set.
+	queueTimeout   time.Duration
+	batchSize      int
+	spill          *spillQueue   // nil if not spilling.
+	spillStop      chan struct{} // Closed to stop the spill drainer once the spill is empty.
+	spillDone      chan struct{} // Closed by the spill drainer upon exit.
+	logger         log.Logger
+
+	statusMtx      sync.Mutex // Protects lastDequeued and the *Persist* fields.
+	lastDequeued   time.Time  // When the loop last took a request from the write queue.
+	lastPersistErr error      // Result of the last attempt to persist.
+
+	lastPersistTime        time.Time
+	lastPersistDuration    time.Duration
+	lastPersistSuccessTime time.Time
+
+	// unpersistedSince is the time of the oldest change not covered by a
+	// started persisting, persistingSince the time of the oldest change
+	// covered by the running one. Zero if there is no such change.
+	unpersistedSince  time.Time
+	persistingSince   time.Time
+	persistLagWarning time.Duration // See SetPersistLagWarning.
+
+	persistDuration    prometheus.Summary
+	persistErrors      prometheus.Counter
+	lastPersistSuccess prometheus.Gauge
+	persistLag         prometheus.GaugeFunc
+	logErrors          prometheus.Counter
+	evictions          *prometheus.CounterVec
+	internSavedBytes   prometheus.Gauge
+}
+
+// Limits restrict the content of a DiskMetricStore. Metric families and samples
+// are only counted if they have been pushed, i.e. the automatically added push
+// timestamp metrics are not counted. A zero value means no limit.
+type Limits struct {
+	MaxGroups           int // Maximum number of metric groups.
+	MaxFamiliesPerGroup int // Maximum number of metric families in one group.
+	MaxSamples          int // Maximum number of samples in all groups combined.
+	MaxSeriesPerGroup   int // Maximum number of samples in one group.
+	MaxLabelsPerMetric  int // Maximum number of labels of one metric, including the grouping labels.
+	MaxLabelValueLength int // Maximum length of a label value in bytes.
+	// Truncate makes pushes exceeding one of the three limits above
+	// succeed anyway, with the offending label values truncated, the
+	// offending labels dropped (other than grouping labels), and the
+	// metrics exceeding the series limit dropped (the last ones of the
+	// metric families last in lexicographical order), rather than being
+	// rejected. Grouping label values and aggregating pushes are never
+	// truncated.
+	Truncate bool
+}
+
+// Retention configures the periodic removal of metric groups from a
+// DiskMetricStore, independent of the TTL of their metric families. Locked
+// groups are neither removed nor counted. A zero value means no limit.
+type Retention struct {
+	// MaxGroupsPerJob is the maximum number of metric groups with the same
+	// job label. The groups pushed to least recently are removed first.
+	MaxGroupsPerJob int
+	// MaxAge is the maximum time since the last successful push to a
+	// metric group.
+	MaxAge time.Duration
+}
+
+// EmptyGroupPolicy determines what happens to a metric group left without any
+// pushed metric families after deleting some of them or after their TTL has
+// elapsed. Deleting a group as a whole always removes it.
+type EmptyGroupPolicy string
+
+// Valid EmptyGroupPolicy values.
+const (
+	// EmptyGroupRemove removes the group completely. It is the default.
+	EmptyGroupRemove EmptyGroupPolicy = "remove"
+	// EmptyGroupKeep keeps the group with only the push_time_seconds and
+	// push_failure_time_seconds metrics, e.g. for alerting on the time
+	// of its last push.
+	EmptyGroupKeep EmptyGroupPolicy = "keep"
+)
+
+// EmptyGroupPolicies are all valid EmptyGroupPolicy values as strings.
+var EmptyGroupPolicies = []string{string(EmptyGroupRemove), string(EmptyGroupKeep)}
+
+// Reasons for evicting a metric group, see Retention.
+const (
+	evictedMaxGroupsPerJob = "max_groups_per_job"
+	evictedMaxAge          = "max_age"
+)
+
+// GroupRemoval describes a metric group that has been removed from a
+// DiskMetricStore, see SetRemovalHook.
+type GroupRemoval struct {
+	Event        string            // One of the Removal* constants below.
+	Reason       string            // For RemovalEvicted, why the group has been evicted.
+	Labels       map[string]string // The grouping labels.
+	LastPushTime time.Time         // See MetricGroup.LastPushTime.
+	Time         time.Time         // When the group has been removed.
+}
+
+// Valid GroupRemoval events.
+const (
+	// RemovalExpired is the event of a group removed because the TTL of
+	// all its pushed metric families has elapsed.
+	RemovalExpired = "expired"
+	// RemovalEvicted is the event of a group removed because of the
+	// Retention. The Reason is "max_groups_per_job" or "max_age".
+	RemovalEvicted = "evicted"
+	// RemovalDeleted is the event of a group removed by a WriteRequest
+	// deleting it (or its last pushed metric families).
+	RemovalDeleted = "deleted"
+)
+
+// LimitError is sent to the Done channel of a WriteRequest that has been
+// rejected because applying it would exceed the Limits of the DiskMetricStore.
+type LimitError struct {
+	What       string // What has been counted, e.g. "metric groups".
+	Value, Max int
+}
+
+func (e LimitError) Error() string {
+	return fmt.Sprintf("push would result in %d %s, exceeding the limit of %d", e.Value, e.What, e.Max)
 }
 
-type mfStat struct {
-	pos    int  // Where in the result slice is the MetricFamily?
-	copied bool // Has the MetricFamily already been copied?
+// SequenceError is sent to the Done channel of a WriteRequest that has been
+// rejected because its Sequence is not greater than the Sequence of its group.
+type SequenceError struct {
+	Sequence, Stored uint64
+}
+
+func (e SequenceError) Error() string {
+	return fmt.Sprintf("push is out of order, sequence number %d is not greater than %d of the group", e.Sequence, e.Stored)
+}
+
+// WriteQueueOptions configure the write queue of a DiskMetricStore.
+type WriteQueueOptions struct {
+	// Capacity is the number of WriteRequests that can be queued. Zero
+	// means DefaultWriteQueueCapacity.
+	Capacity int
+	// Timeout is how long SubmitWriteRequest waits for space in a full
+	// queue before returning ErrWriteQueueFull. Zero means waiting
+	// indefinitely.
+	Timeout time.Duration
+	// SpillDir is the directory of a file to which WriteRequests are
+	// spilled while the queue is full, rather than waiting for space in
+	// the queue. Spilled WriteRequests are fed back into the queue in
+	// order as soon as possible, also after a restart. The empty string
+	// means no spilling. Timeout only applies if spilling is not possible.
+	SpillDir string
+	// SpillMaxSize is the maximum size of the spill file in bytes. Once
+	// it is reached, SubmitWriteRequest returns ErrWriteQueueFull. Zero
+	// means no limit.
+	SpillMaxSize int64
+	// BatchSize is the maximum number of queued WriteRequests the store
+	// loop applies at once, taking the write lock only once for all of
+	// them. Zero or 1 disables batching.
+	BatchSize int
 }
 
 // NewDiskMetricStore returns a DiskMetricStore ready to use. To cleanly shut it
@@ -67,30 +305,103 @@ type mfStat struct {
 //
 // If persistenceFile is the empty string, no persisting to disk will
 // happen. Otherwise, a file of that name is used for persisting metrics to
-// disk. If the file already exists, metrics are read from it as part of the
-// start-up. Persisting is happening upon shutdown and after every write action,
-// but the latter will only happen persistenceDuration after the previous
-// persisting.
+// disk, see NewFilePersister and NewPersistentMetricStore.
 //
 // If a non-nil Gatherer is provided, the help strings of metrics gathered by it
 // will be used as standard. Pushed metrics with deviating help strings will be
 // adjusted to avoid inconsistent expositions.
+//
+// The returned DiskMetricStore implements prometheus.Collector to expose
+// metrics about its own operation. It is up to the caller to register it.
 func NewDiskMetricStore(
 	persistenceFile string,
 	persistenceInterval time.Duration,
 	gatherPredefinedHelpFrom prometheus.Gatherer,
 	logger log.Logger,
+) *DiskMetricStore {
+	var p Persister
+	if persistenceFile != "" {
+		p = NewFilePersister(persistenceFile, "", logger)
+	}
+	return NewPersistentMetricStore(p, persistenceInterval, Limits{}, WriteQueueOptions{}, gatherPredefinedHelpFrom, logger)
+}
+
+// NewPersistentMetricStore returns a DiskMetricStore that uses the provided
+// Persister. If the Persister is nil, metrics are only kept in memory. The
+// persisted state is restored as part of the start-up. Every change is logged
+// with the Persister right away. Persisting the whole state is happening upon
+// shutdown and after every write action, but the latter will only happen
+// persistenceInterval after the previous persisting started and, so that slow
+// persisting does not keep the store busy under sustained load, not before as
+// much time has passed after the previous persisting as it took. All changes in
+// the meantime are coalesced into one persisting.
+//
+// WriteRequests that would exceed the provided Limits are rejected with a
+// LimitError. The Limits are not enforced upon restoring persisted state. The
+// write queue is set up according to the provided WriteQueueOptions.
+//
+// See NewDiskMetricStore for the meaning of the other arguments.
+func NewPersistentMetricStore(
+	p Persister,
+	persistenceInterval time.Duration,
+	limits Limits,
+	queue WriteQueueOptions,
+	gatherPredefinedHelpFrom prometheus.Gatherer,
+	logger log.Logger,
 ) *DiskMetricStore {
 	// TODO: Do that outside of the constructor to allow the HTTP server to
 	//  serve /-/healthy and /-/ready earlier.
+	if queue.Capacity <= 0 {
+		queue.Capacity = DefaultWriteQueueCapacity
+	}
+	if queue.BatchSize <= 0 {
+		queue.BatchSize = 1
+	}
 	dms := &DiskMetricStore{
-		writeQueue:      make(chan WriteRequest, writeQueueCapacity),
-		drain:           make(chan struct{}),
-		done:            make(chan error),
-		metricGroups:    GroupingKeyToMetricGroup{},
-		persistenceFile: persistenceFile,
-		logger:          logger,
+		writeQueue:   make(chan WriteRequest, queue.Capacity),
+		drain:        make(chan struct{}),
+		done:         make(chan error),
+		metricGroups: GroupingKeyToMetricGroup{},
+		persister:    p,
+		limits:       limits,
+		queueTimeout: queue.Timeout,
+		batchSize:    queue.BatchSize,
+		logger:       logger,
+		lastDequeued: time.Now(),
+		persistDuration: prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:       "pushgateway_persistence_duration_seconds",
+			Help:       "Duration of persisting the metric store.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}),
+		persistErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pushgateway_persistence_errors_total",
+			Help: "Total number of failed attempts to persist the metric store.",
+		}),
+		lastPersistSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pushgateway_persistence_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful persisting of the metric store.",
+		}),
+		persistLagWarning: 3 * persistenceInterval,
+		logErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pushgateway_persistence_wal_errors_total",
+			Help: "Total number of failed attempts to append to the write-ahead log.",
+		}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pushgateway_retention_evictions_total",
+			Help: "Total number of metric groups removed because of the retention settings, by reason.",
+		}, []string{"reason"}),
+		internSavedBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pushgateway_intern_saved_bytes",
+			Help: "Estimated number of bytes of memory saved by sharing identical label pairs and help strings between the stored metric families, as of the last deduplication.",
+		}),
+	}
+	for _, reason := range []string{evictedMaxGroupsPerJob, evictedMaxAge} {
+		dms.evictions.WithLabelValues(reason)
 	}
+	dms.persistLag = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "pushgateway_persistence_lag_seconds",
+		Help: "Age of the oldest change of the metric store that has not been persisted yet, 0 if all changes are persisted.",
+	}, func() float64 { return dms.persistenceLag(time.Now()).Seconds() })
 	if err := dms.restore(); err != nil {
 		level.Error(logger).Log("msg", "could not load persisted metrics", "err", err)
 	}
@@ -99,23 +410,193 @@ func NewDiskMetricStore(
 	} else {
 		level.Error(logger).Log("msg", "could not gather metrics for predefined help strings", "err", err)
 	}
+	if queue.SpillDir != "" {
+		dms.openSpill(queue)
+	}
 
 	go dms.loop(persistenceInterval)
+	if dms.spill != nil {
+		go dms.drainSpill()
+	}
 	return dms
 }
 
-// SubmitWriteRequest implements the MetricStore interface.
-func (dms *DiskMetricStore) SubmitWriteRequest(req WriteRequest) {
-	dms.writeQueue <- req
+// openSpill opens the spill file of the write queue. If that fails, spilling is
+// disabled.
+func (dms *DiskMetricStore) openSpill(queue WriteQueueOptions) {
+	sq, corrupted, err := openSpillQueue(queue.SpillDir, queue.SpillMaxSize)
+	if err != nil {
+		level.Error(dms.logger).Log("msg", "could not open spill file, write requests will not be spilled", "dir", queue.SpillDir, "err", err)
+		return
+	}
+	if corrupted > 0 {
+		level.Warn(dms.logger).Log("msg", "discarded corrupted end of spill file", "dir", queue.SpillDir, "bytes", corrupted)
+	}
+	if n, _, _ := sq.stats(); n > 0 {
+		level.Info(dms.logger).Log("msg", "feeding spilled write requests back into the write queue", "count", n)
+	}
+	dms.spill = sq
+	dms.spillStop = make(chan struct{})
+	dms.spillDone = make(chan struct{})
+}
+
+// drainSpill feeds the spilled WriteRequests back into the write queue, blocking
+// while it is full. Once spillStop is closed, it returns as soon as the spill
+// is empty.
+func (dms *DiskMetricStore) drainSpill() {
+	defer close(dms.spillDone)
+	stopping := false
+	for {
+		wr, ok, err := dms.spill.peek()
+		if !ok {
+			if stopping {
+				return
+			}
+			select {
+			case <-dms.spill.wake:
+			case <-dms.spillStop:
+				stopping = true
+			}
+			continue
+		}
+		if err != nil {
+			level.Error(dms.logger).Log("msg", "dropping spilled write request that cannot be read", "err", err)
+			if wr.Done != nil {
+				wr.Done <- err
+				close(wr.Done)
+			}
+		} else {
+			dms.writeQueue <- wr
+		}
+		if err := dms.spill.pop(); err != nil {
+			level.Error(dms.logger).Log("msg", "could not update spill file", "err", err)
+		}
+	}
+}
+
+// SubmitWriteRequest implements the MetricStore interface. If spilling is
+// enabled, req is spilled to disk if the write queue is full (or other
+// WriteRequests have been spilled already).
+func (dms *DiskMetricStore) SubmitWriteRequest(req WriteRequest) error {
+	if dms.spill != nil {
+		fallBack, err := dms.spill.pushOrSend(req, dms.writeQueue)
+		if err == nil {
+			return nil
+		}
+		level.Warn(dms.logger).Log("msg", "could not spill write request", "queue_length", len(dms.writeQueue), "err", err)
+		if !fallBack {
+			return ErrWriteQueueFull
+		}
+	}
+	if dms.queueTimeout <= 0 {
+		dms.writeQueue <- req
+		return nil
+	}
+	select {
+	case dms.writeQueue <- req:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(dms.queueTimeout)
+	defer timer.Stop()
+	select {
+	case dms.writeQueue <- req:
+		return nil
+	case <-timer.C:
+		return ErrWriteQueueFull
+	}
+}
+
+// SetLimits replaces the limits of the DiskMetricStore, e.g. upon reloading
+// the configuration. Groups already exceeding the new limits are kept, but
+// further pushes to them are rejected.
+func (dms *DiskMetricStore) SetLimits(limits Limits) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dms.limits = limits
 }
 
-// Shutdown implements the MetricStore interface.
+// SetPersistLagWarning sets the persistence lag (the age of the oldest change
+// not persisted yet) beyond which a warning is logged upon persisting. Zero
+// disables the warning. The default is three times the persistence interval.
+func (dms *DiskMetricStore) SetPersistLagWarning(threshold time.Duration) {
+	dms.statusMtx.Lock()
+	defer dms.statusMtx.Unlock()
+	dms.persistLagWarning = threshold
+}
+
+// SetRetention replaces the Retention of the DiskMetricStore. It takes effect
+// with the next periodic cleanup pass of the store loop.
+func (dms *DiskMetricStore) SetRetention(retention Retention) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dms.retention = retention
+}
+
+// SetGroupMetrics sets whether the DiskMetricStore exposes metrics about every
+// metric group (labeled by its grouping labels) when collected as a
+// prometheus.Collector, see collectGroupMetrics. As this creates a few series
+// per group, it is disabled by default.
+func (dms *DiskMetricStore) SetGroupMetrics(enabled bool) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dms.groupMetrics = enabled
+}
+
+// SetEmptyGroupPolicy sets the EmptyGroupPolicy of the DiskMetricStore. The
+// empty string means EmptyGroupRemove.
+func (dms *DiskMetricStore) SetEmptyGroupPolicy(policy EmptyGroupPolicy) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dms.emptyGroups = policy
+}
+
+// SetRemovalHook sets a function to be called for every metric group removed
+// from the DiskMetricStore by expiration, retention, or deletion, but not by a
+// wipe. The function is called with the lock of the DiskMetricStore held, so it
+// must not block and must not call any methods of the DiskMetricStore.
+func (dms *DiskMetricStore) SetRemovalHook(hook func(GroupRemoval)) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dms.removalHook = hook
+}
+
+// notifyRemoval calls the removal hook, if any, for the provided group. The
+// caller must hold the write lock.
+func (dms *DiskMetricStore) notifyRemoval(group MetricGroup, event, reason string, now time.Time) {
+	if dms.removalHook == nil {
+		return
+	}
+	dms.removalHook(GroupRemoval{
+		Event:        event,
+		Reason:       reason,
+		Labels:       group.Labels,
+		LastPushTime: group.LastPushTime(),
+		Time:         now,
+	})
+}
+
+// Shutdown implements the MetricStore interface. Spilled WriteRequests are
+// processed, too.
 func (dms *DiskMetricStore) Shutdown() error {
+	if dms.spill != nil {
+		close(dms.spillStop)
+		<-dms.spillDone
+	}
 	close(dms.drain)
-	return <-dms.done
+	err := <-dms.done
+	if dms.spill != nil {
+		if closeErr := dms.spill.close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
-// Healthy implements the MetricStore interface.
+// Healthy implements the MetricStore interface. The DiskMetricStore is healthy
+// if its write queue is neither full nor stuck, i.e. not processed for a while
+// although requests are waiting. With spilling enabled, a full write queue is
+// fine.
 func (dms *DiskMetricStore) Healthy() error {
 	// By taking the lock we check that there is no deadlock.
 	dms.lock.Lock()
@@ -123,122 +604,448 @@ func (dms *DiskMetricStore) Healthy() error {
 
 	// A pushgateway that cannot be written to should not be
 	// considered as healthy.
-	if len(dms.writeQueue) == cap(dms.writeQueue) {
-		return fmt.Errorf("write queue is full")
+	if dms.spill == nil && len(dms.writeQueue) == cap(dms.writeQueue) {
+		return fmt.Errorf("write queue is full (capacity %d)", cap(dms.writeQueue))
+	}
+	dms.statusMtx.Lock()
+	sinceDequeued := time.Since(dms.lastDequeued)
+	dms.statusMtx.Unlock()
+	if len(dms.writeQueue) > 0 && sinceDequeued > stuckQueueTimeout {
+		return fmt.Errorf(
+			"write queue is stuck (%d requests waiting, none processed for %v)",
+			len(dms.writeQueue), sinceDequeued.Round(time.Second),
+		)
 	}
 
 	return nil
 }
 
-// Ready implements the MetricStore interface.
+// Ready implements the MetricStore interface. The DiskMetricStore is ready if
+// it is healthy and the last attempt to persist it (if any) has succeeded.
 func (dms *DiskMetricStore) Ready() error {
-	return dms.Healthy()
+	if err := dms.Healthy(); err != nil {
+		return err
+	}
+	dms.statusMtx.Lock()
+	defer dms.statusMtx.Unlock()
+	if dms.lastPersistErr != nil {
+		return fmt.Errorf("last attempt to persist metrics failed: %v", dms.lastPersistErr)
+	}
+	return nil
+}
+
+// Status implements the StatusReporter interface.
+func (dms *DiskMetricStore) Status() StoreStatus {
+	s := StoreStatus{
+		WriteQueueLength:   len(dms.writeQueue),
+		WriteQueueCapacity: cap(dms.writeQueue),
+		Persisting:         dms.persister != nil,
+	}
+	for _, group := range dms.groupsSnapshot() {
+		s.Groups++
+		for name, tmf := range group.Metrics {
+			if name == pushMetricName || name == pushFailedMetricName {
+				continue
+			}
+			s.MetricFamilies++
+			s.Samples += NumSamples(tmf.GetMetricFamily())
+		}
+	}
+	if !s.Persisting {
+		return s
+	}
+	dms.statusMtx.Lock()
+	s.LastPersistTime = dms.lastPersistTime
+	s.LastPersistDuration = dms.lastPersistDuration
+	s.LastPersistError = dms.lastPersistErr
+	s.LastPersistSuccessTime = dms.lastPersistSuccessTime
+	dms.statusMtx.Unlock()
+	s.PersistenceSize = -1
+	if ps, ok := dms.persister.(persistenceSizer); ok {
+		if size, err := ps.persistenceSize(); err == nil {
+			s.PersistenceSize = size
+		}
+	}
+	return s
+}
+
+// Describe implements prometheus.Collector.
+func (dms *DiskMetricStore) Describe(ch chan<- *prometheus.Desc) {
+	ch <- writeQueueLengthDesc
+	ch <- writeQueueCapacityDesc
+	ch <- spillLengthDesc
+	ch <- spillBytesDesc
+	ch <- spilledDesc
+	ch <- metricGroupsDesc
+	ch <- metricFamiliesDesc
+	ch <- persistenceEnabledDesc
+	dms.persistDuration.Describe(ch)
+	dms.persistErrors.Describe(ch)
+	dms.lastPersistSuccess.Describe(ch)
+	dms.persistLag.Describe(ch)
+	dms.logErrors.Describe(ch)
+	dms.evictions.Describe(ch)
+	dms.internSavedBytes.Describe(ch)
+	if c, ok := dms.persister.(prometheus.Collector); ok {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (dms *DiskMetricStore) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(
+		writeQueueLengthDesc, prometheus.GaugeValue, float64(len(dms.writeQueue)),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		writeQueueCapacityDesc, prometheus.GaugeValue, float64(cap(dms.writeQueue)),
+	)
+	if dms.spill != nil {
+		length, size, total := dms.spill.stats()
+		ch <- prometheus.MustNewConstMetric(spillLengthDesc, prometheus.GaugeValue, float64(length))
+		ch <- prometheus.MustNewConstMetric(spillBytesDesc, prometheus.GaugeValue, float64(size))
+		ch <- prometheus.MustNewConstMetric(spilledDesc, prometheus.CounterValue, float64(total))
+	}
+
+	dms.lock.RLock()
+	groups, families := len(dms.metricGroups), dms.families
+	groupMetrics := dms.groupMetrics
+	dms.lock.RUnlock()
+	ch <- prometheus.MustNewConstMetric(
+		metricGroupsDesc, prometheus.GaugeValue, float64(groups),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		metricFamiliesDesc, prometheus.GaugeValue, float64(families),
+	)
+	if groupMetrics {
+		collectGroupMetrics(dms.groupsSnapshot(), ch)
+	}
+	persistenceEnabled := 0.
+	if dms.persister != nil {
+		persistenceEnabled = 1
+	}
+	ch <- prometheus.MustNewConstMetric(persistenceEnabledDesc, prometheus.GaugeValue, persistenceEnabled)
+
+	dms.persistDuration.Collect(ch)
+	dms.persistErrors.Collect(ch)
+	dms.lastPersistSuccess.Collect(ch)
+	dms.persistLag.Collect(ch)
+	dms.logErrors.Collect(ch)
+	dms.evictions.Collect(ch)
+	dms.internSavedBytes.Collect(ch)
+	if c, ok := dms.persister.(prometheus.Collector); ok {
+		c.Collect(ch)
+	}
+}
+
+// collectGroupMetrics sends metrics about each of the provided groups to ch,
+// labeled by the grouping labels of the group. As groups have different
+// grouping label names, the Descs are created on the fly.
+func collectGroupMetrics(groups GroupingKeyToMetricGroup, ch chan<- prometheus.Metric) {
+	for _, group := range groups {
+		names := make([]string, 0, len(group.Labels))
+		for name := range group.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = group.Labels[name]
+		}
+		for _, m := range []struct {
+			name, help string
+			typ        prometheus.ValueType
+			value      int
+		}{
+			{"pushgateway_group_metric_families", "Number of pushed metric families in the metric group.", prometheus.GaugeValue, group.NumMetricFamilies()},
+			{"pushgateway_group_samples", "Number of samples in the pushed metric families of the metric group.", prometheus.GaugeValue, group.NumSamples()},
+			{"pushgateway_group_last_push_size_bytes", "Size of the body of the last successful push to the metric group, 0 if unknown.", prometheus.GaugeValue, group.LastPushSize},
+			{"pushgateway_group_pushes_total", "Total number of pushes to the metric group processed since start-up, including failed ones.", prometheus.CounterValue, group.Pushes},
+			{"pushgateway_group_failed_pushes_total", "Total number of failed pushes to the metric group processed since start-up.", prometheus.CounterValue, group.FailedPushes},
+		} {
+			ch <- prometheus.MustNewConstMetric(
+				prometheus.NewDesc(m.name, m.help, names, nil), m.typ, float64(m.value), values...,
+			)
+		}
+	}
 }
 
 // GetMetricFamilies implements the MetricStore interface.
 func (dms *DiskMetricStore) GetMetricFamilies() []*dto.MetricFamily {
-	dms.lock.RLock()
-	defer dms.lock.RUnlock()
+	return dms.getMetricFamilies(Shard{}, nil)
+}
 
-	result := []*dto.MetricFamily{}
-	mfStatByName := map[string]mfStat{}
+// GetMatchingMetricFamilies implements the MatchingMetricStore interface. Groups
+// whose grouping labels rule out all selectors are skipped without copying any
+// of their metric families.
+func (dms *DiskMetricStore) GetMatchingMetricFamilies(selectors []Selector) []*dto.MetricFamily {
+	return dms.getMetricFamilies(Shard{}, selectors)
+}
 
-	for _, group := range dms.metricGroups {
-		for name, tmf := range group.Metrics {
-			mf := tmf.GetMetricFamily()
+// GetShardMetricFamilies implements the ShardedMetricStore interface. Groups
+// not in the Shard are skipped without copying any of their metric families.
+func (dms *DiskMetricStore) GetShardMetricFamilies(shard Shard, selectors []Selector) []*dto.MetricFamily {
+	return dms.getMetricFamilies(shard, selectors)
+}
+
+// WalkMetricFamilies implements the StreamingMetricStore interface. Only the
+// metric families of one name are merged at a time.
+func (dms *DiskMetricStore) WalkMetricFamilies(shard Shard, selectors []Selector, groups func(GroupingKeyToMetricGroup) error, f func(*dto.MetricFamily, []MetricGroup) error) error {
+	snapshot := shard.Groups(dms.groupsSnapshot())
+	if groups != nil {
+		if err := groups(snapshot); err != nil {
+			return err
+		}
+	}
+
+	// Iterate in a reproducible order so that the result (including which
+	// help string wins) does not depend on map iteration order.
+	byName := groupsByName(snapshot)
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var result *dto.MetricFamily
+		copied := false // Has result already been copied?
+		var merged []MetricGroup
+		for _, group := range byName[name] {
+			mf := group.Metrics[name].GetMetricFamily()
 			if mf == nil {
-				level.Warn(dms.logger).Log("msg", "storage corruption detected, consider wiping the persistence file")
+				level.Warn(dms.logger).Log(append(
+					[]interface{}{"msg", "storage corruption detected, consider wiping the persistence file", "metric_family", name},
+					groupLogFields(group.Labels)...,
+				)...)
 				continue
 			}
-			stat, exists := mfStatByName[name]
-			if exists {
-				existingMF := result[stat.pos]
-				if !stat.copied {
-					mfStatByName[name] = mfStat{
-						pos:    stat.pos,
-						copied: true,
-					}
-					existingMF = copyMetricFamily(existingMF)
-					result[stat.pos] = existingMF
-				}
-				if mf.GetHelp() != existingMF.GetHelp() {
-					level.Info(dms.logger).Log("msg", "metric families inconsistent help strings", "err", "Metric families have inconsistent help strings. The latter will have priority. This is bad. Fix your pushed metrics!", "new", mf, "old", existingMF)
+			selected := false
+			if len(selectors) > 0 {
+				if mf, selected = selectMetricFamily(mf, group.Labels, selectors); mf == nil {
+					continue
 				}
-				// Type inconsistency cannot be fixed here. We will detect it during
-				// gathering anyway, so no reason to log anything here.
-				existingMF.Metric = append(existingMF.Metric, mf.Metric...)
-			} else {
-				copied := false
-				if help, ok := dms.predefinedHelp[name]; ok && mf.GetHelp() != help {
-					level.Info(dms.logger).Log("msg", "metric families overlap", "err", "Metric family has the same name as a metric family used by the Pushgateway itself but it has a different help string. Changing it to the standard help string. This is bad. Fix your pushed metrics!", "metric_family", mf, "standard_help", help)
-					mf = copyMetricFamily(mf)
+			}
+			if result != nil {
+				if !copied {
+					result = copyMetricFamily(result)
 					copied = true
-					mf.Help = proto.String(help)
 				}
-				mfStatByName[name] = mfStat{
-					pos:    len(result),
-					copied: copied,
+				if mf.GetHelp() != result.GetHelp() {
+					level.Info(dms.logger).Log("msg", "metric families inconsistent help strings", "err", "Metric families have inconsistent help strings. The latter will have priority. This is bad. Fix your pushed metrics!", "new", mf, "old", result)
 				}
-				result = append(result, mf)
+				// Type inconsistency cannot be fixed here. We will detect it during
+				// gathering anyway, so no reason to log anything here.
+				result.Metric = append(result.Metric, mf.Metric...)
+				merged = append(merged, group)
+				continue
 			}
+			copied = selected
+			if help, ok := dms.predefinedHelp[name]; ok && mf.GetHelp() != help {
+				level.Info(dms.logger).Log("msg", "metric families overlap", "err", "Metric family has the same name as a metric family used by the Pushgateway itself but it has a different help string. Changing it to the standard help string. This is bad. Fix your pushed metrics!", "metric_family", mf, "standard_help", help)
+				mf = copyMetricFamily(mf)
+				copied = true
+				mf.Help = proto.String(help)
+			}
+			result = mf
+			merged = append(merged, group)
+		}
+		if result == nil {
+			continue
+		}
+
+		less := func(a, b int) bool {
+			return labelsLess(result.Metric[a].Label, result.Metric[b].Label)
+		}
+		if !sort.SliceIsSorted(result.Metric, less) {
+			if !copied {
+				result = copyMetricFamily(result)
+			}
+			sort.SliceStable(result.Metric, less)
+		}
+		if err := f(result, merged); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// getMetricFamilies returns the metric families as described for
+// GetMetricFamilies, restricted to the groups in the provided Shard and to the
+// metrics matched by any of the provided selectors (if there are any).
+func (dms *DiskMetricStore) getMetricFamilies(shard Shard, selectors []Selector) []*dto.MetricFamily {
+	result := []*dto.MetricFamily{}
+	dms.WalkMetricFamilies(shard, selectors, nil, func(mf *dto.MetricFamily, _ []MetricGroup) error {
+		result = append(result, mf)
+		return nil
+	})
 	return result
 }
 
+// labelsLess compares two label sets, each sorted by label name, pair by pair,
+// first by name and then by value.
+func labelsLess(a, b []*dto.LabelPair) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].GetName() != b[i].GetName() {
+			return a[i].GetName() < b[i].GetName()
+		}
+		if a[i].GetValue() != b[i].GetValue() {
+			return a[i].GetValue() < b[i].GetValue()
+		}
+	}
+	return len(a) < len(b)
+}
+
 // GetMetricFamiliesMap implements the MetricStore interface.
 func (dms *DiskMetricStore) GetMetricFamiliesMap() GroupingKeyToMetricGroup {
+	groupsCopy := dms.groupsSnapshot()
+	for k, g := range groupsCopy {
+		g.Metrics = copyMetrics(g.Metrics)
+		groupsCopy[k] = g
+	}
+	return groupsCopy
+}
+
+// GetMetricGroup implements the GroupMetricStore interface.
+func (dms *DiskMetricStore) GetMetricGroup(labels map[string]string) (MetricGroup, bool) {
+	dms.lock.RLock()
+	group, ok := dms.metricGroups[groupingKeyFor(labels)]
+	dms.lock.RUnlock()
+	if ok {
+		group.Metrics = copyMetrics(group.Metrics)
+	}
+	return group, ok
+}
+
+// groupsSnapshot returns a shallow copy of the stored metric groups. As the
+// groups are copy-on-write, the snapshot stays consistent without holding the
+// lock, but neither the groups nor their Metrics maps may be modified.
+func (dms *DiskMetricStore) groupsSnapshot() GroupingKeyToMetricGroup {
 	dms.lock.RLock()
 	defer dms.lock.RUnlock()
-	groupsCopy := make(GroupingKeyToMetricGroup, len(dms.metricGroups))
+	snapshot := make(GroupingKeyToMetricGroup, len(dms.metricGroups))
 	for k, g := range dms.metricGroups {
-		metricsCopy := make(NameToTimestampedMetricFamilyMap, len(g.Metrics))
-		groupsCopy[k] = MetricGroup{Labels: g.Labels, Metrics: metricsCopy}
-		for n, tmf := range g.Metrics {
-			metricsCopy[n] = tmf
+		snapshot[k] = g
+	}
+	return snapshot
+}
+
+// countGroup updates the running counts of metric families and pushed samples
+// in all groups for the provided group replacing the provided stored one. A
+// zero MetricGroup stands for a group that does not exist (anymore). The caller
+// must hold the write lock.
+func (dms *DiskMetricStore) countGroup(stored, group MetricGroup) {
+	dms.families += len(group.Metrics) - len(stored.Metrics)
+	if dms.samples >= 0 {
+		dms.samples += group.NumSamples() - stored.NumSamples()
+	}
+}
+
+// recount counts the metric families in all groups anew after the groups have
+// been replaced as a whole. The samples are only counted once needed, see
+// storedSamples, so that lazily restored metric families are not loaded just
+// for counting. The caller must hold the write lock (or, during restore, be
+// the only one accessing the groups).
+func (dms *DiskMetricStore) recount() {
+	dms.families = 0
+	for _, group := range dms.metricGroups {
+		dms.families += len(group.Metrics)
+	}
+	dms.samples = -1
+}
+
+// storedSamples returns the number of pushed samples in all groups, counting
+// them first if that has not happened since the last recount.
+func (dms *DiskMetricStore) storedSamples() int {
+	dms.lock.RLock()
+	n := dms.samples
+	dms.lock.RUnlock()
+	if n >= 0 {
+		return n
+	}
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	if dms.samples < 0 {
+		dms.samples = 0
+		for _, group := range dms.metricGroups {
+			dms.samples += group.NumSamples()
 		}
 	}
-	return groupsCopy
+	return dms.samples
+}
+
+// copyMetrics returns a copy of the provided map, to be modified instead of a
+// Metrics map of a stored group.
+func copyMetrics(metrics NameToTimestampedMetricFamilyMap) NameToTimestampedMetricFamilyMap {
+	metricsCopy := make(NameToTimestampedMetricFamilyMap, len(metrics)+2)
+	for n, tmf := range metrics {
+		metricsCopy[n] = tmf
+	}
+	return metricsCopy
 }
 
 func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
-	lastPersist := time.Now()
+	now := time.Now()
+	lastPersist := persistRun{started: now, finished: now}
 	persistScheduled := false
 	lastWrite := time.Time{}
-	persistDone := make(chan time.Time)
+	if dms.persistOnStart {
+		// Persist right away, see restore.
+		lastWrite, lastPersist = now, persistRun{}
+	}
+	persistDone := make(chan persistRun)
 	var persistTimer *time.Timer
+	expirationTicker := time.NewTicker(expirationInterval)
+	defer expirationTicker.Stop()
 
 	checkPersist := func() {
-		if dms.persistenceFile != "" && !persistScheduled && lastWrite.After(lastPersist) {
+		if dms.persister != nil && !persistScheduled && lastWrite.After(lastPersist.started) {
+			delay := persistenceInterval - lastWrite.Sub(lastPersist.started)
+			// Pause at least as long as the previous persisting took.
+			if pause := lastPersist.finished.Sub(lastPersist.started) - time.Since(lastPersist.finished); pause > delay {
+				delay = pause
+			}
 			persistTimer = time.AfterFunc(
-				persistenceInterval-lastWrite.Sub(lastPersist),
+				delay,
 				func() {
-					persistStarted := time.Now()
+					run := persistRun{started: time.Now()}
 					if err := dms.persist(); err != nil {
-						level.Error(dms.logger).Log("msg", "error persisting metrics", "err", err)
+						level.Error(dms.logger).Log("msg", "error persisting metrics", "queue_length", len(dms.writeQueue), "err", err)
 					} else {
-						level.Info(dms.logger).Log("msg", "metrics persisted", "file", dms.persistenceFile)
+						level.Info(dms.logger).Log("msg", "metrics persisted")
 					}
-					persistDone <- persistStarted
+					run.finished = time.Now()
+					persistDone <- run
 				},
 			)
 			persistScheduled = true
 		}
 	}
+	checkPersist()
 
 	for {
 		select {
 		case wr := <-dms.writeQueue:
+			dms.statusMtx.Lock()
+			dms.lastDequeued = time.Now()
+			dms.statusMtx.Unlock()
+			if wr.Flush {
+				dms.flush(wr)
+				continue
+			}
 			lastWrite = time.Now()
-			if dms.checkWriteRequest(wr) {
-				dms.processWriteRequest(wr)
-			} else {
-				dms.setPushFailedTimestamp(wr)
+			dms.processQueued(wr)
+			dms.markUnpersisted(lastWrite)
+			checkPersist()
+		case now := <-expirationTicker.C:
+			expired := dms.removeExpired(now)
+			if evicted := dms.applyRetention(now); expired || evicted {
+				lastWrite = now
+				dms.markUnpersisted(lastWrite)
+				checkPersist()
 			}
-			if wr.Done != nil {
-				close(wr.Done)
+			if dms.internDue(now) {
+				dms.intern(now)
 			}
-			checkPersist()
 		case lastPersist = <-persistDone:
 			persistScheduled = false
 			checkPersist() // In case something has been written in the meantime.
@@ -247,16 +1054,49 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 			if persistTimer != nil {
 				persistTimer.Stop()
 			}
-			// Now draining...
-			for {
-				select {
-				case wr := <-dms.writeQueue:
-					dms.processWriteRequest(wr)
-				default:
-					dms.done <- dms.persist()
-					return
+			dms.done <- dms.drainWriteQueue()
+			return
+		}
+	}
+}
+
+// applyWriteRequest checks and processes the provided WriteRequest (which must
+// not be a flush) and closes its Done channel afterwards.
+func (dms *DiskMetricStore) applyWriteRequest(wr WriteRequest) {
+	if wr.Wipe {
+		dms.wipe(wr)
+	} else if err := dms.checkWriteRequest(wr); err == nil {
+		dms.processWriteRequest(wr)
+	} else {
+		dms.setPushFailedTimestamp(wr, err)
+	}
+	if wr.Done != nil {
+		close(wr.Done)
+	}
+}
+
+// drainWriteQueue applies all WriteRequests left in the write queue, persists
+// the result, and closes the persister. It is called by the loop upon shutdown.
+func (dms *DiskMetricStore) drainWriteQueue() error {
+	for {
+		select {
+		case wr := <-dms.writeQueue:
+			if wr.Flush {
+				// Persisting happens below anyway.
+				if wr.Done != nil {
+					close(wr.Done)
+				}
+				continue
+			}
+			dms.applyWriteRequest(wr)
+		default:
+			err := dms.persist()
+			if dms.persister != nil {
+				if closeErr := dms.persister.Close(); err == nil {
+					err = closeErr
 				}
 			}
+			return err
 		}
 	}
 }
@@ -265,23 +1105,66 @@ func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 	dms.lock.Lock()
 	defer dms.lock.Unlock()
 
+	dms.processWriteRequestLocked(wr)
+}
+
+// processWriteRequestLocked is processWriteRequest for callers already holding
+// the write lock.
+func (dms *DiskMetricStore) processWriteRequestLocked(wr WriteRequest) {
+	dms.logWriteRequest(wr, false)
+
+	if wr.Wipe {
+		dms.metricGroups = GroupingKeyToMetricGroup{}
+		dms.families, dms.samples = 0, 0
+		return
+	}
+
+	if wr.Groups != nil {
+		dms.metricGroups = wr.Groups
+		dms.recount()
+		return
+	}
+
 	key := groupingKeyFor(wr.Labels)
 
+	if wr.Lock || wr.Unlock {
+		if group, ok := dms.metricGroups[key]; ok {
+			group.Locked = wr.Lock
+			dms.metricGroups[key] = group
+		}
+		return
+	}
+	if wr.RenameTo != nil {
+		dms.renameGroup(key, wr.RenameTo)
+		return
+	}
 	if wr.MetricFamilies == nil {
 		// No MetricFamilies means delete request. Delete the whole
-		// metric group, and we are done here.
-		delete(dms.metricGroups, key)
+		// metric group unless only selected metric families or metrics
+		// are to be deleted, and we are done here.
+		if len(wr.MetricNames) > 0 || len(wr.MetricLabels) > 0 {
+			dms.deleteMetricFamilies(key, wr.MetricNames, wr.MetricLabels, wr.Timestamp)
+			return
+		}
+		if group, ok := dms.metricGroups[key]; ok {
+			delete(dms.metricGroups, key)
+			dms.countGroup(group, MetricGroup{})
+			dms.notifyRemoval(group, RemovalDeleted, "", wr.Timestamp)
+		}
 		return
 	}
-	// Otherwise, it's an update.
+	// Otherwise, it's an update, applied to a copy of the group.
 	group, ok := dms.metricGroups[key]
+	stored := group
 	if !ok {
 		group = MetricGroup{
 			Labels:  wr.Labels,
 			Metrics: NameToTimestampedMetricFamilyMap{},
 		}
-		dms.metricGroups[key] = group
-	} else if wr.Replace {
+	} else {
+		group.Metrics = copyMetrics(group.Metrics)
+	}
+	if ok && wr.Replace {
 		// For replace, we have to delete all metric families in the
 		// group except pre-existing push timestamps.
 		for name := range group.Metrics {
@@ -290,34 +1173,472 @@ func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 			}
 		}
 	}
+	if wr.Replace || len(wr.Annotations) > 0 {
+		group.Annotations = mergeAnnotations(group.Annotations, wr.Annotations, wr.Replace)
+	}
+	group.ExpectedInterval = mergeExpectedInterval(group.ExpectedInterval, wr.ExpectedInterval, wr.Replace)
+	if wr.Sequence > 0 {
+		group.Sequence = wr.Sequence
+	}
 	wr.MetricFamilies[pushMetricName] = newPushTimestampGauge(wr.Labels, wr.Timestamp)
+	newTimestampGauges := 1
 	// Only add a zero push-failed metric if none is there yet, so that a
 	// previously added fail timestamp is retained.
 	if _, ok := group.Metrics[pushFailedMetricName]; !ok {
 		wr.MetricFamilies[pushFailedMetricName] = newPushFailedTimestampGauge(wr.Labels, time.Time{})
+		newTimestampGauges++
 	}
 	for name, mf := range wr.MetricFamilies {
-		group.Metrics[name] = TimestampedMetricFamily{
+		tmf := TimestampedMetricFamily{
 			Timestamp:            wr.Timestamp,
 			GobbableMetricFamily: (*GobbableMetricFamily)(mf),
 		}
+		if name != pushMetricName && name != pushFailedMetricName {
+			tmf.TTL = wr.TTL
+			// Aggregate into a new MetricFamily. Neither the stored
+			// one nor the one in the WriteRequest may be modified as
+			// the latter might get processed again after a check.
+			if stored, ok := group.Metrics[name]; ok && wr.Aggregation != AggregateNone && !wr.Replace {
+				tmf.GobbableMetricFamily = (*GobbableMetricFamily)(
+					aggregateMetricFamily(stored.GetMetricFamily(), mf, wr.Aggregation),
+				)
+			}
+		}
+		group.Metrics[name] = tmf
+	}
+	// Only keep a payload hash identifying exactly the stored metric
+	// families, see MetricGroup.
+	group.PayloadHash = ""
+	if wr.Aggregation == AggregateNone && group.NumMetricFamilies() == len(wr.MetricFamilies)-newTimestampGauges {
+		group.PayloadHash = wr.PayloadHash
+	}
+	group.countPush(wr.Timestamp)
+	group.LastPushSize = wr.PayloadSize
+	group.LastPushDuration = time.Since(wr.Timestamp)
+	group.PushFormat = wr.PushFormat
+	dms.metricGroups[key] = group
+	dms.countGroup(stored, group)
+}
+
+// mergeExpectedInterval returns the expected interval resulting from pushing
+// the provided one to a group with the stored one, see WriteRequest.
+func mergeExpectedInterval(stored, pushed time.Duration, replace bool) time.Duration {
+	if replace || pushed > 0 {
+		return pushed
+	}
+	return stored
+}
+
+// mergeAnnotations returns the annotations resulting from pushing the provided
+// annotations to a group with the stored annotations, see WriteRequest. The
+// stored map is not modified as it might still be read elsewhere. The result is
+// nil if no annotations are left.
+func mergeAnnotations(stored, pushed map[string]string, replace bool) map[string]string {
+	result := map[string]string{}
+	if !replace {
+		for name, value := range stored {
+			result[name] = value
+		}
+	}
+	for name, value := range pushed {
+		if value == "" {
+			delete(result, name)
+			continue
+		}
+		result[name] = value
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// logWriteRequest logs the provided WriteRequest with the Persister, if any. The
+// caller must hold the write lock so that the order of logged changes matches
+// the order in which they are applied.
+func (dms *DiskMetricStore) logWriteRequest(wr WriteRequest, pushFailed bool) {
+	if dms.persister == nil || dms.replaying {
+		// Replayed changes are logged already.
+		return
+	}
+	if err := dms.persister.Log(wr, pushFailed); err != nil {
+		dms.logErrors.Inc()
+		level.Error(dms.logger).Log(append(
+			[]interface{}{"msg", "could not append to write-ahead log", "queue_length", len(dms.writeQueue), "err", err},
+			groupLogFields(wr.Labels)...,
+		)...)
+	}
+}
+
+// renameGroup moves the group with the provided grouping key to the provided
+// grouping labels, see WriteRequest. Nothing happens if the group does not
+// exist or the grouping labels are taken. The caller must hold the write lock.
+func (dms *DiskMetricStore) renameGroup(key string, labels map[string]string) {
+	group, ok := dms.metricGroups[key]
+	if !ok {
+		return
+	}
+	newKey := groupingKeyFor(labels)
+	if newKey == key {
+		return
+	}
+	if _, ok := dms.metricGroups[newKey]; ok {
+		return
+	}
+	oldLabels := group.Labels
+	group.Labels = labels
+	group.Metrics = make(NameToTimestampedMetricFamilyMap, len(group.Metrics))
+	for name, tmf := range dms.metricGroups[key].Metrics {
+		mf := proto.Clone(tmf.GetMetricFamily()).(*dto.MetricFamily)
+		for _, m := range mf.GetMetric() {
+			// Remove grouping labels the new grouping key does not
+			// have. sanitizeLabels takes care of the others.
+			kept := m.Label[:0]
+			for _, lp := range m.GetLabel() {
+				if _, ok := oldLabels[lp.GetName()]; ok {
+					if _, ok := labels[lp.GetName()]; !ok {
+						continue
+					}
+				}
+				kept = append(kept, lp)
+			}
+			m.Label = kept
+		}
+		sanitizeLabels(mf, labels)
+		group.Metrics[name] = tmf.withMetricFamily(mf)
+	}
+	delete(dms.metricGroups, key)
+	dms.metricGroups[newKey] = group
+}
+
+// deleteMetricFamilies deletes the metric families with the provided names from
+// the group with the provided grouping key. If labels is not empty, only the
+// metrics with all of those label pairs are deleted from the metric families
+// (from all pushed metric families if names is empty), see WriteRequest. The
+// group is removed if no pushed metric families are left, unless the
+// EmptyGroupPolicy is EmptyGroupKeep. The caller must hold the write lock.
+func (dms *DiskMetricStore) deleteMetricFamilies(key string, names []string, labels map[string]string, now time.Time) {
+	group, ok := dms.metricGroups[key]
+	if !ok {
+		return
+	}
+	stored := group
+	group.Metrics = copyMetrics(group.Metrics)
+	if len(names) == 0 {
+		for name := range group.Metrics {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if name == pushMetricName || name == pushFailedMetricName {
+			continue
+		}
+		tmf, ok := group.Metrics[name]
+		if !ok {
+			continue
+		}
+		if len(labels) == 0 {
+			delete(group.Metrics, name)
+			continue
+		}
+		if tmf.GetMetricFamily() == nil {
+			continue
+		}
+		// Copy-on-write, the stored MetricFamily must not be modified.
+		mf := *tmf.GetMetricFamily()
+		mf.Metric = nil
+		for _, m := range tmf.GetMetricFamily().GetMetric() {
+			if !hasLabels(m, labels) {
+				mf.Metric = append(mf.Metric, m)
+			}
+		}
+		switch len(mf.Metric) {
+		case 0:
+			delete(group.Metrics, name)
+			continue
+		case len(tmf.GetMetricFamily().GetMetric()):
+			continue
+		}
+		group.Metrics[name] = tmf.withMetricFamily(&mf)
+	}
+	group.PayloadHash = ""
+	if !hasPushedMetricFamilies(group) && dms.emptyGroups != EmptyGroupKeep {
+		delete(dms.metricGroups, key)
+		dms.countGroup(stored, MetricGroup{})
+		dms.notifyRemoval(group, RemovalDeleted, "", now)
+		return
+	}
+	dms.metricGroups[key] = group
+	dms.countGroup(stored, group)
+}
+
+// flush processes a WriteRequest with Flush set, i.e. it persists the metric
+// store right away.
+func (dms *DiskMetricStore) flush(wr WriteRequest) {
+	err := dms.persist()
+	if err != nil {
+		level.Error(dms.logger).Log("msg", "error persisting metrics on flush", "queue_length", len(dms.writeQueue), "err", err)
+	}
+	if wr.Done != nil {
+		if err != nil {
+			wr.Done <- err
+		}
+		close(wr.Done)
+	}
+}
+
+// wipe processes a WriteRequest with Wipe set, i.e. it deletes all metric
+// groups and removes the persistence file. Both happen while holding the
+// persistLock so that a concurrently running persist cannot resurrect the
+// wiped metrics.
+func (dms *DiskMetricStore) wipe(wr WriteRequest) {
+	dms.persistLock.Lock()
+	defer dms.persistLock.Unlock()
+
+	dms.processWriteRequest(wr)
+	if dms.persister == nil {
+		return
+	}
+	if err := dms.persister.Wipe(); err != nil {
+		level.Error(dms.logger).Log("msg", "could not remove persisted metrics after wipe", "err", err)
+		if wr.Done != nil {
+			wr.Done <- err
+		}
+	}
+}
+
+// removeExpired removes all metric families with a TTL that has elapsed at the
+// provided time. A group that contains no pushed metric families anymore after
+// the removal (i.e. only the push timestamp metrics are left) is removed
+// completely, unless the EmptyGroupPolicy is EmptyGroupKeep. removeExpired
+// returns true if anything has been removed.
+func (dms *DiskMetricStore) removeExpired(now time.Time) bool {
+	// Scan with the read lock first so that the common case of nothing
+	// having expired doesn't block readers.
+	if !dms.hasExpired(now) {
+		return false
+	}
+
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+
+	for key, group := range dms.metricGroups {
+		metrics := NameToTimestampedMetricFamilyMap{}
+		for name, tmf := range group.Metrics {
+			if !tmf.expired(now) {
+				metrics[name] = tmf
+			}
+		}
+		removed := len(group.Metrics) - len(metrics)
+		if removed == 0 {
+			continue
+		}
+		stored := group
+		group.Metrics = metrics
+		group.PayloadHash = ""
+		dms.metricGroups[key] = group
+		dms.countGroup(stored, group)
+		level.Debug(dms.logger).Log(append(
+			[]interface{}{"msg", "expired metric families removed", "count", removed},
+			groupLogFields(group.Labels)...,
+		)...)
+		if !hasPushedMetricFamilies(group) && dms.emptyGroups != EmptyGroupKeep {
+			delete(dms.metricGroups, key)
+			dms.countGroup(group, MetricGroup{})
+			dms.notifyRemoval(group, RemovalExpired, "", now)
+			level.Debug(dms.logger).Log(append(
+				[]interface{}{"msg", "expired metric group removed"},
+				groupLogFields(group.Labels)...,
+			)...)
+		}
+	}
+	return true
+}
+
+// applyRetention removes the metric groups exceeding the Retention at the
+// provided time. In contrast to the removal of expired metric families, the
+// removals are logged with the Persister (if any) like deletions, so that
+// evicted groups do not come back upon restart. applyRetention returns true if
+// anything has been removed.
+func (dms *DiskMetricStore) applyRetention(now time.Time) bool {
+	dms.lock.RLock()
+	retention := dms.retention
+	dms.lock.RUnlock()
+	if retention == (Retention{}) {
+		return false
+	}
+	// Only the store loop changes the groups, so the snapshot stays
+	// current until the evictions below.
+	evictions := retentionEvictions(dms.groupsSnapshot(), retention, now)
+	if len(evictions) == 0 {
+		return false
+	}
+
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+
+	for key, reason := range evictions {
+		group, ok := dms.metricGroups[key]
+		if !ok {
+			continue
+		}
+		dms.logWriteRequest(WriteRequest{Labels: group.Labels, Timestamp: now}, false)
+		delete(dms.metricGroups, key)
+		dms.countGroup(group, MetricGroup{})
+		dms.evictions.WithLabelValues(reason).Inc()
+		dms.notifyRemoval(group, RemovalEvicted, reason, now)
+		level.Debug(dms.logger).Log(append(
+			[]interface{}{"msg", "metric group evicted", "reason", reason},
+			groupLogFields(group.Labels)...,
+		)...)
+	}
+	return true
+}
+
+// retentionEvictions returns the grouping keys of the provided groups to be
+// removed according to retention at the provided time, mapped to the reason.
+func retentionEvictions(groups GroupingKeyToMetricGroup, retention Retention, now time.Time) map[string]string {
+	evictions := map[string]string{}
+	byJob := map[string][]string{}
+	for key, group := range groups {
+		if group.Locked {
+			continue
+		}
+		if last := group.LastPushTime(); retention.MaxAge > 0 && !last.IsZero() && now.Sub(last) > retention.MaxAge {
+			evictions[key] = evictedMaxAge
+			continue
+		}
+		job := group.Labels["job"]
+		byJob[job] = append(byJob[job], key)
+	}
+	if retention.MaxGroupsPerJob <= 0 {
+		return evictions
+	}
+	for _, keys := range byJob {
+		if len(keys) <= retention.MaxGroupsPerJob {
+			continue
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			ti, tj := groups[keys[i]].LastPushTime(), groups[keys[j]].LastPushTime()
+			if !ti.Equal(tj) {
+				return ti.Before(tj)
+			}
+			return keys[i] < keys[j]
+		})
+		for _, key := range keys[:len(keys)-retention.MaxGroupsPerJob] {
+			evictions[key] = evictedMaxGroupsPerJob
+		}
+	}
+	return evictions
+}
+
+// hasExpired returns true if there is at least one metric family with a TTL
+// that has elapsed at the provided time.
+func (dms *DiskMetricStore) hasExpired(now time.Time) bool {
+	for _, group := range dms.groupsSnapshot() {
+		for _, tmf := range group.Metrics {
+			if tmf.expired(now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupState returns if the group with the provided grouping labels exists and
+// if it is locked.
+func (dms *DiskMetricStore) groupState(labels map[string]string) (exists, locked bool) {
+	dms.lock.RLock()
+	defer dms.lock.RUnlock()
+
+	group, ok := dms.metricGroups[groupingKeyFor(labels)]
+	return ok, group.Locked
+}
+
+// groupLogFields returns key-value pairs identifying the group with the provided
+// grouping labels in log lines. The job and instance labels are included on
+// their own for easier filtering.
+func groupLogFields(labels map[string]string) []interface{} {
+	return []interface{}{
+		"job", labels["job"],
+		"instance", labels["instance"],
+		"group", fmt.Sprint(labels),
+	}
+}
+
+// hasLabels returns true if the provided metric has all of the provided label
+// pairs, where a missing label counts as a label with an empty value.
+func hasLabels(m *dto.Metric, labels map[string]string) bool {
+	for name, value := range labels {
+		v := ""
+		for _, lp := range m.GetLabel() {
+			if lp.GetName() == name {
+				v = lp.GetValue()
+				break
+			}
+		}
+		if v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPushedMetricFamilies returns true if the provided group contains any
+// metric families other than the automatically added push timestamp metrics.
+func hasPushedMetricFamilies(group MetricGroup) bool {
+	for name := range group.Metrics {
+		if name != pushMetricName && name != pushFailedMetricName {
+			return true
+		}
 	}
+	return false
 }
 
-func (dms *DiskMetricStore) setPushFailedTimestamp(wr WriteRequest) {
+// setPushFailedTimestamp records the failure of the provided WriteRequest with
+// the provided error (nil if unknown, e.g. when replaying) on its group.
+func (dms *DiskMetricStore) setPushFailedTimestamp(wr WriteRequest, err error) {
 	dms.lock.Lock()
 	defer dms.lock.Unlock()
 
+	dms.setPushFailedTimestampLocked(wr, err)
+}
+
+// setPushFailedTimestampLocked is setPushFailedTimestamp for callers already
+// holding the write lock.
+func (dms *DiskMetricStore) setPushFailedTimestampLocked(wr WriteRequest, err error) {
 	key := groupingKeyFor(wr.Labels)
 
 	group, ok := dms.metricGroups[key]
+	if !ok && dms.limits.MaxGroups > 0 && len(dms.metricGroups) >= dms.limits.MaxGroups {
+		// Do not exceed the limit just to record the failure.
+		return
+	}
+	if group.Locked || wr.Lock || wr.Unlock || wr.RenameTo != nil {
+		// A locked group is not changed at all, and failing to lock,
+		// unlock, or rename a group is not a failed push.
+		return
+	}
+
+	dms.logWriteRequest(wr, true)
+
+	stored := group
 	if !ok {
 		group = MetricGroup{
 			Labels:  wr.Labels,
 			Metrics: NameToTimestampedMetricFamilyMap{},
 		}
-		dms.metricGroups[key] = group
+	} else {
+		group.Metrics = copyMetrics(group.Metrics)
+	}
+	if wr.MetricFamilies != nil {
+		group.countPush(wr.Timestamp)
+		group.FailedPushes++
 	}
+	if err != nil {
+		group.LastPushError = err.Error()
+	}
+	dms.metricGroups[key] = group
 
 	group.Metrics[pushFailedMetricName] = TimestampedMetricFamily{
 		Timestamp:            wr.Timestamp,
@@ -331,112 +1652,486 @@ func (dms *DiskMetricStore) setPushFailedTimestamp(wr WriteRequest) {
 			GobbableMetricFamily: (*GobbableMetricFamily)(newPushTimestampGauge(wr.Labels, time.Time{})),
 		}
 	}
+	dms.countGroup(stored, group)
 }
 
-// checkWriteRequest return if applying the provided WriteRequest will result in
-// a consistent state of metrics. The dms is not modified by the check. However,
-// the WriteRequest _will_ be sanitized: the MetricFamilies are ensured to
-// contain the grouping Labels after the check. If false is returned, the
-// causing error is written to the Done channel of the WriteRequest.
+// checkWriteRequest returns nil if applying the provided WriteRequest will
+// result in a consistent state of metrics. The dms is not modified by the check.
+// However, the WriteRequest _will_ be sanitized: the MetricFamilies are ensured
+// to contain the grouping Labels after the check. Otherwise, the causing error
+// is returned and also written to the Done channel of the WriteRequest.
 //
 // Special case: If the WriteRequest has no Done channel set, the (expensive)
 // consistency check is skipped. The WriteRequest is still sanitized, and the
-// presence of timestamps still results in returning false.
-func (dms *DiskMetricStore) checkWriteRequest(wr WriteRequest) bool {
+// presence of timestamps still results in returning an error (unless the
+// WriteRequest allows timestamps).
+func (dms *DiskMetricStore) checkWriteRequest(wr WriteRequest) error {
+	err := dms.validateWriteRequest(wr)
+	// Without Done channel, don't do the expensive consistency check.
+	if err == nil && wr.Done != nil && pushesMetrics(wr) {
+		tdms := dms.testStore()
+		tdms.processWriteRequest(wr)
+		err = tdms.checkConsistency()
+	}
+	dms.reportRejection(wr, err)
+	return err
+}
+
+// validateWriteRequest does all the checks of checkWriteRequest except the
+// consistency check, and it does not report the returned error.
+func (dms *DiskMetricStore) validateWriteRequest(wr WriteRequest) error {
+	if wr.Groups != nil {
+		// Restoring replaces everything, so there is nothing to check.
+		return nil
+	}
+	exists, locked := dms.groupState(wr.Labels)
+	if wr.Lock || wr.Unlock {
+		if !exists {
+			return ErrGroupNotFound
+		}
+		return nil
+	}
+	if wr.RenameTo != nil {
+		switch {
+		case !exists:
+			return ErrGroupNotFound
+		case locked:
+			return ErrGroupLocked
+		case groupingKeyFor(wr.RenameTo) != groupingKeyFor(wr.Labels):
+			if exists, _ := dms.groupState(wr.RenameTo); exists {
+				return ErrGroupExists
+			}
+		}
+		return nil
+	}
 	if wr.MetricFamilies == nil {
 		// Delete request cannot create inconsistencies, and nothing has
 		// to be sanitized.
-		return true
+		return nil
 	}
 
-	var err error
-	defer func() {
-		if err != nil && wr.Done != nil {
-			wr.Done <- err
-		}
-	}()
-
-	if timestampsPresent(wr.MetricFamilies) {
-		err = errTimestamp
-		return false
+	if locked {
+		return ErrGroupLocked
+	}
+	if err := dms.checkSequence(wr); err != nil {
+		return err
+	}
+	if !wr.AllowTimestamps && timestampsPresent(wr.MetricFamilies) {
+		return errTimestamp
+	}
+	if err := checkAggregation(wr); err != nil {
+		return err
+	}
+	if err := checkAnnotations(wr.Annotations); err != nil {
+		return err
+	}
+	if err := dms.checkLimits(wr); err != nil {
+		return err
 	}
 	for _, mf := range wr.MetricFamilies {
 		sanitizeLabels(mf, wr.Labels)
 	}
+	if err := dms.checkLabelLimits(wr); err != nil {
+		return err
+	}
+	return dms.checkMergeable(wr)
+}
 
-	// Without Done channel, don't do the expensive consistency check.
-	if wr.Done == nil {
-		return true
+// pushesMetrics returns true if the provided WriteRequest pushes metric
+// families rather than restoring, locking, unlocking, renaming, or deleting.
+func pushesMetrics(wr WriteRequest) bool {
+	return wr.Groups == nil && !wr.Lock && !wr.Unlock && wr.RenameTo == nil && wr.MetricFamilies != nil
+}
+
+// reportRejection writes the provided error (if any) to the Done channel of the
+// provided WriteRequest or, if there is none, logs it.
+func (dms *DiskMetricStore) reportRejection(wr WriteRequest, err error) {
+	if err == nil {
+		return
 	}
+	if wr.Done != nil {
+		wr.Done <- err
+		return
+	}
+	// Nobody is waiting for the error, so at least log it.
+	level.Warn(dms.logger).Log(append(
+		[]interface{}{"msg", "write request rejected", "err", err},
+		groupLogFields(wr.Labels)...,
+	)...)
+}
+
+// testStore returns a DiskMetricStore acting on a snapshot of the metric groups
+// of dms to test WriteRequests with. As the groups are copy-on-write, the test
+// store cannot modify the groups of dms.
+func (dms *DiskMetricStore) testStore() *DiskMetricStore {
+	dms.lock.RLock()
+	defer dms.lock.RUnlock()
 
-	// Construct a test dms, acting on a copy of the metrics, to test the
-	// WriteRequest with.
 	tdms := &DiskMetricStore{
-		metricGroups:   dms.GetMetricFamiliesMap(),
+		metricGroups:   make(GroupingKeyToMetricGroup, len(dms.metricGroups)),
+		families:       dms.families,
+		samples:        dms.samples,
+		limits:         dms.limits,
 		predefinedHelp: dms.predefinedHelp,
 		logger:         log.NewNopLogger(),
 	}
-	tdms.processWriteRequest(wr)
+	for k, g := range dms.metricGroups {
+		tdms.metricGroups[k] = g
+	}
+	return tdms
+}
 
-	// Construct a test Gatherer to check if consistent gathering is possible.
+// checkConsistency returns an error if the metrics of dms (usually a test
+// store) cannot be gathered consistently together with the ones of the
+// prometheus.DefaultGatherer.
+func (dms *DiskMetricStore) checkConsistency() error {
 	tg := prometheus.Gatherers{
 		prometheus.DefaultGatherer,
 		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
-			return tdms.GetMetricFamilies(), nil
+			return dms.GetMetricFamilies(), nil
 		}),
 	}
-	if _, err = tg.Gather(); err != nil {
-		return false
+	_, err := tg.Gather()
+	return err
+}
+
+// ValidateWriteRequest implements the ValidatingMetricStore interface. As the
+// check does not go through the write queue, WriteRequests still waiting in the
+// queue are not taken into account.
+func (dms *DiskMetricStore) ValidateWriteRequest(wr WriteRequest) error {
+	// With a Done channel, the consistency check is done, too.
+	wr.Done = make(chan error, 1)
+	return dms.checkWriteRequest(wr)
+}
+
+// checkSequence returns a SequenceError if the provided WriteRequest has a
+// Sequence not greater than the one of its group.
+func (dms *DiskMetricStore) checkSequence(wr WriteRequest) error {
+	if wr.Sequence == 0 {
+		return nil
 	}
-	return true
+	dms.lock.RLock()
+	stored := dms.metricGroups[groupingKeyFor(wr.Labels)].Sequence
+	dms.lock.RUnlock()
+	if wr.Sequence <= stored {
+		return SequenceError{Sequence: wr.Sequence, Stored: stored}
+	}
+	return nil
+}
+
+// checkLimits returns a LimitError if applying the provided WriteRequest would
+// exceed the limits of the dms.
+func (dms *DiskMetricStore) checkLimits(wr WriteRequest) error {
+	dms.lock.RLock()
+	limits := dms.limits
+	group, ok := dms.metricGroups[groupingKeyFor(wr.Labels)]
+	groups := len(dms.metricGroups)
+	dms.lock.RUnlock()
+	if limits == (Limits{}) {
+		return nil
+	}
+	if !ok && limits.MaxGroups > 0 && groups >= limits.MaxGroups {
+		return LimitError{What: "metric groups", Value: groups + 1, Max: limits.MaxGroups}
+	}
+
+	// Number of samples per metric family in the group after the write.
+	samples := map[string]int{}
+	if !wr.Replace {
+		for name, tmf := range group.Metrics {
+			samples[name] = NumSamples(tmf.GetMetricFamily())
+		}
+	}
+	for name, mf := range wr.MetricFamilies {
+		if tmf, ok := group.Metrics[name]; ok && wr.Aggregation != AggregateNone && !wr.Replace {
+			mf = aggregateMetricFamily(tmf.GetMetricFamily(), mf, wr.Aggregation)
+		}
+		samples[name] = NumSamples(mf)
+	}
+	delete(samples, pushMetricName)
+	delete(samples, pushFailedMetricName)
+	if max := limits.MaxFamiliesPerGroup; max > 0 && len(samples) > max {
+		return LimitError{What: "metric families in the group", Value: len(samples), Max: max}
+	}
+
+	if max := limits.MaxSeriesPerGroup; max > 0 {
+		total := 0
+		for _, n := range samples {
+			total += n
+		}
+		if total > max && limits.Truncate && wr.Aggregation == AggregateNone {
+			total = truncateSeries(wr, group, samples, total, max)
+			level.Debug(dms.logger).Log(append([]interface{}{"msg", "dropped metrics exceeding the series limit"}, groupLogFields(wr.Labels)...)...)
+		}
+		if total > max {
+			return LimitError{What: "series in the group", Value: total, Max: max}
+		}
+	}
+
+	if max := limits.MaxSamples; max > 0 {
+		// Only the loop changes the groups, so the group is still the
+		// one counted in the stored samples.
+		total := dms.storedSamples() - group.NumSamples()
+		for _, n := range samples {
+			total += n
+		}
+		if total > max {
+			return LimitError{What: "samples", Value: total, Max: max}
+		}
+	}
+	return nil
+}
+
+// truncateSeries drops metrics from the MetricFamilies of the provided
+// WriteRequest until the group the WriteRequest is applied to has at most max
+// samples (or no pushed metrics are left), updating the provided samples per
+// metric family and returning the new total. Metric families left without
+// metrics are removed from the WriteRequest.
+func truncateSeries(wr WriteRequest, group MetricGroup, samples map[string]int, total, max int) int {
+	names := make([]string, 0, len(wr.MetricFamilies))
+	for name := range wr.MetricFamilies {
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		mf := wr.MetricFamilies[name]
+		for total > max && len(mf.Metric) > 0 {
+			last := mf.Metric[len(mf.Metric)-1]
+			mf.Metric = mf.Metric[:len(mf.Metric)-1]
+			n := NumSamples(&dto.MetricFamily{Metric: []*dto.Metric{last}})
+			samples[name] -= n
+			total -= n
+		}
+		if len(mf.Metric) == 0 {
+			// Without the pushed metric family, the stored one
+			// is kept, unless it is replaced anyway.
+			delete(wr.MetricFamilies, name)
+			delete(samples, name)
+			if tmf, ok := group.Metrics[name]; ok && !wr.Replace {
+				samples[name] = NumSamples(tmf.GetMetricFamily())
+				total += samples[name]
+			}
+		}
+		if total <= max {
+			break
+		}
+	}
+	return total
+}
+
+// checkLabelLimits returns a LimitError if a metric in the provided
+// WriteRequest exceeds the label limits of the dms, or truncates the metric if
+// the Limits say so. The labels must have been sanitized already.
+func (dms *DiskMetricStore) checkLabelLimits(wr WriteRequest) error {
+	dms.lock.RLock()
+	limits := dms.limits
+	dms.lock.RUnlock()
+	maxLen, maxLabels := limits.MaxLabelValueLength, limits.MaxLabelsPerMetric
+	if maxLen <= 0 && maxLabels <= 0 {
+		return nil
+	}
+	isGrouping := func(name string) bool {
+		_, ok := wr.Labels[name]
+		return ok || name == string(model.InstanceLabel)
+	}
+	if maxLen > 0 {
+		for name, value := range wr.Labels {
+			if len(value) > maxLen {
+				return LimitError{What: fmt.Sprintf("bytes in the value of grouping label %q", name), Value: len(value), Max: maxLen}
+			}
+		}
+	}
+	truncated := false
+	for name, mf := range wr.MetricFamilies {
+		for _, m := range mf.Metric {
+			if maxLabels > 0 && len(m.Label) > maxLabels {
+				if !limits.Truncate {
+					return LimitError{What: fmt.Sprintf("labels on a metric of family %q", name), Value: len(m.Label), Max: maxLabels}
+				}
+				// Drop the last labels other than grouping labels.
+				drop := len(m.Label) - maxLabels
+				kept := make([]*dto.LabelPair, 0, maxLabels)
+				for i := len(m.Label) - 1; i >= 0; i-- {
+					if drop > 0 && !isGrouping(m.Label[i].GetName()) {
+						drop--
+						continue
+					}
+					kept = append(kept, m.Label[i])
+				}
+				for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+					kept[i], kept[j] = kept[j], kept[i]
+				}
+				m.Label = kept
+				if len(m.Label) > maxLabels {
+					return LimitError{What: fmt.Sprintf("labels on a metric of family %q", name), Value: len(m.Label), Max: maxLabels}
+				}
+				truncated = true
+			}
+			for _, lp := range m.Label {
+				if maxLen <= 0 || len(lp.GetValue()) <= maxLen {
+					continue
+				}
+				if !limits.Truncate {
+					return LimitError{What: fmt.Sprintf("bytes in the value of label %q", lp.GetName()), Value: len(lp.GetValue()), Max: maxLen}
+				}
+				lp.Value = proto.String(truncateUTF8(lp.GetValue(), maxLen))
+				truncated = true
+			}
+		}
+	}
+	if truncated {
+		level.Debug(dms.logger).Log(append([]interface{}{"msg", "truncated labels exceeding the label limits"}, groupLogFields(wr.Labels)...)...)
+	}
+	return nil
+}
+
+// truncateUTF8 returns the longest prefix of s of at most max bytes that does
+// not split a UTF-8 encoded rune.
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
 }
 
 func (dms *DiskMetricStore) persist() error {
 	// Check (again) if persistence is configured because some code paths
 	// will call this method even if it is not.
-	if dms.persistenceFile == "" {
+	if dms.persister == nil {
 		return nil
 	}
-	f, err := ioutil.TempFile(
-		path.Dir(dms.persistenceFile),
-		path.Base(dms.persistenceFile)+".in_progress.",
-	)
-	if err != nil {
-		return err
-	}
-	inProgressFileName := f.Name()
-	e := gob.NewEncoder(f)
+	dms.persistLock.Lock()
+	defer dms.persistLock.Unlock()
 
+	_, span := tracing.Start(context.Background(), "persist", tracing.SpanKindInternal)
+	defer span.End()
+	start := time.Now()
+	// All changes marked as unpersisted so far are covered, as they have
+	// been applied before the read lock below can be taken.
+	dms.statusMtx.Lock()
+	covered := dms.unpersistedSince
+	dms.persistingSince, dms.unpersistedSince = covered, time.Time{}
+	dms.statusMtx.Unlock()
+	// Holding the read lock excludes logging of changes, so that the
+	// persisted state reflects exactly the changes logged so far.
 	dms.lock.RLock()
-	err = e.Encode(dms.metricGroups)
+	span.SetAttribute("pushgateway.groups", len(dms.metricGroups))
+	err := dms.persister.Persist(dms.metricGroups)
 	dms.lock.RUnlock()
+	span.SetError(err)
+	now := time.Now()
+	dms.persistDuration.Observe(now.Sub(start).Seconds())
+	dms.statusMtx.Lock()
+	dms.lastPersistErr = err
+	dms.lastPersistTime, dms.lastPersistDuration = now, now.Sub(start)
+	if err == nil {
+		dms.lastPersistSuccessTime = now
+	} else if dms.unpersistedSince.IsZero() || covered.Before(dms.unpersistedSince) {
+		// The covered changes are still unpersisted.
+		dms.unpersistedSince = covered
+	}
+	dms.persistingSince = time.Time{}
+	lagWarning := dms.persistLagWarning
+	dms.statusMtx.Unlock()
+	if lag := now.Sub(covered); !covered.IsZero() && lagWarning > 0 && lag > lagWarning {
+		level.Warn(dms.logger).Log(
+			"msg", "persisting lags behind, changes are at risk of getting lost upon a crash",
+			"lag", lag, "duration", now.Sub(start), "threshold", lagWarning, "err", err,
+		)
+	}
 	if err != nil {
-		f.Close()
-		os.Remove(inProgressFileName)
+		dms.persistErrors.Inc()
 		return err
 	}
-	if err := f.Close(); err != nil {
-		os.Remove(inProgressFileName)
-		return err
+	dms.lastPersistSuccess.SetToCurrentTime()
+	return nil
+}
+
+// persistRun records when the store loop's persisting started and finished.
+type persistRun struct {
+	started, finished time.Time
+}
+
+// markUnpersisted records that the metric store has been changed at the
+// provided time. It must only be called after the change has been applied.
+func (dms *DiskMetricStore) markUnpersisted(t time.Time) {
+	if dms.persister == nil {
+		return
+	}
+	dms.statusMtx.Lock()
+	defer dms.statusMtx.Unlock()
+	if dms.unpersistedSince.IsZero() {
+		dms.unpersistedSince = t
+	}
+}
+
+// persistenceLag returns how long before now the oldest change has been
+// applied that has not been persisted yet, or zero if there is none.
+func (dms *DiskMetricStore) persistenceLag(now time.Time) time.Duration {
+	dms.statusMtx.Lock()
+	defer dms.statusMtx.Unlock()
+	oldest := dms.persistingSince
+	if oldest.IsZero() || (!dms.unpersistedSince.IsZero() && dms.unpersistedSince.Before(oldest)) {
+		oldest = dms.unpersistedSince
 	}
-	return os.Rename(inProgressFileName, dms.persistenceFile)
+	if oldest.IsZero() {
+		return 0
+	}
+	return now.Sub(oldest)
 }
 
+// restore loads the persisted metric groups and replays the logged changes on
+// top of them. If anything has been replayed, or if the Persister asks for it,
+// the state is persisted right away. If the Persister has restored metric
+// families lazily, persisting would load all of them first, so it is left to
+// the loop in order not to delay the start-up.
 func (dms *DiskMetricStore) restore() error {
-	if dms.persistenceFile == "" {
+	if dms.persister == nil {
 		return nil
 	}
-	f, err := os.Open(dms.persistenceFile)
-	if os.IsNotExist(err) {
-		return nil
+	_, span := tracing.Start(context.Background(), "restore", tracing.SpanKindInternal)
+	// Even if the persisted state cannot be read, replay the logged
+	// changes to recover as much as possible.
+	groups, dirty, restoreErr := dms.persister.Restore()
+	if restoreErr == nil {
+		dms.metricGroups = groups
+		dms.recount()
+	}
+	dms.replaying = true
+	replayed, err := dms.persister.Replay(func(wr WriteRequest, pushFailed bool) {
+		if pushFailed {
+			dms.setPushFailedTimestamp(wr, nil)
+			return
+		}
+		dms.processWriteRequest(wr)
+	})
+	dms.replaying = false
+	if replayed > 0 {
+		// The replayed pushes have been received before the restart.
+		for key, group := range dms.metricGroups {
+			group.LastPushDuration = 0
+			dms.metricGroups[key] = group
+		}
+	}
+	span.SetAttribute("pushgateway.groups", len(dms.metricGroups))
+	span.SetAttribute("pushgateway.replayed", replayed)
+	if err == nil {
+		err = restoreErr
 	}
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	d := gob.NewDecoder(f)
-	if err := d.Decode(&dms.metricGroups); err != nil {
-		return err
+	if dirty || replayed > 0 {
+		if lr, ok := dms.persister.(lazyRestorer); ok && lr.restoredLazily() {
+			dms.markUnpersisted(time.Now())
+			dms.persistOnStart = true
+			return nil
+		}
+		return dms.persist()
 	}
 	return nil
 }
@@ -524,6 +2219,79 @@ func newTimestampGauge(name, help string, groupingLabels map[string]string, t ti
 	return mf
 }
 
+// AnnotationsInfo returns an info metric family with one metric per group that
+// has annotations, labeled with the grouping labels and the annotations. An
+// annotation with the same name as a grouping label (or the instance label) is
+// left out. If no group has annotations, nil is returned.
+func AnnotationsInfo(groups GroupingKeyToMetricGroup) *dto.MetricFamily {
+	keys := make([]string, 0, len(groups))
+	for key, group := range groups {
+		if len(group.Annotations) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	result := &dto.MetricFamily{
+		Name: proto.String(annotationsMetricName),
+		Help: proto.String(annotationsMetricHelp),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, key := range keys {
+		group := groups[key]
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+		for name, value := range group.Annotations {
+			if _, ok := group.Labels[name]; !ok && name != string(model.InstanceLabel) {
+				m.Label = append(m.Label, &dto.LabelPair{
+					Name:  proto.String(name),
+					Value: proto.String(value),
+				})
+			}
+		}
+		mf := &dto.MetricFamily{Metric: []*dto.Metric{m}}
+		sanitizeLabels(mf, group.Labels)
+		result.Metric = append(result.Metric, m)
+	}
+	return result
+}
+
+// PushOverdue returns a gauge metric family with one metric per group that has
+// an ExpectedInterval, labeled with the grouping labels, with a value of 1 if
+// the group is overdue at the provided time (see MetricGroup.Overdue) and 0
+// otherwise. If no group has an ExpectedInterval, nil is returned.
+func PushOverdue(groups GroupingKeyToMetricGroup, now time.Time) *dto.MetricFamily {
+	keys := make([]string, 0, len(groups))
+	for key, group := range groups {
+		if group.ExpectedInterval > 0 {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	result := &dto.MetricFamily{
+		Name: proto.String(overdueMetricName),
+		Help: proto.String(overdueMetricHelp),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, key := range keys {
+		group := groups[key]
+		v := 0.
+		if group.Overdue(now) {
+			v = 1
+		}
+		mf := &dto.MetricFamily{Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(v)}}}}
+		sanitizeLabels(mf, group.Labels)
+		result.Metric = append(result.Metric, mf.Metric[0])
+	}
+	return result
+}
+
 // sanitizeLabels ensures that all the labels in groupingLabels and the
 // `instance` label are present in the MetricFamily. The label values from
 // groupingLabels are set in each Metric, no matter what. After that, if the
@@ -574,6 +2342,260 @@ metric:
 	}
 }
 
+// checkAggregation returns an error if the provided WriteRequest has an
+// Aggregation set but contains metric families that cannot be aggregated.
+func checkAggregation(wr WriteRequest) error {
+	switch wr.Aggregation {
+	case AggregateNone:
+		return nil
+	case AggregateSum, AggregateMax:
+	default:
+		return fmt.Errorf("unknown aggregation %q", wr.Aggregation)
+	}
+	for name, mf := range wr.MetricFamilies {
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER, dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		case dto.MetricType_HISTOGRAM, dto.MetricType_SUMMARY:
+			if wr.Aggregation != AggregateSum {
+				return fmt.Errorf("metric family %q of type %s can only be aggregated with %q", name, mf.GetType(), AggregateSum)
+			}
+		default:
+			return fmt.Errorf("metric family %q of type %s cannot be aggregated", name, mf.GetType())
+		}
+	}
+	return nil
+}
+
+// checkMergeable returns an error if any pushed histogram or summary in the
+// provided WriteRequest cannot be merged with the stored one of the same label
+// set, i.e. if the histograms have different buckets or the summaries have
+// different quantiles. It has to be called after the labels of the pushed
+// metric families have been sanitized.
+func (dms *DiskMetricStore) checkMergeable(wr WriteRequest) error {
+	if wr.Aggregation == AggregateNone || wr.Replace {
+		return nil
+	}
+	dms.lock.RLock()
+	group := dms.metricGroups[groupingKeyFor(wr.Labels)]
+	dms.lock.RUnlock()
+	for name, mf := range wr.MetricFamilies {
+		tmf, ok := group.Metrics[name]
+		if !ok {
+			continue
+		}
+		stored := tmf.GetMetricFamily()
+		if stored.GetType() != mf.GetType() {
+			continue
+		}
+		metrics := make(map[uint64]*dto.Metric, len(stored.GetMetric()))
+		for _, m := range stored.GetMetric() {
+			metrics[labelPairsSignature(m.GetLabel())] = m
+		}
+		for _, m := range mf.GetMetric() {
+			old, ok := metrics[labelPairsSignature(m.GetLabel())]
+			if !ok {
+				continue
+			}
+			var err error
+			switch mf.GetType() {
+			case dto.MetricType_HISTOGRAM:
+				_, err = mergeHistograms(old.GetHistogram(), m.GetHistogram())
+			case dto.MetricType_SUMMARY:
+				_, err = mergeSummaries(old.GetSummary(), m.GetSummary())
+			}
+			if err != nil {
+				return fmt.Errorf("metric family %q cannot be aggregated: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkAnnotations returns an error if any of the provided annotation names is
+// not a valid label name.
+func checkAnnotations(annotations map[string]string) error {
+	for name := range annotations {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid annotation name %q", name)
+		}
+	}
+	return nil
+}
+
+// aggregateMetricFamily returns a new MetricFamily combining the pushed with the
+// stored samples according to the provided Aggregation. Pushed samples with the
+// same label set as a stored sample are combined with it, all other samples are
+// taken over as they are. Histograms and summaries are merged (see
+// mergeHistograms and mergeSummaries). If they cannot be merged, the pushed one
+// replaces the stored one. If the types do not match, the pushed MetricFamily is
+// returned unchanged. Neither of the provided MetricFamilies is modified.
+func aggregateMetricFamily(stored, pushed *dto.MetricFamily, agg Aggregation) *dto.MetricFamily {
+	if stored == nil || stored.GetType() != pushed.GetType() {
+		return pushed
+	}
+	result := &dto.MetricFamily{
+		Name:   pushed.Name,
+		Help:   pushed.Help,
+		Type:   pushed.Type,
+		Metric: make([]*dto.Metric, 0, len(stored.GetMetric())+len(pushed.GetMetric())),
+	}
+	indexes := make(map[uint64]int, len(stored.GetMetric()))
+	for _, m := range stored.GetMetric() {
+		indexes[labelPairsSignature(m.GetLabel())] = len(result.Metric)
+		result.Metric = append(result.Metric, m)
+	}
+	for _, m := range pushed.GetMetric() {
+		i, ok := indexes[labelPairsSignature(m.GetLabel())]
+		if !ok {
+			result.Metric = append(result.Metric, m)
+			continue
+		}
+		old := result.Metric[i]
+		merged := &dto.Metric{Label: m.Label, TimestampMs: m.TimestampMs}
+		switch {
+		case m.Histogram != nil:
+			h, err := mergeHistograms(old.GetHistogram(), m.Histogram)
+			if err != nil {
+				result.Metric[i] = m
+				continue
+			}
+			merged.Histogram = h
+			result.Metric[i] = merged
+			continue
+		case m.Summary != nil:
+			s, err := mergeSummaries(old.GetSummary(), m.Summary)
+			if err != nil {
+				result.Metric[i] = m
+				continue
+			}
+			merged.Summary = s
+			result.Metric[i] = merged
+			continue
+		}
+		v := aggregateValues(metricValue(old), metricValue(m), agg)
+		switch {
+		case m.Counter != nil:
+			merged.Counter = &dto.Counter{Value: proto.Float64(v)}
+		case m.Gauge != nil:
+			merged.Gauge = &dto.Gauge{Value: proto.Float64(v)}
+		default:
+			merged.Untyped = &dto.Untyped{Value: proto.Float64(v)}
+		}
+		result.Metric[i] = merged
+	}
+	return result
+}
+
+// mergeHistograms returns a new Histogram with the sample counts, the sample
+// sums, and the bucket counts of both provided Histograms added up, or an error
+// if the Histograms do not have the same bucket upper bounds. Exemplars of the
+// pushed Histogram take precedence.
+func mergeHistograms(stored, pushed *dto.Histogram) (*dto.Histogram, error) {
+	if stored == nil {
+		return nil, errors.New("stored metric is not a histogram")
+	}
+	if len(stored.GetBucket()) != len(pushed.GetBucket()) {
+		return nil, fmt.Errorf("histograms have different numbers of buckets (%d and %d)", len(stored.GetBucket()), len(pushed.GetBucket()))
+	}
+	merged := &dto.Histogram{
+		SampleCount: proto.Uint64(stored.GetSampleCount() + pushed.GetSampleCount()),
+		SampleSum:   proto.Float64(stored.GetSampleSum() + pushed.GetSampleSum()),
+		Bucket:      make([]*dto.Bucket, len(pushed.GetBucket())),
+	}
+	for i, b := range pushed.GetBucket() {
+		sb := stored.GetBucket()[i]
+		if sb.GetUpperBound() != b.GetUpperBound() {
+			return nil, fmt.Errorf("histograms have different bucket upper bounds (%g and %g)", sb.GetUpperBound(), b.GetUpperBound())
+		}
+		exemplar := b.Exemplar
+		if exemplar == nil {
+			exemplar = sb.Exemplar
+		}
+		merged.Bucket[i] = &dto.Bucket{
+			UpperBound:      b.UpperBound,
+			CumulativeCount: proto.Uint64(sb.GetCumulativeCount() + b.GetCumulativeCount()),
+			Exemplar:        exemplar,
+		}
+	}
+	return merged, nil
+}
+
+// mergeSummaries returns a new Summary with the sample counts and the sample
+// sums of both provided Summaries added up, or an error if the Summaries do not
+// have the same quantiles. As quantiles cannot be merged exactly, each merged
+// quantile value is the average of both values, weighted by the sample counts.
+func mergeSummaries(stored, pushed *dto.Summary) (*dto.Summary, error) {
+	if stored == nil {
+		return nil, errors.New("stored metric is not a summary")
+	}
+	if len(stored.GetQuantile()) != len(pushed.GetQuantile()) {
+		return nil, fmt.Errorf("summaries have different numbers of quantiles (%d and %d)", len(stored.GetQuantile()), len(pushed.GetQuantile()))
+	}
+	storedCount, pushedCount := float64(stored.GetSampleCount()), float64(pushed.GetSampleCount())
+	merged := &dto.Summary{
+		SampleCount: proto.Uint64(stored.GetSampleCount() + pushed.GetSampleCount()),
+		SampleSum:   proto.Float64(stored.GetSampleSum() + pushed.GetSampleSum()),
+		Quantile:    make([]*dto.Quantile, len(pushed.GetQuantile())),
+	}
+	for i, q := range pushed.GetQuantile() {
+		sq := stored.GetQuantile()[i]
+		if sq.GetQuantile() != q.GetQuantile() {
+			return nil, fmt.Errorf("summaries have different quantiles (%g and %g)", sq.GetQuantile(), q.GetQuantile())
+		}
+		v := q.GetValue()
+		if storedCount+pushedCount > 0 {
+			v = (sq.GetValue()*storedCount + q.GetValue()*pushedCount) / (storedCount + pushedCount)
+		}
+		merged.Quantile[i] = &dto.Quantile{Quantile: q.Quantile, Value: proto.Float64(v)}
+	}
+	return merged, nil
+}
+
+func aggregateValues(stored, pushed float64, agg Aggregation) float64 {
+	if agg == AggregateMax {
+		return math.Max(stored, pushed)
+	}
+	return stored + pushed
+}
+
+// metricValue returns the value of a counter, gauge, or untyped Metric.
+func metricValue(m *dto.Metric) float64 {
+	switch {
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	default:
+		return m.Untyped.GetValue()
+	}
+}
+
+func labelPairsSignature(lps []*dto.LabelPair) uint64 {
+	labels := make(map[string]string, len(lps))
+	for _, lp := range lps {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	return model.LabelsToSignature(labels)
+}
+
+// NumSamples returns the number of samples in the exposition of the provided
+// metric family, counting each bucket or quantile as well as the sum and the
+// count of histograms and summaries.
+func NumSamples(mf *dto.MetricFamily) int {
+	n := 0
+	for _, m := range mf.GetMetric() {
+		switch {
+		case m.Histogram != nil:
+			n += len(m.Histogram.GetBucket()) + 2
+		case m.Summary != nil:
+			n += len(m.Summary.GetQuantile()) + 2
+		default:
+			n++
+		}
+	}
+	return n
+}
+
 // Checks if any timestamps have been specified.
 func timestampsPresent(metricFamilies map[string]*dto.MetricFamily) bool {
 	for _, mf := range metricFamilies {
@@ -14,12 +14,16 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
+	"reflect"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -30,6 +34,7 @@ import (
 
 	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/pushgateway/internal/codec"
 	"github.com/prometheus/pushgateway/testutil"
 )
 
@@ -648,6 +653,25 @@ func TestGetMetricFamilies(t *testing.T) {
 	if err := checkMetricFamilies(dms, mf1acd, mf2, mf3, mf4); err != nil {
 		t.Error(err)
 	}
+
+	// The result is sorted and thus reproducible.
+	first := dms.GetMetricFamilies()
+	for i := 0; i < 10; i++ {
+		mfs := dms.GetMetricFamilies()
+		for j, mf := range mfs {
+			if j > 0 && mfs[j-1].GetName() >= mf.GetName() {
+				t.Errorf("Metric families not sorted: %q before %q.", mfs[j-1].GetName(), mf.GetName())
+			}
+			for k := 1; k < len(mf.Metric); k++ {
+				if labelsLess(mf.Metric[k].Label, mf.Metric[k-1].Label) {
+					t.Errorf("Metrics of metric family %q not sorted: %v", mf.GetName(), mf.Metric)
+				}
+			}
+			if !proto.Equal(first[j], mf) {
+				t.Errorf("Metric family %q differs between calls.", mf.GetName())
+			}
+		}
+	}
 }
 
 func TestAddDeletePersistRestore(t *testing.T) {
@@ -986,9 +1010,479 @@ func TestRejectTimestamps(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Now allow timestamps explicitly.
+	ts2 := ts1.Add(time.Second)
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:          grouping1,
+		Timestamp:       ts2,
+		MetricFamilies:  testutil.MetricFamiliesMap(mf1ts),
+		AllowTimestamps: true,
+		Done:            errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	pushTimestamp = newPushTimestampGauge(grouping1, ts2)
+	if err := checkMetricFamilies(
+		dms,
+		mf1ts, pushTimestamp, pushFailedTimestamp,
+	); err != nil {
+		t.Error(err)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	dms := NewPersistentMetricStore(nil, time.Hour, Limits{
+		MaxGroups:           2,
+		MaxFamiliesPerGroup: 2,
+		MaxSamples:          4,
+	}, WriteQueueOptions{}, nil, logger)
+
+	grouping1 := map[string]string{"job": "job1"}
+	grouping2 := map[string]string{"job": "job2"}
+	grouping3 := map[string]string{"job": "job3"}
+
+	scenarios := []struct {
+		name      string
+		wr        WriteRequest
+		exceeding string // Empty if no limit is exceeded.
+	}{
+		{
+			name: "first push",
+			wr: WriteRequest{
+				Labels:         grouping1,
+				MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+			},
+		},
+		{
+			name: "too many families",
+			wr: WriteRequest{
+				Labels:         grouping1,
+				MetricFamilies: testutil.MetricFamiliesMap(mf3),
+			},
+			exceeding: "metric families in the group",
+		},
+		{
+			name: "replacing families",
+			wr: WriteRequest{
+				Labels:         grouping1,
+				MetricFamilies: testutil.MetricFamiliesMap(mf3),
+				Replace:        true,
+			},
+		},
+		{
+			name: "second group",
+			wr: WriteRequest{
+				Labels:         grouping2,
+				MetricFamilies: testutil.MetricFamiliesMap(mf2),
+			},
+		},
+		{
+			name: "too many groups",
+			wr: WriteRequest{
+				Labels:         grouping3,
+				MetricFamilies: testutil.MetricFamiliesMap(mf4),
+			},
+			exceeding: "metric groups",
+		},
+		{
+			name: "too many samples",
+			wr: WriteRequest{
+				Labels:         grouping1,
+				MetricFamilies: testutil.MetricFamiliesMap(mf1be),
+			},
+			exceeding: "samples",
+		},
+		{
+			name: "deletion",
+			wr: WriteRequest{
+				Labels: grouping2,
+			},
+		},
+		{
+			name: "samples available again",
+			wr: WriteRequest{
+				Labels:         grouping1,
+				MetricFamilies: testutil.MetricFamiliesMap(mf1be),
+			},
+		},
+	}
+
+	for _, s := range scenarios {
+		s.wr.Timestamp = time.Now()
+		errCh := make(chan error, 1)
+		s.wr.Done = errCh
+		dms.SubmitWriteRequest(s.wr)
+		var err error
+		for err = range errCh {
+			if s.exceeding == "" {
+				t.Errorf("%s: Unexpected error: %v", s.name, err)
+				continue
+			}
+			limitErr, ok := err.(LimitError)
+			if !ok {
+				t.Errorf("%s: Wanted LimitError, got %v.", s.name, err)
+				continue
+			}
+			if expected, got := s.exceeding, limitErr.What; expected != got {
+				t.Errorf("%s: Wanted exceeded limit %q, got %q.", s.name, expected, got)
+			}
+		}
+		if err == nil && s.exceeding != "" {
+			t.Errorf("%s: Expected error.", s.name)
+		}
+	}
+
+	if expected, got := 1, len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d metric groups, got %d.", expected, got)
+	}
+	// The rejected push into a new group has not created that group, not
+	// even for the push failure timestamp.
+	if _, ok := dms.GetMetricFamiliesMap()[groupingKeyFor(grouping3)]; ok {
+		t.Error("Unexpected group for rejected push.")
+	}
+
+	// Lifted limits apply to the next push.
+	dms.SetLimits(Limits{})
+	submit(t, dms, WriteRequest{
+		Labels:         grouping3,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+		Timestamp:      time.Now(),
+	})
+	if _, ok := dms.GetMetricFamiliesMap()[groupingKeyFor(grouping3)]; !ok {
+		t.Error("Wanted group after lifting the limits.")
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunningCounts(t *testing.T) {
+	dms := NewPersistentMetricStore(nil, time.Hour, Limits{}, WriteQueueOptions{}, nil, logger)
+	// Counting the samples from scratch must give the running counts.
+	check := func(name string) {
+		dms.lock.RLock()
+		families, samples := dms.families, dms.samples
+		dms.lock.RUnlock()
+		dms.lock.Lock()
+		dms.recount()
+		dms.lock.Unlock()
+		if expected, got := dms.families, families; expected != got {
+			t.Errorf("%s: Wanted %d metric families, got %d.", name, expected, got)
+		}
+		if expected, got := dms.storedSamples(), samples; expected != got {
+			t.Errorf("%s: Wanted %d samples, got %d.", name, expected, got)
+		}
+	}
+
+	grouping1 := map[string]string{"job": "job1"}
+	grouping2 := map[string]string{"job": "job2"}
+	now := time.Now()
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      now,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+	})
+	submit(t, dms, WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      now,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		TTL:            time.Minute,
+	})
+	check("pushes")
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      now,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1be),
+		Aggregation:    AggregateSum,
+	})
+	check("aggregating push")
+	submit(t, dms, WriteRequest{
+		Labels:      grouping1,
+		Timestamp:   now,
+		MetricNames: []string{"mf2"},
+	})
+	check("deleted metric family")
+	if !dms.removeExpired(now.Add(time.Hour)) {
+		t.Fatal("Expected expired metric families.")
+	}
+	check("expiry")
+	submit(t, dms, WriteRequest{Labels: grouping1, Timestamp: now})
+	check("deleted group")
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLabelLimits(t *testing.T) {
+	dms := NewPersistentMetricStore(nil, time.Hour, Limits{
+		MaxSeriesPerGroup:   3,
+		MaxLabelsPerMetric:  3,
+		MaxLabelValueLength: 4,
+	}, WriteQueueOptions{}, nil, logger)
+
+	// gauge returns a gauge family named "g" with one metric per label set.
+	gauge := func(labelSets ...[]string) map[string]*dto.MetricFamily {
+		mf := &dto.MetricFamily{Name: proto.String("g"), Type: dto.MetricType_GAUGE.Enum()}
+		for _, ls := range labelSets {
+			m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+			for i := 0; i < len(ls); i += 2 {
+				m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(ls[i]), Value: proto.String(ls[i+1])})
+			}
+			mf.Metric = append(mf.Metric, m)
+		}
+		return map[string]*dto.MetricFamily{"g": mf}
+	}
+	grouping := map[string]string{"job": "job1"}
+	scenarios := []struct {
+		name      string
+		wr        WriteRequest
+		exceeding string
+	}{
+		{
+			name:      "too many labels",
+			wr:        WriteRequest{Labels: grouping, MetricFamilies: gauge([]string{"a", "1", "b", "2"})},
+			exceeding: `labels on a metric of family "g"`,
+		},
+		{
+			name:      "label value too long",
+			wr:        WriteRequest{Labels: grouping, MetricFamilies: gauge([]string{"a", "12345"})},
+			exceeding: `bytes in the value of label "a"`,
+		},
+		{
+			name:      "grouping label value too long",
+			wr:        WriteRequest{Labels: map[string]string{"job": "job12"}, MetricFamilies: gauge([]string{"a", "1"})},
+			exceeding: `bytes in the value of grouping label "job"`,
+		},
+		{
+			name:      "too many series",
+			wr:        WriteRequest{Labels: grouping, MetricFamilies: gauge([]string{"a", "1"}, []string{"a", "2"}, []string{"a", "3"}, []string{"a", "4"})},
+			exceeding: "series in the group",
+		},
+	}
+	for _, s := range scenarios {
+		s.wr.Timestamp = time.Now()
+		errCh := make(chan error, 1)
+		s.wr.Done = errCh
+		dms.SubmitWriteRequest(s.wr)
+		var err error
+		for err = range errCh {
+			limitErr, ok := err.(LimitError)
+			if !ok {
+				t.Errorf("%s: Wanted LimitError, got %v.", s.name, err)
+				continue
+			}
+			if expected, got := s.exceeding, limitErr.What; expected != got {
+				t.Errorf("%s: Wanted exceeded limit %q, got %q.", s.name, expected, got)
+			}
+		}
+		if err == nil {
+			t.Errorf("%s: Expected error.", s.name)
+		}
+	}
+
+	// With truncation, the offenders are truncated instead, but grouping
+	// labels are kept.
+	dms.SetLimits(Limits{
+		MaxSeriesPerGroup:   3,
+		MaxLabelsPerMetric:  3,
+		MaxLabelValueLength: 4,
+		Truncate:            true,
+	})
+	labels := func() []string {
+		var result []string
+		for _, m := range dms.GetMetricFamiliesMap()[groupingKeyFor(grouping)].Metrics["g"].GetMetricFamily().GetMetric() {
+			var pairs []string
+			for _, lp := range m.GetLabel() {
+				pairs = append(pairs, lp.GetName()+"="+lp.GetValue())
+			}
+			result = append(result, strings.Join(pairs, ","))
+		}
+		return result
+	}
+	for _, s := range []struct {
+		name     string
+		mfs      map[string]*dto.MetricFamily
+		expected []string
+	}{
+		{
+			name:     "too many labels",
+			mfs:      gauge([]string{"a", "1", "b", "2"}),
+			expected: []string{"a=1,instance=,job=job1"},
+		},
+		{
+			name:     "label value too long",
+			mfs:      gauge([]string{"a", "12345"}, []string{"a", "abc\u00e9"}),
+			expected: []string{"a=1234,instance=,job=job1", "a=abc,instance=,job=job1"},
+		},
+		{
+			name:     "too many series",
+			mfs:      gauge([]string{"a", "1"}, []string{"a", "2"}, []string{"a", "3"}, []string{"a", "4"}),
+			expected: []string{"a=1,instance=,job=job1", "a=2,instance=,job=job1", "a=3,instance=,job=job1"},
+		},
+	} {
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{Labels: grouping, Timestamp: time.Now(), MetricFamilies: s.mfs, Done: errCh})
+		for err := range errCh {
+			t.Errorf("%s: Unexpected error: %v", s.name, err)
+		}
+		if expected, got := s.expected, labels(); !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: Wanted metrics %v, got %v.", s.name, expected, got)
+		}
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteQueueTimeout(t *testing.T) {
+	timeout := 20 * time.Millisecond
+	dms := NewPersistentMetricStore(nil, time.Hour, Limits{}, WriteQueueOptions{
+		Capacity: 2,
+		Timeout:  timeout,
+	}, nil, logger)
+
+	// Block processing of write requests by holding the lock.
+	dms.lock.Lock()
+	var err error
+	start := time.Now()
+	for i := 0; i < 4 && err == nil; i++ {
+		err = dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1"},
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		})
+	}
+	if expected, got := ErrWriteQueueFull, err; expected != got {
+		t.Errorf("Wanted error %v, got %v.", expected, got)
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("Submitting gave up after %v, before the timeout of %v.", elapsed, timeout)
+	}
+	dms.lock.Unlock()
+
+	// Once the queue has drained, submitting works again.
+	errCh := make(chan error, 1)
+	if err := dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Done:           errCh,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStuckWriteQueue(t *testing.T) {
+	// No loop is running, so nothing is taken from the queue.
+	dms := &DiskMetricStore{
+		writeQueue:   make(chan WriteRequest, 2),
+		lastDequeued: time.Now(),
+		logger:       logger,
+	}
+	if err := dms.Healthy(); err != nil {
+		t.Error("Unexpected error for empty queue:", err)
+	}
+	dms.writeQueue <- WriteRequest{}
+	if err := dms.Healthy(); err != nil {
+		t.Error("Unexpected error for recently processed queue:", err)
+	}
+	dms.lastDequeued = time.Now().Add(-2 * stuckQueueTimeout)
+	if err := dms.Healthy(); err == nil {
+		t.Error("Expected error for stuck queue.")
+	}
+	if err := dms.Ready(); err == nil {
+		t.Error("Expected stuck queue to make the store unready, too.")
+	}
+}
+
+func TestDrainWriteQueue(t *testing.T) {
+	dms := NewDiskMetricStore("", time.Hour, nil, logger)
+
+	ts1 := time.Now()
+	ts2 := ts1.Add(time.Second)
+	grouping1 := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+	grouping2 := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+	})
+	submit(t, dms, WriteRequest{
+		Labels:    grouping1,
+		Timestamp: ts1,
+		Lock:      true,
+	})
 	if err := dms.Shutdown(); err != nil {
 		t.Fatal(err)
 	}
+
+	// The loop has stopped, so the queued WriteRequests are only processed
+	// by draining the queue, which has to check them like the loop does.
+	lockedCh := make(chan error, 1)
+	dms.writeQueue <- WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+		Done:           lockedCh,
+	}
+	timestampCh := make(chan error, 1)
+	dms.writeQueue <- WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1ts),
+		Done:           timestampCh,
+	}
+	flushCh := make(chan error, 1)
+	dms.writeQueue <- WriteRequest{Flush: true, Done: flushCh}
+	if err := dms.drainWriteQueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []struct {
+		name string
+		done chan error
+		want error
+	}{
+		{"locked", lockedCh, ErrGroupLocked},
+		{"timestamp", timestampCh, errTimestamp},
+		{"flush", flushCh, nil},
+	} {
+		var errs []error
+		for err := range s.done {
+			errs = append(errs, err)
+		}
+		if s.want == nil && len(errs) > 0 || s.want != nil && (len(errs) != 1 || errs[0] != s.want) {
+			t.Errorf("%s: Wanted error %v, got %v.", s.name, s.want, errs)
+		}
+	}
+	groups := dms.GetMetricFamiliesMap()
+	if _, ok := groups[groupingKeyFor(grouping1)].Metrics[mf4.GetName()]; ok {
+		t.Error("Push to locked group has been applied.")
+	}
+	if expected, got := 1, groups[groupingKeyFor(grouping2)].FailedPushes; expected != got {
+		t.Errorf("Wanted %d failed pushes, got %d.", expected, got)
+	}
 }
 
 func TestRejectInconsistentPush(t *testing.T) {
@@ -1287,65 +1781,1698 @@ func TestReplace(t *testing.T) {
 	}
 }
 
-func TestGetMetricFamiliesMap(t *testing.T) {
-	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestGetMetricFamiliesMap.")
-	if err != nil {
-		t.Fatal(err)
-	}
-	defer os.RemoveAll(tempDir)
-	fileName := path.Join(tempDir, "persistence")
-
-	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, nil, logger)
+func TestExpiration(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
 
-	labels1 := map[string]string{
+	ts1 := time.Now()
+	grouping1 := map[string]string{
 		"job":      "job1",
-		"instance": "instance1",
+		"instance": "instance2",
 	}
-
-	labels2 := map[string]string{
+	grouping2 := map[string]string{
 		"job":      "job1",
-		"instance": "instance2",
+		"instance": "instance1",
 	}
-
-	gk1 := groupingKeyFor(labels1)
-	gk2 := groupingKeyFor(labels2)
-
-	// Submit a single simple metric family.
-	ts1 := time.Now()
 	errCh := make(chan error, 1)
 	dms.SubmitWriteRequest(WriteRequest{
-		Labels:         labels1,
+		Labels:         grouping1,
 		Timestamp:      ts1,
-		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a),
+		TTL:            time.Hour,
 		Done:           errCh,
 	})
 	for err := range errCh {
 		t.Fatal("Unexpected error:", err)
 	}
-	pushTimestamp := newPushTimestampGauge(labels1, ts1)
-	pushFailedTimestamp := newPushFailedTimestampGauge(labels1, time.Time{})
-	if err := checkMetricFamilies(
-		dms, mf3,
-		pushTimestamp, pushFailedTimestamp,
-	); err != nil {
-		t.Error(err)
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		TTL:            30 * time.Minute,
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
 	}
-
-	// Submit two metric families for a different instance.
+	// Push mf2 without TTL into the first group.
 	ts2 := ts1.Add(time.Second)
 	errCh = make(chan error, 1)
 	dms.SubmitWriteRequest(WriteRequest{
-		Labels:         labels2,
+		Labels:         grouping1,
 		Timestamp:      ts2,
-		MetricFamilies: testutil.MetricFamiliesMap(mf1b, mf2),
+		MetricFamilies: testutil.MetricFamiliesMap(mf2),
 		Done:           errCh,
 	})
 	for err := range errCh {
 		t.Fatal("Unexpected error:", err)
 	}
 
-	// expectedMFMap is a multi-layered map that maps the labelset
-	// fingerprints to the corresponding metric family string
+	mfMap := dms.GetMetricFamiliesMap()
+	if expected, got := ts1.Add(time.Hour), mfMap[groupingKeyFor(grouping1)].Metrics["mf1"].Expiration(); !expected.Equal(got) {
+		t.Errorf("Wanted expiration %v, got %v.", expected, got)
+	}
+	if got := mfMap[groupingKeyFor(grouping1)].Metrics["mf2"].Expiration(); !got.IsZero() {
+		t.Errorf("Wanted no expiration, got %v.", got)
+	}
+	if got := mfMap[groupingKeyFor(grouping1)].Metrics[pushMetricName].Expiration(); !got.IsZero() {
+		t.Errorf("Wanted no expiration for push timestamp, got %v.", got)
+	}
+
+	if dms.removeExpired(ts1.Add(time.Minute)) {
+		t.Error("Expected nothing to expire.")
+	}
+
+	// The second group expires completely.
+	if !dms.removeExpired(ts1.Add(45 * time.Minute)) {
+		t.Error("Expected metric families to expire.")
+	}
+	pushTimestamp := newPushTimestampGauge(grouping1, ts2)
+	pushFailedTimestamp := newPushFailedTimestampGauge(grouping1, time.Time{})
+	if err := checkMetricFamilies(
+		dms, mf1a, mf2,
+		pushTimestamp, pushFailedTimestamp,
+	); err != nil {
+		t.Error(err)
+	}
+
+	// Only mf1 expires in the first group, mf2 keeps the group alive.
+	if !dms.removeExpired(ts1.Add(2 * time.Hour)) {
+		t.Error("Expected metric families to expire.")
+	}
+	if err := checkMetricFamilies(
+		dms, mf2,
+		pushTimestamp, pushFailedTimestamp,
+	); err != nil {
+		t.Error(err)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+
+	ts := time.Now()
+	if dms.applyRetention(ts) {
+		t.Error("Expected nothing to be evicted without retention.")
+	}
+	dms.SetRetention(Retention{MaxGroupsPerJob: 2, MaxAge: time.Hour})
+
+	grouping := func(job, instance string) map[string]string {
+		return map[string]string{"job": job, "instance": instance}
+	}
+	for i, g := range []map[string]string{
+		grouping("job1", "instance1"),
+		grouping("job1", "instance2"),
+		grouping("job1", "instance3"),
+		grouping("job2", "instance1"),
+		grouping("job2", "instance2"),
+	} {
+		submit(t, dms, WriteRequest{
+			Labels:         g,
+			Timestamp:      ts.Add(time.Duration(i) * time.Second),
+			MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		})
+	}
+	submit(t, dms, WriteRequest{Labels: grouping("job2", "instance2"), Timestamp: ts, Lock: true})
+
+	groups := func() []string {
+		var keys []string
+		for _, group := range dms.GetMetricFamiliesMap() {
+			keys = append(keys, group.Labels["job"]+"/"+group.Labels["instance"])
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	evictions := func(reason string) float64 {
+		m := &dto.Metric{}
+		if err := dms.evictions.WithLabelValues(reason).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	// The oldest group of job1 is evicted. (The store loop might do it
+	// first, so the result is not checked.)
+	dms.applyRetention(ts.Add(time.Minute))
+	if expected, got := []string{"job1/instance2", "job1/instance3", "job2/instance1", "job2/instance2"}, groups(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted groups %v, got %v.", expected, got)
+	}
+	if dms.applyRetention(ts.Add(time.Minute)) {
+		t.Error("Expected nothing to be evicted.")
+	}
+
+	// Everything but the locked group gets too old.
+	if !dms.applyRetention(ts.Add(2 * time.Hour)) {
+		t.Error("Expected groups to be evicted.")
+	}
+	if expected, got := []string{"job2/instance2"}, groups(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted groups %v, got %v.", expected, got)
+	}
+	if expected, got := 1., evictions(evictedMaxGroupsPerJob); expected != got {
+		t.Errorf("Wanted %v evictions for exceeding the groups per job, got %v.", expected, got)
+	}
+	if expected, got := 3., evictions(evictedMaxAge); expected != got {
+		t.Errorf("Wanted %v evictions for exceeding the age, got %v.", expected, got)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemovalHook(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+
+	var (
+		mtx      sync.Mutex
+		removals []GroupRemoval
+	)
+	dms.SetRemovalHook(func(gr GroupRemoval) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		removals = append(removals, gr)
+	})
+
+	ts := time.Now()
+	grouping := func(instance string) map[string]string {
+		return map[string]string{"job": "job1", "instance": instance}
+	}
+	submit(t, dms, WriteRequest{Labels: grouping("expiring"), Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(mf3), TTL: time.Minute})
+	submit(t, dms, WriteRequest{Labels: grouping("old"), Timestamp: ts.Add(-2 * time.Hour), MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	submit(t, dms, WriteRequest{Labels: grouping("deleted"), Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	submit(t, dms, WriteRequest{Labels: grouping("partly"), Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(mf2, mf3)})
+
+	submit(t, dms, WriteRequest{Labels: grouping("deleted"), Timestamp: ts})
+	// Deleting a group that does not exist is not a removal.
+	submit(t, dms, WriteRequest{Labels: grouping("missing"), Timestamp: ts})
+	// Only deleting the last pushed metric family removes the group.
+	submit(t, dms, WriteRequest{Labels: grouping("partly"), Timestamp: ts, MetricNames: []string{"mf2"}})
+	submit(t, dms, WriteRequest{Labels: grouping("partly"), Timestamp: ts, MetricNames: []string{"mf3"}})
+	dms.removeExpired(ts.Add(2 * time.Minute))
+	dms.SetRetention(Retention{MaxAge: time.Hour})
+	dms.applyRetention(ts)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	got := map[string]GroupRemoval{}
+	for _, gr := range removals {
+		got[gr.Labels["instance"]] = gr
+	}
+	if expected, got := 4, len(removals); expected != got {
+		t.Errorf("Wanted %d removals, got %d: %v", expected, got, removals)
+	}
+	for instance, expected := range map[string][2]string{
+		"deleted":  {RemovalDeleted, ""},
+		"partly":   {RemovalDeleted, ""},
+		"expiring": {RemovalExpired, ""},
+		"old":      {RemovalEvicted, evictedMaxAge},
+	} {
+		gr, ok := got[instance]
+		if !ok {
+			t.Errorf("%s: Removal missing.", instance)
+			continue
+		}
+		if gr.Event != expected[0] || gr.Reason != expected[1] {
+			t.Errorf("%s: Wanted event %q with reason %q, got %q with reason %q.", instance, expected[0], expected[1], gr.Event, gr.Reason)
+		}
+	}
+	if expected, got := ts.Add(-2*time.Hour).Unix(), got["old"].LastPushTime.Unix(); expected != got {
+		t.Errorf("Wanted last push time %v, got %v.", expected, got)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestAggregation.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts1 := time.Now()
+	ts2 := ts1.Add(time.Second)
+	grouping1 := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a),
+	})
+	// mf1 is summed up, mf2 is new and simply stored.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1b, mf2),
+		Aggregation:    AggregateSum,
+	})
+	// The stored value is larger, so nothing changes.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a),
+		Aggregation:    AggregateMax,
+	})
+	// Summaries cannot be aggregated with max.
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf5),
+		Aggregation:    AggregateMax,
+		Done:           errCh,
+	})
+	err = nil
+	for err = range errCh {
+	}
+	if err == nil {
+		t.Error("Expected error aggregating a summary with max.")
+	}
+
+	mf1sum := proto.Clone(mf1a).(*dto.MetricFamily)
+	mf1sum.Metric[0].Untyped.Value = proto.Float64(-3e3 + 42)
+	// The failed push has to be reflected, too.
+	pushTimestamp := newPushTimestampGauge(grouping1, ts2)
+	pushFailedTimestamp := newPushFailedTimestampGauge(grouping1, ts2)
+	if err := checkMetricFamilies(
+		dms, mf1sum, mf2,
+		pushTimestamp, pushFailedTimestamp,
+	); err != nil {
+		t.Error(err)
+	}
+	// Replaying the WAL aggregates again.
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	if err := checkMetricFamilies(
+		dms2, mf1sum, mf2,
+		pushTimestamp, pushFailedTimestamp,
+	); err != nil {
+		t.Error(err)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregateHistogramsAndSummaries(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	grouping := map[string]string{"job": "job1"}
+	labels := []*dto.LabelPair{
+		{Name: proto.String("instance"), Value: proto.String("")},
+		{Name: proto.String("job"), Value: proto.String("job1")},
+	}
+	histogram := func(count, sum float64, bounds ...float64) *dto.MetricFamily {
+		h := &dto.Histogram{SampleCount: proto.Uint64(uint64(count)), SampleSum: proto.Float64(sum)}
+		for i, b := range bounds {
+			h.Bucket = append(h.Bucket, &dto.Bucket{
+				UpperBound:      proto.Float64(b),
+				CumulativeCount: proto.Uint64(uint64(count) * uint64(i+1) / uint64(len(bounds))),
+			})
+		}
+		return &dto.MetricFamily{
+			Name:   proto.String("h"),
+			Type:   dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Label: labels, Histogram: h}},
+		}
+	}
+	summary := func(count, sum, median float64) *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("s"),
+			Type: dto.MetricType_SUMMARY.Enum(),
+			Metric: []*dto.Metric{{Label: labels, Summary: &dto.Summary{
+				SampleCount: proto.Uint64(uint64(count)),
+				SampleSum:   proto.Float64(sum),
+				Quantile:    []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(median)}},
+			}}},
+		}
+	}
+	push := func(mfs ...*dto.MetricFamily) error {
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         grouping,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(mfs...),
+			Aggregation:    AggregateSum,
+			Done:           errCh,
+		})
+		var err error
+		for err = range errCh {
+		}
+		return err
+	}
+
+	if err := push(histogram(4, 10, 1, 2), summary(2, 4, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := push(histogram(8, 30, 1, 2), summary(6, 18, 3)); err != nil {
+		t.Fatal(err)
+	}
+	// Incompatible buckets or quantiles are rejected.
+	if err := push(histogram(2, 1, 1, 5)); err == nil {
+		t.Error("Expected error merging histograms with different buckets.")
+	}
+	if err := push(histogram(2, 1, 1, 2, 5)); err == nil {
+		t.Error("Expected error merging histograms with different numbers of buckets.")
+	}
+	incompatible := summary(1, 1, 1)
+	incompatible.Metric[0].Summary.Quantile[0].Quantile = proto.Float64(0.9)
+	if err := push(incompatible); err == nil {
+		t.Error("Expected error merging summaries with different quantiles.")
+	}
+
+	group, ok := dms.GetMetricGroup(grouping)
+	if !ok {
+		t.Fatal("Group not found.")
+	}
+	if expected, got := histogram(12, 40, 1, 2), group.Metrics["h"].GetMetricFamily(); !proto.Equal(expected, got) {
+		t.Errorf("Wanted merged histogram %s, got %s.", expected, got)
+	}
+	// The quantiles are weighted by the sample counts: (1*2 + 3*6) / 8 = 2.5
+	if expected, got := summary(8, 22, 2.5), group.Metrics["s"].GetMetricFamily(); !proto.Equal(expected, got) {
+		t.Errorf("Wanted merged summary %s, got %s.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteMetricFamilies(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+
+	ts := time.Now()
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// Deleting the push timestamp is ignored, unknown names are a no-op.
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:      grouping,
+		Timestamp:   ts.Add(time.Second),
+		MetricNames: []string{"mf1", pushMetricName, "unknown"},
+		Done:        errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := checkMetricFamilies(
+		dms, mf2,
+		newPushTimestampGauge(grouping, ts),
+		newPushFailedTimestampGauge(grouping, time.Time{}),
+	); err != nil {
+		t.Error(err)
+	}
+
+	// Deleting the last pushed metric family deletes the group.
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:      grouping,
+		Timestamp:   ts.Add(2 * time.Second),
+		MetricNames: []string{"mf2"},
+		Done:        errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepEmptyGroups(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	dms.SetEmptyGroupPolicy(EmptyGroupKeep)
+
+	ts := time.Now()
+	deleted := map[string]string{"job": "job1", "instance": "deleted"}
+	expired := map[string]string{"job": "job1", "instance": "expired"}
+	submit(t, dms, WriteRequest{Labels: deleted, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(mf2)})
+	submit(t, dms, WriteRequest{Labels: expired, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(mf3), TTL: time.Minute})
+
+	// Both groups are kept with their push timestamps.
+	submit(t, dms, WriteRequest{Labels: deleted, Timestamp: ts.Add(time.Second), MetricNames: []string{"mf2"}})
+	if !dms.removeExpired(ts.Add(time.Hour)) {
+		t.Error("Expected metric families to expire.")
+	}
+	if err := checkMetricFamilyGroups(dms, map[string]map[string]string{
+		groupingKeyFor(deleted): {
+			pushMetricName:       newPushTimestampGauge(deleted, ts).String(),
+			pushFailedMetricName: newPushFailedTimestampGauge(deleted, time.Time{}).String(),
+		},
+		groupingKeyFor(expired): {
+			pushMetricName:       newPushTimestampGauge(expired, ts).String(),
+			pushFailedMetricName: newPushFailedTimestampGauge(expired, time.Time{}).String(),
+		},
+	}); err != nil {
+		t.Error(err)
+	}
+
+	// Deleting a group as a whole still removes it.
+	submit(t, dms, WriteRequest{Labels: deleted, Timestamp: ts.Add(2 * time.Second)})
+	if expected, got := 1, len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d group, got %d.", expected, got)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteMetrics(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestDeleteMetrics.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts := time.Now()
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+	})
+
+	// Only the metric of mf2 with labelname="val2" has that label.
+	submit(t, dms, WriteRequest{
+		Labels:       grouping,
+		Timestamp:    ts.Add(time.Second),
+		MetricLabels: map[string]string{"labelname": "val2"},
+	})
+	mf2val1 := proto.Clone(mf2).(*dto.MetricFamily)
+	mf2val1.Metric = mf2val1.Metric[1:]
+	if err := checkMetricFamilies(
+		dms, mf1a, mf2val1,
+		newPushTimestampGauge(grouping, ts),
+		newPushFailedTimestampGauge(grouping, time.Time{}),
+	); err != nil {
+		t.Error(err)
+	}
+
+	// A missing label counts as empty, the remaining metric of mf2 is
+	// deleted, and mf2 with it, but not mf1.
+	submit(t, dms, WriteRequest{
+		Labels:       grouping,
+		Timestamp:    ts.Add(2 * time.Second),
+		MetricNames:  []string{"mf2"},
+		MetricLabels: map[string]string{"basename": ""},
+	})
+	check := func(dms *DiskMetricStore) {
+		if err := checkMetricFamilies(
+			dms, mf1a,
+			newPushTimestampGauge(grouping, ts),
+			newPushFailedTimestampGauge(grouping, time.Time{}),
+		); err != nil {
+			t.Error(err)
+		}
+	}
+	check(dms)
+	// The stored metric family has not been modified.
+	if expected, got := 2, len(mf2.Metric); expected != got {
+		t.Errorf("Wanted %d metrics in mf2, got %d.", expected, got)
+	}
+
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	check(dms2)
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestWipe.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts1 := time.Now()
+	for _, grouping := range []map[string]string{
+		{"job": "job1", "instance": "instance1"},
+		{"job": "job1", "instance": "instance2"},
+	} {
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         grouping,
+			Timestamp:      ts1,
+			MetricFamilies: testutil.MetricFamiliesMap(mf3),
+			Done:           errCh,
+		})
+		for err := range errCh {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(fileName); err != nil {
+		t.Fatal("Persistence file not written:", err)
+	}
+
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Timestamp: ts1.Add(time.Second),
+		Wipe:      true,
+		Done:      errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Error("Expected persistence file to be removed, got:", err)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	// The final persist on shutdown must not resurrect anything.
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if err := checkMetricFamilies(dms); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestLock.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts1 := time.Now()
+	ts2 := ts1.Add(time.Second)
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+	key := groupingKeyFor(grouping)
+
+	// Locking a group that does not exist fails.
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:    grouping,
+		Timestamp: ts1,
+		Lock:      true,
+		Done:      errCh,
+	})
+	if expected, got := ErrGroupNotFound, <-errCh; expected != got {
+		t.Errorf("Wanted error %v, got %v.", expected, got)
+	}
+	if expected, got := 0, len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+	})
+	submit(t, dms, WriteRequest{
+		Labels:    grouping,
+		Timestamp: ts1,
+		Lock:      true,
+	})
+	if !dms.GetMetricFamiliesMap()[key].Locked {
+		t.Error("Expected group to be locked.")
+	}
+
+	// Pushes to the locked group are rejected without recording a failed
+	// push.
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+		Done:           errCh,
+	})
+	if expected, got := ErrGroupLocked, <-errCh; expected != got {
+		t.Errorf("Wanted error %v, got %v.", expected, got)
+	}
+	expectedMFs := []*dto.MetricFamily{
+		mf3,
+		newPushTimestampGauge(grouping, ts1),
+		newPushFailedTimestampGauge(grouping, time.Time{}),
+	}
+	if err := checkMetricFamilies(dms, expectedMFs...); err != nil {
+		t.Error(err)
+	}
+
+	// The lock survives a crash (via the WAL) and a clean restart (via the
+	// snapshot).
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	if !dms2.GetMetricFamiliesMap()[key].Locked {
+		t.Error("Expected group to be locked after replaying the WAL.")
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if !dms.GetMetricFamiliesMap()[key].Locked {
+		t.Error("Expected group to be locked after restart.")
+	}
+
+	// After unlocking, pushes are accepted again.
+	submit(t, dms, WriteRequest{
+		Labels:    grouping,
+		Timestamp: ts2,
+		Unlock:    true,
+	})
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	if dms.GetMetricFamiliesMap()[key].Locked {
+		t.Error("Expected group to be unlocked.")
+	}
+	if err := checkMetricFamilies(
+		dms, mf3,
+		newPushTimestampGauge(grouping, ts2),
+		newPushFailedTimestampGauge(grouping, time.Time{}),
+	); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestRename.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts1 := time.Now()
+	from := map[string]string{"job": "job1", "instance": "instance1"}
+	to := map[string]string{"job": "job3"}
+	other := map[string]string{"job": "job2"}
+	rename := func(from, to map[string]string) error {
+		errCh := make(chan error, 1)
+		if err := dms.SubmitWriteRequest(WriteRequest{
+			Labels:    from,
+			Timestamp: time.Now(),
+			RenameTo:  to,
+			Done:      errCh,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return <-errCh
+	}
+
+	if expected, got := ErrGroupNotFound, rename(from, to); expected != got {
+		t.Errorf("Wanted error %v, got %v.", expected, got)
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         from,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Annotations:    map[string]string{"build": "1"},
+	})
+	submit(t, dms, WriteRequest{
+		Labels:         other,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+	})
+	if expected, got := ErrGroupExists, rename(from, other); expected != got {
+		t.Errorf("Wanted error %v, got %v.", expected, got)
+	}
+	// Neither failure is recorded as a failed push.
+	for _, labels := range []map[string]string{from, other} {
+		if !dms.GetMetricFamiliesMap()[groupingKeyFor(labels)].LastPushSuccess() {
+			t.Errorf("Failed push recorded for group %v.", labels)
+		}
+	}
+
+	if err := rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+	check := func(dms *DiskMetricStore) {
+		t.Helper()
+		groups := dms.GetMetricFamiliesMap()
+		if _, ok := groups[groupingKeyFor(from)]; ok {
+			t.Error("Renamed group still exists.")
+		}
+		group, ok := groups[groupingKeyFor(to)]
+		if !ok {
+			t.Fatal("Renamed group not found.")
+		}
+		if expected, got := "1", group.Annotations["build"]; expected != got {
+			t.Errorf("Wanted annotation %q, got %q.", expected, got)
+		}
+		if d := group.LastPushTime().Sub(ts1); d < -time.Millisecond || d > time.Millisecond {
+			t.Errorf("Wanted push time %v, got %v.", ts1, group.LastPushTime())
+		}
+		for name, tmf := range group.Metrics {
+			for _, m := range tmf.GetMetricFamily().GetMetric() {
+				labels := map[string]string{}
+				for _, lp := range m.GetLabel() {
+					labels[lp.GetName()] = lp.GetValue()
+				}
+				if labels["job"] != "job3" || labels["instance"] != "" {
+					t.Errorf("Unexpected labels %v of metric family %s.", labels, name)
+				}
+			}
+		}
+	}
+	check(dms)
+
+	// The rename survives a crash.
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	check(dms2)
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Locked groups cannot be renamed.
+	submit(t, dms, WriteRequest{Labels: to, Timestamp: ts1, Lock: true})
+	if expected, got := ErrGroupLocked, rename(to, from); expected != got {
+		t.Errorf("Wanted error %v, got %v.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestAnnotations.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts := time.Now()
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+	key := groupingKeyFor(grouping)
+	annotations := func() map[string]string {
+		return dms.GetMetricFamiliesMap()[key].Annotations
+	}
+
+	// Invalid annotation names are rejected.
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Annotations:    map[string]string{"build-id": "1"},
+		Done:           errCh,
+	})
+	if err := <-errCh; err == nil {
+		t.Error("Expected error for invalid annotation name.")
+	}
+
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Annotations:    map[string]string{"build": "1", "branch": "main"},
+	})
+	stored := annotations()
+	// A POST merges, and an empty value removes an annotation.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+		Annotations:    map[string]string{"build": "2", "branch": "", "run": "7"},
+	})
+	if expected, got := map[string]string{"build": "2", "run": "7"}, annotations(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted annotations %v, got %v.", expected, got)
+	}
+	if expected, got := map[string]string{"build": "1", "branch": "main"}, stored; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Previously returned annotations modified, got %v.", got)
+	}
+	// A push without annotations leaves them alone.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+	})
+	if expected, got := map[string]string{"build": "2", "run": "7"}, annotations(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted annotations %v, got %v.", expected, got)
+	}
+
+	// Annotations survive a crash (via the WAL) and a clean restart (via
+	// the snapshot).
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	if expected, got := map[string]string{"build": "2", "run": "7"}, dms2.GetMetricFamiliesMap()[key].Annotations; !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted annotations %v after replaying the WAL, got %v.", expected, got)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if expected, got := map[string]string{"build": "2", "run": "7"}, annotations(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted annotations %v after restart, got %v.", expected, got)
+	}
+
+	mf := AnnotationsInfo(dms.GetMetricFamiliesMap())
+	if mf == nil {
+		t.Fatal("No annotations info metric family.")
+	}
+	if expected, got := `label:<name:"build" value:"2" > label:<name:"instance" value:"instance1" > label:<name:"job" value:"job1" > label:<name:"run" value:"7" > gauge:<value:1 > `, proto.CompactTextString(mf.Metric[0]); len(mf.Metric) != 1 || expected != got {
+		t.Errorf("Wanted annotations info metric %s, got %v.", expected, mf.Metric)
+	}
+
+	// A PUT replaces all annotations.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Replace:        true,
+	})
+	if got := annotations(); got != nil {
+		t.Errorf("Wanted no annotations, got %v.", got)
+	}
+	if mf := AnnotationsInfo(dms.GetMetricFamiliesMap()); mf != nil {
+		t.Errorf("Wanted no annotations info metric family, got %v.", mf)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushOverdue(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPushOverdue.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts := time.Now()
+	grouping := map[string]string{"job": "job1"}
+	key := groupingKeyFor(grouping)
+	if mf := PushOverdue(dms.GetMetricFamiliesMap(), ts); mf != nil {
+		t.Errorf("Wanted no push overdue metric family, got %v.", mf)
+	}
+
+	submit(t, dms, WriteRequest{
+		Labels:           grouping,
+		Timestamp:        ts,
+		MetricFamilies:   testutil.MetricFamiliesMap(mf3),
+		ExpectedInterval: time.Hour,
+	})
+	// A push without an expected interval leaves it alone.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+	})
+	group := dms.GetMetricFamiliesMap()[key]
+	if expected, got := time.Hour, group.ExpectedInterval; expected != got {
+		t.Errorf("Wanted expected interval %v, got %v.", expected, got)
+	}
+	for _, s := range []struct {
+		now      time.Time
+		expected string
+	}{
+		{ts.Add(time.Minute), `label:<name:"instance" value:"" > label:<name:"job" value:"job1" > gauge:<value:0 > `},
+		{ts.Add(2 * time.Hour), `label:<name:"instance" value:"" > label:<name:"job" value:"job1" > gauge:<value:1 > `},
+	} {
+		mf := PushOverdue(dms.GetMetricFamiliesMap(), s.now)
+		if mf == nil {
+			t.Fatal("No push overdue metric family.")
+		}
+		if got := proto.CompactTextString(mf.Metric[0]); len(mf.Metric) != 1 || s.expected != got {
+			t.Errorf("At %v: Wanted push overdue metric %s, got %v.", s.now, s.expected, mf.Metric)
+		}
+	}
+
+	// The expected interval survives a crash (via the WAL) and a clean
+	// restart (via the snapshot).
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	if expected, got := time.Hour, dms2.GetMetricFamiliesMap()[key].ExpectedInterval; expected != got {
+		t.Errorf("Wanted expected interval %v after replaying the WAL, got %v.", expected, got)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if expected, got := time.Hour, dms.GetMetricFamiliesMap()[key].ExpectedInterval; expected != got {
+		t.Errorf("Wanted expected interval %v after restart, got %v.", expected, got)
+	}
+
+	// A PUT replaces the expected interval.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Replace:        true,
+	})
+	if mf := PushOverdue(dms.GetMetricFamiliesMap(), ts.Add(2*time.Hour)); mf != nil {
+		t.Errorf("Wanted no push overdue metric family, got %v.", mf)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushFormat(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPushFormat.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	grouping := map[string]string{"job": "job1"}
+	key := groupingKeyFor(grouping)
+	pf := PushFormat{
+		ContentType:     "application/openmetrics-text; version=1.0.0",
+		ContentEncoding: "gzip",
+		Format:          codec.OpenMetrics,
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		PushFormat:     pf,
+	})
+	if expected, got := pf, dms.GetMetricFamiliesMap()[key].PushFormat; expected != got {
+		t.Errorf("Wanted push format %v, got %v.", expected, got)
+	}
+
+	// The push format survives a crash (via the WAL) and a clean restart
+	// (via the snapshot).
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	if expected, got := pf, dms2.GetMetricFamiliesMap()[key].PushFormat; expected != got {
+		t.Errorf("Wanted push format %v after replaying the WAL, got %v.", expected, got)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if expected, got := pf, dms.GetMetricFamiliesMap()[key].PushFormat; expected != got {
+		t.Errorf("Wanted push format %v after restart, got %v.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushSequence(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPushSequence.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	grouping := map[string]string{"job": "job1"}
+	key := groupingKeyFor(grouping)
+	push := func(seq uint64, mf *dto.MetricFamily) error {
+		errCh := make(chan error, 1)
+		dms.SubmitWriteRequest(WriteRequest{
+			Labels:         grouping,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(mf),
+			Replace:        true,
+			Sequence:       seq,
+			Done:           errCh,
+		})
+		return <-errCh
+	}
+	pushed := func() string {
+		group := dms.GetMetricFamiliesMap()[key]
+		if _, ok := group.Metrics["mf3"]; ok {
+			return "mf3"
+		}
+		return "mf4"
+	}
+
+	if err := push(2, mf3); err != nil {
+		t.Fatal(err)
+	}
+	// An older and a retried push are both rejected.
+	for _, seq := range []uint64{1, 2} {
+		if expected, got := error(SequenceError{Sequence: seq, Stored: 2}), push(seq, mf4); expected != got {
+			t.Errorf("Wanted error %v, got %v.", expected, got)
+		}
+		if expected, got := "mf3", pushed(); expected != got {
+			t.Errorf("Wanted %s after out-of-order push, got %s.", expected, got)
+		}
+	}
+	// A push without a sequence number is not checked and keeps the
+	// stored one.
+	if err := push(0, mf4); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(2), dms.GetMetricFamiliesMap()[key].Sequence; expected != got {
+		t.Errorf("Wanted sequence %d, got %d.", expected, got)
+	}
+	if err := push(5, mf3); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "mf3", pushed(); expected != got {
+		t.Errorf("Wanted %s, got %s.", expected, got)
+	}
+
+	// The sequence survives a crash (via the WAL) and a clean restart (via
+	// the snapshot).
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	if expected, got := uint64(5), dms2.GetMetricFamiliesMap()[key].Sequence; expected != got {
+		t.Errorf("Wanted sequence %d after replaying the WAL, got %d.", expected, got)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if expected, got := uint64(5), dms.GetMetricFamiliesMap()[key].Sequence; expected != got {
+		t.Errorf("Wanted sequence %d after restart, got %d.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayloadHash(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestPayloadHash.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts := time.Now()
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+	payloadHash := func() string {
+		group, ok := dms.GetMetricGroup(grouping)
+		if !ok {
+			t.Fatal("Group not found.")
+		}
+		return group.PayloadHash
+	}
+
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		PayloadHash:    "a",
+	})
+	if expected, got := "a", payloadHash(); expected != got {
+		t.Errorf("Wanted payload hash %q, got %q.", expected, got)
+	}
+	// Merged with another metric family, the group is not the result of a
+	// single push anymore.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+		PayloadHash:    "b",
+	})
+	if got := payloadHash(); got != "" {
+		t.Errorf("Wanted no payload hash, got %q.", got)
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3, mf4),
+		PayloadHash:    "c",
+		Annotations:    map[string]string{"build": "1"},
+	})
+	if expected, got := "c", payloadHash(); expected != got {
+		t.Errorf("Wanted payload hash %q, got %q.", expected, got)
+	}
+
+	group, _ := dms.GetMetricGroup(grouping)
+	for _, s := range []struct {
+		wr        WriteRequest
+		unchanged bool
+	}{
+		{WriteRequest{PayloadHash: "c"}, true},
+		{WriteRequest{PayloadHash: "c", Annotations: map[string]string{"build": "1"}}, true},
+		{WriteRequest{PayloadHash: "c", Annotations: map[string]string{"build": "1"}, Replace: true}, true},
+		{WriteRequest{PayloadHash: "c", Replace: true}, false},
+		{WriteRequest{PayloadHash: "c", Annotations: map[string]string{"build": "2"}}, false},
+		{WriteRequest{PayloadHash: "c", Aggregation: AggregateSum}, false},
+		{WriteRequest{PayloadHash: "c", Sequence: 1}, false},
+		{WriteRequest{PayloadHash: "d"}, false},
+		{WriteRequest{}, false},
+	} {
+		if expected, got := s.unchanged, group.Unchanged(s.wr); expected != got {
+			t.Errorf("%+v: Wanted unchanged %t, got %t.", s.wr, expected, got)
+		}
+	}
+
+	// The payload hash survives a crash (via the WAL) and a clean
+	// restart (via the snapshot).
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	if group, _ := dms2.GetMetricGroup(grouping); group.PayloadHash != "c" {
+		t.Errorf("Wanted payload hash %q after replaying the WAL, got %q.", "c", group.PayloadHash)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if expected, got := "c", payloadHash(); expected != got {
+		t.Errorf("Wanted payload hash %q after restart, got %q.", expected, got)
+	}
+
+	// Deleting a metric family or aggregating removes the payload hash.
+	submit(t, dms, WriteRequest{
+		Labels:      grouping,
+		Timestamp:   ts,
+		MetricNames: []string{mf4.GetName()},
+	})
+	if got := payloadHash(); got != "" {
+		t.Errorf("Wanted no payload hash after deletion, got %q.", got)
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Replace:        true,
+		PayloadHash:    "e",
+	})
+	if expected, got := "e", payloadHash(); expected != got {
+		t.Errorf("Wanted payload hash %q, got %q.", expected, got)
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Aggregation:    AggregateMax,
+		PayloadHash:    "e",
+	})
+	if got := payloadHash(); got != "" {
+		t.Errorf("Wanted no payload hash after aggregation, got %q.", got)
+	}
+
+	if _, ok := dms.GetMetricGroup(map[string]string{"job": "job2"}); ok {
+		t.Error("Unexpected group found.")
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreGroups(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestRestoreGroups.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	ts := time.Now()
+	source := NewDiskMetricStore("", time.Hour, nil, logger)
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job2"}
+	submit(t, source, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Annotations:    map[string]string{"build": "1"},
+	})
+	submit(t, source, WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf4),
+	})
+	submit(t, source, WriteRequest{Labels: grouping2, Timestamp: ts, Lock: true})
+
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, source.GetMetricFamiliesMap()); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The restore replaces everything already in the store.
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	submit(t, dms, WriteRequest{
+		Labels:         map[string]string{"job": "job3"},
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a),
+	})
+	submit(t, dms, WriteRequest{Timestamp: ts, Groups: groups})
+
+	check := func(dms *DiskMetricStore, when string) {
+		got := dms.GetMetricFamiliesMap()
+		if expected, got := 2, len(got); expected != got {
+			t.Errorf("%s: Wanted %d groups, got %d.", when, expected, got)
+		}
+		group1, group2 := got[groupingKeyFor(grouping1)], got[groupingKeyFor(grouping2)]
+		if _, ok := group1.Metrics["mf3"]; !ok {
+			t.Errorf("%s: Wanted mf3 in first group, got %v.", when, group1.Metrics)
+		}
+		if expected, got := map[string]string{"build": "1"}, group1.Annotations; !reflect.DeepEqual(expected, got) {
+			t.Errorf("%s: Wanted annotations %v, got %v.", when, expected, got)
+		}
+		if _, ok := group2.Metrics["mf4"]; !ok {
+			t.Errorf("%s: Wanted mf4 in second group, got %v.", when, group2.Metrics)
+		}
+		if !group2.Locked {
+			t.Errorf("%s: Expected second group to be locked.", when)
+		}
+	}
+	check(dms, "after restore")
+
+	// The restore survives a crash (via the WAL).
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	check(dms2, "after replaying the WAL")
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupted snapshots are rejected.
+	if err := WriteSnapshot(&buf, groups); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	b[len(b)-1] ^= 0xff
+	if _, err := ReadSnapshot(bytes.NewReader(b)); err == nil {
+		t.Error("Expected error for corrupted snapshot.")
+	}
+}
+
+func TestCollect(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestCollect.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(dms); err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance2"},
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+		Done:           errCh,
+	})
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1", "instance": "instance1"},
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Done:           errCh,
+	})
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		m := mf.GetMetric()[0]
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE:
+			got[mf.GetName()] = m.GetGauge().GetValue()
+		case dto.MetricType_COUNTER:
+			got[mf.GetName()] = m.GetCounter().GetValue()
+		case dto.MetricType_SUMMARY:
+			got[mf.GetName()] = float64(m.GetSummary().GetSampleCount())
+		}
+	}
+	for name, expected := range map[string]float64{
+		"pushgateway_write_queue_length":           0,
+		"pushgateway_write_queue_capacity":         DefaultWriteQueueCapacity,
+		"pushgateway_metric_groups":                2,
+		"pushgateway_metric_families":              7, // Including push timestamps.
+		"pushgateway_persistence_duration_seconds": 1,
+		"pushgateway_persistence_errors_total":     0,
+		"pushgateway_persistence_lag_seconds":      0,
+		"pushgateway_persistence_enabled":          1,
+	} {
+		if got, ok := got[name]; !ok || expected != got {
+			t.Errorf("Wanted %s to be %v, got %v.", name, expected, got)
+		}
+	}
+	if got["pushgateway_persistence_last_success_timestamp_seconds"] <= 0 {
+		t.Error("Wanted pushgateway_persistence_last_success_timestamp_seconds to be set.")
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingPersister is a Persister that only fails to persist if told so.
+type failingPersister struct {
+	mtx  sync.Mutex
+	fail bool
+}
+
+func (p *failingPersister) Restore() (GroupingKeyToMetricGroup, bool, error) {
+	return GroupingKeyToMetricGroup{}, false, nil
+}
+
+func (p *failingPersister) Replay(func(WriteRequest, bool)) (int, error) { return 0, nil }
+
+func (p *failingPersister) Log(WriteRequest, bool) error { return nil }
+
+func (p *failingPersister) Persist(GroupingKeyToMetricGroup) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.fail {
+		return fmt.Errorf("disk full")
+	}
+	return nil
+}
+
+func (p *failingPersister) Wipe() error { return nil }
+
+func (p *failingPersister) Close() error { return nil }
+
+func (p *failingPersister) setFail(fail bool) {
+	p.mtx.Lock()
+	p.fail = fail
+	p.mtx.Unlock()
+}
+
+func TestPersistenceLag(t *testing.T) {
+	var buf bytes.Buffer
+	p := &failingPersister{}
+	dms := NewPersistentMetricStore(p, time.Hour, Limits{}, WriteQueueOptions{}, nil, log.NewLogfmtLogger(log.NewSyncWriter(&buf)))
+	dms.SetPersistLagWarning(50 * time.Millisecond)
+
+	if expected, got := time.Duration(0), dms.persistenceLag(time.Now()); expected != got {
+		t.Errorf("Wanted lag %v without changes, got %v.", expected, got)
+	}
+	start := time.Now()
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         map[string]string{"job": "job1"},
+		Timestamp:      start,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal(err)
+	}
+	// The change has been applied after start.
+	if lag := dms.persistenceLag(start.Add(time.Minute)); lag <= 0 || lag > time.Minute {
+		t.Errorf("Wanted lag of at most a minute, got %v.", lag)
+	}
+
+	// Failed persisting leaves the lag growing, and too much of it is
+	// logged.
+	time.Sleep(100 * time.Millisecond)
+	p.setFail(true)
+	if err := dms.persist(); err == nil {
+		t.Error("Expected error from persisting.")
+	}
+	if lag := dms.persistenceLag(time.Now()); lag < 100*time.Millisecond {
+		t.Errorf("Wanted lag of at least 100ms after failed persisting, got %v.", lag)
+	}
+	if !strings.Contains(buf.String(), "persisting lags behind") {
+		t.Errorf("Wanted lag warning, got log %q.", buf.String())
+	}
+	p.setFail(false)
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := time.Duration(0), dms.persistenceLag(time.Now()); expected != got {
+		t.Errorf("Wanted lag %v after persisting, got %v.", expected, got)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupMetrics(t *testing.T) {
+	dms := NewDiskMetricStore("", time.Hour, nil, logger)
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(dms); err != nil {
+		t.Fatal(err)
+	}
+	grouping := map[string]string{"job": "job1", "instance": "instance2"}
+	for i := 0; i < 2; i++ {
+		submit(t, dms, WriteRequest{
+			Labels:         grouping,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+			PayloadSize:    100 + i,
+		})
+	}
+
+	gatherGroupMetrics := func() map[string]*dto.Metric {
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]*dto.Metric{}
+		for _, mf := range mfs {
+			if strings.HasPrefix(mf.GetName(), "pushgateway_group_") {
+				got[mf.GetName()] = mf.GetMetric()[0]
+			}
+		}
+		return got
+	}
+	if got := gatherGroupMetrics(); len(got) != 0 {
+		t.Errorf("Unexpected group metrics while disabled: %v", got)
+	}
+
+	dms.SetGroupMetrics(true)
+	got := gatherGroupMetrics()
+	for name, expected := range map[string]float64{
+		"pushgateway_group_metric_families":      2,
+		"pushgateway_group_samples":              float64(NumSamples(mf1a) + NumSamples(mf2)),
+		"pushgateway_group_last_push_size_bytes": 101,
+		"pushgateway_group_pushes_total":         2,
+		"pushgateway_group_failed_pushes_total":  0,
+	} {
+		m, ok := got[name]
+		if !ok {
+			t.Errorf("Metric %s missing.", name)
+			continue
+		}
+		if v := m.GetGauge().GetValue() + m.GetCounter().GetValue(); expected != v {
+			t.Errorf("Wanted %s to be %v, got %v.", name, expected, v)
+		}
+		if expected, got := 2, len(m.GetLabel()); expected != got {
+			t.Errorf("Wanted %d labels for %s, got %d.", expected, name, got)
+		}
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPushesToday(t *testing.T) {
+	day := time.Date(2020, 3, 11, 0, 0, 0, 0, time.UTC)
+	var group MetricGroup
+	for _, ts := range []time.Time{
+		day.Add(-time.Minute), day.Add(time.Minute), day.Add(23 * time.Hour),
+	} {
+		group.countPush(ts)
+	}
+	for _, s := range []struct {
+		now      time.Time
+		expected int
+	}{
+		{day.Add(-time.Second), 0},
+		{day.Add(12 * time.Hour), 2},
+		{day.Add(25 * time.Hour), 0},
+	} {
+		if got := group.PushesToday(s.now); s.expected != got {
+			t.Errorf("At %v: Wanted %d pushes today, got %d.", s.now, s.expected, got)
+		}
+	}
+	if expected, got := 3, group.Pushes; expected != got {
+		t.Errorf("Wanted %d pushes, got %d.", expected, got)
+	}
+}
+
+func TestMetricGroupSummary(t *testing.T) {
+	dms := NewDiskMetricStore("", time.Hour, nil, logger)
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+
+	group := MetricGroup{Labels: grouping, Metrics: NameToTimestampedMetricFamilyMap{}}
+	if expected, got := 0, group.NumMetricFamilies(); expected != got {
+		t.Errorf("Wanted %d metric families, got %d.", expected, got)
+	}
+	if got := group.LastPushTime(); !got.IsZero() {
+		t.Errorf("Wanted zero last push time, got %v.", got)
+	}
+
+	ts := time.Unix(1500000000, 500000000)
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+	})
+	group = dms.GetMetricFamiliesMap()[groupingKeyFor(grouping)]
+	if expected, got := 2, group.NumMetricFamilies(); expected != got {
+		t.Errorf("Wanted %d metric families, got %d.", expected, got)
+	}
+	if expected, got := ts, group.LastPushTime(); !expected.Equal(got) {
+		t.Errorf("Wanted last push time %v, got %v.", expected, got)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetMetricFamiliesMap(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestGetMetricFamiliesMap.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	dms := NewDiskMetricStore(fileName, 100*time.Millisecond, nil, logger)
+
+	labels1 := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+
+	labels2 := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+
+	gk1 := groupingKeyFor(labels1)
+	gk2 := groupingKeyFor(labels2)
+
+	// Submit a single simple metric family.
+	ts1 := time.Now()
+	errCh := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         labels1,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+	pushTimestamp := newPushTimestampGauge(labels1, ts1)
+	pushFailedTimestamp := newPushFailedTimestampGauge(labels1, time.Time{})
+	if err := checkMetricFamilies(
+		dms, mf3,
+		pushTimestamp, pushFailedTimestamp,
+	); err != nil {
+		t.Error(err)
+	}
+
+	// Submit two metric families for a different instance.
+	ts2 := ts1.Add(time.Second)
+	errCh = make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         labels2,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1b, mf2),
+		Done:           errCh,
+	})
+	for err := range errCh {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	// expectedMFMap is a multi-layered map that maps the labelset
+	// fingerprints to the corresponding metric family string
 	// representations.  This is for test assertion purposes.
 	expectedMFMap := map[string]map[string]string{
 		gk1: {
@@ -1532,3 +3659,81 @@ func (s metricSorter) Less(i, j int) bool {
 	}
 	return true
 }
+
+// newBenchmarkStore returns a DiskMetricStore with the provided number of
+// groups (see newBenchmarkWriteRequest) and the WriteRequest that pushes one of
+// those groups anew.
+func newBenchmarkStore(groups int, queue WriteQueueOptions) (*DiskMetricStore, WriteRequest) {
+	dms := NewPersistentMetricStore(nil, time.Hour, Limits{}, queue, nil, log.NewNopLogger())
+	for g := 0; g < groups; g++ {
+		dms.processWriteRequest(newBenchmarkWriteRequest(fmt.Sprint("job", g)))
+	}
+	return dms, newBenchmarkWriteRequest("job0")
+}
+
+// newBenchmarkWriteRequest returns a WriteRequest pushing 10 gauge families of
+// 10 samples to the group of the provided job.
+func newBenchmarkWriteRequest(job string) WriteRequest {
+	mfs := map[string]*dto.MetricFamily{}
+	for f := 0; f < 10; f++ {
+		mf := &dto.MetricFamily{
+			Name: proto.String(fmt.Sprintf("benchmark_metric_%d", f)),
+			Help: proto.String("A metric for benchmarking."),
+			Type: dto.MetricType_GAUGE.Enum(),
+		}
+		for m := 0; m < 10; m++ {
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("job"), Value: proto.String(job)},
+					{Name: proto.String("sample"), Value: proto.String(fmt.Sprint(m))},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(float64(m))},
+			})
+		}
+		mfs[mf.GetName()] = mf
+	}
+	return WriteRequest{
+		Labels:         map[string]string{"job": job},
+		Timestamp:      time.Now(),
+		MetricFamilies: mfs,
+	}
+}
+
+// BenchmarkProcessWriteRequestWhileScraping measures how long pushes take to be
+// applied while the store is scraped concurrently.
+func BenchmarkProcessWriteRequestWhileScraping(b *testing.B) {
+	dms, wr := newBenchmarkStore(1000, WriteQueueOptions{})
+	defer dms.Shutdown()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				dms.GetMetricFamilies()
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dms.processWriteRequest(wr)
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+// BenchmarkGetMetricFamilies measures scrapes without concurrent pushes.
+func BenchmarkGetMetricFamilies(b *testing.B) {
+	dms, _ := newBenchmarkStore(1000, WriteQueueOptions{})
+	defer dms.Shutdown()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dms.GetMetricFamilies()
+	}
+}
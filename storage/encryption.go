@@ -0,0 +1,162 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// An encrypted persistence file starts with encryptedMagic, followed by a random
+// nonce and the AES-GCM encrypted content of a plain persistence file (see
+// persistence.go), with encryptedMagic as additional authenticated data. Like
+// persistenceMagic, encryptedMagic starts with a zero byte so that it cannot be
+// confused with the legacy gob format.
+//
+// An encrypted write-ahead log record starts with encryptedRecordMarker,
+// followed by a random nonce and the AES-GCM encrypted plain record (see
+// wal.go). A plain record never starts with a zero byte as that would be an
+// invalid protobuf tag.
+//
+// The AES-256 key is the SHA-256 hash of the secret provided by the user.
+const (
+	encryptedMagic        = "\x00pushgateway-aes-gcm"
+	encryptedRecordMarker = 0
+)
+
+var errNoEncryptionKey = errors.New("persisted data is encrypted, but no encryption key is configured")
+
+// encryption encrypts and decrypts persisted data. A nil *encryption is valid
+// and means that data is persisted unencrypted.
+type encryption struct {
+	aead cipher.AEAD
+}
+
+// newEncryption returns an encryption keyed from the provided secret, or nil if
+// the secret is empty.
+func newEncryption(secret string) *encryption {
+	if secret == "" {
+		return nil
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		// Cannot happen with a 32-byte key.
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &encryption{aead: aead}
+}
+
+// seal returns prefix followed by a random nonce and the encrypted plaintext.
+// The prefix is authenticated, too.
+func (e *encryption) seal(prefix, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not create nonce: %v", err)
+	}
+	b := make([]byte, 0, len(prefix)+len(nonce)+len(plaintext)+e.aead.Overhead())
+	b = append(append(b, prefix...), nonce...)
+	return e.aead.Seal(b, nonce, plaintext, prefix), nil
+}
+
+// open reverses seal. The caller has to make sure b starts with prefix.
+func (e *encryption) open(prefix, b []byte) ([]byte, error) {
+	b = b[len(prefix):]
+	if len(b) < e.aead.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+	nonce, ciphertext := b[:e.aead.NonceSize()], b[e.aead.NonceSize():]
+	plaintext, err := e.aead.Open(nil, nonce, ciphertext, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt persisted data, wrong encryption key? %v", err)
+	}
+	return plaintext, nil
+}
+
+// writeSnapshot works like the writeSnapshot function but compresses the
+// snapshot with the provided Compression and then encrypts it if e is not nil.
+func (e *encryption) writeSnapshot(w io.Writer, groups GroupingKeyToMetricGroup, lastSequence uint64, c Compression) error {
+	if e == nil {
+		return compressSnapshot(w, groups, lastSequence, c)
+	}
+	var buf bytes.Buffer
+	if err := compressSnapshot(&buf, groups, lastSequence, c); err != nil {
+		return err
+	}
+	b, err := e.seal([]byte(encryptedMagic), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// snapshotReader returns a reader for the plain, uncompressed snapshot read from
+// r, whether the snapshot was encrypted, and the Compression it was compressed
+// with. Plain snapshots are always readable so that encryption can be enabled
+// for an existing persistence file. An encrypted snapshot requires e to be
+// non-nil.
+func (e *encryption) snapshotReader(r io.Reader) (io.Reader, bool, Compression, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(encryptedMagic))
+	if (err != nil && err != io.EOF) || string(magic) != encryptedMagic {
+		// Let readSnapshot deal with errors and plain snapshots.
+		dr, c, err := decompressingReader(br)
+		return dr, false, c, err
+	}
+	if e == nil {
+		return nil, true, CompressionNone, errNoEncryptionKey
+	}
+	b, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, true, CompressionNone, err
+	}
+	plaintext, err := e.open([]byte(encryptedMagic), b)
+	if err != nil {
+		return nil, true, CompressionNone, err
+	}
+	dr, c, err := decompressingReader(bytes.NewReader(plaintext))
+	return dr, true, c, err
+}
+
+// sealRecord encrypts a write-ahead log record if e is not nil.
+func (e *encryption) sealRecord(record []byte) ([]byte, error) {
+	if e == nil {
+		return record, nil
+	}
+	return e.seal([]byte{encryptedRecordMarker}, record)
+}
+
+// openRecord decrypts a write-ahead log record if it is encrypted.
+func (e *encryption) openRecord(record []byte) ([]byte, error) {
+	if len(record) == 0 || record[0] != encryptedRecordMarker {
+		return record, nil
+	}
+	if e == nil {
+		return nil, errNoEncryptionKey
+	}
+	return e.open([]byte{encryptedRecordMarker}, record)
+}
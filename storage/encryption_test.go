@@ -0,0 +1,155 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+func TestEncryptedFilePersister(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestEncryptedFilePersister.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	newDMS := func(file, key string) *DiskMetricStore {
+		return NewPersistentMetricStore(NewFilePersister(file, key, logger), time.Hour, Limits{}, WriteQueueOptions{}, nil, logger)
+	}
+	// Neither the persistence file nor the write-ahead log may contain
+	// anything in plain text.
+	checkEncrypted := func(file string) {
+		t.Helper()
+		files := []string{file}
+		segments, err := listWALSegments(file + walDirSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, first := range segments {
+			files = append(files, segmentPath(file+walDirSuffix, first))
+		}
+		for _, f := range files {
+			content, err := ioutil.ReadFile(f)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(content, []byte("instance2")) {
+				t.Errorf("File %s contains unencrypted metrics.", f)
+			}
+		}
+	}
+
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+	ts := time.Now()
+	dms := newDMS(fileName, "secret")
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a),
+	})
+	pushTimestamp := newPushTimestampGauge(grouping, ts)
+	pushFailedTimestamp := newPushFailedTimestampGauge(grouping, time.Time{})
+
+	// Only in the write-ahead log so far.
+	image := crashImage(t, fileName, tempDir)
+	checkEncrypted(image)
+	dms2 := newDMS(image, "secret")
+	if err := checkMetricFamilies(dms2, mf1a, pushTimestamp, pushFailedTimestamp); err != nil {
+		t.Error(err)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewFilePersister(crashImage(t, fileName, tempDir), "", logger)
+	if _, _, err := p.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Replay(func(WriteRequest, bool) {}); err != errNoEncryptionKey {
+		t.Errorf("Wanted error %q replaying without key, got %v.", errNoEncryptionKey, err)
+	}
+
+	// Now in the persistence file.
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	checkEncrypted(fileName)
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(content, []byte(encryptedMagic)) {
+		t.Error("Persistence file is not encrypted.")
+	}
+	for _, key := range []string{"", "wrong"} {
+		p := NewFilePersister(fileName, key, logger)
+		if _, _, err := p.Restore(); err == nil {
+			t.Errorf("Expected error restoring with key %q.", key)
+		}
+		if err := p.Persist(GroupingKeyToMetricGroup{}); err == nil {
+			t.Errorf("Expected error overwriting persistence file with key %q.", key)
+		}
+	}
+	dms = newDMS(fileName, "secret")
+	if err := checkMetricFamilies(dms, mf1a, pushTimestamp, pushFailedTimestamp); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unencrypted persistence file is encrypted upon restore.
+	plainFile := path.Join(tempDir, "plain")
+	dms = newDMS(plainFile, "")
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a),
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	p = NewFilePersister(plainFile, "secret", logger)
+	_, dirty, err := p.Restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dirty {
+		t.Error("Expected unencrypted persistence file to be persisted again.")
+	}
+	dms = newDMS(plainFile, "secret")
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	checkEncrypted(plainFile)
+	dms = newDMS(plainFile, "secret")
+	if err := checkMetricFamilies(dms, mf1a, pushTimestamp, pushFailedTimestamp); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
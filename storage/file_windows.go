@@ -0,0 +1,59 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package storage
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// replaceRetries is how often replaceFile tries to replace a file that is
+// opened by another process.
+const replaceRetries = 5
+
+// replaceFile renames the file from to the file to, replacing it atomically if
+// it exists already. Unlike with os.Rename, the rename is written through to
+// disk before replaceFile returns, so that syncDir is not needed afterwards.
+//
+// Replacing a file fails on Windows as long as another process (typically a
+// virus scanner or backup agent) has opened it without sharing it for
+// deletion. As that is usually brief, the rename is retried a few times in that
+// case.
+func replaceFile(from, to string) error {
+	fromPtr, err := windows.UTF16PtrFromString(from)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	toPtr, err := windows.UTF16PtrFromString(to)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	for i := 1; ; i++ {
+		err = windows.MoveFileEx(fromPtr, toPtr, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH)
+		if err == nil {
+			return nil
+		}
+		if i == replaceRetries || (err != windows.ERROR_ACCESS_DENIED && err != windows.ERROR_SHARING_VIOLATION) {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+		}
+		time.Sleep(time.Duration(i) * 20 * time.Millisecond)
+	}
+}
+
+// syncDir does nothing on Windows, where directories cannot be synced. Renames
+// by replaceFile are durable anyway.
+func syncDir(dir string) error {
+	return nil
+}
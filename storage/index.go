@@ -0,0 +1,408 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/codec"
+)
+
+// The index file of a persistence file is named like the persistence file with
+// ".index" appended. If enabled, it is written along with every persistence
+// file that is neither compressed nor encrypted, so that the persistence file
+// can be restored without decoding the metric families in it. Instead, each
+// metric family is read from the persistence file when it is accessed for the
+// first time, see lazySnapshot.
+//
+// The index file is structured like the persistence file (see persistence.go),
+// but it starts with indexMagic, followed by the index format version as a
+// uvarint, an IndexHeader message, the Group messages of the persistence file
+// with IndexedFamily messages in place of the Family messages, and the trailer:
+//
+//	message IndexHeader {
+//	  uint64 last_sequence = 1;
+//	  uint64 snapshot_size = 2;
+//	  uint32 snapshot_checksum = 3;
+//	}
+//
+//	message IndexedFamily {
+//	  int64 timestamp_seconds = 1;
+//	  int32 timestamp_nanos = 2;
+//	  int64 ttl_nanoseconds = 4;
+//	  string name = 5;
+//	  uint64 offset = 6;
+//	  uint32 length = 7;
+//	  uint32 checksum = 8;
+//	}
+//
+// snapshot_size is the size of the persistence file, and snapshot_checksum is
+// the file checksum from its trailer. An index file not matching the
+// persistence file, e.g. because the Pushgateway crashed after writing the
+// persistence file but before writing the index file, is ignored. offset and
+// length locate the encoded metric family in the persistence file, and checksum
+// is its CRC-32C.
+//
+// Unlike the persistence file, an index file is only used if it is completely
+// intact. Otherwise, the persistence file is read as a whole.
+const (
+	indexSuffix        = ".index"
+	indexMagic         = "\x00pushgateway-index"
+	indexFormatVersion = 1
+
+	indexHeaderLastSequenceField     protowire.Number = 1
+	indexHeaderSnapshotSizeField     protowire.Number = 2
+	indexHeaderSnapshotChecksumField protowire.Number = 3
+
+	familyNameField     protowire.Number = 5
+	familyOffsetField   protowire.Number = 6
+	familyLengthField   protowire.Number = 7
+	familyChecksumField protowire.Number = 8
+)
+
+var errStaleIndex = errors.New("index file does not match persistence file")
+
+// snapshotIndex collects the index of a snapshot while writeIndexedSnapshot
+// writes the snapshot.
+type snapshotIndex struct {
+	records      []byte // The checksummed Group records.
+	snapshotSize int64
+	snapshotCRC  uint32
+}
+
+// add adds the provided group to the index. Its record starts at recordOffset
+// in the snapshot, and its encoded metric families are at the provided
+// positions within the record.
+func (ix *snapshotIndex) add(group MetricGroup, recordOffset int64, positions []familyPosition) error {
+	i := 0
+	record, err := appendGroup(nil, group, func(b []byte, name string, tmf TimestampedMetricFamily) ([]byte, error) {
+		if i >= len(positions) {
+			return nil, fmt.Errorf("no position of metric family %q in snapshot", name)
+		}
+		p := positions[i]
+		i++
+		family := appendFamilyTTL(appendFamilyTimestamp(nil, tmf), tmf)
+		family = protowire.AppendTag(family, familyNameField, protowire.BytesType)
+		family = protowire.AppendString(family, name)
+		family = protowire.AppendTag(family, familyOffsetField, protowire.VarintType)
+		family = protowire.AppendVarint(family, uint64(recordOffset)+uint64(p.offset))
+		family = protowire.AppendTag(family, familyLengthField, protowire.VarintType)
+		family = protowire.AppendVarint(family, uint64(p.length))
+		family = protowire.AppendTag(family, familyChecksumField, protowire.VarintType)
+		family = protowire.AppendVarint(family, uint64(p.crc))
+		return protowire.AppendBytes(b, family), nil
+	})
+	if err != nil {
+		return err
+	}
+	ix.records = appendChecksummedRecord(ix.records, record)
+	return nil
+}
+
+// write writes the index file to w. lastSequence is the one of the snapshot.
+func (ix *snapshotIndex) write(w io.Writer, lastSequence uint64) error {
+	bw := bufio.NewWriter(w)
+	fileCRC := crc32.New(crcTable)
+	cw := io.MultiWriter(bw, fileCRC)
+
+	b := append([]byte(indexMagic), protowire.AppendVarint(nil, indexFormatVersion)...)
+	header := protowire.AppendTag(nil, indexHeaderLastSequenceField, protowire.VarintType)
+	header = protowire.AppendVarint(header, lastSequence)
+	header = protowire.AppendTag(header, indexHeaderSnapshotSizeField, protowire.VarintType)
+	header = protowire.AppendVarint(header, uint64(ix.snapshotSize))
+	header = protowire.AppendTag(header, indexHeaderSnapshotChecksumField, protowire.VarintType)
+	header = protowire.AppendVarint(header, uint64(ix.snapshotCRC))
+	b = appendChecksummedRecord(b, header)
+	if _, err := cw.Write(b); err != nil {
+		return err
+	}
+	if _, err := cw.Write(ix.records); err != nil {
+		return err
+	}
+	if _, err := cw.Write(protowire.AppendVarint(nil, 0)); err != nil {
+		return err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint32(nil, fileCRC.Sum32())); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readIndex reads the index file from r and returns the groups of the
+// persistence file opened as ls, with their metric families to be loaded from
+// ls, together with the sequence number of the last write request reflected in
+// them. Any corruption of the index file is an error, and so is an index file
+// not matching ls (errStaleIndex).
+func readIndex(r io.Reader, ls *lazySnapshot) (GroupingKeyToMetricGroup, uint64, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != indexMagic {
+		return nil, 0, errors.New("not an index file")
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read index format version: %v", err)
+	}
+	if version != indexFormatVersion {
+		return nil, 0, fmt.Errorf("unsupported index format version %d", version)
+	}
+	cr := &crcReader{br: br}
+	cr.update(magic)
+	cr.update(protowire.AppendVarint(nil, version))
+
+	header, err := readChecksummedRecord(cr)
+	if err == nil && header == nil {
+		err = errors.New("missing header")
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read index file header: %v", err)
+	}
+	var lastSequence, size, sum uint64
+	if err := forEachField(header, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		var err error
+		switch num {
+		case indexHeaderLastSequenceField:
+			lastSequence, err = varintValue(typ, v)
+		case indexHeaderSnapshotSizeField:
+			size, err = varintValue(typ, v)
+		case indexHeaderSnapshotChecksumField:
+			sum, err = varintValue(typ, v)
+		}
+		return err
+	}); err != nil {
+		return nil, 0, fmt.Errorf("could not decode index file header: %v", err)
+	}
+	if int64(size) != ls.size || uint32(sum) != ls.crc {
+		return nil, 0, errStaleIndex
+	}
+
+	groups := GroupingKeyToMetricGroup{}
+	for {
+		record, err := readChecksummedRecord(cr)
+		if err == io.EOF {
+			return nil, 0, errors.New("truncated index file")
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if record == nil {
+			// Trailer.
+			sum := make([]byte, 4)
+			if _, err := io.ReadFull(br, sum); err != nil || binary.LittleEndian.Uint32(sum) != cr.crc {
+				return nil, 0, errors.New("index file checksum mismatch")
+			}
+			return groups, lastSequence, nil
+		}
+		group, err := unmarshalIndexedGroup(record, ls)
+		if err != nil {
+			return nil, 0, fmt.Errorf("could not decode index record: %v", err)
+		}
+		groups[groupingKeyFor(group.Labels)] = group
+	}
+}
+
+// lazySnapshot is a persistence file restored with its index file. It is kept
+// open to load its metric families on first access until it is released.
+type lazySnapshot struct {
+	name        string
+	size        int64
+	crc         uint32 // The file checksum from the trailer.
+	corruptions prometheus.Counter
+	logger      log.Logger
+
+	mtx       sync.RWMutex
+	f         *os.File // nil once released.
+	families  []*lazyFamily
+	corrupted int32 // Accessed atomically.
+}
+
+// openLazySnapshot opens the provided persistence file, which has to be in the
+// current format, neither compressed nor encrypted, to restore it lazily.
+// Metric families that cannot be loaded are counted with the provided counter.
+func openLazySnapshot(name string, corruptions prometheus.Counter, logger log.Logger) (*lazySnapshot, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	ls := &lazySnapshot{name: name, corruptions: corruptions, logger: logger, f: f}
+	if err := ls.check(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return ls, nil
+}
+
+// check checks the format of the persistence file and determines its size and
+// file checksum to match them against the index file.
+func (ls *lazySnapshot) check() error {
+	fi, err := ls.f.Stat()
+	if err != nil {
+		return err
+	}
+	prefix := append([]byte(persistenceMagic), protowire.AppendVarint(nil, persistenceFormatVersion)...)
+	// The file ends with the trailer, whose zero length precedes the file
+	// checksum.
+	if fi.Size() < int64(len(prefix))+5 {
+		return errStaleIndex
+	}
+	b := make([]byte, len(prefix))
+	if _, err := ls.f.ReadAt(b, 0); err != nil {
+		return err
+	}
+	if string(b) != string(prefix) {
+		// Compressed, encrypted, or in an older format.
+		return errStaleIndex
+	}
+	sum := make([]byte, 4)
+	if _, err := ls.f.ReadAt(sum, fi.Size()-4); err != nil {
+		return err
+	}
+	ls.size, ls.crc = fi.Size(), binary.LittleEndian.Uint32(sum)
+	return nil
+}
+
+// add returns a lazyFamily loaded from ls according to the provided familyRef.
+// It must not be called concurrently.
+func (ls *lazySnapshot) add(ref familyRef) *lazyFamily {
+	lf := &lazyFamily{familyRef: ref, ls: ls}
+	ls.families = append(ls.families, lf)
+	return lf
+}
+
+// load reads the metric family referenced by ref. A metric family that cannot
+// be read is counted as a corruption and dropped, i.e. nil is returned.
+func (ls *lazySnapshot) load(ref familyRef) *dto.MetricFamily {
+	ls.mtx.RLock()
+	defer ls.mtx.RUnlock()
+
+	mf, err := ls.read(ref)
+	if err != nil {
+		atomic.AddInt32(&ls.corrupted, 1)
+		ls.corruptions.Inc()
+		level.Warn(ls.logger).Log("msg", "could not load metric family from persistence file, dropping it", "file", ls.name, "metric_family", ref.name, "err", err)
+		return nil
+	}
+	return mf
+}
+
+func (ls *lazySnapshot) read(ref familyRef) (*dto.MetricFamily, error) {
+	if ls.f == nil {
+		return nil, errors.New("persistence file has been released")
+	}
+	if ref.offset < 0 || ref.offset+int64(ref.length) > ls.size || ref.length > maxRecordSize {
+		return nil, fmt.Errorf("metric family at offset %d with %d bytes is outside of the persistence file", ref.offset, ref.length)
+	}
+	raw := make([]byte, ref.length)
+	if _, err := ls.f.ReadAt(raw, ref.offset); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(raw, crcTable) != ref.crc {
+		return nil, errCorruptedRecord
+	}
+	mf := &dto.MetricFamily{}
+	if err := codec.UnmarshalMetricFamily(raw, mf); err != nil {
+		return nil, err
+	}
+	if mf.GetName() != ref.name {
+		return nil, fmt.Errorf("found metric family %q instead", mf.GetName())
+	}
+	return mf, nil
+}
+
+// release loads all metric families that have not been loaded yet and closes
+// the persistence file so that it can be replaced or removed. It returns the
+// number of metric families that could not be loaded.
+func (ls *lazySnapshot) release() int {
+	for _, lf := range ls.families {
+		lf.get()
+	}
+	ls.close()
+	return int(atomic.LoadInt32(&ls.corrupted))
+}
+
+// close closes the persistence file without loading anything. Metric families
+// not loaded so far are dropped upon access.
+func (ls *lazySnapshot) close() {
+	ls.mtx.Lock()
+	defer ls.mtx.Unlock()
+	if ls.f != nil {
+		ls.f.Close()
+		ls.f = nil
+	}
+	ls.families = nil
+}
+
+// familyRef locates an encoded metric family in a persistence file as recorded
+// by an IndexedFamily message.
+type familyRef struct {
+	name        string
+	offset      int64
+	length, crc uint32
+}
+
+// unmarshalField decodes the IndexedFamily field with the provided number into
+// ref. Other fields are ignored.
+func (ref *familyRef) unmarshalField(num protowire.Number, typ protowire.Type, v []byte) error {
+	switch num {
+	case familyNameField:
+		raw, err := bytesValue(typ, v)
+		ref.name = string(raw)
+		return err
+	case familyOffsetField:
+		x, err := varintValue(typ, v)
+		ref.offset = int64(x)
+		return err
+	case familyLengthField:
+		x, err := varintValue(typ, v)
+		ref.length = uint32(x)
+		return err
+	case familyChecksumField:
+		x, err := varintValue(typ, v)
+		ref.crc = uint32(x)
+		return err
+	}
+	return nil
+}
+
+// lazyFamily is a metric family loaded from a lazySnapshot on first access.
+type lazyFamily struct {
+	familyRef
+	ls *lazySnapshot // nil once loaded.
+
+	once sync.Once
+	mf   *dto.MetricFamily
+}
+
+func (lf *lazyFamily) get() *dto.MetricFamily {
+	lf.once.Do(func() {
+		lf.mf = lf.ls.load(lf.familyRef)
+		lf.ls = nil
+	})
+	return lf.mf
+}
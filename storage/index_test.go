@@ -0,0 +1,245 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/codec"
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+func TestIndexedFilePersister(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestIndexedFilePersister.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	indexName := fileName + indexSuffix
+
+	ts := time.Unix(1600000000, 123456789)
+	mg := GroupingKeyToMetricGroup{}
+	addGroup(mg, map[string]string{"job": "job1"}, NameToTimestampedMetricFamilyMap{
+		"mf1": {Timestamp: ts, GobbableMetricFamily: (*GobbableMetricFamily)(mf1a), TTL: time.Minute},
+		"mf2": {Timestamp: ts.Add(time.Second), GobbableMetricFamily: (*GobbableMetricFamily)(mf2)},
+	})
+	addGroup(mg, map[string]string{"job": "job2"}, NameToTimestampedMetricFamilyMap{
+		"mf3": {Timestamp: ts, GobbableMetricFamily: (*GobbableMetricFamily)(mf3)},
+	})
+	newFP := func(index bool) *filePersister {
+		fp := newFilePersister(fileName, "", 0, SyncNever, CompressionNone, logger)
+		fp.index = index
+		return fp
+	}
+	restore := func() (*filePersister, GroupingKeyToMetricGroup) {
+		t.Helper()
+		fp := newFP(true)
+		groups, dirty, err := fp.Restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dirty {
+			t.Error("Restored groups unexpectedly dirty.")
+		}
+		return fp, groups
+	}
+	if err := newFP(true).Persist(mg); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metric families are only loaded on first access.
+	fp, groups := restore()
+	if !fp.restoredLazily() {
+		t.Fatal("Wanted persistence file restored lazily.")
+	}
+	if expected, got := len(mg), len(groups); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+	for key, group := range mg {
+		restored := groups[key]
+		if expected, got := len(group.Metrics), len(restored.Metrics); expected != got {
+			t.Errorf("Wanted %d metric families, got %d.", expected, got)
+		}
+		for name, tmf := range group.Metrics {
+			got := restored.Metrics[name]
+			if got.GobbableMetricFamily != nil {
+				t.Errorf("Metric family %s loaded before first access.", name)
+			}
+			if !tmf.Timestamp.Equal(got.Timestamp) || tmf.TTL != got.TTL {
+				t.Errorf("Wanted timestamp %v and TTL %v for %s, got %v and %v.", tmf.Timestamp, tmf.TTL, name, got.Timestamp, got.TTL)
+			}
+			if !proto.Equal(tmf.GetMetricFamily(), got.GetMetricFamily()) {
+				t.Errorf("Wanted metric family %s, got %s.", tmf.GetMetricFamily(), got.GetMetricFamily())
+			}
+		}
+	}
+
+	// Persisting releases the persistence file and writes a new index
+	// file.
+	if err := fp.Persist(groups); err != nil {
+		t.Fatal(err)
+	}
+	if fp.restoredLazily() {
+		t.Error("Persistence file not released by persisting.")
+	}
+	if fp, _ = restore(); !fp.restoredLazily() {
+		t.Error("Wanted persistence file restored lazily with the new index file.")
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted metric family is dropped upon access and counted.
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := codec.MarshalMetricFamily(mf3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(content, raw)
+	if i < 0 {
+		t.Fatal("Metric family not found in persistence file.")
+	}
+	content[i+len(raw)-1]++
+	if err := ioutil.WriteFile(fileName, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	fp, groups = restore()
+	if mf := groups[groupingKeyFor(map[string]string{"job": "job2"})].Metrics["mf3"].GetMetricFamily(); mf != nil {
+		t.Errorf("Wanted corrupted metric family dropped, got %s.", mf)
+	}
+	m := &dto.Metric{}
+	if err := fp.corruptions.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1., m.GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted %f corruptions counted, got %f.", expected, got)
+	}
+	if err := fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An index file not matching the persistence file is ignored.
+	delete(mg, groupingKeyFor(map[string]string{"job": "job2"}))
+	if err := newFP(false).Persist(mg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(indexName); err != nil {
+		t.Fatal(err)
+	}
+	if fp, groups = restore(); fp.restoredLazily() || len(groups) != 1 {
+		t.Errorf("Wanted 1 group read as a whole, got %d, restored lazily %v.", len(groups), fp.restoredLazily())
+	}
+
+	// So is a corrupted one.
+	if err := fp.Persist(groups); err != nil {
+		t.Fatal(err)
+	}
+	content, err = ioutil.ReadFile(indexName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[bytes.Index(content, []byte("job1"))] = 'x'
+	if err := ioutil.WriteFile(indexName, content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if fp, groups = restore(); fp.restoredLazily() || len(groups) != 1 {
+		t.Errorf("Wanted 1 group read as a whole, got %d, restored lazily %v.", len(groups), fp.restoredLazily())
+	}
+
+	// Wiping removes the index file, too.
+	if err := fp.Wipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(indexName); !os.IsNotExist(err) {
+		t.Errorf("Wanted index file removed, got %v.", err)
+	}
+}
+
+func TestLazyRestoreDefersPersisting(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestLazyRestoreDefersPersisting.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	newDMS := func() (*DiskMetricStore, *filePersister) {
+		fp := newFilePersister(fileName, "", 0, SyncNever, CompressionNone, logger)
+		fp.index = true
+		return NewPersistentMetricStore(fp, time.Hour, Limits{}, WriteQueueOptions{}, nil, logger), fp
+	}
+	grouping1 := map[string]string{"job": "job1"}
+	grouping2 := map[string]string{"job": "job2"}
+
+	dms, _ := newDMS()
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a),
+	})
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+	// Only in the write-ahead log, to be replayed upon restart.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      time.Now(),
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+	})
+	if err := dms.persister.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replayed change is persisted by the loop rather than during the
+	// restore, which would have to load all metric families first.
+	dms, fp := newDMS()
+	if expected, got := 2, len(dms.GetMetricFamiliesMap()); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+	if !dms.persistOnStart {
+		t.Error("Wanted persisting left to the loop.")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for dms.persistenceLag(time.Now()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Replayed change not persisted.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if fp.restoredLazily() {
+		t.Error("Persistence file not released by persisting.")
+	}
+	pf, err := ReadPersistenceFile(fileName, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(pf.Groups); expected != got {
+		t.Errorf("Wanted %d persisted groups, got %d.", expected, got)
+	}
+}
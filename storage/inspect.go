@@ -0,0 +1,127 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// PersistenceFile is the content of a persistence file, for inspecting and
+// repairing it offline, i.e. while no Pushgateway is using it.
+type PersistenceFile struct {
+	Groups GroupingKeyToMetricGroup
+	// Legacy is true if the file is in the legacy gob format.
+	Legacy bool
+	// Encrypted is true if the file is encrypted.
+	Encrypted bool
+	// Compression is the Compression the file is compressed with. It is
+	// always CompressionNone in the legacy format.
+	Compression Compression
+	// LastSequence is the sequence number of the last write-ahead log
+	// record reflected in the file.
+	LastSequence uint64
+	// Corruptions is the number of corrupted records (or otherwise
+	// corrupted parts) skipped while reading the file.
+	Corruptions int
+	// Deltas is the number of delta files applied to Groups.
+	Deltas int
+}
+
+// ReadPersistenceFile reads the persistence file with the provided name and
+// applies its delta files, if any (see NewIncrementalFilePersister). An
+// encrypted file requires the encryptionKey it was written with. Unlike upon
+// start-up, neither the backup file nor the write-ahead log is considered.
+// Corrupted records are skipped and counted in the result.
+func ReadPersistenceFile(name, encryptionKey string) (*PersistenceFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	enc := newEncryption(encryptionKey)
+	sr, encrypted, compression, err := enc.snapshotReader(f)
+	if err != nil {
+		return nil, err
+	}
+	pf := &PersistenceFile{Encrypted: encrypted, Compression: compression}
+	var r io.Reader
+	pf.Groups, pf.LastSequence, pf.Corruptions, r, err = readSnapshot(sr)
+	if err == errLegacyFormat {
+		pf.Legacy = true
+		pf.Groups, err = readLegacySnapshot(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var corrupted int
+	pf.LastSequence, pf.Deltas, corrupted, err = applyDeltas(name+deltaDirSuffix, pf.LastSequence, enc, pf.Groups)
+	if err != nil {
+		return nil, err
+	}
+	pf.Corruptions += corrupted
+	return pf, nil
+}
+
+// DeleteGroup removes the group with the provided grouping labels from pf. It
+// returns false if there is no such group.
+func (pf *PersistenceFile) DeleteGroup(labels map[string]string) bool {
+	key := groupingKeyFor(labels)
+	if _, ok := pf.Groups[key]; !ok {
+		return false
+	}
+	delete(pf.Groups, key)
+	return true
+}
+
+// WritePersistenceFile writes pf to the file with the provided name, replacing
+// it atomically if it exists. The file is written in the legacy gob format if
+// pf.Legacy is true, and in the current format otherwise, compressed with
+// pf.Compression and encrypted if encryptionKey is not empty. The legacy format cannot be encrypted and has no
+// notion of write-ahead log sequence numbers, so that the whole write-ahead log
+// (and all delta files) will be replayed on top of it. In the current format,
+// pf.LastSequence marks the delta files already reflected in pf as obsolete.
+func WritePersistenceFile(name string, pf *PersistenceFile, encryptionKey string) error {
+	if pf.Legacy && encryptionKey != "" {
+		return errors.New("the legacy format cannot be encrypted")
+	}
+	if pf.Legacy && pf.Compression != "" && pf.Compression != CompressionNone {
+		return errors.New("the legacy format cannot be compressed")
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".in_progress.")
+	if err != nil {
+		return err
+	}
+	inProgressFileName := f.Name()
+	if pf.Legacy {
+		err = gob.NewEncoder(f).Encode(pf.Groups)
+	} else {
+		err = newEncryption(encryptionKey).writeSnapshot(f, pf.Groups, pf.LastSequence, pf.Compression)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(inProgressFileName)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(inProgressFileName)
+		return err
+	}
+	return replaceFile(inProgressFileName, name)
+}
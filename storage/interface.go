@@ -14,12 +14,15 @@
 package storage
 
 import (
+	"math"
 	"sort"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/codec"
 )
 
 // MetricStore is the interface to the storage layer for metrics. All its
@@ -27,8 +30,12 @@ import (
 type MetricStore interface {
 	// SubmitWriteRequest submits a WriteRequest for processing. There is no
 	// guarantee when a request will be processed, but it is guaranteed that
-	// the requests are processed in the order of submission.
-	SubmitWriteRequest(req WriteRequest)
+	// the requests are processed in the order of submission. If the
+	// MetricStore cannot accept the request in time (e.g. because its
+	// write queue is full), ErrWriteQueueFull is returned. If an error is
+	// returned, the request has not been submitted, and its Done channel
+	// will not be closed.
+	SubmitWriteRequest(req WriteRequest) error
 	// GetMetricFamilies returns all the currently saved MetricFamilies. The
 	// returned MetricFamilies are guaranteed to not be modified by the
 	// MetricStore anymore. However, they may still be read somewhere else,
@@ -37,7 +44,8 @@ type MetricStore interface {
 	// are all merged into one MetricFamily by concatenating the contained
 	// Metrics. Inconsistent help strings are logged, and one of the
 	// versions will "win". Inconsistent types and inconsistent or duplicate
-	// label sets will go undetected.
+	// label sets will go undetected. The MetricFamilies are sorted by
+	// name, and the Metrics within each of them by their labels.
 	GetMetricFamilies() []*dto.MetricFamily
 	// GetMetricFamiliesMap returns a map grouping-key -> MetricGroup. The
 	// MetricFamily pointed to by the Metrics map in each MetricGroup is
@@ -74,10 +82,87 @@ type MetricStore interface {
 // given Labels as a grouping key. Otherwise, this is a request to update the
 // MetricStore with the MetricFamilies.
 //
+// If MetricFamilies is nil but MetricNames is not empty, only the metric
+// families with the given names are deleted from the group. A group left without
+// any pushed MetricFamilies is removed completely. The automatically added push
+// timestamp metrics cannot be deleted that way.
+//
+// If MetricFamilies is nil but MetricLabels is not empty, only the metrics with
+// all of the given label pairs are deleted from the group, from the metric
+// families named in MetricNames or, if MetricNames is empty, from all pushed
+// metric families. Metric families left without metrics are removed, and so is
+// a group left without any pushed MetricFamilies.
+//
+// If Wipe is true, this is a request to delete all metrics in the MetricStore at
+// once, no matter what is set in Labels and MetricFamilies. If the MetricStore
+// persists its content, the persistence file and write-ahead log are removed,
+// too.
+//
+// If Flush is true, this is a request to persist the content of the
+// MetricStore right away, after all previously submitted WriteRequests have
+// been processed. Nothing else in the WriteRequest is considered. Errors
+// encountered while persisting are sent to the Done channel. For a MetricStore
+// that does not persist its content, a flush is a no-op.
+//
+// If Lock is true, this is a request to lock the group with the given Labels as
+// grouping key. Pushes to a locked group are rejected with ErrGroupLocked until
+// the group is unlocked again by a WriteRequest with Unlock set. Deleting a
+// locked group (or wiping the MetricStore) is still possible. Nothing else in
+// the WriteRequest is considered. If the group does not exist, ErrGroupNotFound
+// is sent to the Done channel.
+//
+// If RenameTo is not nil, this is a request to move the group with the given
+// Labels as grouping key to the grouping key RenameTo, keeping its metric
+// families with their push timestamps and TTLs, its annotations, and its
+// statistics. The grouping labels of the stored metrics are changed
+// accordingly. Nothing else in the WriteRequest is considered. If the group
+// does not exist, ErrGroupNotFound is sent to the Done channel, if it is
+// locked, ErrGroupLocked, and if a group with the grouping key RenameTo exists
+// already, ErrGroupExists.
+//
+// If Groups is not nil, this is a request to replace the whole content of the
+// MetricStore with the provided metric groups at once, e.g. to restore a
+// snapshot (see ReadSnapshot). The MetricStore takes ownership of Groups, and
+// its Limits are not enforced. Nothing else in the WriteRequest is considered.
+//
 // If Replace is true, the MetricFamilies will completely replace the metrics
 // with the same grouping key. Otherwise, only those MetricFamilies with the
 // same name as new MetricFamilies will be replaced.
 //
+// If Aggregation is set (and Replace is not), the samples of pushed counters,
+// gauges, and untyped metrics are combined with the stored samples of the same
+// metric family and label set (e.g. summed up) rather than replacing them.
+// Stored samples without a pushed counterpart are retained. With AggregateSum,
+// histograms and summaries are merged, too, which requires the same buckets or
+// quantiles, respectively. Pushing a metric family of any other type with an
+// Aggregation set is an error.
+//
+// Annotations are free-form metadata (e.g. the build that produced the pushed
+// metrics) stored with the group of an update. The annotation names follow the
+// rules for label names. If Replace is true, the Annotations replace all
+// annotations of the group. Otherwise, they are merged into the existing ones,
+// and an annotation with an empty value removes the annotation of that name.
+//
+// If ExpectedInterval is positive, it declares for the group of an update that
+// the next successful push is expected within that interval, see
+// MetricGroup.Overdue. If Replace is true, ExpectedInterval replaces the
+// expected interval of the group, i.e. a zero ExpectedInterval removes it.
+// Otherwise, a zero ExpectedInterval leaves the expected interval alone.
+//
+// If Sequence is positive, it is a number chosen by the client, increasing with
+// each push to the group, so that a delayed or retried push can never overwrite
+// the metric families of a later one: An update is rejected with a
+// SequenceError if its Sequence is not greater than the Sequence of the group,
+// and it becomes the Sequence of the group otherwise. An update without a
+// Sequence is never rejected for that reason and leaves the Sequence of the
+// group alone. Note that WriteRequests are processed in the order they have
+// been submitted, so there is no race between two submitted updates.
+//
+// PayloadHash identifies the pushed payload of an update (e.g. the hex-encoded
+// SHA-256 of the request body), see MetricGroup. PayloadSize is its size in
+// bytes, or zero if unknown. PushFormat describes the wire format of the
+// payload, or it is zero if unknown.
+//
 // The key in MetricFamilies is the name of the mapped metric family.
 //
 // When the WriteRequest is processed, the metrics in MetricFamilies will be
@@ -88,18 +173,206 @@ type MetricStore interface {
 //
 // The Timestamp field marks the time the request was received from the
 // network. It is not related to the TimestampMs field in the Metric proto
-// message. In fact, WriteRequests containing any Metrics with a TimestampMs set
-// are invalid and will be rejected.
+// message. WriteRequests containing any Metrics with a TimestampMs set are
+// invalid and will be rejected, unless AllowTimestamps is true.
+//
+// If TTL is positive, the MetricFamilies in the WriteRequest expire once TTL
+// has passed after Timestamp. Expired MetricFamilies are removed from the
+// MetricStore automatically. A group left without any pushed MetricFamilies by
+// the expiration is removed completely. The automatically added push timestamp
+// metrics never expire on their own.
 //
 // The Done channel may be nil. If it is not nil, it will be closed once the
 // write request is processed. Any errors occurring during processing are sent to
 // the channel before closing it.
 type WriteRequest struct {
-	Labels         map[string]string
-	Timestamp      time.Time
-	MetricFamilies map[string]*dto.MetricFamily
-	Replace        bool
-	Done           chan error
+	Labels           map[string]string
+	Timestamp        time.Time
+	MetricFamilies   map[string]*dto.MetricFamily
+	MetricNames      []string
+	MetricLabels     map[string]string
+	Replace          bool
+	Wipe             bool
+	Flush            bool
+	Lock             bool
+	Unlock           bool
+	TTL              time.Duration
+	AllowTimestamps  bool
+	Aggregation      Aggregation
+	Annotations      map[string]string
+	ExpectedInterval time.Duration
+	Sequence         uint64
+	PayloadHash      string
+	PayloadSize      int
+	PushFormat       PushFormat
+	Groups           GroupingKeyToMetricGroup
+	RenameTo         map[string]string
+	Done             chan error
+}
+
+// PushFormat describes how the payload of a push was encoded on the wire.
+type PushFormat struct {
+	// ContentType is the Content-Type header of the push as sent by the
+	// client, including its parameters (e.g. the version of the format).
+	ContentType string
+	// ContentEncoding is the Content-Encoding header of the push as sent
+	// by the client (e.g. "gzip"), empty if the payload was not compressed.
+	ContentEncoding string
+	// Format is the exposition format the payload was decoded as.
+	Format codec.Format
+}
+
+// Aggregation determines how the samples in a WriteRequest are combined with
+// the stored samples, see WriteRequest.
+type Aggregation string
+
+// Valid Aggregation values.
+const (
+	// AggregateNone replaces the stored samples.
+	AggregateNone Aggregation = ""
+	// AggregateSum adds the pushed values to the stored values.
+	AggregateSum Aggregation = "sum"
+	// AggregateMax stores the larger of the pushed and the stored value.
+	AggregateMax Aggregation = "max"
+)
+
+// MatchingMetricStore is implemented by MetricStores that can efficiently
+// return only the metrics matched by series selectors.
+type MatchingMetricStore interface {
+	// GetMatchingMetricFamilies returns the same as GetMetricFamilies,
+	// but only with the metrics matched by any of the provided Selectors.
+	// Metric families left without metrics are omitted.
+	GetMatchingMetricFamilies(selectors []Selector) []*dto.MetricFamily
+}
+
+// MatchingMetricFamilies returns the metric families in ms matched by any of the
+// provided Selectors, using GetMatchingMetricFamilies if ms is a
+// MatchingMetricStore. Without Selectors, all metric families are returned.
+func MatchingMetricFamilies(ms MetricStore, selectors []Selector) []*dto.MetricFamily {
+	if len(selectors) == 0 {
+		return ms.GetMetricFamilies()
+	}
+	if mms, ok := ms.(MatchingMetricStore); ok {
+		return mms.GetMatchingMetricFamilies(selectors)
+	}
+	return SelectMetricFamilies(ms.GetMetricFamilies(), selectors)
+}
+
+// GroupMetricStore is implemented by MetricStores that can efficiently look up
+// a single metric group.
+type GroupMetricStore interface {
+	// GetMetricGroup returns the MetricGroup with the provided grouping
+	// labels and true, or false if there is no such group. The same
+	// ownership rules as for GetMetricFamiliesMap apply.
+	GetMetricGroup(labels map[string]string) (MetricGroup, bool)
+}
+
+// GetMetricGroup returns the MetricGroup in ms with the provided grouping labels
+// and true, or false if there is no such group. It uses GetMetricGroup if ms is
+// a GroupMetricStore.
+func GetMetricGroup(ms MetricStore, labels map[string]string) (MetricGroup, bool) {
+	if gms, ok := ms.(GroupMetricStore); ok {
+		return gms.GetMetricGroup(labels)
+	}
+	group, ok := ms.GetMetricFamiliesMap()[groupingKeyFor(labels)]
+	return group, ok
+}
+
+// StreamingMetricStore is implemented by MetricStores that can hand out their
+// metric families one at a time, without materializing all of them at once.
+type StreamingMetricStore interface {
+	// WalkMetricFamilies calls f for each metric family that
+	// GetShardMetricFamilies would return for the provided Shard and
+	// Selectors, in the same order, together with the groups it has been
+	// merged from, ordered by grouping key. If groups is not nil, it is
+	// called once before that with all groups in the Shard. Both see the
+	// same state of the MetricStore. The first error returned by groups or
+	// f stops the walk and is returned. The same ownership rules as for
+	// GetMetricFamilies apply to the metric families, while the groups and
+	// their Metrics maps are shared with the MetricStore and must not be
+	// modified.
+	WalkMetricFamilies(shard Shard, selectors []Selector, groups func(GroupingKeyToMetricGroup) error, f func(*dto.MetricFamily, []MetricGroup) error) error
+}
+
+// WalkMetricFamilies calls groups (if not nil) and then f like the
+// WalkMetricFamilies method of StreamingMetricStore does, which it uses if ms
+// is a StreamingMetricStore. Otherwise, the groups and the metric families
+// returned by ShardMetricFamilies might not see the same state of ms.
+func WalkMetricFamilies(ms MetricStore, shard Shard, selectors []Selector, groups func(GroupingKeyToMetricGroup) error, f func(*dto.MetricFamily, []MetricGroup) error) error {
+	if sms, ok := ms.(StreamingMetricStore); ok {
+		return sms.WalkMetricFamilies(shard, selectors, groups, f)
+	}
+	shardGroups := shard.Groups(ms.GetMetricFamiliesMap())
+	if groups != nil {
+		if err := groups(shardGroups); err != nil {
+			return err
+		}
+	}
+	byName := groupsByName(shardGroups)
+	for _, mf := range ShardMetricFamilies(ms, shard, selectors) {
+		if err := f(mf, byName[mf.GetName()]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupsByName returns the provided groups by the names of the metric families
+// they contain, each ordered by grouping key.
+func groupsByName(groups GroupingKeyToMetricGroup) map[string][]MetricGroup {
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := map[string][]MetricGroup{}
+	for _, k := range keys {
+		group := groups[k]
+		for name := range group.Metrics {
+			result[name] = append(result[name], group)
+		}
+	}
+	return result
+}
+
+// ValidatingMetricStore is implemented by MetricStores that can check a
+// WriteRequest against the stored metrics without applying it.
+type ValidatingMetricStore interface {
+	// ValidateWriteRequest returns the error that would be sent to the
+	// Done channel of the provided WriteRequest if it was submitted now,
+	// or nil if it would be applied successfully. The MetricStore is not
+	// modified, but the MetricFamilies of the WriteRequest might be
+	// sanitized as upon processing.
+	ValidateWriteRequest(wr WriteRequest) error
+}
+
+// StatusReporter is implemented by MetricStores that can report their internal
+// state, like DiskMetricStore.
+type StatusReporter interface {
+	Status() StoreStatus
+}
+
+// StoreStatus is the internal state of a MetricStore at a point in time. Like
+// with Limits, metric families and samples are only counted if they have been
+// pushed.
+type StoreStatus struct {
+	WriteQueueLength   int
+	WriteQueueCapacity int
+	Groups             int
+	MetricFamilies     int
+	Samples            int
+
+	// The remaining fields are only set if Persisting is true.
+	Persisting bool
+	// LastPersistTime is when the last attempt to persist has finished,
+	// or the zero time if there has been none yet.
+	LastPersistTime        time.Time
+	LastPersistDuration    time.Duration
+	LastPersistError       error // Result of the last attempt to persist.
+	LastPersistSuccessTime time.Time
+	// PersistenceSize is the size of the persistence file in bytes, or -1
+	// if unknown (e.g. if persisting to object storage).
+	PersistenceSize int64
 }
 
 // GroupingKeyToMetricGroup is the first level of the metric store, keyed by
@@ -107,9 +380,75 @@ type WriteRequest struct {
 type GroupingKeyToMetricGroup map[string]MetricGroup
 
 // MetricGroup adds the grouping labels to a NameToTimestampedMetricFamilyMap.
+//
+// PayloadHash is the PayloadHash of the WriteRequest that resulted in the
+// current pushed metric families of the group. It is empty if they are not
+// exactly the ones of a single push, e.g. because the push was merged with
+// other metric families, aggregated, or some metric families have expired or
+// been deleted since.
+//
+// ExpectedInterval is the interval within which the next successful push to
+// the group is expected as declared by the pushes, or zero if none has been
+// declared, see WriteRequest.
+//
+// PushFormat is the PushFormat of the last successful push to the group, zero
+// if unknown.
+//
+// Sequence is the greatest Sequence of the updates applied to the group, or
+// zero if none had one, see WriteRequest.
+//
+// Pushes, FailedPushes, LastPushSize, and LastPushDuration are statistics kept
+// in memory only: Pushes counts the pushes to the group processed since the
+// start-up, including failed ones, and FailedPushes only the failed ones (e.g.
+// rejected because of an inconsistency or a limit). LastPushSize is the
+// PayloadSize of the last successful push, and LastPushDuration is the time
+// from receiving it (i.e. its Timestamp) until it was applied, or zero if
+// unknown (e.g. after a restart). LastPushError is the error the last failed
+// push was rejected with, empty if unknown. It is kept after a successful push,
+// see LastPushFailureTime and LastPushSuccess. See also PushesToday.
 type MetricGroup struct {
-	Labels  map[string]string
-	Metrics NameToTimestampedMetricFamilyMap
+	Labels      map[string]string
+	Metrics     NameToTimestampedMetricFamilyMap
+	Locked      bool              // If true, pushes to the group are rejected.
+	Annotations map[string]string // Never modified in place, see WriteRequest.
+	PayloadHash string
+
+	ExpectedInterval time.Duration
+	PushFormat       PushFormat
+	Sequence         uint64
+
+	Pushes           int
+	FailedPushes     int
+	LastPushSize     int
+	LastPushDuration time.Duration
+	LastPushError    string
+	pushesToday      int
+	pushDay          int64 // The day pushesToday counts, see unixDay.
+}
+
+// PushesToday returns the number of pushes to the group processed since the
+// start of the day (in UTC) of the provided time, including failed ones. Like
+// Pushes, only pushes since the start-up are counted.
+func (mg MetricGroup) PushesToday(now time.Time) int {
+	if mg.pushDay != unixDay(now) {
+		return 0
+	}
+	return mg.pushesToday
+}
+
+// countPush counts a push received at the provided time.
+func (mg *MetricGroup) countPush(ts time.Time) {
+	mg.Pushes++
+	if day := unixDay(ts); day != mg.pushDay {
+		mg.pushDay = day
+		mg.pushesToday = 0
+	}
+	mg.pushesToday++
+}
+
+// unixDay returns the number of days (in UTC) since the Unix epoch at t.
+func unixDay(t time.Time) int64 {
+	return t.Unix() / (24 * 60 * 60)
 }
 
 // SortedLabels returns the label names of the grouping labels sorted
@@ -133,15 +472,153 @@ func (mg MetricGroup) SortedLabels() []string {
 // all other cases, it returns true (including the case that one or both of
 // those metrics are missing for some reason.)
 func (mg MetricGroup) LastPushSuccess() bool {
-	fail := mg.Metrics[pushFailedMetricName].GobbableMetricFamily
+	fail := mg.Metrics[pushFailedMetricName].GetMetricFamily()
 	if fail == nil {
 		return true
 	}
-	success := mg.Metrics[pushMetricName].GobbableMetricFamily
+	success := mg.Metrics[pushMetricName].GetMetricFamily()
 	if success == nil {
 		return true
 	}
-	return (*dto.MetricFamily)(fail).GetMetric()[0].GetGauge().GetValue() <= (*dto.MetricFamily)(success).GetMetric()[0].GetGauge().GetValue()
+	return fail.GetMetric()[0].GetGauge().GetValue() <= success.GetMetric()[0].GetGauge().GetValue()
+}
+
+// LastPushTime returns the time of the last successful push as recorded by the
+// automatically added metric for the timestamp of the last successful push. The
+// zero time is returned if there was no successful push yet (or the metric is
+// missing for some reason).
+func (mg MetricGroup) LastPushTime() time.Time {
+	return mg.timestamp(pushMetricName)
+}
+
+// LastPushFailureTime returns the time of the last failed push as recorded by
+// the automatically added metric for the timestamp of the last failed push. The
+// zero time is returned if no push has failed yet (or the metric is missing for
+// some reason).
+func (mg MetricGroup) LastPushFailureTime() time.Time {
+	return mg.timestamp(pushFailedMetricName)
+}
+
+// timestamp returns the time recorded by the automatically added timestamp
+// metric of the provided name, or the zero time if it is missing or zero.
+func (mg MetricGroup) timestamp(name string) time.Time {
+	mf := mg.Metrics[name].GetMetricFamily()
+	if mf == nil {
+		return time.Time{}
+	}
+	v := mf.GetMetric()[0].GetGauge().GetValue()
+	if v == 0 {
+		return time.Time{}
+	}
+	secs, frac := math.Modf(v)
+	return time.Unix(int64(secs), int64(frac*1e9))
+}
+
+// Overdue returns true if the group has an ExpectedInterval and the last
+// successful push (see LastPushTime) is longer ago than that at the provided
+// time.
+func (mg MetricGroup) Overdue(now time.Time) bool {
+	if mg.ExpectedInterval <= 0 {
+		return false
+	}
+	return now.Sub(mg.LastPushTime()) > mg.ExpectedInterval
+}
+
+// Expiration returns the time at which the group expires, i.e. at which the TTL
+// of the last of its pushed metric families elapses (see
+// TimestampedMetricFamily). The zero time is returned if any of its pushed
+// metric families has no TTL, or if there are no pushed metric families.
+func (mg MetricGroup) Expiration() time.Time {
+	var exp time.Time
+	for name, tmf := range mg.Metrics {
+		if name == pushMetricName || name == pushFailedMetricName {
+			continue
+		}
+		e := tmf.Expiration()
+		if e.IsZero() {
+			return time.Time{}
+		}
+		if e.After(exp) {
+			exp = e
+		}
+	}
+	return exp
+}
+
+// MetricNames returns the sorted names of the pushed metric families in the
+// group, i.e. without the automatically added push timestamp metrics.
+func (mg MetricGroup) MetricNames() []string {
+	names := make([]string, 0, len(mg.Metrics))
+	for name := range mg.Metrics {
+		if name != pushMetricName && name != pushFailedMetricName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Unchanged returns whether processing the provided update would not change
+// the group apart from its push timestamps, judged by the PayloadHash of both.
+// In that case, processing the update can be skipped, although the push time
+// and the time to live of the pushed metric families are not refreshed then.
+// An update with an Aggregation set always changes the group.
+func (mg MetricGroup) Unchanged(wr WriteRequest) bool {
+	if mg.PayloadHash == "" || wr.PayloadHash != mg.PayloadHash || wr.Aggregation != AggregateNone {
+		return false
+	}
+	if mergeExpectedInterval(mg.ExpectedInterval, wr.ExpectedInterval, wr.Replace) != mg.ExpectedInterval {
+		return false
+	}
+	if wr.Sequence > 0 && wr.Sequence != mg.Sequence {
+		return false
+	}
+	annotations := mergeAnnotations(mg.Annotations, wr.Annotations, wr.Replace)
+	if len(annotations) != len(mg.Annotations) {
+		return false
+	}
+	for name, value := range annotations {
+		if stored, ok := mg.Annotations[name]; !ok || stored != value {
+			return false
+		}
+	}
+	return true
+}
+
+// NumMetricFamilies returns the number of pushed metric families in the group,
+// i.e. not counting the automatically added push timestamp metrics.
+func (mg MetricGroup) NumMetricFamilies() int {
+	n := 0
+	for name := range mg.Metrics {
+		if name != pushMetricName && name != pushFailedMetricName {
+			n++
+		}
+	}
+	return n
+}
+
+// NumSamples returns the number of samples in the pushed metric families of the
+// group, see NumSamples and NumMetricFamilies.
+func (mg MetricGroup) NumSamples() int {
+	n := 0
+	for name, tmf := range mg.Metrics {
+		if name != pushMetricName && name != pushFailedMetricName {
+			n += NumSamples(tmf.GetMetricFamily())
+		}
+	}
+	return n
+}
+
+// SizeBytes returns the size of the pushed metric families of the group in their
+// protobuf encoding.
+func (mg MetricGroup) SizeBytes() int {
+	n := 0
+	for name, tmf := range mg.Metrics {
+		if mf := tmf.GetMetricFamily(); mf != nil && name != pushMetricName && name != pushFailedMetricName {
+			n += proto.Size(mf)
+		}
+	}
+	return n
 }
 
 // NameToTimestampedMetricFamilyMap is the second level of the metric store,
@@ -149,27 +626,65 @@ func (mg MetricGroup) LastPushSuccess() bool {
 type NameToTimestampedMetricFamilyMap map[string]TimestampedMetricFamily
 
 // TimestampedMetricFamily adds the push timestamp to a gobbable version of the
-// MetricFamily-DTO.
+// MetricFamily-DTO. A positive TTL is the time to live of the MetricFamily,
+// counted from the push timestamp.
+//
+// A TimestampedMetricFamily restored lazily from the persistence file (see
+// index.go) has a nil GobbableMetricFamily until it is replaced. Use
+// GetMetricFamily to access the MetricFamily.
 type TimestampedMetricFamily struct {
 	Timestamp            time.Time
 	GobbableMetricFamily *GobbableMetricFamily
+	TTL                  time.Duration
+
+	lazy *lazyFamily
+}
+
+// Expiration returns the time at which the MetricFamily expires. If no TTL has
+// been set, the zero time is returned.
+func (tmf TimestampedMetricFamily) Expiration() time.Time {
+	if tmf.TTL <= 0 {
+		return time.Time{}
+	}
+	return tmf.Timestamp.Add(tmf.TTL)
+}
+
+// expired returns true if the MetricFamily has a TTL that has elapsed at the
+// provided time.
+func (tmf TimestampedMetricFamily) expired(now time.Time) bool {
+	exp := tmf.Expiration()
+	return !exp.IsZero() && !now.Before(exp)
 }
 
 // GetMetricFamily returns the normal GetMetricFamily DTO (without the gob additions).
+// A lazily restored MetricFamily is loaded on first access. If it cannot be
+// loaded, nil is returned like for any corrupted MetricFamily.
 func (tmf TimestampedMetricFamily) GetMetricFamily() *dto.MetricFamily {
+	if tmf.GobbableMetricFamily == nil && tmf.lazy != nil {
+		return tmf.lazy.get()
+	}
 	return (*dto.MetricFamily)(tmf.GobbableMetricFamily)
 }
 
+// withMetricFamily returns a copy of tmf with the provided MetricFamily. Unlike
+// setting GobbableMetricFamily, it drops the reference to a lazily restored
+// MetricFamily so that the latter can be garbage collected.
+func (tmf TimestampedMetricFamily) withMetricFamily(mf *dto.MetricFamily) TimestampedMetricFamily {
+	tmf.GobbableMetricFamily = (*GobbableMetricFamily)(mf)
+	tmf.lazy = nil
+	return tmf
+}
+
 // GobbableMetricFamily is a dto.MetricFamily that implements GobDecoder and
 // GobEncoder.
 type GobbableMetricFamily dto.MetricFamily
 
 // GobDecode implements gob.GobDecoder.
 func (gmf *GobbableMetricFamily) GobDecode(b []byte) error {
-	return proto.Unmarshal(b, (*dto.MetricFamily)(gmf))
+	return codec.UnmarshalMetricFamily(b, (*dto.MetricFamily)(gmf))
 }
 
 // GobEncode implements gob.GobEncoder.
 func (gmf *GobbableMetricFamily) GobEncode() ([]byte, error) {
-	return proto.Marshal((*dto.MetricFamily)(gmf))
+	return codec.MarshalMetricFamily((*dto.MetricFamily)(gmf))
 }
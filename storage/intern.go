@@ -0,0 +1,196 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sort"
+	"time"
+	"unsafe"
+
+	"github.com/go-kit/kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Estimated sizes of the deduplicated objects in memory.
+const (
+	labelPairSize = int(unsafe.Sizeof(dto.LabelPair{}))
+	stringSize    = int(unsafe.Sizeof(""))
+)
+
+type labelPairKey struct {
+	name, value string
+}
+
+// interner finds identical label pairs and help strings in metric families
+// and replaces them by the first one seen, so that they are kept in memory only
+// once. Fan-out jobs pushing the same metric families under many groups (e.g.
+// one per instance) thus share most of their label pairs and all their help
+// strings.
+type interner struct {
+	labelPairs map[labelPairKey]*dto.LabelPair
+	helps      map[string]*string
+	saved      int // Estimated bytes saved by sharing.
+}
+
+func newInterner() *interner {
+	return &interner{
+		labelPairs: map[labelPairKey]*dto.LabelPair{},
+		helps:      map[string]*string{},
+	}
+}
+
+// metricFamily returns a copy of the provided MetricFamily with interned label
+// pairs and help string, and true. If everything is interned already, the
+// provided MetricFamily is returned with false. The provided MetricFamily is
+// never modified.
+func (in *interner) metricFamily(mf *dto.MetricFamily) (*dto.MetricFamily, bool) {
+	help := in.help(mf.Help)
+	var metrics []*dto.Metric
+	for i, m := range mf.GetMetric() {
+		lps, changed := in.labelPairList(m.GetLabel())
+		if !changed {
+			continue
+		}
+		if metrics == nil {
+			metrics = append(make([]*dto.Metric, 0, len(mf.Metric)), mf.Metric...)
+		}
+		mc := *m
+		mc.Label = lps
+		metrics[i] = &mc
+	}
+	if help == mf.Help && metrics == nil {
+		return mf, false
+	}
+	mfc := *mf
+	mfc.Help = help
+	if metrics != nil {
+		mfc.Metric = metrics
+	}
+	return &mfc, true
+}
+
+// labelPairList returns the provided label pairs with each of them replaced by
+// its interned counterpart. If that changes anything, a new slice is returned
+// with true.
+func (in *interner) labelPairList(lps []*dto.LabelPair) ([]*dto.LabelPair, bool) {
+	var result []*dto.LabelPair
+	for i, lp := range lps {
+		interned := in.labelPair(lp)
+		if interned != lp && result == nil {
+			result = append(make([]*dto.LabelPair, 0, len(lps)), lps...)
+		}
+		if result != nil {
+			result[i] = interned
+		}
+	}
+	if result == nil {
+		return lps, false
+	}
+	return result, true
+}
+
+func (in *interner) labelPair(lp *dto.LabelPair) *dto.LabelPair {
+	key := labelPairKey{name: lp.GetName(), value: lp.GetValue()}
+	if interned, ok := in.labelPairs[key]; ok {
+		in.saved += labelPairSize + 2*stringSize + len(key.name) + len(key.value)
+		return interned
+	}
+	in.labelPairs[key] = lp
+	return lp
+}
+
+func (in *interner) help(help *string) *string {
+	if help == nil {
+		return nil
+	}
+	if interned, ok := in.helps[*help]; ok {
+		in.saved += stringSize + len(*help)
+		return interned
+	}
+	in.helps[*help] = help
+	return help
+}
+
+// SetInternInterval sets the interval at which identical label pairs and help
+// strings of the stored metric families are deduplicated in memory. Zero (the
+// default) disables the deduplication.
+func (dms *DiskMetricStore) SetInternInterval(interval time.Duration) {
+	dms.lock.Lock()
+	defer dms.lock.Unlock()
+	dms.internInterval = interval
+}
+
+// internDue returns true if the intern interval has elapsed since the last
+// call of intern. It must only be called from the store loop.
+func (dms *DiskMetricStore) internDue(now time.Time) bool {
+	dms.lock.RLock()
+	interval := dms.internInterval
+	dms.lock.RUnlock()
+	return interval > 0 && now.Sub(dms.lastIntern) >= interval
+}
+
+// intern deduplicates the label pairs and help strings of all stored metric
+// families, see interner. The groups and metric families are iterated in a
+// reproducible order, so that the same objects are kept in every run and
+// nothing has to be copied if nothing has been pushed in the meantime. As the
+// groups are copy-on-write, changed groups are stored as copies. The stored
+// metrics do not change semantically, so nothing has to be persisted. intern
+// must only be called from the store loop.
+func (dms *DiskMetricStore) intern(now time.Time) {
+	groups := dms.groupsSnapshot()
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	in := newInterner()
+	changed := GroupingKeyToMetricGroup{}
+	for _, key := range keys {
+		group := groups[key]
+		names := make([]string, 0, len(group.Metrics))
+		for name := range group.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var metrics NameToTimestampedMetricFamilyMap
+		for _, name := range names {
+			tmf := group.Metrics[name]
+			if tmf.GetMetricFamily() == nil {
+				continue
+			}
+			mf, ok := in.metricFamily(tmf.GetMetricFamily())
+			if !ok {
+				continue
+			}
+			if metrics == nil {
+				metrics = copyMetrics(group.Metrics)
+			}
+			metrics[name] = tmf.withMetricFamily(mf)
+		}
+		if metrics != nil {
+			group.Metrics = metrics
+			changed[key] = group
+		}
+	}
+
+	dms.lock.Lock()
+	for key, group := range changed {
+		dms.metricGroups[key] = group
+	}
+	dms.lock.Unlock()
+	dms.lastIntern = now
+	dms.internSavedBytes.Set(float64(in.saved))
+	level.Debug(dms.logger).Log("msg", "metric families interned", "changed_groups", len(changed), "saved_bytes", in.saved)
+}
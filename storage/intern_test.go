@@ -0,0 +1,108 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+func TestIntern(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	defer dms.Shutdown()
+
+	newMF := func() *dto.MetricFamily {
+		return &dto.MetricFamily{
+			Name: proto.String("requests_total"),
+			Help: proto.String("Total number of requests."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}},
+					Counter: &dto.Counter{Value: proto.Float64(1)},
+				},
+				{
+					Label:   []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("500")}},
+					Counter: &dto.Counter{Value: proto.Float64(2)},
+				},
+			},
+		}
+	}
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job1", "instance": "instance2"}
+	for _, grouping := range []map[string]string{grouping1, grouping2} {
+		submit(t, dms, WriteRequest{
+			Labels:         grouping,
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(newMF()),
+		})
+	}
+	savedBytes := func() float64 {
+		m := &dto.Metric{}
+		if err := dms.internSavedBytes.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+	before := dms.GetMetricFamilies()
+
+	dms.intern(time.Now())
+	saved := savedBytes()
+	if saved <= 0 {
+		t.Errorf("Wanted saved bytes, got %v.", saved)
+	}
+	after := dms.GetMetricFamilies()
+	if expected, got := len(before), len(after); expected != got {
+		t.Fatalf("Wanted %d metric families, got %d.", expected, got)
+	}
+	for i := range before {
+		if !proto.Equal(before[i], after[i]) {
+			t.Errorf("Wanted unchanged metric family %s, got %s.", before[i], after[i])
+		}
+	}
+
+	group1, _ := dms.GetMetricGroup(grouping1)
+	group2, _ := dms.GetMetricGroup(grouping2)
+	mf1 := group1.Metrics["requests_total"].GetMetricFamily()
+	mf2 := group2.Metrics["requests_total"].GetMetricFamily()
+	if mf1.Help != mf2.Help {
+		t.Error("Wanted shared help string.")
+	}
+	for i, m := range mf1.Metric {
+		// Labels are sorted, i.e. code, instance, job.
+		for _, j := range []int{0, 2} {
+			if m.Label[j] != mf2.Metric[i].Label[j] {
+				t.Errorf("Wanted shared label pair %s.", m.Label[j])
+			}
+		}
+		if m.Label[1] == mf2.Metric[i].Label[1] {
+			t.Errorf("Wanted distinct label pairs for %s and %s.", m.Label[1], mf2.Metric[i].Label[1])
+		}
+	}
+
+	// Nothing has to be copied again if nothing has been pushed.
+	dms.intern(time.Now())
+	group1Again, _ := dms.GetMetricGroup(grouping1)
+	if group1Again.Metrics["requests_total"].GetMetricFamily() != mf1 {
+		t.Error("Wanted unchanged metric family after interning again.")
+	}
+	if expected, got := saved, savedBytes(); expected != got {
+		t.Errorf("Wanted %v saved bytes, got %v.", expected, got)
+	}
+}
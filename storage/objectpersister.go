@@ -0,0 +1,200 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// objectName is the name of the object holding the snapshot, relative to the
+// prefix provided in the persistence URL.
+const objectName = "pushgateway"
+
+const (
+	defaultS3Region  = "us-east-1"
+	gcsEndpoint      = "https://storage.googleapis.com"
+	gcsRegion        = "auto"
+	envAccessKeyID   = "AWS_ACCESS_KEY_ID"
+	envSecretKey     = "AWS_SECRET_ACCESS_KEY"
+	envSessionToken  = "AWS_SESSION_TOKEN"
+	envDefaultRegion = "AWS_REGION"
+)
+
+// objectPersister persists snapshots as a single object in an object storage.
+// It does not log individual changes, so changes since the last persisting are
+// lost upon a crash.
+type objectPersister struct {
+	client *s3Client
+	key    string
+	enc    *encryption
+	logger log.Logger
+	// restoreFailed prevents overwriting a snapshot that could not be
+	// restored, e.g. because of a temporary network problem.
+	restoreFailed bool
+}
+
+// NewObjectPersister returns a Persister that stores snapshots in an object
+// storage bucket. The provided URL has the form "s3://bucket/prefix" for Amazon
+// S3 or "gs://bucket/prefix" for Google Cloud Storage. The snapshot is stored
+// in an object named "pushgateway" below the prefix.
+//
+// For S3, the query parameters "region" (default: the AWS_REGION environment
+// variable or "us-east-1") and "endpoint" (for S3-compatible storage, which is
+// then addressed path-style) are supported. The credentials are taken from the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and (optionally) AWS_SESSION_TOKEN
+// environment variables. Google Cloud Storage is accessed via its XML API, which
+// requires the environment variables to contain an HMAC key.
+//
+// If encryptionKey is not empty, the snapshot is encrypted like the persistence
+// file of NewFilePersister.
+func NewObjectPersister(rawURL, encryptionKey string, logger log.Logger) (Persister, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no bucket in persistence URL %q", rawURL)
+	}
+	c := &s3Client{
+		bucket: u.Host,
+		creds: s3Credentials{
+			accessKeyID:     os.Getenv(envAccessKeyID),
+			secretAccessKey: os.Getenv(envSecretKey),
+			sessionToken:    os.Getenv(envSessionToken),
+		},
+		client: &http.Client{Timeout: s3RequestTimeout},
+		now:    time.Now,
+	}
+	if c.creds.accessKeyID == "" || c.creds.secretAccessKey == "" {
+		return nil, fmt.Errorf("%s and %s have to be set to access %q", envAccessKeyID, envSecretKey, rawURL)
+	}
+	query := u.Query()
+	endpoint := query.Get("endpoint")
+	switch u.Scheme {
+	case "s3":
+		c.region = query.Get("region")
+		if c.region == "" {
+			c.region = os.Getenv(envDefaultRegion)
+		}
+		if c.region == "" {
+			c.region = defaultS3Region
+		}
+		if endpoint == "" {
+			endpoint = "https://s3." + c.region + ".amazonaws.com"
+		} else {
+			c.pathStyle = true
+		}
+	case "gs":
+		c.region = gcsRegion
+		if endpoint == "" {
+			endpoint = gcsEndpoint
+		}
+		c.pathStyle = true
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in persistence URL %q, supported are s3 and gs", u.Scheme, rawURL)
+	}
+	if c.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	if c.endpoint.Scheme == "" || c.endpoint.Host == "" {
+		return nil, fmt.Errorf("endpoint %q has to be an absolute URL like http://localhost:9000", endpoint)
+	}
+
+	key := objectName
+	if prefix := strings.Trim(u.Path, "/"); prefix != "" {
+		key = prefix + "/" + objectName
+	}
+	return &objectPersister{client: c, key: key, enc: newEncryption(encryptionKey), logger: logger}, nil
+}
+
+// Restore implements Persister. A missing object is not an error. If restoring
+// fails for any other reason, the objectPersister refuses to persist anything
+// later to not overwrite the existing snapshot.
+func (op *objectPersister) Restore() (GroupingKeyToMetricGroup, bool, error) {
+	op.restoreFailed = true
+	content, err := op.client.get(op.key)
+	if err != nil {
+		return nil, false, err
+	}
+	if content == nil {
+		level.Info(op.logger).Log("msg", "no snapshot found in object storage", "object", op.key)
+		op.restoreFailed = false
+		return GroupingKeyToMetricGroup{}, false, nil
+	}
+	sr, encrypted, _, err := op.enc.snapshotReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, false, err
+	}
+	groups, _, corrupted, _, err := readSnapshot(sr)
+	if err != nil {
+		return nil, false, err
+	}
+	op.restoreFailed = false
+	if corrupted > 0 {
+		level.Warn(op.logger).Log(
+			"msg", "snapshot is corrupted, restored what could be read",
+			"object", op.key, "corruptions", corrupted, "groups_restored", len(groups),
+		)
+		return groups, true, nil
+	}
+	return groups, op.enc != nil && !encrypted, nil
+}
+
+// Replay implements Persister. As no changes are logged, there is nothing to
+// replay.
+func (op *objectPersister) Replay(func(wr WriteRequest, pushFailed bool)) (int, error) {
+	return 0, nil
+}
+
+// Log implements Persister. It is a no-op.
+func (op *objectPersister) Log(WriteRequest, bool) error {
+	return nil
+}
+
+// Persist implements Persister. It uploads a snapshot, replacing the previous
+// one.
+func (op *objectPersister) Persist(groups GroupingKeyToMetricGroup) error {
+	if op.restoreFailed {
+		return fmt.Errorf("not overwriting object %q as it could not be restored", op.key)
+	}
+	var buf bytes.Buffer
+	if err := op.enc.writeSnapshot(&buf, groups, 0, CompressionNone); err != nil {
+		return err
+	}
+	return op.client.put(op.key, buf.Bytes())
+}
+
+// Wipe implements Persister. A successful wipe allows persisting again after a
+// failed restore.
+func (op *objectPersister) Wipe() error {
+	if err := op.client.delete(op.key); err != nil {
+		return err
+	}
+	op.restoreFailed = false
+	return nil
+}
+
+// Close implements Persister.
+func (op *objectPersister) Close() error {
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+// fakeS3 is a minimal in-memory implementation of the S3 object API.
+type fakeS3 struct {
+	mtx     sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		http.Error(w, "missing or wrong Authorization header", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		content, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	case http.MethodPut:
+		content, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if expected, got := sha256Hex(content), r.Header.Get("X-Amz-Content-Sha256"); expected != got {
+			http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = content
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestObjectPersister(t *testing.T) {
+	for name, value := range map[string]string{
+		envAccessKeyID: "AKID",
+		envSecretKey:   "secret",
+	} {
+		old, ok := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	s3 := &fakeS3{objects: map[string][]byte{}}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+	persistenceURL := "s3://bucket/some/prefix/?endpoint=" + server.URL
+
+	for _, u := range []string{"s3://", "ftp://bucket/prefix", "s3://bucket/prefix?endpoint=minio:9000"} {
+		if _, err := NewObjectPersister(u, "", logger); err == nil {
+			t.Errorf("Expected error for persistence URL %q.", u)
+		}
+	}
+
+	p, err := NewObjectPersister(persistenceURL, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dms := NewPersistentMetricStore(p, time.Hour, Limits{}, WriteQueueOptions{}, nil, logger)
+	ts := time.Now()
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping,
+		Timestamp:      ts,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+	})
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s3.objects["/bucket/some/prefix/pushgateway"]; !ok {
+		t.Fatalf("Snapshot not uploaded, objects: %v", s3.objects)
+	}
+
+	p, err = NewObjectPersister(persistenceURL, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dms = NewPersistentMetricStore(p, time.Hour, Limits{}, WriteQueueOptions{}, nil, logger)
+	if err := checkMetricFamilies(
+		dms, mf3,
+		newPushTimestampGauge(grouping, ts),
+		newPushFailedTimestampGauge(grouping, time.Time{}),
+	); err != nil {
+		t.Error(err)
+	}
+
+	submit(t, dms, WriteRequest{
+		Timestamp: ts,
+		Wipe:      true,
+	})
+	if len(s3.objects) != 0 {
+		t.Errorf("Expected no objects after wipe, got %v.", s3.objects)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot that cannot be restored is not overwritten.
+	s3.objects["/bucket/some/prefix/pushgateway"] = []byte("garbage")
+	p, err = NewObjectPersister(persistenceURL, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.Restore(); err == nil {
+		t.Error("Expected error restoring garbage.")
+	}
+	if err := p.Persist(GroupingKeyToMetricGroup{}); err == nil {
+		t.Error("Expected error persisting after failed restore.")
+	}
+	if expected, got := "garbage", string(s3.objects["/bucket/some/prefix/pushgateway"]); expected != got {
+		t.Errorf("Wanted object content %q, got %q.", expected, got)
+	}
+}
@@ -0,0 +1,790 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/codec"
+)
+
+// The persistence file starts with persistenceMagic, followed by the format
+// version as a uvarint, a Header message, a sequence of Group messages, and a
+// trailer. Each message is stored as a record, i.e. a uvarint length, followed
+// by the protobuf-encoded message, followed by the CRC-32C (Castagnoli) of the
+// message as a little-endian uint32:
+//
+//	message Header {
+//	  uint64 last_sequence = 1;
+//	}
+//
+//	message Group {
+//	  repeated io.prometheus.client.LabelPair label = 1;
+//	  repeated Family family = 2;
+//	  bool locked = 3;
+//	  repeated io.prometheus.client.LabelPair annotation = 4;
+//	  bool deleted = 5;
+//	  string payload_hash = 6;
+//	  int64 expected_interval_nanoseconds = 7;
+//	  string content_type = 8;
+//	  string content_encoding = 9;
+//	  string format = 10;
+//	  uint64 push_sequence = 11;
+//	}
+//
+//	message Family {
+//	  int64 timestamp_seconds = 1;
+//	  int32 timestamp_nanos = 2;
+//	  io.prometheus.client.MetricFamily metric_family = 3;
+//	  int64 ttl_nanoseconds = 4;
+//	}
+//
+// The trailer is a zero length (which no record can have) followed by the
+// CRC-32C of the whole file up to and including that zero length, again as a
+// little-endian uint32. A record failing its checksum (or failing to decode) is
+// skipped while reading. A missing trailer or a mismatch of the file checksum is
+// reported as corruption, too, but the records read so far are kept.
+//
+// The last_sequence in the Header is the sequence number of the last write-ahead
+// log record reflected in the file, see wal.go. Version 1 of the format had no
+// Header, and versions 1 and 2 had neither record checksums nor a trailer. They
+// are still readable, but any corruption is an error for them.
+//
+// Delta files (see persister.go) have the same format but only contain the
+// groups changed since the previous persistence file or delta file. A deleted
+// group is recorded with its labels and deleted set to true, and nothing else.
+// It is represented by a MetricGroup with nil Metrics in memory, see tombstone.
+//
+// Unknown fields are skipped while decoding so that fields can be added in a
+// backwards compatible way without bumping the format version.
+//
+// A persistence file may have an index file to restore it lazily, see index.go.
+//
+// The leading zero byte of persistenceMagic can never start a gob stream, which
+// is how the legacy format is told apart.
+const (
+	persistenceMagic         = "\x00pushgateway"
+	persistenceFormatVersion = 3
+
+	headerLastSequenceField protowire.Number = 1
+
+	groupLabelField            protowire.Number = 1
+	groupFamilyField           protowire.Number = 2
+	groupLockedField           protowire.Number = 3
+	groupAnnotationField       protowire.Number = 4
+	groupDeletedField          protowire.Number = 5
+	groupPayloadHashField      protowire.Number = 6
+	groupExpectedIntervalField protowire.Number = 7
+	groupContentTypeField      protowire.Number = 8
+	groupContentEncodingField  protowire.Number = 9
+	groupFormatField           protowire.Number = 10
+	groupPushSequenceField     protowire.Number = 11
+
+	familyTimestampSecondsField protowire.Number = 1
+	familyTimestampNanosField   protowire.Number = 2
+	familyMetricFamilyField     protowire.Number = 3
+	familyTTLField              protowire.Number = 4
+
+	// maxRecordSize protects against allocating huge amounts of memory
+	// because of a corrupted record length.
+	maxRecordSize = 1 << 30
+)
+
+var (
+	errLegacyFormat = errors.New("persistence file is in the legacy gob format")
+	errNoMFFound    = errors.New("persisted metric family record without metric family")
+	// errCorruptedRecord is returned by readChecksummedRecord for a record
+	// failing its checksum.
+	errCorruptedRecord = errors.New("persistence record has an invalid checksum")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// WriteSnapshot writes the provided metric groups to w in the (unencrypted)
+// format of the persistence file, e.g. for a backup.
+func WriteSnapshot(w io.Writer, groups GroupingKeyToMetricGroup) error {
+	return writeSnapshot(w, groups, 0)
+}
+
+// ReadSnapshot reads metric groups written by WriteSnapshot or from an
+// unencrypted persistence file in any of the supported formats except the
+// legacy one. Unlike upon start-up, any corruption is an error.
+func ReadSnapshot(r io.Reader) (GroupingKeyToMetricGroup, error) {
+	groups, _, corrupted, _, err := readSnapshot(r)
+	if err == errLegacyFormat {
+		return nil, errors.New("snapshot is not in a supported format")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if corrupted > 0 {
+		return nil, fmt.Errorf("snapshot is corrupted (%d corruptions found)", corrupted)
+	}
+	return groups, nil
+}
+
+// writeSnapshot writes the provided metric groups to w in the current
+// persistence format. lastSequence is the sequence number of the last write
+// request reflected in groups.
+func writeSnapshot(w io.Writer, groups GroupingKeyToMetricGroup, lastSequence uint64) error {
+	return writeIndexedSnapshot(w, groups, lastSequence, nil)
+}
+
+// writeIndexedSnapshot works like writeSnapshot. If ix is not nil, every
+// written group is added to it together with the position of its encoded metric
+// families in the snapshot, see snapshotIndex.
+func writeIndexedSnapshot(w io.Writer, groups GroupingKeyToMetricGroup, lastSequence uint64, ix *snapshotIndex) error {
+	bw := bufio.NewWriter(w)
+	fileCRC := crc32.New(crcTable)
+	cw := io.MultiWriter(bw, fileCRC)
+	if _, err := io.WriteString(cw, persistenceMagic); err != nil {
+		return err
+	}
+	if _, err := cw.Write(protowire.AppendVarint(nil, persistenceFormatVersion)); err != nil {
+		return err
+	}
+	var buf []byte
+	buf = appendChecksummedRecord(buf[:0], marshalHeader(lastSequence))
+	if _, err := cw.Write(buf); err != nil {
+		return err
+	}
+	// pos is the offset in the snapshot at which the next record starts.
+	pos := int64(len(persistenceMagic) + protowire.SizeVarint(persistenceFormatVersion) + len(buf))
+	var positions []familyPosition
+
+	// Sort the groups to get a reproducible file.
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var (
+			record []byte
+			err    error
+		)
+		if ix == nil {
+			record, err = marshalGroup(groups[k])
+		} else {
+			record, positions, err = marshalGroupPositions(groups[k], positions[:0])
+		}
+		if err != nil {
+			return err
+		}
+		buf = appendChecksummedRecord(buf[:0], record)
+		if _, err := cw.Write(buf); err != nil {
+			return err
+		}
+		if ix != nil {
+			recordOffset := pos + int64(protowire.SizeVarint(uint64(len(record))))
+			if err := ix.add(groups[k], recordOffset, positions); err != nil {
+				return err
+			}
+		}
+		pos += int64(len(buf))
+	}
+
+	if _, err := cw.Write(protowire.AppendVarint(nil, 0)); err != nil {
+		return err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint32(nil, fileCRC.Sum32())); err != nil {
+		return err
+	}
+	if ix != nil {
+		ix.snapshotSize = pos + int64(protowire.SizeVarint(0)) + 4
+		ix.snapshotCRC = fileCRC.Sum32()
+	}
+	return bw.Flush()
+}
+
+func appendChecksummedRecord(b, record []byte) []byte {
+	b = protowire.AppendBytes(b, record)
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(record, crcTable))
+}
+
+// readSnapshot reads metric groups from r and returns them together with the
+// sequence number of the last write request reflected in them and the number
+// of corruptions encountered, each of which is a skipped record, a missing
+// trailer, or a mismatching file checksum. If r is not in the current
+// persistence format, errLegacyFormat is returned, and nothing is consumed from
+// the returned reader so that it can be used to decode the legacy format.
+func readSnapshot(r io.Reader) (GroupingKeyToMetricGroup, uint64, int, *bufio.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(persistenceMagic))
+	if err == io.EOF && len(magic) == 0 {
+		// An empty file is an empty store.
+		return GroupingKeyToMetricGroup{}, 0, 0, br, nil
+	}
+	if err != nil && err != io.EOF {
+		return nil, 0, 0, br, err
+	}
+	if string(magic) != persistenceMagic {
+		return nil, 0, 0, br, errLegacyFormat
+	}
+	if _, err := br.Discard(len(persistenceMagic)); err != nil {
+		return nil, 0, 0, br, err
+	}
+	version, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, 0, 0, br, fmt.Errorf("could not read persistence format version: %v", err)
+	}
+	var lastSequence uint64
+	switch version {
+	case 1:
+		// No header.
+	case 2:
+		header, err := readRecord(br)
+		if err != nil {
+			return nil, 0, 0, br, fmt.Errorf("could not read persistence file header: %v", err)
+		}
+		if lastSequence, err = unmarshalHeader(header); err != nil {
+			return nil, 0, 0, br, err
+		}
+	case persistenceFormatVersion:
+		groups, lastSequence, corrupted := readChecksummedSnapshot(br)
+		return groups, lastSequence, corrupted, br, nil
+	default:
+		return nil, 0, 0, br, fmt.Errorf("unsupported persistence format version %d", version)
+	}
+
+	groups := GroupingKeyToMetricGroup{}
+	for {
+		record, err := readRecord(br)
+		if err == io.EOF {
+			return groups, lastSequence, 0, br, nil
+		}
+		if err != nil {
+			return nil, 0, 0, br, err
+		}
+		group, err := unmarshalGroup(record)
+		if err != nil {
+			return nil, 0, 0, br, err
+		}
+		groups[groupingKeyFor(group.Labels)] = group
+	}
+}
+
+// readChecksummedSnapshot reads the records of the current persistence format
+// from br, positioned right after the format version. See readSnapshot for the
+// return values. A corrupted header results in a lastSequence of zero.
+func readChecksummedSnapshot(br *bufio.Reader) (GroupingKeyToMetricGroup, uint64, int) {
+	cr := &crcReader{br: br}
+	cr.update([]byte(persistenceMagic))
+	cr.update(protowire.AppendVarint(nil, persistenceFormatVersion))
+
+	var (
+		groups       = GroupingKeyToMetricGroup{}
+		lastSequence uint64
+		corrupted    int
+	)
+	for first := true; ; first = false {
+		record, err := readChecksummedRecord(cr)
+		if err == io.EOF {
+			// Missing trailer, i.e. the file is truncated.
+			return groups, lastSequence, corrupted + 1
+		}
+		if err == errCorruptedRecord {
+			corrupted++
+			continue
+		}
+		if err != nil {
+			// Cannot find the next record anymore.
+			return groups, lastSequence, corrupted + 1
+		}
+		if record == nil {
+			// Trailer.
+			sum := make([]byte, 4)
+			if _, err := io.ReadFull(br, sum); err != nil || binary.LittleEndian.Uint32(sum) != cr.crc {
+				corrupted++
+			}
+			return groups, lastSequence, corrupted
+		}
+		if first {
+			if lastSequence, err = unmarshalHeader(record); err != nil {
+				lastSequence = 0
+				corrupted++
+			}
+			continue
+		}
+		group, err := unmarshalGroup(record)
+		if err != nil {
+			corrupted++
+			continue
+		}
+		groups[groupingKeyFor(group.Labels)] = group
+	}
+}
+
+// readChecksummedRecord reads a record with checksum from cr. It returns a nil
+// record for the zero length of the trailer, errCorruptedRecord if the record
+// has been read but its checksum does not match, and io.EOF only if cr is
+// exhausted before the first byte of the record.
+func readChecksummedRecord(cr *crcReader) ([]byte, error) {
+	size, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("persistence record of %d bytes is too large", size)
+	}
+	b := make([]byte, size+4)
+	if _, err := io.ReadFull(cr, b); err != nil {
+		return nil, fmt.Errorf("truncated persistence record: %v", err)
+	}
+	record, sum := b[:size], b[size:]
+	if binary.LittleEndian.Uint32(sum) != crc32.Checksum(record, crcTable) {
+		return nil, errCorruptedRecord
+	}
+	return record, nil
+}
+
+// crcReader reads from a bufio.Reader and keeps track of the CRC-32C of all
+// bytes read.
+type crcReader struct {
+	br  *bufio.Reader
+	crc uint32
+}
+
+func (cr *crcReader) update(b []byte) {
+	cr.crc = crc32.Update(cr.crc, crcTable, b)
+}
+
+func (cr *crcReader) Read(p []byte) (int, error) {
+	n, err := cr.br.Read(p)
+	cr.update(p[:n])
+	return n, err
+}
+
+func (cr *crcReader) ReadByte() (byte, error) {
+	b, err := cr.br.ReadByte()
+	if err == nil {
+		cr.update([]byte{b})
+	}
+	return b, err
+}
+
+// readRecord reads a uvarint-length-delimited record from br. io.EOF is only
+// returned if br is exhausted before the first byte of the record.
+func readRecord(br *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("persistence record of %d bytes is too large", size)
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(br, record); err != nil {
+		return nil, fmt.Errorf("truncated persistence record: %v", err)
+	}
+	return record, nil
+}
+
+// readLegacySnapshot decodes metric groups persisted with gob by previous
+// versions of the Pushgateway.
+func readLegacySnapshot(r io.Reader) (GroupingKeyToMetricGroup, error) {
+	groups := GroupingKeyToMetricGroup{}
+	if err := gob.NewDecoder(r).Decode(&groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func marshalHeader(lastSequence uint64) []byte {
+	b := protowire.AppendTag(nil, headerLastSequenceField, protowire.VarintType)
+	return protowire.AppendVarint(b, lastSequence)
+}
+
+func unmarshalHeader(b []byte) (uint64, error) {
+	var lastSequence uint64
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != headerLastSequenceField {
+			return nil
+		}
+		var err error
+		lastSequence, err = varintValue(typ, v)
+		return err
+	})
+	return lastSequence, err
+}
+
+// tombstone returns the MetricGroup recording the deletion of the group with the
+// provided labels in a delta file.
+func tombstone(labels map[string]string) MetricGroup {
+	return MetricGroup{Labels: labels}
+}
+
+func isTombstone(group MetricGroup) bool {
+	return group.Metrics == nil
+}
+
+func marshalGroup(group MetricGroup) ([]byte, error) {
+	return appendGroup(nil, group, func(b []byte, _ string, tmf TimestampedMetricFamily) ([]byte, error) {
+		family, err := marshalFamily(tmf)
+		if err != nil {
+			return nil, err
+		}
+		return protowire.AppendBytes(b, family), nil
+	})
+}
+
+// familyPosition is the position of an encoded metric family within a group
+// record, together with its CRC-32C.
+type familyPosition struct {
+	offset, length int
+	crc            uint32
+}
+
+// marshalGroupPositions works like marshalGroup but also appends the positions
+// of the encoded metric families to the provided ones, in the order of the Family
+// messages in the record.
+func marshalGroupPositions(group MetricGroup, positions []familyPosition) ([]byte, []familyPosition, error) {
+	b, err := appendGroup(nil, group, func(b []byte, _ string, tmf TimestampedMetricFamily) ([]byte, error) {
+		raw, err := codec.MarshalMetricFamily(tmf.GetMetricFamily())
+		if err != nil {
+			return nil, err
+		}
+		family, offset := appendFamily(nil, tmf, raw)
+		b = protowire.AppendVarint(b, uint64(len(family)))
+		positions = append(positions, familyPosition{
+			offset: len(b) + offset,
+			length: len(raw),
+			crc:    crc32.Checksum(raw, crcTable),
+		})
+		return append(b, family...), nil
+	})
+	return b, positions, err
+}
+
+// appendGroup appends the Group message for the provided group to b. The value
+// of each family field (i.e. a length-delimited Family message) is appended by
+// appendFamily, in the order of the names of the metric families.
+func appendGroup(
+	b []byte,
+	group MetricGroup,
+	appendFamily func(b []byte, name string, tmf TimestampedMetricFamily) ([]byte, error),
+) ([]byte, error) {
+	b, err := appendLabels(b, groupLabelField, group.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if isTombstone(group) {
+		b = protowire.AppendTag(b, groupDeletedField, protowire.VarintType)
+		return protowire.AppendVarint(b, 1), nil
+	}
+
+	names := make([]string, 0, len(group.Metrics))
+	for name := range group.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tmf := group.Metrics[name]
+		if tmf.GetMetricFamily() == nil {
+			// Corrupted storage, see GetMetricFamilies. Drop it.
+			continue
+		}
+		b = protowire.AppendTag(b, groupFamilyField, protowire.BytesType)
+		if b, err = appendFamily(b, name, tmf); err != nil {
+			return nil, err
+		}
+	}
+	if group.Locked {
+		b = protowire.AppendTag(b, groupLockedField, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if group.PayloadHash != "" {
+		b = protowire.AppendTag(b, groupPayloadHashField, protowire.BytesType)
+		b = protowire.AppendString(b, group.PayloadHash)
+	}
+	if group.ExpectedInterval > 0 {
+		b = protowire.AppendTag(b, groupExpectedIntervalField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(group.ExpectedInterval))
+	}
+	b = appendPushFormat(b, group.PushFormat, groupContentTypeField, groupContentEncodingField, groupFormatField)
+	if group.Sequence > 0 {
+		b = protowire.AppendTag(b, groupPushSequenceField, protowire.VarintType)
+		b = protowire.AppendVarint(b, group.Sequence)
+	}
+	return appendLabels(b, groupAnnotationField, group.Annotations)
+}
+
+// appendPushFormat appends the non-empty fields of pf to b, using the provided
+// field numbers.
+func appendPushFormat(b []byte, pf PushFormat, contentTypeField, contentEncodingField, formatField protowire.Number) []byte {
+	for _, f := range []struct {
+		num   protowire.Number
+		value string
+	}{
+		{contentTypeField, pf.ContentType},
+		{contentEncodingField, pf.ContentEncoding},
+		{formatField, string(pf.Format)},
+	} {
+		if f.value != "" {
+			b = protowire.AppendTag(b, f.num, protowire.BytesType)
+			b = protowire.AppendString(b, f.value)
+		}
+	}
+	return b
+}
+
+func unmarshalGroup(b []byte) (MetricGroup, error) {
+	return unmarshalIndexedGroup(b, nil)
+}
+
+// unmarshalIndexedGroup works like unmarshalGroup. If ls is not nil, b may also
+// be a group record of an index file, whose metric families are loaded from ls
+// on first access.
+func unmarshalIndexedGroup(b []byte, ls *lazySnapshot) (MetricGroup, error) {
+	group := MetricGroup{
+		Labels:  map[string]string{},
+		Metrics: NameToTimestampedMetricFamilyMap{},
+	}
+	deleted := false
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case groupLabelField:
+			return addLabel(group.Labels, typ, v)
+		case groupFamilyField:
+			raw, err := bytesValue(typ, v)
+			if err != nil {
+				return err
+			}
+			name, tmf, err := unmarshalFamily(raw, ls)
+			if err != nil {
+				return err
+			}
+			group.Metrics[name] = tmf
+		case groupLockedField:
+			x, err := varintValue(typ, v)
+			group.Locked = x != 0
+			return err
+		case groupAnnotationField:
+			if group.Annotations == nil {
+				group.Annotations = map[string]string{}
+			}
+			return addLabel(group.Annotations, typ, v)
+		case groupPayloadHashField:
+			raw, err := bytesValue(typ, v)
+			group.PayloadHash = string(raw)
+			return err
+		case groupExpectedIntervalField:
+			x, err := varintValue(typ, v)
+			group.ExpectedInterval = time.Duration(x)
+			return err
+		case groupContentTypeField:
+			raw, err := bytesValue(typ, v)
+			group.PushFormat.ContentType = string(raw)
+			return err
+		case groupContentEncodingField:
+			raw, err := bytesValue(typ, v)
+			group.PushFormat.ContentEncoding = string(raw)
+			return err
+		case groupFormatField:
+			raw, err := bytesValue(typ, v)
+			group.PushFormat.Format = codec.Format(raw)
+			return err
+		case groupPushSequenceField:
+			x, err := varintValue(typ, v)
+			group.Sequence = x
+			return err
+		case groupDeletedField:
+			x, err := varintValue(typ, v)
+			deleted = x != 0
+			return err
+		}
+		return nil
+	})
+	if deleted {
+		return tombstone(group.Labels), err
+	}
+	return group, err
+}
+
+// appendLabels appends the provided labels, sorted by name, to b as repeated
+// LabelPair fields with the provided field number.
+func appendLabels(b []byte, num protowire.Number, labels map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(labels))
+	for ln := range labels {
+		names = append(names, ln)
+	}
+	sort.Strings(names)
+	for _, ln := range names {
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, codec.MarshalLabelPair(ln, labels[ln]))
+	}
+	return b, nil
+}
+
+// addLabel decodes the provided LabelPair field value and adds it to labels.
+func addLabel(labels map[string]string, typ protowire.Type, v []byte) error {
+	raw, err := bytesValue(typ, v)
+	if err != nil {
+		return err
+	}
+	name, value, err := codec.UnmarshalLabelPair(raw)
+	if err != nil {
+		return err
+	}
+	labels[name] = value
+	return nil
+}
+
+func marshalFamily(tmf TimestampedMetricFamily) ([]byte, error) {
+	raw, err := codec.MarshalMetricFamily(tmf.GetMetricFamily())
+	if err != nil {
+		return nil, err
+	}
+	b, _ := appendFamily(nil, tmf, raw)
+	return b, nil
+}
+
+// appendFamily appends the Family message for tmf, with raw as its encoded
+// metric family, to b and returns the offset of raw in the result.
+func appendFamily(b []byte, tmf TimestampedMetricFamily, raw []byte) ([]byte, int) {
+	b = appendFamilyTimestamp(b, tmf)
+	b = protowire.AppendTag(b, familyMetricFamilyField, protowire.BytesType)
+	b = protowire.AppendVarint(b, uint64(len(raw)))
+	offset := len(b)
+	b = append(b, raw...)
+	return appendFamilyTTL(b, tmf), offset
+}
+
+func appendFamilyTimestamp(b []byte, tmf TimestampedMetricFamily) []byte {
+	b = protowire.AppendTag(b, familyTimestampSecondsField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(tmf.Timestamp.Unix()))
+	b = protowire.AppendTag(b, familyTimestampNanosField, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(tmf.Timestamp.Nanosecond()))
+}
+
+func appendFamilyTTL(b []byte, tmf TimestampedMetricFamily) []byte {
+	if tmf.TTL > 0 {
+		b = protowire.AppendTag(b, familyTTLField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(tmf.TTL))
+	}
+	return b
+}
+
+// unmarshalFamily decodes a Family message and returns the name of its metric
+// family along with it. If ls is not nil, b may also be an IndexedFamily
+// message (see index.go), whose metric family is loaded from ls on first
+// access.
+func unmarshalFamily(b []byte, ls *lazySnapshot) (string, TimestampedMetricFamily, error) {
+	var (
+		tmf         TimestampedMetricFamily
+		secs, nanos int64
+		mf          *dto.MetricFamily
+		ref         familyRef
+	)
+	err := forEachField(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch num {
+		case familyTimestampSecondsField:
+			x, err := varintValue(typ, v)
+			secs = int64(x)
+			return err
+		case familyTimestampNanosField:
+			x, err := varintValue(typ, v)
+			nanos = int64(x)
+			return err
+		case familyMetricFamilyField:
+			raw, err := bytesValue(typ, v)
+			if err != nil {
+				return err
+			}
+			mf = &dto.MetricFamily{}
+			return codec.UnmarshalMetricFamily(raw, mf)
+		case familyTTLField:
+			x, err := varintValue(typ, v)
+			tmf.TTL = time.Duration(x)
+			return err
+		}
+		if ls == nil {
+			return nil
+		}
+		return ref.unmarshalField(num, typ, v)
+	})
+	if err != nil {
+		return "", tmf, err
+	}
+	tmf.Timestamp = time.Unix(secs, nanos)
+	if mf == nil {
+		if ls == nil || ref.name == "" || ref.length == 0 {
+			return "", tmf, errNoMFFound
+		}
+		tmf.lazy = ls.add(ref)
+		return ref.name, tmf, nil
+	}
+	tmf.GobbableMetricFamily = (*GobbableMetricFamily)(mf)
+	return mf.GetName(), tmf, nil
+}
+
+// forEachField calls f for each field of the provided protobuf-encoded
+// message. The raw value v passed to f still contains the length prefix in
+// case of length-delimited fields. Use bytesValue and varintValue to decode it.
+func forEachField(b []byte, f func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := f(num, typ, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func bytesValue(typ protowire.Type, v []byte) ([]byte, error) {
+	if typ != protowire.BytesType {
+		return nil, fmt.Errorf("unexpected wire type %d for length-delimited field", typ)
+	}
+	raw, n := protowire.ConsumeBytes(v)
+	if n < 0 {
+		return nil, protowire.ParseError(n)
+	}
+	return raw, nil
+}
+
+func varintValue(typ protowire.Type, v []byte) (uint64, error) {
+	if typ != protowire.VarintType {
+		return 0, fmt.Errorf("unexpected wire type %d for varint field", typ)
+	}
+	x, n := protowire.ConsumeVarint(v)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	return x, nil
+}
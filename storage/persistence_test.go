@@ -0,0 +1,383 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ts := time.Unix(1600000000, 123456789)
+	mg := GroupingKeyToMetricGroup{}
+	addGroup(
+		mg,
+		map[string]string{
+			"job":      "job1",
+			"instance": "instance2",
+		},
+		NameToTimestampedMetricFamilyMap{
+			"mf1": TimestampedMetricFamily{
+				Timestamp:            ts,
+				GobbableMetricFamily: (*GobbableMetricFamily)(mf1a),
+				TTL:                  5 * time.Minute,
+			},
+			"mf2": TimestampedMetricFamily{
+				Timestamp:            ts.Add(time.Second),
+				GobbableMetricFamily: (*GobbableMetricFamily)(mf2),
+			},
+		},
+	)
+	addGroup(
+		mg,
+		map[string]string{
+			"job": "job4",
+		},
+		NameToTimestampedMetricFamilyMap{},
+	)
+
+	buf := &bytes.Buffer{}
+	if err := writeSnapshot(buf, mg, 42); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), persistenceMagic) {
+		t.Fatalf("Snapshot doesn't start with magic bytes: %q", buf.String())
+	}
+	got, lastSequence, corrupted, _, err := readSnapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(42), lastSequence; expected != got {
+		t.Errorf("Wanted last sequence %d, got %d.", expected, got)
+	}
+	if expected, got := 0, corrupted; expected != got {
+		t.Errorf("Wanted %d corruptions, got %d.", expected, got)
+	}
+	if expected, got := len(mg), len(got); expected != got {
+		t.Fatalf("Wanted %d groups, got %d.", expected, got)
+	}
+	for k, group := range mg {
+		gotGroup, ok := got[k]
+		if !ok {
+			t.Fatalf("Group %v missing after round trip.", group.Labels)
+		}
+		if expected, got := len(group.Labels), len(gotGroup.Labels); expected != got {
+			t.Errorf("Wanted %d labels, got %d.", expected, got)
+		}
+		if expected, got := len(group.Metrics), len(gotGroup.Metrics); expected != got {
+			t.Errorf("Wanted %d metric families, got %d.", expected, got)
+		}
+		for name, tmf := range group.Metrics {
+			gotTMF := gotGroup.Metrics[name]
+			if !tmf.Timestamp.Equal(gotTMF.Timestamp) {
+				t.Errorf("Wanted timestamp %v, got %v.", tmf.Timestamp, gotTMF.Timestamp)
+			}
+			if expected, got := tmf.TTL, gotTMF.TTL; expected != got {
+				t.Errorf("Wanted TTL %v, got %v.", expected, got)
+			}
+			if expected, got := tmf.GetMetricFamily().String(), gotTMF.GetMetricFamily().String(); expected != got {
+				t.Errorf("Wanted metric family %s, got %s.", expected, got)
+			}
+		}
+	}
+}
+
+func TestReadSnapshotErrors(t *testing.T) {
+	// Empty input is an empty store.
+	got, _, _, _, err := readSnapshot(&bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Wanted empty store, got %v.", got)
+	}
+
+	// Unknown format version.
+	buf := bytes.NewBufferString(persistenceMagic)
+	buf.Write(protowire.AppendVarint(nil, persistenceFormatVersion+1))
+	if _, _, _, _, err := readSnapshot(buf); err == nil {
+		t.Error("Expected error for unknown format version.")
+	}
+
+	// Version 1 has no header.
+	buf = bytes.NewBufferString(persistenceMagic)
+	buf.Write(protowire.AppendVarint(nil, 1))
+	if got, lastSequence, _, _, err := readSnapshot(buf); err != nil || len(got) != 0 || lastSequence != 0 {
+		t.Errorf("Wanted empty version 1 snapshot, got %v, %d, %v.", got, lastSequence, err)
+	}
+
+	// Truncated record in version 2, which has no checksums.
+	buf = bytes.NewBufferString(persistenceMagic)
+	buf.Write(protowire.AppendVarint(nil, 2))
+	buf.Write(protowire.AppendBytes(nil, marshalHeader(0)))
+	buf.Write(protowire.AppendVarint(nil, 100))
+	buf.WriteString("too short")
+	if _, _, _, _, err := readSnapshot(buf); err == nil {
+		t.Error("Expected error for truncated record.")
+	}
+
+	// Anything else is assumed to be legacy.
+	if _, _, _, _, err := readSnapshot(bytes.NewBufferString("legacy")); err != errLegacyFormat {
+		t.Errorf("Wanted error %q, got %v.", errLegacyFormat, err)
+	}
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	mg := GroupingKeyToMetricGroup{}
+	for _, job := range []string{"job1", "job2", "job3"} {
+		addGroup(mg, map[string]string{"job": job}, NameToTimestampedMetricFamilyMap{})
+	}
+	buf := &bytes.Buffer{}
+	if err := writeSnapshot(buf, mg, 42); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := buf.Bytes()
+
+	for name, s := range []struct {
+		name          string
+		corrupt       func([]byte) []byte
+		wantGroups    int
+		wantSequence  uint64
+		wantCorrupted int
+	}{
+		{
+			name:          "intact",
+			corrupt:       func(b []byte) []byte { return b },
+			wantGroups:    3,
+			wantSequence:  42,
+			wantCorrupted: 0,
+		},
+		{
+			// Both the record and the file checksum fail.
+			name: "flipped byte in group",
+			corrupt: func(b []byte) []byte {
+				i := bytes.Index(b, []byte("job2"))
+				b[i] = 'x'
+				return b
+			},
+			wantGroups:    2,
+			wantSequence:  42,
+			wantCorrupted: 2,
+		},
+		{
+			name: "flipped byte in header",
+			corrupt: func(b []byte) []byte {
+				b[len(persistenceMagic)+3] ^= 0xff
+				return b
+			},
+			wantGroups:    3,
+			wantSequence:  0,
+			wantCorrupted: 2,
+		},
+		{
+			name: "truncated trailer",
+			corrupt: func(b []byte) []byte {
+				return b[:len(b)-2]
+			},
+			wantGroups:    3,
+			wantSequence:  42,
+			wantCorrupted: 1,
+		},
+		{
+			name: "truncated group",
+			corrupt: func(b []byte) []byte {
+				return b[:bytes.Index(b, []byte("job3"))]
+			},
+			wantGroups:    2,
+			wantSequence:  42,
+			wantCorrupted: 1,
+		},
+	} {
+		got, lastSequence, corrupted, _, err := readSnapshot(bytes.NewReader(s.corrupt(append([]byte{}, snapshot...))))
+		if err != nil {
+			t.Errorf("%d. %s: Unexpected error: %v", name, s.name, err)
+			continue
+		}
+		if expected, got := s.wantGroups, len(got); expected != got {
+			t.Errorf("%d. %s: Wanted %d groups, got %d.", name, s.name, expected, got)
+		}
+		if expected, got := s.wantSequence, lastSequence; expected != got {
+			t.Errorf("%d. %s: Wanted last sequence %d, got %d.", name, s.name, expected, got)
+		}
+		if expected, got := s.wantCorrupted, corrupted; expected != got {
+			t.Errorf("%d. %s: Wanted %d corruptions, got %d.", name, s.name, expected, got)
+		}
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestRestoreBackup.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	backupName := fileName + backupSuffix
+
+	mg := GroupingKeyToMetricGroup{}
+	addGroup(mg, map[string]string{"job": "job1"}, NameToTimestampedMetricFamilyMap{})
+	fp := NewFilePersister(fileName, "", logger).(*filePersister)
+	if err := fp.Persist(mg); err != nil {
+		t.Fatal(err)
+	}
+	addGroup(mg, map[string]string{"job": "job2"}, NameToTimestampedMetricFamilyMap{})
+	if err := fp.Persist(mg); err != nil {
+		t.Fatal(err)
+	}
+	restore := func() (*filePersister, GroupingKeyToMetricGroup, bool) {
+		t.Helper()
+		fp := NewFilePersister(fileName, "", logger).(*filePersister)
+		groups, dirty, err := fp.Restore()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fp, groups, dirty
+	}
+
+	// The previous persistence file is the backup.
+	if _, groups, dirty := restore(); len(groups) != 2 || dirty {
+		t.Errorf("Wanted 2 clean groups, got %d, dirty %v.", len(groups), dirty)
+	}
+	if err := os.Rename(backupName, fileName); err != nil {
+		t.Fatal(err)
+	}
+	if _, groups, _ := restore(); len(groups) != 1 {
+		t.Errorf("Wanted 1 group in the backup, got %d.", len(groups))
+	}
+
+	// A missing or unreadable persistence file is replaced by the backup.
+	if err := fp.Persist(mg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(persistenceMagic+"garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	fp, groups, dirty := restore()
+	if len(groups) != 1 || !dirty {
+		t.Errorf("Wanted 1 dirty group from the backup, got %d, dirty %v.", len(groups), dirty)
+	}
+	// Persisting now must not replace the backup with the unreadable file.
+	if err := fp.Persist(groups); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(backupName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, _, _, err := readSnapshot(bytes.NewReader(content)); err != nil || len(got) != 1 {
+		t.Errorf("Wanted backup with 1 group, got %v, %v.", got, err)
+	}
+	if err := os.Remove(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if _, groups, dirty := restore(); len(groups) != 1 || !dirty {
+		t.Errorf("Wanted 1 dirty group from the backup, got %d, dirty %v.", len(groups), dirty)
+	}
+
+	// Corrupted records are skipped and counted.
+	buf := &bytes.Buffer{}
+	if err := writeSnapshot(buf, mg, 0); err != nil {
+		t.Fatal(err)
+	}
+	corrupted := buf.Bytes()
+	corrupted[bytes.Index(corrupted, []byte("job2"))] = 'x'
+	if err := ioutil.WriteFile(fileName, corrupted, 0666); err != nil {
+		t.Fatal(err)
+	}
+	fp, groups, dirty = restore()
+	if len(groups) != 1 || !dirty {
+		t.Errorf("Wanted 1 dirty group, got %d, dirty %v.", len(groups), dirty)
+	}
+	m := &dto.Metric{}
+	if err := fp.corruptions.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2., m.GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted %f corruptions counted, got %f.", expected, got)
+	}
+
+	// Wiping removes the backup, too.
+	if err := fp.Wipe(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupName); !os.IsNotExist(err) {
+		t.Errorf("Backup file not removed by wipe: %v", err)
+	}
+}
+
+func TestRestoreLegacyFormat(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestRestoreLegacyFormat.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+
+	ts := time.Now()
+	grouping := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+	mg := GroupingKeyToMetricGroup{}
+	addGroup(mg, grouping, NameToTimestampedMetricFamilyMap{
+		"mf3": TimestampedMetricFamily{
+			Timestamp:            ts,
+			GobbableMetricFamily: (*GobbableMetricFamily)(mf3),
+		},
+	})
+	f, err := os.Create(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gob.NewEncoder(f).Encode(mg); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file must have been converted.
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(content), persistenceMagic) {
+		t.Error("Persistence file has not been converted to the current format.")
+	}
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	if err := checkMetricFamilies(dms, mf3); err != nil {
+		t.Error(err)
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,711 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Persister is the persistence layer of a DiskMetricStore. The DiskMetricStore
+// does all the in-memory bookkeeping and calls the Persister to make its state
+// survive restarts.
+//
+// The DiskMetricStore calls Restore and then Replay once upon start-up, and
+// Close once upon shutdown. In between, it calls Log for each change before the
+// change becomes visible, and occasionally Persist and Wipe. None of these calls
+// happen concurrently. If a Persister implements prometheus.Collector, its
+// metrics are collected together with those of the DiskMetricStore.
+type Persister interface {
+	// Restore returns the persisted metric groups. If it returns true,
+	// the returned state should be persisted right away, e.g. because it
+	// was read from a deprecated format.
+	Restore() (GroupingKeyToMetricGroup, bool, error)
+	// Replay calls apply, in order, for every logged change that is not
+	// reflected in the metric groups returned by Restore. It returns the
+	// number of changes replayed. Afterwards, the Persister is ready to
+	// log new changes.
+	Replay(apply func(wr WriteRequest, pushFailed bool)) (int, error)
+	// Log records a change. If pushFailed is true, the change is only the
+	// update of the push failure timestamp for a failed push of wr.
+	Log(wr WriteRequest, pushFailed bool) error
+	// Persist persists the provided state, reflecting all changes logged
+	// so far. The Persister must not modify the provided metric groups.
+	Persist(groups GroupingKeyToMetricGroup) error
+	// Wipe removes everything persisted or logged so far.
+	Wipe() error
+	// Close frees any resources held by the Persister.
+	Close() error
+}
+
+// persistenceSizer is implemented by Persisters that know the size of what
+// they have persisted.
+type persistenceSizer interface {
+	persistenceSize() (int64, error)
+}
+
+// lazyRestorer is implemented by Persisters that may restore metric families
+// lazily, i.e. only load them on first access, see index.go.
+type lazyRestorer interface {
+	// restoredLazily returns true if Restore has restored metric families
+	// lazily and they have not been released by persisting since.
+	restoredLazily() bool
+}
+
+// filePersister persists snapshots to a file and logs changes to a
+// write-ahead log in a directory next to it. If persisting incrementally, it
+// writes delta files to another directory next to it in between snapshots.
+type filePersister struct {
+	file        string
+	wal         *wal // nil until Replay has been called.
+	restoredSeq uint64
+	enc         *encryption
+	logger      log.Logger
+	// compactionInterval is the minimum time between two snapshots if
+	// persisting incrementally. Zero means every Persist writes a snapshot.
+	compactionInterval time.Duration
+	lastSnapshot       time.Time
+	sync               SyncPolicy
+	compression        Compression
+	// changed maps the grouping keys of the groups changed since the last
+	// Persist to their grouping labels. The groups are written to the next
+	// delta file. If changed is nil, the next Persist writes a snapshot.
+	changed map[string]map[string]string
+	// decryptFailed prevents overwriting a persistence file (or delta
+	// files) that could not be decrypted, e.g. because the encryption key
+	// is missing.
+	decryptFailed bool
+	// keepBackup prevents replacing the backup file with a persistence
+	// file that was found to be corrupted.
+	keepBackup  bool
+	corruptions prometheus.Counter
+	// index enables writing an index file along with every persistence
+	// file that is neither compressed nor encrypted, see index.go.
+	index bool
+	// lazy is the persistence file restored with its index file, if any.
+	lazy *lazySnapshot
+}
+
+// backupSuffix is appended to the name of the persistence file to name the
+// backup file, which is the previous persistence file.
+const backupSuffix = ".bak"
+
+// deltaDirSuffix is appended to the name of the persistence file to name the
+// directory with the delta files. Each delta file is named after the 20-digit
+// zero-padded sequence number of the last write-ahead log record it reflects.
+const deltaDirSuffix = ".delta"
+
+// NewFilePersister returns a Persister that writes snapshots to the provided file
+// and logs every change to a write-ahead log in the directory named like the
+// file with ".wal" appended. If encryptionKey is not empty, both are encrypted
+// with AES-256-GCM, using the SHA-256 hash of encryptionKey as the key. Files
+// are synced to disk according to SyncInterval and not compressed.
+func NewFilePersister(file, encryptionKey string, logger log.Logger) Persister {
+	return NewIncrementalFilePersister(file, encryptionKey, 0, SyncInterval, CompressionNone, logger)
+}
+
+// NewIncrementalFilePersister works like NewFilePersister, but Persist writes a
+// snapshot only if at least compactionInterval has passed since the previous
+// one. Otherwise, it only writes the groups changed since the previous Persist
+// to a new delta file in the directory named like the file with ".delta"
+// appended. Writing a snapshot compacts the delta files into the persistence
+// file. Upon Restore, the delta files are applied to the persistence file in
+// order. A compactionInterval of zero or less disables delta files. Files are
+// synced to disk according to the provided SyncPolicy. The persistence file and
+// the delta files are compressed with the provided Compression (none if empty),
+// while files compressed with any Compression are read.
+func NewIncrementalFilePersister(file, encryptionKey string, compactionInterval time.Duration, syncPolicy SyncPolicy, compression Compression, logger log.Logger) Persister {
+	return newFilePersister(file, encryptionKey, compactionInterval, syncPolicy, compression, logger)
+}
+
+func newFilePersister(file, encryptionKey string, compactionInterval time.Duration, syncPolicy SyncPolicy, compression Compression, logger log.Logger) *filePersister {
+	if compression == "" {
+		compression = CompressionNone
+	}
+	return &filePersister{
+		file:               file,
+		enc:                newEncryption(encryptionKey),
+		logger:             logger,
+		compactionInterval: compactionInterval,
+		sync:               syncPolicy,
+		compression:        compression,
+		corruptions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pushgateway_persistence_corruptions_total",
+			Help: "Total number of corrupted records (or otherwise corrupted parts) skipped while restoring the persistence file.",
+		}),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (fp *filePersister) Describe(ch chan<- *prometheus.Desc) {
+	fp.corruptions.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (fp *filePersister) Collect(ch chan<- prometheus.Metric) {
+	fp.corruptions.Collect(ch)
+}
+
+// Restore implements Persister. It restores the persistence file (see
+// restoreSnapshot) and applies the delta files written after it. A corrupted
+// delta file is skipped and counted, and true is returned so that a complete
+// snapshot is written right away.
+func (fp *filePersister) Restore() (GroupingKeyToMetricGroup, bool, error) {
+	groups, dirty, err := fp.restoreSnapshot()
+	if err != nil {
+		return groups, dirty, err
+	}
+	if fi, err := os.Stat(fp.file); err == nil {
+		fp.lastSnapshot = fi.ModTime()
+	}
+	last, applied, corrupted, err := applyDeltas(fp.file+deltaDirSuffix, fp.restoredSeq, fp.enc, groups)
+	if err != nil {
+		// A snapshot written now would lack the changes in the
+		// delta files, so do not write any.
+		fp.decryptFailed = true
+		return nil, false, err
+	}
+	fp.restoredSeq = last
+	if applied > 0 {
+		level.Info(fp.logger).Log("msg", "applied delta files", "files", applied)
+	}
+	if corrupted > 0 {
+		fp.corruptions.Add(float64(corrupted))
+		level.Warn(fp.logger).Log("msg", "delta files are corrupted, restored what could be read", "corruptions", corrupted)
+		dirty = true
+	}
+	if fp.compactionInterval > 0 && !dirty {
+		fp.changed = map[string]map[string]string{}
+	}
+	return groups, dirty, nil
+}
+
+// restoreSnapshot restores the persistence file. A missing persistence file is
+// not an error. A persistence file in the legacy gob format is read, and true is
+// returned so that it gets converted to the current format. Likewise, true is
+// returned for an unencrypted persistence file if encryption is configured.
+//
+// Corrupted records in the persistence file are skipped and counted. If the
+// persistence file is missing or cannot be read at all, the backup file (named
+// like the persistence file with ".bak" appended) is restored instead. In both
+// cases, true is returned, and the backup file is kept as the last known-good
+// state when persisting next time.
+func (fp *filePersister) restoreSnapshot() (GroupingKeyToMetricGroup, bool, error) {
+	groups, dirty, err := fp.restoreFile(fp.file)
+	if err == nil || fp.decryptFailed {
+		return groups, dirty, err
+	}
+	backup := fp.file + backupSuffix
+	backupGroups, _, backupErr := fp.restoreFile(backup)
+	if backupErr != nil {
+		if os.IsNotExist(err) {
+			if !os.IsNotExist(backupErr) {
+				level.Warn(fp.logger).Log("msg", "could not restore backup file", "file", backup, "err", backupErr)
+			}
+			return GroupingKeyToMetricGroup{}, false, nil
+		}
+		return nil, false, err
+	}
+	if os.IsNotExist(err) {
+		level.Warn(fp.logger).Log("msg", "persistence file missing, restored backup file", "file", backup)
+	} else {
+		level.Warn(fp.logger).Log("msg", "could not restore persistence file, restored backup file", "file", backup, "err", err)
+	}
+	fp.keepBackup = true
+	return backupGroups, true, nil
+}
+
+// restoreFile restores the provided persistence file, see restoreSnapshot. An
+// error opening the file is returned unchanged. The persistence file (but not
+// the backup file) is restored lazily if it has a matching index file.
+func (fp *filePersister) restoreFile(name string) (GroupingKeyToMetricGroup, bool, error) {
+	if name == fp.file && fp.indexed() {
+		if groups, ok := fp.restoreLazily(); ok {
+			return groups, false, nil
+		}
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	sr, encrypted, compression, err := fp.enc.snapshotReader(f)
+	if err != nil {
+		fp.decryptFailed = encrypted
+		return nil, false, fmt.Errorf("could not read persistence file %q: %v", name, err)
+	}
+	groups, lastSequence, corrupted, r, err := readSnapshot(sr)
+	if err == errLegacyFormat {
+		if groups, err = readLegacySnapshot(r); err != nil {
+			return nil, false, err
+		}
+		level.Info(fp.logger).Log("msg", "converting legacy persistence file to current format", "file", name)
+		return groups, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	fp.restoredSeq = lastSequence
+	dirty := false
+	if corrupted > 0 {
+		fp.corruptions.Add(float64(corrupted))
+		fp.keepBackup = true
+		level.Warn(fp.logger).Log(
+			"msg", "persistence file is corrupted, restored what could be read",
+			"file", name, "corruptions", corrupted, "groups_restored", len(groups),
+		)
+		dirty = true
+	}
+	if fp.enc != nil && !encrypted {
+		level.Info(fp.logger).Log("msg", "encrypting unencrypted persistence file", "file", name)
+		dirty = true
+	}
+	if compression != fp.compression {
+		level.Info(fp.logger).Log("msg", "changing compression of persistence file", "file", name, "from", compression, "to", fp.compression)
+		dirty = true
+	}
+	return groups, dirty, nil
+}
+
+// restoreLazily restores the persistence file with its index file, so that the
+// metric families are only loaded from the persistence file on first access. It
+// returns false if there is no usable index file, in which case the persistence
+// file has to be read as a whole.
+func (fp *filePersister) restoreLazily() (GroupingKeyToMetricGroup, bool) {
+	indexFile := fp.file + indexSuffix
+	f, err := os.Open(indexFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			level.Warn(fp.logger).Log("msg", "could not open index file, reading persistence file as a whole", "file", indexFile, "err", err)
+		}
+		return nil, false
+	}
+	defer f.Close()
+
+	ls, err := openLazySnapshot(fp.file, fp.corruptions, fp.logger)
+	if err == nil {
+		var groups GroupingKeyToMetricGroup
+		if groups, fp.restoredSeq, err = readIndex(f, ls); err == nil {
+			fp.lazy = ls
+			level.Info(fp.logger).Log("msg", "restored persistence file with its index file, metric families are loaded on first access", "file", fp.file, "groups", len(groups))
+			return groups, true
+		}
+		ls.close()
+	}
+	if !os.IsNotExist(err) {
+		level.Warn(fp.logger).Log("msg", "could not use index file, reading persistence file as a whole", "file", indexFile, "err", err)
+	}
+	return nil, false
+}
+
+// restoredLazily implements lazyRestorer.
+func (fp *filePersister) restoredLazily() bool {
+	return fp.lazy != nil
+}
+
+// indexed returns true if an index file is written along with the persistence
+// file.
+func (fp *filePersister) indexed() bool {
+	return fp.index && fp.enc == nil && fp.compression == CompressionNone
+}
+
+// Replay implements Persister.
+func (fp *filePersister) Replay(apply func(wr WriteRequest, pushFailed bool)) (int, error) {
+	walDir := fp.file + walDirSuffix
+	replayed := 0
+	last, err := replayWAL(walDir, fp.restoredSeq, fp.enc, fp.logger, func(wr WriteRequest, pushFailed bool) {
+		replayed++
+		fp.recordChange(wr)
+		apply(wr, pushFailed)
+	})
+	if err != nil {
+		return replayed, err
+	}
+	if replayed > 0 {
+		level.Info(fp.logger).Log("msg", "replayed write-ahead log", "records", replayed)
+	}
+	fp.wal, err = openWAL(walDir, last, fp.enc, fp.sync)
+	return replayed, err
+}
+
+// Log implements Persister.
+func (fp *filePersister) Log(wr WriteRequest, pushFailed bool) error {
+	if fp.wal == nil {
+		return fmt.Errorf("write-ahead log not opened yet")
+	}
+	// Even if logging fails, the change is applied to the metric store.
+	fp.recordChange(wr)
+	return fp.wal.log(wr, pushFailed)
+}
+
+// recordChange records the groups changed by the provided WriteRequest for the
+// next delta file.
+func (fp *filePersister) recordChange(wr WriteRequest) {
+	if fp.changed == nil {
+		return
+	}
+	if wr.Wipe || wr.Groups != nil {
+		// Changes all groups, so write a snapshot next time.
+		fp.changed = nil
+		return
+	}
+	fp.changed[groupingKeyFor(wr.Labels)] = wr.Labels
+	if wr.RenameTo != nil {
+		fp.changed[groupingKeyFor(wr.RenameTo)] = wr.RenameTo
+	}
+}
+
+// persistenceSize implements persistenceSizer. It returns the size of the
+// persistence file, not counting delta files or the write-ahead log.
+func (fp *filePersister) persistenceSize() (int64, error) {
+	fi, err := os.Stat(fp.file)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Persist implements Persister. It writes a snapshot to a temporary file and
+// renames it to the persistence file afterwards. Then, the write-ahead log
+// segments covered by the snapshot are removed. The previous persistence file
+// becomes the backup file (unless it was found to be corrupted upon Restore). A
+// persistence file that could not be decrypted upon Restore is never
+// overwritten, unless wiped.
+//
+// If persisting incrementally (see NewIncrementalFilePersister), a delta file
+// is written instead if possible, see persistDelta. Writing a snapshot removes
+// all delta files afterwards.
+func (fp *filePersister) Persist(groups GroupingKeyToMetricGroup) error {
+	if fp.decryptFailed {
+		return fmt.Errorf("not overwriting persistence file %q as it (or one of its delta files) could not be read", fp.file)
+	}
+	if fp.compactionInterval > 0 && fp.wal != nil && fp.changed != nil &&
+		!fp.lastSnapshot.IsZero() && time.Since(fp.lastSnapshot) < fp.compactionInterval {
+		return fp.persistDelta(groups)
+	}
+	if err := fp.persistSnapshot(groups); err != nil {
+		return err
+	}
+	fp.lastSnapshot = time.Now()
+	if fp.compactionInterval > 0 {
+		fp.changed = map[string]map[string]string{}
+	}
+	// Left-over delta files are skipped upon restore as they are older
+	// than the snapshot, so failing to remove them is harmless.
+	if err := removeDeltas(fp.file + deltaDirSuffix); err != nil {
+		level.Warn(fp.logger).Log("msg", "could not remove delta files", "dir", fp.file+deltaDirSuffix, "err", err)
+	}
+	return nil
+}
+
+// persistDelta writes the changed groups to a new delta file, recording
+// deleted groups as tombstones, and removes the write-ahead log segments
+// covered by it. If no group has changed, it does nothing.
+func (fp *filePersister) persistDelta(groups GroupingKeyToMetricGroup) error {
+	if len(fp.changed) == 0 {
+		return nil
+	}
+	delta := make(GroupingKeyToMetricGroup, len(fp.changed))
+	for key, labels := range fp.changed {
+		if group, ok := groups[key]; ok {
+			delta[key] = group
+		} else {
+			delta[key] = tombstone(labels)
+		}
+	}
+	dir := fp.file + deltaDirSuffix
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "in_progress.")
+	if err != nil {
+		return err
+	}
+	inProgressFileName := f.Name()
+
+	lastSequence := fp.wal.last()
+	cutErr := fp.wal.cut()
+	if err := fp.writeFile(f, delta, lastSequence, nil); err != nil {
+		os.Remove(inProgressFileName)
+		return err
+	}
+	if err := replaceFile(inProgressFileName, segmentPath(dir, lastSequence)); err != nil {
+		return err
+	}
+	fp.syncDir(dir)
+	fp.changed = map[string]map[string]string{}
+	level.Debug(fp.logger).Log("msg", "wrote delta file", "groups", len(delta), "last_sequence", lastSequence)
+	if cutErr != nil {
+		return fmt.Errorf("could not start new write-ahead log segment: %v", cutErr)
+	}
+	return fp.wal.truncate(lastSequence)
+}
+
+// persistSnapshot writes the provided groups to the persistence file, see
+// Persist.
+func (fp *filePersister) persistSnapshot(groups GroupingKeyToMetricGroup) error {
+	f, err := ioutil.TempFile(
+		filepath.Dir(fp.file),
+		filepath.Base(fp.file)+".in_progress.",
+	)
+	if err != nil {
+		return err
+	}
+	inProgressFileName := f.Name()
+
+	if fp.lazy != nil {
+		// The persistence file is about to be replaced, so load what
+		// has not been loaded from it yet.
+		if corrupted := fp.lazy.release(); corrupted > 0 {
+			fp.keepBackup = true
+		}
+		fp.lazy = nil
+	}
+	var (
+		lastSequence uint64
+		cutErr       error
+		ix           *snapshotIndex
+	)
+	if fp.wal != nil {
+		lastSequence = fp.wal.last()
+		cutErr = fp.wal.cut()
+	}
+	if fp.indexed() {
+		ix = &snapshotIndex{}
+	}
+	if err := fp.writeFile(f, groups, lastSequence, ix); err != nil {
+		os.Remove(inProgressFileName)
+		return err
+	}
+	if !fp.keepBackup {
+		if err := replaceFile(fp.file, fp.file+backupSuffix); err != nil && !os.IsNotExist(err) {
+			level.Warn(fp.logger).Log("msg", "could not back up persistence file", "file", fp.file, "err", err)
+		}
+	}
+	if err := replaceFile(inProgressFileName, fp.file); err != nil {
+		return err
+	}
+	fp.syncDir(filepath.Dir(fp.file))
+	fp.keepBackup = false
+	if ix != nil {
+		fp.writeIndex(ix, lastSequence)
+	}
+	if fp.wal == nil {
+		return nil
+	}
+	if cutErr != nil {
+		// The current segment contains records reflected in the
+		// snapshot. Keep it, replaying them again is harmless.
+		return fmt.Errorf("could not start new write-ahead log segment: %v", cutErr)
+	}
+	return fp.wal.truncate(lastSequence)
+}
+
+// writeFile writes the provided groups as a snapshot to f, compressed with the
+// configured Compression, and closes it. Unless
+// the SyncPolicy is SyncNever, f is synced to disk before closing it, so that
+// renaming it into place cannot result in an empty or partial file after a
+// crash of the machine. If ix is not nil, the snapshot is indexed into it,
+// which requires neither compression nor encryption.
+func (fp *filePersister) writeFile(f *os.File, groups GroupingKeyToMetricGroup, lastSequence uint64, ix *snapshotIndex) error {
+	var err error
+	if ix != nil {
+		err = writeIndexedSnapshot(f, groups, lastSequence, ix)
+	} else {
+		err = fp.enc.writeSnapshot(f, groups, lastSequence, fp.compression)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fp.sync != SyncNever {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// writeIndex writes the index file for the persistence file just written. The
+// index file only speeds up restoring, so failing to write it is only logged,
+// and it is not synced to disk, as a stale or partial index file is detected
+// and ignored upon restore.
+func (fp *filePersister) writeIndex(ix *snapshotIndex, lastSequence uint64) {
+	indexFile := fp.file + indexSuffix
+	err := func() error {
+		f, err := ioutil.TempFile(filepath.Dir(indexFile), filepath.Base(indexFile)+".in_progress.")
+		if err != nil {
+			return err
+		}
+		if err := ix.write(f, lastSequence); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		return replaceFile(f.Name(), indexFile)
+	}()
+	if err != nil {
+		level.Warn(fp.logger).Log("msg", "could not write index file", "file", indexFile, "err", err)
+	}
+}
+
+// syncDir syncs the provided directory after renaming a file into it, unless the
+// SyncPolicy is SyncNever. The file is in place already, so failing to sync is
+// only logged.
+func (fp *filePersister) syncDir(dir string) {
+	if fp.sync == SyncNever {
+		return
+	}
+	if err := syncDir(dir); err != nil {
+		level.Warn(fp.logger).Log("msg", "could not sync directory", "dir", dir, "err", err)
+	}
+}
+
+// Wipe implements Persister.
+func (fp *filePersister) Wipe() error {
+	if fp.lazy != nil {
+		fp.lazy.close()
+		fp.lazy = nil
+	}
+	if err := os.Remove(fp.file + indexSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove index file %q: %v", fp.file+indexSuffix, err)
+	}
+	if err := os.Remove(fp.file); err != nil && !os.IsNotExist(err) {
+		// The wipe is still recorded in the write-ahead log.
+		return fmt.Errorf("could not remove persistence file %q: %v", fp.file, err)
+	}
+	fp.decryptFailed = false
+	if err := os.Remove(fp.file + backupSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove backup file %q: %v", fp.file+backupSuffix, err)
+	}
+	fp.keepBackup = false
+	fp.changed = nil
+	if err := removeDeltas(fp.file + deltaDirSuffix); err != nil {
+		return fmt.Errorf("could not remove delta files: %v", err)
+	}
+	if fp.wal == nil {
+		return nil
+	}
+	if err := fp.wal.reset(); err != nil {
+		return fmt.Errorf("could not remove write-ahead log: %v", err)
+	}
+	return nil
+}
+
+// Close implements Persister.
+func (fp *filePersister) Close() error {
+	if fp.lazy != nil {
+		fp.lazy.close()
+	}
+	if fp.wal == nil {
+		return nil
+	}
+	return fp.wal.close()
+}
+
+// applyDeltas applies the delta files in dir with a sequence number higher than
+// the provided one to groups, in order. It returns the sequence number of the
+// last delta file found (or the provided one if there is none higher), the
+// number of delta files applied, and the number of corruptions encountered. A
+// delta file that cannot be read at all counts as one corruption, but failing
+// to decrypt one is an error. A missing directory is not an error.
+func applyDeltas(
+	dir string,
+	after uint64,
+	enc *encryption,
+	groups GroupingKeyToMetricGroup,
+) (last uint64, applied, corrupted int, err error) {
+	last = after
+	deltas, err := listWALSegments(dir)
+	if os.IsNotExist(err) {
+		return last, 0, 0, nil
+	}
+	if err != nil {
+		return last, 0, 0, err
+	}
+	for _, seq := range deltas {
+		if seq <= after {
+			continue
+		}
+		last = seq
+		n, encrypted, err := applyDelta(segmentPath(dir, seq), enc, groups)
+		if err != nil && encrypted {
+			return last, applied, corrupted, fmt.Errorf("could not read delta file %q: %v", segmentPath(dir, seq), err)
+		}
+		if err != nil {
+			corrupted++
+			continue
+		}
+		applied++
+		corrupted += n
+	}
+	return last, applied, corrupted, nil
+}
+
+// applyDelta applies the delta file with the provided name to groups and returns
+// the number of corruptions encountered and whether the file is encrypted.
+func applyDelta(name string, enc *encryption, groups GroupingKeyToMetricGroup) (int, bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	sr, encrypted, _, err := enc.snapshotReader(f)
+	if err != nil {
+		return 0, encrypted, err
+	}
+	delta, _, corrupted, _, err := readSnapshot(sr)
+	if err != nil {
+		return 0, encrypted, err
+	}
+	for key, group := range delta {
+		if isTombstone(group) {
+			delete(groups, key)
+			continue
+		}
+		groups[key] = group
+	}
+	return corrupted, encrypted, nil
+}
+
+// removeDeltas removes all delta files in dir.
+func removeDeltas(dir string) error {
+	deltas, err := listWALSegments(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, seq := range deltas {
+		if err := os.Remove(segmentPath(dir, seq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
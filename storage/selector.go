@@ -0,0 +1,319 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MatchType is the type of a LabelMatcher.
+type MatchType int
+
+// Valid MatchType values.
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return fmt.Sprintf("MatchType(%d)", int(t))
+}
+
+// LabelMatcher matches the value of the label with the given name, where a
+// missing label counts as a label with an empty value. The metric name is
+// matched as the label "__name__".
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+	re    *regexp.Regexp // Only set for MatchRegexp and MatchNotRegexp.
+}
+
+// NewLabelMatcher returns a LabelMatcher of the provided type. Regular
+// expressions are anchored at both ends, as usual in Prometheus.
+func NewLabelMatcher(t MatchType, name, value string) (*LabelMatcher, error) {
+	m := &LabelMatcher{Type: t, Name: name, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches returns whether the LabelMatcher matches the provided label value.
+func (m *LabelMatcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+func (m *LabelMatcher) String() string {
+	return m.Name + m.Type.String() + strconv.Quote(m.Value)
+}
+
+// Selector selects the metrics matched by all of its LabelMatchers, like a
+// Prometheus series selector.
+type Selector []*LabelMatcher
+
+// ParseSelector parses a Prometheus series selector, i.e. an optional metric
+// name followed by optional label matchers in curly braces, e.g.
+// `some_metric{job="foo",instance=~"bar.*"}`. The selector must contain at
+// least one matcher (with the metric name counting as one).
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	rest := strings.TrimSpace(s)
+	if name := leadingName(rest, true); name != "" {
+		m, _ := NewLabelMatcher(MatchEqual, model.MetricNameLabel, name)
+		sel = append(sel, m)
+		rest = strings.TrimSpace(rest[len(name):])
+	}
+	if rest != "" {
+		if rest[0] != '{' || rest[len(rest)-1] != '}' {
+			return nil, fmt.Errorf("invalid selector %q", s)
+		}
+		var err error
+		for rest = strings.TrimSpace(rest[1 : len(rest)-1]); rest != ""; {
+			var m *LabelMatcher
+			if m, rest, err = parseLabelMatcher(rest); err != nil {
+				return nil, fmt.Errorf("invalid selector %q: %v", s, err)
+			}
+			sel = append(sel, m)
+			if rest = strings.TrimSpace(rest); rest == "" {
+				break
+			}
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("invalid selector %q: expected ',' before %q", s, rest)
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("selector %q contains no matchers", s)
+	}
+	return sel, nil
+}
+
+// leadingName returns the longest prefix of s that is a valid label name or,
+// if metricName is true, a valid metric name.
+func leadingName(s string, metricName bool) string {
+	for i, r := range s {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r == ':' && metricName:
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// parseLabelMatcher parses the label matcher at the start of s and returns it
+// together with the rest of s.
+func parseLabelMatcher(s string) (*LabelMatcher, string, error) {
+	name := leadingName(s, false)
+	if name == "" {
+		return nil, "", fmt.Errorf("expected label name at %q", s)
+	}
+	rest := strings.TrimSpace(s[len(name):])
+	var t MatchType
+	switch {
+	case strings.HasPrefix(rest, "=~"):
+		t = MatchRegexp
+	case strings.HasPrefix(rest, "!~"):
+		t = MatchNotRegexp
+	case strings.HasPrefix(rest, "!="):
+		t = MatchNotEqual
+	case strings.HasPrefix(rest, "="):
+		t = MatchEqual
+	default:
+		return nil, "", fmt.Errorf("expected match operator after label name %q", name)
+	}
+	value, rest, err := parseQuoted(strings.TrimSpace(rest[len(t.String()):]))
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := NewLabelMatcher(t, name, value)
+	if err != nil {
+		return nil, "", err
+	}
+	return m, rest, nil
+}
+
+// parseQuoted parses the string in double quotes, single quotes, or backticks
+// at the start of s and returns its value together with the rest of s.
+func parseQuoted(s string) (string, string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'' && s[0] != '`') {
+		return "", "", errors.New("expected quoted label value")
+	}
+	q := s[0]
+	// A single-quoted string is converted into a double-quoted one to be
+	// unquoted by strconv.Unquote.
+	var converted strings.Builder
+	converted.WriteByte('"')
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == q:
+			if q != '\'' {
+				converted.Reset()
+				converted.WriteString(s[:i+1])
+			} else {
+				converted.WriteByte('"')
+			}
+			value, err := strconv.Unquote(converted.String())
+			if err != nil {
+				return "", "", fmt.Errorf("invalid quoted label value %s: %v", s[:i+1], err)
+			}
+			return value, s[i+1:], nil
+		case c == '\\' && q != '`' && i+1 < len(s):
+			i++
+			if s[i] != '\'' {
+				converted.WriteByte('\\')
+			}
+			converted.WriteByte(s[i])
+		case c == '"':
+			converted.WriteString(`\"`)
+		default:
+			converted.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted label value %s", s)
+}
+
+// SelectMetricFamilies returns the metric families resulting from removing all
+// metrics from the provided ones that are not matched by any of the provided
+// Selectors. Metric families left without metrics are dropped. If there are no
+// Selectors, the provided metric families are returned unchanged. The provided
+// metric families are not modified.
+func SelectMetricFamilies(mfs []*dto.MetricFamily, selectors []Selector) []*dto.MetricFamily {
+	if len(selectors) == 0 {
+		return mfs
+	}
+	result := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		if mf, _ = selectMetricFamily(mf, nil, selectors); mf != nil {
+			result = append(result, mf)
+		}
+	}
+	return result
+}
+
+// selectMetricFamily returns the provided metric family with only the metrics
+// matched by any of the provided Selectors, or nil if there are none. All
+// metrics are expected to have the provided grouping labels (which may be nil),
+// so that they are only checked once per Selector. If all metrics are matched,
+// the metric family is returned as is. Otherwise, a copy is returned, and
+// copied is true.
+func selectMetricFamily(mf *dto.MetricFamily, groupingLabels map[string]string, selectors []Selector) (result *dto.MetricFamily, copied bool) {
+	// The matchers that remain to be checked per metric, for each Selector
+	// that has not been ruled out yet.
+	var remaining []Selector
+	for _, sel := range selectors {
+		var perMetric Selector
+		matched := true
+		for _, m := range sel {
+			if m.Name == model.MetricNameLabel {
+				matched = m.Matches(mf.GetName())
+			} else if v, ok := groupingLabels[m.Name]; ok {
+				matched = m.Matches(v)
+			} else {
+				perMetric = append(perMetric, m)
+			}
+			if !matched {
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if len(perMetric) == 0 {
+			return mf, false
+		}
+		remaining = append(remaining, perMetric)
+	}
+	if len(remaining) == 0 {
+		return nil, false
+	}
+
+	var metrics []*dto.Metric
+	for _, metric := range mf.GetMetric() {
+		for _, sel := range remaining {
+			if selectorMatchesMetric(sel, metric) {
+				metrics = append(metrics, metric)
+				break
+			}
+		}
+	}
+	switch len(metrics) {
+	case 0:
+		return nil, false
+	case len(mf.GetMetric()):
+		return mf, false
+	}
+	return &dto.MetricFamily{
+		Name:   mf.Name,
+		Help:   mf.Help,
+		Type:   mf.Type,
+		Metric: metrics,
+	}, true
+}
+
+// selectorMatchesMetric returns whether all matchers of the provided Selector
+// (none of them for the metric name) match the labels of the provided metric.
+func selectorMatchesMetric(sel Selector, metric *dto.Metric) bool {
+	for _, m := range sel {
+		value := ""
+		for _, lp := range metric.GetLabel() {
+			if lp.GetName() == m.Name {
+				value = lp.GetValue()
+				break
+			}
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+func TestParseSelector(t *testing.T) {
+	for s, expected := range map[string][]string{
+		`some_metric`:                              {`__name__="some_metric"`},
+		` some:metric { } `:                        {`__name__="some:metric"`},
+		`{job="foo"}`:                              {`job="foo"`},
+		`{job="foo",}`:                             {`job="foo"`},
+		`x{job!="a", instance=~"b.*",zone!~'c'}`:   {`__name__="x"`, `job!="a"`, `instance=~"b.*"`, `zone!~"c"`},
+		`{a="\"q\"", b='it\'s "x"', c=` + "`\\d`}": {`a="\"q\""`, `b="it's \"x\""`, `c="\\d"`},
+	} {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %v", s, err)
+			continue
+		}
+		got := make([]string, len(sel))
+		for i, m := range sel {
+			got[i] = m.String()
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("%q: Wanted matchers %v, got %v.", s, expected, got)
+		}
+	}
+
+	for _, s := range []string{
+		``, `{}`, `{job}`, `{job="foo"`, `job="foo"`, `{job=foo}`, `{job="foo" instance="bar"}`,
+		`{job="foo}`, `{job=~"("}`, `{0job="foo"}`, `1metric`,
+	} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("%q: Expected error.", s)
+		}
+	}
+}
+
+func TestGetMatchingMetricFamilies(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+
+	grouping1 := map[string]string{"job": "job1", "instance": "instance1"}
+	grouping2 := map[string]string{"job": "job2", "instance": "instance2"}
+	submit(t, dms, WriteRequest{Labels: grouping1, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2)})
+	submit(t, dms, WriteRequest{Labels: grouping2, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf1b, mf3)})
+
+	// series returns the name and the job label of every metric.
+	series := func(selectors ...string) []string {
+		sels := make([]Selector, len(selectors))
+		for i, s := range selectors {
+			sel, err := ParseSelector(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sels[i] = sel
+		}
+		var result []string
+		for _, mf := range dms.GetMatchingMetricFamilies(sels) {
+			for _, m := range mf.GetMetric() {
+				job := ""
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "job" {
+						job = lp.GetValue()
+					}
+				}
+				result = append(result, mf.GetName()+"/"+job)
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	for _, s := range []struct {
+		selectors []string
+		expected  []string
+	}{
+		{[]string{`mf1`}, []string{"mf1/job1", "mf1/job2"}},
+		{[]string{`{job="job2",__name__=~"mf.*"}`}, []string{"mf1/job2", "mf3/job2"}},
+		{[]string{`mf1{job="job1"}`, `mf2`}, []string{"mf1/job1", "mf2/job1", "mf2/job1"}},
+		{[]string{`{instance!="instance1",__name__!~"push_.*|mf1"}`}, []string{"mf3/job2"}},
+		// Only one of the metrics in mf2 matches.
+		{[]string{`mf2{labelname="val1"}`}, []string{"mf2/job1"}},
+		{[]string{`{job="job3"}`}, nil},
+	} {
+		if got := series(s.selectors...); !reflect.DeepEqual(s.expected, got) {
+			t.Errorf("%v: Wanted %v, got %v.", s.selectors, s.expected, got)
+		}
+	}
+	// Without selectors, the result is the same as for GetMetricFamilies.
+	if expected, got := dms.GetMetricFamilies(), dms.GetMatchingMetricFamilies(nil); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wanted %v, got %v.", expected, got)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
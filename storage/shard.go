@@ -0,0 +1,134 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Shard is one of Count disjoint subsets of the metric groups, numbered from 1
+// to Count. A group belongs to the shard given by the FNV-1a hash of its
+// grouping key modulo Count, so that the assignment is the same on every
+// Pushgateway and across restarts. The zero value (Count 0) contains all
+// groups.
+type Shard struct {
+	Index, Count int
+}
+
+// ParseShard parses a Shard in the form "<index>of<count>", e.g. "2of5".
+func ParseShard(s string) (Shard, error) {
+	i := strings.Index(s, "of")
+	if i < 0 {
+		return Shard{}, fmt.Errorf("invalid shard %q, expected e.g. 2of5", s)
+	}
+	index, err1 := strconv.Atoi(s[:i])
+	count, err2 := strconv.Atoi(s[i+2:])
+	if err1 != nil || err2 != nil || index < 1 || index > count {
+		return Shard{}, fmt.Errorf("invalid shard %q, expected e.g. 2of5", s)
+	}
+	return Shard{Index: index, Count: count}, nil
+}
+
+func (s Shard) String() string {
+	return fmt.Sprintf("%dof%d", s.Index, s.Count)
+}
+
+// All returns true for the zero Shard, which contains all groups.
+func (s Shard) All() bool {
+	return s.Count == 0
+}
+
+// Contains returns true if the group with the provided grouping labels belongs
+// to the Shard.
+func (s Shard) Contains(labels map[string]string) bool {
+	return s.containsKey(groupingKeyFor(labels))
+}
+
+func (s Shard) containsKey(groupingKey string) bool {
+	if s.All() {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(groupingKey))
+	return int(h.Sum64()%uint64(s.Count)) == s.Index-1
+}
+
+// Groups returns the groups of the provided ones that belong to the Shard. For
+// the zero Shard, the provided groups are returned as is.
+func (s Shard) Groups(groups GroupingKeyToMetricGroup) GroupingKeyToMetricGroup {
+	if s.All() {
+		return groups
+	}
+	result := GroupingKeyToMetricGroup{}
+	for k, g := range groups {
+		if s.containsKey(k) {
+			result[k] = g
+		}
+	}
+	return result
+}
+
+// ShardedMetricStore is implemented by MetricStores that can efficiently return
+// only the metrics of the groups in a Shard.
+type ShardedMetricStore interface {
+	// GetShardMetricFamilies returns the same as GetMatchingMetricFamilies,
+	// but only with the metrics of the groups in the provided Shard.
+	GetShardMetricFamilies(shard Shard, selectors []Selector) []*dto.MetricFamily
+}
+
+// ShardMetricFamilies returns the metric families of the groups in the provided
+// Shard in ms, restricted to those matched by any of the provided Selectors (if
+// there are any) like MatchingMetricFamilies does. It uses
+// GetShardMetricFamilies if ms is a ShardedMetricStore.
+func ShardMetricFamilies(ms MetricStore, shard Shard, selectors []Selector) []*dto.MetricFamily {
+	if shard.All() {
+		return MatchingMetricFamilies(ms, selectors)
+	}
+	if sms, ok := ms.(ShardedMetricStore); ok {
+		return sms.GetShardMetricFamilies(shard, selectors)
+	}
+	groups := shard.Groups(ms.GetMetricFamiliesMap())
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var result []*dto.MetricFamily
+	byName := map[string]*dto.MetricFamily{}
+	for _, k := range keys {
+		for name, tmf := range groups[k].Metrics {
+			mf := tmf.GetMetricFamily()
+			if mf == nil {
+				continue
+			}
+			if merged, ok := byName[name]; ok {
+				merged.Metric = append(merged.Metric, mf.Metric...)
+				continue
+			}
+			mf = copyMetricFamily(mf)
+			byName[name] = mf
+			result = append(result, mf)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GetName() < result[j].GetName()
+	})
+	return SelectMetricFamilies(result, selectors)
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+func TestParseShard(t *testing.T) {
+	for s, expected := range map[string]Shard{
+		"1of1": {Index: 1, Count: 1},
+		"2of5": {Index: 2, Count: 5},
+		"5of5": {Index: 5, Count: 5},
+	} {
+		got, err := ParseShard(s)
+		if err != nil {
+			t.Errorf("%q: Unexpected error: %v", s, err)
+			continue
+		}
+		if expected != got {
+			t.Errorf("%q: Wanted %v, got %v.", s, expected, got)
+		}
+		if got.String() != s {
+			t.Errorf("Wanted %q, got %q.", s, got)
+		}
+	}
+	for _, s := range []string{"", "2", "of5", "2of", "0of5", "6of5", "-1of5", "2 of 5", "aofb"} {
+		if got, err := ParseShard(s); err == nil {
+			t.Errorf("%q: Expected error, got %v.", s, got)
+		}
+	}
+}
+
+// unshardedStore hides the GetShardMetricFamilies method of a MetricStore.
+type unshardedStore struct {
+	MetricStore
+}
+
+func TestShardMetricFamilies(t *testing.T) {
+	dms := NewDiskMetricStore("", 100*time.Millisecond, nil, logger)
+	for i := 0; i < 20; i++ {
+		grouping := map[string]string{"job": fmt.Sprintf("job%d", i)}
+		submit(t, dms, WriteRequest{Labels: grouping, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	}
+
+	// series returns the name and the job label of every metric in the shard.
+	series := func(ms MetricStore, shard Shard) []string {
+		var result []string
+		for _, mf := range ShardMetricFamilies(ms, shard, nil) {
+			for _, m := range mf.GetMetric() {
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "job" {
+						result = append(result, mf.GetName()+"/"+lp.GetValue())
+					}
+				}
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	all := series(dms, Shard{})
+	seen := map[string]int{}
+	for i := 1; i <= 3; i++ {
+		shard := Shard{Index: i, Count: 3}
+		got := series(dms, shard)
+		if len(got) == 0 {
+			t.Errorf("%v: Wanted some metrics, got none.", shard)
+		}
+		if expected, got := got, series(unshardedStore{dms}, shard); !reflect.DeepEqual(expected, got) {
+			t.Errorf("%v: Wanted %v without ShardedMetricStore, got %v.", shard, expected, got)
+		}
+		// Each group has one metric in mf3 and the two push time metrics.
+		if expected, got := len(shard.Groups(dms.GetMetricFamiliesMap())), len(got)/3; expected != got {
+			t.Errorf("%v: Wanted %d groups, got %d.", shard, expected, got)
+		}
+		for _, s := range got {
+			seen[s]++
+		}
+	}
+	// The shards partition all metrics.
+	if expected, got := len(all), len(seen); expected != got {
+		t.Errorf("Wanted %d metrics in all shards, got %d.", expected, got)
+	}
+	for s, n := range seen {
+		if n != 1 {
+			t.Errorf("Wanted %s in one shard, got %d.", s, n)
+		}
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// spillFileName is the name of the spill file within the spill
+	// directory.
+	spillFileName = "write-queue.spill"
+	// spillHeaderSize is the size of the header of the spill file, which
+	// is the offset of the first record not yet consumed as a
+	// little-endian uint64.
+	spillHeaderSize = 8
+)
+
+// Flags in the first byte of a spill record, for the fields of a WriteRequest
+// not covered by the write-ahead log record format.
+const (
+	spillAllowTimestamps byte = 1 << iota
+	spillFlush
+)
+
+// errSpillFull is returned by spillQueue.pushOrSend if the spill file would exceed
+// its maximum size.
+var errSpillFull = errors.New("spill file is full")
+
+// spillQueue is a FIFO of WriteRequests kept in a file, used as an overflow for
+// a full write queue. The file starts with a header, see spillHeaderSize,
+// followed by the records. Each record is a flags byte followed by the
+// WriteRequest in the write-ahead log record format, framed like the records of
+// a snapshot (uvarint length, record, CRC-32C). The Done channels of queued
+// WriteRequests are kept in memory. The file is truncated whenever the queue
+// becomes empty.
+//
+// A spillQueue survives a restart: Upon opening, all intact records after the
+// offset in the header are queued again. All methods are safe for concurrent
+// use.
+type spillQueue struct {
+	mtx     sync.Mutex
+	file    *os.File
+	maxSize int64         // 0 means no limit.
+	size    int64         // Size of the file, including the header.
+	entries []spillEntry  // In file order.
+	total   int           // Number of WriteRequests ever spilled.
+	wake    chan struct{} // Signaled after a push.
+}
+
+type spillEntry struct {
+	offset int64
+	length int
+	done   chan error
+}
+
+// openSpillQueue opens the spill file in dir, creating dir and the file if
+// needed. It returns the spillQueue and the number of corrupted bytes that have
+// been truncated from the end of the file.
+func openSpillQueue(dir string, maxSize int64) (*spillQueue, int64, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, spillFileName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+	sq := &spillQueue{
+		file:    f,
+		maxSize: maxSize,
+		wake:    make(chan struct{}, 1),
+	}
+	corrupted, err := sq.recover()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if len(sq.entries) > 0 {
+		sq.wake <- struct{}{}
+	}
+	return sq, corrupted, nil
+}
+
+// recover queues the records left in the file and truncates anything after the
+// last intact record. It returns the number of truncated bytes.
+func (sq *spillQueue) recover() (int64, error) {
+	fileSize, err := sq.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	head := int64(spillHeaderSize)
+	if fileSize >= spillHeaderSize {
+		header := make([]byte, spillHeaderSize)
+		if _, err := sq.file.ReadAt(header, 0); err != nil {
+			return 0, err
+		}
+		head = int64(binary.LittleEndian.Uint64(header))
+	}
+	if head < spillHeaderSize || head > fileSize {
+		// Nothing left to consume (or garbage).
+		head = fileSize
+	}
+	sq.size = head
+	if _, err := sq.file.Seek(head, io.SeekStart); err != nil {
+		return 0, err
+	}
+	cr := &crcReader{br: bufio.NewReader(sq.file)}
+	for {
+		record, err := readChecksummedRecord(cr)
+		if err != nil || len(record) == 0 {
+			// io.EOF, a corrupted record, or a zero-length record,
+			// which is never written. Everything from here on is
+			// discarded.
+			break
+		}
+		length := protowire.SizeBytes(len(record)) + 4
+		sq.entries = append(sq.entries, spillEntry{offset: sq.size, length: length})
+		sq.size += int64(length)
+	}
+	corrupted := fileSize - sq.size
+	if len(sq.entries) == 0 {
+		return corrupted, sq.reset()
+	}
+	if corrupted > 0 {
+		return corrupted, sq.file.Truncate(sq.size)
+	}
+	return 0, nil
+}
+
+// reset empties the file. The caller must hold mtx unless the spillQueue is
+// still being opened.
+func (sq *spillQueue) reset() error {
+	sq.entries = nil
+	sq.size = spillHeaderSize
+	if err := sq.file.Truncate(spillHeaderSize); err != nil {
+		return err
+	}
+	return sq.writeHead(spillHeaderSize)
+}
+
+func (sq *spillQueue) writeHead(head int64) error {
+	_, err := sq.file.WriteAt(binary.LittleEndian.AppendUint64(nil, uint64(head)), 0)
+	return err
+}
+
+// pushOrSend sends wr to ch without blocking if the spillQueue is empty.
+// Otherwise, or if ch is full, wr is appended to the spillQueue so that the
+// order of WriteRequests is kept. If appending fails, the error is returned
+// together with whether the spillQueue is empty, in which case the caller may
+// still send wr to ch in the usual way without breaking the order.
+func (sq *spillQueue) pushOrSend(wr WriteRequest, ch chan<- WriteRequest) (bool, error) {
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+
+	if len(sq.entries) == 0 {
+		select {
+		case ch <- wr:
+			return false, nil
+		default:
+		}
+	}
+	if err := sq.pushLocked(wr); err != nil {
+		return len(sq.entries) == 0, err
+	}
+	return false, nil
+}
+
+func (sq *spillQueue) pushLocked(wr WriteRequest) error {
+	var flags byte
+	if wr.AllowTimestamps {
+		flags |= spillAllowTimestamps
+	}
+	record := []byte{flags}
+	if wr.Flush {
+		record[0] |= spillFlush
+	} else {
+		raw, err := marshalWALRecord(0, wr, false)
+		if err != nil {
+			return err
+		}
+		record = append(record, raw...)
+	}
+	b := appendChecksummedRecord(nil, record)
+	if sq.maxSize > 0 && sq.size-spillHeaderSize+int64(len(b)) > sq.maxSize {
+		return errSpillFull
+	}
+	if _, err := sq.file.WriteAt(b, sq.size); err != nil {
+		// Cut off what might have been written partially.
+		sq.file.Truncate(sq.size)
+		return err
+	}
+	sq.entries = append(sq.entries, spillEntry{offset: sq.size, length: len(b), done: wr.Done})
+	sq.size += int64(len(b))
+	sq.total++
+	select {
+	case sq.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek returns the oldest WriteRequest in the spillQueue without removing it,
+// or false if the spillQueue is empty. A WriteRequest that cannot be read is
+// returned together with the error, with only its Done channel set.
+func (sq *spillQueue) peek() (WriteRequest, bool, error) {
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+
+	if len(sq.entries) == 0 {
+		return WriteRequest{}, false, nil
+	}
+	e := sq.entries[0]
+	wr, err := sq.read(e)
+	if err != nil {
+		wr = WriteRequest{}
+	}
+	wr.Done = e.done
+	return wr, true, err
+}
+
+func (sq *spillQueue) read(e spillEntry) (WriteRequest, error) {
+	b := make([]byte, e.length)
+	if _, err := sq.file.ReadAt(b, e.offset); err != nil {
+		return WriteRequest{}, err
+	}
+	record, n := protowire.ConsumeBytes(b)
+	if n < 0 || n+4 != len(b) || len(record) == 0 {
+		return WriteRequest{}, fmt.Errorf("malformed spill record at offset %d", e.offset)
+	}
+	if binary.LittleEndian.Uint32(b[n:]) != crc32.Checksum(record, crcTable) {
+		return WriteRequest{}, errCorruptedRecord
+	}
+	flags := record[0]
+	if flags&spillFlush != 0 {
+		return WriteRequest{Flush: true}, nil
+	}
+	wr, err := UnmarshalWriteRequest(record[1:])
+	if err != nil {
+		return WriteRequest{}, err
+	}
+	wr.AllowTimestamps = flags&spillAllowTimestamps != 0
+	return wr, nil
+}
+
+// pop removes the oldest WriteRequest from the spillQueue by advancing the
+// offset in the header, or by truncating the file if the spillQueue is empty
+// afterwards.
+func (sq *spillQueue) pop() error {
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+
+	if len(sq.entries) == 0 {
+		return nil
+	}
+	sq.entries = sq.entries[1:]
+	if len(sq.entries) == 0 {
+		return sq.reset()
+	}
+	return sq.writeHead(sq.entries[0].offset)
+}
+
+// stats returns the number of queued WriteRequests, their size in the file,
+// and the total number of WriteRequests ever spilled.
+func (sq *spillQueue) stats() (int, int64, int) {
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+	if len(sq.entries) == 0 {
+		return 0, 0, sq.total
+	}
+	return len(sq.entries), sq.size - sq.entries[0].offset, sq.total
+}
+
+// close closes the file. If the spillQueue is empty, the file is removed.
+func (sq *spillQueue) close() error {
+	sq.mtx.Lock()
+	defer sq.mtx.Unlock()
+
+	name := sq.file.Name()
+	err := sq.file.Close()
+	if err == nil && len(sq.entries) == 0 {
+		err = os.Remove(name)
+	}
+	return err
+}
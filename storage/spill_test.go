@@ -0,0 +1,158 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+func TestWriteQueueSpill(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestWriteQueueSpill.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	dms := NewPersistentMetricStore(nil, time.Hour, Limits{}, WriteQueueOptions{
+		Capacity: 2,
+		Timeout:  time.Millisecond,
+		SpillDir: tempDir,
+	}, nil, logger)
+
+	// Block processing of write requests by holding the lock.
+	dms.lock.Lock()
+	const n = 10
+	errChs := []chan error{}
+	for i := 0; i < n; i++ {
+		errCh := make(chan error, 1)
+		if err := dms.SubmitWriteRequest(WriteRequest{
+			Labels:         map[string]string{"job": "job1", "instance": strconv.Itoa(i)},
+			Timestamp:      time.Now(),
+			MetricFamilies: testutil.MetricFamiliesMap(mf3),
+			Done:           errCh,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		errChs = append(errChs, errCh)
+	}
+	// Deleting the first group only works if the order is kept.
+	if err := dms.SubmitWriteRequest(WriteRequest{
+		Labels:    map[string]string{"job": "job1", "instance": "0"},
+		Timestamp: time.Now(),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	length, size, total := dms.spill.stats()
+	// Up to 3 write requests are in the queue or taken by the loop.
+	if length < n-2 || size == 0 || total != length {
+		t.Errorf("Unexpected spill stats: length %d, size %d, total %d.", length, size, total)
+	}
+	dms.lock.Unlock()
+
+	for _, errCh := range errChs {
+		for err := range errCh {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	groups := dms.GetMetricFamiliesMap()
+	if expected, got := n-1, len(groups); expected != got {
+		t.Errorf("Wanted %d groups, got %d.", expected, got)
+	}
+	if _, ok := groups[groupingKeyFor(map[string]string{"job": "job1", "instance": "0"})]; ok {
+		t.Error("Deleted group still present.")
+	}
+	if _, err := os.Stat(path.Join(tempDir, spillFileName)); !os.IsNotExist(err) {
+		t.Error("Spill file not removed upon shutdown:", err)
+	}
+}
+
+func TestSpillQueueRecovery(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestSpillQueueRecovery.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sq, _, err := openSpillQueue(tempDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wr := range []WriteRequest{
+		{Labels: map[string]string{"job": "job1"}, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf3)},
+		{Labels: map[string]string{"job": "job2"}, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf3), AllowTimestamps: true},
+		{Flush: true},
+	} {
+		// A nil channel is always full.
+		if _, err := sq.pushOrSend(wr, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sq.pop(); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash in the middle of writing a record.
+	if _, err := sq.file.WriteAt([]byte{42, 1, 2}, sq.size); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, corrupted, err := openSpillQueue(tempDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := int64(3), corrupted; expected != got {
+		t.Errorf("Wanted %d corrupted bytes, got %d.", expected, got)
+	}
+	if length, _, _ := recovered.stats(); length != 2 {
+		t.Fatalf("Wanted 2 recovered write requests, got %d.", length)
+	}
+	wr, ok, err := recovered.peek()
+	if !ok || err != nil {
+		t.Fatal("Could not read recovered write request:", err)
+	}
+	if wr.Labels["job"] != "job2" || !wr.AllowTimestamps || len(wr.MetricFamilies) != 1 {
+		t.Errorf("Unexpected recovered write request %+v.", wr)
+	}
+	recovered.pop()
+	if wr, _, _ := recovered.peek(); !wr.Flush {
+		t.Errorf("Wanted flush request, got %+v.", wr)
+	}
+	recovered.pop()
+	if err := recovered.close(); err != nil {
+		t.Fatal(err)
+	}
+	sq.file.Close()
+
+	// A limited spillQueue rejects records exceeding the limit.
+	limited, _, err := openSpillQueue(tempDir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limited.close()
+	fallBack, err := limited.pushOrSend(WriteRequest{Labels: map[string]string{"job": "job1"}, Timestamp: time.Now()}, nil)
+	if expected, got := errSpillFull, err; expected != got {
+		t.Errorf("Wanted error %v, got %v.", expected, got)
+	}
+	if !fallBack {
+		t.Error("Expected fall-back for empty spill queue.")
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+// SyncPolicy determines when a filePersister syncs the files it writes to disk.
+type SyncPolicy string
+
+// Valid SyncPolicy values.
+const (
+	// SyncAlways syncs the write-ahead log after every record, and every
+	// persistence file and delta file before renaming it into place,
+	// followed by the directory containing it.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval syncs persistence files and delta files like
+	// SyncAlways, and the write-ahead log whenever the persistence file or
+	// a delta file is written, i.e. once per persistence interval.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever never syncs anything, leaving it to the operating system
+	// when to write changes to disk.
+	SyncNever SyncPolicy = "never"
+)
+
+// SyncPolicies are all valid SyncPolicy values as strings.
+var SyncPolicies = []string{
+	string(SyncAlways), string(SyncInterval), string(SyncNever),
+}
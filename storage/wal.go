@@ -0,0 +1,634 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/codec"
+)
+
+// The write-ahead log (WAL) lives in a directory next to the persistence file,
+// named like the persistence file with walDirSuffix appended. It consists of
+// segment files, each named after the 20-digit zero-padded sequence number of
+// its first record. A segment is a sequence of records, each of them a uvarint
+// length followed by a protobuf-encoded Record message:
+//
+//	message Record {
+//	  uint64 sequence = 1;
+//	  Type type = 2;
+//	  repeated io.prometheus.client.LabelPair label = 3;
+//	  int64 timestamp_seconds = 4;
+//	  int32 timestamp_nanos = 5;
+//	  repeated io.prometheus.client.MetricFamily metric_family = 6;
+//	  repeated string metric_name = 7;
+//	  bool replace = 8;
+//	  int64 ttl_nanoseconds = 9;
+//	  string aggregation = 10;
+//	  repeated io.prometheus.client.LabelPair annotation = 11;
+//	  repeated Group group = 12; // See persistence.go.
+//	  string payload_hash = 13;
+//	  int64 payload_size = 14;
+//	  repeated io.prometheus.client.LabelPair rename_to = 15;
+//	  repeated io.prometheus.client.LabelPair metric_label = 16;
+//	  int64 expected_interval_nanoseconds = 17;
+//	  string content_type = 18;
+//	  string content_encoding = 19;
+//	  string format = 20;
+//	  uint64 push_sequence = 21;
+//	}
+//
+//	enum Type {
+//	  UPDATE = 0;
+//	  DELETE = 1;
+//	  PUSH_FAILED = 2;
+//	  WIPE = 3;
+//	  LOCK = 4;
+//	  UNLOCK = 5;
+//	  RESTORE = 6;
+//	  RENAME = 7;
+//	}
+//
+// Every change of the metric store is appended to the WAL before it becomes
+// visible. Persisting a snapshot starts a new segment and removes all older
+// segments once the snapshot, which records the sequence number of the last
+// change it reflects, has been written successfully. On start-up, all records
+// with a higher sequence number than the one recorded in the snapshot are
+// replayed.
+const (
+	walDirSuffix = ".wal"
+
+	walSequenceField         protowire.Number = 1
+	walTypeField             protowire.Number = 2
+	walLabelField            protowire.Number = 3
+	walTimestampSecondsField protowire.Number = 4
+	walTimestampNanosField   protowire.Number = 5
+	walMetricFamilyField     protowire.Number = 6
+	walMetricNameField       protowire.Number = 7
+	walReplaceField          protowire.Number = 8
+	walTTLField              protowire.Number = 9
+	walAggregationField      protowire.Number = 10
+	walAnnotationField       protowire.Number = 11
+	walGroupField            protowire.Number = 12
+	walPayloadHashField      protowire.Number = 13
+	walPayloadSizeField      protowire.Number = 14
+	walRenameToField         protowire.Number = 15
+	walMetricLabelField      protowire.Number = 16
+	walExpectedIntervalField protowire.Number = 17
+	walContentTypeField      protowire.Number = 18
+	walContentEncodingField  protowire.Number = 19
+	walFormatField           protowire.Number = 20
+	walPushSequenceField     protowire.Number = 21
+)
+
+type walRecordType uint64
+
+const (
+	walUpdate walRecordType = iota
+	walDelete
+	walPushFailed
+	walWipe
+	walLock
+	walUnlock
+	walRestore
+	walRename
+)
+
+// wal is the write-ahead log of a DiskMetricStore. All its methods are safe for
+// concurrent use.
+type wal struct {
+	mtx          sync.Mutex
+	dir          string
+	segment      *os.File
+	segmentFirst uint64 // Sequence number of the first record in segment.
+	lastSequence uint64
+	enc          *encryption
+	sync         SyncPolicy
+}
+
+// openWAL creates the WAL directory if needed and starts a new segment, with
+// lastSequence being the sequence number of the last record ever written. New
+// records are encrypted with enc if it is not nil. With SyncAlways, every record
+// is synced to disk right away. Otherwise, unless with SyncNever, a segment is
+// synced when the next one is started.
+func openWAL(dir string, lastSequence uint64, enc *encryption, syncPolicy SyncPolicy) (*wal, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	w := &wal{dir: dir, lastSequence: lastSequence, enc: enc, sync: syncPolicy}
+	if err := w.openSegment(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// log appends a record for the provided WriteRequest. If pushFailed is true, the
+// record marks a failed push rather than a change of metrics.
+func (w *wal) log(wr WriteRequest, pushFailed bool) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.lastSequence++
+	record, err := marshalWALRecord(w.lastSequence, wr, pushFailed)
+	if err != nil {
+		return err
+	}
+	if record, err = w.enc.sealRecord(record); err != nil {
+		return err
+	}
+	if _, err := w.segment.Write(protowire.AppendBytes(nil, record)); err != nil {
+		// The segment might end in a partial record now. Continue
+		// in a new segment so that later records can be replayed. If
+		// that fails, too, later writes will report it.
+		w.cutLocked()
+		return err
+	}
+	if w.sync == SyncAlways {
+		return w.segment.Sync()
+	}
+	return nil
+}
+
+// last returns the sequence number of the last record written.
+func (w *wal) last() uint64 {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.lastSequence
+}
+
+// cut closes the current segment and starts a new one, unless the current
+// segment is still empty.
+func (w *wal) cut() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.cutLocked()
+}
+
+func (w *wal) cutLocked() error {
+	if w.segmentFirst == w.lastSequence+1 {
+		return nil
+	}
+	if w.sync != SyncNever {
+		if err := w.segment.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := w.segment.Close(); err != nil {
+		return err
+	}
+	return w.openSegment()
+}
+
+// truncate removes all segments that only contain records with a sequence
+// number up to and including the provided one. The current segment is never
+// removed.
+func (w *wal) truncate(lastSequence uint64) error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	segments, err := listWALSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for i, first := range segments {
+		if first == w.segmentFirst || i+1 >= len(segments) || segments[i+1] > lastSequence+1 {
+			break
+		}
+		if err := os.Remove(segmentPath(w.dir, first)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reset removes all segments and starts a new one. Sequence numbers keep
+// increasing.
+func (w *wal) reset() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.segment.Close()
+	segments, err := listWALSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, first := range segments {
+		if err := os.Remove(segmentPath(w.dir, first)); err != nil {
+			return err
+		}
+	}
+	return w.openSegment()
+}
+
+// close closes the current segment.
+func (w *wal) close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.segment.Close()
+}
+
+// openSegment opens a new segment starting after lastSequence. A left-over
+// segment of the same name cannot contain any valid records (or lastSequence
+// would be higher), so it is truncated. The caller must hold mtx.
+func (w *wal) openSegment() error {
+	first := w.lastSequence + 1
+	f, err := os.OpenFile(segmentPath(w.dir, first), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	w.segment = f
+	w.segmentFirst = first
+	if w.sync == SyncAlways {
+		// Make sure the segment itself survives a crash.
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+// replayWAL calls apply for each record in the WAL in dir with a sequence number
+// higher than the provided one, in order. A segment ending in a corrupted or
+// partial record, which happens if the Pushgateway crashes while writing, is
+// replayed up to that record. replayWAL returns the highest sequence number
+// found, or the provided one if there is none higher. A missing WAL directory
+// is not an error. Encrypted records are decrypted with enc. Finding one while
+// enc is nil is an error.
+func replayWAL(
+	dir string,
+	after uint64,
+	enc *encryption,
+	logger log.Logger,
+	apply func(wr WriteRequest, pushFailed bool),
+) (uint64, error) {
+	segments, err := listWALSegments(dir)
+	if os.IsNotExist(err) {
+		return after, nil
+	}
+	if err != nil {
+		return after, err
+	}
+	last := after
+	for _, first := range segments {
+		err := replaySegment(segmentPath(dir, first), &last, after, enc, apply)
+		if err == errNoEncryptionKey {
+			return last, err
+		}
+		if err != nil {
+			level.Warn(logger).Log("msg", "write-ahead log segment is corrupted, skipping its remainder", "segment", first, "err", err)
+		}
+	}
+	return last, nil
+}
+
+func replaySegment(
+	name string,
+	last *uint64,
+	after uint64,
+	enc *encryption,
+	apply func(wr WriteRequest, pushFailed bool),
+) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		record, err := readRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record, err = enc.openRecord(record); err != nil {
+			return err
+		}
+		seq, wr, pushFailed, err := unmarshalWALRecord(record)
+		if err != nil {
+			return err
+		}
+		if seq > *last {
+			*last = seq
+		}
+		if seq > after {
+			apply(wr, pushFailed)
+		}
+	}
+}
+
+// listWALSegments returns the sequence numbers of the first records of all
+// segments in dir, in ascending order. Files not named like a segment are
+// ignored.
+func listWALSegments(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, fi := range files {
+		first, err := strconv.ParseUint(fi.Name(), 10, 64)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func segmentPath(dir string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d", first))
+}
+
+func marshalWALRecord(seq uint64, wr WriteRequest, pushFailed bool) ([]byte, error) {
+	typ := walUpdate
+	switch {
+	case wr.Wipe:
+		typ = walWipe
+	case wr.Groups != nil:
+		typ = walRestore
+	case wr.Lock:
+		typ = walLock
+	case wr.Unlock:
+		typ = walUnlock
+	case wr.RenameTo != nil:
+		typ = walRename
+	case pushFailed:
+		typ = walPushFailed
+	case wr.MetricFamilies == nil:
+		typ = walDelete
+	}
+
+	b := protowire.AppendTag(nil, walSequenceField, protowire.VarintType)
+	b = protowire.AppendVarint(b, seq)
+	b = protowire.AppendTag(b, walTypeField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(typ))
+	switch typ {
+	case walWipe:
+		return b, nil
+	case walRestore:
+		// Sort the groups to get a reproducible record.
+		keys := make([]string, 0, len(wr.Groups))
+		for k := range wr.Groups {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			raw, err := marshalGroup(wr.Groups[k])
+			if err != nil {
+				return nil, err
+			}
+			b = protowire.AppendTag(b, walGroupField, protowire.BytesType)
+			b = protowire.AppendBytes(b, raw)
+		}
+		return b, nil
+	}
+	b, err := appendLabels(b, walLabelField, wr.Labels)
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, walTimestampSecondsField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(wr.Timestamp.Unix()))
+	b = protowire.AppendTag(b, walTimestampNanosField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(wr.Timestamp.Nanosecond()))
+
+	switch typ {
+	case walUpdate:
+		for _, mf := range wr.MetricFamilies {
+			raw, err := codec.MarshalMetricFamily(mf)
+			if err != nil {
+				return nil, err
+			}
+			b = protowire.AppendTag(b, walMetricFamilyField, protowire.BytesType)
+			b = protowire.AppendBytes(b, raw)
+		}
+		if wr.Replace {
+			b = protowire.AppendTag(b, walReplaceField, protowire.VarintType)
+			b = protowire.AppendVarint(b, 1)
+		}
+		if wr.TTL > 0 {
+			b = protowire.AppendTag(b, walTTLField, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(wr.TTL))
+		}
+		if wr.Aggregation != AggregateNone {
+			b = protowire.AppendTag(b, walAggregationField, protowire.BytesType)
+			b = protowire.AppendString(b, string(wr.Aggregation))
+		}
+		if wr.PayloadHash != "" {
+			b = protowire.AppendTag(b, walPayloadHashField, protowire.BytesType)
+			b = protowire.AppendString(b, wr.PayloadHash)
+		}
+		if wr.PayloadSize > 0 {
+			b = protowire.AppendTag(b, walPayloadSizeField, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(wr.PayloadSize))
+		}
+		if b, err = appendLabels(b, walAnnotationField, wr.Annotations); err != nil {
+			return nil, err
+		}
+		if wr.ExpectedInterval > 0 {
+			b = protowire.AppendTag(b, walExpectedIntervalField, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(wr.ExpectedInterval))
+		}
+		b = appendPushFormat(b, wr.PushFormat, walContentTypeField, walContentEncodingField, walFormatField)
+		if wr.Sequence > 0 {
+			b = protowire.AppendTag(b, walPushSequenceField, protowire.VarintType)
+			b = protowire.AppendVarint(b, wr.Sequence)
+		}
+	case walDelete:
+		for _, name := range wr.MetricNames {
+			b = protowire.AppendTag(b, walMetricNameField, protowire.BytesType)
+			b = protowire.AppendString(b, name)
+		}
+		if b, err = appendLabels(b, walMetricLabelField, wr.MetricLabels); err != nil {
+			return nil, err
+		}
+	case walRename:
+		if b, err = appendLabels(b, walRenameToField, wr.RenameTo); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func unmarshalWALRecord(b []byte) (uint64, WriteRequest, bool, error) {
+	var (
+		seq         uint64
+		typ         walRecordType
+		secs, nanos int64
+		wr          = WriteRequest{Labels: map[string]string{}}
+		mfs         = map[string]*dto.MetricFamily{}
+		groups      = GroupingKeyToMetricGroup{}
+		renameTo    = map[string]string{}
+	)
+	err := forEachField(b, func(num protowire.Number, pwt protowire.Type, v []byte) error {
+		switch num {
+		case walSequenceField:
+			x, err := varintValue(pwt, v)
+			seq = x
+			return err
+		case walTypeField:
+			x, err := varintValue(pwt, v)
+			typ = walRecordType(x)
+			return err
+		case walLabelField:
+			return addLabel(wr.Labels, pwt, v)
+		case walTimestampSecondsField:
+			x, err := varintValue(pwt, v)
+			secs = int64(x)
+			return err
+		case walTimestampNanosField:
+			x, err := varintValue(pwt, v)
+			nanos = int64(x)
+			return err
+		case walMetricFamilyField:
+			raw, err := bytesValue(pwt, v)
+			if err != nil {
+				return err
+			}
+			mf := &dto.MetricFamily{}
+			if err := codec.UnmarshalMetricFamily(raw, mf); err != nil {
+				return err
+			}
+			mfs[mf.GetName()] = mf
+		case walMetricNameField:
+			raw, err := bytesValue(pwt, v)
+			if err != nil {
+				return err
+			}
+			wr.MetricNames = append(wr.MetricNames, string(raw))
+		case walReplaceField:
+			x, err := varintValue(pwt, v)
+			wr.Replace = x != 0
+			return err
+		case walTTLField:
+			x, err := varintValue(pwt, v)
+			wr.TTL = time.Duration(x)
+			return err
+		case walAggregationField:
+			raw, err := bytesValue(pwt, v)
+			wr.Aggregation = Aggregation(raw)
+			return err
+		case walPayloadHashField:
+			raw, err := bytesValue(pwt, v)
+			wr.PayloadHash = string(raw)
+			return err
+		case walPayloadSizeField:
+			x, err := varintValue(pwt, v)
+			wr.PayloadSize = int(x)
+			return err
+		case walExpectedIntervalField:
+			x, err := varintValue(pwt, v)
+			wr.ExpectedInterval = time.Duration(x)
+			return err
+		case walContentTypeField:
+			raw, err := bytesValue(pwt, v)
+			wr.PushFormat.ContentType = string(raw)
+			return err
+		case walContentEncodingField:
+			raw, err := bytesValue(pwt, v)
+			wr.PushFormat.ContentEncoding = string(raw)
+			return err
+		case walFormatField:
+			raw, err := bytesValue(pwt, v)
+			wr.PushFormat.Format = codec.Format(raw)
+			return err
+		case walPushSequenceField:
+			x, err := varintValue(pwt, v)
+			wr.Sequence = x
+			return err
+		case walGroupField:
+			raw, err := bytesValue(pwt, v)
+			if err != nil {
+				return err
+			}
+			group, err := unmarshalGroup(raw)
+			if err != nil {
+				return err
+			}
+			groups[groupingKeyFor(group.Labels)] = group
+		case walRenameToField:
+			return addLabel(renameTo, pwt, v)
+		case walMetricLabelField:
+			if wr.MetricLabels == nil {
+				wr.MetricLabels = map[string]string{}
+			}
+			return addLabel(wr.MetricLabels, pwt, v)
+		case walAnnotationField:
+			if wr.Annotations == nil {
+				wr.Annotations = map[string]string{}
+			}
+			return addLabel(wr.Annotations, pwt, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, wr, false, err
+	}
+	wr.Timestamp = time.Unix(secs, nanos)
+	switch typ {
+	case walUpdate:
+		wr.MetricFamilies = mfs
+	case walDelete, walPushFailed:
+	case walLock:
+		wr.Lock = true
+	case walUnlock:
+		wr.Unlock = true
+	case walRename:
+		wr.RenameTo = renameTo
+	case walWipe:
+		wr = WriteRequest{Wipe: true}
+	case walRestore:
+		wr = WriteRequest{Timestamp: wr.Timestamp, Groups: groups}
+	default:
+		return 0, wr, false, fmt.Errorf("unknown write-ahead log record type %d", typ)
+	}
+	return seq, wr, typ == walPushFailed, nil
+}
+
+// MarshalWriteRequest encodes the change described by the provided WriteRequest
+// in the record format of the write-ahead log, e.g. to send it to another
+// Pushgateway. Flush requests cannot be encoded. The AllowTimestamps and Done
+// fields are not encoded.
+func MarshalWriteRequest(wr WriteRequest) ([]byte, error) {
+	if wr.Flush {
+		return nil, errors.New("flush requests cannot be marshaled")
+	}
+	return marshalWALRecord(0, wr, false)
+}
+
+// UnmarshalWriteRequest decodes a WriteRequest encoded by MarshalWriteRequest.
+func UnmarshalWriteRequest(b []byte) (WriteRequest, error) {
+	_, wr, pushFailed, err := unmarshalWALRecord(b)
+	if err == nil && pushFailed {
+		err = errors.New("unexpected push failure record")
+	}
+	return wr, err
+}
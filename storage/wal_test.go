@@ -0,0 +1,432 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/testutil"
+)
+
+// crashImage copies the persistence file, the write-ahead log, and the delta
+// files of a running DiskMetricStore into a new directory, mimicking what is
+// left on disk if the Pushgateway crashes at that moment. It returns the name of
+// the copied persistence file.
+func crashImage(t *testing.T, fileName, tempDir string) string {
+	imageDir, err := ioutil.TempDir(tempDir, "crash.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageFile := path.Join(imageDir, path.Base(fileName))
+	if content, err := ioutil.ReadFile(fileName); err == nil {
+		if err := ioutil.WriteFile(imageFile, content, 0666); err != nil {
+			t.Fatal(err)
+		}
+	} else if !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{walDirSuffix, deltaDirSuffix} {
+		segments, err := listWALSegments(fileName + suffix)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Mkdir(imageFile+suffix, 0777); err != nil {
+			t.Fatal(err)
+		}
+		for _, first := range segments {
+			content, err := ioutil.ReadFile(segmentPath(fileName+suffix, first))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(segmentPath(imageFile+suffix, first), content, 0666); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return imageFile
+}
+
+func submit(t *testing.T, dms *DiskMetricStore, wr WriteRequest) {
+	errCh := make(chan error, 1)
+	wr.Done = errCh
+	dms.SubmitWriteRequest(wr)
+	for range errCh {
+		// Errors are expected for failed pushes. The state is checked
+		// by the caller.
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestWALReplay.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger)
+
+	ts1 := time.Now()
+	ts2 := ts1.Add(time.Second)
+	ts3 := ts2.Add(time.Second)
+	grouping1 := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+	grouping2 := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+		TTL:            time.Hour,
+	})
+
+	// Nothing is persisted yet, but everything is in the WAL.
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Fatal("Unexpected persistence file:", err)
+	}
+	dms2 := NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	pushTimestamp1 := newPushTimestampGauge(grouping1, ts1)
+	pushFailedTimestamp1 := newPushFailedTimestampGauge(grouping1, time.Time{})
+	if err := checkMetricFamilies(
+		dms2, mf1a, mf2,
+		pushTimestamp1, pushFailedTimestamp1,
+	); err != nil {
+		t.Error(err)
+	}
+	if expected, got := ts1.Add(time.Hour), dms2.GetMetricFamiliesMap()[groupingKeyFor(grouping1)].Metrics["mf1"].Expiration(); !expected.Equal(got) {
+		t.Errorf("Wanted expiration %v, got %v.", expected, got)
+	}
+	// Replayed changes are not logged again.
+	m := &dto.Metric{}
+	if err := dms2.logErrors.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 0., m.GetCounter().GetValue(); expected != got {
+		t.Errorf("Wanted %f write-ahead log errors, got %f.", expected, got)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After persisting, only later changes are replayed on top of the
+	// snapshot.
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+	})
+	submit(t, dms, WriteRequest{
+		Labels:      grouping1,
+		Timestamp:   ts2,
+		MetricNames: []string{"mf2"},
+	})
+	// A failed push.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts3,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1ts),
+	})
+	segments, err := listWALSegments(fileName + walDirSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, len(segments); expected != got {
+		t.Errorf("Wanted %d WAL segments, got %d.", expected, got)
+	}
+
+	pushTimestamp := newPushTimestampGauge(grouping1, ts1)
+	pushTimestamp.Metric = append(
+		pushTimestamp.Metric, newPushTimestampGauge(grouping2, ts2).Metric[0],
+	)
+	pushFailedTimestamp := newPushFailedTimestampGauge(grouping1, ts3)
+	pushFailedTimestamp.Metric = append(
+		pushFailedTimestamp.Metric, newPushFailedTimestampGauge(grouping2, time.Time{}).Metric[0],
+	)
+	expectedMFs := []*dto.MetricFamily{
+		mf1a, mf3, pushTimestamp, pushFailedTimestamp,
+	}
+	imageFile := crashImage(t, fileName, tempDir)
+	dms2 = NewDiskMetricStore(imageFile, time.Hour, nil, logger)
+	if err := checkMetricFamilies(dms2, expectedMFs...); err != nil {
+		t.Error(err)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	// Replaying has compacted the WAL.
+	f, err := os.Open(imageFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, lastSequence, _, _, err := readSnapshot(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := uint64(4), lastSequence; expected != got {
+		t.Errorf("Wanted last sequence %d, got %d.", expected, got)
+	}
+
+	// A partially written record at the end of the WAL is ignored.
+	imageFile = crashImage(t, fileName, tempDir)
+	f, err = os.OpenFile(segmentPath(imageFile+walDirSuffix, segments[0]), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(protowire.AppendVarint([]byte{}, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString("too short"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	dms2 = NewDiskMetricStore(imageFile, time.Hour, nil, logger)
+	if err := checkMetricFamilies(dms2, expectedMFs...); err != nil {
+		t.Error(err)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A wipe leaves nothing to replay.
+	submit(t, dms, WriteRequest{
+		Timestamp: ts3,
+		Wipe:      true,
+	})
+	dms2 = NewDiskMetricStore(crashImage(t, fileName, tempDir), time.Hour, nil, logger)
+	if err := checkMetricFamilies(dms2); err != nil {
+		t.Error(err)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncrementalPersistence(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "diskmetricstore.TestIncrementalPersistence.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fileName := path.Join(tempDir, "persistence")
+	newStore := func(fileName string) *DiskMetricStore {
+		return NewPersistentMetricStore(
+			NewIncrementalFilePersister(fileName, "", time.Hour, SyncInterval, CompressionNone, logger),
+			time.Hour, Limits{}, WriteQueueOptions{}, nil, logger,
+		)
+	}
+	listDeltas := func() []uint64 {
+		deltas, err := listWALSegments(fileName + deltaDirSuffix)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return deltas
+	}
+	dms := newStore(fileName)
+
+	ts1 := time.Now()
+	ts2 := ts1.Add(time.Second)
+	grouping1 := map[string]string{
+		"job":      "job1",
+		"instance": "instance2",
+	}
+	grouping2 := map[string]string{
+		"job":      "job1",
+		"instance": "instance1",
+	}
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1a, mf2),
+	})
+	submit(t, dms, WriteRequest{
+		Labels:         grouping2,
+		Timestamp:      ts1,
+		MetricFamilies: testutil.MetricFamiliesMap(mf3),
+	})
+
+	// Without a persistence file, a snapshot is written first.
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 0, len(listDeltas()); expected != got {
+		t.Errorf("Wanted %d delta files, got %d.", expected, got)
+	}
+
+	// Afterwards, only the changed groups are written to a delta file.
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf1b),
+	})
+	submit(t, dms, WriteRequest{
+		Labels:    grouping2,
+		Timestamp: ts2,
+	})
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing changed, so no delta file is written.
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(fileName); err != nil || string(content) != string(snapshot) {
+		t.Errorf("Persistence file changed by writing a delta file, error %v.", err)
+	}
+	deltas := listDeltas()
+	if len(deltas) != 1 || deltas[0] != 4 {
+		t.Fatalf("Wanted one delta file for sequence number 4, got %v.", deltas)
+	}
+	f, err := os.Open(segmentPath(fileName+deltaDirSuffix, deltas[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, _, _, _, err := readSnapshot(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 2, len(delta); expected != got {
+		t.Errorf("Wanted %d groups in delta file, got %d.", expected, got)
+	}
+	if !isTombstone(delta[groupingKeyFor(grouping2)]) {
+		t.Error("Deleted group not recorded as tombstone.")
+	}
+	segments, err := listWALSegments(fileName + walDirSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 1, len(segments); expected != got {
+		t.Errorf("Wanted %d WAL segments, got %d.", expected, got)
+	}
+
+	// Restoring applies the delta file to the snapshot.
+	expectedMFs := []*dto.MetricFamily{
+		mf1b, mf2,
+		newPushTimestampGauge(grouping1, ts2),
+		newPushFailedTimestampGauge(grouping1, time.Time{}),
+	}
+	dms2 := newStore(crashImage(t, fileName, tempDir))
+	if err := checkMetricFamilies(dms2, expectedMFs...); err != nil {
+		t.Error(err)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the compaction interval has passed, a snapshot is written, and
+	// the delta files are removed.
+	dms.persister.(*filePersister).lastSnapshot = ts1.Add(-time.Hour)
+	submit(t, dms, WriteRequest{
+		Labels:         grouping1,
+		Timestamp:      ts2,
+		MetricFamilies: testutil.MetricFamiliesMap(mf2),
+	})
+	if err := dms.persist(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := 0, len(listDeltas()); expected != got {
+		t.Errorf("Wanted %d delta files, got %d.", expected, got)
+	}
+	dms2 = newStore(crashImage(t, fileName, tempDir))
+	if err := checkMetricFamilies(dms2, expectedMFs...); err != nil {
+		t.Error(err)
+	}
+	if err := dms2.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dms.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	for _, policy := range SyncPolicies {
+		tempDir, err := ioutil.TempDir("", "diskmetricstore.TestSyncPolicies.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tempDir)
+		fileName := path.Join(tempDir, "persistence")
+		newStore := func(fileName string) *DiskMetricStore {
+			return NewPersistentMetricStore(
+				NewIncrementalFilePersister(fileName, "", time.Hour, SyncPolicy(policy), CompressionNone, logger),
+				time.Hour, Limits{}, WriteQueueOptions{}, nil, logger,
+			)
+		}
+		dms := newStore(fileName)
+
+		grouping1 := map[string]string{"job": "job1"}
+		grouping2 := map[string]string{"job": "job2"}
+		grouping3 := map[string]string{"job": "job3"}
+		// Written to the snapshot, a delta file, and only the WAL, respectively.
+		for _, grouping := range []map[string]string{grouping1, grouping2, grouping3} {
+			submit(t, dms, WriteRequest{
+				Labels:         grouping,
+				Timestamp:      time.Now(),
+				MetricFamilies: testutil.MetricFamiliesMap(mf3),
+			})
+			if grouping["job"] == "job3" {
+				break
+			}
+			if err := dms.persist(); err != nil {
+				t.Fatalf("%s: %v", policy, err)
+			}
+		}
+		deltas, err := listWALSegments(fileName + deltaDirSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, got := 1, len(deltas); expected != got {
+			t.Errorf("%s: Wanted %d delta files, got %d.", policy, expected, got)
+		}
+
+		dms2 := newStore(crashImage(t, fileName, tempDir))
+		if expected, got := 3, len(dms2.GetMetricFamiliesMap()); expected != got {
+			t.Errorf("%s: Wanted %d groups, got %d.", policy, expected, got)
+		}
+		if err := dms2.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+		if err := dms.Shutdown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -13,10 +13,9 @@
 package testutil
 
 import (
-	//lint:ignore SA1019 Dependencies use the deprecated package, so we have to, too.
-	"github.com/golang/protobuf/proto"
-
 	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/pushgateway/internal/codec"
 )
 
 // MetricFamiliesMap creates the map needed in the MetricFamilies field of a
@@ -27,12 +26,12 @@ import (
 func MetricFamiliesMap(mfs ...*dto.MetricFamily) map[string]*dto.MetricFamily {
 	m := map[string]*dto.MetricFamily{}
 	for _, mf := range mfs {
-		buf, err := proto.Marshal(mf)
+		buf, err := codec.MarshalMetricFamily(mf)
 		if err != nil {
 			panic(err)
 		}
 		mfCopy := &dto.MetricFamily{}
-		if err := proto.Unmarshal(buf, mfCopy); err != nil {
+		if err := codec.UnmarshalMetricFamily(buf, mfCopy); err != nil {
 			panic(err)
 		}
 		m[mf.GetName()] = mfCopy
@@ -0,0 +1,157 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// certCheckInterval is the interval at which the certificate and key files are
+// checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader provides the certificate loaded from a certificate and a key
+// file and reloads it if asked to or if the files have changed.
+type certReloader struct {
+	certFile, keyFile string
+	logger            log.Logger
+
+	mtx             sync.RWMutex
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+}
+
+// newCertReloader returns a certReloader with the certificate already loaded.
+func newCertReloader(certFile, keyFile string, logger log.Logger) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// getCertificate is meant to be used as tls.Config.GetCertificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mtx.RLock()
+	defer cr.mtx.RUnlock()
+	return cr.cert, nil
+}
+
+// reload loads the certificate and key files. If that fails, the previously
+// loaded certificate is kept.
+func (cr *certReloader) reload() error {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %v", err)
+	}
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+	cr.cert = &cert
+	cr.certMod, cr.keyMod = certMod, keyMod
+	return nil
+}
+
+// reloadIfChanged calls reload if the modification time of the certificate or
+// the key file has changed since the last successful reload. It returns true if
+// it has reloaded the certificate.
+func (cr *certReloader) reloadIfChanged() (bool, error) {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return false, err
+	}
+	cr.mtx.RLock()
+	changed := !certMod.Equal(cr.certMod) || !keyMod.Equal(cr.keyMod)
+	cr.mtx.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	return true, cr.reload()
+}
+
+func (cr *certReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	fi, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	certMod = fi.ModTime()
+	if fi, err = os.Stat(cr.keyFile); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certMod, fi.ModTime(), nil
+}
+
+// watch reloads the certificate whenever something is received from hupCh and
+// whenever a change of the files is detected, checking every interval. It never
+// returns.
+func (cr *certReloader) watch(interval time.Duration, hupCh <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hupCh:
+			if err := cr.reload(); err != nil {
+				level.Error(cr.logger).Log("msg", "could not reload TLS certificate upon SIGHUP", "err", err)
+				continue
+			}
+			level.Info(cr.logger).Log("msg", "reloaded TLS certificate upon SIGHUP")
+		case <-ticker.C:
+			reloaded, err := cr.reloadIfChanged()
+			if err != nil {
+				level.Error(cr.logger).Log("msg", "could not reload changed TLS certificate", "err", err)
+				continue
+			}
+			if reloaded {
+				level.Info(cr.logger).Log("msg", "reloaded changed TLS certificate")
+			}
+		}
+	}
+}
+
+// newTLSConfig returns a tls.Config serving the certificate from cr. If
+// clientCAFile is not empty, clients have to present a certificate signed by
+// one of the CAs in that file.
+func newTLSConfig(cr *certReloader, clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}
+	if clientCAFile == "" {
+		return cfg, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates found in client CA file %q", clientCAFile)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// writeCert writes a new self-signed certificate for the provided common name
+// and its key to certFile and keyFile, setting their modification time to mod.
+func writeCert(t *testing.T, certFile, keyFile, commonName string, mod time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func commonName(t *testing.T, cr *certReloader) string {
+	cert, err := cr.getCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestCertReloader.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	certFile := path.Join(tempDir, "cert.pem")
+	keyFile := path.Join(tempDir, "key.pem")
+	mod := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	if _, err := newCertReloader(certFile, keyFile, log.NewNopLogger()); err == nil {
+		t.Error("Expected error for missing certificate.")
+	}
+
+	writeCert(t, certFile, keyFile, "first", mod)
+	cr, err := newCertReloader(certFile, keyFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := "first", commonName(t, cr); expected != got {
+		t.Errorf("Wanted certificate for %q, got %q.", expected, got)
+	}
+
+	reloaded, err := cr.reloadIfChanged()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded {
+		t.Error("Unexpected reload of unchanged files.")
+	}
+
+	writeCert(t, certFile, keyFile, "second", mod.Add(time.Second))
+	if reloaded, err = cr.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Error("Expected reload of changed files.")
+	}
+	if expected, got := "second", commonName(t, cr); expected != got {
+		t.Errorf("Wanted certificate for %q, got %q.", expected, got)
+	}
+
+	// A broken certificate keeps the previous one in place.
+	if err := ioutil.WriteFile(certFile, []byte("broken"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.reload(); err == nil {
+		t.Error("Expected error for broken certificate.")
+	}
+	if expected, got := "second", commonName(t, cr); expected != got {
+		t.Errorf("Wanted certificate for %q, got %q.", expected, got)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "pushgateway.TestNewTLSConfig.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	certFile := path.Join(tempDir, "cert.pem")
+	keyFile := path.Join(tempDir, "key.pem")
+	writeCert(t, certFile, keyFile, "server", time.Now())
+	cr, err := newCertReloader(certFile, keyFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := newTLSConfig(cr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := tls.NoClientCert, cfg.ClientAuth; expected != got {
+		t.Errorf("Wanted client auth %v, got %v.", expected, got)
+	}
+
+	// The self-signed certificate doubles as client CA.
+	if cfg, err = newTLSConfig(cr, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := tls.RequireAndVerifyClientCert, cfg.ClientAuth; expected != got {
+		t.Errorf("Wanted client auth %v, got %v.", expected, got)
+	}
+
+	if _, err := newTLSConfig(cr, keyFile); err == nil {
+		t.Error("Expected error for client CA file without certificates.")
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	queueCapacity   = 2048
+	maxBatchSize    = 512
+	flushInterval   = 5 * time.Second
+	requestTimeout  = 10 * time.Second
+	shutdownTimeout = 5 * time.Second
+	scopeName       = "github.com/prometheus/pushgateway"
+)
+
+var (
+	exportedDesc = prometheus.NewDesc(
+		"pushgateway_tracing_spans_exported_total",
+		"Total number of spans successfully exported to the OTLP endpoint.",
+		nil, nil,
+	)
+	droppedDesc = prometheus.NewDesc(
+		"pushgateway_tracing_spans_dropped_total",
+		"Total number of spans that could not be exported to the OTLP endpoint.",
+		nil, nil,
+	)
+)
+
+// Exporter sends ended Spans in batches to an OTLP/HTTP endpoint, using the
+// JSON encoding of OTLP. Spans are exported asynchronously and on a best-effort
+// basis: If the queue is full or a batch cannot be sent, the Spans are dropped.
+//
+// An Exporter implements prometheus.Collector to expose metrics about the
+// exporting. It is up to the caller to register it.
+type Exporter struct {
+	url      string
+	resource []otlpAttribute
+	client   *http.Client
+	queue    chan *Span
+	done     chan struct{}
+	logger   log.Logger
+
+	mtx               sync.Mutex
+	exported, dropped int
+}
+
+// NewExporter returns an Exporter sending to the provided URL of an OTLP/HTTP
+// traces endpoint, usually ending in "/v1/traces". The spans are attributed to
+// a service with the provided name and version.
+func NewExporter(endpointURL, serviceName, serviceVersion string, logger log.Logger) (*Exporter, error) {
+	u, err := url.Parse(endpointURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %v", endpointURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("OTLP endpoint %q has to start with http:// or https://", endpointURL)
+	}
+	e := &Exporter{
+		url: u.String(),
+		resource: []otlpAttribute{
+			stringAttribute("service.name", serviceName),
+			stringAttribute("service.version", serviceVersion),
+		},
+		client: &http.Client{Timeout: requestTimeout},
+		queue:  make(chan *Span, queueCapacity),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	go e.loop(e.queue)
+	return e, nil
+}
+
+// Shutdown exports the queued Spans, waiting a bit for them to be sent. Spans
+// ended after Shutdown are dropped silently, so SetTracer(nil) should be called
+// before.
+func (e *Exporter) Shutdown() {
+	e.mtx.Lock()
+	queue := e.queue
+	e.queue = nil
+	e.mtx.Unlock()
+	close(queue)
+	select {
+	case <-e.done:
+	case <-time.After(shutdownTimeout):
+		level.Warn(e.logger).Log("msg", "not all spans exported before shutdown")
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- exportedDesc
+	ch <- droppedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.mtx.Lock()
+	exported, dropped := e.exported, e.dropped
+	e.mtx.Unlock()
+	ch <- prometheus.MustNewConstMetric(exportedDesc, prometheus.CounterValue, float64(exported))
+	ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(dropped))
+}
+
+func (e *Exporter) export(s *Span) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if e.queue == nil {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+		e.dropped++
+	}
+}
+
+func (e *Exporter) loop(queue <-chan *Span) {
+	defer close(e.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s, ok := <-queue:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) >= maxBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send exports the provided batch of Spans, counting them as dropped if that
+// fails.
+func (e *Exporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	err := e.post(batch)
+	e.mtx.Lock()
+	if err != nil {
+		e.dropped += len(batch)
+	} else {
+		e.exported += len(batch)
+	}
+	e.mtx.Unlock()
+	if err != nil {
+		level.Warn(e.logger).Log("msg", "dropping spans for OTLP endpoint", "spans", len(batch), "err", err)
+	}
+}
+
+func (e *Exporter) post(batch []*Span) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, toOTLPSpan(s))
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: e.resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Pushgateway")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(respBody))
+}
+
+// The following types mirror the messages of the OTLP trace service in their
+// JSON encoding, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/docs/specification.md#json-protobuf-encoding.
+// IDs are hex-encoded, 64-bit integers are encoded as strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+// The status codes of OTLP.
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func toOTLPSpan(s *Span) otlpSpan {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.sc.TraceID[:]),
+		SpanID:            hex.EncodeToString(s.sc.SpanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		Status:            otlpStatus{Code: statusUnset},
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.errorStatus != "" {
+		span.Status = otlpStatus{Code: statusError, Message: s.errorStatus}
+	}
+	for key, value := range s.attributes {
+		var v otlpValue
+		switch value := value.(type) {
+		case string:
+			v.StringValue = &value
+		case bool:
+			v.BoolValue = &value
+		case int:
+			i := strconv.Itoa(value)
+			v.IntValue = &i
+		case int64:
+			i := strconv.FormatInt(value, 10)
+			v.IntValue = &i
+		case float64:
+			v.DoubleValue = &value
+		default:
+			str := fmt.Sprint(value)
+			v.StringValue = &str
+		}
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: key, Value: v})
+	}
+	return span
+}
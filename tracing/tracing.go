@@ -0,0 +1,262 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records spans of the operations of the Pushgateway and
+// exports them to an OpenTelemetry collector via OTLP/HTTP. The trace context is
+// propagated with W3C traceparent headers, so that the spans of pushes end up
+// in the traces of the pushing clients.
+//
+// Spans are recorded by a process-wide Tracer set with SetTracer, like the
+// global TracerProvider of the OpenTelemetry SDK, so that the packages creating
+// spans need no further wiring. Without a Tracer, creating spans is a no-op.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the HTTP header propagating the trace context, see
+// https://www.w3.org/TR/trace-context/.
+const TraceparentHeader = "traceparent"
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid returns true if neither the trace ID nor the span ID are all zeros.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent returns the SpanContext formatted as a traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", sc.TraceID[:], sc.SpanID[:], flags)
+}
+
+// ParseTraceparent parses a traceparent header value. Versions other than 00
+// are parsed as far as they are compatible with version 00, as the
+// specification demands.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid trace ID in traceparent %q", s)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid span ID in traceparent %q", s)
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, fmt.Errorf("invalid flags in traceparent %q", s)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// SpanKind is the kind of a span as defined by OpenTelemetry.
+type SpanKind int
+
+// The SpanKinds used by the Pushgateway.
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+)
+
+// Span is an operation within a trace. A nil *Span is valid and records
+// nothing, which is what Start returns for unsampled traces.
+type Span struct {
+	tracer      *Tracer
+	name        string
+	kind        SpanKind
+	sc          SpanContext
+	parentID    [8]byte
+	start, end  time.Time
+	attributes  map[string]interface{}
+	errorStatus string
+
+	mtx   sync.Mutex
+	ended bool
+}
+
+// SpanContext returns the SpanContext of the Span, or an invalid one for a nil
+// Span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute sets an attribute of the Span. The value has to be a string, a
+// bool, an int, an int64, or a float64.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.attributes[key] = value
+	s.mtx.Unlock()
+}
+
+// SetError marks the Span as failed with the provided error. A nil error is
+// ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mtx.Lock()
+	s.errorStatus = err.Error()
+	s.mtx.Unlock()
+}
+
+// End ends the Span and hands it to the Exporter. Calling End more than once
+// has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	if s.ended {
+		s.mtx.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mtx.Unlock()
+	s.tracer.exporter.export(s)
+}
+
+// Tracer creates Spans and hands them to its exporter once they have ended.
+type Tracer struct {
+	exporter *Exporter
+	// ratio is the fraction of new traces to sample, see Start.
+	ratio float64
+}
+
+// NewTracer returns a Tracer exporting to the provided Exporter. Of the traces
+// started by the Pushgateway, i.e. of the spans without a (valid) parent span,
+// the provided fraction is sampled. Spans with a parent span are sampled if
+// their parent has been sampled.
+func NewTracer(e *Exporter, samplingRatio float64) *Tracer {
+	return &Tracer{exporter: e, ratio: samplingRatio}
+}
+
+var (
+	tracerMtx sync.RWMutex
+	tracer    *Tracer
+)
+
+// SetTracer sets the process-wide Tracer used by Start. A nil Tracer disables
+// tracing.
+func SetTracer(t *Tracer) {
+	tracerMtx.Lock()
+	tracer = t
+	tracerMtx.Unlock()
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteKey
+)
+
+// ContextWithRemoteSpanContext returns a copy of ctx with the provided
+// SpanContext of a remote parent span, e.g. parsed from a traceparent header.
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteKey, sc)
+}
+
+// SpanFromContext returns the current Span of ctx, or nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// Start starts a Span with the provided name as a child of the current Span of
+// ctx or, if there is none, of the remote parent span of ctx, if any. It
+// returns a copy of ctx with the new Span as the current Span. The returned
+// Span is nil if there is no Tracer or the trace is not sampled. The caller has
+// to call End on it.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	tracerMtx.RLock()
+	t := tracer
+	tracerMtx.RUnlock()
+	if t == nil {
+		return ctx, nil
+	}
+
+	var parent SpanContext
+	if s := SpanFromContext(ctx); s != nil {
+		parent = s.sc
+	} else if sc, ok := ctx.Value(remoteKey).(SpanContext); ok {
+		parent = sc
+	}
+	s := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: map[string]interface{}{},
+	}
+	if parent.IsValid() {
+		if !parent.Sampled {
+			return ctx, nil
+		}
+		s.sc.TraceID, s.parentID = parent.TraceID, parent.SpanID
+	} else {
+		if !sample(t.ratio) {
+			return ctx, nil
+		}
+		rand.Read(s.sc.TraceID[:])
+	}
+	rand.Read(s.sc.SpanID[:])
+	s.sc.Sampled = true
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// sample returns true with the provided probability.
+func sample(ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	const precision = 1 << 30
+	n, err := rand.Int(rand.Reader, big.NewInt(precision))
+	return err == nil && float64(n.Int64()) < ratio*precision
+}
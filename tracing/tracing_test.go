@@ -0,0 +1,135 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const valid = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled || !sc.IsValid() {
+		t.Errorf("Unexpected span context %+v.", sc)
+	}
+	if expected, got := valid, sc.Traceparent(); expected != got {
+		t.Errorf("Wanted traceparent %q, got %q.", expected, got)
+	}
+	if sc, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future"); err != nil || sc.Sampled {
+		t.Errorf("Wanted unsampled span context of future version, got %+v, error %v.", sc, err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+	} {
+		if _, err := ParseTraceparent(invalid); err == nil {
+			t.Errorf("Wanted error for traceparent %q.", invalid)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	var (
+		mtx   sync.Mutex
+		spans []otlpSpan
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	// Without a Tracer, nothing is recorded.
+	if _, span := Start(context.Background(), "untraced", SpanKindInternal); span != nil {
+		t.Error("Wanted no span without a Tracer.")
+	}
+
+	e, err := NewExporter(ts.URL+"/v1/traces", "pushgateway", "test", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTracer(NewTracer(e, 0))
+	defer SetTracer(nil)
+
+	if _, span := Start(context.Background(), "unsampled", SpanKindInternal); span != nil {
+		t.Error("Wanted no span for sampling ratio 0.")
+	}
+	unsampled, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if _, span := Start(ContextWithRemoteSpanContext(context.Background(), unsampled), "unsampled", SpanKindServer); span != nil {
+		t.Error("Wanted no span for unsampled parent.")
+	}
+
+	// A sampled remote parent is sampled regardless of the ratio.
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := Start(ContextWithRemoteSpanContext(context.Background(), remote), "push", SpanKindServer)
+	if server == nil {
+		t.Fatal("Wanted span for sampled parent.")
+	}
+	server.SetAttribute("http.status_code", 400)
+	server.SetError(errors.New("bad request"))
+	_, child := Start(ctx, "write", SpanKindInternal)
+	child.End()
+	server.End()
+	server.End()
+	e.Shutdown()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if expected, got := 2, len(spans); expected != got {
+		t.Fatalf("Wanted %d spans, got %d.", expected, got)
+	}
+	write, push := spans[0], spans[1]
+	if write.Name != "write" || push.Name != "push" {
+		t.Fatalf("Unexpected spans %+v.", spans)
+	}
+	if push.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || write.TraceID != push.TraceID {
+		t.Errorf("Unexpected trace IDs %q and %q.", write.TraceID, push.TraceID)
+	}
+	if push.ParentSpanID != "00f067aa0ba902b7" || write.ParentSpanID != push.SpanID {
+		t.Errorf("Unexpected parent span IDs %q and %q.", write.ParentSpanID, push.ParentSpanID)
+	}
+	if push.Kind != SpanKindServer || push.Status.Code != statusError || push.Status.Message != "bad request" {
+		t.Errorf("Unexpected push span %+v.", push)
+	}
+	if len(push.Attributes) != 1 || push.Attributes[0].Value.IntValue == nil || *push.Attributes[0].Value.IntValue != "400" {
+		t.Errorf("Unexpected attributes %+v.", push.Attributes)
+	}
+}
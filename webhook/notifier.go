@@ -0,0 +1,260 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook notifies webhooks about metric groups removed from the
+// Pushgateway.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+const (
+	queueCapacity   = 1000
+	sendAttempts    = 5
+	maxBackoff      = 30 * time.Second
+	requestTimeout  = 10 * time.Second
+	shutdownTimeout = 5 * time.Second
+)
+
+// minBackoff is the time to wait before the first retry. It is doubled for
+// each further retry, up to maxBackoff. It is a variable for testing.
+var minBackoff = time.Second
+
+var (
+	sentDesc = prometheus.NewDesc(
+		"pushgateway_webhook_notifications_sent_total",
+		"Total number of notifications about removed metric groups successfully sent to a webhook.",
+		[]string{"webhook"}, nil,
+	)
+	droppedDesc = prometheus.NewDesc(
+		"pushgateway_webhook_notifications_dropped_total",
+		"Total number of notifications about removed metric groups that could not be sent to a webhook.",
+		[]string{"webhook"}, nil,
+	)
+)
+
+// Notification is the JSON body POSTed to the webhooks for every removed metric
+// group.
+type Notification struct {
+	Event        string            `json:"event"`            // See storage.GroupRemoval.
+	Reason       string            `json:"reason,omitempty"` // See storage.GroupRemoval.
+	Tenant       string            `json:"tenant,omitempty"`
+	Group        map[string]string `json:"group"`
+	LastPushTime *time.Time        `json:"last_push_time"` // nil if unknown.
+	Time         time.Time         `json:"time"`
+}
+
+// Notifier sends a Notification to a number of webhooks for every removed
+// metric group it is notified about. Its Notify method is meant to be used as
+// the removal hook of a storage.DiskMetricStore, see SetRemovalHook.
+//
+// Notifications are sent asynchronously and on a best-effort basis: A
+// notification that cannot be sent to a webhook after a few attempts (with
+// exponential backoff) or that is rejected by the webhook is dropped for that
+// webhook.
+//
+// A Notifier implements prometheus.Collector to expose metrics about the sent
+// notifications. It is up to the caller to register it.
+type Notifier struct {
+	webhooks []*webhook
+}
+
+// NewNotifier returns a Notifier sending to the webhooks with the provided URLs.
+// Credentials for basic auth may be included in the URLs.
+func NewNotifier(webhookURLs []string, logger log.Logger) (*Notifier, error) {
+	n := &Notifier{}
+	client := &http.Client{Timeout: requestTimeout}
+	for _, rawURL := range webhookURLs {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook URL %q: %v", rawURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("webhook URL %q has to start with http:// or https://", rawURL)
+		}
+		name := u.Host + u.Path
+		n.webhooks = append(n.webhooks, &webhook{
+			name:     name,
+			url:      u.String(),
+			client:   client,
+			requests: make(chan []byte, queueCapacity),
+			done:     make(chan struct{}),
+			logger:   log.With(logger, "webhook", name),
+		})
+	}
+	for _, w := range n.webhooks {
+		go w.loop()
+	}
+	return n, nil
+}
+
+// Hook returns a function to be used as the removal hook of the metric store of
+// the provided tenant (empty for the default namespace).
+func (n *Notifier) Hook(tenant string) func(storage.GroupRemoval) {
+	return func(gr storage.GroupRemoval) {
+		n.Notify(tenant, gr)
+	}
+}
+
+// Notify queues a Notification about the provided removed metric group of the
+// provided tenant for all webhooks. It never blocks. If the queue of a webhook
+// is full, the Notification is dropped for that webhook.
+func (n *Notifier) Notify(tenant string, gr storage.GroupRemoval) {
+	notification := Notification{
+		Event:  gr.Event,
+		Reason: gr.Reason,
+		Tenant: tenant,
+		Group:  gr.Labels,
+		Time:   gr.Time,
+	}
+	if !gr.LastPushTime.IsZero() {
+		notification.LastPushTime = &gr.LastPushTime
+	}
+	body, err := json.Marshal(notification)
+	if err != nil {
+		// Cannot happen for the types involved.
+		panic(err)
+	}
+	for _, w := range n.webhooks {
+		w.enqueue(body)
+	}
+}
+
+// Close waits a bit for pending notifications to be sent. Notify must not be
+// called anymore afterwards.
+func (n *Notifier) Close() {
+	for _, w := range n.webhooks {
+		close(w.requests)
+	}
+	timeout := time.After(shutdownTimeout)
+	for _, w := range n.webhooks {
+		select {
+		case <-w.done:
+		case <-timeout:
+			level.Warn(w.logger).Log("msg", "not all notifications sent to webhook before shutdown")
+		}
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (n *Notifier) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sentDesc
+	ch <- droppedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (n *Notifier) Collect(ch chan<- prometheus.Metric) {
+	for _, w := range n.webhooks {
+		w.mtx.Lock()
+		sent, dropped := w.sent, w.dropped
+		w.mtx.Unlock()
+		ch <- prometheus.MustNewConstMetric(sentDesc, prometheus.CounterValue, float64(sent), w.name)
+		ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(dropped), w.name)
+	}
+}
+
+// webhook sends notifications to one webhook.
+type webhook struct {
+	name     string
+	url      string
+	client   *http.Client
+	requests chan []byte
+	done     chan struct{}
+	logger   log.Logger
+
+	mtx           sync.Mutex
+	sent, dropped int
+}
+
+func (w *webhook) enqueue(body []byte) {
+	select {
+	case w.requests <- body:
+	default:
+		w.drop(fmt.Errorf("queue full"))
+	}
+}
+
+func (w *webhook) drop(err error) {
+	w.mtx.Lock()
+	w.dropped++
+	w.mtx.Unlock()
+	level.Warn(w.logger).Log("msg", "dropping notification for webhook", "err", err)
+}
+
+func (w *webhook) loop() {
+	defer close(w.done)
+	for body := range w.requests {
+		var (
+			err       error
+			retryable bool
+			backoff   = minBackoff
+		)
+		for attempt := 0; attempt < sendAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(backoff)
+				if backoff *= 2; backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+			}
+			if retryable, err = w.send(body); err == nil || !retryable {
+				break
+			}
+		}
+		if err != nil {
+			w.drop(err)
+			continue
+		}
+		w.mtx.Lock()
+		w.sent++
+		w.mtx.Unlock()
+	}
+}
+
+// send sends the provided request body to the webhook. If it fails, it returns
+// whether it makes sense to try again, which is the case for server errors and
+// throttling, but not if the webhook has rejected the request.
+func (w *webhook) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Pushgateway")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status %q: %s", resp.Status, bytes.TrimSpace(respBody))
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
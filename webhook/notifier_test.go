@@ -0,0 +1,101 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/prometheus/pushgateway/storage"
+)
+
+func TestNotifier(t *testing.T) {
+	minBackoff = time.Millisecond
+
+	var (
+		mtx           sync.Mutex
+		notifications []Notification
+		failures      = 1
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var n Notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		notifications = append(notifications, n)
+	}))
+	defer srv.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "go away", http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	if _, err := NewNotifier([]string{"ftp://example.org/"}, log.NewNopLogger()); err == nil {
+		t.Error("Expected error for a non-HTTP URL.")
+	}
+	n, err := NewNotifier([]string{srv.URL + "/hook", rejecting.URL}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastPush := time.Unix(1000, 0).UTC()
+	n.Hook("")(storage.GroupRemoval{
+		Event:        storage.RemovalEvicted,
+		Reason:       "max_age",
+		Labels:       map[string]string{"job": "foo"},
+		LastPushTime: lastPush,
+		Time:         time.Unix(2000, 0).UTC(),
+	})
+	n.Hook("team-a")(storage.GroupRemoval{
+		Event:  storage.RemovalDeleted,
+		Labels: map[string]string{"job": "bar", "instance": "baz"},
+		Time:   time.Unix(3000, 0).UTC(),
+	})
+	n.Close()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if expected, got := 2, len(notifications); expected != got {
+		t.Fatalf("Wanted %d notifications, got %d.", expected, got)
+	}
+	first, second := notifications[0], notifications[1]
+	if first.Event != storage.RemovalEvicted || first.Reason != "max_age" || first.Tenant != "" || first.Group["job"] != "foo" {
+		t.Errorf("Unexpected first notification %+v.", first)
+	}
+	if first.LastPushTime == nil || !first.LastPushTime.Equal(lastPush) {
+		t.Errorf("Wanted last push time %v, got %v.", lastPush, first.LastPushTime)
+	}
+	if second.Event != storage.RemovalDeleted || second.Tenant != "team-a" || second.Group["instance"] != "baz" || second.LastPushTime != nil {
+		t.Errorf("Unexpected second notification %+v.", second)
+	}
+
+	for i, expected := range [][2]int{{2, 0}, {0, 2}} {
+		w := n.webhooks[i]
+		if w.sent != expected[0] || w.dropped != expected[1] {
+			t.Errorf("%s: Wanted %d sent and %d dropped, got %d and %d.", w.name, expected[0], expected[1], w.sent, w.dropped)
+		}
+	}
+}